@@ -0,0 +1,578 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package mongoproxyv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// ControlPlaneClient is the client API for ControlPlane service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ControlPlaneClient interface {
+	// ListConnections lists the open client connections (GET /admin/connections)
+	ListConnections(ctx context.Context, in *ListConnectionsRequest, opts ...grpc.CallOption) (*ListConnectionsResponse, error)
+	// ListOps lists the running requests (GET /admin/ops)
+	ListOps(ctx context.Context, in *ListOpsRequest, opts ...grpc.CallOption) (*ListOpsResponse, error)
+	// KillOp cancels a running request (POST /admin/ops/{id}/kill)
+	KillOp(ctx context.Context, in *KillOpRequest, opts ...grpc.CallOption) (*KillOpResponse, error)
+	// KillCursor kills a cursor on the backend and in the proxy (POST /admin/cursors/{id}/kill)
+	KillCursor(ctx context.Context, in *KillCursorRequest, opts ...grpc.CallOption) (*KillCursorResponse, error)
+	// GetReadOnly shows whether read-only mode is enabled (GET /admin/readonly)
+	GetReadOnly(ctx context.Context, in *GetReadOnlyRequest, opts ...grpc.CallOption) (*ReadOnly, error)
+	// SetReadOnly toggles read-only mode (POST /admin/readonly/{on,off})
+	SetReadOnly(ctx context.Context, in *SetReadOnlyRequest, opts ...grpc.CallOption) (*ReadOnly, error)
+	// ListPlugins lists the plugin configs (GET /admin/plugins)
+	ListPlugins(ctx context.Context, in *ListPluginsRequest, opts ...grpc.CallOption) (*ListPluginsResponse, error)
+	// SetPluginEnabled enables or disables a plugin (POST /admin/plugins/{name}/{enable,disable})
+	SetPluginEnabled(ctx context.Context, in *SetPluginEnabledRequest, opts ...grpc.CallOption) (*ListPluginsResponse, error)
+	// SetPluginConfig replaces a plugin's config (PUT /admin/plugins/{name}/config)
+	SetPluginConfig(ctx context.Context, in *SetPluginConfigRequest, opts ...grpc.CallOption) (*ListPluginsResponse, error)
+	// ListChanges lists the config and schema changes, newest first (GET /admin/changes)
+	ListChanges(ctx context.Context, in *ListChangesRequest, opts ...grpc.CallOption) (*ListChangesResponse, error)
+	// StreamEvents streams live events until cancelled (GET /admin/events)
+	StreamEvents(ctx context.Context, in *StreamEventsRequest, opts ...grpc.CallOption) (ControlPlane_StreamEventsClient, error)
+	// StreamTap streams a sample of the requests as they complete until cancelled
+	// or the duration passed (GET /admin/plugins/capture/api/tap)
+	StreamTap(ctx context.Context, in *StreamTapRequest, opts ...grpc.CallOption) (ControlPlane_StreamTapClient, error)
+}
+
+type controlPlaneClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewControlPlaneClient(cc grpc.ClientConnInterface) ControlPlaneClient {
+	return &controlPlaneClient{cc}
+}
+
+func (c *controlPlaneClient) ListConnections(ctx context.Context, in *ListConnectionsRequest, opts ...grpc.CallOption) (*ListConnectionsResponse, error) {
+	out := new(ListConnectionsResponse)
+	err := c.cc.Invoke(ctx, "/mongoproxy.v1.ControlPlane/ListConnections", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlPlaneClient) ListOps(ctx context.Context, in *ListOpsRequest, opts ...grpc.CallOption) (*ListOpsResponse, error) {
+	out := new(ListOpsResponse)
+	err := c.cc.Invoke(ctx, "/mongoproxy.v1.ControlPlane/ListOps", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlPlaneClient) KillOp(ctx context.Context, in *KillOpRequest, opts ...grpc.CallOption) (*KillOpResponse, error) {
+	out := new(KillOpResponse)
+	err := c.cc.Invoke(ctx, "/mongoproxy.v1.ControlPlane/KillOp", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlPlaneClient) KillCursor(ctx context.Context, in *KillCursorRequest, opts ...grpc.CallOption) (*KillCursorResponse, error) {
+	out := new(KillCursorResponse)
+	err := c.cc.Invoke(ctx, "/mongoproxy.v1.ControlPlane/KillCursor", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlPlaneClient) GetReadOnly(ctx context.Context, in *GetReadOnlyRequest, opts ...grpc.CallOption) (*ReadOnly, error) {
+	out := new(ReadOnly)
+	err := c.cc.Invoke(ctx, "/mongoproxy.v1.ControlPlane/GetReadOnly", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlPlaneClient) SetReadOnly(ctx context.Context, in *SetReadOnlyRequest, opts ...grpc.CallOption) (*ReadOnly, error) {
+	out := new(ReadOnly)
+	err := c.cc.Invoke(ctx, "/mongoproxy.v1.ControlPlane/SetReadOnly", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlPlaneClient) ListPlugins(ctx context.Context, in *ListPluginsRequest, opts ...grpc.CallOption) (*ListPluginsResponse, error) {
+	out := new(ListPluginsResponse)
+	err := c.cc.Invoke(ctx, "/mongoproxy.v1.ControlPlane/ListPlugins", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlPlaneClient) SetPluginEnabled(ctx context.Context, in *SetPluginEnabledRequest, opts ...grpc.CallOption) (*ListPluginsResponse, error) {
+	out := new(ListPluginsResponse)
+	err := c.cc.Invoke(ctx, "/mongoproxy.v1.ControlPlane/SetPluginEnabled", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlPlaneClient) SetPluginConfig(ctx context.Context, in *SetPluginConfigRequest, opts ...grpc.CallOption) (*ListPluginsResponse, error) {
+	out := new(ListPluginsResponse)
+	err := c.cc.Invoke(ctx, "/mongoproxy.v1.ControlPlane/SetPluginConfig", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlPlaneClient) ListChanges(ctx context.Context, in *ListChangesRequest, opts ...grpc.CallOption) (*ListChangesResponse, error) {
+	out := new(ListChangesResponse)
+	err := c.cc.Invoke(ctx, "/mongoproxy.v1.ControlPlane/ListChanges", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlPlaneClient) StreamEvents(ctx context.Context, in *StreamEventsRequest, opts ...grpc.CallOption) (ControlPlane_StreamEventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ControlPlane_ServiceDesc.Streams[0], "/mongoproxy.v1.ControlPlane/StreamEvents", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &controlPlaneStreamEventsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ControlPlane_StreamEventsClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type controlPlaneStreamEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *controlPlaneStreamEventsClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *controlPlaneClient) StreamTap(ctx context.Context, in *StreamTapRequest, opts ...grpc.CallOption) (ControlPlane_StreamTapClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ControlPlane_ServiceDesc.Streams[1], "/mongoproxy.v1.ControlPlane/StreamTap", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &controlPlaneStreamTapClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ControlPlane_StreamTapClient interface {
+	Recv() (*TapRecord, error)
+	grpc.ClientStream
+}
+
+type controlPlaneStreamTapClient struct {
+	grpc.ClientStream
+}
+
+func (x *controlPlaneStreamTapClient) Recv() (*TapRecord, error) {
+	m := new(TapRecord)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ControlPlaneServer is the server API for ControlPlane service.
+// All implementations must embed UnimplementedControlPlaneServer
+// for forward compatibility
+type ControlPlaneServer interface {
+	// ListConnections lists the open client connections (GET /admin/connections)
+	ListConnections(context.Context, *ListConnectionsRequest) (*ListConnectionsResponse, error)
+	// ListOps lists the running requests (GET /admin/ops)
+	ListOps(context.Context, *ListOpsRequest) (*ListOpsResponse, error)
+	// KillOp cancels a running request (POST /admin/ops/{id}/kill)
+	KillOp(context.Context, *KillOpRequest) (*KillOpResponse, error)
+	// KillCursor kills a cursor on the backend and in the proxy (POST /admin/cursors/{id}/kill)
+	KillCursor(context.Context, *KillCursorRequest) (*KillCursorResponse, error)
+	// GetReadOnly shows whether read-only mode is enabled (GET /admin/readonly)
+	GetReadOnly(context.Context, *GetReadOnlyRequest) (*ReadOnly, error)
+	// SetReadOnly toggles read-only mode (POST /admin/readonly/{on,off})
+	SetReadOnly(context.Context, *SetReadOnlyRequest) (*ReadOnly, error)
+	// ListPlugins lists the plugin configs (GET /admin/plugins)
+	ListPlugins(context.Context, *ListPluginsRequest) (*ListPluginsResponse, error)
+	// SetPluginEnabled enables or disables a plugin (POST /admin/plugins/{name}/{enable,disable})
+	SetPluginEnabled(context.Context, *SetPluginEnabledRequest) (*ListPluginsResponse, error)
+	// SetPluginConfig replaces a plugin's config (PUT /admin/plugins/{name}/config)
+	SetPluginConfig(context.Context, *SetPluginConfigRequest) (*ListPluginsResponse, error)
+	// ListChanges lists the config and schema changes, newest first (GET /admin/changes)
+	ListChanges(context.Context, *ListChangesRequest) (*ListChangesResponse, error)
+	// StreamEvents streams live events until cancelled (GET /admin/events)
+	StreamEvents(*StreamEventsRequest, ControlPlane_StreamEventsServer) error
+	// StreamTap streams a sample of the requests as they complete until cancelled
+	// or the duration passed (GET /admin/plugins/capture/api/tap)
+	StreamTap(*StreamTapRequest, ControlPlane_StreamTapServer) error
+	mustEmbedUnimplementedControlPlaneServer()
+}
+
+// UnimplementedControlPlaneServer must be embedded to have forward compatible implementations.
+type UnimplementedControlPlaneServer struct {
+}
+
+func (UnimplementedControlPlaneServer) ListConnections(context.Context, *ListConnectionsRequest) (*ListConnectionsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListConnections not implemented")
+}
+func (UnimplementedControlPlaneServer) ListOps(context.Context, *ListOpsRequest) (*ListOpsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListOps not implemented")
+}
+func (UnimplementedControlPlaneServer) KillOp(context.Context, *KillOpRequest) (*KillOpResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method KillOp not implemented")
+}
+func (UnimplementedControlPlaneServer) KillCursor(context.Context, *KillCursorRequest) (*KillCursorResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method KillCursor not implemented")
+}
+func (UnimplementedControlPlaneServer) GetReadOnly(context.Context, *GetReadOnlyRequest) (*ReadOnly, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetReadOnly not implemented")
+}
+func (UnimplementedControlPlaneServer) SetReadOnly(context.Context, *SetReadOnlyRequest) (*ReadOnly, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetReadOnly not implemented")
+}
+func (UnimplementedControlPlaneServer) ListPlugins(context.Context, *ListPluginsRequest) (*ListPluginsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListPlugins not implemented")
+}
+func (UnimplementedControlPlaneServer) SetPluginEnabled(context.Context, *SetPluginEnabledRequest) (*ListPluginsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetPluginEnabled not implemented")
+}
+func (UnimplementedControlPlaneServer) SetPluginConfig(context.Context, *SetPluginConfigRequest) (*ListPluginsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetPluginConfig not implemented")
+}
+func (UnimplementedControlPlaneServer) ListChanges(context.Context, *ListChangesRequest) (*ListChangesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListChanges not implemented")
+}
+func (UnimplementedControlPlaneServer) StreamEvents(*StreamEventsRequest, ControlPlane_StreamEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamEvents not implemented")
+}
+func (UnimplementedControlPlaneServer) StreamTap(*StreamTapRequest, ControlPlane_StreamTapServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamTap not implemented")
+}
+func (UnimplementedControlPlaneServer) mustEmbedUnimplementedControlPlaneServer() {}
+
+// UnsafeControlPlaneServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ControlPlaneServer will
+// result in compilation errors.
+type UnsafeControlPlaneServer interface {
+	mustEmbedUnimplementedControlPlaneServer()
+}
+
+func RegisterControlPlaneServer(s grpc.ServiceRegistrar, srv ControlPlaneServer) {
+	s.RegisterService(&ControlPlane_ServiceDesc, srv)
+}
+
+func _ControlPlane_ListConnections_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListConnectionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlPlaneServer).ListConnections(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mongoproxy.v1.ControlPlane/ListConnections",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlPlaneServer).ListConnections(ctx, req.(*ListConnectionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControlPlane_ListOps_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListOpsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlPlaneServer).ListOps(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mongoproxy.v1.ControlPlane/ListOps",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlPlaneServer).ListOps(ctx, req.(*ListOpsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControlPlane_KillOp_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(KillOpRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlPlaneServer).KillOp(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mongoproxy.v1.ControlPlane/KillOp",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlPlaneServer).KillOp(ctx, req.(*KillOpRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControlPlane_KillCursor_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(KillCursorRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlPlaneServer).KillCursor(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mongoproxy.v1.ControlPlane/KillCursor",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlPlaneServer).KillCursor(ctx, req.(*KillCursorRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControlPlane_GetReadOnly_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetReadOnlyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlPlaneServer).GetReadOnly(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mongoproxy.v1.ControlPlane/GetReadOnly",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlPlaneServer).GetReadOnly(ctx, req.(*GetReadOnlyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControlPlane_SetReadOnly_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetReadOnlyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlPlaneServer).SetReadOnly(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mongoproxy.v1.ControlPlane/SetReadOnly",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlPlaneServer).SetReadOnly(ctx, req.(*SetReadOnlyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControlPlane_ListPlugins_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListPluginsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlPlaneServer).ListPlugins(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mongoproxy.v1.ControlPlane/ListPlugins",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlPlaneServer).ListPlugins(ctx, req.(*ListPluginsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControlPlane_SetPluginEnabled_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetPluginEnabledRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlPlaneServer).SetPluginEnabled(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mongoproxy.v1.ControlPlane/SetPluginEnabled",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlPlaneServer).SetPluginEnabled(ctx, req.(*SetPluginEnabledRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControlPlane_SetPluginConfig_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetPluginConfigRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlPlaneServer).SetPluginConfig(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mongoproxy.v1.ControlPlane/SetPluginConfig",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlPlaneServer).SetPluginConfig(ctx, req.(*SetPluginConfigRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControlPlane_ListChanges_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListChangesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlPlaneServer).ListChanges(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mongoproxy.v1.ControlPlane/ListChanges",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlPlaneServer).ListChanges(ctx, req.(*ListChangesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControlPlane_StreamEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ControlPlaneServer).StreamEvents(m, &controlPlaneStreamEventsServer{stream})
+}
+
+type ControlPlane_StreamEventsServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type controlPlaneStreamEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *controlPlaneStreamEventsServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _ControlPlane_StreamTap_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamTapRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ControlPlaneServer).StreamTap(m, &controlPlaneStreamTapServer{stream})
+}
+
+type ControlPlane_StreamTapServer interface {
+	Send(*TapRecord) error
+	grpc.ServerStream
+}
+
+type controlPlaneStreamTapServer struct {
+	grpc.ServerStream
+}
+
+func (x *controlPlaneStreamTapServer) Send(m *TapRecord) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// ControlPlane_ServiceDesc is the grpc.ServiceDesc for ControlPlane service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ControlPlane_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "mongoproxy.v1.ControlPlane",
+	HandlerType: (*ControlPlaneServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListConnections",
+			Handler:    _ControlPlane_ListConnections_Handler,
+		},
+		{
+			MethodName: "ListOps",
+			Handler:    _ControlPlane_ListOps_Handler,
+		},
+		{
+			MethodName: "KillOp",
+			Handler:    _ControlPlane_KillOp_Handler,
+		},
+		{
+			MethodName: "KillCursor",
+			Handler:    _ControlPlane_KillCursor_Handler,
+		},
+		{
+			MethodName: "GetReadOnly",
+			Handler:    _ControlPlane_GetReadOnly_Handler,
+		},
+		{
+			MethodName: "SetReadOnly",
+			Handler:    _ControlPlane_SetReadOnly_Handler,
+		},
+		{
+			MethodName: "ListPlugins",
+			Handler:    _ControlPlane_ListPlugins_Handler,
+		},
+		{
+			MethodName: "SetPluginEnabled",
+			Handler:    _ControlPlane_SetPluginEnabled_Handler,
+		},
+		{
+			MethodName: "SetPluginConfig",
+			Handler:    _ControlPlane_SetPluginConfig_Handler,
+		},
+		{
+			MethodName: "ListChanges",
+			Handler:    _ControlPlane_ListChanges_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamEvents",
+			Handler:       _ControlPlane_StreamEvents_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "StreamTap",
+			Handler:       _ControlPlane_StreamTap_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "mongoproxy/v1/control.proto",
+}
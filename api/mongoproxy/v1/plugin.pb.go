@@ -0,0 +1,441 @@
+// The API of the external plugin's out-of-process interceptors (see
+// pkg/mongoproxy/plugins/external). Interceptors serve the ExternalPlugin
+// service, and the standard gRPC health service (grpc.health.v1.Health) for
+// the "mongoproxy.v1.ExternalPlugin" service. Commands and responses are BSON
+// documents, as sent by the client and the backend.
+//
+// Regenerate the Go code (from the repository root) with:
+//   protoc -I api --go_out=api --go_opt=paths=source_relative \
+//     --go-grpc_out=api --go-grpc_opt=paths=source_relative mongoproxy/v1/plugin.proto
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.27.1
+// 	protoc        v3.17.3
+// source: mongoproxy/v1/plugin.proto
+
+package mongoproxyv1
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type ProcessRequestRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	CommandName string `protobuf:"bytes,1,opt,name=command_name,json=commandName,proto3" json:"command_name,omitempty"`
+	Database    string `protobuf:"bytes,2,opt,name=database,proto3" json:"database,omitempty"`
+	Collection  string `protobuf:"bytes,3,opt,name=collection,proto3" json:"collection,omitempty"`
+	// command is the command as a BSON document
+	Command []byte `protobuf:"bytes,4,opt,name=command,proto3" json:"command,omitempty"`
+}
+
+func (x *ProcessRequestRequest) Reset() {
+	*x = ProcessRequestRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_mongoproxy_v1_plugin_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ProcessRequestRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProcessRequestRequest) ProtoMessage() {}
+
+func (x *ProcessRequestRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_mongoproxy_v1_plugin_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProcessRequestRequest.ProtoReflect.Descriptor instead.
+func (*ProcessRequestRequest) Descriptor() ([]byte, []int) {
+	return file_mongoproxy_v1_plugin_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ProcessRequestRequest) GetCommandName() string {
+	if x != nil {
+		return x.CommandName
+	}
+	return ""
+}
+
+func (x *ProcessRequestRequest) GetDatabase() string {
+	if x != nil {
+		return x.Database
+	}
+	return ""
+}
+
+func (x *ProcessRequestRequest) GetCollection() string {
+	if x != nil {
+		return x.Collection
+	}
+	return ""
+}
+
+func (x *ProcessRequestRequest) GetCommand() []byte {
+	if x != nil {
+		return x.Command
+	}
+	return nil
+}
+
+type ProcessRequestResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// command (if set) is a BSON document replacing the command sent downstream
+	Command []byte `protobuf:"bytes,1,opt,name=command,proto3" json:"command,omitempty"`
+	// response (if set) is a BSON document returned to the client without running
+	// the rest of the plugin chain (e.g. to reject the request)
+	Response []byte `protobuf:"bytes,2,opt,name=response,proto3" json:"response,omitempty"`
+}
+
+func (x *ProcessRequestResponse) Reset() {
+	*x = ProcessRequestResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_mongoproxy_v1_plugin_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ProcessRequestResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProcessRequestResponse) ProtoMessage() {}
+
+func (x *ProcessRequestResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_mongoproxy_v1_plugin_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProcessRequestResponse.ProtoReflect.Descriptor instead.
+func (*ProcessRequestResponse) Descriptor() ([]byte, []int) {
+	return file_mongoproxy_v1_plugin_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ProcessRequestResponse) GetCommand() []byte {
+	if x != nil {
+		return x.Command
+	}
+	return nil
+}
+
+func (x *ProcessRequestResponse) GetResponse() []byte {
+	if x != nil {
+		return x.Response
+	}
+	return nil
+}
+
+type ProcessResponseRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	CommandName string `protobuf:"bytes,1,opt,name=command_name,json=commandName,proto3" json:"command_name,omitempty"`
+	Database    string `protobuf:"bytes,2,opt,name=database,proto3" json:"database,omitempty"`
+	Collection  string `protobuf:"bytes,3,opt,name=collection,proto3" json:"collection,omitempty"`
+	// response is the response as a BSON document
+	Response []byte `protobuf:"bytes,4,opt,name=response,proto3" json:"response,omitempty"`
+}
+
+func (x *ProcessResponseRequest) Reset() {
+	*x = ProcessResponseRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_mongoproxy_v1_plugin_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ProcessResponseRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProcessResponseRequest) ProtoMessage() {}
+
+func (x *ProcessResponseRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_mongoproxy_v1_plugin_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProcessResponseRequest.ProtoReflect.Descriptor instead.
+func (*ProcessResponseRequest) Descriptor() ([]byte, []int) {
+	return file_mongoproxy_v1_plugin_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ProcessResponseRequest) GetCommandName() string {
+	if x != nil {
+		return x.CommandName
+	}
+	return ""
+}
+
+func (x *ProcessResponseRequest) GetDatabase() string {
+	if x != nil {
+		return x.Database
+	}
+	return ""
+}
+
+func (x *ProcessResponseRequest) GetCollection() string {
+	if x != nil {
+		return x.Collection
+	}
+	return ""
+}
+
+func (x *ProcessResponseRequest) GetResponse() []byte {
+	if x != nil {
+		return x.Response
+	}
+	return nil
+}
+
+type ProcessResponseResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// response (if set) is a BSON document replacing the response returned to the
+	// client
+	Response []byte `protobuf:"bytes,1,opt,name=response,proto3" json:"response,omitempty"`
+}
+
+func (x *ProcessResponseResponse) Reset() {
+	*x = ProcessResponseResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_mongoproxy_v1_plugin_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ProcessResponseResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProcessResponseResponse) ProtoMessage() {}
+
+func (x *ProcessResponseResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_mongoproxy_v1_plugin_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProcessResponseResponse.ProtoReflect.Descriptor instead.
+func (*ProcessResponseResponse) Descriptor() ([]byte, []int) {
+	return file_mongoproxy_v1_plugin_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ProcessResponseResponse) GetResponse() []byte {
+	if x != nil {
+		return x.Response
+	}
+	return nil
+}
+
+var File_mongoproxy_v1_plugin_proto protoreflect.FileDescriptor
+
+var file_mongoproxy_v1_plugin_proto_rawDesc = []byte{
+	0x0a, 0x1a, 0x6d, 0x6f, 0x6e, 0x67, 0x6f, 0x70, 0x72, 0x6f, 0x78, 0x79, 0x2f, 0x76, 0x31, 0x2f,
+	0x70, 0x6c, 0x75, 0x67, 0x69, 0x6e, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x0d, 0x6d, 0x6f,
+	0x6e, 0x67, 0x6f, 0x70, 0x72, 0x6f, 0x78, 0x79, 0x2e, 0x76, 0x31, 0x22, 0x90, 0x01, 0x0a, 0x15,
+	0x50, 0x72, 0x6f, 0x63, 0x65, 0x73, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x52, 0x65,
+	0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x21, 0x0a, 0x0c, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64,
+	0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x63, 0x6f, 0x6d,
+	0x6d, 0x61, 0x6e, 0x64, 0x4e, 0x61, 0x6d, 0x65, 0x12, 0x1a, 0x0a, 0x08, 0x64, 0x61, 0x74, 0x61,
+	0x62, 0x61, 0x73, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x64, 0x61, 0x74, 0x61,
+	0x62, 0x61, 0x73, 0x65, 0x12, 0x1e, 0x0a, 0x0a, 0x63, 0x6f, 0x6c, 0x6c, 0x65, 0x63, 0x74, 0x69,
+	0x6f, 0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x63, 0x6f, 0x6c, 0x6c, 0x65, 0x63,
+	0x74, 0x69, 0x6f, 0x6e, 0x12, 0x18, 0x0a, 0x07, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x18,
+	0x04, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x07, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x22, 0x4e,
+	0x0a, 0x16, 0x50, 0x72, 0x6f, 0x63, 0x65, 0x73, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x18, 0x0a, 0x07, 0x63, 0x6f, 0x6d, 0x6d,
+	0x61, 0x6e, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x07, 0x63, 0x6f, 0x6d, 0x6d, 0x61,
+	0x6e, 0x64, 0x12, 0x1a, 0x0a, 0x08, 0x72, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x0c, 0x52, 0x08, 0x72, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x93,
+	0x01, 0x0a, 0x16, 0x50, 0x72, 0x6f, 0x63, 0x65, 0x73, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e,
+	0x73, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x21, 0x0a, 0x0c, 0x63, 0x6f, 0x6d,
+	0x6d, 0x61, 0x6e, 0x64, 0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x0b, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x4e, 0x61, 0x6d, 0x65, 0x12, 0x1a, 0x0a, 0x08,
+	0x64, 0x61, 0x74, 0x61, 0x62, 0x61, 0x73, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08,
+	0x64, 0x61, 0x74, 0x61, 0x62, 0x61, 0x73, 0x65, 0x12, 0x1e, 0x0a, 0x0a, 0x63, 0x6f, 0x6c, 0x6c,
+	0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x63, 0x6f,
+	0x6c, 0x6c, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x1a, 0x0a, 0x08, 0x72, 0x65, 0x73, 0x70,
+	0x6f, 0x6e, 0x73, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x08, 0x72, 0x65, 0x73, 0x70,
+	0x6f, 0x6e, 0x73, 0x65, 0x22, 0x35, 0x0a, 0x17, 0x50, 0x72, 0x6f, 0x63, 0x65, 0x73, 0x73, 0x52,
+	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12,
+	0x1a, 0x0a, 0x08, 0x72, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x0c, 0x52, 0x08, 0x72, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x32, 0xd1, 0x01, 0x0a, 0x0e,
+	0x45, 0x78, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x50, 0x6c, 0x75, 0x67, 0x69, 0x6e, 0x12, 0x5d,
+	0x0a, 0x0e, 0x50, 0x72, 0x6f, 0x63, 0x65, 0x73, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x12, 0x24, 0x2e, 0x6d, 0x6f, 0x6e, 0x67, 0x6f, 0x70, 0x72, 0x6f, 0x78, 0x79, 0x2e, 0x76, 0x31,
+	0x2e, 0x50, 0x72, 0x6f, 0x63, 0x65, 0x73, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x25, 0x2e, 0x6d, 0x6f, 0x6e, 0x67, 0x6f, 0x70, 0x72,
+	0x6f, 0x78, 0x79, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x72, 0x6f, 0x63, 0x65, 0x73, 0x73, 0x52, 0x65,
+	0x71, 0x75, 0x65, 0x73, 0x74, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x60, 0x0a,
+	0x0f, 0x50, 0x72, 0x6f, 0x63, 0x65, 0x73, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65,
+	0x12, 0x25, 0x2e, 0x6d, 0x6f, 0x6e, 0x67, 0x6f, 0x70, 0x72, 0x6f, 0x78, 0x79, 0x2e, 0x76, 0x31,
+	0x2e, 0x50, 0x72, 0x6f, 0x63, 0x65, 0x73, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65,
+	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x26, 0x2e, 0x6d, 0x6f, 0x6e, 0x67, 0x6f, 0x70,
+	0x72, 0x6f, 0x78, 0x79, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x72, 0x6f, 0x63, 0x65, 0x73, 0x73, 0x52,
+	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x42,
+	0x3b, 0x5a, 0x39, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x77, 0x69,
+	0x73, 0x68, 0x2f, 0x6d, 0x6f, 0x6e, 0x67, 0x6f, 0x70, 0x72, 0x6f, 0x78, 0x79, 0x2f, 0x61, 0x70,
+	0x69, 0x2f, 0x6d, 0x6f, 0x6e, 0x67, 0x6f, 0x70, 0x72, 0x6f, 0x78, 0x79, 0x2f, 0x76, 0x31, 0x3b,
+	0x6d, 0x6f, 0x6e, 0x67, 0x6f, 0x70, 0x72, 0x6f, 0x78, 0x79, 0x76, 0x31, 0x62, 0x06, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_mongoproxy_v1_plugin_proto_rawDescOnce sync.Once
+	file_mongoproxy_v1_plugin_proto_rawDescData = file_mongoproxy_v1_plugin_proto_rawDesc
+)
+
+func file_mongoproxy_v1_plugin_proto_rawDescGZIP() []byte {
+	file_mongoproxy_v1_plugin_proto_rawDescOnce.Do(func() {
+		file_mongoproxy_v1_plugin_proto_rawDescData = protoimpl.X.CompressGZIP(file_mongoproxy_v1_plugin_proto_rawDescData)
+	})
+	return file_mongoproxy_v1_plugin_proto_rawDescData
+}
+
+var file_mongoproxy_v1_plugin_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_mongoproxy_v1_plugin_proto_goTypes = []interface{}{
+	(*ProcessRequestRequest)(nil),   // 0: mongoproxy.v1.ProcessRequestRequest
+	(*ProcessRequestResponse)(nil),  // 1: mongoproxy.v1.ProcessRequestResponse
+	(*ProcessResponseRequest)(nil),  // 2: mongoproxy.v1.ProcessResponseRequest
+	(*ProcessResponseResponse)(nil), // 3: mongoproxy.v1.ProcessResponseResponse
+}
+var file_mongoproxy_v1_plugin_proto_depIdxs = []int32{
+	0, // 0: mongoproxy.v1.ExternalPlugin.ProcessRequest:input_type -> mongoproxy.v1.ProcessRequestRequest
+	2, // 1: mongoproxy.v1.ExternalPlugin.ProcessResponse:input_type -> mongoproxy.v1.ProcessResponseRequest
+	1, // 2: mongoproxy.v1.ExternalPlugin.ProcessRequest:output_type -> mongoproxy.v1.ProcessRequestResponse
+	3, // 3: mongoproxy.v1.ExternalPlugin.ProcessResponse:output_type -> mongoproxy.v1.ProcessResponseResponse
+	2, // [2:4] is the sub-list for method output_type
+	0, // [0:2] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_mongoproxy_v1_plugin_proto_init() }
+func file_mongoproxy_v1_plugin_proto_init() {
+	if File_mongoproxy_v1_plugin_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_mongoproxy_v1_plugin_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ProcessRequestRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_mongoproxy_v1_plugin_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ProcessRequestResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_mongoproxy_v1_plugin_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ProcessResponseRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_mongoproxy_v1_plugin_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ProcessResponseResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_mongoproxy_v1_plugin_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   4,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_mongoproxy_v1_plugin_proto_goTypes,
+		DependencyIndexes: file_mongoproxy_v1_plugin_proto_depIdxs,
+		MessageInfos:      file_mongoproxy_v1_plugin_proto_msgTypes,
+	}.Build()
+	File_mongoproxy_v1_plugin_proto = out.File
+	file_mongoproxy_v1_plugin_proto_rawDesc = nil
+	file_mongoproxy_v1_plugin_proto_goTypes = nil
+	file_mongoproxy_v1_plugin_proto_depIdxs = nil
+}
@@ -0,0 +1,145 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package mongoproxyv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// ExternalPluginClient is the client API for ExternalPlugin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ExternalPluginClient interface {
+	// ProcessRequest is called for each request before the rest of the plugin
+	// chain. Errors fail the request.
+	ProcessRequest(ctx context.Context, in *ProcessRequestRequest, opts ...grpc.CallOption) (*ProcessRequestResponse, error)
+	// ProcessResponse is called for each response of the rest of the plugin chain
+	// (only if the plugin's responseHook is set). Errors fail the request.
+	ProcessResponse(ctx context.Context, in *ProcessResponseRequest, opts ...grpc.CallOption) (*ProcessResponseResponse, error)
+}
+
+type externalPluginClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewExternalPluginClient(cc grpc.ClientConnInterface) ExternalPluginClient {
+	return &externalPluginClient{cc}
+}
+
+func (c *externalPluginClient) ProcessRequest(ctx context.Context, in *ProcessRequestRequest, opts ...grpc.CallOption) (*ProcessRequestResponse, error) {
+	out := new(ProcessRequestResponse)
+	err := c.cc.Invoke(ctx, "/mongoproxy.v1.ExternalPlugin/ProcessRequest", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *externalPluginClient) ProcessResponse(ctx context.Context, in *ProcessResponseRequest, opts ...grpc.CallOption) (*ProcessResponseResponse, error) {
+	out := new(ProcessResponseResponse)
+	err := c.cc.Invoke(ctx, "/mongoproxy.v1.ExternalPlugin/ProcessResponse", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ExternalPluginServer is the server API for ExternalPlugin service.
+// All implementations must embed UnimplementedExternalPluginServer
+// for forward compatibility
+type ExternalPluginServer interface {
+	// ProcessRequest is called for each request before the rest of the plugin
+	// chain. Errors fail the request.
+	ProcessRequest(context.Context, *ProcessRequestRequest) (*ProcessRequestResponse, error)
+	// ProcessResponse is called for each response of the rest of the plugin chain
+	// (only if the plugin's responseHook is set). Errors fail the request.
+	ProcessResponse(context.Context, *ProcessResponseRequest) (*ProcessResponseResponse, error)
+	mustEmbedUnimplementedExternalPluginServer()
+}
+
+// UnimplementedExternalPluginServer must be embedded to have forward compatible implementations.
+type UnimplementedExternalPluginServer struct {
+}
+
+func (UnimplementedExternalPluginServer) ProcessRequest(context.Context, *ProcessRequestRequest) (*ProcessRequestResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ProcessRequest not implemented")
+}
+func (UnimplementedExternalPluginServer) ProcessResponse(context.Context, *ProcessResponseRequest) (*ProcessResponseResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ProcessResponse not implemented")
+}
+func (UnimplementedExternalPluginServer) mustEmbedUnimplementedExternalPluginServer() {}
+
+// UnsafeExternalPluginServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ExternalPluginServer will
+// result in compilation errors.
+type UnsafeExternalPluginServer interface {
+	mustEmbedUnimplementedExternalPluginServer()
+}
+
+func RegisterExternalPluginServer(s grpc.ServiceRegistrar, srv ExternalPluginServer) {
+	s.RegisterService(&ExternalPlugin_ServiceDesc, srv)
+}
+
+func _ExternalPlugin_ProcessRequest_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProcessRequestRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ExternalPluginServer).ProcessRequest(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mongoproxy.v1.ExternalPlugin/ProcessRequest",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ExternalPluginServer).ProcessRequest(ctx, req.(*ProcessRequestRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ExternalPlugin_ProcessResponse_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProcessResponseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ExternalPluginServer).ProcessResponse(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mongoproxy.v1.ExternalPlugin/ProcessResponse",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ExternalPluginServer).ProcessResponse(ctx, req.(*ProcessResponseRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ExternalPlugin_ServiceDesc is the grpc.ServiceDesc for ExternalPlugin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ExternalPlugin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "mongoproxy.v1.ExternalPlugin",
+	HandlerType: (*ExternalPluginServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ProcessRequest",
+			Handler:    _ExternalPlugin_ProcessRequest_Handler,
+		},
+		{
+			MethodName: "ProcessResponse",
+			Handler:    _ExternalPlugin_ProcessResponse_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "mongoproxy/v1/plugin.proto",
+}
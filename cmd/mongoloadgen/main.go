@@ -0,0 +1,251 @@
+package main
+
+// mongoloadgen is a simple load generator for mongoproxy. It drives the proxy
+// with a configurable mix of commands and reports latency percentiles and
+// throughput per command.
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/time/rate"
+)
+
+var opts struct {
+	URI         string        `long:"uri" description:"mongo URI to drive load against" default:"mongodb://localhost:27016"`
+	Database    string        `long:"database" description:"database to run commands against" default:"loadgen"`
+	Collection  string        `long:"collection" description:"collection to run commands against" default:"loadgen"`
+	Concurrency int           `long:"concurrency" description:"number of concurrent workers" default:"16"`
+	Duration    time.Duration `long:"duration" description:"how long to generate load for" default:"30s"`
+	Rate        float64       `long:"rate" description:"max total ops/s (0 is unlimited, which measures max throughput)" default:"0"`
+	Mix         string        `long:"mix" description:"weighted command mix (find,insert,update,delete,count,aggregate)" default:"find=60,insert=20,update=15,delete=5"`
+	KeySpace    int           `long:"keyspace" description:"number of distinct _id values to use" default:"10000"`
+	LogLevel    string        `long:"log-level" description:"Log level" default:"info"`
+}
+
+// opFunc runs a single operation against the collection
+type opFunc func(ctx context.Context, c *mongo.Collection, r *rand.Rand) error
+
+var ops = map[string]opFunc{
+	"find": func(ctx context.Context, c *mongo.Collection, r *rand.Rand) error {
+		cur, err := c.Find(ctx, bson.D{{"_id", r.Intn(opts.KeySpace)}}, options.Find().SetLimit(10))
+		if err != nil {
+			return err
+		}
+		return cur.Close(ctx)
+	},
+	"insert": func(ctx context.Context, c *mongo.Collection, r *rand.Rand) error {
+		_, err := c.InsertOne(ctx, bson.D{
+			{"k", r.Intn(opts.KeySpace)},
+			{"s", strconv.Itoa(r.Int())},
+			{"t", time.Now()},
+		})
+		return err
+	},
+	"update": func(ctx context.Context, c *mongo.Collection, r *rand.Rand) error {
+		_, err := c.UpdateOne(ctx,
+			bson.D{{"_id", r.Intn(opts.KeySpace)}},
+			bson.D{{"$inc", bson.D{{"n", 1}}}, {"$set", bson.D{{"t", time.Now()}}}},
+			options.Update().SetUpsert(true),
+		)
+		return err
+	},
+	"delete": func(ctx context.Context, c *mongo.Collection, r *rand.Rand) error {
+		_, err := c.DeleteOne(ctx, bson.D{{"k", r.Intn(opts.KeySpace)}})
+		return err
+	},
+	"count": func(ctx context.Context, c *mongo.Collection, r *rand.Rand) error {
+		_, err := c.CountDocuments(ctx, bson.D{{"k", bson.D{{"$lt", r.Intn(opts.KeySpace)}}}})
+		return err
+	},
+	"aggregate": func(ctx context.Context, c *mongo.Collection, r *rand.Rand) error {
+		cur, err := c.Aggregate(ctx, mongo.Pipeline{
+			{{"$match", bson.D{{"k", bson.D{{"$gte", r.Intn(opts.KeySpace)}}}}}},
+			{{"$limit", 10}},
+		})
+		if err != nil {
+			return err
+		}
+		return cur.Close(ctx)
+	},
+}
+
+type weightedOp struct {
+	name   string
+	weight int
+}
+
+// parseMix parses a mix string (e.g. "find=60,insert=40") into a weighted list of ops
+func parseMix(s string) ([]weightedOp, int, error) {
+	var (
+		mix   []weightedOp
+		total int
+	)
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			return nil, 0, fmt.Errorf("invalid mix item %q", item)
+		}
+		if _, ok := ops[parts[0]]; !ok {
+			return nil, 0, fmt.Errorf("unknown op %q", parts[0])
+		}
+		w, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid weight for %s: %v", parts[0], err)
+		}
+		if w <= 0 {
+			continue
+		}
+		mix = append(mix, weightedOp{parts[0], w})
+		total += w
+	}
+	if total == 0 {
+		return nil, 0, fmt.Errorf("empty mix")
+	}
+	return mix, total, nil
+}
+
+// stats records latencies for a single op
+type stats struct {
+	l         sync.Mutex
+	latencies []time.Duration
+	errors    int
+}
+
+func (s *stats) record(d time.Duration, err error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if err != nil {
+		s.errors++
+		return
+	}
+	s.latencies = append(s.latencies, d)
+}
+
+func (s *stats) percentile(p float64) time.Duration {
+	if len(s.latencies) == 0 {
+		return 0
+	}
+	idx := int(float64(len(s.latencies)-1) * p)
+	return s.latencies[idx]
+}
+
+func main() {
+	parser := flags.NewParser(&opts, flags.Default)
+	if _, err := parser.Parse(); err != nil {
+		if _, ok := err.(*flags.Error); ok {
+			os.Exit(1)
+		}
+		logrus.Fatalf("error parsing flags: %v", err)
+	}
+
+	level, err := logrus.ParseLevel(opts.LogLevel)
+	if err != nil {
+		logrus.Fatalf("Unknown log level %s: %v", opts.LogLevel, err)
+	}
+	logrus.SetLevel(level)
+
+	mix, total, err := parseMix(opts.Mix)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(opts.URI).SetMaxPoolSize(uint64(opts.Concurrency)))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+
+	pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	err = client.Ping(pingCtx, nil)
+	cancel()
+	if err != nil {
+		logrus.Fatalf("error pinging %s: %v", opts.URI, err)
+	}
+
+	collection := client.Database(opts.Database).Collection(opts.Collection)
+
+	limiter := rate.NewLimiter(rate.Inf, 1)
+	if opts.Rate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(opts.Rate), opts.Concurrency)
+	}
+
+	allStats := make(map[string]*stats, len(mix))
+	for _, op := range mix {
+		allStats[op.name] = &stats{}
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+
+	logrus.Infof("generating load against %s for %v with %d workers", opts.URI, opts.Duration, opts.Concurrency)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for {
+				if err := limiter.Wait(runCtx); err != nil {
+					return
+				}
+
+				// Pick an op from the mix
+				n := r.Intn(total)
+				var name string
+				for _, op := range mix {
+					if n < op.weight {
+						name = op.name
+						break
+					}
+					n -= op.weight
+				}
+
+				opStart := time.Now()
+				err := ops[name](runCtx, collection, r)
+				if runCtx.Err() != nil {
+					return
+				}
+				if err != nil {
+					logrus.Debugf("error running %s: %v", name, err)
+				}
+				allStats[name].record(time.Since(opStart), err)
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// Report
+	names := make([]string, 0, len(allStats))
+	for name := range allStats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var totalOps, totalErrors int
+	fmt.Printf("%-10s %10s %8s %12s %12s %12s %12s\n", "op", "count", "errors", "p50", "p90", "p99", "max")
+	for _, name := range names {
+		s := allStats[name]
+		sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+		totalOps += len(s.latencies)
+		totalErrors += s.errors
+		fmt.Printf("%-10s %10d %8d %12v %12v %12v %12v\n", name, len(s.latencies), s.errors,
+			s.percentile(0.5), s.percentile(0.9), s.percentile(0.99), s.percentile(1))
+	}
+	fmt.Printf("\ntotal: %d ops (%d errors) in %v; throughput %.1f ops/s\n",
+		totalOps, totalErrors, elapsed.Truncate(time.Millisecond), float64(totalOps)/elapsed.Seconds())
+}
@@ -0,0 +1,258 @@
+package main
+
+// mongoproxyctl is an administrative CLI for mongoproxy; it talks to the admin
+// API served on the proxy's metrics bind address.
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+var opts struct {
+	Addr    string        `long:"addr" env:"MONGOPROXY_ADMIN_ADDR" description:"address of the mongoproxy admin (metrics) interface" default:"http://localhost:8080"`
+	Timeout time.Duration `long:"timeout" description:"timeout for admin requests (not including tail)" default:"1m"`
+}
+
+func main() {
+	parser := flags.NewParser(&opts, flags.Default)
+	parser.AddCommand("connections", "List client connections", "", &connectionsCommand{})
+	parser.AddCommand("ops", "List running requests", "", &opsCommand{})
+	parser.AddCommand("kill-op", "Cancel a running request", "", &killOpCommand{})
+	parser.AddCommand("kill-cursor", "Kill a cursor", "", &killCursorCommand{})
+	parser.AddCommand("reload", "Reload the config file", "", &reloadCommand{})
+	parser.AddCommand("read-only", "Show or toggle read-only mode", "", &readOnlyCommand{})
+	parser.AddCommand("plugins", "List the plugin configs", "", &pluginsCommand{})
+	parser.AddCommand("enable-plugin", "Enable a plugin", "", &togglePluginCommand{action: "enable"})
+	parser.AddCommand("disable-plugin", "Disable a plugin", "", &togglePluginCommand{action: "disable"})
+	parser.AddCommand("schema", "Dump the effective schema of a namespace", "", &schemaCommand{})
+	parser.AddCommand("tail-slowlog", "Stream slow queries", "", &tailSlowlogCommand{})
+
+	if _, err := parser.Parse(); err != nil {
+		if _, ok := err.(*flags.Error); ok {
+			os.Exit(1)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// do makes a request to the admin API returning the body
+func do(method, path string, body io.Reader, timeout time.Duration) (io.ReadCloser, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(opts.Addr, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(b)))
+	}
+	return resp.Body, nil
+}
+
+// doJSON makes a request to the admin API decoding the response into v
+func doJSON(method, path string, body io.Reader, v interface{}) error {
+	rc, err := do(method, path, body, opts.Timeout)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return json.NewDecoder(rc).Decode(v)
+}
+
+// printJSON prints the response of the request indented
+func printJSON(method, path string, body io.Reader) error {
+	var v interface{}
+	if err := doJSON(method, path, body, &v); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+type connectionsCommand struct{}
+
+func (c *connectionsCommand) Execute(args []string) error {
+	var conns []struct {
+		Client       string    `json:"client"`
+		AppName      string    `json:"appName"`
+		Users        []string  `json:"users"`
+		State        string    `json:"state"`
+		LastActivity time.Time `json:"lastActivity"`
+
+		ClientMetadata struct {
+			Driver struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"driver"`
+		} `json:"clientMetadata"`
+	}
+	if err := doJSON(http.MethodGet, "/admin/connections", nil, &conns); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CLIENT\tAPPNAME\tDRIVER\tUSERS\tSTATE\tLAST ACTIVITY")
+	for _, conn := range conns {
+		driver := strings.TrimSpace(conn.ClientMetadata.Driver.Name + " " + conn.ClientMetadata.Driver.Version)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", conn.Client, conn.AppName, driver, strings.Join(conn.Users, ","), conn.State, time.Since(conn.LastActivity).Truncate(time.Second))
+	}
+	return w.Flush()
+}
+
+type opsCommand struct{}
+
+func (c *opsCommand) Execute(args []string) error {
+	var ops []struct {
+		ID          int64     `json:"id"`
+		Client      string    `json:"client"`
+		AppName     string    `json:"appName"`
+		CommandName string    `json:"commandName"`
+		Database    string    `json:"database"`
+		Collection  string    `json:"collection"`
+		Start       time.Time `json:"start"`
+	}
+	if err := doJSON(http.MethodGet, "/admin/ops", nil, &ops); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCLIENT\tAPPNAME\tCOMMAND\tNAMESPACE\tRUNNING")
+	for _, op := range ops {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s.%s\t%s\n", op.ID, op.Client, op.AppName, op.CommandName, op.Database, op.Collection, time.Since(op.Start).Truncate(time.Millisecond))
+	}
+	return w.Flush()
+}
+
+type killOpCommand struct {
+	Args struct {
+		ID int64 `positional-arg-name:"id" required:"true"`
+	} `positional-args:"true"`
+}
+
+func (c *killOpCommand) Execute(args []string) error {
+	return printJSON(http.MethodPost, "/admin/ops/"+strconv.FormatInt(c.Args.ID, 10)+"/kill", nil)
+}
+
+type killCursorCommand struct {
+	Args struct {
+		ID int64 `positional-arg-name:"id" required:"true"`
+	} `positional-args:"true"`
+}
+
+func (c *killCursorCommand) Execute(args []string) error {
+	return printJSON(http.MethodPost, "/admin/cursors/"+strconv.FormatInt(c.Args.ID, 10)+"/kill", nil)
+}
+
+type reloadCommand struct{}
+
+func (c *reloadCommand) Execute(args []string) error {
+	rc, err := do(http.MethodPost, "/admin/reload", nil, opts.Timeout)
+	if err != nil {
+		return err
+	}
+	rc.Close()
+	fmt.Println("reloaded")
+	return nil
+}
+
+type readOnlyCommand struct {
+	Args struct {
+		State string `positional-arg-name:"on|off"`
+	} `positional-args:"true"`
+}
+
+func (c *readOnlyCommand) Execute(args []string) error {
+	switch c.Args.State {
+	case "":
+		return printJSON(http.MethodGet, "/admin/readonly", nil)
+	case "on", "off":
+		return printJSON(http.MethodPost, "/admin/readonly/"+c.Args.State, nil)
+	default:
+		return fmt.Errorf("invalid read-only state %q; must be on or off", c.Args.State)
+	}
+}
+
+type pluginsCommand struct{}
+
+func (c *pluginsCommand) Execute(args []string) error {
+	return printJSON(http.MethodGet, "/admin/plugins", nil)
+}
+
+type togglePluginCommand struct {
+	action string
+	Args   struct {
+		Name string `positional-arg-name:"plugin" required:"true"`
+	} `positional-args:"true"`
+}
+
+func (c *togglePluginCommand) Execute(args []string) error {
+	return printJSON(http.MethodPost, "/admin/plugins/"+url.PathEscape(c.Args.Name)+"/"+c.action, bytes.NewReader(nil))
+}
+
+type schemaCommand struct {
+	Plugin string `long:"plugin" description:"name of the schema plugin" default:"schema"`
+	Args   struct {
+		Namespace string `positional-arg-name:"db.collection" required:"true"`
+	} `positional-args:"true"`
+}
+
+func (c *schemaCommand) Execute(args []string) error {
+	parts := strings.SplitN(c.Args.Namespace, ".", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid namespace %q; must be db.collection", c.Args.Namespace)
+	}
+	q := url.Values{"database": {parts[0]}, "collection": {parts[1]}}
+	return printJSON(http.MethodGet, "/admin/plugins/"+url.PathEscape(c.Plugin)+"/api/schema?"+q.Encode(), nil)
+}
+
+type tailSlowlogCommand struct {
+	Plugin string `long:"plugin" description:"name of the slowlog plugin" default:"slowlog"`
+}
+
+func (c *tailSlowlogCommand) Execute(args []string) error {
+	rc, err := do(http.MethodGet, "/admin/plugins/"+url.PathEscape(c.Plugin)+"/api/tail", nil, 0)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	s := bufio.NewScanner(rc)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for s.Scan() {
+		var e struct {
+			Time        time.Time `json:"time"`
+			Database    string    `json:"database"`
+			Collection  string    `json:"collection"`
+			CommandName string    `json:"commandName"`
+			Took        string    `json:"took"`
+			Request     string    `json:"request"`
+		}
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return err
+		}
+		fmt.Printf("%s %s %s.%s took=%s %s\n", e.Time.Format(time.RFC3339), e.CommandName, e.Database, e.Collection, e.Took, e.Request)
+	}
+	return s.Err()
+}
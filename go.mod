@@ -5,25 +5,36 @@ go 1.13
 require (
 	github.com/HdrHistogram/hdrhistogram-go v1.1.0 // indirect
 	github.com/ReneKroon/ttlcache/v2 v2.3.0
-	github.com/cespare/xxhash/v2 v2.1.1
+	github.com/Shopify/sarama v1.29.1
+	github.com/alicebob/miniredis/v2 v2.14.5
+	github.com/apache/arrow/go/v7 v7.0.0
+	github.com/aws/aws-sdk-go v1.34.28
+	github.com/beorn7/perks v1.0.1
+	github.com/cespare/xxhash/v2 v2.1.2
 	github.com/getsentry/sentry-go v0.9.0
+	github.com/go-redis/redis/v8 v8.11.5
+	github.com/golang/snappy v0.0.4
 	github.com/jessevdk/go-flags v1.4.0
 	github.com/json-iterator/go v1.1.11
 	github.com/miekg/dns v1.1.41 // indirect
 	github.com/opentracing/opentracing-go v1.1.0
 	github.com/prometheus/client_golang v1.8.0
-	github.com/sirupsen/logrus v1.7.0
+	github.com/sirupsen/logrus v1.8.1
 	github.com/stretchr/testify v1.7.0
 	github.com/uber/jaeger-client-go v2.27.0+incompatible
 	github.com/uber/jaeger-lib v2.4.1+incompatible // indirect
 	github.com/wish/discovery v0.0.0-20190510213300-be3745886c68
+	github.com/yuin/gopher-lua v0.0.0-20210529063254-f4c35e4016d9
 	go.mongodb.org/mongo-driver v1.5.1
 	go.uber.org/automaxprocs v1.3.0
-	golang.org/x/net v0.0.0-20210331212208-0fccb6fa2b5c // indirect
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
-	golang.org/x/sys v0.0.0-20210426080607-c94f62235c83 // indirect
+	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e
+	golang.org/x/text v0.3.6
 	golang.org/x/time v0.0.0-20201208040808-7e3f01d25324
+	google.golang.org/grpc v1.41.0
+	google.golang.org/protobuf v1.27.1
 	gopkg.in/fsnotify.v1 v1.4.7
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
 
 replace go.mongodb.org/mongo-driver => github.com/wish/mongo-go-driver v1.5.1-fork
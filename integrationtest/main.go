@@ -16,6 +16,7 @@ import (
 
 	"github.com/wish/mongoproxy/pkg/mongoproxy"
 	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongotest"
 )
 
 var (
@@ -40,7 +41,26 @@ func init() {
 	fmt.Println("addr", mongoAddr)
 }
 
+// SetupMockProxy sets up a proxy in front of an in-process fake backend (instead
+// of a real mongod) for tests which don't need a real mongo.
+func SetupMockProxy(t *testing.T, cfg *config.Config) (*mongotest.Server, *mongoproxy.Proxy, func()) {
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, cleanup := setupProxy(t, cfg, backend.URI())
+	return backend, proxy, func() {
+		cleanup()
+		backend.Close()
+	}
+}
+
 func SetupProxy(t *testing.T, cfg *config.Config) (*mongoproxy.Proxy, func()) {
+	return setupProxy(t, cfg, mongoAddr)
+}
+
+func setupProxy(t *testing.T, cfg *config.Config, mongoAddr string) (*mongoproxy.Proxy, func()) {
 	l, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", proxyPort))
 	if err != nil {
 		t.Fatal(err)
@@ -0,0 +1,220 @@
+// Package bsonarrow converts BSON documents to Arrow records: the columns are
+// the top-level fields of the documents, typed by their values.
+package bsonarrow
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/apache/arrow/go/v7/arrow"
+	"github.com/apache/arrow/go/v7/arrow/array"
+	"github.com/apache/arrow/go/v7/arrow/memory"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// kind is the kind of values of a column
+type kind int
+
+const (
+	kindNull kind = iota
+	kindBool
+	kindInt32
+	kindInt64
+	kindDouble
+	kindString
+	kindObjectID
+	kindDate
+	// kindJSON are the values of other types, or of several types, as relaxed
+	// extended JSON
+	kindJSON
+)
+
+func (k kind) dataType() arrow.DataType {
+	switch k {
+	case kindNull:
+		return arrow.Null
+	case kindBool:
+		return arrow.FixedWidthTypes.Boolean
+	case kindInt32:
+		return arrow.PrimitiveTypes.Int32
+	case kindInt64:
+		return arrow.PrimitiveTypes.Int64
+	case kindDouble:
+		return arrow.PrimitiveTypes.Float64
+	case kindDate:
+		return arrow.FixedWidthTypes.Timestamp_ms
+	default:
+		return arrow.BinaryTypes.String
+	}
+}
+
+// valueKind returns the kind of a BSON value
+func valueKind(v bson.RawValue) kind {
+	switch v.Type {
+	case bsontype.Null, bsontype.Undefined:
+		return kindNull
+	case bsontype.Boolean:
+		return kindBool
+	case bsontype.Int32:
+		return kindInt32
+	case bsontype.Int64:
+		return kindInt64
+	case bsontype.Double:
+		return kindDouble
+	case bsontype.String:
+		return kindString
+	case bsontype.ObjectID:
+		return kindObjectID
+	case bsontype.DateTime:
+		return kindDate
+	default:
+		return kindJSON
+	}
+}
+
+// mergeKinds returns the kind of a column with values of both kinds: integers
+// are widened, and columns of unrelated kinds are JSON
+func mergeKinds(a, b kind) kind {
+	switch {
+	case a == b || b == kindNull:
+		return a
+	case a == kindNull:
+		return b
+	case a > b:
+		a, b = b, a
+	}
+	if a >= kindInt32 && b <= kindDouble {
+		return b
+	}
+	return kindJSON
+}
+
+// Schema is the schema of records of BSON documents
+type Schema struct {
+	names   []string
+	kinds   []kind
+	columns map[string]int
+	schema  *arrow.Schema
+}
+
+// NewSchema returns the schema of the documents: the columns are their top-level
+// fields (in the order they are first seen), typed by their values. Integers
+// are widened, and the values of columns of other types (or of several types)
+// are relaxed extended JSON strings.
+func NewSchema(documents []bson.Raw) (*Schema, error) {
+	s := &Schema{columns: make(map[string]int)}
+	for _, doc := range documents {
+		elems, err := doc.Elements()
+		if err != nil {
+			return nil, err
+		}
+		for _, elem := range elems {
+			i, ok := s.columns[elem.Key()]
+			if !ok {
+				i = len(s.names)
+				s.columns[elem.Key()] = i
+				s.names = append(s.names, elem.Key())
+				s.kinds = append(s.kinds, kindNull)
+			}
+			s.kinds[i] = mergeKinds(s.kinds[i], valueKind(elem.Value()))
+		}
+	}
+
+	fields := make([]arrow.Field, len(s.names))
+	for i, name := range s.names {
+		fields[i] = arrow.Field{Name: name, Type: s.kinds[i].dataType(), Nullable: true}
+	}
+	s.schema = arrow.NewSchema(fields, nil)
+	return s, nil
+}
+
+// Arrow returns the Arrow schema
+func (s *Schema) Arrow() *arrow.Schema { return s.schema }
+
+// Record returns the documents as a record of the schema: missing fields are
+// nulls. It returns an error if a document has a field that isn't in the schema,
+// or a value that doesn't fit the type of its column.
+func (s *Schema) Record(mem memory.Allocator, documents []bson.Raw) (arrow.Record, error) {
+	b := array.NewRecordBuilder(mem, s.schema)
+	defer b.Release()
+	b.Reserve(len(documents))
+	for _, doc := range documents {
+		elems, err := doc.Elements()
+		if err != nil {
+			return nil, err
+		}
+		for _, elem := range elems {
+			i, ok := s.columns[elem.Key()]
+			if !ok {
+				return nil, fmt.Errorf("field %q isn't in the schema", elem.Key())
+			}
+			if k := valueKind(elem.Value()); mergeKinds(s.kinds[i], k) != s.kinds[i] {
+				return nil, fmt.Errorf("%s value of field %q doesn't fit its %s column", elem.Value().Type, elem.Key(), s.kinds[i].dataType())
+			}
+		}
+		for i, name := range s.names {
+			if err := appendValue(b.Field(i), s.kinds[i], doc.Lookup(name)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b.NewRecord(), nil
+}
+
+// appendValue appends the value (of a column of the kind) to the column's builder
+func appendValue(b array.Builder, k kind, v bson.RawValue) error {
+	// Missing fields are nulls
+	if v.Type == 0 || valueKind(v) == kindNull {
+		b.AppendNull()
+		return nil
+	}
+	switch b := b.(type) {
+	case *array.BooleanBuilder:
+		b.Append(v.Boolean())
+	case *array.Int32Builder:
+		b.Append(v.Int32())
+	case *array.Int64Builder:
+		if v.Type == bsontype.Int32 {
+			b.Append(int64(v.Int32()))
+		} else {
+			b.Append(v.Int64())
+		}
+	case *array.Float64Builder:
+		switch v.Type {
+		case bsontype.Int32:
+			b.Append(float64(v.Int32()))
+		case bsontype.Int64:
+			b.Append(float64(v.Int64()))
+		default:
+			b.Append(v.Double())
+		}
+	case *array.TimestampBuilder:
+		b.Append(arrow.Timestamp(v.DateTime()))
+	case *array.StringBuilder:
+		switch k {
+		case kindString:
+			b.Append(v.StringValue())
+		case kindObjectID:
+			b.Append(v.ObjectID().Hex())
+		default:
+			s, err := jsonValue(v)
+			if err != nil {
+				return err
+			}
+			b.Append(s)
+		}
+	}
+	return nil
+}
+
+// jsonValue returns the value as relaxed extended JSON
+func jsonValue(v bson.RawValue) (string, error) {
+	b, err := bson.MarshalExtJSON(bson.D{{"v", v}}, false, false)
+	if err != nil {
+		return "", err
+	}
+	// Strip the wrapping document: {"v":...}
+	b = bytes.TrimPrefix(b, []byte(`{"v":`))
+	return string(b[:len(b)-1]), nil
+}
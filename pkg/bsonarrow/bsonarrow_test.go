@@ -0,0 +1,65 @@
+package bsonarrow
+
+import (
+	"testing"
+
+	"github.com/apache/arrow/go/v7/arrow/array"
+	"github.com/apache/arrow/go/v7/arrow/memory"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func raw(t *testing.T, docs ...bson.D) []bson.Raw {
+	var documents []bson.Raw
+	for _, doc := range docs {
+		b, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		documents = append(documents, b)
+	}
+	return documents
+}
+
+func TestRecord(t *testing.T) {
+	schema, err := NewSchema(raw(t,
+		bson.D{{"n", int32(1)}, {"s", "a"}, {"mixed", "x"}},
+		bson.D{{"n", int64(2)}, {"mixed", 1.5}},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		doc bson.D
+		ok  bool
+	}{
+		{bson.D{{"n", int32(3)}, {"s", "b"}, {"mixed", bson.D{{"a", 1}}}}, true},
+		{bson.D{{"n", nil}}, true},
+		{bson.D{}, true},
+		{bson.D{{"n", 1.5}}, false},
+		{bson.D{{"s", int32(1)}}, false},
+		{bson.D{{"other", "x"}}, false},
+	}
+	mem := memory.NewGoAllocator()
+	for i, test := range tests {
+		rec, err := schema.Record(mem, raw(t, test.doc))
+		if (err == nil) != test.ok {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if err != nil {
+			continue
+		}
+		if rec.NumRows() != 1 || rec.NumCols() != 3 {
+			t.Fatalf("%d: unexpected record %v", i, rec)
+		}
+		if i == 0 {
+			if n := rec.Column(0).(*array.Int64).Value(0); n != 3 {
+				t.Fatalf("expected 3, got %d", n)
+			}
+			if mixed := rec.Column(2).(*array.String).Value(0); mixed != `{"a":1}` {
+				t.Fatalf("unexpected JSON %q", mixed)
+			}
+		}
+		rec.Release()
+	}
+}
@@ -12,23 +12,47 @@ import (
 
 	"github.com/getsentry/sentry-go"
 	"github.com/jessevdk/go-flags"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	_ "go.uber.org/automaxprocs"
+	"google.golang.org/grpc"
 
+	"github.com/wish/mongoproxy/pkg/filewatch"
 	"github.com/wish/mongoproxy/pkg/mongoproxy"
 	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
 )
 
 var opts struct {
-	Config      string        `long:"config" description:"path to config file" required:"true"`
-	LogLevel    string        `long:"log-level" description:"Log level" default:"info"`
-	MetricsBind string        `long:"metrics-bind" description:"address to bind metrics interface to" required:"true"`
-	TermSleep   time.Duration `long:"term-sleep" description:"how long to wait on shutdown after getting a termination signal" default:"5s"`
+	configOpts
+	LogLevel    string        `long:"log-level" env:"MONGOPROXY_LOG_LEVEL" description:"Log level" default:"info"`
+	MetricsBind string        `long:"metrics-bind" env:"MONGOPROXY_METRICS_BIND" description:"address to bind metrics interface to" required:"true"`
+	TermSleep   time.Duration `long:"term-sleep" env:"MONGOPROXY_TERM_SLEEP" description:"how long to wait on shutdown after getting a termination signal" default:"5s"`
 	SentryDSN   string        `long:"sentry-dsn" env:"SENTRY_DSN"`
+	WatchConfig bool          `long:"watch-config" env:"MONGOPROXY_WATCH_CONFIG" description:"reload the config when the config files change (e.g. a mounted ConfigMap is updated)"`
+}
+
+// configOpts are the options for loading the config; see config.Loader for
+// the precedence of the config sources
+type configOpts struct {
+	Config []string `long:"config" env:"MONGOPROXY_CONFIG" env-delim:"," description:"path to config file (extended JSON, or YAML if .yaml/.yml); may be repeated with later files taking precedence" required:"true"`
+	Set    []string `long:"set" description:"override a config key (path=value; e.g. plugins.mongo.config.mongoAddr=mongodb://localhost:27017); may be repeated"`
+}
+
+// load loads the config from the files, environment and flags
+func (o *configOpts) load() (*config.Config, error) {
+	return config.Loader{
+		Files:     o.Config,
+		Env:       os.Environ(),
+		Overrides: o.Set,
+	}.Load()
 }
 
 func Main() {
+	if len(os.Args) > 1 && os.Args[1] == validateConfigCommand {
+		os.Exit(validateConfig(os.Args[2:]))
+	}
+
 	// Wait for reload or termination signals. Start the handler for SIGHUP as
 	// early as possible, but ignore it until we are ready to handle reloading
 	// our config.
@@ -66,7 +90,7 @@ func Main() {
 	}
 
 	// Get config
-	cfg, err := config.ConfigFromFile(opts.Config)
+	cfg, err := opts.load()
 	if err != nil {
 		logrus.Fatal(err)
 	}
@@ -79,9 +103,23 @@ func Main() {
 	logrus.Debugf("Metrics bind started: %v", ml.Addr())
 	mux := http.NewServeMux()
 
-	ready := false
+	var (
+		ready bool
+		proxy *mongoproxy.Proxy
+	)
+
+	// reload re-reads the config and applies the plugin changes
+	reload := func(ctx context.Context) error {
+		newCfg, err := opts.load()
+		if err != nil {
+			return err
+		}
+		return proxy.Reload(ctx, newCfg)
+	}
 	go func() {
-		mux.Handle("/metrics", promhttp.Handler())
+		// OpenMetrics is negotiated so that exemplars (e.g. of the request phases) are exposed
+		mux.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+			promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
 
 		mux.HandleFunc("/debug/pprof/", pprof.Index)
 		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
@@ -97,6 +135,43 @@ func Main() {
 				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			}
 		})
+		// readiness check; this includes the health of all plugins
+		mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+			if !ready || proxy == nil {
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+			defer cancel()
+			if err := proxy.Health(ctx); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			}
+		})
+		mux.HandleFunc("/admin/reload", func(w http.ResponseWriter, r *http.Request) {
+			if !ready || proxy == nil {
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+			if r.Method != http.MethodPost {
+				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				return
+			}
+			user := r.RemoteAddr
+			if u, _, ok := r.BasicAuth(); ok {
+				user = u
+			}
+			if err := reload(mongoproxy.WithChangeAuthor(r.Context(), "reload", user)); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+		})
+		// admin API (only available once the proxy has started)
+		mux.HandleFunc("/admin/", func(w http.ResponseWriter, r *http.Request) {
+			if !ready || proxy == nil {
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+			proxy.AdminHandler().ServeHTTP(w, r)
+		})
 		http.Serve(ml, mux)
 	}()
 
@@ -106,11 +181,43 @@ func Main() {
 		logrus.Fatal(err)
 	}
 
-	proxy, err := mongoproxy.NewProxy(l, cfg)
+	proxy, err = mongoproxy.NewProxy(l, cfg)
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
+	// Serve the data API (if configured)
+	var dataAPI *http.Server
+	if cfg.DataAPI != nil {
+		dl, err := net.Listen("tcp", cfg.DataAPI.BindAddr)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Debugf("Data API bind started: %v", dl.Addr())
+		dataAPI = &http.Server{Handler: proxy.DataAPIHandler()}
+		go func() {
+			if err := dataAPI.Serve(dl); err != nil && err != http.ErrServerClosed {
+				logrus.Fatal(err)
+			}
+		}()
+	}
+
+	// Serve the gRPC control-plane API (if configured)
+	var controlPlane *grpc.Server
+	if cfg.ControlPlane != nil {
+		cl, err := net.Listen("tcp", cfg.ControlPlane.BindAddr)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Debugf("Control plane bind started: %v", cl.Addr())
+		controlPlane = proxy.ControlServer()
+		go func() {
+			if err := controlPlane.Serve(cl); err != nil {
+				logrus.Fatal(err)
+			}
+		}()
+	}
+
 	go func() {
 		ready = true
 		if err := proxy.Serve(); err != nil && err != mongoproxy.ErrServerClosed {
@@ -118,18 +225,43 @@ func Main() {
 		}
 	}()
 
+	if opts.WatchConfig {
+		w, err := filewatch.New(cfg.Files, filewatch.DefaultDebounce, func() {
+			logrus.Infof("Config files changed, reloading config")
+			if err := reload(mongoproxy.WithChangeAuthor(context.TODO(), "file", "")); err != nil {
+				logrus.Errorf("Error reloading config: %v", err)
+			}
+		})
+		if err != nil {
+			logrus.Fatalf("error watching config: %v", err)
+		}
+		defer w.Close()
+	}
+
 	logrus.Infof("started, ready!")
 
 	// wait for signals etc.
 	for sig := range sigs {
 		switch sig {
 		case syscall.SIGHUP:
-			logrus.Infof("TODO: Reloading config")
+			logrus.Infof("Reloading config")
+			if err := reload(mongoproxy.WithChangeAuthor(context.TODO(), "signal", "")); err != nil {
+				logrus.Errorf("Error reloading config: %v", err)
+			}
 		case syscall.SIGTERM, syscall.SIGINT:
 			ready = false
 			logrus.Infof("received exit signal, starting graceful shutdown after %v", opts.TermSleep)
 			time.Sleep(opts.TermSleep)
 			logrus.Info("starting graceful shutdown NOW")
+			if dataAPI != nil {
+				if err := dataAPI.Shutdown(context.TODO()); err != nil {
+					logrus.Errorf("Error shutting down the data API: %v", err)
+				}
+			}
+			if controlPlane != nil {
+				// Event streams only end when cancelled, so don't wait for them
+				controlPlane.Stop()
+			}
 			if err := proxy.Shutdown(context.TODO()); err != nil {
 				logrus.Errorf("Error shutting down: %v", err)
 			}
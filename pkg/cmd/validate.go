@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// validateConfigCommand is the name of the subcommand to validate a config
+const validateConfigCommand = "validate-config"
+
+var validateOpts struct {
+	configOpts
+}
+
+// validateConfig parses and validates the config file (including configuring
+// all plugins) and prints any problems found; it returns the process exit code.
+func validateConfig(args []string) int {
+	parser := flags.NewNamedParser(validateConfigCommand, flags.Default)
+	if _, err := parser.AddGroup("options", "", &validateOpts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if _, err := parser.ParseArgs(args); err != nil {
+		return 1
+	}
+
+	cfg, err := validateOpts.load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	errs := cfg.Validate()
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "%d problem(s) found\n", len(errs))
+		return 1
+	}
+	fmt.Println("config OK")
+	return 0
+}
@@ -0,0 +1,46 @@
+package command
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+)
+
+func init() {
+	Register("collMod", func() Command {
+		return &CollMod{}
+	})
+}
+
+// CollMod mongo command
+type CollMod struct {
+	Collection       string        `bson:"collMod"`
+	Index            bson.D        `bson:"index,omitempty"`
+	Validator        bson.D        `bson:"validator,omitempty"`
+	ValidationLevel  string        `bson:"validationLevel,omitempty"`
+	ValidationAction string        `bson:"validationAction,omitempty"`
+	ViewOn           string        `bson:"viewOn,omitempty"`
+	Pipeline         primitive.A   `bson:"pipeline,omitempty"`
+	WriteConcern     *WriteConcern `bson:"writeConcern,omitempty"`
+	Comment          interface{}   `bson:"comment,omitempty"`
+
+	Common `bson:",inline"`
+}
+
+// GetCollection returns the collection name for this Command
+func (m *CollMod) GetCollection() string { return m.Collection }
+
+// FromBSOND loads the command from a bson.D
+func (m *CollMod) FromBSOND(d bson.D) error {
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&m); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type WriteConcern struct {
@@ -14,6 +15,11 @@ type WriteConcern struct {
 
 type ReadConcern struct {
 	Level string `bson:"level,omitempty"`
+	// AfterClusterTime is set by causally consistent sessions so the read sees
+	// the session's previous operations
+	AfterClusterTime *primitive.Timestamp `bson:"afterClusterTime,omitempty"`
+	// AtClusterTime is the time of snapshot reads
+	AtClusterTime *primitive.Timestamp `bson:"atClusterTime,omitempty"`
 }
 
 type ReadPreference struct {
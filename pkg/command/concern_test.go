@@ -0,0 +1,30 @@
+package command
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestReadConcernClusterTime(t *testing.T) {
+	in := bson.D{
+		{"find", "coll"},
+		{"readConcern", bson.D{{"level", "majority"}, {"afterClusterTime", primitive.Timestamp{T: 1, I: 2}}}},
+	}
+
+	cmd, _ := GetCommand(in[0].Key)
+	if err := cmd.FromBSOND(in); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cluster time is sent on to the backend
+	b, err := bson.Marshal(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, i, ok := bson.Raw(b).Lookup("readConcern", "afterClusterTime").TimestampOK()
+	if !ok || ts != 1 || i != 2 {
+		t.Fatalf("expected afterClusterTime to be kept, got %s", bson.Raw(b))
+	}
+}
@@ -19,6 +19,7 @@ type Delete struct {
 	Ordered      *bool         `bson:"ordered,omitempty"`
 	WriteConcern *WriteConcern `bson:"writeConcern,omitempty"`
 	Hint         interface{}   `bson:"hint,omitempty"`
+	Comment      interface{}   `bson:"comment,omitempty"`
 
 	Common `bson:",inline"`
 }
@@ -30,6 +30,7 @@ type FindAndModify struct {
 	WriteConcern             *WriteConcern `bson:"writeConcern,omitempty"`
 	Collation                *Collation    `bson:"collation,omitempty"`
 	ArrayFilters             interface{}   `bson:"arrayFilters,omitempty"` // TODO
+	Comment                  interface{}   `bson:"comment,omitempty"`
 
 	Common `bson:",inline"`
 }
@@ -64,6 +65,7 @@ type FindAndModifyLegacy struct {
 	WriteConcern             *WriteConcern `bson:"writeConcern,omitempty"`
 	Collation                *Collation    `bson:"collation,omitempty"`
 	ArrayFilters             interface{}   `bson:"arrayFilters,omitempty"` // TODO
+	Comment                  interface{}   `bson:"comment,omitempty"`
 
 	Common `bson:",inline"`
 }
@@ -0,0 +1,45 @@
+package command
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func init() {
+	Register("getParameter", func() Command {
+		return &GetParameter{}
+	})
+}
+
+// the struct for the 'getParameter' command.
+type GetParameter struct {
+	// GetParameter is either "*" (or {allParameters: true}) or 1 to get the parameters in Parameters
+	GetParameter interface{} `bson:"getParameter"`
+	// Parameters are the requested parameters (e.g. {featureCompatibilityVersion: 1})
+	Parameters bson.D `bson:"-"`
+
+	Common `bson:",inline"`
+}
+
+func (m *GetParameter) FromBSOND(d bson.D) error {
+	if len(d) > 0 {
+		m.GetParameter = d[0].Value
+	}
+	parameters, err := decodeOptions(d, &m.Common)
+	if err != nil {
+		return err
+	}
+	m.Parameters = parameters
+	return nil
+}
+
+// AllParameters returns whether all parameters were requested
+func (m *GetParameter) AllParameters() bool {
+	switch v := m.GetParameter.(type) {
+	case string:
+		return v == "*"
+	case bson.D:
+		all, _ := v.Map()["allParameters"].(bool)
+		return all
+	}
+	return false
+}
@@ -16,17 +16,31 @@ func init() {
 type Insert struct {
 	Collection string   `bson:"insert"`
 	Documents  []bson.D `bson:"documents"`
-	Ordered    *bool    `bson:"ordered,omitempty"`
+	// RawDocuments are the documents when kept raw (as sent in a document
+	// sequence) rather than decoded into Documents (see DecodeDocuments)
+	RawDocuments []bson.Raw `bson:"-"`
+	Ordered      *bool      `bson:"ordered,omitempty"`
 	//selector                 description.ServerSelector
 	WriteConcern             *WriteConcern `bson:"writeConcern,omitempty"`
 	BypassDocumentValidation *bool         `bson:"bypassDocumentValidation,omitempty"`
+	Comment                  interface{}   `bson:"comment,omitempty"`
 
 	Common `bson:",inline"`
 }
 
 func (m *Insert) GetCollection() string { return m.Collection }
 
+// FromBSOND decodes the command; raw documents ([]bson.Raw) are kept as
+// RawDocuments
 func (m *Insert) FromBSOND(d bson.D) error {
+	if v, ok := bsonutil.Lookup(d, "documents"); ok {
+		if raw, ok := v.([]bson.Raw); ok {
+			// Pop changes d in place, which the caller keeps
+			d, _, _ = bsonutil.Pop(append(bson.D(nil), d...), "documents")
+			m.RawDocuments = raw
+		}
+	}
+
 	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
 	if err != nil {
 		return err
@@ -38,3 +52,48 @@ func (m *Insert) FromBSOND(d bson.D) error {
 
 	return nil
 }
+
+// DecodeDocuments decodes the raw documents (if any) into Documents
+func (m *Insert) DecodeDocuments() error {
+	if m.RawDocuments == nil {
+		return nil
+	}
+	docs := make([]bson.D, len(m.RawDocuments))
+	for i, raw := range m.RawDocuments {
+		if err := bson.Unmarshal(raw, &docs[i]); err != nil {
+			return err
+		}
+	}
+	m.Documents, m.RawDocuments = docs, nil
+	return nil
+}
+
+// DocumentCount returns the number of documents inserted, raw or not
+func (m *Insert) DocumentCount() int {
+	if m.RawDocuments != nil {
+		return len(m.RawDocuments)
+	}
+	return len(m.Documents)
+}
+
+// MarshalBSON encodes the command with its raw documents (if kept raw) as-is
+func (m *Insert) MarshalBSON() ([]byte, error) {
+	type insert Insert
+	if m.RawDocuments == nil {
+		return bson.Marshal((*insert)(m))
+	}
+	b, err := bson.Marshal((*insert)(m))
+	if err != nil {
+		return nil, err
+	}
+	var d bson.D
+	if err := bson.Unmarshal(b, &d); err != nil {
+		return nil, err
+	}
+	for i, e := range d {
+		if e.Key == "documents" {
+			d[i].Value = m.RawDocuments
+		}
+	}
+	return bson.Marshal(d)
+}
@@ -14,12 +14,16 @@ func init() {
 	Register("ismaster", func() Command {
 		return &IsMaster{}
 	})
+	Register("hello", func() Command {
+		return &IsMaster{}
+	})
 }
 
-// IsMaster mongo command
+// IsMaster mongo command (also used for hello)
 type IsMaster struct {
 	IsMaster       int      `bson:"isMaster"`
 	IsMasterLegacy int      `bson:"ismaster"`
+	Hello          int      `bson:"hello"`
 	HelloOk        bool     `bson:"helloOk"`
 	Client         bson.D   `bson:"client"` // TODO parse out
 	Compression    []string `bson:"compression"`
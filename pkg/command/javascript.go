@@ -0,0 +1,77 @@
+package command
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// javaScriptOperators are the query and aggregation operators which run
+// server-side JavaScript
+var javaScriptOperators = map[string]struct{}{
+	"$where":       {},
+	"$function":    {},
+	"$accumulator": {},
+}
+
+// FindJavaScript returns the first operator (or "JavaScript" for code values) in
+// v which runs server-side JavaScript
+func FindJavaScript(v interface{}) (string, bool) {
+	switch vTyped := v.(type) {
+	case bson.D:
+		for _, e := range vTyped {
+			if _, ok := javaScriptOperators[e.Key]; ok {
+				return e.Key, true
+			}
+			if op, ok := FindJavaScript(e.Value); ok {
+				return op, true
+			}
+		}
+	case primitive.A:
+		for _, item := range vTyped {
+			if op, ok := FindJavaScript(item); ok {
+				return op, true
+			}
+		}
+	case []bson.D:
+		for _, item := range vTyped {
+			if op, ok := FindJavaScript(item); ok {
+				return op, true
+			}
+		}
+	case primitive.JavaScript, primitive.CodeWithScope:
+		return "JavaScript", true
+	}
+	return "", false
+}
+
+// CommandJavaScript returns the first operator (or the command itself for
+// mapReduce) which runs server-side JavaScript in the command
+func CommandJavaScript(c Command) (string, bool) {
+	switch cmd := c.(type) {
+	case *MapReduce:
+		return "mapReduce", true
+	case *Find:
+		return FindJavaScript(bson.A{cmd.Filter, cmd.Projection})
+	case *Aggregate:
+		return FindJavaScript(cmd.Pipeline)
+	case *Count:
+		return FindJavaScript(cmd.Query)
+	case *Distinct:
+		return FindJavaScript(cmd.Query)
+	case *Delete:
+		return FindJavaScript(cmd.Deletes)
+	case *Update:
+		for _, u := range cmd.Updates {
+			if op, ok := FindJavaScript(bson.A{u.Query, u.U}); ok {
+				return op, true
+			}
+		}
+	case *FindAndModify:
+		return FindJavaScript(bson.A{cmd.Query, cmd.Update, cmd.Fields})
+	case *FindAndModifyLegacy:
+		return FindJavaScript(bson.A{cmd.Query, cmd.Update, cmd.Fields})
+	case *Explain:
+		return CommandJavaScript(cmd.Cmd)
+	}
+	return "", false
+}
@@ -13,11 +13,12 @@ func init() {
 	})
 }
 
-// the struct for the 'find' command.
+// the struct for the 'killOp' command.
 type KillOp struct {
-	KillOp  int    `bson:"killOp"`
-	OpID    int    `bson:"op"`
-	Comment string `bson:"comment,omitempty"`
+	KillOp int `bson:"killOp"`
+	// OpID is a number for mongod or a "shard:opid" string for mongos
+	OpID    interface{} `bson:"op"`
+	Comment string      `bson:"comment,omitempty"`
 
 	Common `bson:",inline"`
 }
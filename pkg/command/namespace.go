@@ -0,0 +1,57 @@
+package command
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// SetCommandNamespace changes the database and collection the command runs on,
+// returning false if the command doesn't run on a collection (or isn't supported).
+// References to other collections (e.g. $lookup) aren't changed.
+func SetCommandNamespace(c Command, db, collection string) bool {
+	switch cmd := c.(type) {
+	case *Find:
+		cmd.Database, cmd.Collection = db, collection
+	case *Insert:
+		cmd.Database, cmd.Collection = db, collection
+	case *Update:
+		cmd.Database, cmd.Collection = db, collection
+	case *Delete:
+		cmd.Database, cmd.Collection = db, collection
+	case *FindAndModify:
+		cmd.Database, cmd.Collection = db, collection
+	case *FindAndModifyLegacy:
+		cmd.Database, cmd.Collection = db, collection
+	case *Count:
+		cmd.Database, cmd.Collection = db, collection
+	case *Distinct:
+		cmd.Database, cmd.Collection = db, collection
+	case *GetMore:
+		cmd.Database, cmd.Collection = db, collection
+	case *KillCursors:
+		cmd.Database, cmd.Collection = db, collection
+	case *ListIndexes:
+		cmd.Database, cmd.Collection = db, collection
+	case *CreateIndexes:
+		cmd.Database, cmd.Collection = db, collection
+	case *DropIndexes:
+		cmd.Database, cmd.Collection = db, collection
+	case *CollStats:
+		cmd.Database, cmd.Collection = db, collection
+	case *CollMod:
+		cmd.Database, cmd.Collection = db, collection
+	case *Aggregate:
+		// Database level aggregates ({aggregate: 1}) have no collection
+		if cmd.GetCollection() == "" {
+			return false
+		}
+		cmd.Database = db
+		cmd.Aggregate = bson.RawValue{Type: bsontype.String, Value: bsoncore.AppendString(nil, collection)}
+	case *Explain:
+		return SetCommandNamespace(cmd.Cmd, db, collection)
+	default:
+		return false
+	}
+	return true
+}
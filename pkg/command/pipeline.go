@@ -0,0 +1,116 @@
+package command
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PipelineStage is a stage of an aggregation pipeline
+type PipelineStage struct {
+	// Name of the stage (e.g. "$match")
+	Name string
+	// Spec is the value of the stage
+	Spec interface{}
+	// Parent is the stage whose sub-pipeline the stage is in ($lookup, $unionWith
+	// or $facet); nil for top-level stages
+	Parent *PipelineStage
+}
+
+// Depth returns the number of stages the stage is nested in with the given name
+// (including the stage itself); e.g. the $lookup depth of a stage
+func (s *PipelineStage) Depth(name string) int {
+	depth := 0
+	for ; s != nil; s = s.Parent {
+		if s.Name == name {
+			depth++
+		}
+	}
+	return depth
+}
+
+// WalkPipeline calls f for each stage of the pipeline, including the stages of
+// sub-pipelines ($lookup, $unionWith and $facet) after their parent stage
+func WalkPipeline(pipeline primitive.A, f func(*PipelineStage) error) error {
+	return walkPipeline(pipeline, nil, f)
+}
+
+func walkPipeline(pipeline primitive.A, parent *PipelineStage, f func(*PipelineStage) error) error {
+	for _, raw := range pipeline {
+		stageDoc, ok := raw.(bson.D)
+		if !ok || len(stageDoc) != 1 {
+			return fmt.Errorf("a pipeline stage specification object must contain exactly one field")
+		}
+		stage := &PipelineStage{Name: stageDoc[0].Key, Spec: stageDoc[0].Value, Parent: parent}
+		if err := f(stage); err != nil {
+			return err
+		}
+
+		for _, sub := range subPipelines(stage) {
+			if err := walkPipeline(sub, stage, f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// subPipelines returns the sub-pipelines of the stage
+func subPipelines(stage *PipelineStage) []primitive.A {
+	spec, ok := stage.Spec.(bson.D)
+	if !ok {
+		return nil
+	}
+
+	var pipelines []primitive.A
+	switch stage.Name {
+	case "$lookup", "$unionWith":
+		for _, e := range spec {
+			if p, ok := e.Value.(primitive.A); ok && e.Key == "pipeline" {
+				pipelines = append(pipelines, p)
+			}
+		}
+	case "$facet":
+		for _, e := range spec {
+			if p, ok := e.Value.(primitive.A); ok {
+				pipelines = append(pipelines, p)
+			}
+		}
+	}
+	return pipelines
+}
+
+// PipelineOutput returns the namespace the $out or $merge stage writes to; db
+// is empty if the stage writes to the database of the aggregate
+func PipelineOutput(stage *PipelineStage) (db, collection string, err error) {
+	spec := stage.Spec
+	if stage.Name == "$merge" {
+		if d, ok := spec.(bson.D); ok {
+			for _, e := range d {
+				if e.Key == "into" {
+					spec = e.Value
+				}
+			}
+		}
+	}
+
+	switch v := spec.(type) {
+	case string:
+		return "", v, nil
+	case bson.D:
+		for _, e := range v {
+			s, _ := e.Value.(string)
+			switch e.Key {
+			case "db":
+				db = s
+			case "coll":
+				collection = s
+			}
+		}
+		if collection != "" {
+			return db, collection, nil
+		}
+	}
+	return "", "", fmt.Errorf("invalid %s specification: %v", stage.Name, stage.Spec)
+}
@@ -0,0 +1,41 @@
+package command
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+)
+
+func init() {
+	Register("proxyStats", func() Command {
+		return &ProxyStats{}
+	})
+}
+
+// the struct for the 'proxyStats' command, answered by the proxy itself with the
+// stats of its requests on the collection (or all namespaces of the database
+// for {proxyStats: 1})
+type ProxyStats struct {
+	ProxyStats interface{} `bson:"proxyStats"`
+
+	Common `bson:",inline"`
+}
+
+// GetCollection returns the collection, empty for all the database's namespaces
+func (m *ProxyStats) GetCollection() string {
+	collection, _ := m.ProxyStats.(string)
+	return collection
+}
+
+func (m *ProxyStats) FromBSOND(d bson.D) error {
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&m); err != nil {
+		return err
+	}
+
+	return nil
+}
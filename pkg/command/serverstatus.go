@@ -2,8 +2,6 @@ package command
 
 import (
 	"go.mongodb.org/mongo-driver/bson"
-
-	"github.com/wish/mongoproxy/pkg/bsonutil"
 )
 
 func init() {
@@ -12,22 +10,21 @@ func init() {
 	})
 }
 
-// the struct for the 'update' command.
+// the struct for the 'serverStatus' command.
 type ServerStatus struct {
 	ServerStatus int `bson:"serverStatus"`
+	// Options are the section options (e.g. {repl: 0}) which vary so are kept as-is
+	Options bson.D `bson:"-"`
 
 	Common `bson:",inline"`
 }
 
 func (m *ServerStatus) FromBSOND(d bson.D) error {
-	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	m.ServerStatus = 1
+	options, err := decodeOptions(d, &m.Common)
 	if err != nil {
 		return err
 	}
-
-	if err := dec.Decode(&m); err != nil {
-		return err
-	}
-
+	m.Options = options
 	return nil
 }
@@ -16,10 +16,20 @@ func (t *OptionalDoc) IsZero() bool {
 }
 
 type Session struct {
-	LSID        bson.D       `bson:"lsid,omitempty"`
-	TxnNumber   *int64       `bson:"txnNumber,omitempty"`
-	StmtIDs     []int32      `bson:"stmtIds,omitempty"`
-	ClusterTime *ClusterTime `bson:"$clusterTime,omitempty"`
+	LSID      bson.D  `bson:"lsid,omitempty"`
+	TxnNumber *int64  `bson:"txnNumber,omitempty"`
+	StmtIDs   []int32 `bson:"stmtIds,omitempty"`
+	// StartTransaction and Autocommit are set on the commands of transactions
+	// (autocommit always being false)
+	StartTransaction *bool        `bson:"startTransaction,omitempty"`
+	Autocommit       *bool        `bson:"autocommit,omitempty"`
+	ClusterTime      *ClusterTime `bson:"$clusterTime,omitempty"`
+}
+
+// InTransaction returns whether the command is part of a transaction (rather
+// than e.g. a retryable write, also with a txnNumber)
+func (s *Session) InTransaction() bool {
+	return s.TxnNumber != nil && s.Autocommit != nil
 }
 
 func (s *Session) GetSession() *Session {
@@ -40,6 +50,9 @@ type Common struct {
 func (c *Common) GetDatabase() string                { return c.Database }
 func (c *Common) GetReadPreference() *ReadPreference { return c.ReadPreference }
 
+// SetReadPreference sets the $readPreference of the command
+func (c *Common) SetReadPreference(rp *ReadPreference) { c.ReadPreference = rp }
+
 // Cursor encapsulates the separate "cursor" doc found on some commands
 type Cursor struct {
 	BatchSize *int32 `bson:"batchSize,omitempty"`
@@ -19,6 +19,7 @@ type Update struct {
 	WriteConcern             *WriteConcern     `bson:"writeConcern,omitempty"`
 	Ordered                  *bool             `bson:"ordered,omitempty"`
 	BypassDocumentValidation *bool             `bson:"bypassDocumentValidation,omitempty"`
+	Comment                  interface{}       `bson:"comment,omitempty"`
 
 	Common `bson:",inline"`
 }
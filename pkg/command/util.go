@@ -1,5 +1,7 @@
 package command
 
+import "go.mongodb.org/mongo-driver/bson"
+
 func GetCommandReadPreferenceMode(c Command) string {
 	if cr, ok := c.(CommandReadPreference); ok {
 		pref := cr.GetReadPreference()
@@ -24,3 +26,35 @@ func GetCommandCollection(c Command) string {
 	}
 	return ""
 }
+
+// commonKeys are the keys of a command decoded into Common
+var commonKeys = map[string]struct{}{
+	"$readPreference": {},
+	"$db":             {},
+	"lsid":            {},
+	"txnNumber":       {},
+	"stmtIds":         {},
+	"$clusterTime":    {},
+}
+
+// decodeOptions decodes the Common fields of the command d into c returning the
+// remaining fields (other than the command name itself); this is for commands
+// which accept arbitrary options.
+func decodeOptions(d bson.D, c *Common) (bson.D, error) {
+	b, err := bson.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	if err := bson.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+
+	var options bson.D
+	for i, e := range d {
+		if _, ok := commonKeys[e.Key]; ok || i == 0 {
+			continue
+		}
+		options = append(options, e)
+	}
+	return options, nil
+}
@@ -0,0 +1,134 @@
+// Package filewatch watches files for changes to their content.
+//
+// The directories containing the files are watched (rather than the files
+// themselves) so that files which are atomically replaced are handled. This
+// includes the symlink swap Kubernetes uses to update ConfigMap and Secret
+// volumes: the files are symlinks into a "..data" symlink which is replaced
+// to point at a new directory, so the files themselves never see an event.
+package filewatch
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/fsnotify.v1"
+)
+
+// DefaultDebounce is how long to wait after the last event before checking files
+const DefaultDebounce = time.Second
+
+// Watcher calls a func whenever the content of any of the watched files changes
+type Watcher struct {
+	paths    []string
+	debounce time.Duration
+	onChange func()
+
+	w      *fsnotify.Watcher
+	hashes map[string]uint64
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// New starts watching paths; onChange is called (from a single goroutine) once
+// events have settled for debounce and the content of a file has changed.
+func New(paths []string, debounce time.Duration, onChange func()) (*Watcher, error) {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{
+		paths:    paths,
+		debounce: debounce,
+		onChange: onChange,
+		w:        fw,
+		hashes:   make(map[string]uint64, len(paths)),
+		done:     make(chan struct{}),
+	}
+
+	dirs := make(map[string]struct{})
+	for _, p := range paths {
+		w.hashes[p], _ = hashFile(p)
+		dir := filepath.Dir(p)
+		if _, ok := dirs[dir]; ok {
+			continue
+		}
+		dirs[dir] = struct{}{}
+		if err := fw.Add(dir); err != nil {
+			fw.Close()
+			return nil, err
+		}
+	}
+
+	go w.run()
+	return w, nil
+}
+
+// Close stops watching
+func (w *Watcher) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.done)
+		err = w.w.Close()
+	})
+	return err
+}
+
+func (w *Watcher) run() {
+	timer := time.NewTimer(w.debounce)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case event, ok := <-w.w.Events:
+			if !ok {
+				return
+			}
+			logrus.Debugf("filewatch event: %v", event)
+			timer.Reset(w.debounce)
+		case err, ok := <-w.w.Errors:
+			if !ok {
+				return
+			}
+			logrus.Errorf("filewatch error: %v", err)
+		case <-timer.C:
+			if w.changed() {
+				w.onChange()
+			}
+		}
+	}
+}
+
+// changed updates the hashes of the files returning whether any changed. Files
+// which can't be read (e.g. mid swap) are skipped until the next event.
+func (w *Watcher) changed() bool {
+	changed := false
+	for _, p := range w.paths {
+		h, err := hashFile(p)
+		if err != nil {
+			logrus.Warnf("filewatch unable to read %s: %v", p, err)
+			continue
+		}
+		if h != w.hashes[p] {
+			w.hashes[p] = h
+			changed = true
+		}
+	}
+	return changed
+}
+
+func hashFile(path string) (uint64, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return xxhash.Sum64(b), nil
+}
@@ -0,0 +1,70 @@
+package filewatch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeVersion lays out dir the way Kubernetes mounts a ConfigMap:
+// dir/config.json -> ..data/config.json, ..data -> ..<version>
+func writeVersion(t *testing.T, dir, version, content string) {
+	t.Helper()
+	vdir := filepath.Join(dir, ".."+version)
+	if err := os.Mkdir(vdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(vdir, "config.json"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tmp := filepath.Join(dir, "..data_tmp")
+	if err := os.Symlink(".."+version, tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "config.json")); os.IsNotExist(err) {
+		if err := os.Symlink(filepath.Join("..data", "config.json"), filepath.Join(dir, "config.json")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWatcherSymlinkSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filewatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeVersion(t, dir, "1", "a")
+
+	changes := make(chan struct{}, 10)
+	w, err := New([]string{filepath.Join(dir, "config.json")}, 10*time.Millisecond, func() {
+		changes <- struct{}{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	writeVersion(t, dir, "2", "b")
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no change detected")
+	}
+
+	// Events without a content change don't trigger onChange
+	if err := ioutil.WriteFile(filepath.Join(dir, "other"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changes:
+		t.Fatalf("unexpected change")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
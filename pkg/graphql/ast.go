@@ -0,0 +1,180 @@
+// Package graphql parses GraphQL queries, for the proxy's read-only GraphQL
+// facade. Only queries are supported (no mutations or subscriptions); type
+// checking against a schema is left to the resolver.
+package graphql
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Document is a parsed GraphQL document
+type Document struct {
+	Operations []*Operation
+	Fragments  map[string]*Fragment
+}
+
+// Operation is a query of a document
+type Operation struct {
+	Name         string
+	Variables    []*VariableDefinition
+	Directives   []*Directive
+	SelectionSet SelectionSet
+}
+
+// VariableDefinition is a variable of an operation, with its type (e.g.
+// "[String!]!") and default value (nil if none)
+type VariableDefinition struct {
+	Name    string
+	Type    string
+	Default Value
+}
+
+// Fragment is a named fragment of a document
+type Fragment struct {
+	Name          string
+	TypeCondition string
+	Directives    []*Directive
+	SelectionSet  SelectionSet
+}
+
+// SelectionSet are the selections of an operation, field or fragment
+type SelectionSet []Selection
+
+// Selection is a *Field, *FragmentSpread or *InlineFragment
+type Selection interface {
+	selection()
+}
+
+// Field is a selected field
+type Field struct {
+	Alias        string
+	Name         string
+	Arguments    []*Argument
+	Directives   []*Directive
+	SelectionSet SelectionSet
+}
+
+// ResponseKey returns the key of the field in the response: its alias, or name
+func (f *Field) ResponseKey() string {
+	if f.Alias != "" {
+		return f.Alias
+	}
+	return f.Name
+}
+
+// Argument returns the value of the argument, and false if it isn't set
+func (f *Field) Argument(name string) (Value, bool) {
+	for _, arg := range f.Arguments {
+		if arg.Name == name {
+			return arg.Value, true
+		}
+	}
+	return nil, false
+}
+
+// FragmentSpread is a spread of a named fragment
+type FragmentSpread struct {
+	Name       string
+	Directives []*Directive
+}
+
+// InlineFragment is an inline fragment, with an optional type condition
+type InlineFragment struct {
+	TypeCondition string
+	Directives    []*Directive
+	SelectionSet  SelectionSet
+}
+
+func (*Field) selection()          {}
+func (*FragmentSpread) selection() {}
+func (*InlineFragment) selection() {}
+
+// Directive is a directive of a selection (e.g. @skip(if: $x))
+type Directive struct {
+	Name      string
+	Arguments []*Argument
+}
+
+// Argument is an argument of a field or directive, or a field of an object value
+type Argument struct {
+	Name  string
+	Value Value
+}
+
+// Value is the value of an argument: nil, a bool, string, Number, Enum, Variable,
+// ListValue or ObjectValue
+type Value interface{}
+
+type (
+	// Number is an Int or Float value, as written
+	Number string
+	// Enum is an enum value
+	Enum string
+	// Variable is a reference to a variable of the operation
+	Variable string
+	// ListValue is a list value
+	ListValue []Value
+	// ObjectValue is an input object value, with its fields in order
+	ObjectValue []*Argument
+)
+
+// ValueJSON returns the value as JSON with the variables substituted;
+// variables which aren't defined are an error
+func ValueJSON(v Value, vars map[string]json.RawMessage) (json.RawMessage, error) {
+	var buf bytes.Buffer
+	if err := writeValueJSON(&buf, v, vars); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeValueJSON(buf *bytes.Buffer, v Value, vars map[string]json.RawMessage) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool, string, Enum:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	case Number:
+		buf.WriteString(string(v))
+	case Variable:
+		raw, ok := vars[string(v)]
+		if !ok {
+			return fmt.Errorf("variable $%s is not defined", v)
+		}
+		buf.Write(raw)
+	case ListValue:
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeValueJSON(buf, item, vars); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case ObjectValue:
+		buf.WriteByte('{')
+		for i, field := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			b, _ := json.Marshal(field.Name)
+			buf.Write(b)
+			buf.WriteByte(':')
+			if err := writeValueJSON(buf, field.Value, vars); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("invalid value %T", v)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package graphql
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Request is a GraphQL request, as POSTed over HTTP
+type Request struct {
+	Query         string `json:"query"`
+	OperationName string `json:"operationName,omitempty"`
+	// Variables are kept as JSON so the order of the fields of objects is kept
+	Variables map[string]json.RawMessage `json:"variables,omitempty"`
+}
+
+// Response is the response of a GraphQL request; Data is nil if the request
+// failed before it was executed
+type Response struct {
+	Data   *Object `json:"data,omitempty"`
+	Errors []Error `json:"errors,omitempty"`
+}
+
+// Errorf adds an error to the response
+func (r *Response) Errorf(path []interface{}, format string, args ...interface{}) {
+	r.Errors = append(r.Errors, Error{Message: fmt.Sprintf(format, args...), Path: path})
+}
+
+// Error is an error of a response, with the path of the field it's of (if any)
+type Error struct {
+	Message    string                 `json:"message"`
+	Path       []interface{}          `json:"path,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// Object is an object of a response, with its fields in the order they were
+// selected in
+type Object []ObjectField
+
+// ObjectField is a field of an Object
+type ObjectField struct {
+	Key   string
+	Value interface{}
+}
+
+// MarshalJSON marshals the object with its fields in order
+func (o Object) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(f.Key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(f.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Operation returns the operation of the name, which may be empty if the
+// document has a single operation
+func (d *Document) Operation(name string) (*Operation, error) {
+	if name == "" {
+		if len(d.Operations) > 1 {
+			return nil, fmt.Errorf("operationName is required for documents with several operations")
+		}
+		return d.Operations[0], nil
+	}
+	for _, op := range d.Operations {
+		if op.Name == name {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown operation %s", name)
+}
+
+// CoerceVariables returns the values of the operation's variables, with their
+// defaults. Variables without a value (nor default) are null, unless their type
+// is non-null. Values aren't checked against their types.
+func (op *Operation) CoerceVariables(values map[string]json.RawMessage) (map[string]json.RawMessage, error) {
+	vars := make(map[string]json.RawMessage, len(op.Variables))
+	for _, def := range op.Variables {
+		if _, ok := vars[def.Name]; ok {
+			return nil, fmt.Errorf("variable $%s is defined more than once", def.Name)
+		}
+		v, ok := values[def.Name]
+		if !ok && def.Default != nil {
+			var err error
+			if v, err = ValueJSON(def.Default, nil); err != nil {
+				return nil, err
+			}
+			ok = true
+		}
+		if !ok || string(bytes.TrimSpace(v)) == "null" {
+			if strings.HasSuffix(def.Type, "!") {
+				return nil, fmt.Errorf("variable $%s of non-null type %s must be set", def.Name, def.Type)
+			}
+			v = json.RawMessage("null")
+		}
+		vars[def.Name] = v
+	}
+	return vars, nil
+}
+
+// CollectFields returns the fields of the selection set selected on an object
+// of the type: the fields not skipped by @skip or @include, including those of
+// the fragments on the type. Fields with the same response key are merged.
+func (d *Document) CollectFields(set SelectionSet, typeName string, vars map[string]json.RawMessage) ([]*Field, error) {
+	var fields []*Field
+	index := make(map[string]int)
+	visited := make(map[string]struct{})
+
+	var collect func(SelectionSet) error
+	collect = func(set SelectionSet) error {
+		for _, sel := range set {
+			if ok, err := included(sel, vars); err != nil {
+				return err
+			} else if !ok {
+				continue
+			}
+			switch sel := sel.(type) {
+			case *Field:
+				key := sel.ResponseKey()
+				i, ok := index[key]
+				if !ok {
+					index[key] = len(fields)
+					fields = append(fields, sel)
+					continue
+				}
+				if fields[i].Name != sel.Name {
+					return fmt.Errorf("fields %s and %s conflict as %s", fields[i].Name, sel.Name, key)
+				}
+				merged := *fields[i]
+				merged.SelectionSet = append(append(SelectionSet{}, merged.SelectionSet...), sel.SelectionSet...)
+				fields[i] = &merged
+			case *FragmentSpread:
+				if _, ok := visited[sel.Name]; ok {
+					continue
+				}
+				visited[sel.Name] = struct{}{}
+				f := d.Fragments[sel.Name]
+				if f.TypeCondition != typeName {
+					continue
+				}
+				if err := collect(f.SelectionSet); err != nil {
+					return err
+				}
+			case *InlineFragment:
+				if sel.TypeCondition != "" && sel.TypeCondition != typeName {
+					continue
+				}
+				if err := collect(sel.SelectionSet); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := collect(set); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// included returns whether the selection is included, as per its @skip(if:) and
+// @include(if:) directives; other directives are an error
+func included(sel Selection, vars map[string]json.RawMessage) (bool, error) {
+	var directives []*Directive
+	switch sel := sel.(type) {
+	case *Field:
+		directives = sel.Directives
+	case *FragmentSpread:
+		directives = sel.Directives
+	case *InlineFragment:
+		directives = sel.Directives
+	}
+	for _, d := range directives {
+		if d.Name != "skip" && d.Name != "include" {
+			return false, fmt.Errorf("unknown directive @%s", d.Name)
+		}
+		if len(d.Arguments) != 1 || d.Arguments[0].Name != "if" {
+			return false, fmt.Errorf("directive @%s takes a single if argument", d.Name)
+		}
+		v, err := ValueJSON(d.Arguments[0].Value, vars)
+		if err != nil {
+			return false, err
+		}
+		var cond bool
+		if err := json.Unmarshal(v, &cond); err != nil {
+			return false, fmt.Errorf("directive @%s: if must be a Boolean", d.Name)
+		}
+		if cond == (d.Name == "skip") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
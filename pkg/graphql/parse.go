@@ -0,0 +1,761 @@
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxDepth is the maximum nesting of the selection sets, values and types of a
+// document
+const MaxDepth = 64
+
+// MaxSelections is the maximum number of selections of a document, with its
+// fragments expanded
+const MaxSelections = 10000
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenPunct
+	tokenName
+	tokenInt
+	tokenFloat
+	tokenString
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+// lexer splits a document into tokens, skipping whitespace, commas and comments
+type lexer struct {
+	src string
+	pos int
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// IsName returns whether s is a valid GraphQL name
+func IsName(s string) bool {
+	if s == "" || !isNameStart(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isNameStart(s[i]) && !isDigit(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *lexer) errorf(pos int, format string, args ...interface{}) error {
+	line, col := 1, 1
+	for _, c := range l.src[:pos] {
+		if c == '\n' {
+			line, col = line+1, 1
+		} else {
+			col++
+		}
+	}
+	return fmt.Errorf("syntax error at %d:%d: %s", line, col, fmt.Sprintf(format, args...))
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' && l.src[l.pos] != '\r' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], "\ufeff"):
+			l.pos += len("\ufeff")
+		default:
+			return l.token()
+		}
+	}
+	return token{kind: tokenEOF, pos: l.pos}, nil
+}
+
+func (l *lexer) token() (token, error) {
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case strings.IndexByte("!$()&:=@[]{}|", c) >= 0:
+		l.pos++
+		return token{kind: tokenPunct, value: string(c), pos: start}, nil
+	case strings.HasPrefix(l.src[l.pos:], "..."):
+		l.pos += 3
+		return token{kind: tokenPunct, value: "...", pos: start}, nil
+	case isNameStart(c):
+		for l.pos < len(l.src) && (isNameStart(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		return token{kind: tokenName, value: l.src[start:l.pos], pos: start}, nil
+	case c == '-' || isDigit(c):
+		return l.number()
+	case strings.HasPrefix(l.src[l.pos:], `"""`):
+		return l.blockString()
+	case c == '"':
+		return l.string()
+	}
+	r, _ := utf8.DecodeRuneInString(l.src[l.pos:])
+	return token{}, l.errorf(start, "unexpected character %q", r)
+}
+
+func (l *lexer) digits() int {
+	start := l.pos
+	for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+		l.pos++
+	}
+	return l.pos - start
+}
+
+func (l *lexer) number() (token, error) {
+	start := l.pos
+	if l.src[l.pos] == '-' {
+		l.pos++
+	}
+	intStart := l.pos
+	if l.digits() == 0 {
+		return token{}, l.errorf(start, "invalid number")
+	}
+	if l.src[intStart] == '0' && l.pos-intStart > 1 {
+		return token{}, l.errorf(start, "invalid number %s", l.src[start:l.pos])
+	}
+	kind := tokenInt
+	if l.pos < len(l.src) && l.src[l.pos] == '.' {
+		l.pos++
+		if l.digits() == 0 {
+			return token{}, l.errorf(start, "invalid number %s", l.src[start:l.pos])
+		}
+		kind = tokenFloat
+	}
+	if l.pos < len(l.src) && (l.src[l.pos] == 'e' || l.src[l.pos] == 'E') {
+		l.pos++
+		if l.pos < len(l.src) && (l.src[l.pos] == '+' || l.src[l.pos] == '-') {
+			l.pos++
+		}
+		if l.digits() == 0 {
+			return token{}, l.errorf(start, "invalid number %s", l.src[start:l.pos])
+		}
+		kind = tokenFloat
+	}
+	if l.pos < len(l.src) && (isNameStart(l.src[l.pos]) || l.src[l.pos] == '.') {
+		return token{}, l.errorf(start, "invalid number %s", l.src[start:l.pos+1])
+	}
+	return token{kind: kind, value: l.src[start:l.pos], pos: start}, nil
+}
+
+func (l *lexer) string() (token, error) {
+	start := l.pos
+	l.pos++
+	var sb strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '"':
+			l.pos++
+			return token{kind: tokenString, value: sb.String(), pos: start}, nil
+		case c == '\n' || c == '\r':
+			return token{}, l.errorf(start, "unterminated string")
+		case c == '\\':
+			if l.pos+1 >= len(l.src) {
+				return token{}, l.errorf(start, "unterminated string")
+			}
+			switch e := l.src[l.pos+1]; e {
+			case '"', '\\', '/':
+				sb.WriteByte(e)
+			case 'b':
+				sb.WriteByte('\b')
+			case 'f':
+				sb.WriteByte('\f')
+			case 'n':
+				sb.WriteByte('\n')
+			case 'r':
+				sb.WriteByte('\r')
+			case 't':
+				sb.WriteByte('\t')
+			case 'u':
+				if l.pos+6 > len(l.src) {
+					return token{}, l.errorf(l.pos, "invalid unicode escape")
+				}
+				n, err := strconv.ParseUint(l.src[l.pos+2:l.pos+6], 16, 16)
+				if err != nil {
+					return token{}, l.errorf(l.pos, "invalid unicode escape %s", l.src[l.pos:l.pos+6])
+				}
+				sb.WriteRune(rune(n))
+				l.pos += 4
+			default:
+				return token{}, l.errorf(l.pos, "invalid escape \\%c", e)
+			}
+			l.pos += 2
+		default:
+			sb.WriteByte(c)
+			l.pos++
+		}
+	}
+	return token{}, l.errorf(start, "unterminated string")
+}
+
+// blockString lexes a """block string""", removing its common indentation and
+// leading and trailing blank lines
+func (l *lexer) blockString() (token, error) {
+	start := l.pos
+	l.pos += 3
+	var sb strings.Builder
+	for l.pos < len(l.src) {
+		switch {
+		case strings.HasPrefix(l.src[l.pos:], `"""`):
+			l.pos += 3
+			return token{kind: tokenString, value: blockStringValue(sb.String()), pos: start}, nil
+		case strings.HasPrefix(l.src[l.pos:], `\"""`):
+			sb.WriteString(`"""`)
+			l.pos += 4
+		default:
+			sb.WriteByte(l.src[l.pos])
+			l.pos++
+		}
+	}
+	return token{}, l.errorf(start, "unterminated block string")
+}
+
+func blockStringValue(raw string) string {
+	lines := strings.Split(strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(raw), "\n")
+	indent := -1
+	for _, line := range lines[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" {
+			continue
+		}
+		if n := len(line) - len(trimmed); indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	if indent > 0 {
+		for i := 1; i < len(lines); i++ {
+			if len(lines[i]) >= indent {
+				lines[i] = lines[i][indent:]
+			} else {
+				lines[i] = strings.TrimLeft(lines[i], " \t")
+			}
+		}
+	}
+	for len(lines) > 0 && strings.TrimLeft(lines[0], " \t") == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimLeft(lines[len(lines)-1], " \t") == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parser is a recursive descent parser of executable documents
+type parser struct {
+	lex   *lexer
+	tok   token
+	depth int
+}
+
+// Parse parses the query document. Fragments must be defined once, be used
+// and not spread themselves (directly or not).
+func Parse(query string) (*Document, error) {
+	p := &parser{lex: &lexer{src: query}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	doc := &Document{Fragments: make(map[string]*Fragment)}
+	if p.tok.kind == tokenEOF {
+		return nil, p.lex.errorf(p.tok.pos, "empty document")
+	}
+	for p.tok.kind != tokenEOF {
+		switch {
+		case p.peek(tokenPunct, "{"):
+			set, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.Operations = append(doc.Operations, &Operation{SelectionSet: set})
+		case p.peek(tokenName, "query"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.Operations = append(doc.Operations, op)
+		case p.peek(tokenName, "fragment"):
+			f, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := doc.Fragments[f.Name]; ok {
+				return nil, fmt.Errorf("fragment %s is defined more than once", f.Name)
+			}
+			doc.Fragments[f.Name] = f
+		case p.peek(tokenName, "mutation"), p.peek(tokenName, "subscription"):
+			return nil, fmt.Errorf("%s operations are not supported", p.tok.value)
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if err := doc.validate(); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (p *parser) advance() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) peek(kind tokenKind, value string) bool {
+	return p.tok.kind == kind && p.tok.value == value
+}
+
+func (p *parser) unexpected() error {
+	if p.tok.kind == tokenEOF {
+		return p.lex.errorf(p.tok.pos, "unexpected end of document")
+	}
+	return p.lex.errorf(p.tok.pos, "unexpected %q", p.tok.value)
+}
+
+// expect consumes the punctuator
+func (p *parser) expect(punct string) error {
+	if !p.peek(tokenPunct, punct) {
+		return p.unexpected()
+	}
+	return p.advance()
+}
+
+// skip consumes the punctuator if it's next, returning whether it was
+func (p *parser) skip(punct string) (bool, error) {
+	if !p.peek(tokenPunct, punct) {
+		return false, nil
+	}
+	return true, p.advance()
+}
+
+// nest enters a nested selection set, value or type; the caller must call
+// p.unnest() once done
+func (p *parser) nest() error {
+	if p.depth++; p.depth > MaxDepth {
+		return p.lex.errorf(p.tok.pos, "document is nested deeper than %d", MaxDepth)
+	}
+	return nil
+}
+
+func (p *parser) unnest() { p.depth-- }
+
+func (p *parser) name() (string, error) {
+	if p.tok.kind != tokenName {
+		return "", p.unexpected()
+	}
+	name := p.tok.value
+	return name, p.advance()
+}
+
+func (p *parser) operation() (*Operation, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	op := &Operation{}
+	var err error
+	if p.tok.kind == tokenName {
+		if op.Name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if ok, err := p.skip("("); err != nil {
+		return nil, err
+	} else if ok {
+		for !p.peek(tokenPunct, ")") {
+			def, err := p.variableDefinition()
+			if err != nil {
+				return nil, err
+			}
+			op.Variables = append(op.Variables, def)
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	if op.Directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if op.SelectionSet, err = p.selectionSet(); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+func (p *parser) variableDefinition() (*VariableDefinition, error) {
+	if err := p.expect("$"); err != nil {
+		return nil, err
+	}
+	def := &VariableDefinition{}
+	var err error
+	if def.Name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	if def.Type, err = p.typeRef(); err != nil {
+		return nil, err
+	}
+	if ok, err := p.skip("="); err != nil {
+		return nil, err
+	} else if ok {
+		if def.Default, err = p.value(true); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	return def, nil
+}
+
+func (p *parser) typeRef() (string, error) {
+	if err := p.nest(); err != nil {
+		return "", err
+	}
+	defer p.unnest()
+	var t string
+	if ok, err := p.skip("["); err != nil {
+		return "", err
+	} else if ok {
+		elem, err := p.typeRef()
+		if err != nil {
+			return "", err
+		}
+		if err := p.expect("]"); err != nil {
+			return "", err
+		}
+		t = "[" + elem + "]"
+	} else if t, err = p.name(); err != nil {
+		return "", err
+	}
+	if ok, err := p.skip("!"); err != nil {
+		return "", err
+	} else if ok {
+		t += "!"
+	}
+	return t, nil
+}
+
+func (p *parser) fragment() (*Fragment, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	f := &Fragment{}
+	var err error
+	if f.Name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if f.Name == "on" {
+		return nil, fmt.Errorf("invalid fragment name %q", f.Name)
+	}
+	if !p.peek(tokenName, "on") {
+		return nil, p.unexpected()
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if f.TypeCondition, err = p.name(); err != nil {
+		return nil, err
+	}
+	if f.Directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if f.SelectionSet, err = p.selectionSet(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (p *parser) selectionSet() (SelectionSet, error) {
+	if err := p.nest(); err != nil {
+		return nil, err
+	}
+	defer p.unnest()
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var set SelectionSet
+	for !p.peek(tokenPunct, "}") {
+		sel, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		set = append(set, sel)
+	}
+	if len(set) == 0 {
+		return nil, p.lex.errorf(p.tok.pos, "empty selection set")
+	}
+	return set, p.advance()
+}
+
+func (p *parser) selection() (Selection, error) {
+	if ok, err := p.skip("..."); err != nil {
+		return nil, err
+	} else if !ok {
+		return p.field()
+	}
+
+	if p.tok.kind == tokenName && p.tok.value != "on" {
+		spread := &FragmentSpread{Name: p.tok.value}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		var err error
+		spread.Directives, err = p.directives()
+		return spread, err
+	}
+	inline := &InlineFragment{}
+	var err error
+	if p.peek(tokenName, "on") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if inline.TypeCondition, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if inline.Directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if inline.SelectionSet, err = p.selectionSet(); err != nil {
+		return nil, err
+	}
+	return inline, nil
+}
+
+func (p *parser) field() (*Field, error) {
+	f := &Field{}
+	var err error
+	if f.Name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if ok, err := p.skip(":"); err != nil {
+		return nil, err
+	} else if ok {
+		f.Alias = f.Name
+		if f.Name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if f.Arguments, err = p.arguments(false); err != nil {
+		return nil, err
+	}
+	if f.Directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if p.peek(tokenPunct, "{") {
+		if f.SelectionSet, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (p *parser) arguments(isConst bool) ([]*Argument, error) {
+	if ok, err := p.skip("("); err != nil || !ok {
+		return nil, err
+	}
+	var args []*Argument
+	for !p.peek(tokenPunct, ")") {
+		arg, err := p.argument(isConst)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	if len(args) == 0 {
+		return nil, p.lex.errorf(p.tok.pos, "empty arguments")
+	}
+	return args, p.advance()
+}
+
+func (p *parser) argument(isConst bool) (*Argument, error) {
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	v, err := p.value(isConst)
+	if err != nil {
+		return nil, err
+	}
+	return &Argument{Name: name, Value: v}, nil
+}
+
+func (p *parser) directives() ([]*Directive, error) {
+	var directives []*Directive
+	for p.peek(tokenPunct, "@") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		d := &Directive{}
+		var err error
+		if d.Name, err = p.name(); err != nil {
+			return nil, err
+		}
+		if d.Arguments, err = p.arguments(false); err != nil {
+			return nil, err
+		}
+		directives = append(directives, d)
+	}
+	return directives, nil
+}
+
+// value parses a value; constant values (e.g. defaults) can't have variables
+func (p *parser) value(isConst bool) (Value, error) {
+	if err := p.nest(); err != nil {
+		return nil, err
+	}
+	defer p.unnest()
+	tok := p.tok
+	switch tok.kind {
+	case tokenInt, tokenFloat:
+		return Number(tok.value), p.advance()
+	case tokenString:
+		return tok.value, p.advance()
+	case tokenName:
+		var v Value
+		switch tok.value {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		default:
+			v = Enum(tok.value)
+		}
+		return v, p.advance()
+	case tokenPunct:
+		switch tok.value {
+		case "$":
+			if isConst {
+				return nil, p.lex.errorf(tok.pos, "unexpected variable in constant value")
+			}
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			name, err := p.name()
+			return Variable(name), err
+		case "[":
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			list := ListValue{}
+			for !p.peek(tokenPunct, "]") {
+				item, err := p.value(isConst)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, item)
+			}
+			return list, p.advance()
+		case "{":
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			obj := ObjectValue{}
+			for !p.peek(tokenPunct, "}") {
+				field, err := p.argument(isConst)
+				if err != nil {
+					return nil, err
+				}
+				obj = append(obj, field)
+			}
+			return obj, p.advance()
+		}
+	}
+	return nil, p.unexpected()
+}
+
+// validate checks the operations' names are unique and the fragments are all
+// defined, used and not cyclic
+func (d *Document) validate() error {
+	names := make(map[string]struct{}, len(d.Operations))
+	for _, op := range d.Operations {
+		if len(d.Operations) > 1 && op.Name == "" {
+			return fmt.Errorf("anonymous operations must be the only operation")
+		}
+		if _, ok := names[op.Name]; ok {
+			return fmt.Errorf("operation %s is defined more than once", op.Name)
+		}
+		names[op.Name] = struct{}{}
+	}
+	if len(d.Operations) == 0 {
+		return fmt.Errorf("document has no operations")
+	}
+
+	used := make(map[string]struct{})
+	selections := 0
+	var visit func(set SelectionSet, path []string) error
+	visit = func(set SelectionSet, path []string) error {
+		for _, sel := range set {
+			// Fragments spread several times can expand exponentially
+			if selections++; selections > MaxSelections {
+				return fmt.Errorf("document has more than %d selections", MaxSelections)
+			}
+			switch sel := sel.(type) {
+			case *Field:
+				if err := visit(sel.SelectionSet, path); err != nil {
+					return err
+				}
+			case *InlineFragment:
+				if err := visit(sel.SelectionSet, path); err != nil {
+					return err
+				}
+			case *FragmentSpread:
+				f, ok := d.Fragments[sel.Name]
+				if !ok {
+					return fmt.Errorf("fragment %s is not defined", sel.Name)
+				}
+				for _, name := range path {
+					if name == sel.Name {
+						return fmt.Errorf("fragment %s spreads itself", sel.Name)
+					}
+				}
+				used[sel.Name] = struct{}{}
+				if err := visit(f.SelectionSet, append(path, sel.Name)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	for _, op := range d.Operations {
+		if err := visit(op.SelectionSet, nil); err != nil {
+			return err
+		}
+	}
+	for name := range d.Fragments {
+		if _, ok := used[name]; !ok {
+			return fmt.Errorf("fragment %s is not used", name)
+		}
+	}
+	return nil
+}
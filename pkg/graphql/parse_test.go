@@ -0,0 +1,154 @@
+package graphql
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	doc, err := Parse(`
+		# The orders of a user
+		query Orders($user: String!, $limit: Int = 10, $full: Boolean = false) {
+			orders: prod_orders(filter: {user: $user, tags: ["a", "b"]}, limit: $limit, sort: ["-total"]) {
+				_id
+				total
+				... on Prod_orders { status }
+				...items @include(if: $full)
+				items { sku }
+			}
+		}
+
+		fragment items on Prod_orders {
+			items { qty }
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op, err := doc.Operation("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.Name != "Orders" || len(op.Variables) != 3 || op.Variables[0].Type != "String!" || op.Variables[1].Default != Number("10") {
+		t.Fatalf("unexpected operation %+v", op)
+	}
+
+	vars, err := op.CoerceVariables(map[string]json.RawMessage{"user": json.RawMessage(`"u1"`), "full": json.RawMessage("true")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, err := doc.CollectFields(op.SelectionSet, "Query", vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 1 || fields[0].ResponseKey() != "orders" || fields[0].Name != "prod_orders" {
+		t.Fatalf("unexpected fields %+v", fields)
+	}
+	filter, _ := fields[0].Argument("filter")
+	b, err := ValueJSON(filter, vars)
+	if err != nil || string(b) != `{"user":"u1","tags":["a","b"]}` {
+		t.Fatalf("unexpected filter %s: %v", b, err)
+	}
+	limit, _ := fields[0].Argument("limit")
+	if b, _ := ValueJSON(limit, vars); string(b) != "10" {
+		t.Fatalf("expected the default limit, got %s", b)
+	}
+
+	var keys []string
+	sub, err := doc.CollectFields(fields[0].SelectionSet, "Prod_orders", vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range sub {
+		keys = append(keys, f.ResponseKey())
+	}
+	if strings.Join(keys, ",") != "_id,total,status,items" {
+		t.Fatalf("unexpected fields %v", keys)
+	}
+	// The items of the fragment and the field are merged
+	if items := sub[3]; len(items.SelectionSet) != 2 {
+		t.Fatalf("expected the selections to be merged, got %+v", items.SelectionSet)
+	}
+
+	// The fragment isn't on other types, nor included without $full
+	sub, _ = doc.CollectFields(fields[0].SelectionSet, "Other", map[string]json.RawMessage{"full": json.RawMessage("false")})
+	if len(sub) != 3 || len(sub[2].SelectionSet) != 1 {
+		t.Fatalf("unexpected fields %+v", sub)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{``, "empty document"},
+		{`{ a `, "unexpected end of document"},
+		{`{ a(x: 01) }`, "invalid number"},
+		{`{ a(x: "b) }`, "unterminated string"},
+		{`{ a } { b }`, "anonymous operations must be the only operation"},
+		{`query A { a } query A { b }`, "operation A is defined more than once"},
+		{`mutation { a }`, "mutation operations are not supported"},
+		{`{ ...f }`, "fragment f is not defined"},
+		{`{ a } fragment f on T { b }`, "fragment f is not used"},
+		{`{ ...f } fragment f on T { a { ...g } } fragment g on T { ...f }`, "spreads itself"},
+		{`query($a: Int = $b) { a }`, "unexpected variable in constant value"},
+		{`{ a {} }`, "empty selection set"},
+		{"{ a(x: " + strings.Repeat("[", MaxDepth) + "1" + strings.Repeat("]", MaxDepth) + ") }", "nested deeper than"},
+		{`{ a ~ }`, "unexpected character"},
+	}
+	for i, test := range tests {
+		_, err := Parse(test.query)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("%d: expected %q, got %v", i, test.err, err)
+		}
+	}
+}
+
+func TestValues(t *testing.T) {
+	tests := []struct {
+		value string
+		json  string
+	}{
+		{`1`, `1`},
+		{`-1.5e3`, `-1.5e3`},
+		{`"a\"é\n"`, `"a\"é\n"`},
+		{`"""
+			multi
+			  line
+		"""`, `"multi\n  line"`},
+		{`true`, `true`},
+		{`null`, `null`},
+		{`ASC`, `"ASC"`},
+		{`[1, [2], {a: $v}]`, `[1,[2],{"a":{"$gt":1}}]`},
+	}
+	vars := map[string]json.RawMessage{"v": json.RawMessage(`{"$gt":1}`)}
+	for i, test := range tests {
+		doc, err := Parse(`{ f(x: ` + test.value + `) }`)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		v, _ := doc.Operations[0].SelectionSet[0].(*Field).Argument("x")
+		b, err := ValueJSON(v, vars)
+		if err != nil || string(b) != test.json {
+			t.Fatalf("%d: expected %s, got %s: %v", i, test.json, b, err)
+		}
+	}
+}
+
+func TestCoerceVariables(t *testing.T) {
+	doc, _ := Parse(`query($a: Int!, $b: String) { f(a: $a, b: $b, c: $c) }`)
+	op := doc.Operations[0]
+	if _, err := op.CoerceVariables(nil); err == nil {
+		t.Fatal("expected the non-null variable to be required")
+	}
+	vars, err := op.CoerceVariables(map[string]json.RawMessage{"a": json.RawMessage("1")})
+	if err != nil || string(vars["b"]) != "null" {
+		t.Fatalf("unexpected variables %v: %v", vars, err)
+	}
+	c, _ := op.SelectionSet[0].(*Field).Argument("c")
+	if _, err := ValueJSON(c, vars); err == nil {
+		t.Fatal("expected undefined variables to be an error")
+	}
+}
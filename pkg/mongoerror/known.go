@@ -0,0 +1,13 @@
+package mongoerror
+
+// Known returns whether the code is a known error code (String panics for
+// unknown codes)
+func (c ErrorCode) Known() (known bool) {
+	defer func() {
+		if recover() != nil {
+			known = false
+		}
+	}()
+	_ = c.String()
+	return true
+}
@@ -0,0 +1,227 @@
+package mongoproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+var (
+	abandonedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_operation_abandoned_total",
+		Help: "The total number of requests cancelled as the client disconnected before the response",
+	}, []string{"command"})
+	abandonedKillOpCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_operation_abandoned_killop_total",
+		Help: "The total number of backend killOps for abandoned requests by result",
+	}, []string{"result"})
+	orphanedReapedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_orphaned_reaped_total",
+		Help: "The total number of backend operations and cursors of abandoned requests cleaned up",
+	}, []string{"kind"})
+	maxTimeMSCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_operation_max_time_ms_total",
+		Help: "The total number of requests cancelled by the proxy after their maxTimeMS (plus maxTimeMSGrace)",
+	}, []string{"command"})
+)
+
+// abandonKillOpTimeout bounds the backend commands cleaning up after an abandoned request
+const abandonKillOpTimeout = 5 * time.Second
+
+// watchedConn is a client connection which can be watched for the client going
+// away while a request is handled; a byte read while watching is kept for the
+// next request.
+type watchedConn struct {
+	net.Conn
+	peeked []byte
+}
+
+func (c *watchedConn) Read(b []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(b, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+type abandonedKey struct{}
+
+// watch returns a context which is cancelled if the client disconnects (or
+// resets the connection) before the returned func is called. The request must
+// have been read fully as the connection is read from while watching.
+func (c *watchedConn) watch(ctx context.Context) (context.Context, func()) {
+	abandoned := new(int32)
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, abandonedKey{}, abandoned))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var b [1]byte
+		n, err := c.Conn.Read(b[:])
+		if n > 0 {
+			c.peeked = append(c.peeked, b[0])
+		}
+		if err == nil {
+			return
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return
+		}
+		atomic.StoreInt32(abandoned, 1)
+		cancel()
+	}()
+
+	return ctx, func() {
+		// Unblock the read; the deadline is reset once it returned
+		c.Conn.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		c.Conn.SetReadDeadline(time.Time{})
+		cancel()
+	}
+}
+
+// abandoned returns whether the client of the request disconnected
+func abandoned(ctx context.Context) bool {
+	a, ok := ctx.Value(abandonedKey{}).(*int32)
+	return ok && atomic.LoadInt32(a) == 1
+}
+
+// maxTimeMS returns the maxTimeMS of the command (0 if none)
+func maxTimeMS(d bson.D) time.Duration {
+	v, ok := bsonutil.Lookup(d, "maxTimeMS")
+	if !ok {
+		return 0
+	}
+	var ms int64
+	switch n := v.(type) {
+	case int32:
+		ms = int64(n)
+	case int64:
+		ms = n
+	case float64:
+		ms = int64(n)
+	}
+	if ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// abandonedCursor returns the cursor (and its namespace) left behind by the
+// abandoned command (0 if none): the cursor of the getMore or the one the
+// response opened
+func abandonedCursor(d, resp bson.D) (int64, string) {
+	if d[0].Key == "getMore" {
+		id, _ := d[0].Value.(int64)
+		db, _ := bsonutil.Lookup(d, "$db")
+		collection, _ := bsonutil.Lookup(d, "collection")
+		return id, fmt.Sprintf("%v.%v", db, collection)
+	}
+	id, _ := bsonutil.Lookup(resp, "cursor", "id")
+	ns, _ := bsonutil.Lookup(resp, "cursor", "ns")
+	cursorID, _ := id.(int64)
+	namespace, _ := ns.(string)
+	return cursorID, namespace
+}
+
+// reapAbandoned cleans up after a command whose client disconnected: the backend
+// operation (if it may still be running) and the cursor nobody will iterate,
+// which also drops its pin to the backend server.
+func (p *Proxy) reapAbandoned(d bson.D, cursorID int64, ns string, running bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), abandonKillOpTimeout)
+	defer cancel()
+
+	if running {
+		p.killAbandoned(ctx, d)
+	}
+	if cursorID != 0 {
+		p.killAbandonedCursor(ctx, cursorID, ns)
+	}
+}
+
+// killAbandonedCursor kills the cursor on the backend and removes it from the
+// cursor cache
+func (p *Proxy) killAbandonedCursor(ctx context.Context, cursorID int64, ns string) {
+	defer p.CloseCursor(cursorID)
+
+	i := strings.IndexByte(ns, '.')
+	if i < 0 {
+		return
+	}
+	resp, err := p.HandleMongo(ctx, &plugins.Request{CursorCache: p, CC: p.internalCC}, bson.D{
+		{"killCursors", ns[i+1:]},
+		{"cursors", bson.A{cursorID}},
+		{"$db", ns[:i]},
+	})
+	if err != nil || !bsonutil.Ok(resp) {
+		logrus.Debugf("Error killing abandoned cursor %d: %v %v", cursorID, err, resp)
+		return
+	}
+	killed, _ := bsonutil.Lookup(resp, "cursorsKilled")
+	if killed, ok := killed.(bson.A); ok && len(killed) > 0 {
+		orphanedReapedCounter.WithLabelValues("cursor").Inc()
+	}
+}
+
+// killAbandoned kills the backend operations of the abandoned command. The
+// backend interrupts most operations once the proxy closes the connection they
+// run on, but not all (e.g. writes), so they are looked up by the command's
+// session and killed. Commands without a session can't be found; this is best
+// effort.
+func (p *Proxy) killAbandoned(ctx context.Context, d bson.D) {
+	lsid, ok := bsonutil.Lookup(d, "lsid", "id")
+	if !ok {
+		abandonedKillOpCounter.WithLabelValues("no_session").Inc()
+		return
+	}
+	cr := p.commandRunner()
+	if cr == nil {
+		return
+	}
+
+	resp, err := cr.RunCommand(ctx, "admin", bson.D{
+		{"currentOp", 1},
+		{"lsid.id", lsid},
+		{"command." + d[0].Key, bson.D{{"$exists", true}}},
+	})
+	if err != nil {
+		logrus.Debugf("Error finding abandoned %s operations: %v", d[0].Key, err)
+		abandonedKillOpCounter.WithLabelValues("error").Inc()
+		return
+	}
+	inprog, _ := bsonutil.Lookup(resp, "inprog")
+	ops, _ := inprog.(bson.A)
+	if len(ops) == 0 {
+		// Already interrupted by the backend
+		abandonedKillOpCounter.WithLabelValues("not_found").Inc()
+		return
+	}
+	for _, op := range ops {
+		opDoc, ok := op.(bson.D)
+		if !ok {
+			continue
+		}
+		opid, ok := bsonutil.Lookup(opDoc, "opid")
+		if !ok {
+			continue
+		}
+		if _, err := cr.RunCommand(ctx, "admin", bson.D{{"killOp", 1}, {"op", opid}}); err != nil {
+			logrus.Debugf("Error killing abandoned %s operation %v: %v", d[0].Key, opid, err)
+			abandonedKillOpCounter.WithLabelValues("error").Inc()
+			continue
+		}
+		abandonedKillOpCounter.WithLabelValues("killed").Inc()
+		orphanedReapedCounter.WithLabelValues("op").Inc()
+	}
+}
@@ -0,0 +1,280 @@
+package mongoproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+	"github.com/wish/mongoproxy/pkg/mongotest"
+)
+
+// connPair returns the ends of a loopback TCP connection
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, client
+}
+
+func TestWatchedConn(t *testing.T) {
+	t.Run("next request", func(t *testing.T) {
+		server, client := connPair(t)
+		defer server.Close()
+		defer client.Close()
+		c := &watchedConn{Conn: server}
+
+		ctx, stop := c.watch(context.Background())
+		if _, err := client.Write([]byte("ab")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		stop()
+		if ctx.Err() == nil || abandoned(ctx) {
+			t.Fatalf("expected the context to be done but not abandoned")
+		}
+
+		// A byte read while watching is read first
+		if _, err := client.Write([]byte("c")); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 3)
+		if _, err := io.ReadFull(c, b); err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "abc" {
+			t.Fatalf("expected abc, got %q", b)
+		}
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		server, client := connPair(t)
+		defer server.Close()
+		c := &watchedConn{Conn: server}
+
+		ctx, stop := c.watch(context.Background())
+		defer stop()
+		client.Close()
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the context to be cancelled")
+		}
+		if !abandoned(ctx) {
+			t.Fatalf("expected the request to be abandoned")
+		}
+	})
+}
+
+func TestMaxTimeMS(t *testing.T) {
+	tests := []struct {
+		cmd      bson.D
+		expected time.Duration
+	}{
+		{bson.D{{"find", "foo"}}, 0},
+		{bson.D{{"find", "foo"}, {"maxTimeMS", int32(100)}}, 100 * time.Millisecond},
+		{bson.D{{"find", "foo"}, {"maxTimeMS", int64(2000)}}, 2 * time.Second},
+		{bson.D{{"find", "foo"}, {"maxTimeMS", 1.5}}, time.Millisecond},
+		{bson.D{{"find", "foo"}, {"maxTimeMS", int32(0)}}, 0},
+	}
+	for _, test := range tests {
+		if d := maxTimeMS(test.cmd); d != test.expected {
+			t.Fatalf("%v: expected %s, got %s", test.cmd, test.expected, d)
+		}
+	}
+}
+
+// newDeadlineProxy returns a proxy for the backend whose "find" blocks until
+// release is closed (if not nil)
+func newDeadlineProxy(t *testing.T, backend *mongotest.Server, release chan struct{}, cfg *config.Config) *Proxy {
+	if release != nil {
+		backend.Handle("find", func(database string, cmd bson.D) bson.D {
+			<-release
+			return bson.D{{"ok", 1}}
+		})
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Plugins = []config.PluginConfig{
+		{
+			Name: "mongo",
+			Config: bson.D{
+				{"connectTimeout", "1s"},
+				{"mongoAddr", backend.URI()},
+			},
+		},
+	}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewProxy(l, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Serve()
+	return proxy
+}
+
+func TestProxyMaxTimeMSGrace(t *testing.T) {
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	release := make(chan struct{})
+	defer close(release)
+
+	proxy := newDeadlineProxy(t, backend, release, &config.Config{MaxTimeMSGrace: "50ms"})
+	defer proxy.Shutdown(context.TODO())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://"+proxy.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+
+	err = client.Database("test").RunCommand(ctx, bson.D{{"find", "foo"}, {"maxTimeMS", int32(50)}}).Err()
+	if cmdErr, ok := err.(mongo.CommandError); !ok || cmdErr.Code != int32(mongoerror.MaxTimeMSExpired) {
+		t.Fatalf("expected MaxTimeMSExpired error: %v", err)
+	}
+}
+
+func TestProxyCancelAbandoned(t *testing.T) {
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	release := make(chan struct{})
+	defer close(release)
+
+	// The abandoned find is found by its session and killed
+	killed := make(chan interface{}, 1)
+	backend.Handle("currentOp", func(database string, cmd bson.D) bson.D {
+		return bson.D{{"inprog", bson.A{bson.D{{"opid", int32(7)}}}}, {"ok", 1}}
+	})
+	backend.Handle("killOp", func(database string, cmd bson.D) bson.D {
+		op, _ := cmd.Map()["op"]
+		killed <- op
+		return bson.D{{"ok", 1}}
+	})
+
+	proxy := newDeadlineProxy(t, backend, release, &config.Config{CancelAbandoned: true})
+	defer proxy.Shutdown(context.TODO())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://"+proxy.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+
+	// The driver closes the connection once the context expires
+	findCtx, findCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer findCancel()
+	if err := client.Database("test").RunCommand(findCtx, bson.D{{"find", "foo"}}).Err(); err == nil {
+		t.Fatalf("expected the find to time out")
+	}
+
+	select {
+	case op := <-killed:
+		if op != int32(7) {
+			t.Fatalf("expected op 7 to be killed, got %v", op)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the abandoned operation to be killed")
+	}
+	if len(proxy.Ops()) != 0 {
+		t.Fatalf("expected no running ops, got %v", proxy.Ops())
+	}
+
+	// Other connections are still served
+	if err := client.Database("test").RunCommand(ctx, bson.D{{"ping", 1}}).Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAbandonedCursor(t *testing.T) {
+	tests := []struct {
+		cmd        bson.D
+		resp       bson.D
+		expected   int64
+		expectedNS string
+	}{
+		{bson.D{{"find", "foo"}}, nil, 0, ""},
+		{bson.D{{"find", "foo"}}, bson.D{{"cursor", bson.D{{"id", int64(0)}, {"ns", "test.foo"}}}, {"ok", 1}}, 0, "test.foo"},
+		{bson.D{{"find", "foo"}}, bson.D{{"cursor", bson.D{{"id", int64(5)}, {"ns", "test.foo"}}}, {"ok", 1}}, 5, "test.foo"},
+		{bson.D{{"getMore", int64(6)}, {"collection", "foo"}, {"$db", "test"}}, nil, 6, "test.foo"},
+	}
+	for _, test := range tests {
+		if id, ns := abandonedCursor(test.cmd, test.resp); id != test.expected || ns != test.expectedNS {
+			t.Fatalf("%v: expected cursor %d on %s, got %d on %s", test.cmd, test.expected, test.expectedNS, id, ns)
+		}
+	}
+}
+
+func TestReapAbandoned(t *testing.T) {
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	proxy := newDeadlineProxy(t, backend, nil, &config.Config{CancelAbandoned: true})
+	defer proxy.Shutdown(context.TODO())
+
+	// Open a cursor whose response the client never read
+	run := func(cmd bson.D) bson.D {
+		resp, err := proxy.HandleMongo(context.TODO(), &plugins.Request{CursorCache: proxy, CC: proxy.internalCC}, cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	run(bson.D{{"insert", "bar"}, {"documents", bson.A{bson.D{{"_id", 1}}, bson.D{{"_id", 2}}}}, {"$db", "test"}})
+	find := bson.D{
+		{"find", "bar"},
+		{"batchSize", int32(1)},
+		{"$db", "test"},
+	}
+	resp := run(find)
+	cursorID, ns := abandonedCursor(find, resp)
+	if cursorID == 0 {
+		t.Fatalf("expected a cursor: %v", resp)
+	}
+
+	// The cursor is killed; as the command finished there is no operation to kill
+	proxy.reapAbandoned(find, cursorID, ns, false)
+	for cmd, expected := range map[string]int64{"currentOp": 0, "killCursors": 1} {
+		if n := backend.CommandCount(cmd); n != expected {
+			t.Fatalf("expected %d %s, got %d", expected, cmd, n)
+		}
+	}
+	if n := proxy.cursorCache.Count(); n != 0 {
+		t.Fatalf("expected the cursor to be removed from the cache, got %d cursors", n)
+	}
+}
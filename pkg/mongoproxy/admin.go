@@ -0,0 +1,326 @@
+package mongoproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+// adminPluginsPath is the prefix of the plugin admin endpoints
+const adminPluginsPath = "/admin/plugins"
+
+var (
+	errPluginNotFound  = errors.New("plugin not found")
+	errPluginAmbiguous = errors.New("multiple plugins with the same name")
+)
+
+// AdminHandler returns an http.Handler for the admin API:
+//
+//	GET  /admin/connections              list the open client connections
+//	GET  /admin/ops                      list the running requests
+//	POST /admin/ops/{id}/kill            cancel a running request
+//	POST /admin/cursors/{id}/kill        kill a cursor (on the backend and in the proxy)
+//	GET  /admin/readonly                 show whether read-only mode is enabled
+//	POST /admin/readonly/{on,off}        toggle read-only mode (write commands are rejected)
+//	GET  /admin/plugins                  list the plugin configs
+//	POST /admin/plugins/{name}/enable    enable the plugin
+//	POST /admin/plugins/{name}/disable   disable the plugin
+//	PUT  /admin/plugins/{name}/config    replace the plugin config (extended JSON body)
+//	*    /admin/plugins/{name}/api/...   plugin specific endpoints (see plugins.AdminHandler)
+//	GET  /admin/changes                  list the config and schema changes, newest first
+//	                                     (optional kind, since (RFC3339) and limit params)
+//	GET  /admin/namespaces               the stats of the requests by namespace (optional db param)
+//	GET  /admin/slow                     the slowest recent requests with the time of their
+//	                                     phases, slowest first (optional limit param)
+//	GET  /admin/events                   stream live events as JSON lines (optional comma
+//	                                     separated type param, e.g. violation,topology)
+//
+// Plugin changes are applied with an atomic swap of the plugin chain and are not
+// persisted to the config file. Changes are recorded in the change history as made
+// by the basic auth user of the request (or its remote address).
+func (p *Proxy) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/connections", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, p.Connections())
+	})
+	mux.HandleFunc("/admin/ops", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, p.Ops())
+	})
+	mux.HandleFunc("/admin/ops/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/ops/"), "/")
+		if len(parts) != 2 || parts[1] != "kill" || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		id, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		found := p.KillOp(id)
+		auditKill("op", id, "admin", nil, found)
+		if !found {
+			http.Error(w, "op not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, map[string]int64{"killed": id})
+	})
+	mux.HandleFunc("/admin/cursors/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/cursors/"), "/")
+		if len(parts) != 2 || parts[1] != "kill" || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		id, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = p.KillCursor(r.Context(), id)
+		auditKill("cursor", id, "admin", nil, err == nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, map[string]int64{"killed": id})
+	})
+	mux.HandleFunc("/admin/readonly", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]bool{"readOnly": p.ReadOnly()})
+	})
+	mux.HandleFunc("/admin/readonly/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		switch strings.TrimPrefix(r.URL.Path, "/admin/readonly/") {
+		case "on":
+			p.setReadOnlyBy(adminUser(r), true)
+		case "off":
+			p.setReadOnlyBy(adminUser(r), false)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, map[string]bool{"readOnly": p.ReadOnly()})
+	})
+	mux.HandleFunc(adminPluginsPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		p.writePluginConfigs(w)
+	})
+	mux.HandleFunc(adminPluginsPath+"/", p.handleAdminPlugin)
+	mux.HandleFunc("/admin/changes", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var since time.Time
+		if v := q.Get("since"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "invalid since: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			since = t
+		}
+		var limit int
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid limit: "+v, http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		writeJSON(w, p.Changes(q.Get("kind"), since, limit))
+	})
+	mux.HandleFunc("/admin/namespaces", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, p.NamespaceStats(r.URL.Query().Get("db")))
+	})
+	mux.HandleFunc("/admin/slow", func(w http.ResponseWriter, r *http.Request) {
+		var limit int
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid limit: "+v, http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		if p.phases == nil {
+			http.Error(w, "requestPhases is not enabled", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, p.SlowRequests(limit))
+	})
+	mux.HandleFunc("/admin/events", serveEvents)
+	return mux
+}
+
+// adminUser returns who made an admin request: the basic auth user or else the
+// remote address
+func adminUser(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok {
+		return user
+	}
+	return r.RemoteAddr
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (p *Proxy) writePluginConfigs(w http.ResponseWriter) {
+	b, err := bson.MarshalExtJSON(bson.D{{"plugins", p.PluginConfigs()}}, false, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (p *Proxy) handleAdminPlugin(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, adminPluginsPath+"/"), "/")
+	if len(parts) > 2 && parts[1] == "api" {
+		p.servePluginAPI(w, r, parts[0])
+		return
+	}
+	if len(parts) != 2 || parts[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+	name, action := parts[0], parts[1]
+
+	var update func(*config.PluginConfig) error
+	switch {
+	case action == "enable" && r.Method == http.MethodPost:
+		update = func(pc *config.PluginConfig) error {
+			enabled := true
+			pc.Enabled = &enabled
+			return nil
+		}
+	case action == "disable" && r.Method == http.MethodPost:
+		update = func(pc *config.PluginConfig) error {
+			enabled := false
+			pc.Enabled = &enabled
+			return nil
+		}
+	case action == "config" && r.Method == http.MethodPut:
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var d bson.D
+		if err := bson.UnmarshalExtJSON(b, false, &d); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		update = func(pc *config.PluginConfig) error {
+			pc.Config = d
+			return nil
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	err := p.updatePlugin(WithChangeAuthor(r.Context(), "admin", adminUser(r)), name, update)
+	switch err {
+	case nil:
+	case errPluginNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errPluginAmbiguous:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		http.Error(w, fmt.Sprintf("error updating plugin %s: %v", name, err), http.StatusBadRequest)
+		return
+	}
+
+	p.writePluginConfigs(w)
+}
+
+// setReadOnlyBy sets read-only mode on behalf of the admin user, recording the
+// change in the change history
+func (p *Proxy) setReadOnlyBy(user string, readOnly bool) {
+	old := p.ReadOnly()
+	p.SetReadOnly(readOnly)
+	logrus.Infof("read-only mode set to %v", readOnly)
+	if old != readOnly {
+		p.changes.RecordChange(plugins.Change{
+			Kind:   "readOnly",
+			Source: "admin",
+			User:   user,
+			Diff:   []string{fmt.Sprintf("- readOnly %v", old), fmt.Sprintf("+ readOnly %v", readOnly)},
+		})
+	}
+}
+
+// updatePlugin applies update to the config of the named plugin, returning
+// errPluginNotFound or errPluginAmbiguous if there isn't exactly one
+func (p *Proxy) updatePlugin(ctx context.Context, name string, update func(*config.PluginConfig) error) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	return p.UpdatePlugins(ctx, func(pcs []config.PluginConfig) ([]config.PluginConfig, error) {
+		idx := -1
+		for i, pc := range pcs {
+			if pc.Name == name {
+				if idx >= 0 {
+					return nil, errPluginAmbiguous
+				}
+				idx = i
+			}
+		}
+		if idx < 0 {
+			return nil, errPluginNotFound
+		}
+		if err := update(&pcs[idx]); err != nil {
+			return nil, err
+		}
+		return pcs, nil
+	})
+}
+
+// servePluginAPI passes the request to the AdminHandler of the named plugin
+func (p *Proxy) servePluginAPI(w http.ResponseWriter, r *http.Request, name string) {
+	p.chainLock.RLock()
+	c := p.chain
+	p.chainLock.RUnlock()
+
+	for _, pl := range c.plugins {
+		if pl.Name() != name {
+			continue
+		}
+		h, ok := plugins.Unwrap(pl).(plugins.AdminHandler)
+		if !ok {
+			break
+		}
+		http.StripPrefix(adminPluginsPath+"/"+name+"/api", h.AdminHandler()).ServeHTTP(w, r)
+		return
+	}
+	http.Error(w, "no admin api for plugin "+name, http.StatusNotFound)
+}
+
+// Reload replaces the plugin chain with the plugins from cfg
+func (p *Proxy) Reload(ctx context.Context, cfg *config.Config) error {
+	return p.UpdatePlugins(ctx, func([]config.PluginConfig) ([]config.PluginConfig, error) {
+		return cfg.Plugins, nil
+	})
+}
@@ -0,0 +1,241 @@
+package mongoproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+	"github.com/wish/mongoproxy/pkg/mongotest"
+)
+
+func TestAdminPlugins(t *testing.T) {
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		Plugins: []config.PluginConfig{
+			{
+				Name:   "filtercommand",
+				Config: bson.D{{"filterCommands", bson.A{"count"}}},
+			},
+			{
+				Name: "mongo",
+				Config: bson.D{
+					{"connectTimeout", "1s"},
+					{"mongoAddr", backend.URI()},
+				},
+			},
+		},
+	}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(l, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Serve()
+	defer proxy.Shutdown(context.TODO())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://"+proxy.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+
+	countOk := func() bool {
+		return client.Database("test").RunCommand(ctx, bson.D{{"count", "foo"}}).Err() == nil
+	}
+
+	mongoPlugin := proxy.chain.plugins[1]
+
+	admin := httptest.NewServer(proxy.AdminHandler())
+	defer admin.Close()
+	do := func(method, path, body string) int {
+		req, err := http.NewRequest(method, admin.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	tests := []struct {
+		method, path, body string
+		status             int
+		countOk            bool
+	}{
+		{"GET", "/admin/plugins", "", http.StatusOK, false},
+		{"POST", "/admin/plugins/filtercommand/disable", "", http.StatusOK, true},
+		{"POST", "/admin/plugins/filtercommand/enable", "", http.StatusOK, false},
+		{"PUT", "/admin/plugins/filtercommand/config", `{"filterCommands": ["insert"]}`, http.StatusOK, true},
+		{"PUT", "/admin/plugins/filtercommand/config", `{"unknownOption": 1}`, http.StatusBadRequest, true},
+		{"POST", "/admin/plugins/unknown/disable", "", http.StatusNotFound, true},
+		{"GET", "/admin/plugins/filtercommand/disable", "", http.StatusNotFound, true},
+	}
+
+	for i, test := range tests {
+		if status := do(test.method, test.path, test.body); status != test.status {
+			t.Fatalf("%d: mismatch in status expected=%d actual=%d", i, test.status, status)
+		}
+		if ok := countOk(); ok != test.countOk {
+			t.Fatalf("%d: mismatch in count ok expected=%v actual=%v", i, test.countOk, ok)
+		}
+	}
+
+	// The unchanged mongo plugin should have been reused throughout
+	if proxy.chain.plugins[len(proxy.chain.plugins)-1] != mongoPlugin {
+		t.Fatalf("mongo plugin was not reused")
+	}
+
+	// The successful changes were recorded, newest first
+	changes := proxy.Changes("plugins", time.Time{}, 0)
+	if len(changes) != 3 {
+		t.Fatalf("expected 3 changes, got %v", changes)
+	}
+	if c := changes[0]; c.Source != "admin" || !strings.HasPrefix(c.User, "127.0.0.1:") || len(c.Diff) != 2 ||
+		!strings.Contains(c.Diff[1], "insert") {
+		t.Fatalf("unexpected change %+v", c)
+	}
+	if status := do("GET", "/admin/changes?kind=plugins&limit=1", ""); status != http.StatusOK {
+		t.Fatalf("expected 200 listing changes, got %d", status)
+	}
+	if status := do("GET", "/admin/changes?since=yesterday", ""); status != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid since, got %d", status)
+	}
+}
+
+func TestAdminOps(t *testing.T) {
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	// Block the "find" until the op is killed
+	release := make(chan struct{})
+	defer close(release)
+	backend.Handle("find", func(database string, cmd bson.D) bson.D {
+		<-release
+		return bson.D{{"ok", 1}}
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		Plugins: []config.PluginConfig{
+			{
+				Name: "mongo",
+				Config: bson.D{
+					{"connectTimeout", "1s"},
+					{"mongoAddr", backend.URI()},
+				},
+			},
+		},
+	}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewProxy(l, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Serve()
+	defer proxy.Shutdown(context.TODO())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://"+proxy.Addr()).SetAppName("opsTest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- client.Database("test").RunCommand(ctx, bson.D{{"find", "foo"}}).Err()
+	}()
+
+	var op Op
+	for start := time.Now(); op.ID == 0; {
+		for _, o := range proxy.Ops() {
+			if o.CommandName == "find" {
+				op = o
+			}
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("find op not found")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if op.AppName != "opsTest" || op.Database != "test" || op.Collection != "foo" {
+		t.Fatalf("mismatch in op: %+v", op)
+	}
+
+	found := false
+	for _, conn := range proxy.Connections() {
+		if conn.AppName == "opsTest" {
+			found = true
+			if conn.ClientMetadata == nil || conn.ClientMetadata.Driver.Name == "" {
+				t.Fatalf("missing client metadata: %+v", conn)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("connection not found")
+	}
+
+	// Kill it as a client would
+	killOp := bson.D{{"killOp", 1}, {"op", plugins.ProxyOpPrefix + strconv.FormatInt(op.ID, 10)}}
+	if err := client.Database("admin").RunCommand(ctx, killOp).Err(); err != nil {
+		t.Fatalf("error killing op: %v", err)
+	}
+	if err := <-errCh; err == nil {
+		t.Fatalf("expected error from killed op")
+	} else if cmdErr, ok := err.(mongo.CommandError); !ok || cmdErr.Code != int32(mongoerror.Interrupted) {
+		t.Fatalf("expected Interrupted error from killed op: %v", err)
+	}
+	if proxy.KillOp(op.ID) {
+		t.Fatalf("op should be gone")
+	}
+
+	// Read-only mode
+	proxy.SetReadOnly(true)
+	if _, err := client.Database("test").Collection("foo").InsertOne(ctx, bson.D{{"a", 1}}); err == nil {
+		t.Fatalf("expected insert to fail in read-only mode")
+	}
+	proxy.SetReadOnly(false)
+	if _, err := client.Database("test").Collection("foo").InsertOne(ctx, bson.D{{"a", 1}}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,199 @@
+package mongoproxy
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+)
+
+var (
+	userBytesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_client_user_bytes_total",
+		Help: "The total bytes of the requests (in) and responses (out) of each user",
+	}, []string{"user", "direction"})
+	namespaceBytesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_client_namespace_bytes_total",
+		Help: "The total bytes of the requests (in) and responses (out) on each namespace",
+	}, []string{"db", "collection", "direction"})
+	bandwidthThrottledCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_client_bandwidth_throttled_total",
+		Help: "The total requests delayed for exceeding a bandwidth quota",
+	}, []string{"quota"})
+	bandwidthDelayCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_client_bandwidth_delay_seconds_total",
+		Help: "The total time requests were delayed for exceeding a bandwidth quota",
+	}, []string{"quota"})
+)
+
+// byteBucket is a token bucket of bytes which may go into debt: a request is
+// always let through, and its excess over the available bytes delays the next
+// requests until the bucket refills
+type byteBucket struct {
+	l      sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newByteBucket(q *config.BandwidthQuotaConfig, now time.Time) *byteBucket {
+	return &byteBucket{
+		rate:   float64(q.BytesPerSecond),
+		burst:  float64(q.BurstBytes),
+		tokens: float64(q.BurstBytes),
+		last:   now,
+	}
+}
+
+// take takes n bytes from the bucket, returning how long until it is out of debt
+func (b *byteBucket) take(n int64, now time.Time) time.Duration {
+	b.l.Lock()
+	defer b.l.Unlock()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// bandwidthQuota is a quota and the buckets of the clients sharing its allowances
+type bandwidthQuota struct {
+	conf     *config.BandwidthQuotaConfig
+	users    map[string]struct{}
+	appNames map[string]struct{}
+
+	l sync.Mutex
+	// buckets are the buckets of the users (by user), or of the quota ("")
+	buckets map[string]*byteBucket
+}
+
+// matches returns whether the quota applies to the connection's client
+func (q *bandwidthQuota) matches(c *conn, user string) bool {
+	if len(q.users) == 0 && len(q.appNames) == 0 {
+		return true
+	}
+	if _, ok := q.users[user]; ok && user != "" {
+		return true
+	}
+	_, ok := q.appNames[c.cc.AppName]
+	return ok
+}
+
+// bucket returns the bucket of the connection's client
+func (q *bandwidthQuota) bucket(c *conn, user string, now time.Time) *byteBucket {
+	var key string
+	switch q.conf.Per {
+	case config.BandwidthPerConnection:
+		if c.quotas == nil {
+			c.quotas = make(map[*bandwidthQuota]*byteBucket)
+		}
+		b, ok := c.quotas[q]
+		if !ok {
+			b = newByteBucket(q.conf, now)
+			c.quotas[q] = b
+		}
+		return b
+	case config.BandwidthPerUser:
+		key = user
+	}
+	q.l.Lock()
+	defer q.l.Unlock()
+	b, ok := q.buckets[key]
+	if !ok {
+		b = newByteBucket(q.conf, now)
+		q.buckets[key] = b
+	}
+	return b
+}
+
+// bandwidth accounts the bytes of the client requests and throttles the clients
+// exceeding their quotas
+type bandwidth struct {
+	conf   *config.BandwidthConfig
+	quotas []*bandwidthQuota
+}
+
+func newBandwidth(conf *config.BandwidthConfig) *bandwidth {
+	b := &bandwidth{conf: conf}
+	for i := range conf.Quotas {
+		q := &bandwidthQuota{
+			conf:     &conf.Quotas[i],
+			users:    make(map[string]struct{}),
+			appNames: make(map[string]struct{}),
+			buckets:  make(map[string]*byteBucket),
+		}
+		for _, user := range q.conf.Users {
+			q.users[user] = struct{}{}
+		}
+		for _, appName := range q.conf.AppNames {
+			q.appNames[appName] = struct{}{}
+		}
+		b.quotas = append(b.quotas, q)
+	}
+	return b
+}
+
+// connUser returns the (first) authenticated user of the connection ("" if none)
+func connUser(c *conn) string {
+	if c.cc == nil || len(c.cc.Identities) == 0 {
+		return ""
+	}
+	return c.cc.Identities[0].User()
+}
+
+// record accounts the bytes of a request on the namespace ("" if unknown) of the
+// connection, returning how long the connection must wait before its next request
+func (b *bandwidth) record(c *conn, ns string, in, out int64, now time.Time) time.Duration {
+	atomic.AddInt64(&c.bytesIn, in)
+	atomic.AddInt64(&c.bytesOut, out)
+	if b == nil {
+		return 0
+	}
+
+	user := connUser(c)
+	if b.conf.UserMetrics {
+		userBytesCounter.WithLabelValues(user, "in").Add(float64(in))
+		userBytesCounter.WithLabelValues(user, "out").Add(float64(out))
+	}
+	if b.conf.NamespaceMetrics && ns != "" {
+		db, collection := ns, ""
+		if i := strings.IndexByte(ns, '.'); i != -1 {
+			db, collection = ns[:i], ns[i+1:]
+		}
+		namespaceBytesCounter.WithLabelValues(db, collection, "in").Add(float64(in))
+		namespaceBytesCounter.WithLabelValues(db, collection, "out").Add(float64(out))
+	}
+
+	var wait time.Duration
+	for _, q := range b.quotas {
+		if !q.matches(c, user) {
+			continue
+		}
+		d := q.bucket(c, user, now).take(in+out, now)
+		if d <= 0 {
+			continue
+		}
+		if d > q.conf.MaxDelayDuration {
+			d = q.conf.MaxDelayDuration
+		}
+		bandwidthThrottledCounter.WithLabelValues(q.conf.Name).Inc()
+		bandwidthDelayCounter.WithLabelValues(q.conf.Name).Add(d.Seconds())
+		if d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
@@ -0,0 +1,99 @@
+package mongoproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func TestBandwidth(t *testing.T) {
+	cfg := &config.Config{
+		Bandwidth: &config.BandwidthConfig{
+			Quotas: []config.BandwidthQuotaConfig{
+				// 1000 bytes/s shared by the connections of each user
+				{Name: "users", Users: []string{"alice", "bob"}, BytesPerSecond: 1000},
+				// 1000 bytes/s per connection of the reporting app
+				{Name: "reporting", AppNames: []string{"reporting"}, Per: config.BandwidthPerConnection, BytesPerSecond: 1000, MaxDelay: "2s"},
+				// 10000 bytes/s shared by all the clients of the batch app
+				{Name: "batch", AppNames: []string{"batch"}, Per: config.BandwidthPerQuota, BytesPerSecond: 10000},
+			},
+		},
+	}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+	b := newBandwidth(cfg.Bandwidth)
+
+	newConn := func(appName, user string) *conn {
+		cc := plugins.NewClientConnection()
+		cc.AppName = appName
+		if user != "" {
+			cc.Identities = []plugins.ClientIdentity{plugins.NewStaticIdentity("test", user)}
+		}
+		return &conn{cc: cc}
+	}
+	alice1, alice2, bob := newConn("web", "alice"), newConn("web", "alice"), newConn("web", "bob")
+	reporting1, reporting2 := newConn("reporting", ""), newConn("reporting", "")
+	batch1, batch2 := newConn("batch", ""), newConn("batch", "")
+	other := newConn("web", "carol")
+
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	tests := []struct {
+		c    *conn
+		in   int64
+		out  int64
+		now  time.Time
+		wait time.Duration
+	}{
+		// The burst (a second of bytes) is allowed, and the excess delays the client
+		{c: alice1, in: 100, out: 900, now: at(0)},
+		{c: alice2, in: 100, out: 400, now: at(0), wait: 500 * time.Millisecond},
+		// The bucket refills at the rate
+		{c: alice1, in: 100, out: 0, now: at(500), wait: 100 * time.Millisecond},
+		// Each user has its own allowance
+		{c: bob, in: 100, out: 900, now: at(0)},
+		// Clients without a quota aren't throttled
+		{c: other, in: 100, out: 100000, now: at(0)},
+		// Each connection has its own allowance, and delays are capped at maxDelay
+		{c: reporting1, in: 100, out: 5000, now: at(0), wait: 2 * time.Second},
+		{c: reporting2, in: 100, out: 900, now: at(0)},
+		// The excess over maxDelay delays the next requests
+		{c: reporting1, in: 100, out: 0, now: at(2000), wait: 2 * time.Second},
+		// All the clients of the quota share its allowance
+		{c: batch1, in: 100, out: 9900, now: at(0)},
+		{c: batch2, in: 100, out: 900, now: at(0), wait: 100 * time.Millisecond},
+	}
+	for i, test := range tests {
+		if wait := b.record(test.c, "db.coll", test.in, test.out, test.now); wait != test.wait {
+			t.Fatalf("%d: expected to wait %s, got %s", i, test.wait, wait)
+		}
+	}
+
+	if alice1.bytesIn != 200 || alice1.bytesOut != 900 {
+		t.Fatalf("unexpected bytes of the connection: %d in, %d out", alice1.bytesIn, alice1.bytesOut)
+	}
+	// The bytes are counted per connection without a bandwidth config
+	var none *bandwidth
+	if wait := none.record(other, "db.coll", 10, 20, start); wait != 0 || other.bytesIn != 110 || other.bytesOut != 100020 {
+		t.Fatalf("unexpected bytes of the connection: %d in, %d out (wait %s)", other.bytesIn, other.bytesOut, wait)
+	}
+}
+
+func TestBandwidthConfig(t *testing.T) {
+	tests := []config.BandwidthQuotaConfig{
+		{Name: "", BytesPerSecond: 1000},
+		{Name: "q", BytesPerSecond: 0},
+		{Name: "q", BytesPerSecond: 1000, Per: "app"},
+		{Name: "q", BytesPerSecond: 1000, BurstBytes: -1},
+		{Name: "q", BytesPerSecond: 1000, MaxDelay: "0s"},
+	}
+	for i, q := range tests {
+		cfg := &config.Config{Bandwidth: &config.BandwidthConfig{Quotas: []config.BandwidthQuotaConfig{q}}}
+		if err := cfg.Load(); err == nil {
+			t.Fatalf("%d: expected an error", i)
+		}
+	}
+}
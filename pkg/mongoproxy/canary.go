@@ -0,0 +1,83 @@
+package mongoproxy
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+var (
+	canaryRequestSummary = promauto.NewSummaryVec(prometheus.SummaryOpts{
+		Name:       "mongoproxy_canary_request_duration_seconds",
+		Help:       "Summary of requests by canary group",
+		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001, 1.0: 0.0},
+		MaxAge:     time.Minute,
+	}, []string{"group", "status"})
+	canaryConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_canary_connections_total",
+		Help: "The total number of client connections assigned to each canary group",
+	}, []string{"group"})
+)
+
+const (
+	groupBaseline = "baseline"
+	groupCanary   = "canary"
+)
+
+// canaryKey is the ClientConnection.Map key for whether the connection was
+// (randomly) selected for the canary
+type canaryKey struct{}
+
+// assignCanary randomly assigns the connection to the canary group based on the
+// configured percent. This is done once per connection so that all requests
+// (including cursors) from a connection use the same chain.
+func (p *Proxy) assignCanary(cc *plugins.ClientConnection) {
+	if p.canary == nil {
+		return
+	}
+	canary := rand.Float64()*100 < p.cfg.Canary.Percent
+	cc.Map[canaryKey{}] = canary
+	if canary {
+		canaryConnections.WithLabelValues(groupCanary).Inc()
+	} else {
+		canaryConnections.WithLabelValues(groupBaseline).Inc()
+	}
+}
+
+// acquireChain returns the chain (and canary group) to use for the connection.
+// The caller must call chain.inflight.Done() once the request is finished.
+func (p *Proxy) acquireChain(cc *plugins.ClientConnection) (*chain, string) {
+	group := p.canaryGroup(cc)
+	if group == groupCanary {
+		// The canary chain is never swapped
+		p.canary.inflight.Add(1)
+		return p.canary, group
+	}
+
+	p.chainLock.RLock()
+	c := p.chain
+	c.inflight.Add(1)
+	p.chainLock.RUnlock()
+	return c, group
+}
+
+// canaryGroup returns the canary group of the connection ("" if there is no canary)
+func (p *Proxy) canaryGroup(cc *plugins.ClientConnection) string {
+	if p.canary == nil {
+		return ""
+	}
+	if cc == nil {
+		return groupBaseline
+	}
+	if _, ok := p.canaryAppNames[cc.AppName]; ok && cc.AppName != "" {
+		return groupCanary
+	}
+	if canary, _ := cc.Map[canaryKey{}].(bool); canary {
+		return groupCanary
+	}
+	return groupBaseline
+}
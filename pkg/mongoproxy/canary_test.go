@@ -0,0 +1,92 @@
+package mongoproxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongotest"
+)
+
+func TestCanary(t *testing.T) {
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mongoPlugin := config.PluginConfig{
+		Name: "mongo",
+		Config: bson.D{
+			{"connectTimeout", "1s"},
+			{"mongoAddr", backend.URI()},
+		},
+	}
+	cfg := &config.Config{
+		Plugins: []config.PluginConfig{mongoPlugin},
+		Canary: &config.CanaryConfig{
+			Plugins: []config.PluginConfig{
+				{
+					Name:   "filtercommand",
+					Config: bson.D{{"filterCommands", bson.A{"count"}}},
+				},
+				mongoPlugin,
+			},
+			AppNames: []string{"canaryApp"},
+		},
+	}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(l, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Serve()
+	defer proxy.Shutdown(context.TODO())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, test := range []struct {
+		appName string
+		ok      bool
+	}{
+		{"baselineApp", true},
+		{"canaryApp", false},
+	} {
+		client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://"+proxy.Addr()).SetAppName(test.appName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.Database("test").RunCommand(ctx, bson.D{{"count", "foo"}}).Err()
+		client.Disconnect(ctx)
+		if (err == nil) != test.ok {
+			t.Fatalf("%s: mismatch in count result expected ok=%v err=%v", test.appName, test.ok, err)
+		}
+	}
+}
+
+func TestCanaryConfig(t *testing.T) {
+	cfg := &config.Config{
+		Canary: &config.CanaryConfig{
+			Plugins: []config.PluginConfig{{Name: "filtercommand"}},
+			Percent: 101,
+		},
+	}
+	if err := cfg.Load(); err == nil {
+		t.Fatalf("expected error for invalid percent")
+	}
+}
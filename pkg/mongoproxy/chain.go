@@ -0,0 +1,192 @@
+package mongoproxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+// chain is a started plugin chain
+type chain struct {
+	plugins []plugins.Plugin
+	// keys are the config keys of the plugins (used to reuse unchanged plugins on reconfigure)
+	keys       []string
+	pipe       plugins.PipelineFunc
+	postCommit *plugins.PostCommitDispatcher
+	// rawBatches is set if no plugin reads cursor batches (see plugins.BatchReader)
+	rawBatches bool
+	// rawDocuments is set if no plugin reads the documents of inserts (see
+	// plugins.DocumentReader)
+	rawDocuments bool
+
+	// inflight tracks the requests running through the chain
+	inflight sync.WaitGroup
+}
+
+// newChain builds a chain for the given plugins and starts the plugins in start
+// (the others are assumed to already be running).
+func (p *Proxy) newChain(ps []plugins.Plugin, keys []string, start []plugins.Plugin) (*chain, error) {
+	if err := plugins.CheckTransactionRunnerUsers(ps); err != nil {
+		return nil, err
+	}
+	c := &chain{
+		plugins:      ps,
+		keys:         keys,
+		pipe:         plugins.BuildPipeline(ps, p.baseRequestHandler),
+		postCommit:   plugins.NewPostCommitDispatcher(ps, p.cfg.PostCommitWorkers, p.cfg.PostCommitQueueSize),
+		rawBatches:   !plugins.ReadsBatches(ps),
+		rawDocuments: !plugins.ReadsDocuments(ps),
+	}
+
+	plugins.SetCommandRunners(ps)
+	plugins.SetTransactionRunners(ps)
+	plugins.SetSchemaProviders(ps)
+	plugins.SetCoordinators(ps)
+	plugins.SetClusterStateProviders(ps)
+	plugins.SetChangeRecorders(ps, p.changes)
+	if err := plugins.StartPlugins(context.TODO(), start); err != nil {
+		c.postCommit.Close(context.TODO())
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// newChainFromConfig builds and starts a chain for the given plugin configs
+func (p *Proxy) newChainFromConfig(pluginConfigs []config.PluginConfig) (*chain, error) {
+	configs := config.EnabledPlugins(pluginConfigs)
+	ps := make([]plugins.Plugin, len(configs))
+	keys := make([]string, len(configs))
+	for i, pc := range configs {
+		pl, err := pc.Build()
+		if err != nil {
+			return nil, err
+		}
+		key, err := pc.Key()
+		if err != nil {
+			return nil, err
+		}
+		ps[i], keys[i] = pl, key
+	}
+	return p.newChain(ps, keys, ps)
+}
+
+// close waits for in-flight requests and post-commit hooks to finish and then
+// stops the plugins in stop
+func (c *chain) close(ctx context.Context, stop []plugins.Plugin) error {
+	if c == nil {
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if err := c.postCommit.Close(ctx); err != nil {
+		return err
+	}
+	return plugins.StopPlugins(ctx, stop)
+}
+
+// health returns an error if any of the plugins are unhealthy
+func (c *chain) health(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+	return plugins.CheckHealth(ctx, c.plugins)
+}
+
+// PluginConfigs returns a copy of the current (main chain) plugin configs
+func (p *Proxy) PluginConfigs() []config.PluginConfig {
+	p.reconfigureLock.Lock()
+	defer p.reconfigureLock.Unlock()
+	return append([]config.PluginConfig(nil), p.cfg.Plugins...)
+}
+
+// UpdatePlugins atomically replaces the main plugin chain with one built from
+// the configs returned by f (which is passed a copy of the current configs).
+// Plugins whose config is unchanged are reused; new (or changed) plugins are
+// started before the swap and removed plugins are stopped once the requests
+// in-flight on the old chain have finished.
+func (p *Proxy) UpdatePlugins(ctx context.Context, f func([]config.PluginConfig) ([]config.PluginConfig, error)) error {
+	p.reconfigureLock.Lock()
+	defer p.reconfigureLock.Unlock()
+
+	pluginConfigs, err := f(append([]config.PluginConfig(nil), p.cfg.Plugins...))
+	if err != nil {
+		return err
+	}
+
+	p.chainLock.RLock()
+	old := p.chain
+	p.chainLock.RUnlock()
+
+	// Index the existing plugins so unchanged ones can be reused
+	existing := make(map[string][]plugins.Plugin, len(old.keys))
+	for i, key := range old.keys {
+		existing[key] = append(existing[key], old.plugins[i])
+	}
+
+	configs := config.EnabledPlugins(pluginConfigs)
+	ps := make([]plugins.Plugin, len(configs))
+	keys := make([]string, len(configs))
+	reused := make(map[plugins.Plugin]struct{}, len(configs))
+	var added []plugins.Plugin
+	for i, pc := range configs {
+		key, err := pc.Key()
+		if err != nil {
+			return err
+		}
+		keys[i] = key
+		if candidates := existing[key]; len(candidates) > 0 {
+			ps[i] = candidates[0]
+			existing[key] = candidates[1:]
+			reused[ps[i]] = struct{}{}
+			continue
+		}
+		pl, err := pc.Build()
+		if err != nil {
+			return fmt.Errorf("error building plugin %s: %w", pc.Name, err)
+		}
+		ps[i] = pl
+		added = append(added, pl)
+	}
+
+	c, err := p.newChain(ps, keys, added)
+	if err != nil {
+		return err
+	}
+
+	p.chainLock.Lock()
+	p.chain = c
+	p.chainLock.Unlock()
+	source, user := getChangeAuthor(ctx)
+	p.changes.RecordChange(plugins.Change{
+		Kind:   "plugins",
+		Source: source,
+		User:   user,
+		Diff:   plugins.DiffLines(pluginConfigLines(p.cfg.Plugins), pluginConfigLines(pluginConfigs)),
+	})
+	p.cfg.Plugins = pluginConfigs
+	logrus.Infof("plugin chain updated: %d plugins (%d new)", len(ps), len(added))
+
+	var removed []plugins.Plugin
+	for _, pl := range old.plugins {
+		if _, ok := reused[pl]; !ok {
+			removed = append(removed, pl)
+		}
+	}
+	return old.close(ctx, removed)
+}
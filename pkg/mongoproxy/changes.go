@@ -0,0 +1,213 @@
+package mongoproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+var (
+	changesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_config_changes_total",
+		Help: "The total config and schema changes applied to the proxy",
+	}, []string{"kind", "source"})
+	changeHistoryErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mongoproxy_config_change_history_errors_total",
+		Help: "The total errors persisting the change history",
+	})
+)
+
+type changeAuthorKey struct{}
+
+type changeAuthor struct {
+	source, user string
+}
+
+// WithChangeAuthor returns a context recording the changes made with it (e.g. by
+// Reload or UpdatePlugins) as coming from the source and made by the user (if known)
+func WithChangeAuthor(ctx context.Context, source, user string) context.Context {
+	return context.WithValue(ctx, changeAuthorKey{}, changeAuthor{source, user})
+}
+
+// getChangeAuthor returns the source and user of changes made with the context
+func getChangeAuthor(ctx context.Context) (string, string) {
+	if a, ok := ctx.Value(changeAuthorKey{}).(changeAuthor); ok {
+		return a.source, a.user
+	}
+	return "api", ""
+}
+
+// changeHistory is the history of the changes applied to the proxy, persisted
+// to a file of JSON lines if configured
+type changeHistory struct {
+	cfg *config.ChangeHistoryConfig
+
+	l       sync.Mutex
+	changes []plugins.Change
+	nextID  int64
+	// lines is the number of changes in the file; it's rewritten with the kept
+	// changes once twice as many
+	lines int
+}
+
+func newChangeHistory(cfg *config.ChangeHistoryConfig) *changeHistory {
+	if cfg == nil {
+		cfg = &config.ChangeHistoryConfig{MaxChanges: 1000}
+	}
+	h := &changeHistory{cfg: cfg, nextID: 1}
+	if cfg.Path != "" {
+		if err := h.load(); err != nil {
+			changeHistoryErrors.Inc()
+			logrus.Errorf("Error loading change history: %v", err)
+		}
+	}
+	return h
+}
+
+// load reads the changes from the history file
+func (h *changeHistory) load() error {
+	f, err := os.Open(h.cfg.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		var c plugins.Change
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			return fmt.Errorf("invalid change on line %d: %w", h.lines+1, err)
+		}
+		h.lines++
+		h.append(c)
+	}
+	return scanner.Err()
+}
+
+// append adds the change, dropping the oldest over the max
+func (h *changeHistory) append(c plugins.Change) {
+	h.changes = append(h.changes, c)
+	if over := len(h.changes) - h.cfg.MaxChanges; over > 0 {
+		h.changes = append(h.changes[:0], h.changes[over:]...)
+	}
+	if c.ID >= h.nextID {
+		h.nextID = c.ID + 1
+	}
+}
+
+// RecordChange adds the change to the history (and the audit log)
+func (h *changeHistory) RecordChange(c plugins.Change) {
+	if len(c.Diff) == 0 {
+		return
+	}
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	c.ID = h.nextID
+	c.Time = time.Now()
+	h.append(c)
+
+	changesCounter.WithLabelValues(c.Kind, c.Source).Inc()
+	logrus.WithFields(logrus.Fields{
+		"audit":  "change",
+		"id":     c.ID,
+		"kind":   c.Kind,
+		"source": c.Source,
+		"user":   c.User,
+	}).Infof("%s changed: %d lines", c.Kind, len(c.Diff))
+
+	if h.cfg.Path != "" {
+		if err := h.persist(c); err != nil {
+			changeHistoryErrors.Inc()
+			logrus.Errorf("Error persisting change %d: %v", c.ID, err)
+		}
+	}
+}
+
+// persist appends the change to the history file, or rewrites it with only the
+// kept changes once it has grown to twice as many
+func (h *changeHistory) persist(c plugins.Change) error {
+	changes := []plugins.Change{c}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if h.lines >= 2*h.cfg.MaxChanges {
+		changes = h.changes
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		h.lines = 0
+	}
+
+	f, err := os.OpenFile(h.cfg.Path, flags, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, c := range changes {
+		if err := enc.Encode(c); err != nil {
+			f.Close()
+			return err
+		}
+		h.lines++
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// list returns the changes of the kind ("" for all) since the time, newest first
+// and at most limit (0 for all)
+func (h *changeHistory) list(kind string, since time.Time, limit int) []plugins.Change {
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	changes := []plugins.Change{}
+	for i := len(h.changes) - 1; i >= 0; i-- {
+		c := h.changes[i]
+		if c.Time.Before(since) {
+			break
+		}
+		if kind != "" && c.Kind != kind {
+			continue
+		}
+		changes = append(changes, c)
+		if limit > 0 && len(changes) == limit {
+			break
+		}
+	}
+	return changes
+}
+
+// Changes returns the history of the changes applied to the proxy (see changeHistory.list)
+func (p *Proxy) Changes(kind string, since time.Time, limit int) []plugins.Change {
+	return p.changes.list(kind, since, limit)
+}
+
+// pluginConfigLines returns the plugin configs as lines (one per plugin) to diff
+func pluginConfigLines(pcs []config.PluginConfig) []string {
+	lines := make([]string, 0, len(pcs))
+	for _, pc := range pcs {
+		b, err := bson.MarshalExtJSON(pc, false, false)
+		if err != nil {
+			b = []byte(err.Error())
+		}
+		lines = append(lines, pc.Name+" "+string(b))
+	}
+	return lines
+}
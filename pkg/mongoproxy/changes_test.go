@@ -0,0 +1,77 @@
+package mongoproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func TestChangeHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "changes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &config.ChangeHistoryConfig{Path: filepath.Join(dir, "changes.jsonl"), MaxChanges: 2}
+
+	h := newChangeHistory(cfg)
+	h.RecordChange(plugins.Change{Kind: "plugins", Source: "admin", User: "alice", Diff: []string{"+ mongo {}"}})
+	h.RecordChange(plugins.Change{Kind: "readOnly", Source: "admin"})
+	h.RecordChange(plugins.Change{Kind: "schema", Source: "file", Diff: []string{"- test.foo {}"}})
+	start := time.Now()
+	h.RecordChange(plugins.Change{Kind: "plugins", Source: "reload", Diff: []string{"- mongo {}"}})
+
+	// Changes without a diff aren't recorded and only the last MaxChanges are kept
+	tests := []struct {
+		kind     string
+		since    time.Time
+		limit    int
+		expected []int64
+	}{
+		{"", time.Time{}, 0, []int64{3, 2}},
+		{"", time.Time{}, 1, []int64{3}},
+		{"plugins", time.Time{}, 0, []int64{3}},
+		{"", start, 0, []int64{3}},
+	}
+	for _, test := range tests {
+		var ids []int64
+		for _, c := range h.list(test.kind, test.since, test.limit) {
+			ids = append(ids, c.ID)
+		}
+		if len(ids) != len(test.expected) || (len(ids) > 0 && ids[0] != test.expected[0]) {
+			t.Fatalf("%+v: expected %v, got %v", test, test.expected, ids)
+		}
+	}
+
+	// Changes are appended to the file until it has twice MaxChanges
+	lines := func() int {
+		b, err := ioutil.ReadFile(cfg.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Count(string(b), "\n")
+	}
+	if n := lines(); n != 3 {
+		t.Fatalf("expected 3 changes in the file, got %d", n)
+	}
+
+	// The history is loaded on start and continues from the last ID
+	h = newChangeHistory(cfg)
+	h.RecordChange(plugins.Change{Kind: "readOnly", Source: "admin", Diff: []string{"+ readOnly true"}})
+	changes := h.list("", time.Time{}, 0)
+	if len(changes) != 2 || changes[0].ID != 4 || changes[1].ID != 3 || changes[1].Diff[0] != "- mongo {}" {
+		t.Fatalf("unexpected changes after reload: %+v", changes)
+	}
+
+	// And then rewritten with only the kept ones
+	h.RecordChange(plugins.Change{Kind: "readOnly", Source: "admin", Diff: []string{"- readOnly true"}})
+	if n := lines(); n != 2 {
+		t.Fatalf("expected the file to be rewritten with 2 changes, got %d", n)
+	}
+}
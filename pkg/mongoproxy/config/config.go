@@ -2,9 +2,12 @@ package config
 
 import (
 	"fmt"
-	"io/ioutil"
+	"math"
+	"net"
+	"sort"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 
 	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
@@ -17,22 +20,7 @@ var DefaultConfig = Config{
 
 // ConfigFromFile loads a config (based on DefaultConfig) from the given path
 func ConfigFromFile(path string) (*Config, error) {
-	b, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-
-	cfg := DefaultConfig
-
-	if err := bson.UnmarshalExtJSON(b, true, &cfg); err != nil {
-		return nil, err
-	}
-
-	if err := cfg.Load(); err != nil {
-		return nil, err
-	}
-
-	return &cfg, nil
+	return Loader{Files: []string{path}}.Load()
 }
 
 // Config is the configuration struct for mongoproxy
@@ -47,6 +35,540 @@ type Config struct {
 	InternalIdentity *plugins.StaticIdentity `bson:"internalIdentity"`
 
 	RequestLengthLimit int `bson:"requestLengthLimit"`
+
+	// PostCommitWorkers is the number of workers running plugin post-commit hooks (default 4)
+	PostCommitWorkers int `bson:"postCommitWorkers"`
+	// PostCommitQueueSize is the max number of queued post-commit events; events
+	// are dropped if the queue is full (default 10000)
+	PostCommitQueueSize int `bson:"postCommitQueueSize"`
+
+	// Canary is an optional alternate plugin chain used for a subset of clients
+	Canary *CanaryConfig `bson:"canary"`
+
+	// ServerInfoRefresh is how often the downstream server info (used to answer
+	// isMaster/hello and buildInfo) is refreshed (default "1m")
+	ServerInfoRefresh         string        `bson:"serverInfoRefresh"`
+	ServerInfoRefreshInterval time.Duration `bson:"-"`
+	// MergeBackendStatus merges the backend's serverStatus and getParameter
+	// responses into the proxy's (default false; only proxy values)
+	MergeBackendStatus bool `bson:"mergeBackendStatus"`
+
+	// ClientIdleTimeout closes client connections with no request for this long
+	// (default "0"; never)
+	ClientIdleTimeout         string        `bson:"clientIdleTimeout"`
+	ClientIdleTimeoutDuration time.Duration `bson:"-"`
+	// IdlePoll parks idle client connections in an epoll set rather than on a
+	// goroutine blocked reading each, handling them on a new goroutine once the
+	// client sends data (default false; Linux only). TLS connections aren't parked.
+	IdlePoll bool `bson:"idlePoll"`
+	// OperationTimeout limits the wall-clock time of each request through the proxy,
+	// independent of maxTimeMS (default "0"; unlimited). Requests exceeding it fail
+	// with ExceededTimeLimit rather than the server's MaxTimeMSExpired.
+	OperationTimeout         string        `bson:"operationTimeout"`
+	OperationTimeoutDuration time.Duration `bson:"-"`
+	// MaxTimeMSGrace cancels requests with a maxTimeMS this long after it expires
+	// in case the backend doesn't stop them (default none; maxTimeMS is left to the
+	// backend). Requests cancelled this way fail with MaxTimeMSExpired.
+	MaxTimeMSGrace         string        `bson:"maxTimeMSGrace"`
+	MaxTimeMSGraceDuration time.Duration `bson:"-"`
+	// CancelAbandoned cancels requests, and kills their backend operations, when the
+	// client disconnects before the response (default false; requests run to
+	// completion). Requests are then read fully before they are handled.
+	CancelAbandoned bool `bson:"cancelAbandoned"`
+
+	// MaxMessageSizeBytes is the max size of a client message (advertised in isMaster);
+	// larger messages are rejected and the connection closed (default 48000000, as mongod)
+	MaxMessageSizeBytes int `bson:"maxMessageSizeBytes"`
+	// MaxInFlightBytes limits the total size of client messages being processed at
+	// once; when reached the proxy stops reading from clients until requests finish
+	// (default 0; unlimited). Must be at least maxMessageSizeBytes.
+	MaxInFlightBytes int64 `bson:"maxInFlightBytes"`
+
+	// MemoryBudgetBytes is the max bytes of buffered client requests and responses;
+	// once exceeded new requests are rejected with a retryable error until it drops
+	// (default 0; unlimited)
+	MemoryBudgetBytes int64 `bson:"memoryBudgetBytes"`
+
+	// HandshakeLimits rate limits new client connections (default none)
+	HandshakeLimits *HandshakeLimitsConfig `bson:"handshakeLimits"`
+	// TLS serves clients over TLS (default none; plaintext)
+	TLS *TLSConfig `bson:"tls"`
+	// TrustedProxies trusts the original clients forwarded by upstream proxies
+	// (default none; commands with a forwarded client are rejected)
+	TrustedProxies *TrustedProxiesConfig `bson:"trustedProxies"`
+
+	// WarmUp delays readiness until the plugins have warmed up (default none; ready
+	// as soon as the proxy serves)
+	WarmUp *WarmUpConfig `bson:"warmUp"`
+
+	// WorkerPool handles client requests with a bounded pool of workers rather than
+	// on each connection's goroutine (default none)
+	WorkerPool *WorkerPoolConfig `bson:"workerPool"`
+
+	// Bandwidth exports the bytes of users and namespaces and throttles the clients
+	// exceeding their quotas (default none; bytes are only counted per connection)
+	Bandwidth *BandwidthConfig `bson:"bandwidth"`
+
+	// RequestPhases times the phases of each request into metrics and keeps the
+	// slowest recent requests (default none)
+	RequestPhases *RequestPhasesConfig `bson:"requestPhases"`
+
+	// DataAPI serves a REST/JSON API of finds, inserts and updates run through the
+	// plugin chain, for clients which can't hold mongo connections (default none)
+	DataAPI *DataAPIConfig `bson:"dataAPI"`
+
+	// ControlPlane serves the admin API as a gRPC service (see
+	// api/mongoproxy/v1/control.proto) (default none; REST only)
+	ControlPlane *ControlPlaneConfig `bson:"controlPlane"`
+
+	// ChangeHistory configures the history of config and schema changes (default
+	// the last 1000 changes, in memory only)
+	ChangeHistory *ChangeHistoryConfig `bson:"changeHistory"`
+
+	// VirtualAdminDatabase is the name of a virtual database answered by the proxy
+	// whose collections are the proxy's state (connections, ops, ...) for
+	// introspection with a mongo shell (default none). Its requests don't go
+	// through the plugins.
+	VirtualAdminDatabase string `bson:"virtualAdminDatabase"`
+	// VirtualAdminRoles are the roles allowed to use the virtual admin database:
+	// clients without an identity having any of them are rejected (default root)
+	VirtualAdminRoles []string `bson:"virtualAdminRoles"`
+
+	// Files are the config files the config was loaded from (including includes)
+	Files []string `bson:"-"`
+}
+
+// CanaryConfig configures an alternate plugin chain which is used for a subset of
+// client connections so that plugin (or schema) changes can be compared against
+// the baseline before they are rolled out to all clients.
+type CanaryConfig struct {
+	// Plugins is the complete plugin chain to use for canary connections
+	Plugins []PluginConfig `bson:"plugins"`
+	// Percent of client connections (0-100) to use the canary chain for
+	Percent float64 `bson:"percent"`
+	// AppNames are the client application names (from the handshake) which always
+	// use the canary chain
+	AppNames []string `bson:"appNames"`
+}
+
+// HandshakeLimitsConfig rate limits new client connections so that driver
+// reconnect storms don't overwhelm the proxy and the backend. Connections over the
+// rate wait in a backlog before their handshake is read.
+type HandshakeLimitsConfig struct {
+	// Rate is the max new connections per second across all clients (default 0;
+	// unlimited) and Burst the connections allowed at once (default Rate)
+	Rate  float64 `bson:"rate"`
+	Burst int     `bson:"burst"`
+	// PerSourceRate is the max new connections per second per client IP (default
+	// 0; unlimited) and PerSourceBurst the connections allowed at once (default
+	// PerSourceRate)
+	PerSourceRate  float64 `bson:"perSourceRate"`
+	PerSourceBurst int     `bson:"perSourceBurst"`
+	// Backlog is the max number of connections waiting to start; further
+	// connections are closed (default 1000)
+	Backlog int `bson:"backlog"`
+	// BacklogTimeout is the max time a connection waits to start; connections
+	// which would wait longer are closed (default "5s")
+	BacklogTimeout         string        `bson:"backlogTimeout"`
+	BacklogTimeoutDuration time.Duration `bson:"-"`
+	// SlowStart ramps Rate up from 10% over this long after the proxy starts
+	// (default "0s"; no ramp)
+	SlowStart         string        `bson:"slowStart"`
+	SlowStartDuration time.Duration `bson:"-"`
+}
+
+// TLSConfig configures TLS on the client listener. Clients resume sessions with
+// session tickets, skipping the full handshake when they reconnect, and the
+// handshakes done at once are bounded so reconnect storms don't saturate the CPU.
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM encoded certificate (chain) and key (required)
+	CertFile string `bson:"certFile"`
+	KeyFile  string `bson:"keyFile"`
+	// SessionTicketKeyFiles are files each holding a base64 encoded 32 byte session
+	// ticket key, shared by the proxies so clients resume sessions on any of them;
+	// the first encrypts new tickets (default none; a random key per proxy)
+	SessionTicketKeyFiles []string `bson:"sessionTicketKeyFiles"`
+	// DisableSessionTickets always does full handshakes (default false)
+	DisableSessionTickets bool `bson:"disableSessionTickets"`
+	// MaxConcurrentHandshakes is the max handshakes done at once; further
+	// connections wait (default 0; unlimited)
+	MaxConcurrentHandshakes int `bson:"maxConcurrentHandshakes"`
+	// HandshakeTimeout is the max time a connection waits for and does its
+	// handshake before it's closed (default "10s")
+	HandshakeTimeout         string        `bson:"handshakeTimeout"`
+	HandshakeTimeoutDuration time.Duration `bson:"-"`
+}
+
+// WarmUpConfig configures the warm-up after the proxy starts: the plugins open
+// their backend connections and fill their caches (see plugins.WarmUpper) before
+// /readyz reports ready, and client connections can then be ramped up.
+type WarmUpConfig struct {
+	// Timeout is the max time spent warming up; the proxy becomes ready after it
+	// even if not all plugins have warmed up (default "1m")
+	Timeout         string        `bson:"timeout"`
+	TimeoutDuration time.Duration `bson:"-"`
+	// MaxConnections caps the open client connections during the ramp; the cap
+	// grows from 10% to MaxConnections over Ramp after the warm-up, and further
+	// connections are closed (default 0; no ramp)
+	MaxConnections int `bson:"maxConnections"`
+	// Ramp is how long the connections are ramped up for (default "1m")
+	Ramp         string        `bson:"ramp"`
+	RampDuration time.Duration `bson:"-"`
+}
+
+// WorkerPoolConfig configures a fixed pool of workers which handle the client
+// requests, bounding the requests handled at once (and so their memory) at high
+// connection counts. Requests wait for a worker in a queue per priority, and
+// workers take the requests of the highest priority first.
+type WorkerPoolConfig struct {
+	// Size is the number of workers (required). Requests which block (e.g. tailable
+	// cursors awaiting data) hold their worker, so it must cover them.
+	Size int `bson:"size"`
+	// Priorities are the priorities of the clients, highest first; the requests of
+	// clients in none have the lowest priority ("default")
+	Priorities []WorkerPriorityConfig `bson:"priorities"`
+	// MaxQueue is the max requests waiting per priority; further requests are
+	// rejected with a retryable error (default 0; unbounded)
+	MaxQueue int `bson:"maxQueue"`
+}
+
+// WorkerPriorityConfig is a priority of client requests in the worker pool
+type WorkerPriorityConfig struct {
+	Name string `bson:"name"`
+	// AppNames are the client appNames (from the handshake) with the priority
+	AppNames []string `bson:"appNames"`
+}
+
+// load validates the config
+func (c *WorkerPoolConfig) load() error {
+	if c.Size <= 0 {
+		return fmt.Errorf("workerPool.size must be positive: %d", c.Size)
+	}
+	if c.MaxQueue < 0 {
+		return fmt.Errorf("workerPool.maxQueue must not be negative: %d", c.MaxQueue)
+	}
+	names := map[string]struct{}{"default": {}}
+	for _, priority := range c.Priorities {
+		if _, ok := names[priority.Name]; ok || priority.Name == "" {
+			return fmt.Errorf("workerPool priorities must have unique names other than default: %q", priority.Name)
+		}
+		names[priority.Name] = struct{}{}
+	}
+	return nil
+}
+
+// BandwidthConfig configures accounting the bytes clients send and receive and
+// throttling the clients exceeding their quota
+type BandwidthConfig struct {
+	// UserMetrics exports the bytes of each (authenticated) user (default false)
+	UserMetrics bool `bson:"userMetrics"`
+	// NamespaceMetrics exports the bytes of each namespace (default false)
+	NamespaceMetrics bool `bson:"namespaceMetrics"`
+	// Quotas are the bandwidth allowances of the clients
+	Quotas []BandwidthQuotaConfig `bson:"quotas"`
+}
+
+// Who shares the allowance of a bandwidth quota
+const (
+	BandwidthPerUser       = "user"
+	BandwidthPerConnection = "connection"
+	BandwidthPerQuota      = "quota"
+)
+
+// BandwidthQuotaConfig is the bandwidth allowance of some clients; clients
+// exceeding it are throttled by delaying their next request
+type BandwidthQuotaConfig struct {
+	// Name identifies the quota in metrics (required)
+	Name string `bson:"name"`
+	// Users and AppNames are the clients the quota applies to: those with any of
+	// the users or appNames (default all clients)
+	Users    []string `bson:"users"`
+	AppNames []string `bson:"appNames"`
+	// Per is who shares an allowance: each "user" (default), each "connection" or
+	// all the clients of the "quota"
+	Per string `bson:"per"`
+	// BytesPerSecond is the allowed bytes in and out per second (required)
+	BytesPerSecond int64 `bson:"bytesPerSecond"`
+	// BurstBytes are the bytes allowed at once above the rate (default
+	// bytesPerSecond)
+	BurstBytes int64 `bson:"burstBytes"`
+	// MaxDelay is the longest a request is delayed; the rest of the excess delays
+	// the following requests (default "5s")
+	MaxDelay         string        `bson:"maxDelay"`
+	MaxDelayDuration time.Duration `bson:"-"`
+}
+
+// load validates the config and sets the defaults
+func (c *BandwidthConfig) load() error {
+	names := make(map[string]struct{}, len(c.Quotas))
+	for i := range c.Quotas {
+		q := &c.Quotas[i]
+		if _, ok := names[q.Name]; ok || q.Name == "" {
+			return fmt.Errorf("bandwidth quotas must have unique names: %q", q.Name)
+		}
+		names[q.Name] = struct{}{}
+		switch q.Per {
+		case "":
+			q.Per = BandwidthPerUser
+		case BandwidthPerUser, BandwidthPerConnection, BandwidthPerQuota:
+		default:
+			return fmt.Errorf("invalid bandwidth quota %s per %q; must be user, connection or quota", q.Name, q.Per)
+		}
+		if q.BytesPerSecond <= 0 {
+			return fmt.Errorf("bandwidth quota %s bytesPerSecond must be positive: %d", q.Name, q.BytesPerSecond)
+		}
+		if q.BurstBytes < 0 {
+			return fmt.Errorf("bandwidth quota %s burstBytes must not be negative: %d", q.Name, q.BurstBytes)
+		}
+		if q.BurstBytes == 0 {
+			q.BurstBytes = q.BytesPerSecond
+		}
+		q.MaxDelayDuration = 5 * time.Second
+		if q.MaxDelay != "" {
+			d, err := time.ParseDuration(q.MaxDelay)
+			if err != nil {
+				return fmt.Errorf("invalid bandwidth quota %s maxDelay: %w", q.Name, err)
+			}
+			if d <= 0 {
+				return fmt.Errorf("bandwidth quota %s maxDelay must be positive: %s", q.Name, q.MaxDelay)
+			}
+			q.MaxDelayDuration = d
+		}
+	}
+	return nil
+}
+
+// RequestPhasesConfig configures timing the phases of each request: reading,
+// decoding, each plugin, the backend, encoding and writing.
+type RequestPhasesConfig struct {
+	// SlowRequests is the number of the slowest recent requests kept with their
+	// phases (default 100)
+	SlowRequests int `bson:"slowRequests"`
+	// Window is how long the slowest requests are kept for (default "10m")
+	Window         string        `bson:"window"`
+	WindowDuration time.Duration `bson:"-"`
+}
+
+// load validates the config and sets the defaults
+func (c *RequestPhasesConfig) load() error {
+	if c.SlowRequests < 0 {
+		return fmt.Errorf("requestPhases.slowRequests must not be negative: %d", c.SlowRequests)
+	}
+	if c.SlowRequests == 0 {
+		c.SlowRequests = 100
+	}
+	c.WindowDuration = 10 * time.Minute
+	if c.Window != "" {
+		d, err := time.ParseDuration(c.Window)
+		if err != nil {
+			return fmt.Errorf("invalid requestPhases.window: %w", err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("requestPhases.window must be positive: %s", c.Window)
+		}
+		c.WindowDuration = d
+	}
+	return nil
+}
+
+// TrustedProxiesConfig configures the upstream proxies (whose mongo plugin forwards
+// their clients) trusted to forward the original client of their commands, which
+// the plugins then see in place of the upstream proxy's connection
+type TrustedProxiesConfig struct {
+	// KeyFiles are files each holding a base64 encoded key (of at least 32 bytes)
+	// forwarded clients may be signed with, so keys can be rotated (required)
+	KeyFiles []string `bson:"keyFiles"`
+	// MaxAge rejects clients forwarded longer ago (or later, with clock skew)
+	// than this (default "1m")
+	MaxAge         string        `bson:"maxAge"`
+	MaxAgeDuration time.Duration `bson:"-"`
+}
+
+func (c *TrustedProxiesConfig) load() error {
+	if len(c.KeyFiles) == 0 {
+		return fmt.Errorf("trustedProxies.keyFiles must be set")
+	}
+	c.MaxAgeDuration = time.Minute
+	if c.MaxAge != "" {
+		d, err := time.ParseDuration(c.MaxAge)
+		if err != nil {
+			return fmt.Errorf("invalid trustedProxies.maxAge: %w", err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("trustedProxies.maxAge must be positive: %s", c.MaxAge)
+		}
+		c.MaxAgeDuration = d
+	}
+	return nil
+}
+
+// DataAPIConfig configures the HTTP data API
+type DataAPIConfig struct {
+	// BindAddr is the address the data API is served on (required)
+	BindAddr string `bson:"bindAddr"`
+	// Keys are the API keys of the clients (required)
+	Keys []DataAPIKeyConfig `bson:"keys"`
+	// MaxLimit caps the documents returned by a find (default 1000)
+	MaxLimit int64 `bson:"maxLimit"`
+	// MaxBodyBytes caps the size of request bodies (default 16MB)
+	MaxBodyBytes int64 `bson:"maxBodyBytes"`
+	// Timeout bounds each request (default "30s")
+	Timeout         string        `bson:"timeout"`
+	TimeoutDuration time.Duration `bson:"-"`
+}
+
+// DataAPIKeyConfig is an API key of the data API and the client it authenticates
+type DataAPIKeyConfig struct {
+	// KeyFile is a file holding the key (of at least 32 characters), sent by the
+	// client as a bearer token (required)
+	KeyFile string `bson:"keyFile"`
+	// User and Roles are the identity the plugins (e.g. authz) see for the client
+	// (required)
+	User  string   `bson:"user"`
+	Roles []string `bson:"roles"`
+	// AppName is the appName of the client (default "dataAPI")
+	AppName string `bson:"appName"`
+}
+
+// load validates the config and sets the defaults
+func (c *DataAPIConfig) load() error {
+	if c.BindAddr == "" {
+		return fmt.Errorf("dataAPI.bindAddr must be set")
+	}
+	if len(c.Keys) == 0 {
+		return fmt.Errorf("dataAPI.keys must be set")
+	}
+	for i := range c.Keys {
+		if c.Keys[i].KeyFile == "" || c.Keys[i].User == "" {
+			return fmt.Errorf("dataAPI.keys keyFile and user must be set")
+		}
+		if c.Keys[i].AppName == "" {
+			c.Keys[i].AppName = "dataAPI"
+		}
+	}
+	if c.MaxLimit < 0 || c.MaxBodyBytes < 0 {
+		return fmt.Errorf("dataAPI limits must not be negative")
+	}
+	if c.MaxLimit == 0 {
+		c.MaxLimit = 1000
+	}
+	if c.MaxBodyBytes == 0 {
+		c.MaxBodyBytes = 16 * 1024 * 1024
+	}
+	c.TimeoutDuration = 30 * time.Second
+	if c.Timeout != "" {
+		d, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid dataAPI.timeout: %w", err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("dataAPI.timeout must be positive: %s", c.Timeout)
+		}
+		c.TimeoutDuration = d
+	}
+	return nil
+}
+
+// ControlPlaneConfig configures the gRPC control-plane API
+type ControlPlaneConfig struct {
+	// BindAddr is the address the gRPC service is served on (required)
+	BindAddr string `bson:"bindAddr"`
+}
+
+// ChangeHistoryConfig configures the history of the config and schema changes
+// applied to the running proxy (see the /admin/changes endpoint)
+type ChangeHistoryConfig struct {
+	// Path is the file the history is persisted to (as JSON lines) and loaded from
+	// on start (default ""; in memory only)
+	Path string `bson:"path"`
+	// MaxChanges is the number of changes kept (default 1000)
+	MaxChanges int `bson:"maxChanges"`
+}
+
+// load validates the config and sets the defaults
+func (c *ChangeHistoryConfig) load() error {
+	if c.MaxChanges < 0 {
+		return fmt.Errorf("changeHistory.maxChanges must not be negative: %d", c.MaxChanges)
+	}
+	if c.MaxChanges == 0 {
+		c.MaxChanges = 1000
+	}
+	return nil
+}
+
+// load validates the config and sets the defaults
+func (c *WarmUpConfig) load() error {
+	if c.MaxConnections < 0 {
+		return fmt.Errorf("warmUp.maxConnections must not be negative: %d", c.MaxConnections)
+	}
+	c.TimeoutDuration = time.Minute
+	if c.Timeout != "" {
+		d, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid warmUp.timeout: %w", err)
+		}
+		c.TimeoutDuration = d
+	}
+	c.RampDuration = time.Minute
+	if c.Ramp != "" {
+		d, err := time.ParseDuration(c.Ramp)
+		if err != nil {
+			return fmt.Errorf("invalid warmUp.ramp: %w", err)
+		}
+		c.RampDuration = d
+	}
+	return nil
+}
+
+// load validates the config and sets the defaults
+func (c *HandshakeLimitsConfig) load() error {
+	if c.Rate < 0 || c.PerSourceRate < 0 || c.Burst < 0 || c.PerSourceBurst < 0 || c.Backlog < 0 {
+		return fmt.Errorf("handshakeLimits must not be negative")
+	}
+	if c.Burst == 0 {
+		c.Burst = int(math.Ceil(c.Rate))
+	}
+	if c.PerSourceBurst == 0 {
+		c.PerSourceBurst = int(math.Ceil(c.PerSourceRate))
+	}
+	if c.Backlog == 0 {
+		c.Backlog = 1000
+	}
+	c.BacklogTimeoutDuration = 5 * time.Second
+	if c.BacklogTimeout != "" {
+		d, err := time.ParseDuration(c.BacklogTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid handshakeLimits.backlogTimeout: %w", err)
+		}
+		c.BacklogTimeoutDuration = d
+	}
+	if c.SlowStart != "" {
+		d, err := time.ParseDuration(c.SlowStart)
+		if err != nil {
+			return fmt.Errorf("invalid handshakeLimits.slowStart: %w", err)
+		}
+		c.SlowStartDuration = d
+	}
+	return nil
+}
+
+// load validates the config and sets the defaults
+func (c *TLSConfig) load() error {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return fmt.Errorf("tls.certFile and tls.keyFile must be set")
+	}
+	if c.MaxConcurrentHandshakes < 0 {
+		return fmt.Errorf("tls.maxConcurrentHandshakes must not be negative: %d", c.MaxConcurrentHandshakes)
+	}
+	c.HandshakeTimeoutDuration = 10 * time.Second
+	if c.HandshakeTimeout != "" {
+		d, err := time.ParseDuration(c.HandshakeTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid tls.handshakeTimeout: %w", err)
+		}
+		c.HandshakeTimeoutDuration = d
+	}
+	return nil
 }
 
 // Load will load all configuration
@@ -61,18 +583,137 @@ func (c *Config) Load() error {
 		c.IdleCursorTimeout = time.Minute * 30 // Default timeout
 	}
 
+	if c.PostCommitWorkers <= 0 {
+		c.PostCommitWorkers = 4
+	}
+	if c.PostCommitQueueSize <= 0 {
+		c.PostCommitQueueSize = 10000
+	}
+
+	c.ServerInfoRefreshInterval = time.Minute
+	if c.ServerInfoRefresh != "" {
+		d, err := time.ParseDuration(c.ServerInfoRefresh)
+		if err != nil {
+			return fmt.Errorf("invalid serverInfoRefresh: %w", err)
+		}
+		c.ServerInfoRefreshInterval = d
+	}
+
+	if c.ClientIdleTimeout != "" {
+		d, err := time.ParseDuration(c.ClientIdleTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid clientIdleTimeout: %w", err)
+		}
+		c.ClientIdleTimeoutDuration = d
+	}
+	if c.OperationTimeout != "" {
+		d, err := time.ParseDuration(c.OperationTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid operationTimeout: %w", err)
+		}
+		c.OperationTimeoutDuration = d
+	}
+	if c.MaxTimeMSGrace != "" {
+		d, err := time.ParseDuration(c.MaxTimeMSGrace)
+		if err != nil {
+			return fmt.Errorf("invalid maxTimeMSGrace: %w", err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("maxTimeMSGrace must be positive: %s", d)
+		}
+		c.MaxTimeMSGraceDuration = d
+	}
+
+	if c.MaxMessageSizeBytes <= 0 {
+		c.MaxMessageSizeBytes = 48000000
+	}
+	if c.MaxInFlightBytes < 0 || (c.MaxInFlightBytes > 0 && c.MaxInFlightBytes < int64(c.MaxMessageSizeBytes)) {
+		return fmt.Errorf("maxInFlightBytes (%d) must be at least maxMessageSizeBytes (%d)", c.MaxInFlightBytes, c.MaxMessageSizeBytes)
+	}
+
+	if c.HandshakeLimits != nil {
+		if err := c.HandshakeLimits.load(); err != nil {
+			return err
+		}
+	}
+	if c.TLS != nil {
+		if err := c.TLS.load(); err != nil {
+			return err
+		}
+	}
+	if c.TrustedProxies != nil {
+		if err := c.TrustedProxies.load(); err != nil {
+			return err
+		}
+	}
+	if c.WarmUp != nil {
+		if err := c.WarmUp.load(); err != nil {
+			return err
+		}
+	}
+	if c.RequestPhases != nil {
+		if err := c.RequestPhases.load(); err != nil {
+			return err
+		}
+	}
+	if c.WorkerPool != nil {
+		if err := c.WorkerPool.load(); err != nil {
+			return err
+		}
+	}
+	if c.Bandwidth != nil {
+		if err := c.Bandwidth.load(); err != nil {
+			return err
+		}
+	}
+	if c.DataAPI != nil {
+		if err := c.DataAPI.load(); err != nil {
+			return err
+		}
+	}
+	if c.ControlPlane != nil && c.ControlPlane.BindAddr == "" {
+		return fmt.Errorf("controlPlane.bindAddr must be set")
+	}
+	if c.ChangeHistory == nil {
+		c.ChangeHistory = &ChangeHistoryConfig{}
+	}
+	if err := c.ChangeHistory.load(); err != nil {
+		return err
+	}
+
+	if c.Canary != nil {
+		if len(c.Canary.Plugins) == 0 {
+			return fmt.Errorf("canary must have plugins")
+		}
+		if c.Canary.Percent < 0 || c.Canary.Percent > 100 {
+			return fmt.Errorf("canary percent must be between 0 and 100: %v", c.Canary.Percent)
+		}
+	}
+
 	return nil
 }
 
-// GetPlugins returns a list of plugin instances for the given config
+// GetPlugins returns a list of plugin instances for the given config. Disabled
+// plugins are skipped and the remaining plugins are (stably) sorted by Order.
 func (c *Config) GetPlugins() ([]plugins.Plugin, error) {
-	ps := make([]plugins.Plugin, len(c.Plugins))
-	for i, config := range c.Plugins {
-		p, ok := plugins.GetPlugin(config.Name)
-		if !ok {
-			return nil, fmt.Errorf("unknown plugin %s", config.Name)
-		}
-		if err := p.Configure(config.Config); err != nil {
+	return getPlugins(c.Plugins)
+}
+
+// GetCanaryPlugins returns a list of plugin instances for the canary config (nil
+// if there is no canary configured).
+func (c *Config) GetCanaryPlugins() ([]plugins.Plugin, error) {
+	if c.Canary == nil {
+		return nil, nil
+	}
+	return getPlugins(c.Canary.Plugins)
+}
+
+func getPlugins(pluginConfigs []PluginConfig) ([]plugins.Plugin, error) {
+	configs := EnabledPlugins(pluginConfigs)
+	ps := make([]plugins.Plugin, len(configs))
+	for i, config := range configs {
+		p, err := config.Build()
+		if err != nil {
 			return nil, err
 		}
 		ps[i] = p
@@ -81,7 +722,107 @@ func (c *Config) GetPlugins() ([]plugins.Plugin, error) {
 	return ps, nil
 }
 
+// EnabledPlugins returns the enabled plugin configs (stably) sorted by Order
+func EnabledPlugins(pluginConfigs []PluginConfig) []PluginConfig {
+	configs := make([]PluginConfig, 0, len(pluginConfigs))
+	for _, config := range pluginConfigs {
+		if config.Enabled != nil && !*config.Enabled {
+			logrus.Debugf("plugin %s disabled", config.Name)
+			continue
+		}
+		configs = append(configs, config)
+	}
+	sort.SliceStable(configs, func(i, j int) bool {
+		return configs[i].Order < configs[j].Order
+	})
+	return configs
+}
+
 type PluginConfig struct {
 	Name   string `bson:"name"`
 	Config bson.D `bson:"config"`
+
+	// Enabled allows a plugin to be disabled without removing its config (default true)
+	Enabled *bool `bson:"enabled"`
+	// Order is used to order the plugin chain; plugins are sorted by Order
+	// and plugins with the same Order keep their order in the config (default 0)
+	Order int `bson:"order"`
+	// Scope limits which requests the plugin runs for (default all)
+	Scope *plugins.Scope `bson:"scope"`
+	// Timeout limits the time spent in the plugin itself per request (default none)
+	Timeout string `bson:"timeout"`
+	// TimeoutPolicy is what to do when the timeout is exceeded: "fail" the
+	// request (default) or "skip" the plugin
+	TimeoutPolicy string `bson:"timeoutPolicy"`
+}
+
+// Build returns a new plugin instance configured (and wrapped) as defined by the config
+func (config PluginConfig) Build() (plugins.Plugin, error) {
+	p, ok := plugins.GetPlugin(config.Name)
+	if !ok {
+		return nil, fmt.Errorf("unknown plugin %s", config.Name)
+	}
+	if err := p.Configure(config.Config); err != nil {
+		return nil, err
+	}
+	if !config.Scope.IsZero() {
+		logrus.Debugf("plugin %s scoped to: %s", config.Name, config.Scope)
+	}
+	if config.Timeout != "" {
+		timeout, err := time.ParseDuration(config.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout for plugin %s: %w", config.Name, err)
+		}
+		if p, err = plugins.WithTimeout(p, timeout, plugins.TimeoutPolicy(config.TimeoutPolicy)); err != nil {
+			return nil, fmt.Errorf("invalid timeout for plugin %s: %w", config.Name, err)
+		}
+	}
+	return plugins.Scoped(p, config.Scope), nil
+}
+
+// Key returns a key for the config; configs with the same key build identical
+// plugins. Enabled and Order don't affect the plugin itself so aren't included.
+func (config PluginConfig) Key() (string, error) {
+	config.Enabled = nil
+	config.Order = 0
+	b, err := bson.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Validate checks the whole config (including building every plugin) and
+// returns all problems found; it is intended to be run before deploying a config.
+func (c *Config) Validate() []error {
+	var errs []error
+	if c.BindAddr == "" {
+		errs = append(errs, fmt.Errorf("bindAddr must be set"))
+	} else if _, _, err := net.SplitHostPort(c.BindAddr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid bindAddr: %w", err))
+	}
+
+	errs = append(errs, validatePlugins("plugins", c.Plugins)...)
+	if c.Canary != nil {
+		errs = append(errs, validatePlugins("canary.plugins", c.Canary.Plugins)...)
+	}
+	return errs
+}
+
+func validatePlugins(prefix string, pluginConfigs []PluginConfig) []error {
+	var errs []error
+	for i, config := range pluginConfigs {
+		name := fmt.Sprintf("%s[%d] (%s)", prefix, i, config.Name)
+		p, err := config.Build()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		if v, ok := plugins.Unwrap(p).(plugins.ConfigValidator); ok {
+			for _, err := range v.ValidateConfig() {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			}
+		}
+	}
+	return errs
 }
@@ -0,0 +1,26 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.BindAddr = "localhost"
+	cfg.Plugins = []PluginConfig{
+		{Name: "doesnotexist"},
+	}
+	cfg.Canary = &CanaryConfig{Plugins: []PluginConfig{{Name: "alsodoesnotexist"}}}
+
+	errs := cfg.Validate()
+	if len(errs) != 3 {
+		t.Fatalf("expected 3 errors, got: %v", errs)
+	}
+
+	cfg.BindAddr = "localhost:27017"
+	cfg.Plugins = nil
+	cfg.Canary = nil
+	if errs := cfg.Validate(); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+}
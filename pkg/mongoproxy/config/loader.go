@@ -0,0 +1,400 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// EnvPrefix is the prefix of environment variables which override config keys;
+	// e.g. MONGOPROXY_SET_BIND_ADDR or MONGOPROXY_SET_PLUGINS__MONGO__CONFIG__MONGO_ADDR
+	EnvPrefix = "MONGOPROXY_SET_"
+
+	// envSeparator separates the path elements in environment variable names
+	envSeparator = "__"
+
+	// includeKey is the top-level key listing other config files to include
+	includeKey = "include"
+)
+
+// Loader loads a Config from layered sources. In order of increasing precedence:
+//
+//  1. DefaultConfig
+//  2. Files (in order); files included by a file (the top-level "include" key)
+//     are applied before the file including them
+//  3. Environment variables prefixed with EnvPrefix (Env)
+//  4. Overrides ("path=value"; e.g. from --set flags)
+//
+// Files are extended JSON, or YAML if the extension is .yaml or .yml. Documents are
+// merged key by key; arrays (e.g. plugins) are replaced as a whole.
+//
+// Override paths are "."-separated keys (case-sensitive) while environment variables
+// use "__" and match existing keys ignoring case and "_" (BIND_ADDR matches bindAddr).
+// Array elements are selected by index or by the "name" of the element (e.g.
+// plugins.mongo.config.mongoAddr). Values are parsed as extended JSON, falling back
+// to a plain string.
+type Loader struct {
+	Files     []string
+	Env       []string
+	Overrides []string
+}
+
+// Load loads, merges and validates the config
+func (l Loader) Load() (*Config, error) {
+	doc := bson.D{}
+	var files []string
+	for _, path := range l.Files {
+		d, err := loadFile(path, nil, &files)
+		if err != nil {
+			return nil, err
+		}
+		doc = mergeDoc(doc, d)
+	}
+
+	var env []string
+	for _, kv := range l.Env {
+		if strings.HasPrefix(kv, EnvPrefix) {
+			env = append(env, kv)
+		}
+	}
+	sort.Strings(env)
+	for _, kv := range env {
+		parts := strings.SplitN(strings.TrimPrefix(kv, EnvPrefix), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			continue
+		}
+		var err error
+		doc, err = setPath(doc, strings.Split(parts[0], envSeparator), parseValue(parts[1]), false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid environment variable %s%s: %w", EnvPrefix, parts[0], err)
+		}
+	}
+
+	for _, o := range l.Overrides {
+		parts := strings.SplitN(o, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid override %q; must be path=value", o)
+		}
+		var err error
+		doc, err = setPath(doc, strings.Split(parts[0], "."), parseValue(parts[1]), true)
+		if err != nil {
+			return nil, fmt.Errorf("invalid override %q: %w", o, err)
+		}
+	}
+
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	cfg := DefaultConfig
+	if err := bson.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.Load(); err != nil {
+		return nil, err
+	}
+	cfg.Files = files
+	return &cfg, nil
+}
+
+// loadFile reads the file (and the files it includes) into a single document;
+// parents is the chain of files including this one (to detect cycles) and all
+// files read are appended to files
+func loadFile(path string, parents []string, files *[]string) (bson.D, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, parent := range parents {
+		if parent == abs {
+			return nil, fmt.Errorf("include cycle: %s", strings.Join(append(parents, abs), " -> "))
+		}
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	*files = append(*files, path)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if b, err = yamlToJSON(b); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	var d bson.D
+	if err := bson.UnmarshalExtJSON(b, true, &d); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var includes []string
+	for i, e := range d {
+		if e.Key != includeKey {
+			continue
+		}
+		switch v := e.Value.(type) {
+		case string:
+			includes = []string{v}
+		case primitive.A:
+			for _, item := range v {
+				s, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s: %s must be a string or list of strings", path, includeKey)
+				}
+				includes = append(includes, s)
+			}
+		default:
+			return nil, fmt.Errorf("%s: %s must be a string or list of strings", path, includeKey)
+		}
+		d = append(d[:i:i], d[i+1:]...)
+		break
+	}
+
+	merged := bson.D{}
+	for _, include := range includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		id, err := loadFile(include, append(parents, abs), files)
+		if err != nil {
+			return nil, err
+		}
+		merged = mergeDoc(merged, id)
+	}
+	return mergeDoc(merged, d), nil
+}
+
+// mergeDoc merges src into dst; sub-documents are merged and everything else
+// (including arrays) is replaced
+func mergeDoc(dst, src bson.D) bson.D {
+	for _, e := range src {
+		idx := -1
+		for i, de := range dst {
+			if de.Key == e.Key {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			dst = append(dst, e)
+			continue
+		}
+		dd, ok1 := dst[idx].Value.(primitive.D)
+		sd, ok2 := e.Value.(primitive.D)
+		if ok1 && ok2 {
+			dst[idx].Value = mergeDoc(dd, sd)
+		} else {
+			dst[idx].Value = e.Value
+		}
+	}
+	return dst
+}
+
+// keyMatches returns whether the path element selects key; exact matching is
+// used for overrides while environment variables ignore case and "_"
+func keyMatches(key, elem string, exact bool) bool {
+	if exact {
+		return key == elem
+	}
+	return strings.EqualFold(strings.ReplaceAll(key, "_", ""), strings.ReplaceAll(elem, "_", ""))
+}
+
+// topLevelKeys are the keys of Config; used to set keys which aren't in any file
+var topLevelKeys = func() []string {
+	t := reflect.TypeOf(Config{})
+	keys := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if tag := strings.Split(t.Field(i).Tag.Get("bson"), ",")[0]; tag != "" && tag != "-" {
+			keys = append(keys, tag)
+		}
+	}
+	return keys
+}()
+
+// setPath sets the value at path in the top-level document d returning the updated document
+func setPath(d bson.D, path []string, value interface{}, exact bool) (bson.D, error) {
+	return setDocPath(d, path, value, exact, true)
+}
+
+func setDocPath(d bson.D, path []string, value interface{}, exact, topLevel bool) (bson.D, error) {
+	idx := -1
+	for i, e := range d {
+		if keyMatches(e.Key, path[0], exact) {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		// The key doesn't exist yet. With inexact matching the real key is only
+		// known for the top-level config keys.
+		key := ""
+		if exact {
+			key = path[0]
+		} else if topLevel {
+			for _, k := range topLevelKeys {
+				if keyMatches(k, path[0], exact) {
+					key = k
+					break
+				}
+			}
+		}
+		if key == "" {
+			return nil, fmt.Errorf("unknown key %s", path[0])
+		}
+		d = append(d, bson.E{Key: key})
+		idx = len(d) - 1
+	}
+
+	if len(path) == 1 {
+		d[idx].Value = value
+		return d, nil
+	}
+	v, err := setValuePath(d[idx].Value, path[1:], value, exact)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", d[idx].Key, err)
+	}
+	d[idx].Value = v
+	return d, nil
+}
+
+func setValuePath(v interface{}, path []string, value interface{}, exact bool) (interface{}, error) {
+	switch tv := v.(type) {
+	case primitive.D:
+		return setDocPath(tv, path, value, exact, false)
+	case primitive.A:
+		idx, err := arrayIndex(tv, path[0], exact)
+		if err != nil {
+			return nil, err
+		}
+		if len(path) == 1 {
+			tv[idx] = value
+			return tv, nil
+		}
+		sub, err := setValuePath(tv[idx], path[1:], value, exact)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path[0], err)
+		}
+		tv[idx] = sub
+		return tv, nil
+	case nil:
+		return setDocPath(primitive.D{}, path, value, exact, false)
+	default:
+		return nil, fmt.Errorf("%s: not a document or array", path[0])
+	}
+}
+
+// arrayIndex returns the index of the element selected by elem: either an index
+// or the "name" of a document in the array
+func arrayIndex(a primitive.A, elem string, exact bool) (int, error) {
+	if i, err := strconv.Atoi(elem); err == nil {
+		if i < 0 || i >= len(a) {
+			return 0, fmt.Errorf("index %d out of range", i)
+		}
+		return i, nil
+	}
+	idx := -1
+	for i, item := range a {
+		d, ok := item.(primitive.D)
+		if !ok {
+			continue
+		}
+		for _, e := range d {
+			if name, ok := e.Value.(string); ok && e.Key == "name" && keyMatches(name, elem, exact) {
+				if idx >= 0 {
+					return 0, fmt.Errorf("multiple elements named %s", elem)
+				}
+				idx = i
+			}
+		}
+	}
+	if idx < 0 {
+		return 0, fmt.Errorf("no element named %s", elem)
+	}
+	return idx, nil
+}
+
+// parseValue parses an override value as extended JSON, falling back to a string
+func parseValue(s string) interface{} {
+	var d bson.D
+	if err := bson.UnmarshalExtJSON([]byte(`{"v":`+s+`}`), true, &d); err == nil && len(d) == 1 {
+		return d[0].Value
+	}
+	return s
+}
+
+// yamlToJSON converts a YAML document to JSON, preserving the order of keys
+func yamlToJSON(b []byte) ([]byte, error) {
+	var n yaml.Node
+	if err := yaml.Unmarshal(b, &n); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if len(n.Content) == 0 {
+		return []byte("{}"), nil
+	}
+	if err := writeYAMLNode(&buf, n.Content[0]); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeYAMLNode(buf *bytes.Buffer, n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		return writeYAMLNode(buf, n.Content[0])
+	case yaml.AliasNode:
+		return writeYAMLNode(buf, n.Alias)
+	case yaml.MappingNode:
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			k, err := json.Marshal(n.Content[i].Value)
+			if err != nil {
+				return err
+			}
+			buf.Write(k)
+			buf.WriteByte(':')
+			if err := writeYAMLNode(buf, n.Content[i+1]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case yaml.SequenceNode:
+		buf.WriteByte('[')
+		for i, c := range n.Content {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeYAMLNode(buf, c); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case yaml.ScalarNode:
+		var v interface{}
+		if err := n.Decode(&v); err != nil {
+			return err
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n.Line, err)
+		}
+		buf.Write(b)
+	default:
+		return fmt.Errorf("line %d: unsupported yaml node", n.Line)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile(t, dir, "base.json", `{
+		"bindAddr": "localhost:27016",
+		"postCommitWorkers": 2,
+		"plugins": [
+			{"name": "slowlog", "config": {"slowlogThreshold": "100ms"}},
+			{"name": "mongo", "config": {"mongoAddr": "mongodb://localhost:27017"}}
+		]
+	}`)
+	main := writeFile(t, dir, "main.yaml", `
+include: base.json
+postCommitWorkers: 3
+compressors: [snappy]
+`)
+	override := writeFile(t, dir, "override.json", `{"postCommitQueueSize": 10}`)
+
+	tests := []struct {
+		name  string
+		l     Loader
+		check func(*Config) bool
+		err   bool
+	}{
+		{
+			name: "include",
+			l:    Loader{Files: []string{main}},
+			check: func(c *Config) bool {
+				return c.BindAddr == "localhost:27016" && c.PostCommitWorkers == 3 && len(c.Plugins) == 2
+			},
+		},
+		{
+			name:  "multiple files",
+			l:     Loader{Files: []string{main, override}},
+			check: func(c *Config) bool { return c.PostCommitWorkers == 3 && c.PostCommitQueueSize == 10 },
+		},
+		{
+			name: "env",
+			l: Loader{Files: []string{main}, Env: []string{
+				"MONGOPROXY_SET_BIND_ADDR=localhost:1234",
+				"MONGOPROXY_SET_PLUGINS__MONGO__CONFIG__MONGO_ADDR=mongodb://other:27017",
+				"OTHER=1",
+			}},
+			check: func(c *Config) bool {
+				return c.BindAddr == "localhost:1234" && c.Plugins[1].Config.Map()["mongoAddr"] == "mongodb://other:27017"
+			},
+		},
+		{
+			name: "override beats env",
+			l: Loader{
+				Files:     []string{main},
+				Env:       []string{"MONGOPROXY_SET_POST_COMMIT_WORKERS=5"},
+				Overrides: []string{"postCommitWorkers=6", "plugins.0.config.slowlogThreshold=1s"},
+			},
+			check: func(c *Config) bool {
+				return c.PostCommitWorkers == 6 && c.Plugins[0].Config.Map()["slowlogThreshold"] == "1s"
+			},
+		},
+		{
+			name: "unknown env key",
+			l:    Loader{Files: []string{main}, Env: []string{"MONGOPROXY_SET_PLUGINS__MONGO__CONFIG__NEW_KEY=1"}},
+			err:  true,
+		},
+		{
+			name: "unknown plugin",
+			l:    Loader{Files: []string{main}, Overrides: []string{"plugins.nope.config.x=1"}},
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := test.l.Load()
+			if (err != nil) != test.err {
+				t.Fatalf("mismatch in err expected=%v actual=%v", test.err, err)
+			}
+			if err == nil && !test.check(cfg) {
+				t.Fatalf("unexpected config: %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestLoaderIncludeCycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := writeFile(t, dir, "a.json", `{"include": "b.json"}`)
+	writeFile(t, dir, "b.json", `{"include": ["a.json"]}`)
+	if _, err := (Loader{Files: []string{a}}).Load(); err == nil {
+		t.Fatalf("expected include cycle error")
+	}
+}
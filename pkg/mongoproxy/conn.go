@@ -4,6 +4,8 @@ import (
 	"net"
 	"sync/atomic"
 	"time"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
 )
 
 type ConnState int
@@ -27,8 +29,18 @@ func (c ConnState) String() string {
 }
 
 type conn struct {
-	p *Proxy
-	c net.Conn
+	// buffered is the bytes of requests and responses buffered for the
+	// connection (see memoryBudget); first for 64-bit alignment
+	buffered int64
+	// bytesIn and bytesOut are the bytes of the requests and responses of the
+	// connection
+	bytesIn, bytesOut int64
+
+	p  *Proxy
+	c  net.Conn
+	cc *plugins.ClientConnection
+	// quotas are the connection's buckets of the bandwidth quotas per connection
+	quotas map[*bandwidthQuota]*byteBucket
 
 	curState struct{ atomic uint64 } // packed (unixtime<<8|uint8(ConnState))
 }
@@ -0,0 +1,295 @@
+package mongoproxy
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	mongoproxyv1 "github.com/wish/mongoproxy/api/mongoproxy/v1"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+// ControlServer returns a gRPC server of the control-plane API (see
+// api/mongoproxy/v1/control.proto), which mirrors the admin API of AdminHandler.
+// Changes are recorded in the change history as made by the client's address.
+func (p *Proxy) ControlServer() *grpc.Server {
+	s := grpc.NewServer()
+	mongoproxyv1.RegisterControlPlaneServer(s, &controlServer{p: p})
+	return s
+}
+
+// controlServer implements the control-plane API with the proxy's admin functions
+type controlServer struct {
+	mongoproxyv1.UnimplementedControlPlaneServer
+	p *Proxy
+}
+
+// controlUser returns who made a control-plane request: the client's address
+func controlUser(ctx context.Context) string {
+	if pr, ok := peer.FromContext(ctx); ok {
+		return pr.Addr.String()
+	}
+	return ""
+}
+
+func (s *controlServer) ListConnections(ctx context.Context, req *mongoproxyv1.ListConnectionsRequest) (*mongoproxyv1.ListConnectionsResponse, error) {
+	conns := s.p.Connections()
+	resp := &mongoproxyv1.ListConnectionsResponse{Connections: make([]*mongoproxyv1.Connection, len(conns))}
+	for i, c := range conns {
+		conn := &mongoproxyv1.Connection{
+			Client:        c.Client,
+			AppName:       c.AppName,
+			Users:         c.Users,
+			State:         c.State,
+			LastActivity:  timestamppb.New(c.LastActivity),
+			BufferedBytes: c.BufferedBytes,
+		}
+		if c.ClientMetadata != nil {
+			b, err := json.Marshal(c.ClientMetadata)
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			conn.ClientMetadata = string(b)
+		}
+		resp.Connections[i] = conn
+	}
+	return resp, nil
+}
+
+func (s *controlServer) ListOps(ctx context.Context, req *mongoproxyv1.ListOpsRequest) (*mongoproxyv1.ListOpsResponse, error) {
+	ops := s.p.Ops()
+	resp := &mongoproxyv1.ListOpsResponse{Ops: make([]*mongoproxyv1.Op, len(ops))}
+	for i, op := range ops {
+		resp.Ops[i] = &mongoproxyv1.Op{
+			Id:          op.ID,
+			Client:      op.Client,
+			AppName:     op.AppName,
+			CommandName: op.CommandName,
+			Database:    op.Database,
+			Collection:  op.Collection,
+			Start:       timestamppb.New(op.Start),
+		}
+	}
+	return resp, nil
+}
+
+func (s *controlServer) KillOp(ctx context.Context, req *mongoproxyv1.KillOpRequest) (*mongoproxyv1.KillOpResponse, error) {
+	found := s.p.KillOp(req.Id)
+	auditKill("op", req.Id, "admin", nil, found)
+	if !found {
+		return nil, status.Error(codes.NotFound, "op not found")
+	}
+	return &mongoproxyv1.KillOpResponse{}, nil
+}
+
+func (s *controlServer) KillCursor(ctx context.Context, req *mongoproxyv1.KillCursorRequest) (*mongoproxyv1.KillCursorResponse, error) {
+	err := s.p.KillCursor(ctx, req.Id)
+	auditKill("cursor", req.Id, "admin", nil, err == nil)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return &mongoproxyv1.KillCursorResponse{}, nil
+}
+
+func (s *controlServer) GetReadOnly(ctx context.Context, req *mongoproxyv1.GetReadOnlyRequest) (*mongoproxyv1.ReadOnly, error) {
+	return &mongoproxyv1.ReadOnly{ReadOnly: s.p.ReadOnly()}, nil
+}
+
+func (s *controlServer) SetReadOnly(ctx context.Context, req *mongoproxyv1.SetReadOnlyRequest) (*mongoproxyv1.ReadOnly, error) {
+	s.p.setReadOnlyBy(controlUser(ctx), req.ReadOnly)
+	return &mongoproxyv1.ReadOnly{ReadOnly: s.p.ReadOnly()}, nil
+}
+
+func (s *controlServer) ListPlugins(ctx context.Context, req *mongoproxyv1.ListPluginsRequest) (*mongoproxyv1.ListPluginsResponse, error) {
+	return s.pluginConfigs()
+}
+
+func (s *controlServer) SetPluginEnabled(ctx context.Context, req *mongoproxyv1.SetPluginEnabledRequest) (*mongoproxyv1.ListPluginsResponse, error) {
+	return s.updatePlugin(ctx, req.Name, func(pc *config.PluginConfig) error {
+		enabled := req.Enabled
+		pc.Enabled = &enabled
+		return nil
+	})
+}
+
+func (s *controlServer) SetPluginConfig(ctx context.Context, req *mongoproxyv1.SetPluginConfigRequest) (*mongoproxyv1.ListPluginsResponse, error) {
+	var d bson.D
+	if err := bson.UnmarshalExtJSON([]byte(req.Config), false, &d); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return s.updatePlugin(ctx, req.Name, func(pc *config.PluginConfig) error {
+		pc.Config = d
+		return nil
+	})
+}
+
+// updatePlugin updates the named plugin's config, returning the plugin configs
+func (s *controlServer) updatePlugin(ctx context.Context, name string, update func(*config.PluginConfig) error) (*mongoproxyv1.ListPluginsResponse, error) {
+	switch err := s.p.updatePlugin(WithChangeAuthor(ctx, "admin", controlUser(ctx)), name, update); err {
+	case nil:
+	case errPluginNotFound:
+		return nil, status.Error(codes.NotFound, err.Error())
+	case errPluginAmbiguous:
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "error updating plugin %s: %v", name, err)
+	}
+	return s.pluginConfigs()
+}
+
+func (s *controlServer) pluginConfigs() (*mongoproxyv1.ListPluginsResponse, error) {
+	pcs := s.p.PluginConfigs()
+	resp := &mongoproxyv1.ListPluginsResponse{Plugins: make([]*mongoproxyv1.PluginConfig, len(pcs))}
+	for i, pc := range pcs {
+		b, err := bson.MarshalExtJSON(pc, false, false)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		resp.Plugins[i] = &mongoproxyv1.PluginConfig{Name: pc.Name, Config: string(b)}
+	}
+	return resp, nil
+}
+
+func (s *controlServer) ListChanges(ctx context.Context, req *mongoproxyv1.ListChangesRequest) (*mongoproxyv1.ListChangesResponse, error) {
+	if req.Limit < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid limit: %d", req.Limit)
+	}
+	var since time.Time
+	if req.Since != nil {
+		if err := req.Since.CheckValid(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid since: %v", err)
+		}
+		since = req.Since.AsTime()
+	}
+	changes := s.p.Changes(req.Kind, since, int(req.Limit))
+	resp := &mongoproxyv1.ListChangesResponse{Changes: make([]*mongoproxyv1.Change, len(changes))}
+	for i, c := range changes {
+		resp.Changes[i] = &mongoproxyv1.Change{
+			Id:     c.ID,
+			Time:   timestamppb.New(c.Time),
+			Kind:   c.Kind,
+			Source: c.Source,
+			User:   c.User,
+			Diff:   c.Diff,
+		}
+	}
+	return resp, nil
+}
+
+// StreamEvents streams the events (of the requested types, all if none) until
+// the client cancels
+func (s *controlServer) StreamEvents(req *mongoproxyv1.StreamEventsRequest, stream mongoproxyv1.ControlPlane_StreamEventsServer) error {
+	sub := plugins.SubscribeEvents(req.Types...)
+	defer sub.Close()
+
+	// Send the headers so the client knows it is subscribed
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e := <-sub.C:
+			event := &mongoproxyv1.Event{
+				Time:        timestamppb.New(e.Time),
+				Type:        e.Type,
+				Source:      e.Source,
+				Message:     e.Message,
+				Db:          e.Database,
+				Collection:  e.Collection,
+				CommandName: e.CommandName,
+			}
+			if len(e.Fields) > 0 {
+				b, err := json.Marshal(e.Fields)
+				if err != nil {
+					return status.Error(codes.Internal, err.Error())
+				}
+				event.Fields = string(b)
+			}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// tapProvider returns the first plugin of the chain streaming taps
+func (p *Proxy) tapProvider() plugins.TapProvider {
+	p.chainLock.RLock()
+	c := p.chain
+	p.chainLock.RUnlock()
+
+	for _, pl := range c.plugins {
+		if tp, ok := plugins.Unwrap(pl).(plugins.TapProvider); ok {
+			return tp
+		}
+	}
+	return nil
+}
+
+// StreamTap streams a sample of the requests (matching the request) as they
+// complete, until the client cancels or the tap's duration passed
+func (s *controlServer) StreamTap(req *mongoproxyv1.StreamTapRequest, stream mongoproxyv1.ControlPlane_StreamTapServer) error {
+	if req.Sample < 0 || req.Sample > 1 {
+		return status.Errorf(codes.InvalidArgument, "sample must be in (0, 1]: %v", req.Sample)
+	}
+	tp := s.p.tapProvider()
+	if tp == nil {
+		return status.Error(codes.FailedPrecondition, "no plugin in the chain streams taps")
+	}
+	t, err := tp.StartTap(stream.Context(), plugins.TapOptions{
+		Collections: req.Collections,
+		Commands:    req.Commands,
+		Client:      req.Client,
+		Fingerprint: req.Fingerprint,
+		Sample:      req.Sample,
+		Values:      req.Values,
+		Duration:    req.Duration.AsDuration(),
+	})
+	if err != nil {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	defer t.Close()
+	logrus.Infof("Tap started: client=%s sample=%v values=%v", controlUser(stream.Context()), req.Sample, req.Values)
+
+	// Send the headers so the client knows the tap started
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-t.Done():
+			return nil
+		case rec := <-t.Records():
+			if err := stream.Send(&mongoproxyv1.TapRecord{
+				Time:        timestamppb.New(rec.Time),
+				Duration:    durationpb.New(time.Duration(rec.DurationMS * float64(time.Millisecond))),
+				Client:      rec.Client,
+				AppName:     rec.AppName,
+				User:        rec.User,
+				Db:          rec.Database,
+				Collection:  rec.Collection,
+				CommandName: rec.CommandName,
+				Fingerprint: rec.Fingerprint,
+				Request:     string(rec.Request),
+				Ok:          rec.OK,
+				CodeName:    rec.CodeName,
+				Docs:        int64(rec.Docs),
+				Error:       rec.Error,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package mongoproxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	mongoproxyv1 "github.com/wish/mongoproxy/api/mongoproxy/v1"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+	"github.com/wish/mongoproxy/pkg/mongotest"
+)
+
+func TestControlPlane(t *testing.T) {
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	proxy := newDeadlineProxy(t, backend, nil, &config.Config{})
+	defer proxy.Shutdown(context.TODO())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := proxy.ControlServer()
+	go server.Serve(l)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, l.Addr().String(), grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := mongoproxyv1.NewControlPlaneClient(conn)
+
+	// Plugins
+	pcs, err := client.SetPluginEnabled(ctx, &mongoproxyv1.SetPluginEnabledRequest{Name: "mongo", Enabled: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pcs.Plugins) != 1 || pcs.Plugins[0].Name != "mongo" || !strings.Contains(pcs.Plugins[0].Config, `"enabled":false`) {
+		t.Fatalf("expected the mongo plugin disabled, got %v", pcs.Plugins)
+	}
+	if _, err := client.SetPluginEnabled(ctx, &mongoproxyv1.SetPluginEnabledRequest{Name: "nope"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+	if _, err := client.SetPluginConfig(ctx, &mongoproxyv1.SetPluginConfigRequest{Name: "mongo", Config: "{"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+
+	// Read-only mode, recorded in the changes as made by the client
+	if ro, err := client.SetReadOnly(ctx, &mongoproxyv1.SetReadOnlyRequest{ReadOnly: true}); err != nil || !ro.ReadOnly {
+		t.Fatalf("expected read-only mode, got %v %v", ro, err)
+	}
+	if ro, err := client.GetReadOnly(ctx, &mongoproxyv1.GetReadOnlyRequest{}); err != nil || !ro.ReadOnly || !proxy.ReadOnly() {
+		t.Fatalf("expected read-only mode, got %v %v", ro, err)
+	}
+	changes, err := client.ListChanges(ctx, &mongoproxyv1.ListChangesRequest{Kind: "readOnly"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.Changes) != 1 || changes.Changes[0].Source != "admin" || !strings.HasPrefix(changes.Changes[0].User, "127.0.0.1:") {
+		t.Fatalf("expected the read-only change, got %v", changes.Changes)
+	}
+	if _, err := client.ListChanges(ctx, &mongoproxyv1.ListChangesRequest{Limit: -1}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+
+	// Ops and cursors
+	if _, err := client.KillOp(ctx, &mongoproxyv1.KillOpRequest{Id: 1234}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+	if ops, err := client.ListOps(ctx, &mongoproxyv1.ListOpsRequest{}); err != nil || len(ops.Ops) != 0 {
+		t.Fatalf("expected no ops, got %v %v", ops, err)
+	}
+}
+
+func TestControlPlaneEvents(t *testing.T) {
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	proxy := newDeadlineProxy(t, backend, nil, &config.Config{})
+	defer proxy.Shutdown(context.TODO())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := proxy.ControlServer()
+	go server.Serve(l)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, l.Addr().String(), grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The proxies' own topology events are streamed too, so use a type of the test
+	const eventType = "controlPlaneTest"
+	stream, err := mongoproxyv1.NewControlPlaneClient(conn).StreamEvents(ctx, &mongoproxyv1.StreamEventsRequest{Types: []string{eventType}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The headers are sent once subscribed
+	if _, err := stream.Header(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the events of the requested types are streamed
+	plugins.PublishEvent(&plugins.Event{Type: plugins.EventSlowQuery})
+	plugins.PublishEvent(&plugins.Event{
+		Type:    eventType,
+		Source:  "mongo",
+		Message: "server changed",
+		Fields:  map[string]interface{}{"newKind": "RSPrimary"},
+	})
+	e, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != eventType || e.Source != "mongo" || e.Message != "server changed" || e.Fields != `{"newKind":"RSPrimary"}` || e.Time.AsTime().IsZero() {
+		t.Fatalf("expected the test event, got %v", e)
+	}
+}
+
+func TestControlPlaneTap(t *testing.T) {
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{Plugins: []config.PluginConfig{
+		{Name: "capture"},
+		{Name: "mongo", Config: bson.D{{"mongoAddr", backend.URI()}}},
+	}}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewProxy(l, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Serve()
+	defer proxy.Shutdown(context.TODO())
+
+	cl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := proxy.ControlServer()
+	go server.Serve(cl)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, cl.Addr().String(), grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := mongoproxyv1.NewControlPlaneClient(conn)
+
+	// Values are only streamed if the capture plugin allows it
+	denied, err := client.StreamTap(ctx, &mongoproxyv1.StreamTapRequest{Values: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := denied.Recv(); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition, got %v", err)
+	}
+
+	stream, err := client.StreamTap(ctx, &mongoproxyv1.StreamTapRequest{Collections: []string{"test.foo"}, Duration: durationpb.New(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The headers are sent once the tap started
+	if _, err := stream.Header(); err != nil {
+		t.Fatal(err)
+	}
+
+	mc, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://"+proxy.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Disconnect(ctx)
+	for _, coll := range []string{"bar", "foo"} {
+		if _, err := mc.Database("test").Collection(coll).InsertOne(ctx, bson.D{{"secret", "value"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the requests of the tap's collections are streamed
+	rec, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Db != "test" || rec.Collection != "foo" || rec.CommandName != "insert" || !rec.Ok || rec.Docs != 1 || rec.Time.AsTime().IsZero() {
+		t.Fatalf("unexpected record %v", rec)
+	}
+	if strings.Contains(rec.Request, "value") || !strings.Contains(rec.Request, `"?"`) {
+		t.Fatalf("expected the shape of the request, got %s", rec.Request)
+	}
+}
@@ -0,0 +1,488 @@
+package mongoproxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/graphql"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+// DataAPIIdentityType is the type of the identities of the data API clients
+const DataAPIIdentityType = "dataAPI"
+
+var dataAPIRequestsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mongoproxy_dataapi_requests_total",
+	Help: "The total requests of the data API by action and HTTP status",
+}, []string{"action", "status"})
+
+// dataAPIKey is an API key of the data API and the client it authenticates
+type dataAPIKey struct {
+	key  []byte
+	conf config.DataAPIKeyConfig
+}
+
+// loadDataAPIKeys reads the keys of the data API clients from their files
+func loadDataAPIKeys(conf *config.DataAPIConfig) ([]dataAPIKey, error) {
+	keys := make([]dataAPIKey, len(conf.Keys))
+	for i, k := range conf.Keys {
+		b, err := ioutil.ReadFile(k.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading data API key: %w", err)
+		}
+		key := strings.TrimSpace(string(b))
+		if len(key) < 32 {
+			return nil, fmt.Errorf("invalid data API key %s: must be at least 32 characters, got %d", k.KeyFile, len(key))
+		}
+		keys[i] = dataAPIKey{key: []byte(key), conf: k}
+	}
+	return keys, nil
+}
+
+// dataAPIClient returns the client connection of the request's bearer token (nil
+// if it isn't a key of the data API)
+func (p *Proxy) dataAPIClient(r *http.Request) *plugins.ClientConnection {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil
+	}
+	token := []byte(strings.TrimPrefix(auth, "Bearer "))
+	for _, k := range p.dataAPIKeys {
+		if subtle.ConstantTimeCompare(token, k.key) == 1 {
+			cc := plugins.NewClientConnection()
+			cc.Addr, _ = net.ResolveTCPAddr("tcp", r.RemoteAddr)
+			cc.AppName = k.conf.AppName
+			cc.Identities = []plugins.ClientIdentity{plugins.NewStaticIdentity(DataAPIIdentityType, k.conf.User, k.conf.Roles...)}
+			return cc
+		}
+	}
+	return nil
+}
+
+type dataAPIFind struct {
+	Filter     bson.D `bson:"filter"`
+	Projection bson.D `bson:"projection"`
+	Sort       bson.D `bson:"sort"`
+	Skip       int64  `bson:"skip"`
+	Limit      int64  `bson:"limit"`
+}
+
+type dataAPIInsert struct {
+	Documents []bson.D `bson:"documents"`
+}
+
+type dataAPIUpdate struct {
+	Filter bson.D `bson:"filter"`
+	// Update is an update document or pipeline
+	Update interface{} `bson:"update"`
+	Upsert bool        `bson:"upsert"`
+	Multi  bool        `bson:"multi"`
+}
+
+// dataAPIResult is the part of the command responses the data API returns
+type dataAPIResult struct {
+	Ok       float64 `bson:"ok"`
+	Errmsg   string  `bson:"errmsg"`
+	Code     int32   `bson:"code"`
+	CodeName string  `bson:"codeName"`
+
+	Cursor struct {
+		FirstBatch []bson.Raw `bson:"firstBatch"`
+	} `bson:"cursor"`
+
+	N         int64 `bson:"n"`
+	NModified int64 `bson:"nModified"`
+	Upserted  []struct {
+		ID interface{} `bson:"_id"`
+	} `bson:"upserted"`
+	WriteErrors []struct {
+		Index  int64  `bson:"index"`
+		Code   int32  `bson:"code"`
+		Errmsg string `bson:"errmsg"`
+	} `bson:"writeErrors"`
+	WriteConcernError *struct {
+		Code   int32  `bson:"code"`
+		Errmsg string `bson:"errmsg"`
+	} `bson:"writeConcernError"`
+}
+
+// dataAPIError is an error response of the data API
+type dataAPIError struct {
+	status int
+	body   bson.D
+}
+
+func newDataAPIError(status int, msg string) *dataAPIError {
+	return &dataAPIError{status: status, body: bson.D{{"error", msg}}}
+}
+
+// newDataAPICommandError returns the error response of a command error
+func newDataAPICommandError(code int32, msg string) *dataAPIError {
+	status := http.StatusBadRequest
+	if mongoerror.ErrorCode(code) == mongoerror.Unauthorized {
+		status = http.StatusForbidden
+	}
+	return &dataAPIError{status: status, body: bson.D{
+		{"error", msg},
+		{"code", code},
+		{"codeName", mongoerror.ErrorCode(code).String()},
+	}}
+}
+
+// DataAPIHandler returns an http.Handler for the data API, a REST/JSON facade of
+// finds, inserts and updates for clients which can't hold mongo connections:
+//
+//	POST /v1/{db}/{collection}/find     the documents of {filter, projection, sort, skip, limit}
+//	POST /v1/{db}/{collection}/insert   insert the {documents} (with generated _ids if missing)
+//	POST /v1/{db}/{collection}/update   update the documents of {filter} with {update, upsert, multi}
+//	POST /v1/graphql                    answer the GraphQL query (if a plugin provides GraphQL)
+//	GET  /v1/graphql/schema             the GraphQL schema, in the schema definition language
+//
+// Bodies and responses are extended JSON (responses are relaxed), except for
+// GraphQL's and the documents of finds accepting Arrow IPC streams. Clients authenticate with one of the API keys as a bearer token, and
+// the commands are run through the plugin chain as a client with the key's
+// identity and appName.
+func (p *Proxy) DataAPIHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/graphql":
+			p.serveGraphQL(w, r)
+			return
+		case "/v1/graphql/schema":
+			p.serveGraphQLSchema(w, r)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/"), "/")
+		if !strings.HasPrefix(r.URL.Path, "/v1/") || len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+			http.NotFound(w, r)
+			return
+		}
+		db, coll, action := parts[0], parts[1], parts[2]
+		var run func(context.Context, *plugins.ClientConnection, string, string, bson.D) (bson.D, *dataAPIError)
+		switch action {
+		case "find":
+			run = p.dataAPIFind
+		case "insert":
+			run = p.dataAPIInsert
+		case "update":
+			run = p.dataAPIUpdate
+		default:
+			http.NotFound(w, r)
+			return
+		}
+
+		resp, dErr := func() (bson.D, *dataAPIError) {
+			cc, b, dErr := p.readDataAPIRequest(w, r, http.MethodPost)
+			if dErr != nil {
+				return nil, dErr
+			}
+			var body bson.D
+			if err := bson.UnmarshalExtJSON(b, false, &body); err != nil {
+				return nil, newDataAPIError(http.StatusBadRequest, "invalid body: "+err.Error())
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), p.cfg.DataAPI.TimeoutDuration)
+			defer cancel()
+			return run(ctx, cc, db, coll, body)
+		}()
+
+		if dErr == nil && action == "find" && acceptsArrow(r) {
+			writeDataAPIArrow(w, action, resp)
+			return
+		}
+		status, body := http.StatusOK, resp
+		if dErr != nil {
+			status, body = dErr.status, dErr.body
+		}
+		writeDataAPIResponse(w, action, status, body)
+	})
+}
+
+// readDataAPIRequest authenticates the request (of the method) and reads its
+// body, of at most MaxBodyBytes
+func (p *Proxy) readDataAPIRequest(w http.ResponseWriter, r *http.Request, method string) (*plugins.ClientConnection, []byte, *dataAPIError) {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		return nil, nil, newDataAPIError(http.StatusMethodNotAllowed, "method not allowed")
+	}
+	cc := p.dataAPIClient(r)
+	if cc == nil {
+		return nil, nil, newDataAPIError(http.StatusUnauthorized, "invalid API key")
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, p.cfg.DataAPI.MaxBodyBytes+1))
+	if err != nil {
+		return nil, nil, newDataAPIError(http.StatusBadRequest, err.Error())
+	}
+	if int64(len(b)) > p.cfg.DataAPI.MaxBodyBytes {
+		return nil, nil, newDataAPIError(http.StatusRequestEntityTooLarge, "body larger than "+strconv.FormatInt(p.cfg.DataAPI.MaxBodyBytes, 10)+" bytes")
+	}
+	return cc, b, nil
+}
+
+// writeDataAPIResponse writes the body as relaxed extended JSON
+func writeDataAPIResponse(w http.ResponseWriter, action string, status int, body bson.D) {
+	dataAPIRequestsCounter.WithLabelValues(action, strconv.Itoa(status)).Inc()
+	b, err := bson.MarshalExtJSON(body, false, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// graphQLProvider returns the first plugin of the chain which answers GraphQL
+// queries, and its schema
+func (p *Proxy) graphQLProvider() (plugins.GraphQLProvider, string) {
+	p.chainLock.RLock()
+	c := p.chain
+	p.chainLock.RUnlock()
+
+	for _, pl := range c.plugins {
+		gp, ok := plugins.Unwrap(pl).(plugins.GraphQLProvider)
+		if !ok {
+			continue
+		}
+		if sdl, ok := gp.GraphQLSchema(); ok {
+			return gp, sdl
+		}
+	}
+	return nil, ""
+}
+
+// serveGraphQL answers the GraphQL query of the body, running its commands as
+// the client; errors of the query (rather than the request) are in the response
+func (p *Proxy) serveGraphQL(w http.ResponseWriter, r *http.Request) {
+	cc, b, dErr := p.readDataAPIRequest(w, r, http.MethodPost)
+	if dErr != nil {
+		writeDataAPIResponse(w, "graphql", dErr.status, dErr.body)
+		return
+	}
+	gp, _ := p.graphQLProvider()
+	if gp == nil {
+		writeDataAPIResponse(w, "graphql", http.StatusNotFound, bson.D{{"error", "GraphQL is not enabled"}})
+		return
+	}
+	var req graphql.Request
+	if err := json.Unmarshal(b, &req); err != nil {
+		writeDataAPIResponse(w, "graphql", http.StatusBadRequest, bson.D{{"error", "invalid body: " + err.Error()}})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), p.cfg.DataAPI.TimeoutDuration)
+	defer cancel()
+	resp := gp.ResolveGraphQL(ctx, &req, &dataAPIRunner{p: p, cc: cc}, p.cfg.DataAPI.MaxLimit)
+	b, err := json.Marshal(resp)
+	if err != nil {
+		writeDataAPIResponse(w, "graphql", http.StatusInternalServerError, bson.D{{"error", err.Error()}})
+		return
+	}
+	dataAPIRequestsCounter.WithLabelValues("graphql", strconv.Itoa(http.StatusOK)).Inc()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// serveGraphQLSchema writes the GraphQL schema, for clients (and their tooling)
+// as introspection isn't supported
+func (p *Proxy) serveGraphQLSchema(w http.ResponseWriter, r *http.Request) {
+	if _, _, dErr := p.readDataAPIRequest(w, r, http.MethodGet); dErr != nil {
+		writeDataAPIResponse(w, "graphqlSchema", dErr.status, dErr.body)
+		return
+	}
+	gp, sdl := p.graphQLProvider()
+	if gp == nil {
+		writeDataAPIResponse(w, "graphqlSchema", http.StatusNotFound, bson.D{{"error", "GraphQL is not enabled"}})
+		return
+	}
+	dataAPIRequestsCounter.WithLabelValues("graphqlSchema", strconv.Itoa(http.StatusOK)).Inc()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, sdl)
+}
+
+// dataAPIRunner is a plugins.CommandRunner running commands through the plugin
+// chain as a data API client
+type dataAPIRunner struct {
+	p  *Proxy
+	cc *plugins.ClientConnection
+}
+
+func (r *dataAPIRunner) RunCommand(ctx context.Context, db string, cmd bson.D) (bson.D, error) {
+	cmd = append(append(make(bson.D, 0, len(cmd)+1), cmd...), bson.E{"$db", db})
+	return r.p.HandleMongo(ctx, &plugins.Request{CC: r.cc, CursorCache: r.p}, cmd)
+}
+
+// decodeDataAPIBody decodes the body into v, rejecting unknown fields
+func decodeDataAPIBody(body bson.D, v interface{}) *dataAPIError {
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(body))
+	if err == nil {
+		err = dec.Decode(v)
+	}
+	if err != nil {
+		return newDataAPIError(http.StatusBadRequest, "invalid body: "+err.Error())
+	}
+	return nil
+}
+
+// runDataAPI runs the command through the plugin chain, returning its result or
+// the error response of the command's (or its first write's) error
+func (p *Proxy) runDataAPI(ctx context.Context, cc *plugins.ClientConnection, cmd bson.D) (*dataAPIResult, *dataAPIError) {
+	resp, err := p.HandleMongo(ctx, &plugins.Request{CC: cc, CursorCache: p}, cmd)
+	if err != nil {
+		return nil, newDataAPIError(http.StatusInternalServerError, err.Error())
+	}
+	b, err := bson.Marshal(resp)
+	if err != nil {
+		return nil, newDataAPIError(http.StatusInternalServerError, err.Error())
+	}
+	var result dataAPIResult
+	if err := bson.Unmarshal(b, &result); err != nil {
+		return nil, newDataAPIError(http.StatusInternalServerError, "invalid response: "+err.Error())
+	}
+	if result.Ok != 1 {
+		return nil, newDataAPICommandError(result.Code, result.Errmsg)
+	}
+	if len(result.WriteErrors) > 0 {
+		// Writes are ordered, so the ones before the error were applied
+		writeErr := result.WriteErrors[0]
+		dErr := newDataAPICommandError(writeErr.Code, writeErr.Errmsg)
+		dErr.body = append(dErr.body, bson.E{"index", writeErr.Index})
+		return nil, dErr
+	}
+	if result.WriteConcernError != nil {
+		return nil, newDataAPICommandError(result.WriteConcernError.Code, result.WriteConcernError.Errmsg)
+	}
+	return &result, nil
+}
+
+// dataAPIFind returns the documents of the find in a single batch of at most
+// MaxLimit documents
+func (p *Proxy) dataAPIFind(ctx context.Context, cc *plugins.ClientConnection, db, coll string, body bson.D) (bson.D, *dataAPIError) {
+	var req dataAPIFind
+	if dErr := decodeDataAPIBody(body, &req); dErr != nil {
+		return nil, dErr
+	}
+	if req.Skip < 0 || req.Limit < 0 {
+		return nil, newDataAPIError(http.StatusBadRequest, "skip and limit must not be negative")
+	}
+	limit := req.Limit
+	if limit == 0 || limit > p.cfg.DataAPI.MaxLimit {
+		limit = p.cfg.DataAPI.MaxLimit
+	}
+	if req.Filter == nil {
+		req.Filter = bson.D{}
+	}
+
+	cmd := bson.D{{"find", coll}, {"filter", req.Filter}}
+	if req.Projection != nil {
+		cmd = append(cmd, bson.E{"projection", req.Projection})
+	}
+	if req.Sort != nil {
+		cmd = append(cmd, bson.E{"sort", req.Sort})
+	}
+	if req.Skip > 0 {
+		cmd = append(cmd, bson.E{"skip", req.Skip})
+	}
+	// A single batch closes the cursor, so none is left open on the backend
+	cmd = append(cmd,
+		bson.E{"limit", limit},
+		bson.E{"batchSize", limit},
+		bson.E{"singleBatch", true},
+		bson.E{"$db", db},
+	)
+	result, dErr := p.runDataAPI(ctx, cc, cmd)
+	if dErr != nil {
+		return nil, dErr
+	}
+	documents := result.Cursor.FirstBatch
+	if documents == nil {
+		documents = []bson.Raw{}
+	}
+	return bson.D{{"documents", documents}}, nil
+}
+
+// dataAPIInsert inserts the documents (in order), generating the _ids of those
+// without one
+func (p *Proxy) dataAPIInsert(ctx context.Context, cc *plugins.ClientConnection, db, coll string, body bson.D) (bson.D, *dataAPIError) {
+	var req dataAPIInsert
+	if dErr := decodeDataAPIBody(body, &req); dErr != nil {
+		return nil, dErr
+	}
+	if len(req.Documents) == 0 {
+		return nil, newDataAPIError(http.StatusBadRequest, "documents must be set")
+	}
+
+	documents := make(bson.A, len(req.Documents))
+	ids := make(bson.A, len(req.Documents))
+	for i, doc := range req.Documents {
+		id, ok := bsonutil.Lookup(doc, "_id")
+		if !ok {
+			id = primitive.NewObjectID()
+			doc = append(bson.D{{"_id", id}}, doc...)
+		}
+		documents[i], ids[i] = doc, id
+	}
+	result, dErr := p.runDataAPI(ctx, cc, bson.D{
+		{"insert", coll},
+		{"documents", documents},
+		{"ordered", true},
+		{"$db", db},
+	})
+	if dErr != nil {
+		return nil, dErr
+	}
+	return bson.D{{"insertedCount", result.N}, {"insertedIds", ids}}, nil
+}
+
+// dataAPIUpdate updates the document (or documents, with multi) of the filter
+func (p *Proxy) dataAPIUpdate(ctx context.Context, cc *plugins.ClientConnection, db, coll string, body bson.D) (bson.D, *dataAPIError) {
+	var req dataAPIUpdate
+	if dErr := decodeDataAPIBody(body, &req); dErr != nil {
+		return nil, dErr
+	}
+	if req.Update == nil {
+		return nil, newDataAPIError(http.StatusBadRequest, "update must be set")
+	}
+	if req.Filter == nil {
+		req.Filter = bson.D{}
+	}
+
+	result, dErr := p.runDataAPI(ctx, cc, bson.D{
+		{"update", coll},
+		{"updates", bson.A{bson.D{
+			{"q", req.Filter},
+			{"u", req.Update},
+			{"upsert", req.Upsert},
+			{"multi", req.Multi},
+		}}},
+		{"ordered", true},
+		{"$db", db},
+	})
+	if dErr != nil {
+		return nil, dErr
+	}
+	resp := bson.D{
+		{"matchedCount", result.N - int64(len(result.Upserted))},
+		{"modifiedCount", result.NModified},
+	}
+	if len(result.Upserted) > 0 {
+		resp = append(resp, bson.E{"upsertedId", result.Upserted[0].ID})
+	}
+	return resp, nil
+}
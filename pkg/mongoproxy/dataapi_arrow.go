@@ -0,0 +1,66 @@
+package mongoproxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/apache/arrow/go/v7/arrow/ipc"
+	"github.com/apache/arrow/go/v7/arrow/memory"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonarrow"
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+)
+
+// arrowStreamType is the media type of Arrow IPC streams, which clients of the
+// data API can accept instead of JSON for the documents of finds
+const arrowStreamType = "application/vnd.apache.arrow.stream"
+
+// acceptsArrow returns whether the request accepts Arrow IPC streams
+func acceptsArrow(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if strings.TrimSpace(strings.SplitN(accept, ";", 2)[0]) == arrowStreamType {
+			return true
+		}
+	}
+	return false
+}
+
+// writeDataAPIArrow writes the documents of a find response as an Arrow IPC stream
+func writeDataAPIArrow(w http.ResponseWriter, action string, resp bson.D) {
+	documents, _ := bsonutil.Lookup(resp, "documents")
+	var buf bytes.Buffer
+	if err := writeArrowDocuments(&buf, documents.([]bson.Raw)); err != nil {
+		writeDataAPIResponse(w, action, http.StatusInternalServerError, newDataAPIError(http.StatusInternalServerError, err.Error()).body)
+		return
+	}
+	dataAPIRequestsCounter.WithLabelValues(action, strconv.Itoa(http.StatusOK)).Inc()
+	w.Header().Set("Content-Type", arrowStreamType)
+	w.WriteHeader(http.StatusOK)
+	buf.WriteTo(w)
+}
+
+// writeArrowDocuments writes the documents as an Arrow IPC stream of a single
+// record batch. The columns are the top-level fields of the documents (in the
+// order they are first seen), typed by their values: missing fields are nulls.
+func writeArrowDocuments(w io.Writer, documents []bson.Raw) error {
+	schema, err := bsonarrow.NewSchema(documents)
+	if err != nil {
+		return err
+	}
+	mem := memory.NewGoAllocator()
+	rec, err := schema.Record(mem, documents)
+	if err != nil {
+		return err
+	}
+	defer rec.Release()
+
+	iw := ipc.NewWriter(w, ipc.WithSchema(schema.Arrow()), ipc.WithAllocator(mem))
+	if err := iw.Write(rec); err != nil {
+		return err
+	}
+	return iw.Close()
+}
@@ -0,0 +1,112 @@
+package mongoproxy
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v7/arrow"
+	"github.com/apache/arrow/go/v7/arrow/array"
+	"github.com/apache/arrow/go/v7/arrow/ipc"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestWriteArrowDocuments(t *testing.T) {
+	oid := primitive.NewObjectID()
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var documents []bson.Raw
+	for _, doc := range []bson.D{
+		{{"_id", oid}, {"n", int32(1)}, {"f", int32(1)}, {"s", "a"}, {"b", true}, {"created", primitive.NewDateTimeFromTime(created)}, {"mixed", "x"}, {"nested", bson.D{{"a", 1}}}},
+		{{"n", int32(2)}, {"f", 1.5}, {"s", nil}, {"b", false}, {"mixed", int32(1)}, {"extra", nil}},
+		{{"n", int64(3)}},
+	} {
+		b, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		documents = append(documents, b)
+	}
+
+	var buf bytes.Buffer
+	if err := writeArrowDocuments(&buf, documents); err != nil {
+		t.Fatal(err)
+	}
+	r, err := ipc.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Release()
+
+	// Columns are typed by their values, integers are widened and columns of
+	// unrelated types are JSON
+	types := map[string]arrow.DataType{
+		"_id":     arrow.BinaryTypes.String,
+		"n":       arrow.PrimitiveTypes.Int64,
+		"f":       arrow.PrimitiveTypes.Float64,
+		"s":       arrow.BinaryTypes.String,
+		"b":       arrow.FixedWidthTypes.Boolean,
+		"created": arrow.FixedWidthTypes.Timestamp_ms,
+		"mixed":   arrow.BinaryTypes.String,
+		"nested":  arrow.BinaryTypes.String,
+		"extra":   arrow.Null,
+	}
+	fields := r.Schema().Fields()
+	if len(fields) != len(types) || fields[0].Name != "_id" || fields[len(fields)-1].Name != "extra" {
+		t.Fatalf("unexpected schema %s", r.Schema())
+	}
+	for _, f := range fields {
+		if !arrow.TypeEqual(f.Type, types[f.Name]) {
+			t.Fatalf("expected %s to be %s, got %s", f.Name, types[f.Name], f.Type)
+		}
+	}
+
+	if !r.Next() {
+		t.Fatal("expected a record batch")
+	}
+	rec := r.Record()
+	if rec.NumRows() != 3 {
+		t.Fatalf("expected 3 rows, got %d", rec.NumRows())
+	}
+	column := func(name string) array.Interface {
+		return rec.Column(r.Schema().FieldIndices(name)[0])
+	}
+	values := func(a array.Interface) []interface{} {
+		var v []interface{}
+		for i := 0; i < a.Len(); i++ {
+			switch {
+			case a.IsNull(i):
+				v = append(v, nil)
+			case a.DataType().ID() == arrow.STRING:
+				v = append(v, a.(*array.String).Value(i))
+			case a.DataType().ID() == arrow.INT64:
+				v = append(v, a.(*array.Int64).Value(i))
+			case a.DataType().ID() == arrow.FLOAT64:
+				v = append(v, a.(*array.Float64).Value(i))
+			case a.DataType().ID() == arrow.BOOL:
+				v = append(v, a.(*array.Boolean).Value(i))
+			case a.DataType().ID() == arrow.TIMESTAMP:
+				v = append(v, int64(a.(*array.Timestamp).Value(i)))
+			}
+		}
+		return v
+	}
+	for name, expected := range map[string][]interface{}{
+		"_id":     {oid.Hex(), nil, nil},
+		"n":       {int64(1), int64(2), int64(3)},
+		"f":       {1.0, 1.5, nil},
+		"s":       {"a", nil, nil},
+		"b":       {true, false, nil},
+		"created": {created.UnixNano() / int64(time.Millisecond), nil, nil},
+		"mixed":   {`"x"`, `1`, nil},
+		"nested":  {`{"a":1}`, nil, nil},
+	} {
+		if v := values(column(name)); !reflect.DeepEqual(v, expected) {
+			t.Fatalf("expected %s %v, got %v", name, expected, v)
+		}
+	}
+	if r.Next() {
+		t.Fatal("expected a single record batch")
+	}
+}
@@ -0,0 +1,291 @@
+package mongoproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/apache/arrow/go/v7/arrow/ipc"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins/schema"
+	"github.com/wish/mongoproxy/pkg/mongotest"
+)
+
+func TestDataAPI(t *testing.T) {
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	backend.Store.Insert("test", "foo",
+		bson.D{{"_id", 1}, {"a", "x"}},
+		bson.D{{"_id", 2}, {"a", "y"}},
+		bson.D{{"_id", 3}, {"a", "y"}},
+	)
+
+	dir, err := ioutil.TempDir("", "dataapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := strings.Repeat("k", 32)
+	keyFile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, []byte(key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		Plugins: []config.PluginConfig{
+			{Name: "mongo", Config: bson.D{{"connectTimeout", "1s"}, {"mongoAddr", backend.URI()}}},
+		},
+		DataAPI: &config.DataAPIConfig{
+			BindAddr: "127.0.0.1:0",
+			Keys:     []config.DataAPIKeyConfig{{KeyFile: keyFile, User: "edge", Roles: []string{"readWrite"}}},
+			MaxLimit: 2,
+		},
+	}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewProxy(l, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Serve()
+	defer proxy.Shutdown(context.TODO())
+
+	server := httptest.NewServer(proxy.DataAPIHandler())
+	defer server.Close()
+
+	tests := []struct {
+		method string
+		path   string
+		key    string
+		body   string
+		code   int
+		resp   string
+	}{
+		{http.MethodPost, "/v1/test/foo/find", key, `{"filter": {"a": "y"}}`, http.StatusOK, `{"documents":[{"_id":2,"a":"y"},{"_id":3,"a":"y"}]}`},
+		// The limit is capped at maxLimit
+		{http.MethodPost, "/v1/test/foo/find", key, `{"limit": 10}`, http.StatusOK, `{"documents":[{"_id":1,"a":"x"},{"_id":2,"a":"y"}]}`},
+		{http.MethodPost, "/v1/test/foo/find", key, `{"skip": 2}`, http.StatusOK, `{"documents":[{"_id":3,"a":"y"}]}`},
+		{http.MethodPost, "/v1/test/bar/find", key, `{}`, http.StatusOK, `{"documents":[]}`},
+		{http.MethodPost, "/v1/test/foo/insert", key, `{"documents": [{"_id": 4, "n": {"$numberLong": "5"}}]}`, http.StatusOK, `{"insertedCount":1,"insertedIds":[4]}`},
+		{http.MethodPost, "/v1/test/foo/find", key, `{"filter": {"_id": 4}}`, http.StatusOK, `{"documents":[{"_id":4,"n":5}]}`},
+		{http.MethodPost, "/v1/test/foo/update", key, `{"filter": {"a": "y"}, "update": {"$set": {"b": 1}}, "multi": true}`, http.StatusOK, `{"matchedCount":2,"modifiedCount":2}`},
+		{http.MethodPost, "/v1/test/foo/update", key, `{"filter": {"_id": 9}, "update": {"$set": {"b": 1}}, "upsert": true}`, http.StatusOK, `{"matchedCount":0,"modifiedCount":0,"upsertedId":9}`},
+
+		{http.MethodPost, "/v1/test/foo/find", "", `{}`, http.StatusUnauthorized, `{"error":"invalid API key"}`},
+		{http.MethodPost, "/v1/test/foo/find", strings.Repeat("x", 32), `{}`, http.StatusUnauthorized, `{"error":"invalid API key"}`},
+		{http.MethodGet, "/v1/test/foo/find", key, ``, http.StatusMethodNotAllowed, `{"error":"method not allowed"}`},
+		{http.MethodPost, "/v1/test/foo/delete", key, `{}`, http.StatusNotFound, ""},
+		{http.MethodPost, "/v1/test/find", key, `{}`, http.StatusNotFound, ""},
+		{http.MethodPost, "/v1/test/foo/find", key, `{"unknown": 1}`, http.StatusBadRequest, ""},
+		{http.MethodPost, "/v1/test/foo/find", key, `not json`, http.StatusBadRequest, ""},
+		{http.MethodPost, "/v1/test/foo/insert", key, `{"documents": []}`, http.StatusBadRequest, `{"error":"documents must be set"}`},
+		{http.MethodPost, "/v1/test/foo/update", key, `{"filter": {}}`, http.StatusBadRequest, `{"error":"update must be set"}`},
+		{http.MethodPost, "/v1/test/foo/find", key, `{"filter": {"a": "` + strings.Repeat("a", 16*1024*1024) + `"}}`, http.StatusRequestEntityTooLarge, ""},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest(test.method, server.URL+test.path, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.key != "" {
+			req.Header.Set("Authorization", "Bearer "+test.key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.code {
+			t.Fatalf("%d: expected %d, got %d: %s", i, test.code, resp.StatusCode, b)
+		}
+		if test.resp != "" && string(b) != test.resp {
+			t.Fatalf("%d: expected %s, got %s", i, test.resp, b)
+		}
+	}
+
+	// Inserted documents without an _id get one
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/v1/test/baz/insert", strings.NewReader(`{"documents": [{"a": 1}]}`))
+	req.Header.Set("Authorization", "Bearer "+key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(b), `"insertedIds":[{"$oid":"`) {
+		t.Fatalf("expected a generated _id, got %s", b)
+	}
+	if docs := backend.Store.Documents("test", "baz"); len(docs) != 1 || docs[0][0].Key != "_id" {
+		t.Fatalf("unexpected documents %v", docs)
+	}
+
+	// Finds can be answered as Arrow IPC streams
+	req, _ = http.NewRequest(http.MethodPost, server.URL+"/v1/test/foo/find", strings.NewReader(`{"filter": {"a": "y"}}`))
+	req.Header.Set("Authorization", "Bearer "+key)
+	req.Header.Set("Accept", "application/vnd.apache.arrow.stream, application/json;q=0.5")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar, err := ipc.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get("Content-Type") != "application/vnd.apache.arrow.stream" || !ar.Next() || ar.Record().NumRows() != 2 || ar.Schema().Field(1).Name != "a" {
+		t.Fatalf("unexpected Arrow response %s", ar.Schema())
+	}
+	ar.Release()
+	resp.Body.Close()
+
+	// Command and write errors are returned with their code
+	backend.Handle("find", func(database string, cmd bson.D) bson.D {
+		return mongoerror.Unauthorized.ErrMessage("not authorized on test")
+	})
+	backend.Handle("insert", func(database string, cmd bson.D) bson.D {
+		return bson.D{{"n", 0}, {"writeErrors", bson.A{bson.D{{"index", 0}, {"code", 11000}, {"errmsg", "duplicate key"}}}}, {"ok", 1}}
+	})
+	for _, test := range []struct {
+		path string
+		body string
+		code int
+		resp string
+	}{
+		{"/v1/test/foo/find", `{}`, http.StatusForbidden, `{"error":"not authorized on test","code":13,"codeName":"Unauthorized"}`},
+		{"/v1/test/foo/insert", `{"documents": [{"_id": 1}]}`, http.StatusBadRequest, `{"error":"duplicate key","code":11000,"codeName":"DuplicateKey","index":0}`},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+test.path, strings.NewReader(test.body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.code || string(b) != test.resp {
+			t.Fatalf("%s: expected %d %s, got %d %s", test.path, test.code, test.resp, resp.StatusCode, b)
+		}
+	}
+}
+
+func TestDataAPIGraphQL(t *testing.T) {
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	backend.Store.Insert("test", "foo",
+		bson.D{{"_id", 1}, {"a", "x"}, {"b", bson.D{{"c", 1}, {"d", 2}}}},
+		bson.D{{"_id", 2}, {"a", "y"}, {"b", bson.D{{"c", 3}}}},
+	)
+	// The backend doesn't aggregate, counts are answered with the number of documents
+	backend.Handle("aggregate", func(database string, cmd bson.D) bson.D {
+		n := len(backend.Store.Documents(database, cmd[0].Value.(string)))
+		return bson.D{{"cursor", bson.D{{"firstBatch", bson.A{bson.D{{"n", int32(n)}}}}, {"id", int64(0)}, {"ns", database + ".foo"}}}, {"ok", 1}}
+	})
+
+	dir, err := ioutil.TempDir("", "dataapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := strings.Repeat("k", 32)
+	keyFile := filepath.Join(dir, "key")
+	schemaFile := filepath.Join(dir, "schema.json")
+	if err := ioutil.WriteFile(keyFile, []byte(key), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(schemaFile, []byte(`{"dbs": {"test": {"collections": {"foo": {"fields": {
+		"a": {"type": "string"},
+		"b": {"type": "object", "subfields": {"c": {"type": "int"}, "d": {"type": "int"}}}
+	}}}}}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		Plugins: []config.PluginConfig{
+			{Name: schema.Name, Config: bson.D{{"schemaPath", schemaFile}, {"graphQL", true}}},
+			{Name: "mongo", Config: bson.D{{"connectTimeout", "1s"}, {"mongoAddr", backend.URI()}}},
+		},
+		DataAPI: &config.DataAPIConfig{
+			BindAddr: "127.0.0.1:0",
+			Keys:     []config.DataAPIKeyConfig{{KeyFile: keyFile, User: "edge"}},
+			MaxLimit: 10,
+		},
+	}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewProxy(l, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Serve()
+	defer proxy.Shutdown(context.TODO())
+
+	server := httptest.NewServer(proxy.DataAPIHandler())
+	defer server.Close()
+
+	tests := []struct {
+		method string
+		path   string
+		key    string
+		body   string
+		code   int
+		resp   string
+	}{
+		{http.MethodPost, "/v1/graphql", key, `{"query": "query($a: String) { test_foo(a: $a) { _id b { c } } n: test_foo_count }", "variables": {"a": "x"}}`, http.StatusOK, `{"data":{"test_foo":[{"_id":"1","b":{"c":1}}],"n":2}}`},
+		{http.MethodPost, "/v1/graphql", key, `{"query": "{ test_foo(skip: 1, limit: 1) { a } }"}`, http.StatusOK, `{"data":{"test_foo":[{"a":"y"}]}}`},
+		{http.MethodPost, "/v1/graphql", key, `{"query": "{ test_bar { a } }"}`, http.StatusOK, `{"errors":[{"message":"cannot query field \"test_bar\" on type \"Query\""}]}`},
+		{http.MethodPost, "/v1/graphql", key, `not json`, http.StatusBadRequest, ""},
+		{http.MethodPost, "/v1/graphql", "", `{"query": "{ test_foo { a } }"}`, http.StatusUnauthorized, `{"error":"invalid API key"}`},
+		{http.MethodGet, "/v1/graphql", key, ``, http.StatusMethodNotAllowed, ""},
+		{http.MethodGet, "/v1/graphql/schema", key, ``, http.StatusOK, ""},
+		{http.MethodGet, "/v1/graphql/schema", "", ``, http.StatusUnauthorized, ""},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest(test.method, server.URL+test.path, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.key != "" {
+			req.Header.Set("Authorization", "Bearer "+test.key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.code {
+			t.Fatalf("%d: expected %d, got %d: %s", i, test.code, resp.StatusCode, b)
+		}
+		if test.resp != "" && string(b) != test.resp {
+			t.Fatalf("%d: expected %s, got %s", i, test.resp, b)
+		}
+		if test.path == "/v1/graphql/schema" && test.code == http.StatusOK && !strings.Contains(string(b), "test_foo(filter: JSON") {
+			t.Fatalf("unexpected schema %s", b)
+		}
+	}
+}
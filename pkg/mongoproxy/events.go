@@ -0,0 +1,90 @@
+package mongoproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+// violationCodes are the plugins.ViolationCodes by name
+var violationCodes = func() map[string]struct{} {
+	m := make(map[string]struct{}, len(plugins.ViolationCodes))
+	for _, name := range plugins.ViolationCodes {
+		m[name] = struct{}{}
+	}
+	return m
+}()
+
+// publishViolation publishes an event if the response rejected the request (on
+// the namespace) for a policy violation
+func publishViolation(md *plugins.Metadata, req *plugins.Request, db, collection string, resp bson.D) {
+	codeName, _ := bsonutil.Lookup(resp, "codeName")
+	name, _ := codeName.(string)
+	if _, ok := violationCodes[name]; !ok {
+		return
+	}
+	errmsg, _ := bsonutil.Lookup(resp, "errmsg")
+	msg, _ := errmsg.(string)
+
+	fields := map[string]interface{}{"codeName": name}
+	if code, ok := bsonutil.Lookup(resp, "code"); ok {
+		fields["code"] = code
+	}
+	if req.CC != nil {
+		fields["client"] = req.CC.GetAddr()
+		if req.CC.AppName != "" {
+			fields["appName"] = req.CC.AppName
+		}
+	}
+	if identity := md.Identity(); identity != nil {
+		fields["user"] = identity.User()
+	}
+	plugins.PublishEvent(&plugins.Event{
+		Type:        plugins.EventViolation,
+		Source:      "proxy",
+		Message:     msg,
+		Database:    db,
+		Collection:  collection,
+		CommandName: req.CommandName,
+		Fields:      fields,
+	})
+}
+
+// serveEvents streams the events (of the comma separated types in the type
+// param, all if none) as JSON lines until the client disconnects
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	var types []string
+	if v := r.URL.Query().Get("type"); v != "" {
+		types = strings.Split(v, ",")
+	}
+	sub := plugins.SubscribeEvents(types...)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-sub.C:
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
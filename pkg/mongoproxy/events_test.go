@@ -0,0 +1,71 @@
+package mongoproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+	"github.com/wish/mongoproxy/pkg/mongotest"
+)
+
+func TestAdminEvents(t *testing.T) {
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	backend.Handle("find", func(database string, cmd bson.D) bson.D {
+		return mongoerror.Unauthorized.ErrMessage("not authorized on test")
+	})
+
+	proxy := newDeadlineProxy(t, backend, nil, &config.Config{})
+	defer proxy.Shutdown(context.TODO())
+	admin := httptest.NewServer(proxy.AdminHandler())
+	defer admin.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, admin.URL+"/admin/events?type=violation", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Only the violation is streamed
+	plugins.PublishEvent(&plugins.Event{Type: plugins.EventSlowQuery})
+	run := func(cmd bson.D) {
+		if _, err := proxy.HandleMongo(ctx, &plugins.Request{CursorCache: proxy, CC: proxy.internalCC}, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run(bson.D{{"ping", 1}, {"$db", "admin"}})
+	run(bson.D{{"find", "foo"}, {"$db", "test"}})
+
+	scanner := bufio.NewScanner(resp.Body)
+	if !scanner.Scan() {
+		t.Fatalf("expected an event: %v", scanner.Err())
+	}
+	var e plugins.Event
+	if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != plugins.EventViolation || e.CommandName != "find" || e.Database != "test" || e.Collection != "foo" {
+		t.Fatalf("expected the find violation, got %+v", e)
+	}
+	if e.Fields["codeName"] != "Unauthorized" || e.Message != "not authorized on test" {
+		t.Fatalf("expected the error in the event, got %+v", e)
+	}
+}
@@ -0,0 +1,67 @@
+package mongoproxy
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+var forwardedClientsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mongoproxy_forwarded_clients_total",
+	Help: "The total commands forwarded by upstream proxies by whether their client was trusted",
+}, []string{"result"})
+
+// forwardedClient removes the client forwarded by an upstream proxy from the
+// command d and, if it is signed by a trusted proxy, makes it the request's
+// client (and its trace ID and tenant the request's). It returns the error
+// response if the forwarded client isn't trusted.
+func (p *Proxy) forwardedClient(ctx context.Context, req *plugins.Request, d bson.D) (context.Context, bson.D, bson.D) {
+	d, v, ok := bsonutil.Pop(d, plugins.ForwardedClientField)
+	if !ok {
+		return ctx, d, nil
+	}
+	reject := func(reason string) (context.Context, bson.D, bson.D) {
+		forwardedClientsCounter.WithLabelValues("rejected").Inc()
+		var addr string
+		if req.CC != nil {
+			addr = req.CC.GetAddr()
+		}
+		logrus.Warnf("rejected client forwarded by %s: %s", addr, reason)
+		return ctx, d, mongoerror.Unauthorized.ErrMessage("untrusted forwarded client: " + reason)
+	}
+	if p.forwardingKeys == nil {
+		return reject("no proxies are trusted")
+	}
+
+	var f plugins.ForwardedClient
+	b, err := bson.Marshal(bson.D{{"c", v}})
+	if err == nil {
+		err = bson.Raw(b).Lookup("c").Unmarshal(&f)
+	}
+	if err != nil {
+		return reject(err.Error())
+	}
+	db, _ := bsonutil.Lookup(d, "$db")
+	dbName, _ := db.(string)
+	if err := f.Verify(p.forwardingKeys, d[0].Key, dbName, p.cfg.TrustedProxies.MaxAgeDuration); err != nil {
+		return reject(err.Error())
+	}
+
+	forwardedClientsCounter.WithLabelValues("trusted").Inc()
+	req.CC = f.ClientConnection(req.CC)
+	ctx, md := plugins.WithMetadata(ctx)
+	if f.TraceID != "" {
+		md.SetTraceID(f.TraceID)
+	}
+	if f.Tenant != "" {
+		md.SetTenant(f.Tenant)
+	}
+	return ctx, d, nil
+}
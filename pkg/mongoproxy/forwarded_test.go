@@ -0,0 +1,129 @@
+package mongoproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+	"github.com/wish/mongoproxy/pkg/mongotest"
+)
+
+func TestProxyChaining(t *testing.T) {
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	backend.Handle("find", func(database string, cmd bson.D) bson.D {
+		// The forwarded client doesn't reach the backend
+		if _, ok := bsonutil.Lookup(cmd, plugins.ForwardedClientField); ok {
+			return bson.D{{"ok", 0}, {"errmsg", "unexpected forwarded client"}}
+		}
+		return bson.D{{"ok", 1}, {"cursor", bson.D{{"id", int64(0)}, {"ns", "test.foo"}, {"firstBatch", bson.A{}}}}}
+	})
+
+	dir, err := ioutil.TempDir("", "forwarding")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeKey := func(name string, b byte) string {
+		key := make([]byte, 32)
+		key[0] = b
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	trusted, untrusted := writeKey("trusted", 1), writeKey("untrusted", 2)
+
+	// The regional proxy trusts the edge proxies with the trusted key
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	regionalCfg := &config.Config{
+		Plugins: []config.PluginConfig{
+			{Name: "mongo", Config: bson.D{{"connectTimeout", "1s"}, {"mongoAddr", backend.URI()}}},
+		},
+		TrustedProxies: &config.TrustedProxiesConfig{KeyFiles: []string{trusted}},
+	}
+	if err := regionalCfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+	regional, err := NewProxy(l, regionalCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go regional.Serve()
+	defer regional.Shutdown(context.TODO())
+
+	edge := func(keyFile string) *Proxy {
+		cfg := &config.Config{
+			Plugins: []config.PluginConfig{
+				{Name: "mongo", Config: bson.D{
+					{"connectTimeout", "1s"},
+					{"mongoAddr", "mongodb://" + regional.Addr()},
+					{"forwardClient", bson.D{{"keyFile", keyFile}}},
+				}},
+			},
+		}
+		if err := cfg.Load(); err != nil {
+			t.Fatal(err)
+		}
+		proxy, err := NewProxy(nil, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return proxy
+	}
+
+	cc := plugins.NewClientConnection()
+	cc.Addr = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	cc.Identities = []plugins.ClientIdentity{plugins.NewStaticIdentity("x509", "alice", "readWrite")}
+	find := bson.D{{"find", "foo"}, {"$db", "test"}}
+
+	for _, test := range []struct {
+		keyFile string
+		ok      bool
+	}{
+		{keyFile: trusted, ok: true},
+		{keyFile: untrusted},
+	} {
+		p := edge(test.keyFile)
+		defer p.closeDoneChan()
+		// Disconnect from the regional proxy before it shuts down
+		defer p.chain.close(context.TODO(), p.chain.plugins)
+		resp, err := p.HandleMongo(context.TODO(), &plugins.Request{CC: cc, CursorCache: p}, append(bson.D(nil), find...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bsonutil.Ok(resp) != test.ok {
+			t.Fatalf("%s: unexpected response %v", test.keyFile, resp)
+		}
+	}
+
+	// The regional proxy's plugins see the original client
+	f := plugins.NewForwardedClient(context.TODO(), &plugins.Request{CC: cc})
+	if err := f.Sign(regional.forwardingKeys[0], "find", "test"); err != nil {
+		t.Fatal(err)
+	}
+	req := &plugins.Request{CC: plugins.NewClientConnection()}
+	_, d, rejected := regional.forwardedClient(context.TODO(), req, append(find, bson.E{plugins.ForwardedClientField, f}))
+	if rejected != nil || len(d) != len(find) {
+		t.Fatalf("unexpected forwarded client: %v %v", d, rejected)
+	}
+	if req.CC.GetAddr() != "10.0.0.1:5000" || len(req.CC.Identities) != 1 || req.CC.Identities[0].User() != "alice" {
+		t.Fatalf("unexpected client %s %v", req.CC.GetAddr(), req.CC.Identities)
+	}
+}
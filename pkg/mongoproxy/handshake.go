@@ -0,0 +1,178 @@
+package mongoproxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+)
+
+var (
+	handshakeBacklogGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongoproxy_client_handshake_backlog",
+		Help: "The current number of client connections waiting for a handshake slot",
+	})
+	handshakeDelayedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mongoproxy_client_handshake_delayed_total",
+		Help: "The total number of client connections delayed by the handshake rate limits",
+	})
+	handshakeRejectedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_client_handshake_rejected_total",
+		Help: "The total number of client connections closed by the handshake rate limits",
+	}, []string{"reason"})
+)
+
+// slowStartFloor is the fraction of the rate allowed right after the proxy starts
+const slowStartFloor = 0.1
+
+// handshakeLimiter rate limits new client connections globally and per source IP
+// so reconnect storms (e.g. after a deploy) don't overwhelm the proxy and the
+// backend. Connections over the rate wait in a bounded backlog; connections which
+// don't fit in it, or would wait longer than the backlog timeout, are closed.
+type handshakeLimiter struct {
+	cfg   *config.HandshakeLimitsConfig
+	start time.Time
+
+	// global is nil if there is no global rate
+	global  *rate.Limiter
+	waiting int64
+
+	l       sync.Mutex
+	sources map[string]*sourceLimiter
+	cleaned time.Time
+}
+
+type sourceLimiter struct {
+	*rate.Limiter
+	used time.Time
+}
+
+func newHandshakeLimiter(cfg *config.HandshakeLimitsConfig, start time.Time) *handshakeLimiter {
+	h := &handshakeLimiter{
+		cfg:     cfg,
+		start:   start,
+		sources: make(map[string]*sourceLimiter),
+		cleaned: start,
+	}
+	if cfg.Rate > 0 {
+		h.global = rate.NewLimiter(h.limit(start), cfg.Burst)
+	}
+	return h
+}
+
+// limit returns the global rate at the time, ramped up during the slow start
+func (h *handshakeLimiter) limit(now time.Time) rate.Limit {
+	elapsed := now.Sub(h.start)
+	if h.cfg.SlowStartDuration <= 0 || elapsed >= h.cfg.SlowStartDuration {
+		return rate.Limit(h.cfg.Rate)
+	}
+	ramp := slowStartFloor + (1-slowStartFloor)*float64(elapsed)/float64(h.cfg.SlowStartDuration)
+	return rate.Limit(h.cfg.Rate * ramp)
+}
+
+// source returns the limiter of the source (nil if there is no per-source rate)
+func (h *handshakeLimiter) source(addr net.Addr, now time.Time) *rate.Limiter {
+	if h.cfg.PerSourceRate <= 0 {
+		return nil
+	}
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	h.l.Lock()
+	defer h.l.Unlock()
+	// Forget the sources which have refilled their burst
+	idle := time.Minute
+	if refill := time.Duration(float64(h.cfg.PerSourceBurst) / h.cfg.PerSourceRate * float64(time.Second)); refill > idle {
+		idle = refill
+	}
+	if now.Sub(h.cleaned) > idle {
+		for k, s := range h.sources {
+			if now.Sub(s.used) > idle {
+				delete(h.sources, k)
+			}
+		}
+		h.cleaned = now
+	}
+
+	s, ok := h.sources[ip]
+	if !ok {
+		s = &sourceLimiter{Limiter: rate.NewLimiter(rate.Limit(h.cfg.PerSourceRate), h.cfg.PerSourceBurst)}
+		h.sources[ip] = s
+	}
+	s.used = now
+	return s.Limiter
+}
+
+// wait waits until the connection from addr may start; it returns an error if the
+// connection should be closed instead (or done is closed)
+func (h *handshakeLimiter) wait(addr net.Addr, done <-chan struct{}) error {
+	if atomic.AddInt64(&h.waiting, 1) > int64(h.cfg.Backlog) {
+		atomic.AddInt64(&h.waiting, -1)
+		handshakeRejectedCounter.WithLabelValues("backlog").Inc()
+		return fmt.Errorf("handshake backlog full")
+	}
+	defer atomic.AddInt64(&h.waiting, -1)
+
+	now := time.Now()
+	var reservations []*rate.Reservation
+	cancel := func() {
+		for _, r := range reservations {
+			r.CancelAt(now)
+		}
+	}
+	var delay time.Duration
+	reserve := func(lim *rate.Limiter) bool {
+		r := lim.ReserveN(now, 1)
+		if !r.OK() {
+			return false
+		}
+		reservations = append(reservations, r)
+		if d := r.DelayFrom(now); d > delay {
+			delay = d
+		}
+		return true
+	}
+	if lim := h.source(addr, now); lim != nil && !reserve(lim) {
+		cancel()
+		handshakeRejectedCounter.WithLabelValues("rate").Inc()
+		return fmt.Errorf("handshake rate exceeded")
+	}
+	if h.global != nil {
+		h.global.SetLimitAt(now, h.limit(now))
+		if !reserve(h.global) {
+			cancel()
+			handshakeRejectedCounter.WithLabelValues("rate").Inc()
+			return fmt.Errorf("handshake rate exceeded")
+		}
+	}
+	if delay == 0 {
+		return nil
+	}
+	if delay > h.cfg.BacklogTimeoutDuration {
+		cancel()
+		handshakeRejectedCounter.WithLabelValues("rate").Inc()
+		return fmt.Errorf("handshake rate exceeded")
+	}
+
+	handshakeDelayedCounter.Inc()
+	handshakeBacklogGauge.Inc()
+	defer handshakeBacklogGauge.Dec()
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-done:
+		cancel()
+		return ErrServerClosed
+	}
+}
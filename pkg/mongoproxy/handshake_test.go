@@ -0,0 +1,101 @@
+package mongoproxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+)
+
+func TestHandshakeLimiter(t *testing.T) {
+	addr := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+	}
+
+	tests := []struct {
+		name string
+		cfg  config.HandshakeLimitsConfig
+		// addrs connect in order; expected is whether each starts right away,
+		// waits, or is closed
+		addrs    []string
+		expected []string
+	}{
+		{
+			name:     "global",
+			cfg:      config.HandshakeLimitsConfig{Rate: 10, Burst: 2, BacklogTimeout: "150ms"},
+			addrs:    []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+			expected: []string{"now", "now", "wait"},
+		},
+		{
+			name:     "backlog timeout",
+			cfg:      config.HandshakeLimitsConfig{Rate: 10, Burst: 1, BacklogTimeout: "50ms"},
+			addrs:    []string{"10.0.0.1", "10.0.0.2"},
+			expected: []string{"now", "closed"},
+		},
+		{
+			name:     "per source",
+			cfg:      config.HandshakeLimitsConfig{PerSourceRate: 1, BacklogTimeout: "10ms"},
+			addrs:    []string{"10.0.0.1", "10.0.0.1", "10.0.0.2"},
+			expected: []string{"now", "closed", "now"},
+		},
+		{
+			name:     "backlog",
+			cfg:      config.HandshakeLimitsConfig{Rate: 1, Backlog: 1},
+			addrs:    []string{"10.0.0.1"},
+			expected: []string{"closed"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := test.cfg
+			if err := (&config.Config{HandshakeLimits: &cfg}).Load(); err != nil {
+				t.Fatal(err)
+			}
+			h := newHandshakeLimiter(&cfg, time.Now())
+			done := make(chan struct{})
+			defer close(done)
+
+			// The backlog test holds the backlog with a waiting connection
+			if test.name == "backlog" {
+				h.waiting = 1
+			}
+			for i, a := range test.addrs {
+				start := time.Now()
+				err := h.wait(addr(a), done)
+				result := "now"
+				if err != nil {
+					result = "closed"
+				} else if time.Since(start) > 10*time.Millisecond {
+					result = "wait"
+				}
+				if result != test.expected[i] {
+					t.Fatalf("connection %d: expected %s, got %s (%v)", i, test.expected[i], result, err)
+				}
+			}
+		})
+	}
+}
+
+func TestHandshakeSlowStart(t *testing.T) {
+	cfg := config.HandshakeLimitsConfig{Rate: 100, SlowStart: "10s"}
+	if err := (&config.Config{HandshakeLimits: &cfg}).Load(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	h := newHandshakeLimiter(&cfg, start)
+	for _, test := range []struct {
+		at       time.Duration
+		expected float64
+	}{
+		{0, 10},
+		{5 * time.Second, 55},
+		{10 * time.Second, 100},
+		{time.Minute, 100},
+	} {
+		if limit := float64(h.limit(start.Add(test.at))); limit < test.expected-0.001 || limit > test.expected+0.001 {
+			t.Fatalf("expected a rate of %v after %s, got %v", test.expected, test.at, limit)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package mongoproxy
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var parkedConnectionGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "mongoproxy_client_parked_connections",
+	Help: "The current number of idle client connections parked in the idle poller",
+})
+
+// errParked is returned by serveConn once the connection is parked in the idle
+// poller, which serves it again on another goroutine
+var errParked = errors.New("connection parked")
+
+// resume serves the parked connection again once it's readable
+func (ip *idlePoller) resume(c *conn) {
+	go ip.p.serveClient(func() error {
+		return ip.p.serveConn(c, true)
+	})
+}
@@ -0,0 +1,197 @@
+//go:build linux
+// +build linux
+
+package mongoproxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// idlePoller parks idle client connections in an epoll set so that they don't
+// each pin a goroutine (and its stack) blocked reading. A parked connection is
+// served on a new goroutine once it's readable (or closed by the client), or once
+// it's been idle for the clientIdleTimeout so that it's closed.
+type idlePoller struct {
+	p    *Proxy
+	epfd int
+	// wake is an eventfd in the epoll set to wake the poller when it's closed
+	wake int
+	done chan struct{}
+
+	l      sync.Mutex
+	parked map[int32]*parkedConn
+	closed bool
+}
+
+type parkedConn struct {
+	c  *conn
+	at time.Time
+}
+
+func newIdlePoller(p *Proxy) (*idlePoller, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("error creating epoll: %w", err)
+	}
+	wake, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		unix.Close(epfd)
+		return nil, fmt.Errorf("error creating eventfd: %w", err)
+	}
+	if err := unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, wake, &unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(wake)}); err != nil {
+		unix.Close(wake)
+		unix.Close(epfd)
+		return nil, fmt.Errorf("error adding eventfd to epoll: %w", err)
+	}
+
+	ip := &idlePoller{
+		p:      p,
+		epfd:   epfd,
+		wake:   wake,
+		done:   make(chan struct{}),
+		parked: make(map[int32]*parkedConn),
+	}
+	go ip.run()
+	return ip, nil
+}
+
+// connFd returns the file descriptor of the connection, or false if it can't be
+// parked: TLS connections (whose records may already be buffered) and connections
+// with data already read aren't
+func connFd(c net.Conn) (int, bool) {
+	if wc, ok := c.(*watchedConn); ok {
+		if len(wc.peeked) > 0 {
+			return 0, false
+		}
+		c = wc.Conn
+	}
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return 0, false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	fd := -1
+	if err := rc.Control(func(f uintptr) { fd = int(f) }); err != nil || fd < 0 {
+		return 0, false
+	}
+	return fd, true
+}
+
+// park parks the idle connection, returning false if it can't be parked and must
+// be read from on the caller's goroutine. The connection must not be used by the
+// caller once parked.
+func (ip *idlePoller) park(c *conn) bool {
+	fd, ok := connFd(c.c)
+	if !ok {
+		return false
+	}
+
+	ip.l.Lock()
+	defer ip.l.Unlock()
+	if ip.closed {
+		return false
+	}
+	// Level-triggered so that data which arrived before the connection was parked
+	// is seen
+	ev := &unix.EpollEvent{Events: unix.EPOLLIN | unix.EPOLLRDHUP, Fd: int32(fd)}
+	if err := unix.EpollCtl(ip.epfd, unix.EPOLL_CTL_ADD, fd, ev); err != nil {
+		logrus.Debugf("Error parking connection %v: %v", c.c.RemoteAddr(), err)
+		return false
+	}
+	ip.parked[int32(fd)] = &parkedConn{c: c, at: time.Now()}
+	parkedConnectionGauge.Inc()
+	return true
+}
+
+// unparkLocked takes the connection out of the epoll set
+func (ip *idlePoller) unparkLocked(fd int32) *conn {
+	pc, ok := ip.parked[fd]
+	if !ok {
+		return nil
+	}
+	delete(ip.parked, fd)
+	parkedConnectionGauge.Dec()
+	if err := unix.EpollCtl(ip.epfd, unix.EPOLL_CTL_DEL, int(fd), nil); err != nil {
+		logrus.Debugf("Error unparking connection %v: %v", pc.c.c.RemoteAddr(), err)
+	}
+	return pc.c
+}
+
+func (ip *idlePoller) run() {
+	defer close(ip.done)
+
+	events := make([]unix.EpollEvent, 256)
+	lastSweep := time.Now()
+	for {
+		n, err := unix.EpollWait(ip.epfd, events, 1000)
+		if err != nil && err != unix.EINTR {
+			logrus.Errorf("Error polling idle connections: %v", err)
+			time.Sleep(100 * time.Millisecond)
+		}
+		if n < 0 {
+			n = 0
+		}
+
+		var resume []*conn
+		ip.l.Lock()
+		closed := ip.closed
+		if closed {
+			// Serve the parked connections on goroutines again, as without the poller
+			for fd := range ip.parked {
+				resume = append(resume, ip.unparkLocked(fd))
+			}
+		} else {
+			for _, ev := range events[:n] {
+				if c := ip.unparkLocked(ev.Fd); c != nil {
+					resume = append(resume, c)
+				}
+			}
+			// Connections idle for the clientIdleTimeout are resumed to be closed: their
+			// read deadline was set before they were parked, so their read times out
+			if timeout := ip.p.cfg.ClientIdleTimeoutDuration; timeout > 0 && time.Since(lastSweep) >= time.Second {
+				lastSweep = time.Now()
+				for fd, pc := range ip.parked {
+					if lastSweep.Sub(pc.at) >= timeout {
+						resume = append(resume, ip.unparkLocked(fd))
+					}
+				}
+			}
+		}
+		ip.l.Unlock()
+
+		for _, c := range resume {
+			ip.resume(c)
+		}
+		if closed {
+			unix.Close(ip.wake)
+			unix.Close(ip.epfd)
+			return
+		}
+	}
+}
+
+// close stops the poller, serving the parked connections on goroutines again
+func (ip *idlePoller) close() {
+	ip.l.Lock()
+	if ip.closed {
+		ip.l.Unlock()
+		return
+	}
+	ip.closed = true
+	ip.l.Unlock()
+
+	// Any non-zero 8 byte value wakes the poller
+	b := [8]byte{1, 1, 1, 1, 1, 1, 1, 1}
+	unix.Write(ip.wake, b[:])
+	<-ip.done
+}
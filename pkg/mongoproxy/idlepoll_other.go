@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package mongoproxy
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// idlePoller is only implemented on Linux (with epoll)
+type idlePoller struct {
+	p *Proxy
+}
+
+func newIdlePoller(p *Proxy) (*idlePoller, error) {
+	return nil, fmt.Errorf("idlePoll is not supported on %s", runtime.GOOS)
+}
+
+func (ip *idlePoller) park(c *conn) bool { return false }
+
+func (ip *idlePoller) close() {}
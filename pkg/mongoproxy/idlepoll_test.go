@@ -0,0 +1,120 @@
+//go:build linux
+// +build linux
+
+package mongoproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongotest"
+	"github.com/wish/mongoproxy/pkg/mongowire"
+)
+
+func TestProxyIdlePoll(t *testing.T) {
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		Plugins: []config.PluginConfig{
+			{
+				Name: "mongo",
+				Config: bson.D{
+					{"connectTimeout", "1s"},
+					{"mongoAddr", backend.URI()},
+				},
+			},
+		},
+		ClientIdleTimeout: "1s",
+		IdlePoll:          true,
+	}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(l, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Serve()
+	defer proxy.Shutdown(context.TODO())
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", proxy.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		return c
+	}
+	ping := func(c net.Conn) {
+		msg := &mongowire.OP_MSG{
+			Header:   mongowire.MessageHeader{RequestID: 1, OpCode: mongowire.OpMsg},
+			Sections: []mongowire.MSGSection{mongowire.MSGSection_Body{bson.D{{"ping", 1}, {"$db", "admin"}}}},
+		}
+		if err := msg.WriteTo(c); err != nil {
+			t.Fatal(err)
+		}
+		req, err := mongowire.NewRequest(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp := req.GetOpMsg().Sections[0].(mongowire.MSGSection_Body).Document.Map(); resp["ok"] != int32(1) {
+			t.Fatalf("mismatch in ping response: %v", resp)
+		}
+	}
+	parked := func(n int) {
+		for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+			proxy.idle.l.Lock()
+			p := len(proxy.idle.parked)
+			proxy.idle.l.Unlock()
+			if p == n {
+				return
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("expected %d parked connections, got %d", n, p)
+			}
+		}
+	}
+
+	// Connections are parked between requests and resumed when the client sends one
+	a := dial()
+	defer a.Close()
+	ping(a)
+	parked(1)
+	ping(a)
+	parked(1)
+
+	// Parked connections are closed after the clientIdleTimeout
+	start := time.Now()
+	if _, err := a.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected connection to be closed: %v", err)
+	}
+	if idle := time.Since(start); idle < 500*time.Millisecond {
+		t.Fatalf("connection closed after %v", idle)
+	}
+	parked(0)
+
+	// Connections parked when the poller is closed are served on goroutines again
+	b := dial()
+	defer b.Close()
+	ping(b)
+	parked(1)
+	proxy.idle.close()
+	parked(0)
+	ping(b)
+}
@@ -0,0 +1,99 @@
+package mongoproxy
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+)
+
+var (
+	memoryBufferedGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongoproxy_memory_buffered_bytes",
+		Help: "The current bytes of buffered client requests and responses",
+	})
+	memoryShedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mongoproxy_memory_shed_total",
+		Help: "The total number of client requests rejected because the memory budget was exceeded",
+	})
+)
+
+// memoryBudget tracks the bytes of buffered request and response data across all
+// connections (and per connection) so that load can be shed before the proxy runs
+// out of memory. A zero limit only tracks.
+type memoryBudget struct {
+	limit int64
+	used  int64
+}
+
+// reserve accounts for n bytes of a new request on the connection; it returns
+// false (reserving nothing) if that would exceed the budget. A request is always
+// allowed if nothing else is buffered so that requests larger than the budget
+// aren't rejected outright.
+func (m *memoryBudget) reserve(c *conn, n int64) bool {
+	used := atomic.AddInt64(&m.used, n)
+	if m.limit > 0 && used > m.limit && used > n {
+		atomic.AddInt64(&m.used, -n)
+		return false
+	}
+	atomic.AddInt64(&c.buffered, n)
+	memoryBufferedGauge.Add(float64(n))
+	return true
+}
+
+// acquire accounts for n bytes on the connection regardless of the budget (e.g.
+// a response which has already been produced)
+func (m *memoryBudget) acquire(c *conn, n int64) {
+	atomic.AddInt64(&m.used, n)
+	atomic.AddInt64(&c.buffered, n)
+	memoryBufferedGauge.Add(float64(n))
+}
+
+// release returns n bytes reserved or acquired on the connection
+func (m *memoryBudget) release(c *conn, n int64) {
+	atomic.AddInt64(&m.used, -n)
+	atomic.AddInt64(&c.buffered, -n)
+	memoryBufferedGauge.Sub(float64(n))
+}
+
+// Used returns the bytes currently buffered
+func (m *memoryBudget) Used() int64 {
+	return atomic.LoadInt64(&m.used)
+}
+
+// status returns the memory section of serverStatus
+func (m *memoryBudget) status() bson.D {
+	return bson.D{
+		{"buffered", m.Used()},
+		{"budget", m.limit},
+	}
+}
+
+// shedError is the response to requests rejected by the memory budget; drivers
+// retry ExceededTimeLimit (and writes with the RetryableWriteError label)
+func shedError() bson.D {
+	return append(mongoerror.ExceededTimeLimit.ErrMessage("proxy memory budget exceeded; retry later"),
+		bson.E{"errorLabels", bson.A{"RetryableWriteError"}})
+}
+
+// budgetWriter accounts for responses while they're written to the connection
+type budgetWriter struct {
+	net.Conn
+	m *memoryBudget
+	c *conn
+	// written is the bytes written
+	written int64
+}
+
+func (w *budgetWriter) Write(b []byte) (int, error) {
+	n := int64(len(b))
+	w.m.acquire(w.c, n)
+	defer w.m.release(w.c, n)
+	written, err := w.Conn.Write(b)
+	w.written += int64(written)
+	return written, err
+}
@@ -0,0 +1,212 @@
+package mongoproxy
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+)
+
+// maxNamespaceStats bounds the namespaces tracked; requests on further namespaces
+// are counted in otherNamespace
+const maxNamespaceStats = 10000
+
+// otherNamespace is the namespace of the requests over maxNamespaceStats
+const otherNamespace = "*"
+
+// NamespaceStats are the requests through the proxy on a namespace (db.collection,
+// or db for database commands) since it started
+type NamespaceStats struct {
+	Namespace string  `json:"ns" bson:"ns"`
+	Requests  int64   `json:"requests" bson:"requests"`
+	Errors    int64   `json:"errors" bson:"errors"`
+	ErrorRate float64 `json:"errorRate" bson:"errorRate"`
+	// DocsRead are the documents returned in cursor batches
+	DocsRead int64 `json:"docsRead" bson:"docsRead"`
+	// DocsWritten are the documents inserted, matched by updates or deleted
+	DocsWritten int64 `json:"docsWritten" bson:"docsWritten"`
+	// BytesIn and BytesOut are the sizes of the requests and responses on the wire
+	BytesIn  int64 `json:"bytesIn" bson:"bytesIn"`
+	BytesOut int64 `json:"bytesOut" bson:"bytesOut"`
+	// Commands are the requests by command
+	Commands map[string]int64 `json:"commands" bson:"commands"`
+	// LastRequest is when the last request on the namespace completed
+	LastRequest time.Time `json:"lastRequest" bson:"lastRequest"`
+}
+
+// namespaceStats tracks the NamespaceStats of the proxy's requests
+type namespaceStats struct {
+	l  sync.Mutex
+	ns map[string]*NamespaceStats
+}
+
+// get returns the stats of the namespace; s.l must be held
+func (s *namespaceStats) get(ns string) *NamespaceStats {
+	if s.ns == nil {
+		s.ns = make(map[string]*NamespaceStats)
+	}
+	st, ok := s.ns[ns]
+	if !ok {
+		if len(s.ns) >= maxNamespaceStats {
+			return s.get(otherNamespace)
+		}
+		st = &NamespaceStats{Namespace: ns, Commands: make(map[string]int64)}
+		s.ns[ns] = st
+	}
+	return st
+}
+
+// record adds a request on the namespace
+func (s *namespaceStats) record(ns, commandName string, failed bool, read, written int64) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	st := s.get(ns)
+	st.Requests++
+	if failed {
+		st.Errors++
+	}
+	st.DocsRead += read
+	st.DocsWritten += written
+	st.Commands[commandName]++
+	st.LastRequest = time.Now()
+}
+
+// addBytes adds the wire sizes of a request on the namespace
+func (s *namespaceStats) addBytes(ns string, in, out int64) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	st := s.get(ns)
+	st.BytesIn += in
+	st.BytesOut += out
+}
+
+// list returns the stats of the namespaces in the db ("" for all) sorted by
+// namespace
+func (s *namespaceStats) list(db string) []NamespaceStats {
+	s.l.Lock()
+	defer s.l.Unlock()
+	stats := make([]NamespaceStats, 0, len(s.ns))
+	for ns, st := range s.ns {
+		if db != "" && ns != db && (len(ns) <= len(db) || ns[:len(db)+1] != db+".") {
+			continue
+		}
+		c := *st
+		c.Commands = make(map[string]int64, len(st.Commands))
+		for k, v := range st.Commands {
+			c.Commands[k] = v
+		}
+		if c.Requests > 0 {
+			c.ErrorRate = float64(c.Errors) / float64(c.Requests)
+		}
+		stats = append(stats, c)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Namespace < stats[j].Namespace })
+	return stats
+}
+
+// NamespaceStats returns the stats of the namespaces in the db ("" for all)
+func (p *Proxy) NamespaceStats(db string) []NamespaceStats {
+	return p.nsStats.list(db)
+}
+
+// proxyStats answers the proxyStats command: the stats of the collection, or of
+// all the namespaces of the database (all namespaces on admin)
+func (p *Proxy) proxyStats(cmd *command.ProxyStats) bson.D {
+	db := cmd.Database
+	if db == "admin" {
+		db = ""
+	}
+	ns := namespace(cmd.Database, cmd.GetCollection())
+	namespaces := bson.A{}
+	for _, st := range p.NamespaceStats(db) {
+		if cmd.GetCollection() == "" || st.Namespace == ns {
+			namespaces = append(namespaces, st)
+		}
+	}
+	return bson.D{
+		{"namespaces", namespaces},
+		{"ok", 1},
+	}
+}
+
+// namespace returns the namespace of the command for its stats
+func namespace(db, collection string) string {
+	if collection == "" {
+		return db
+	}
+	return db + "." + collection
+}
+
+// docsRead returns the documents in the cursor batch of the response
+func docsRead(resp bson.D) int64 {
+	for _, key := range []string{"firstBatch", "nextBatch"} {
+		switch batch, _ := bsonutil.Lookup(resp, "cursor", key); batch := batch.(type) {
+		case bson.A:
+			return int64(len(batch))
+		case bson.RawValue:
+			if batch.Type != bsontype.Array {
+				continue
+			}
+			values, err := batch.Array().Values()
+			if err == nil {
+				return int64(len(values))
+			}
+		}
+	}
+	return 0
+}
+
+// docsWritten returns the documents written by the command according to the response
+func docsWritten(commandName string, resp bson.D) int64 {
+	if _, ok := writeCommands[commandName]; !ok {
+		return 0
+	}
+	n, ok := bsonutil.Lookup(resp, "n")
+	if !ok {
+		// findAndModify
+		n, _ = bsonutil.Lookup(resp, "lastErrorObject", "n")
+	}
+	switch n := n.(type) {
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case int:
+		return int64(n)
+	case float64:
+		return int64(n)
+	}
+	return 0
+}
+
+type nsTrafficKey struct{}
+
+// nsTraffic is the namespace of a client request, set once known so the wire
+// sizes of the request and response can be added to its stats
+type nsTraffic struct {
+	ns string
+}
+
+// withNSTraffic returns a context tracking the namespace of the request
+func withNSTraffic(ctx context.Context) (context.Context, *nsTraffic) {
+	t := &nsTraffic{}
+	return context.WithValue(ctx, nsTrafficKey{}, t), t
+}
+
+// recordNamespace adds the request on the namespace to the stats
+func (p *Proxy) recordNamespace(ctx context.Context, ns, commandName string, resp bson.D, failed bool) {
+	if failed {
+		p.nsStats.record(ns, commandName, true, 0, 0)
+	} else {
+		p.nsStats.record(ns, commandName, false, docsRead(resp), docsWritten(commandName, resp))
+	}
+	if t, ok := ctx.Value(nsTrafficKey{}).(*nsTraffic); ok && t.ns == "" {
+		t.ns = ns
+	}
+}
@@ -0,0 +1,101 @@
+package mongoproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongotest"
+)
+
+func TestNamespaceStats(t *testing.T) {
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	backend.Handle("aggregate", func(database string, cmd bson.D) bson.D {
+		return mongoerror.Unauthorized.ErrMessage("not authorized")
+	})
+
+	proxy := newDeadlineProxy(t, backend, nil, &config.Config{})
+	defer proxy.Shutdown(context.TODO())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://"+proxy.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+
+	coll := client.Database("test").Collection("foo")
+	if _, err := coll.InsertMany(ctx, []interface{}{bson.D{{"_id", 1}}, bson.D{{"_id", 2}}}); err != nil {
+		t.Fatal(err)
+	}
+	cur, err := coll.Find(ctx, bson.D{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var docs []bson.D
+	if err := cur.All(ctx, &docs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := coll.CountDocuments(ctx, bson.D{}); err == nil {
+		t.Fatalf("expected the count to fail")
+	}
+
+	// The stats can be read through the proxy
+	var resp bson.D
+	if err := client.Database("test").RunCommand(ctx, bson.D{{"proxyStats", "foo"}}).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	namespaces, _ := bsonutil.Lookup(resp, "namespaces")
+	if a, ok := namespaces.(bson.A); !ok || len(a) != 1 {
+		t.Fatalf("expected the stats of test.foo, got %v", resp)
+	}
+	stats := namespaces.(bson.A)[0].(bson.D)
+	for key, expected := range map[string]interface{}{
+		"ns":          "test.foo",
+		"requests":    int64(3),
+		"errors":      int64(1),
+		"docsRead":    int64(2),
+		"docsWritten": int64(2),
+	} {
+		if v, _ := bsonutil.Lookup(stats, key); v != expected {
+			t.Fatalf("expected %s %v, got %v", key, expected, stats)
+		}
+	}
+
+	// And from the admin API, with the bytes on the wire (and the proxyStats)
+	admin := httptest.NewServer(proxy.AdminHandler())
+	defer admin.Close()
+	r, err := http.Get(admin.URL + "/admin/namespaces?db=test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+	var list []NamespaceStats
+	if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	var foo *NamespaceStats
+	for i := range list {
+		if list[i].Namespace == "test.foo" {
+			foo = &list[i]
+		}
+	}
+	if foo == nil || foo.BytesIn == 0 || foo.BytesOut == 0 || foo.Commands["insert"] != 1 || foo.ErrorRate != 0.25 {
+		t.Fatalf("unexpected stats: %+v", list)
+	}
+}
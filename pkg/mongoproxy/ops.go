@@ -0,0 +1,237 @@
+package mongoproxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+var (
+	killsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_kills_total",
+		Help: "The total ops and cursors killed through the proxy",
+	}, []string{"kind", "source"})
+)
+
+// Op is a request currently running through the proxy
+type Op struct {
+	ID          int64     `json:"id" bson:"id"`
+	Client      string    `json:"client" bson:"client"`
+	AppName     string    `json:"appName,omitempty" bson:"appName,omitempty"`
+	CommandName string    `json:"commandName" bson:"commandName"`
+	Database    string    `json:"database" bson:"database"`
+	Collection  string    `json:"collection,omitempty" bson:"collection,omitempty"`
+	Start       time.Time `json:"start" bson:"start"`
+
+	cancel context.CancelFunc
+	killed int32
+}
+
+// Killed returns whether the op was killed
+func (o *Op) Killed() bool {
+	return atomic.LoadInt32(&o.killed) == 1
+}
+
+// opTracker tracks the ops running through the proxy so they can be listed and killed
+type opTracker struct {
+	nextID int64
+
+	l   sync.Mutex
+	ops map[int64]*Op
+}
+
+// start registers the op and returns a context which is cancelled if the op is
+// killed. The returned func must be called once the op is finished.
+func (t *opTracker) start(ctx context.Context, r *plugins.Request) (context.Context, *Op, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	op := &Op{
+		ID:          atomic.AddInt64(&t.nextID, 1),
+		CommandName: r.CommandName,
+		Database:    r.Database(),
+		Collection:  r.Collection(),
+		Start:       time.Now(),
+		cancel:      cancel,
+	}
+	if r.CC != nil {
+		op.Client = r.CC.GetAddr()
+		op.AppName = r.CC.AppName
+	}
+
+	t.l.Lock()
+	if t.ops == nil {
+		t.ops = make(map[int64]*Op)
+	}
+	t.ops[op.ID] = op
+	t.l.Unlock()
+
+	return ctx, op, func() {
+		t.l.Lock()
+		delete(t.ops, op.ID)
+		t.l.Unlock()
+		cancel()
+	}
+}
+
+// list returns a snapshot of the running ops
+func (t *opTracker) list() []Op {
+	t.l.Lock()
+	defer t.l.Unlock()
+	ops := make([]Op, 0, len(t.ops))
+	for _, op := range t.ops {
+		ops = append(ops, *op)
+	}
+	return ops
+}
+
+// kill cancels the op, returning whether it was found
+func (t *opTracker) kill(id int64) bool {
+	t.l.Lock()
+	op, ok := t.ops[id]
+	t.l.Unlock()
+	if ok {
+		atomic.StoreInt32(&op.killed, 1)
+		op.cancel()
+	}
+	return ok
+}
+
+// Ops returns the requests currently running through the proxy
+func (p *Proxy) Ops() []Op {
+	return p.ops.list()
+}
+
+// KillOp cancels the context of the running request, returning whether it was found.
+// Cancelling the context closes the backend connection the request is using, which
+// the backend treats as the client going away and interrupts the operation.
+func (p *Proxy) KillOp(id int64) bool {
+	return p.ops.kill(id)
+}
+
+// KillCursor kills the cursor on the backend and removes it from the cursor cache
+func (p *Proxy) KillCursor(ctx context.Context, cursorID int64) error {
+	resp, err := p.HandleMongo(ctx, &plugins.Request{CursorCache: p, CC: p.internalCC}, bson.D{
+		{"killCursors", "admin"},
+		{"cursors", primitive.A{cursorID}},
+	})
+	if err != nil {
+		return err
+	}
+	if !bsonutil.Ok(resp) {
+		errmsg, _ := resp.Map()["errmsg"].(string)
+		return fmt.Errorf("error killing cursor %d: %s", cursorID, errmsg)
+	}
+	p.CloseCursor(cursorID)
+	return nil
+}
+
+// auditKill records an op or cursor being killed in the audit log; source is where
+// the kill came from (the admin API or a client command).
+func auditKill(kind string, id int64, source string, cc *plugins.ClientConnection, found bool) {
+	killsTotal.WithLabelValues(kind, source).Inc()
+
+	fields := logrus.Fields{
+		"audit":  "kill",
+		"kind":   kind,
+		"id":     id,
+		"source": source,
+		"found":  found,
+	}
+	if cc != nil {
+		fields["client"] = cc.GetAddr()
+		if cc.AppName != "" {
+			fields["appName"] = cc.AppName
+		}
+		users := make([]string, 0, len(cc.Identities))
+		for _, ident := range cc.Identities {
+			users = append(users, ident.User())
+		}
+		fields["users"] = users
+	}
+	logrus.WithFields(fields).Infof("killed %s %d", kind, id)
+}
+
+// ConnInfo describes an open client connection
+type ConnInfo struct {
+	Client       string    `json:"client"`
+	AppName      string    `json:"appName,omitempty"`
+	Users        []string  `json:"users,omitempty"`
+	State        string    `json:"state"`
+	LastActivity time.Time `json:"lastActivity"`
+	// BufferedBytes is the bytes of requests and responses currently buffered
+	BufferedBytes int64 `json:"bufferedBytes"`
+	// BytesIn and BytesOut are the bytes of the connection's requests and responses
+	BytesIn  int64 `json:"bytesIn"`
+	BytesOut int64 `json:"bytesOut"`
+
+	ClientMetadata *plugins.ClientMetadata `json:"clientMetadata,omitempty"`
+}
+
+// Connections returns the open client connections
+func (p *Proxy) Connections() []ConnInfo {
+	p.activeConnLock.Lock()
+	defer p.activeConnLock.Unlock()
+
+	conns := make([]ConnInfo, 0, len(p.activeConn))
+	for c := range p.activeConn {
+		st, unixSec := c.getState()
+		info := ConnInfo{
+			Client:        c.c.RemoteAddr().String(),
+			State:         st.String(),
+			LastActivity:  time.Unix(unixSec, 0),
+			BufferedBytes: atomic.LoadInt64(&c.buffered),
+			BytesIn:       atomic.LoadInt64(&c.bytesIn),
+			BytesOut:      atomic.LoadInt64(&c.bytesOut),
+		}
+		if c.cc != nil {
+			info.AppName = c.cc.AppName
+			info.ClientMetadata = c.cc.ClientMetadata
+			for _, ident := range c.cc.Identities {
+				info.Users = append(info.Users, ident.User())
+			}
+		}
+		conns = append(conns, info)
+	}
+	return conns
+}
+
+// writeCommands are the commands rejected when the proxy is in read-only mode
+var writeCommands = map[string]struct{}{
+	"insert":           {},
+	"update":           {},
+	"delete":           {},
+	"findAndModify":    {},
+	"findandmodify":    {},
+	"create":           {},
+	"createIndexes":    {},
+	"drop":             {},
+	"dropDatabase":     {},
+	"dropIndexes":      {},
+	"deleteIndexes":    {},
+	"renameCollection": {},
+	"collMod":          {},
+}
+
+// SetReadOnly sets whether the proxy rejects write commands
+func (p *Proxy) SetReadOnly(readOnly bool) {
+	var v int32
+	if readOnly {
+		v = 1
+	}
+	atomic.StoreInt32(&p.readOnly, v)
+}
+
+// ReadOnly returns whether the proxy is rejecting write commands
+func (p *Proxy) ReadOnly() bool {
+	return atomic.LoadInt32(&p.readOnly) == 1
+}
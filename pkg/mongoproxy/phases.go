@@ -0,0 +1,308 @@
+package mongoproxy
+
+import (
+	"container/heap"
+	"context"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+var (
+	requestPhaseHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mongoproxy_request_phase_seconds",
+		Help:    "Histogram of the time requests spent in each phase, with the op ID of requests as exemplars",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 3, 12),
+	}, []string{"phase", "plugin"})
+	requestPhaseCancelledCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_request_phase_cancelled_total",
+		Help: "The total requests whose context was cancelled (or timed out) by the phase they were in",
+	}, []string{"phase", "plugin", "reason"})
+)
+
+// The phases of requests timed by the proxy (see plugins.RequestTrace for the others)
+const (
+	phaseRead   = "read"
+	phaseQueue  = "queue"
+	phaseDecode = "decode"
+	phaseEncode = "encode"
+	phaseWrite  = "write"
+)
+
+type requestTimingKey struct{}
+
+// requestTiming times the phases of a request through the proxy
+type requestTiming struct {
+	trace plugins.RequestTrace
+	// start is when the request's header was read
+	start time.Time
+	// queued and handleStart are when the request started waiting for in-flight
+	// bytes and a worker, and when it started being handled
+	queued, handleStart time.Time
+	// pipeStart and pipeEnd are when the plugin pipeline started and returned,
+	// and handled when the request was handled (before its reply was written)
+	pipeStart, pipeEnd, handled time.Time
+	// op is the op of the request, if it reached the pipeline
+	op *Op
+}
+
+func newRequestTiming(ctx context.Context) (context.Context, *requestTiming) {
+	t := &requestTiming{start: time.Now()}
+	ctx = context.WithValue(ctx, requestTimingKey{}, t)
+	return plugins.WithRequestTrace(ctx, &t.trace), t
+}
+
+func getRequestTiming(ctx context.Context) *requestTiming {
+	t, _ := ctx.Value(requestTimingKey{}).(*requestTiming)
+	return t
+}
+
+func (t *requestTiming) queue() {
+	if t != nil {
+		t.queued = time.Now()
+	}
+}
+
+func (t *requestTiming) handle() {
+	if t != nil {
+		t.handleStart = time.Now()
+	}
+}
+
+func (t *requestTiming) endHandle() {
+	if t != nil {
+		t.handled = time.Now()
+	}
+}
+
+// startPipe records the op of the request as it enters the pipeline
+func (t *requestTiming) startPipe(op *Op) {
+	if t == nil {
+		return
+	}
+	if t.pipeStart.IsZero() {
+		opCopy := *op
+		t.op = &opCopy
+		t.pipeStart = time.Now()
+	}
+}
+
+func (t *requestTiming) endPipe() {
+	if t != nil {
+		t.pipeEnd = time.Now()
+	}
+}
+
+// timedReader times the reads of the client connection
+type timedReader struct {
+	io.Reader
+	d time.Duration
+}
+
+func (r *timedReader) Read(b []byte) (int, error) {
+	start := time.Now()
+	n, err := r.Reader.Read(b)
+	r.d += time.Since(start)
+	return n, err
+}
+
+// timedWriter times the writes to the client connection
+type timedWriter struct {
+	io.Writer
+	d time.Duration
+}
+
+func (w *timedWriter) Write(b []byte) (int, error) {
+	start := time.Now()
+	n, err := w.Writer.Write(b)
+	w.d += time.Since(start)
+	return n, err
+}
+
+// PhaseTime is the time a request spent in a phase
+type PhaseTime struct {
+	plugins.Phase
+	Millis float64 `json:"millis"`
+}
+
+// SlowRequest is one of the slowest recent requests with the time of its phases
+type SlowRequest struct {
+	Op
+	Millis    float64               `json:"millis"`
+	Phases    []PhaseTime           `json:"phases"`
+	Cancelled *plugins.Cancellation `json:"cancelled,omitempty"`
+
+	duration time.Duration
+}
+
+// requestPhases records the phases of the requests into metrics and keeps the
+// slowest recent requests. The slowest requests are kept in two halves of the
+// window, so those of the last half to whole window are listed.
+type requestPhases struct {
+	cfg *config.RequestPhasesConfig
+
+	l sync.Mutex
+	// current and previous are min-heaps of the slowest requests of the current
+	// and previous half windows
+	current, previous slowRequestHeap
+	currentStart      time.Time
+}
+
+func newRequestPhases(cfg *config.RequestPhasesConfig) *requestPhases {
+	return &requestPhases{cfg: cfg, currentStart: time.Now()}
+}
+
+// finish records the phases of the request once its reply is written; read and
+// write are the times spent reading it and writing its reply
+func (rp *requestPhases) finish(t *requestTiming, read, write time.Duration) {
+	end := time.Now()
+	handled := t.handled
+	if handled.IsZero() {
+		handled = end
+	}
+	// Requests which didn't reach the pipeline (e.g. the proxy answered them) are
+	// decoded and handled until they're handled
+	decodeEnd, encodeStart := handled, handled
+	if !t.pipeStart.IsZero() {
+		decodeEnd = t.pipeStart
+		if !t.pipeEnd.IsZero() {
+			encodeStart = t.pipeEnd
+		}
+	}
+
+	queue := nonNegative(t.handleStart.Sub(t.queued))
+	phases := []plugins.Phase{
+		{Name: phaseRead, Duration: read},
+		{Name: phaseQueue, Duration: queue},
+		{Name: phaseDecode, Duration: nonNegative(decodeEnd.Sub(t.start) - read - queue)},
+	}
+	phases = append(phases, t.trace.Phases()...)
+	phases = append(phases,
+		plugins.Phase{Name: phaseEncode, Duration: nonNegative(end.Sub(encodeStart) - write)},
+		plugins.Phase{Name: phaseWrite, Duration: write},
+	)
+
+	var exemplar prometheus.Labels
+	if t.op != nil {
+		exemplar = prometheus.Labels{"op_id": strconv.FormatInt(t.op.ID, 10)}
+	}
+	times := make([]PhaseTime, len(phases))
+	for i, phase := range phases {
+		o := requestPhaseHistogram.WithLabelValues(phase.Name, phase.Plugin)
+		if eo, ok := o.(prometheus.ExemplarObserver); ok && exemplar != nil {
+			eo.ObserveWithExemplar(phase.Duration.Seconds(), exemplar)
+		} else {
+			o.Observe(phase.Duration.Seconds())
+		}
+		times[i] = PhaseTime{Phase: phase, Millis: millis(phase.Duration)}
+	}
+	cancelled := t.trace.Cancelled()
+	if cancelled != nil {
+		requestPhaseCancelledCounter.WithLabelValues(cancelled.Phase, cancelled.Plugin, cancelled.Reason).Inc()
+	}
+
+	// Only requests which reached the pipeline have an op to describe them
+	if t.op == nil {
+		return
+	}
+	duration := end.Sub(t.start)
+	rp.add(&SlowRequest{
+		Op:        *t.op,
+		Millis:    millis(duration),
+		Phases:    times,
+		Cancelled: cancelled,
+		duration:  duration,
+	}, end)
+}
+
+// add keeps the request if it's one of the slowest of the current half window
+func (rp *requestPhases) add(r *SlowRequest, now time.Time) {
+	rp.l.Lock()
+	defer rp.l.Unlock()
+	rp.rotate(now)
+	if len(rp.current) < rp.cfg.SlowRequests {
+		heap.Push(&rp.current, r)
+	} else if rp.current[0].duration < r.duration {
+		rp.current[0] = r
+		heap.Fix(&rp.current, 0)
+	}
+}
+
+// rotate starts a new half window once the current one is over
+func (rp *requestPhases) rotate(now time.Time) {
+	half := rp.cfg.WindowDuration / 2
+	if now.Sub(rp.currentStart) < half {
+		return
+	}
+	if now.Sub(rp.currentStart) < 2*half {
+		rp.previous = rp.current
+	} else {
+		rp.previous = nil
+	}
+	rp.current = nil
+	rp.currentStart = now
+}
+
+// slowest returns the slowest recent requests, slowest first
+func (rp *requestPhases) slowest(limit int) []SlowRequest {
+	rp.l.Lock()
+	rp.rotate(time.Now())
+	requests := make([]SlowRequest, 0, len(rp.current)+len(rp.previous))
+	for _, h := range []slowRequestHeap{rp.current, rp.previous} {
+		for _, r := range h {
+			requests = append(requests, *r)
+		}
+	}
+	rp.l.Unlock()
+
+	sort.Slice(requests, func(i, j int) bool { return requests[i].duration > requests[j].duration })
+	if limit <= 0 || limit > rp.cfg.SlowRequests {
+		limit = rp.cfg.SlowRequests
+	}
+	if len(requests) > limit {
+		requests = requests[:limit]
+	}
+	return requests
+}
+
+// SlowRequests returns the slowest recent requests with the time of their phases,
+// slowest first (nil if requestPhases isn't enabled)
+func (p *Proxy) SlowRequests(limit int) []SlowRequest {
+	if p.phases == nil {
+		return nil
+	}
+	return p.phases.slowest(limit)
+}
+
+// slowRequestHeap is a min-heap of requests by duration
+type slowRequestHeap []*SlowRequest
+
+func (h slowRequestHeap) Len() int            { return len(h) }
+func (h slowRequestHeap) Less(i, j int) bool  { return h[i].duration < h[j].duration }
+func (h slowRequestHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *slowRequestHeap) Push(x interface{}) { *h = append(*h, x.(*SlowRequest)) }
+func (h *slowRequestHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+func nonNegative(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
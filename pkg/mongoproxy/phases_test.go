@@ -0,0 +1,137 @@
+package mongoproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongotest"
+	"github.com/wish/mongoproxy/pkg/mongowire"
+)
+
+func TestProxyRequestPhases(t *testing.T) {
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	backend.Handle("find", func(database string, cmd bson.D) bson.D {
+		time.Sleep(30 * time.Millisecond)
+		return bson.D{{"ok", 1}, {"cursor", bson.D{{"id", int64(0)}, {"ns", "test.foo"}, {"firstBatch", bson.A{}}}}}
+	})
+	backend.Handle("count", func(database string, cmd bson.D) bson.D {
+		time.Sleep(200 * time.Millisecond)
+		return bson.D{{"ok", 1}, {"n", 0}}
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		Plugins: []config.PluginConfig{
+			{
+				Name: "mongo",
+				Config: bson.D{
+					{"connectTimeout", "1s"},
+					{"mongoAddr", backend.URI()},
+				},
+			},
+		},
+		OperationTimeout: "100ms",
+		RequestPhases:    &config.RequestPhasesConfig{SlowRequests: 2},
+	}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(l, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Serve()
+	defer proxy.Shutdown(context.TODO())
+
+	c, err := net.Dial("tcp", proxy.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	run := func(d bson.D) {
+		msg := &mongowire.OP_MSG{
+			Header:   mongowire.MessageHeader{RequestID: 1, OpCode: mongowire.OpMsg},
+			Sections: []mongowire.MSGSection{mongowire.MSGSection_Body{d}},
+		}
+		if err := msg.WriteTo(c); err != nil {
+			t.Fatal(err)
+		}
+		req, err := mongowire.NewRequest(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.GetOpMsg()
+	}
+	run(bson.D{{"ping", 1}, {"$db", "admin"}})
+	run(bson.D{{"find", "foo"}, {"$db", "test"}})
+	run(bson.D{{"ping", 1}, {"$db", "admin"}})
+	// The count times out in the backend
+	run(bson.D{{"count", "foo"}, {"$db", "test"}})
+
+	w := httptest.NewRecorder()
+	proxy.AdminHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/slow", nil))
+	var slow []struct {
+		CommandName string  `json:"commandName"`
+		Millis      float64 `json:"millis"`
+		Phases      []struct {
+			Name   string  `json:"name"`
+			Plugin string  `json:"plugin"`
+			Millis float64 `json:"millis"`
+		} `json:"phases"`
+		Cancelled *struct {
+			Phase  string `json:"phase"`
+			Reason string `json:"reason"`
+		} `json:"cancelled"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &slow); err != nil {
+		t.Fatalf("%v: %s", err, w.Body.String())
+	}
+
+	// The slowest two are kept, slowest first
+	if len(slow) != 2 || slow[0].CommandName != "count" || slow[1].CommandName != "find" {
+		t.Fatalf("unexpected slow requests: %s", w.Body.String())
+	}
+	if c := slow[0].Cancelled; c == nil || c.Phase != "backend" || c.Reason != "timeout" {
+		t.Fatalf("expected the count to time out in the backend: %s", w.Body.String())
+	}
+	find := slow[1]
+	if find.Cancelled != nil {
+		t.Fatalf("unexpected cancellation: %s", w.Body.String())
+	}
+	expected := []string{"read", "queue", "decode", "plugin", "backend", "encode", "write"}
+	if len(find.Phases) != len(expected) {
+		t.Fatalf("unexpected phases: %s", w.Body.String())
+	}
+	var total float64
+	for i, phase := range find.Phases {
+		if phase.Name != expected[i] {
+			t.Fatalf("unexpected phase %d: %s", i, w.Body.String())
+		}
+		total += phase.Millis
+	}
+	if find.Phases[3].Plugin != "mongo" || find.Phases[4].Millis < 30 || find.Phases[3].Millis > find.Phases[4].Millis {
+		t.Fatalf("expected the time to be in the backend: %s", w.Body.String())
+	}
+	// The phases add up to the request
+	if total > find.Millis+0.01 || total < find.Millis*0.9 {
+		t.Fatalf("phases add up to %v of %v", total, find.Millis)
+	}
+}
@@ -0,0 +1,9 @@
+package plugins
+
+import "net/http"
+
+// AdminHandler is an optional interface a Plugin can implement to expose plugin
+// specific endpoints on the admin API (under /admin/plugins/{name}/api/).
+type AdminHandler interface {
+	AdminHandler() http.Handler
+}
@@ -0,0 +1,154 @@
+package aggpolicy
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "aggpolicy"
+
+var (
+	violationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_aggpolicy_violations_total",
+		Help: "The total aggregate pipelines violating a policy",
+	}, []string{"db", "collection", "policy"})
+)
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &AggPolicyPlugin{
+			conf: AggPolicyPluginConfig{},
+		}
+	})
+}
+
+type AggPolicyPluginConfig struct {
+	// AllowOut are the namespaces in other databases that $out and $merge may write
+	// to (same format as a plugin scope); writes within the aggregate's database are
+	// always allowed
+	AllowOut *plugins.Scope `bson:"allowOut"`
+	// MaxLookupDepth caps the nesting of $lookup and $graphLookup stages (default 0; unlimited)
+	MaxLookupDepth int `bson:"maxLookupDepth"`
+	// AllowJavaScript allows $where, $function and $accumulator in pipelines (default false)
+	AllowJavaScript bool `bson:"allowJavaScript"`
+	// LogOnly logs violations instead of rejecting the pipeline
+	LogOnly bool `bson:"logOnly"`
+}
+
+// This is a plugin that enforces policies on the stages of aggregate pipelines
+type AggPolicyPlugin struct {
+	conf AggPolicyPluginConfig
+}
+
+func (p *AggPolicyPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *AggPolicyPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	if p.conf.MaxLookupDepth < 0 {
+		return fmt.Errorf("maxLookupDepth must not be negative: %d", p.conf.MaxLookupDepth)
+	}
+	if p.conf.AllowOut != nil {
+		p.conf.AllowOut.Compile()
+	}
+
+	return nil
+}
+
+// violation is a pipeline violating a policy
+type violation struct {
+	policy string
+	msg    string
+}
+
+func (v *violation) Error() string { return v.msg }
+
+// check returns the first policy the pipeline of an aggregate on db violates
+func (p *AggPolicyPlugin) check(db string, pipeline bson.A) error {
+	return command.WalkPipeline(pipeline, func(stage *command.PipelineStage) error {
+		switch stage.Name {
+		case "$out", "$merge":
+			outDB, outCollection, err := command.PipelineOutput(stage)
+			if err != nil {
+				return err
+			}
+			if outDB != "" && outDB != db && (p.conf.AllowOut == nil || !p.conf.AllowOut.MatchNamespace(outDB, outCollection)) {
+				return &violation{"out", fmt.Sprintf("%s to %s.%s is not allowed from database %s", stage.Name, outDB, outCollection, db)}
+			}
+		case "$lookup", "$graphLookup":
+			if p.conf.MaxLookupDepth > 0 {
+				if depth := stage.Depth("$lookup") + stage.Depth("$graphLookup"); depth > p.conf.MaxLookupDepth {
+					return &violation{"lookupDepth", fmt.Sprintf("%s nested %d deep exceeds the max of %d", stage.Name, depth, p.conf.MaxLookupDepth)}
+				}
+			}
+		}
+
+		if !p.conf.AllowJavaScript {
+			// Sub-pipelines are walked separately
+			if spec, ok := stage.Spec.(bson.D); ok && (stage.Name == "$lookup" || stage.Name == "$unionWith" || stage.Name == "$facet") {
+				spec = withoutPipelines(stage.Name, spec)
+				stage = &command.PipelineStage{Name: stage.Name, Spec: spec}
+			}
+			if op, ok := command.FindJavaScript(stage.Spec); ok {
+				return &violation{"javascript", fmt.Sprintf("%s is not allowed in %s", op, stage.Name)}
+			}
+		}
+		return nil
+	})
+}
+
+// withoutPipelines returns the spec of the stage without its sub-pipelines
+func withoutPipelines(name string, spec bson.D) bson.D {
+	if name == "$facet" {
+		return nil
+	}
+	out := make(bson.D, 0, len(spec))
+	for _, e := range spec {
+		if e.Key != "pipeline" {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *AggPolicyPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	cmd, ok := r.Command.(*command.Aggregate)
+	if !ok {
+		return next(ctx, r)
+	}
+
+	if err := p.check(cmd.Database, cmd.Pipeline); err != nil {
+		v, ok := err.(*violation)
+		if !ok {
+			return mongoerror.FailedToParse.ErrMessage(err.Error()), nil
+		}
+		violationsTotal.WithLabelValues(cmd.Database, cmd.GetCollection(), v.policy).Inc()
+		logrus.Warningf("AGGREGATE POLICY VIOLATION: %s, in db: %s, collection: %s", v.msg, cmd.Database, cmd.GetCollection())
+		if !p.conf.LogOnly {
+			return mongoerror.Unauthorized.ErrMessage(v.msg), nil
+		}
+	}
+
+	return next(ctx, r)
+}
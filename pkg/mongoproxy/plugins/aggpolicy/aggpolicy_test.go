@@ -0,0 +1,76 @@
+package aggpolicy
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func TestAggPolicy(t *testing.T) {
+	p := &AggPolicyPlugin{}
+	if err := p.Configure(bson.D{
+		{"allowOut", bson.D{{"collections", bson.A{"reports.*"}}}},
+		{"maxLookupDepth", 2},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	pipe := plugins.BuildPipeline([]plugins.Plugin{p}, func(context.Context, *plugins.Request) (bson.D, error) {
+		return bson.D{{"ok", 1}}, nil
+	})
+
+	lookup := func(pipeline ...interface{}) bson.D {
+		return bson.D{{"$lookup", bson.D{{"from", "other"}, {"pipeline", bson.A(pipeline)}, {"as", "joined"}}}}
+	}
+
+	tests := []struct {
+		pipeline bson.A
+		ok       bool
+	}{
+		{bson.A{bson.D{{"$match", bson.D{{"a", 1}}}}}, true},
+		// $out/$merge
+		{bson.A{bson.D{{"$out", "copy"}}}, true},
+		{bson.A{bson.D{{"$out", bson.D{{"db", "db"}, {"coll", "copy"}}}}}, true},
+		{bson.A{bson.D{{"$out", bson.D{{"db", "reports"}, {"coll", "copy"}}}}}, true},
+		{bson.A{bson.D{{"$out", bson.D{{"db", "other"}, {"coll", "copy"}}}}}, false},
+		{bson.A{bson.D{{"$merge", bson.D{{"into", bson.D{{"db", "other"}, {"coll", "copy"}}}}}}}, false},
+		{bson.A{bson.D{{"$merge", bson.D{{"into", "copy"}}}}}, true},
+		// $lookup depth
+		{bson.A{lookup(lookup())}, true},
+		{bson.A{lookup(lookup(lookup()))}, false},
+		{bson.A{lookup(bson.D{{"$graphLookup", bson.D{}}}, lookup())}, true},
+		{bson.A{lookup(lookup(bson.D{{"$graphLookup", bson.D{}}}))}, false},
+		{bson.A{bson.D{{"$facet", bson.D{{"a", bson.A{lookup(lookup(lookup()))}}}}}}, false},
+		// JavaScript
+		{bson.A{bson.D{{"$match", bson.D{{"$where", "this.a == 1"}}}}}, false},
+		{bson.A{bson.D{{"$addFields", bson.D{{"b", bson.D{{"$function", bson.D{}}}}}}}}, false},
+		{bson.A{lookup(bson.D{{"$match", bson.D{{"$where", "true"}}}})}, false},
+		// Malformed
+		{bson.A{bson.D{{"$match", bson.D{}}, {"$sort", bson.D{}}}}, false},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			r := &plugins.Request{
+				CommandName: "aggregate",
+				Command: &command.Aggregate{
+					Pipeline: test.pipeline,
+					Common:   command.Common{Database: "db"},
+				},
+			}
+			d, err := pipe(context.TODO(), r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok := bsonutil.Ok(d); ok != test.ok {
+				t.Fatalf("expected ok=%v for %v, got %v", test.ok, test.pipeline, d)
+			}
+		})
+	}
+}
@@ -1,15 +1,47 @@
 package all
 
 import (
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/aggpolicy"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/analytics"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/apppolicy"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/atlas"
 	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/authz"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/bulkimport"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/capture"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/changeevents"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/cluster"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/compat"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/ddlreview"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/deadline"
 	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/dedupe"
 	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/defaults"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/deprecation"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/errormap"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/export"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/external"
 	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/filtercommand"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/gridfs"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/guardrails"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/idempotency"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/idpolicy"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/indexadvisor"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/indexpolicy"
 	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/insort"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/jspolicy"
 	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/limits"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/luascript"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/maintenancewindow"
 	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/mongo"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/notify"
 	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/opentracing"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/outbox"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/projection"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/qos"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/router"
 	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/schema"
 	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/slowlog"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/snapshot"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/stalereads"
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/ttl"
 	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/writeconcernoverride"
 )
@@ -0,0 +1,369 @@
+package analytics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beorn7/perks/quantile"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins/capture"
+)
+
+const Name = "analytics"
+
+var (
+	pushesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_analytics_pushes_total",
+		Help: "The total remote-write pushes of query analytics by result",
+	}, []string{"result"})
+	pushedSeries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongoproxy_plugins_analytics_pushed_series",
+		Help: "The series of the last push of query analytics",
+	})
+)
+
+// Names of the series pushed
+const (
+	requestsSeries   = "mongoproxy_query_analytics_requests_total"
+	errorsSeries     = "mongoproxy_query_analytics_errors_total"
+	latencySumSeries = "mongoproxy_query_analytics_latency_seconds_sum"
+	latencySeries    = "mongoproxy_query_analytics_latency_seconds"
+)
+
+// otherFingerprint is the fingerprint of the queries aggregated together once
+// maxFingerprints queries are tracked
+const otherFingerprint = "other"
+
+// labelName is the format of label names (those starting with __ are reserved)
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// queryLabels are the labels of the series of each query
+var queryLabels = map[string]struct{}{
+	"__name__":    {},
+	"db":          {},
+	"collection":  {},
+	"command":     {},
+	"fingerprint": {},
+	"quantile":    {},
+}
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &AnalyticsPlugin{
+			conf: AnalyticsPluginConfig{
+				Interval:        "1m",
+				Timeout:         "10s",
+				Quantiles:       []float64{0.5, 0.9, 0.99},
+				MaxFingerprints: 1000,
+			},
+		}
+	})
+}
+
+type AnalyticsPluginConfig struct {
+	// RemoteWriteURL is the Prometheus remote-write endpoint the analytics are
+	// pushed to (required)
+	RemoteWriteURL string `bson:"remoteWriteURL"`
+	// BearerTokenFile is a file holding the endpoint's bearer token, read on
+	// every push
+	BearerTokenFile string `bson:"bearerTokenFile"`
+	// Headers are set on the pushes (e.g. X-Scope-OrgID for multi-tenant endpoints)
+	Headers map[string]string `bson:"headers"`
+	// Labels are added to every series (e.g. the cluster); instance defaults to
+	// the hostname
+	Labels map[string]string `bson:"labels"`
+	// Interval is the time between pushes (default "1m")
+	Interval string `bson:"interval"`
+	// Timeout is the timeout of a push, retries included (default "10s")
+	Timeout string `bson:"timeout"`
+	// Quantiles are the latency quantiles pushed (default 0.5, 0.9 and 0.99)
+	Quantiles []float64 `bson:"quantiles"`
+	// MaxFingerprints caps the queries (namespace, command and fingerprint)
+	// tracked; further queries are aggregated as the fingerprint "other"
+	// (default 1000)
+	MaxFingerprints int `bson:"maxFingerprints"`
+
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// queryKey identifies the requests aggregated together
+type queryKey struct {
+	db, collection, command, fingerprint string
+}
+
+// queryStats are the analytics of a query: counts since the proxy started and
+// the latencies since the last push
+type queryStats struct {
+	requests, errors uint64
+	latencySum       float64
+	latencies        *quantile.Stream
+}
+
+// This is a plugin that pushes query analytics to a Prometheus remote-write endpoint
+type AnalyticsPlugin struct {
+	conf AnalyticsPluginConfig
+
+	labels     []label
+	objectives map[float64]float64
+	client     *http.Client
+
+	lock    sync.Mutex
+	queries map[queryKey]*queryStats
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (p *AnalyticsPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *AnalyticsPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	if p.conf.RemoteWriteURL == "" {
+		return fmt.Errorf("remoteWriteURL is required")
+	}
+	if _, err := url.Parse(p.conf.RemoteWriteURL); err != nil {
+		return fmt.Errorf("invalid remoteWriteURL: %w", err)
+	}
+	if p.conf.interval, err = time.ParseDuration(p.conf.Interval); err != nil {
+		return err
+	}
+	if p.conf.interval <= 0 {
+		return fmt.Errorf("interval must be positive: %s", p.conf.Interval)
+	}
+	if p.conf.timeout, err = time.ParseDuration(p.conf.Timeout); err != nil {
+		return err
+	}
+	if p.conf.MaxFingerprints <= 0 {
+		return fmt.Errorf("maxFingerprints must be positive: %d", p.conf.MaxFingerprints)
+	}
+
+	// The error of the quantiles is relative to their distance to the median,
+	// like the summaries of the client library
+	p.objectives = make(map[float64]float64, len(p.conf.Quantiles))
+	for _, q := range p.conf.Quantiles {
+		if q <= 0 || q >= 1 {
+			return fmt.Errorf("invalid quantile %v: must be between 0 and 1", q)
+		}
+		if q < 0.5 {
+			p.objectives[q] = q / 10
+		} else {
+			p.objectives[q] = (1 - q) / 10
+		}
+	}
+
+	p.labels = p.labels[:0]
+	if _, ok := p.conf.Labels["instance"]; !ok {
+		hostname, _ := os.Hostname()
+		p.labels = append(p.labels, label{"instance", hostname})
+	}
+	for name, value := range p.conf.Labels {
+		if _, ok := queryLabels[name]; ok || !labelName.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label %q", name)
+		}
+		p.labels = append(p.labels, label{name, value})
+	}
+
+	p.client = &http.Client{}
+	p.queries = make(map[queryKey]*queryStats)
+
+	return nil
+}
+
+// ReadsBatches returns false as only the time requests take is looked at
+func (p *AnalyticsPlugin) ReadsBatches() bool { return false }
+
+// Start starts pushing the analytics every interval
+func (p *AnalyticsPlugin) Start(ctx context.Context) error {
+	p.stop = make(chan struct{})
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(p.conf.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-p.stop:
+				p.flush()
+				return
+			case <-ticker.C:
+				p.flush()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop pushes the analytics of the last interval and stops pushing
+func (p *AnalyticsPlugin) Stop(ctx context.Context) error {
+	if p.stop == nil {
+		return nil
+	}
+	close(p.stop)
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush pushes the analytics; the latencies of a failed push are lost, while the
+// counts are pushed again by the next
+func (p *AnalyticsPlugin) flush() {
+	series := p.series(time.Now())
+	if len(series) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.conf.timeout)
+	defer cancel()
+	if err := p.push(ctx, series); err != nil {
+		pushesTotal.WithLabelValues("failed").Inc()
+		logrus.Errorf("ANALYTICS ERROR: pushing %d series: %s", len(series), err.Error())
+		return
+	}
+	pushesTotal.WithLabelValues("sent").Inc()
+	pushedSeries.Set(float64(len(series)))
+}
+
+// observe adds a request to the analytics of its query
+func (p *AnalyticsPlugin) observe(key queryKey, took time.Duration, failed bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	s, ok := p.queries[key]
+	if !ok {
+		if len(p.queries) >= p.conf.MaxFingerprints {
+			key = queryKey{fingerprint: otherFingerprint}
+			s = p.queries[key]
+		}
+		if s == nil {
+			s = &queryStats{}
+			p.queries[key] = s
+		}
+	}
+	s.requests++
+	if failed {
+		s.errors++
+	}
+	s.latencySum += took.Seconds()
+	if len(p.objectives) > 0 {
+		if s.latencies == nil {
+			s.latencies = quantile.NewTargeted(p.objectives)
+		}
+		s.latencies.Insert(took.Seconds())
+	}
+}
+
+// series returns the series of the analytics at the time, resetting the
+// latencies: counts of every query seen since the start, and latency quantiles
+// of those seen since the last push
+func (p *AnalyticsPlugin) series(now time.Time) []timeSeries {
+	ts := now.UnixNano() / int64(time.Millisecond)
+	newSeries := func(name string, key queryKey, value float64, extra ...label) timeSeries {
+		labels := append(make([]label, 0, len(p.labels)+6), p.labels...)
+		labels = append(labels,
+			label{"__name__", name},
+			label{"db", key.db},
+			label{"collection", key.collection},
+			label{"command", key.command},
+			label{"fingerprint", key.fingerprint},
+		)
+		labels = append(labels, extra...)
+		// Labels can't be empty (e.g. the collection of database commands)
+		n := 0
+		for _, l := range labels {
+			if l.value != "" {
+				labels[n] = l
+				n++
+			}
+		}
+		labels = labels[:n]
+		sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+		return timeSeries{labels: labels, value: value, timestamp: ts}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	series := make([]timeSeries, 0, len(p.queries)*(3+len(p.objectives)))
+	for key, s := range p.queries {
+		series = append(series,
+			newSeries(requestsSeries, key, float64(s.requests)),
+			newSeries(errorsSeries, key, float64(s.errors)),
+			newSeries(latencySumSeries, key, s.latencySum),
+		)
+		if s.latencies == nil {
+			continue
+		}
+		for _, q := range p.conf.Quantiles {
+			series = append(series, newSeries(latencySeries, key, s.latencies.Query(q), label{"quantile", strconv.FormatFloat(q, 'f', -1, 64)}))
+		}
+		s.latencies = nil
+	}
+	return series
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *AnalyticsPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	// The database is cleared from the command by the mongo plugin; so we grab it first
+	key := queryKey{
+		db:          command.GetCommandDatabase(r.Command),
+		collection:  command.GetCommandCollection(r.Command),
+		command:     r.CommandName,
+		fingerprint: fingerprint(r.Command),
+	}
+	start := time.Now()
+	result, err := next(ctx, r)
+	p.observe(key, time.Since(start), err != nil || !bsonutil.Ok(result))
+	return result, err
+}
+
+// fingerprint returns the command's fingerprint, the same as capture's so that
+// captures and taps can be filtered by the fingerprints of the analytics
+func fingerprint(cmd interface{}) string {
+	b, err := bson.Marshal(cmd)
+	if err != nil {
+		return ""
+	}
+	var d bson.D
+	if err := bson.Unmarshal(b, &d); err != nil {
+		return ""
+	}
+	return capture.Fingerprint(d)
+}
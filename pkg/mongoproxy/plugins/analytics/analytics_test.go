@@ -0,0 +1,205 @@
+package analytics
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/golang/snappy"
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+// decodeWriteRequest decodes the series of a remote-write request as
+// name{label="value",...} => value
+func decodeWriteRequest(t *testing.T, b []byte) map[string]float64 {
+	series := make(map[string]float64)
+	fields := func(b []byte, f func(protowire.Number, []byte, uint64)) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatal(protowire.ParseError(n))
+			}
+			b = b[n:]
+			switch typ {
+			case protowire.BytesType:
+				v, n := protowire.ConsumeBytes(b)
+				f(num, v, 0)
+				b = b[n:]
+			case protowire.Fixed64Type:
+				v, n := protowire.ConsumeFixed64(b)
+				f(num, nil, v)
+				b = b[n:]
+			case protowire.VarintType:
+				v, n := protowire.ConsumeVarint(b)
+				f(num, nil, v)
+				b = b[n:]
+			default:
+				t.Fatalf("unexpected wire type %d", typ)
+			}
+		}
+	}
+	fields(b, func(_ protowire.Number, ts []byte, _ uint64) {
+		var (
+			name   string
+			labels []string
+			value  float64
+		)
+		fields(ts, func(num protowire.Number, msg []byte, _ uint64) {
+			switch num {
+			case 1:
+				var l [2]string
+				fields(msg, func(num protowire.Number, v []byte, _ uint64) { l[num-1] = string(v) })
+				if l[0] == "__name__" {
+					name = l[1]
+				} else {
+					labels = append(labels, l[0]+"="+`"`+l[1]+`"`)
+				}
+			case 2:
+				fields(msg, func(num protowire.Number, _ []byte, v uint64) {
+					if num == 1 {
+						value = math.Float64frombits(v)
+					}
+				})
+			}
+		})
+		if !sort.StringsAreSorted(labels) {
+			t.Fatalf("expected sorted labels, got %v", labels)
+		}
+		series[name+"{"+strings.Join(labels, ",")+"}"] = value
+	})
+	return series
+}
+
+func TestAnalytics(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		received []map[string]float64
+		failures = 1
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		// The first push is retried
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("X-Scope-OrgID") != "tenant" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		if b, err := snappy.Decode(nil, b); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		} else {
+			received = append(received, decodeWriteRequest(t, b))
+		}
+	}))
+	defer srv.Close()
+
+	pl, _ := plugins.GetPlugin(Name)
+	d := pl.(*AnalyticsPlugin)
+	if err := d.Configure(bson.D{
+		{"remoteWriteURL", srv.URL},
+		{"headers", bson.D{{"X-Scope-OrgID", "tenant"}}},
+		{"labels", bson.D{{"instance", "proxy-1"}}},
+		{"interval", "1h"},
+		{"quantiles", bson.A{0.5}},
+		{"maxFingerprints", 2},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+
+	p := plugins.BuildPipeline([]plugins.Plugin{d}, func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+		if command.GetCommandCollection(r.Command) == "denied" {
+			return mongoerror.Unauthorized.ErrMessage("denied"), nil
+		}
+		return bson.D{{"ok", 1}}, nil
+	})
+	for _, c := range []bson.D{
+		// The same query with other values has the same fingerprint
+		{{"find", "users"}, {"filter", bson.D{{"name", "a"}}}, {"$db", "db"}},
+		{{"find", "users"}, {"filter", bson.D{{"name", "b"}}}, {"$db", "db"}},
+		{{"find", "denied"}, {"filter", bson.D{}}, {"$db", "db"}},
+		// Queries beyond maxFingerprints are aggregated as other
+		{{"find", "users"}, {"filter", bson.D{{"age", 1}}}, {"$db", "db"}},
+		{{"find", "orders"}, {"$db", "db"}},
+	} {
+		cmd := &command.Find{}
+		if err := cmd.FromBSOND(c); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p(context.TODO(), &plugins.Request{CommandName: "find", Command: cmd}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := d.Stop(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(received) != 1 {
+		t.Fatalf("expected 1 push, got %d", len(received))
+	}
+	series := received[0]
+
+	usersFind := &command.Find{}
+	usersFind.FromBSOND(bson.D{{"find", "users"}, {"filter", bson.D{{"name", "?"}}}})
+	users := `collection="users",command="find",db="db",fingerprint="` + fingerprint(usersFind) + `",instance="proxy-1"`
+	other := `fingerprint="other",instance="proxy-1"`
+	for name, value := range map[string]float64{
+		"mongoproxy_query_analytics_requests_total{" + users + "}": 2,
+		"mongoproxy_query_analytics_errors_total{" + users + "}":   0,
+		"mongoproxy_query_analytics_requests_total{" + other + "}": 2,
+	} {
+		if v, ok := series[name]; !ok || v != value {
+			t.Fatalf("expected %s %v, got %v in %v", name, value, v, series)
+		}
+	}
+	var errors, quantiles int
+	for name, value := range series {
+		if strings.HasPrefix(name, "mongoproxy_query_analytics_errors_total{") && strings.Contains(name, `collection="denied"`) && value == 1 {
+			errors++
+		}
+		if strings.HasPrefix(name, "mongoproxy_query_analytics_latency_seconds{") && strings.Contains(name, `quantile="0.5"`) {
+			quantiles++
+		}
+	}
+	if errors != 1 || quantiles != 3 || len(series) != 3*4 {
+		t.Fatalf("unexpected series %v", series)
+	}
+}
+
+func TestAnalyticsConfig(t *testing.T) {
+	tests := []bson.D{
+		{},
+		{{"remoteWriteURL", "http://localhost"}, {"interval", "0s"}},
+		{{"remoteWriteURL", "http://localhost"}, {"quantiles", bson.A{1.0}}},
+		{{"remoteWriteURL", "http://localhost"}, {"labels", bson.D{{"db", "x"}}}},
+		{{"remoteWriteURL", "http://localhost"}, {"labels", bson.D{{"bad-name", "x"}}}},
+		{{"remoteWriteURL", "http://localhost"}, {"maxFingerprints", 0}},
+	}
+	for i, test := range tests {
+		pl, _ := plugins.GetPlugin(Name)
+		if err := pl.Configure(test); err == nil {
+			t.Fatalf("%d: expected an error", i)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package analytics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// timeSeries is a sample of a series, with its labels sorted by name (including
+// __name__)
+type timeSeries struct {
+	labels    []label
+	value     float64
+	timestamp int64
+}
+
+type label struct {
+	name, value string
+}
+
+// encodeWriteRequest encodes the series as a remote-write WriteRequest:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label        { string name = 1; string value = 2; }
+//	message Sample       { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []timeSeries) []byte {
+	var b, ts, msg []byte
+	for _, s := range series {
+		ts = ts[:0]
+		for _, l := range s.labels {
+			msg = protowire.AppendTag(msg[:0], 1, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.name)
+			msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, msg)
+		}
+		msg = protowire.AppendTag(msg[:0], 1, protowire.Fixed64Type)
+		msg = protowire.AppendFixed64(msg, math.Float64bits(s.value))
+		msg = protowire.AppendTag(msg, 2, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(s.timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, msg)
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+	return b
+}
+
+// retryableError is an error of a push worth retrying (server errors, throttling
+// and connection errors)
+type retryableError struct {
+	error
+}
+
+// push posts the series to the remote-write endpoint, retrying with a backoff
+// until the context is done
+func (p *AnalyticsPlugin) push(ctx context.Context, series []timeSeries) error {
+	body := snappy.Encode(nil, encodeWriteRequest(series))
+	backoff := 500 * time.Millisecond
+	for {
+		err := p.post(ctx, body)
+		if _, ok := err.(retryableError); !ok {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (p *AnalyticsPlugin) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, p.conf.RemoteWriteURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("User-Agent", "mongoproxy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for k, v := range p.conf.Headers {
+		req.Header.Set(k, v)
+	}
+	if p.conf.BearerTokenFile != "" {
+		// The token is read on every push so it can be rotated
+		token, err := ioutil.ReadFile(p.conf.BearerTokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return retryableError{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("%s: %s", resp.Status, msg)
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return retryableError{err}
+		}
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
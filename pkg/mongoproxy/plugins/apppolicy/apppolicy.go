@@ -0,0 +1,274 @@
+package apppolicy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/time/rate"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "apppolicy"
+
+var (
+	rejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_apppolicy_rejected_total",
+		Help: "The total requests rejected by an appName policy",
+	}, []string{"app_name", "reason"})
+	rateLimitDelayTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_apppolicy_ratelimit_delay_seconds_total",
+		Help: "The total delay added by appName rate limits in seconds",
+	}, []string{"app_name"})
+)
+
+// exemptCommands are connection management commands (handshakes, heartbeats, auth)
+// which policies don't apply to
+var exemptCommands = map[string]struct{}{
+	"isMaster":     {},
+	"ismaster":     {},
+	"hello":        {},
+	"ping":         {},
+	"buildInfo":    {},
+	"buildinfo":    {},
+	"saslStart":    {},
+	"saslContinue": {},
+	"getnonce":     {},
+	"logout":       {},
+	"endSessions":  {},
+}
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &AppPolicyPlugin{
+			conf: AppPolicyPluginConfig{},
+		}
+	})
+}
+
+type AppPolicyPluginConfig struct {
+	// Policies are the policies keyed by the client's appName (from the handshake)
+	Policies map[string]*Policy `bson:"policies"`
+	// Default is the policy for clients without a policy for their appName (optional)
+	Default *Policy `bson:"default"`
+}
+
+// Policy is the set of limits applied to all requests from an appName
+type Policy struct {
+	// RateLimit is the max requests per second across all connections with the
+	// appName (default unlimited)
+	RateLimit float64 `bson:"rateLimit"`
+	// RateLimitBurst is the burst size of the rate limit (default RateLimit rounded up)
+	RateLimitBurst int `bson:"rateLimitBurst"`
+	// RateLimitWait is the max time a request waits for the rate limit before it
+	// is rejected (default 0; reject immediately)
+	RateLimitWait string `bson:"rateLimitWait"`
+	// ClusterRateLimit makes RateLimit (and its burst) the limit across the fleet:
+	// each proxy allows its share, split evenly between the live proxies of the
+	// chain's cluster plugin (default false; per proxy)
+	ClusterRateLimit bool `bson:"clusterRateLimit"`
+
+	// ReadPreference overrides the read preference of reads (find, aggregate, count, distinct)
+	ReadPreference *command.ReadPreference `bson:"readPreference"`
+
+	// Allow limits the namespaces and commands allowed (same format as a plugin scope);
+	// other requests are rejected
+	Allow *plugins.Scope `bson:"allow"`
+
+	// MaxTimeMS caps the maxTimeMS of reads; reads without one get the cap
+	MaxTimeMS *int64 `bson:"maxTimeMS"`
+
+	limiter       *rate.Limiter
+	burst         int
+	rateLimitWait time.Duration
+	// members is the number of proxies the limiter is currently split between
+	members int64
+}
+
+func (p *Policy) load() error {
+	if p.RateLimit < 0 {
+		return fmt.Errorf("rateLimit must not be negative: %v", p.RateLimit)
+	}
+	if p.RateLimit > 0 {
+		burst := p.RateLimitBurst
+		if burst <= 0 {
+			burst = int(math.Ceil(p.RateLimit))
+		}
+		p.limiter = rate.NewLimiter(rate.Limit(p.RateLimit), burst)
+		p.burst = burst
+		p.members = 1
+	}
+	if p.RateLimitWait != "" {
+		d, err := time.ParseDuration(p.RateLimitWait)
+		if err != nil {
+			return fmt.Errorf("invalid rateLimitWait: %w", err)
+		}
+		p.rateLimitWait = d
+	}
+	if p.MaxTimeMS != nil && *p.MaxTimeMS <= 0 {
+		return fmt.Errorf("maxTimeMS must be positive: %d", *p.MaxTimeMS)
+	}
+	if p.Allow != nil {
+		p.Allow.Compile()
+	}
+	return nil
+}
+
+// split splits the cluster rate limit between the members of the fleet
+func (p *Policy) split(members int) {
+	if atomic.SwapInt64(&p.members, int64(members)) == int64(members) {
+		return
+	}
+	p.limiter.SetLimit(rate.Limit(p.RateLimit / float64(members)))
+	p.limiter.SetBurst(int(math.Ceil(float64(p.burst) / float64(members))))
+}
+
+// This is a plugin that applies per appName traffic policies
+type AppPolicyPlugin struct {
+	conf AppPolicyPluginConfig
+
+	coordinatorLock sync.RWMutex
+	coordinator     plugins.Coordinator
+}
+
+func (p *AppPolicyPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *AppPolicyPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	for appName, policy := range p.conf.Policies {
+		if policy == nil {
+			return fmt.Errorf("empty policy for appName %s", appName)
+		}
+		if err := policy.load(); err != nil {
+			return fmt.Errorf("invalid policy for appName %s: %w", appName, err)
+		}
+	}
+	if p.conf.Default != nil {
+		if err := p.conf.Default.load(); err != nil {
+			return fmt.Errorf("invalid default policy: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// SetCoordinator sets the coordinator the cluster rate limits are split by
+func (p *AppPolicyPlugin) SetCoordinator(c plugins.Coordinator) {
+	p.coordinatorLock.Lock()
+	defer p.coordinatorLock.Unlock()
+	p.coordinator = c
+}
+
+// members returns the number of proxies in the fleet (1 without a coordinator)
+func (p *AppPolicyPlugin) members() int {
+	p.coordinatorLock.RLock()
+	defer p.coordinatorLock.RUnlock()
+	if p.coordinator == nil {
+		return 1
+	}
+	return p.coordinator.Members()
+}
+
+func (p *AppPolicyPlugin) policy(appName string) *Policy {
+	if policy, ok := p.conf.Policies[appName]; ok {
+		return policy
+	}
+	return p.conf.Default
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *AppPolicyPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	var appName string
+	if r.CC != nil {
+		appName = r.CC.AppName
+	}
+	policy := p.policy(appName)
+	if policy == nil {
+		return next(ctx, r)
+	}
+	if _, ok := exemptCommands[r.CommandName]; ok {
+		return next(ctx, r)
+	}
+
+	if policy.Allow != nil && !policy.Allow.Match(r) {
+		rejectedTotal.WithLabelValues(appName, "allow").Inc()
+		return mongoerror.Unauthorized.ErrMessage(fmt.Sprintf("%s on %s.%s not allowed for appName %q",
+			r.CommandName, command.GetCommandDatabase(r.Command), command.GetCommandCollection(r.Command), appName)), nil
+	}
+
+	if policy.limiter != nil {
+		if policy.ClusterRateLimit {
+			policy.split(p.members())
+		}
+		reservation := policy.limiter.Reserve()
+		delay := reservation.Delay()
+		if !reservation.OK() || delay > policy.rateLimitWait {
+			reservation.Cancel()
+			rejectedTotal.WithLabelValues(appName, "ratelimit").Inc()
+			return mongoerror.ExceededTimeLimit.ErrMessage(fmt.Sprintf("rate limit exceeded for appName %q", appName)), nil
+		}
+		if delay > 0 {
+			t := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				reservation.Cancel()
+				return nil, ctx.Err()
+			case <-t.C:
+			}
+			rateLimitDelayTotal.WithLabelValues(appName).Add(delay.Seconds())
+		}
+	}
+
+	// MaxTimeMS and ReadPreference only apply to reads
+	var maxTimeMS **int64
+	switch cmd := r.Command.(type) {
+	case *command.Find:
+		maxTimeMS = &cmd.MaxTimeMS
+	case *command.Aggregate:
+		maxTimeMS = &cmd.MaxTimeMS
+	case *command.Count:
+		maxTimeMS = &cmd.MaxTimeMS
+	case *command.Distinct:
+		maxTimeMS = &cmd.MaxTimeMS
+	}
+	if maxTimeMS != nil {
+		if policy.MaxTimeMS != nil && (*maxTimeMS == nil || **maxTimeMS <= 0 || **maxTimeMS > *policy.MaxTimeMS) {
+			tmp := *policy.MaxTimeMS
+			*maxTimeMS = &tmp
+			r.Modified()
+		}
+		if policy.ReadPreference != nil {
+			if cmd, ok := r.Command.(interface {
+				SetReadPreference(*command.ReadPreference)
+			}); ok {
+				tmp := *policy.ReadPreference
+				cmd.SetReadPreference(&tmp)
+				r.Modified()
+			}
+		}
+	}
+
+	return next(ctx, r)
+}
@@ -0,0 +1,139 @@
+package apppolicy
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func int64Ptr(i int64) *int64 { return &i }
+
+func TestAppPolicy(t *testing.T) {
+	p := &AppPolicyPlugin{}
+	if err := p.Configure(bson.D{
+		{"policies", bson.D{
+			{"batch", bson.D{
+				{"rateLimit", 1.0},
+				{"readPreference", bson.D{{"mode", "secondary"}}},
+				{"allow", bson.D{{"databases", bson.A{"allowed"}}}},
+				{"maxTimeMS", int64(1000)},
+			}},
+		}},
+		{"default", bson.D{
+			{"maxTimeMS", int64(5000)},
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	pipe := plugins.BuildPipeline([]plugins.Plugin{p}, func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+		cmd := r.Command.(*command.Find)
+		return bson.D{
+			{"maxTimeMS", *cmd.MaxTimeMS},
+			{"readPreference", command.GetCommandReadPreferenceMode(cmd)},
+			{"ok", 1},
+		}, nil
+	})
+
+	find := func(appName, db string, maxTimeMS *int64) *plugins.Request {
+		cc := plugins.NewClientConnection()
+		cc.AppName = appName
+		return &plugins.Request{
+			CC:          cc,
+			CommandName: "find",
+			Command: &command.Find{
+				Collection: "foo",
+				MaxTimeMS:  maxTimeMS,
+				Common:     command.Common{Database: db},
+			},
+		}
+	}
+
+	tests := []struct {
+		r              *plugins.Request
+		ok             bool
+		maxTimeMS      int64
+		readPreference string
+	}{
+		{r: find("batch", "allowed", int64Ptr(10000)), ok: true, maxTimeMS: 1000, readPreference: "secondary"},
+		// rate limited
+		{r: find("batch", "allowed", nil), ok: false},
+		{r: find("batch", "other", nil), ok: false},
+		{r: find("web", "other", int64Ptr(100)), ok: true, maxTimeMS: 100, readPreference: "primary"},
+		{r: find("", "other", nil), ok: true, maxTimeMS: 5000, readPreference: "primary"},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			result, err := pipe(context.TODO(), test.r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bsonutil.Ok(result) != test.ok {
+				t.Fatalf("mismatch in ok expected=%v actual=%v", test.ok, result)
+			}
+			if !test.ok {
+				return
+			}
+			m := result.Map()
+			if m["maxTimeMS"] != test.maxTimeMS || m["readPreference"] != test.readPreference {
+				t.Fatalf("mismatch in result: %v", result)
+			}
+		})
+	}
+}
+
+type fleet int
+
+func (f fleet) Members() int                                        { return int(f) }
+func (f fleet) Value(string) (interface{}, bool)                    { return nil, false }
+func (f fleet) SetValue(context.Context, string, interface{}) error { return nil }
+func (f fleet) Leader(string) bool                                  { return true }
+
+func TestClusterRateLimit(t *testing.T) {
+	p := &AppPolicyPlugin{}
+	if err := p.Configure(bson.D{
+		{"default", bson.D{
+			{"rateLimit", 100.0},
+			{"rateLimitBurst", 10},
+			{"clusterRateLimit", true},
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	pipe := plugins.BuildPipeline([]plugins.Plugin{p}, func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+		return bson.D{{"ok", 1}}, nil
+	})
+	find := &plugins.Request{
+		CommandName: "find",
+		Command:     &command.Find{Collection: "foo", Common: command.Common{Database: "db"}},
+	}
+
+	for _, test := range []struct {
+		members int
+		limit   float64
+		burst   int
+	}{
+		// Without a coordinator the proxy allows the whole limit
+		{0, 100, 10},
+		{4, 25, 3},
+		{1, 100, 10},
+	} {
+		if test.members > 0 {
+			p.SetCoordinator(fleet(test.members))
+		}
+		if _, err := pipe(context.TODO(), find); err != nil {
+			t.Fatal(err)
+		}
+		limiter := p.conf.Default.limiter
+		if float64(limiter.Limit()) != test.limit || limiter.Burst() != test.burst {
+			t.Fatalf("%d members: expected a limit of %v (burst %d), got %v (burst %d)", test.members, test.limit, test.burst, limiter.Limit(), limiter.Burst())
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package atlas
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "atlas"
+
+// defaultBaseURL is the Atlas Admin API (v1.0)
+const defaultBaseURL = "https://cloud.mongodb.com/api/atlas/v1.0"
+
+// stateIdle is the state of an Atlas cluster which isn't being changed
+const stateIdle = "IDLE"
+
+var (
+	pollsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_atlas_polls_total",
+		Help: "The total polls of the Atlas Admin API by whether they succeeded",
+	}, []string{"success"})
+	degradedGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mongoproxy_plugins_atlas_cluster_degraded",
+		Help: "Whether the Atlas cluster is in maintenance or changing topology",
+	}, []string{"cluster"})
+)
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &AtlasPlugin{
+			conf: AtlasPluginConfig{
+				BaseURL:             defaultBaseURL,
+				PollInterval:        "1m",
+				Timeout:             "10s",
+				MaintenanceDuration: "3h",
+			},
+			now: time.Now,
+		}
+	})
+}
+
+type AtlasPluginConfig struct {
+	// BaseURL is the URL of the Atlas Admin API (default
+	// "https://cloud.mongodb.com/api/atlas/v1.0")
+	BaseURL string `bson:"baseURL"`
+	// GroupID is the ID of the Atlas project of the clusters (required)
+	GroupID string `bson:"groupId"`
+	// PublicKey and PrivateKeyFile (a file holding the private key) are the
+	// programmatic API key the API is queried with (required); it only needs the
+	// Project Read Only role
+	PublicKey      string `bson:"publicKey"`
+	PrivateKeyFile string `bson:"privateKeyFile"`
+	// Clusters are the Atlas clusters of the chain's backends (required)
+	Clusters []*Cluster `bson:"clusters"`
+	// PollInterval is how often the clusters are queried (default "1m")
+	PollInterval string `bson:"pollInterval"`
+	// Timeout is the timeout of each query (default "10s")
+	Timeout string `bson:"timeout"`
+	// MaintenanceDuration is how long the project's maintenance is assumed to
+	// last from the start of its window (default "3h")
+	MaintenanceDuration string `bson:"maintenanceDuration"`
+	// Timezone is the IANA timezone of the hour of the maintenance window (default
+	// UTC)
+	Timezone string `bson:"timezone"`
+
+	pollInterval        time.Duration
+	timeout             time.Duration
+	maintenanceDuration time.Duration
+	loc                 *time.Location
+}
+
+// Cluster maps a backend cluster to its Atlas cluster
+type Cluster struct {
+	// Name is the name of the backend cluster in the router plugin (default "",
+	// the backend of a chain without a router)
+	Name string `bson:"name"`
+	// AtlasName is the name of the cluster in Atlas (required)
+	AtlasName string `bson:"atlasName"`
+}
+
+// atlasCluster is the part of an Atlas cluster used by the plugin
+type atlasCluster struct {
+	StateName        string `json:"stateName"`
+	ProviderSettings struct {
+		InstanceSizeName string `json:"instanceSizeName"`
+	} `json:"providerSettings"`
+}
+
+// maintenanceWindow is the weekly maintenance window of an Atlas project
+type maintenanceWindow struct {
+	// DayOfWeek is the day the window starts on, from 1 (Sunday) to 7 (Saturday);
+	// 0 if the project has no window
+	DayOfWeek int `json:"dayOfWeek"`
+	// HourOfDay is the hour the window starts at (0-23)
+	HourOfDay int `json:"hourOfDay"`
+	// StartASAP is set if the maintenance was asked to start as soon as possible
+	StartASAP bool `json:"startASAP"`
+}
+
+// This is a plugin that queries the Atlas Admin API for the tier, maintenance
+// window and state of the backend clusters, reporting them to the other plugins
+// of the chain (see plugins.ClusterStateProvider)
+type AtlasPlugin struct {
+	conf   AtlasPluginConfig
+	client *http.Client
+	now    func() time.Time
+
+	l        sync.RWMutex
+	clusters map[string]*atlasCluster
+	window   *maintenanceWindow
+	lastErr  error
+	lastPoll time.Time
+	// states are the states as of the last poll, to report their changes
+	states map[string]plugins.ClusterState
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (p *AtlasPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *AtlasPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	if p.conf.GroupID == "" {
+		return fmt.Errorf("groupId is required")
+	}
+	if p.conf.PublicKey == "" || p.conf.PrivateKeyFile == "" {
+		return fmt.Errorf("publicKey and privateKeyFile are required")
+	}
+	privateKey, err := ioutil.ReadFile(p.conf.PrivateKeyFile)
+	if err != nil {
+		return fmt.Errorf("error reading privateKeyFile: %w", err)
+	}
+	if len(p.conf.Clusters) == 0 {
+		return fmt.Errorf("clusters are required")
+	}
+	names := make(map[string]struct{}, len(p.conf.Clusters))
+	for i, c := range p.conf.Clusters {
+		if c.AtlasName == "" {
+			return fmt.Errorf("cluster %d: atlasName is required", i)
+		}
+		if _, ok := names[c.Name]; ok {
+			return fmt.Errorf("duplicate cluster %q", c.Name)
+		}
+		names[c.Name] = struct{}{}
+	}
+
+	if p.conf.pollInterval, err = time.ParseDuration(p.conf.PollInterval); err != nil {
+		return fmt.Errorf("invalid pollInterval: %w", err)
+	}
+	if p.conf.pollInterval <= 0 {
+		return fmt.Errorf("pollInterval must be positive: %s", p.conf.PollInterval)
+	}
+	if p.conf.timeout, err = time.ParseDuration(p.conf.Timeout); err != nil {
+		return fmt.Errorf("invalid timeout: %w", err)
+	}
+	if p.conf.maintenanceDuration, err = time.ParseDuration(p.conf.MaintenanceDuration); err != nil {
+		return fmt.Errorf("invalid maintenanceDuration: %w", err)
+	}
+	p.conf.loc = time.UTC
+	if p.conf.Timezone != "" {
+		if p.conf.loc, err = time.LoadLocation(p.conf.Timezone); err != nil {
+			return err
+		}
+	}
+
+	p.client = &http.Client{
+		Timeout: p.conf.timeout,
+		Transport: &digestTransport{
+			username:  p.conf.PublicKey,
+			password:  strings.TrimSpace(string(privateKey)),
+			transport: http.DefaultTransport,
+		},
+	}
+	p.clusters = make(map[string]*atlasCluster)
+	p.states = make(map[string]plugins.ClusterState)
+	return nil
+}
+
+// get decodes the JSON response of the API path into v
+func (p *AtlasPlugin) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(p.conf.BaseURL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("GET %s: %s: %s", path, resp.Status, body)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// poll queries the clusters and the maintenance window of the project; the last
+// known ones are kept if it fails
+func (p *AtlasPlugin) poll(ctx context.Context) (err error) {
+	defer func() {
+		pollsTotal.WithLabelValues(fmt.Sprint(err == nil)).Inc()
+		p.l.Lock()
+		p.lastErr, p.lastPoll = err, p.now()
+		p.l.Unlock()
+	}()
+
+	group := "/groups/" + url.PathEscape(p.conf.GroupID)
+	window := &maintenanceWindow{}
+	if err := p.get(ctx, group+"/maintenanceWindow", window); err != nil {
+		return err
+	}
+	clusters := make(map[string]*atlasCluster, len(p.conf.Clusters))
+	for _, c := range p.conf.Clusters {
+		ac := &atlasCluster{}
+		if err := p.get(ctx, group+"/clusters/"+url.PathEscape(c.AtlasName), ac); err != nil {
+			return err
+		}
+		clusters[c.Name] = ac
+	}
+
+	p.l.Lock()
+	p.window, p.clusters = window, clusters
+	p.l.Unlock()
+	return nil
+}
+
+// maintenance returns whether t is in the maintenance window (or the maintenance
+// is pending to start as soon as possible) and the start of the next window
+func (p *AtlasPlugin) maintenance(w *maintenanceWindow, t time.Time) (bool, time.Time) {
+	if w == nil || w.DayOfWeek < 1 || w.DayOfWeek > 7 {
+		return w != nil && w.StartASAP, time.Time{}
+	}
+	t = t.In(p.conf.loc)
+	weekday := time.Weekday(w.DayOfWeek - 1)
+	in := w.StartASAP
+	var next time.Time
+	// The window may have started up to a week ago (or start within a week)
+	for i := -7; i <= 7; i++ {
+		day := time.Date(t.Year(), t.Month(), t.Day()+i, 0, 0, 0, 0, p.conf.loc)
+		if day.Weekday() != weekday {
+			continue
+		}
+		start := day.Add(time.Duration(w.HourOfDay) * time.Hour)
+		if !start.After(t) {
+			in = in || t.Before(start.Add(p.conf.maintenanceDuration))
+		} else if next.IsZero() {
+			next = start
+		}
+	}
+	return in, next
+}
+
+// ClusterState returns the state of the cluster as of the last poll (false if it
+// hasn't been polled), in maintenance if it's in the window now
+func (p *AtlasPlugin) ClusterState(cluster string) (plugins.ClusterState, bool) {
+	p.l.RLock()
+	c, ok := p.clusters[cluster]
+	window := p.window
+	p.l.RUnlock()
+	if !ok {
+		return plugins.ClusterState{}, false
+	}
+	state := plugins.ClusterState{
+		Tier:     c.ProviderSettings.InstanceSizeName,
+		Changing: c.StateName != stateIdle,
+	}
+	state.Maintenance, state.NextMaintenance = p.maintenance(window, p.now())
+	return state, true
+}
+
+// report logs and publishes the changes of the clusters' states since the last
+// report (e.g. entering maintenance or changing tier)
+func (p *AtlasPlugin) report() {
+	for _, c := range p.conf.Clusters {
+		state, ok := p.ClusterState(c.Name)
+		if !ok {
+			continue
+		}
+		degraded := 0.0
+		if state.Degraded() {
+			degraded = 1
+		}
+		degradedGauge.WithLabelValues(c.AtlasName).Set(degraded)
+
+		p.l.Lock()
+		prev, known := p.states[c.Name]
+		p.states[c.Name] = state
+		p.l.Unlock()
+		if !known || (prev.Tier == state.Tier && prev.Degraded() == state.Degraded()) {
+			continue
+		}
+
+		message := fmt.Sprintf("Atlas cluster %s changed from tier %s to %s", c.AtlasName, prev.Tier, state.Tier)
+		if prev.Degraded() != state.Degraded() {
+			message = fmt.Sprintf("Atlas cluster %s is no longer degraded", c.AtlasName)
+			if state.Degraded() {
+				message = fmt.Sprintf("Atlas cluster %s is degraded (maintenance %v, changing %v)", c.AtlasName, state.Maintenance, state.Changing)
+			}
+		}
+		logrus.Warnf("%s", message)
+		if !plugins.EventSubscribers() {
+			continue
+		}
+		plugins.PublishEvent(&plugins.Event{
+			Type:    plugins.EventTopology,
+			Source:  Name,
+			Message: message,
+			Fields: map[string]interface{}{
+				"cluster":     c.Name,
+				"tier":        state.Tier,
+				"maintenance": state.Maintenance,
+				"changing":    state.Changing,
+			},
+		})
+	}
+}
+
+// Start polls the Atlas Admin API every pollInterval
+func (p *AtlasPlugin) Start(ctx context.Context) error {
+	p.stop = make(chan struct{})
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(p.conf.pollInterval)
+		defer ticker.Stop()
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), p.conf.pollInterval)
+			if err := p.poll(ctx); err != nil {
+				logrus.Errorf("Error polling the Atlas Admin API: %v", err)
+			}
+			cancel()
+			p.report()
+
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops polling
+func (p *AtlasPlugin) Stop(ctx context.Context) error {
+	if p.stop == nil {
+		return nil
+	}
+	close(p.stop)
+	p.wg.Wait()
+	for _, c := range p.conf.Clusters {
+		degradedGauge.DeleteLabelValues(c.AtlasName)
+	}
+	return nil
+}
+
+// Stats returns the state of the clusters (for serverStatus)
+func (p *AtlasPlugin) Stats() bson.D {
+	clusters := bson.A{}
+	for _, c := range p.conf.Clusters {
+		state, ok := p.ClusterState(c.Name)
+		if !ok {
+			continue
+		}
+		d := bson.D{
+			{"name", c.Name},
+			{"atlasName", c.AtlasName},
+			{"tier", state.Tier},
+			{"maintenance", state.Maintenance},
+			{"changing", state.Changing},
+		}
+		if !state.NextMaintenance.IsZero() {
+			d = append(d, bson.E{"nextMaintenance", state.NextMaintenance})
+		}
+		clusters = append(clusters, d)
+	}
+	p.l.RLock()
+	defer p.l.RUnlock()
+	stats := bson.D{{"clusters", clusters}, {"lastPoll", p.lastPoll}}
+	if p.lastErr != nil {
+		stats = append(stats, bson.E{"lastError", p.lastErr.Error()})
+	}
+	return stats
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *AtlasPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	return next(ctx, r)
+}
@@ -0,0 +1,188 @@
+package atlas
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+// testAPI is an Atlas Admin API authenticating requests with digest authentication
+type testAPI struct {
+	l        sync.Mutex
+	clusters map[string]*atlasCluster
+	window   *maintenanceWindow
+	down     bool
+}
+
+func (a *testAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const realm, nonce = "MMS Public API", "abc123"
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Digest ") {
+		w.Header().Set("WWW-Authenticate", `Digest realm="`+realm+`", domain="", nonce="`+nonce+`", algorithm=MD5, qop="auth", stale=false`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	params := parseChallenge(strings.TrimPrefix(auth, "Digest "))
+	ha1 := md5Hex("public:" + realm + ":private")
+	ha2 := md5Hex(r.Method + ":" + r.URL.RequestURI())
+	if params["response"] != md5Hex(ha1+":"+nonce+":"+params["nc"]+":"+params["cnonce"]+":auth:"+ha2) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	a.l.Lock()
+	defer a.l.Unlock()
+	if a.down {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	var v interface{}
+	switch path := strings.TrimPrefix(r.URL.Path, "/api/atlas/v1.0/groups/group/"); {
+	case path == "maintenanceWindow":
+		v = a.window
+	case strings.HasPrefix(path, "clusters/") && a.clusters[strings.TrimPrefix(path, "clusters/")] != nil:
+		v = a.clusters[strings.TrimPrefix(path, "clusters/")]
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(v)
+}
+
+func newCluster(state, tier string) *atlasCluster {
+	c := &atlasCluster{StateName: state}
+	c.ProviderSettings.InstanceSizeName = tier
+	return c
+}
+
+func TestAtlas(t *testing.T) {
+	api := &testAPI{
+		clusters: map[string]*atlasCluster{"Cluster0": newCluster("IDLE", "M30")},
+		// Wednesdays at 10:00
+		window: &maintenanceWindow{DayOfWeek: 4, HourOfDay: 10},
+	}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "atlas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, []byte("private\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	pl, _ := plugins.GetPlugin(Name)
+	p := pl.(*AtlasPlugin)
+	if err := p.Configure(bson.D{
+		{"baseURL", server.URL + "/api/atlas/v1.0"},
+		{"groupId", "group"},
+		{"publicKey", "public"},
+		{"privateKeyFile", keyFile},
+		{"clusters", bson.A{bson.D{{"atlasName", "Cluster0"}}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// 2026-10-14 is a Wednesday
+	wed := func(hour int) time.Time { return time.Date(2026, 10, 14, hour, 0, 0, 0, time.UTC) }
+
+	if _, ok := p.ClusterState(""); ok {
+		t.Fatalf("expected the state to be unknown before polling")
+	}
+
+	tests := []struct {
+		setup    func()
+		now      time.Time
+		expected plugins.ClusterState
+	}{
+		{now: wed(9), expected: plugins.ClusterState{Tier: "M30", NextMaintenance: wed(10)}},
+		{now: wed(11), expected: plugins.ClusterState{Tier: "M30", Maintenance: true, NextMaintenance: wed(10).AddDate(0, 0, 7)}},
+		// The maintenance is assumed to be over after maintenanceDuration
+		{now: wed(13), expected: plugins.ClusterState{Tier: "M30", NextMaintenance: wed(10).AddDate(0, 0, 7)}},
+		{
+			setup:    func() { api.clusters["Cluster0"] = newCluster("UPDATING", "M40") },
+			now:      wed(13),
+			expected: plugins.ClusterState{Tier: "M40", Changing: true, NextMaintenance: wed(10).AddDate(0, 0, 7)},
+		},
+		// The last state is kept if the API is unavailable
+		{
+			setup:    func() { api.down = true },
+			now:      wed(13),
+			expected: plugins.ClusterState{Tier: "M40", Changing: true, NextMaintenance: wed(10).AddDate(0, 0, 7)},
+		},
+		{
+			setup: func() {
+				api.down = false
+				api.clusters["Cluster0"] = newCluster("IDLE", "M40")
+				api.window.StartASAP = true
+			},
+			now:      wed(13),
+			expected: plugins.ClusterState{Tier: "M40", Maintenance: true, NextMaintenance: wed(10).AddDate(0, 0, 7)},
+		},
+	}
+	for i, test := range tests {
+		if test.setup != nil {
+			api.l.Lock()
+			test.setup()
+			api.l.Unlock()
+		}
+		err := p.poll(context.TODO())
+		if (err != nil) != api.down {
+			t.Fatalf("%d: unexpected poll error: %v", i, err)
+		}
+		p.now = func() time.Time { return test.now }
+		state, ok := p.ClusterState("")
+		if !ok || state != test.expected {
+			t.Fatalf("%d: expected %+v, got %+v", i, test.expected, state)
+		}
+		if _, ok := p.ClusterState("other"); ok {
+			t.Fatalf("%d: expected the state of an unknown cluster to be unknown", i)
+		}
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atlas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, []byte("private"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	base := bson.D{{"groupId", "group"}, {"publicKey", "public"}, {"privateKeyFile", keyFile}}
+	cluster := bson.E{"clusters", bson.A{bson.D{{"atlasName", "Cluster0"}}}}
+
+	tests := []struct {
+		conf bson.D
+		ok   bool
+	}{
+		{conf: append(base[:3:3], cluster), ok: true},
+		{conf: base},
+		{conf: append(base[:3:3], bson.E{"clusters", bson.A{bson.D{{"name", "a"}}}})},
+		{conf: append(base[:3:3], bson.E{"clusters", bson.A{bson.D{{"atlasName", "A"}}, bson.D{{"atlasName", "B"}}}})},
+		{conf: append(base[:3:3], cluster, bson.E{"pollInterval", "0s"})},
+		{conf: bson.D{{"groupId", "group"}, {"publicKey", "public"}, {"privateKeyFile", filepath.Join(dir, "missing")}, cluster}},
+	}
+	for i, test := range tests {
+		pl, _ := plugins.GetPlugin(Name)
+		if err := pl.Configure(test.conf); (err == nil) != test.ok {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package atlas
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// digestTransport authenticates requests with HTTP digest authentication, which
+// the Atlas Admin API uses for programmatic API keys. Requests are sent without
+// credentials first and sent again answering the server's challenge, so only
+// requests without a body (GETs) are supported.
+type digestTransport struct {
+	username, password string
+	transport          http.RoundTripper
+}
+
+func (t *digestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if !strings.HasPrefix(challenge, "Digest ") {
+		return resp, nil
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	authorization, err := t.authorization(req, parseChallenge(strings.TrimPrefix(challenge, "Digest ")))
+	if err != nil {
+		return nil, err
+	}
+	retry := req.Clone(req.Context())
+	retry.Header.Set("Authorization", authorization)
+	return t.transport.RoundTrip(retry)
+}
+
+// parseChallenge returns the parameters of a digest challenge (e.g. realm="atlas",
+// nonce="...", qop="auth")
+func parseChallenge(s string) map[string]string {
+	params := make(map[string]string)
+	for s != "" {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.IndexByte(s, '=')
+		if eq == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = s[eq+1:]
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.IndexByte(s[1:], '"')
+			if end == -1 {
+				break
+			}
+			value, s = s[1:end+1], s[end+2:]
+		} else if comma := strings.IndexByte(s, ','); comma != -1 {
+			value, s = s[:comma], s[comma:]
+		} else {
+			value, s = s, ""
+		}
+		params[key] = strings.TrimSpace(value)
+	}
+	return params
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// authorization returns the Authorization header answering the challenge
+func (t *digestTransport) authorization(req *http.Request, challenge map[string]string) (string, error) {
+	if algorithm := challenge["algorithm"]; algorithm != "" && !strings.EqualFold(algorithm, "MD5") {
+		return "", fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+	uri := req.URL.RequestURI()
+	ha1 := md5Hex(t.username + ":" + challenge["realm"] + ":" + t.password)
+	ha2 := md5Hex(req.Method + ":" + uri)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=MD5`, t.username, challenge["realm"], challenge["nonce"], uri)
+	if qop := challenge["qop"]; qop == "" {
+		fmt.Fprintf(&b, `, response="%s"`, md5Hex(ha1+":"+challenge["nonce"]+":"+ha2))
+	} else {
+		supported := false
+		for _, q := range strings.Split(qop, ",") {
+			supported = supported || strings.TrimSpace(q) == "auth"
+		}
+		if !supported {
+			return "", fmt.Errorf("unsupported digest qop %q", qop)
+		}
+		nonce := make([]byte, 8)
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+		cnonce, nc := hex.EncodeToString(nonce), "00000001"
+		response := md5Hex(ha1 + ":" + challenge["nonce"] + ":" + nc + ":" + cnonce + ":auth:" + ha2)
+		fmt.Fprintf(&b, `, qop=auth, nc=%s, cnonce="%s", response="%s"`, nc, cnonce, response)
+	}
+	if opaque, ok := challenge["opaque"]; ok {
+		fmt.Fprintf(&b, `, opaque="%s"`, opaque)
+	}
+	return b.String(), nil
+}
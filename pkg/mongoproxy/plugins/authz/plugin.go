@@ -170,6 +170,14 @@ func (p *AuthzPlugin) resourcesForCommand(r *plugins.Request, c command.Command)
 			},
 		}
 
+	case *command.CollMod:
+		resourceMap[authzlib.Update] = []authzlib.Resource{
+			{
+				DB:         cmd.GetDatabase(),
+				Collection: cmd.GetCollection(),
+			},
+		}
+
 	case *command.CollStats:
 		resourceMap[authzlib.Read] = []authzlib.Resource{
 			{
@@ -513,6 +521,11 @@ func (p *AuthzPlugin) Process(ctx context.Context, r *plugins.Request, next plug
 		identities = append(identities, plugins.NewStaticIdentity(Name, UNAUTHENTICATED_ROLE, UNAUTHENTICATED_ROLE))
 	}
 
+	// Share the resolved identity with the rest of the pipeline
+	if md := plugins.GetMetadata(ctx); md.Identity() == nil {
+		md.SetIdentity(identities[0])
+	}
+
 	// Expand the identities into roles
 	for _, ident := range identities {
 		for _, r := range ident.Roles() {
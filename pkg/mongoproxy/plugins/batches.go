@@ -0,0 +1,32 @@
+package plugins
+
+// BatchReader is an optional interface a Plugin can implement to declare whether
+// it reads the documents of cursor batches (firstBatch/nextBatch) in responses.
+// Plugins implementing ResponseHook or PostCommitHook are assumed to read them
+// unless they implement BatchReader.
+//
+// If no plugin in the chain reads batches the batches are kept as raw BSON
+// (bson.RawValue) and written to the client without being decoded and
+// re-encoded, and the replies of find and getMore may be streamed to the client
+// as they are read from the backend (see Request.ReplyStream).
+type BatchReader interface {
+	ReadsBatches() bool
+}
+
+// ReadsBatches returns whether any of the plugins read cursor batches
+func ReadsBatches(ps []Plugin) bool {
+	for _, p := range ps {
+		p = Unwrap(p)
+		if br, ok := p.(BatchReader); ok {
+			if br.ReadsBatches() {
+				return true
+			}
+			continue
+		}
+		switch p.(type) {
+		case ResponseHook, PostCommitHook:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package plugins
+
+import "testing"
+
+type batchReaderPlugin struct {
+	hookPlugin
+	reads bool
+}
+
+func (p *batchReaderPlugin) ReadsBatches() bool { return p.reads }
+
+func TestReadsBatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		plugins []Plugin
+		reads   bool
+	}{
+		{"none", nil, false},
+		{"noop", []Plugin{&noopPlugin{}}, false},
+		{"responseHook", []Plugin{&noopPlugin{}, &hookPlugin{}}, true},
+		{"scopedResponseHook", []Plugin{Scoped(&hookPlugin{}, &Scope{Databases: []string{"db"}})}, true},
+		{"optOut", []Plugin{&batchReaderPlugin{reads: false}}, false},
+		{"optIn", []Plugin{&noopPlugin{}, &batchReaderPlugin{reads: true}}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if reads := ReadsBatches(test.plugins); reads != test.reads {
+				t.Fatalf("expected %v, got %v", test.reads, reads)
+			}
+		})
+	}
+}
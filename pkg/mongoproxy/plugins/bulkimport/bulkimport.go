@@ -0,0 +1,443 @@
+package bulkimport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+	"golang.org/x/time/rate"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "bulkimport"
+
+var (
+	rateGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongoproxy_plugins_bulkimport_rate",
+		Help: "The current rate (documents per second) imports are paced to",
+	})
+	replicationLagGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongoproxy_plugins_bulkimport_replication_lag_seconds",
+		Help: "The backend's replication lag (of its most lagged secondary) at the last check",
+	})
+	writeQueueGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongoproxy_plugins_bulkimport_write_queue",
+		Help: "The backend's queued writers at the last check",
+	})
+	documentsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_bulkimport_documents_total",
+		Help: "The total documents inserted by importing clients",
+	}, []string{"app_name"})
+	pacedSecondsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_bulkimport_paced_seconds_total",
+		Help: "The total time inserts of importing clients were delayed to pace them",
+	}, []string{"app_name"})
+	rejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_bulkimport_rejected_total",
+		Help: "The total inserts of importing clients rejected as they would have waited longer than maxWait",
+	}, []string{"app_name"})
+	monitorErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_bulkimport_monitor_errors_total",
+		Help: "The total failures to check the backend's replication lag and write queue",
+	}, []string{"command"})
+)
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &BulkImportPlugin{
+			conf: BulkImportPluginConfig{
+				MinRate:           100,
+				MaxReplicationLag: "10s",
+				MaxWriteQueue:     10,
+				CheckInterval:     "1s",
+				Backoff:           0.5,
+				RampUp:            0.1,
+				MaxWait:           "30s",
+			},
+		}
+	})
+}
+
+type BulkImportPluginConfig struct {
+	// AppNames are the client appNames (from the handshake) of the importing
+	// clients whose inserts are paced
+	AppNames []string `bson:"appNames"`
+	// MaxRate is the documents per second importing clients may insert (across
+	// all of them) while the backend keeps up
+	MaxRate float64 `bson:"maxRate"`
+	// MinRate is the documents per second the pace backs off to at most (default 100)
+	MinRate float64 `bson:"minRate"`
+	// MaxReplicationLag is the replication lag (of the most lagged secondary) above
+	// which the pace backs off (default "10s")
+	MaxReplicationLag string `bson:"maxReplicationLag"`
+	maxReplicationLag time.Duration
+	// MaxWriteQueue is the number of queued writers (serverStatus'
+	// globalLock.currentQueue.writers) above which the pace backs off (default 10)
+	MaxWriteQueue int64 `bson:"maxWriteQueue"`
+	// CheckInterval is how often the backend's replication lag and write queue
+	// are checked (and the pace adjusted) (default "1s")
+	CheckInterval string `bson:"checkInterval"`
+	checkInterval time.Duration
+	// Backoff is the factor the pace is multiplied by when the backend falls behind
+	// (default 0.5)
+	Backoff float64 `bson:"backoff"`
+	// RampUp is the fraction of maxRate the pace increases by each check while the
+	// backend keeps up (default 0.1)
+	RampUp float64 `bson:"rampUp"`
+	// MaxWait is the longest an insert is delayed; inserts which would wait longer
+	// are rejected with a retryable error (default "30s")
+	MaxWait string `bson:"maxWait"`
+	maxWait time.Duration
+}
+
+// backendLoad is the load of the backend at the last check
+type backendLoad struct {
+	replicationLag time.Duration
+	writeQueue     int64
+	checked        time.Time
+}
+
+// This is a plugin that paces the inserts of importing (ETL) clients by the
+// backend's replication lag and write queue so they don't starve other traffic
+type BulkImportPlugin struct {
+	conf     BulkImportPluginConfig
+	appNames map[string]struct{}
+
+	limiter *rate.Limiter
+
+	crLock sync.RWMutex
+	cr     plugins.CommandRunner
+
+	l    sync.Mutex
+	load backendLoad
+	// behind is whether the backend was behind at the last check
+	behind bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (p *BulkImportPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *BulkImportPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	if len(p.conf.AppNames) == 0 {
+		return fmt.Errorf("appNames must be set")
+	}
+	if p.conf.MaxRate <= 0 {
+		return fmt.Errorf("maxRate must be positive: %v", p.conf.MaxRate)
+	}
+	if p.conf.MinRate <= 0 || p.conf.MinRate > p.conf.MaxRate {
+		return fmt.Errorf("minRate must be positive and at most maxRate: %v", p.conf.MinRate)
+	}
+	if p.conf.maxReplicationLag, err = time.ParseDuration(p.conf.MaxReplicationLag); err != nil {
+		return fmt.Errorf("invalid maxReplicationLag: %w", err)
+	}
+	if p.conf.MaxWriteQueue < 0 {
+		return fmt.Errorf("maxWriteQueue must not be negative: %d", p.conf.MaxWriteQueue)
+	}
+	if p.conf.checkInterval, err = time.ParseDuration(p.conf.CheckInterval); err != nil {
+		return fmt.Errorf("invalid checkInterval: %w", err)
+	}
+	if p.conf.checkInterval <= 0 {
+		return fmt.Errorf("checkInterval must be positive: %s", p.conf.CheckInterval)
+	}
+	if p.conf.Backoff <= 0 || p.conf.Backoff >= 1 {
+		return fmt.Errorf("backoff must be between 0 and 1: %v", p.conf.Backoff)
+	}
+	if p.conf.RampUp <= 0 || p.conf.RampUp > 1 {
+		return fmt.Errorf("rampUp must be between 0 and 1: %v", p.conf.RampUp)
+	}
+	if p.conf.maxWait, err = time.ParseDuration(p.conf.MaxWait); err != nil {
+		return fmt.Errorf("invalid maxWait: %w", err)
+	}
+
+	p.appNames = make(map[string]struct{}, len(p.conf.AppNames))
+	for _, appName := range p.conf.AppNames {
+		p.appNames[appName] = struct{}{}
+	}
+	// Imports start at the min rate and ramp up while the backend keeps up
+	p.limiter = rate.NewLimiter(rate.Limit(p.conf.MinRate), burst(p.conf.MinRate))
+	rateGauge.Set(p.conf.MinRate)
+
+	return nil
+}
+
+// SetCommandRunner sets the runner used to check the backend's load
+func (p *BulkImportPlugin) SetCommandRunner(cr plugins.CommandRunner) {
+	p.crLock.Lock()
+	defer p.crLock.Unlock()
+	p.cr = cr
+}
+
+func (p *BulkImportPlugin) commandRunner() plugins.CommandRunner {
+	p.crLock.RLock()
+	defer p.crLock.RUnlock()
+	return p.cr
+}
+
+// Start starts checking the backend's load every checkInterval
+func (p *BulkImportPlugin) Start(ctx context.Context) error {
+	p.stop = make(chan struct{})
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(p.conf.checkInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), p.conf.checkInterval)
+				p.check(ctx)
+				cancel()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops checking the backend's load
+func (p *BulkImportPlugin) Stop(ctx context.Context) error {
+	if p.stop == nil {
+		return nil
+	}
+	close(p.stop)
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// check checks the backend's load and adjusts the pace: it backs off while the
+// backend is behind and ramps up while it keeps up. The pace is left as is if
+// the load can't be checked.
+func (p *BulkImportPlugin) check(ctx context.Context) {
+	cr := p.commandRunner()
+	if cr == nil {
+		return
+	}
+	load, err := checkLoad(ctx, cr)
+	if err != nil {
+		logrus.Debugf("bulkimport: unable to check the backend's load: %v", err)
+		return
+	}
+	replicationLagGauge.Set(load.replicationLag.Seconds())
+	writeQueueGauge.Set(float64(load.writeQueue))
+
+	behind := load.replicationLag > p.conf.maxReplicationLag || load.writeQueue > p.conf.MaxWriteQueue
+	limit := float64(p.limiter.Limit())
+	if behind {
+		limit = math.Max(p.conf.MinRate, limit*p.conf.Backoff)
+	} else {
+		limit = math.Min(p.conf.MaxRate, limit+p.conf.MaxRate*p.conf.RampUp)
+	}
+	p.limiter.SetLimit(rate.Limit(limit))
+	p.limiter.SetBurst(burst(limit))
+	rateGauge.Set(limit)
+
+	p.l.Lock()
+	if behind && !p.behind {
+		logrus.Infof("bulkimport: backend behind (replication lag %s, %d queued writers); pacing imports to %.0f documents/s", load.replicationLag, load.writeQueue, limit)
+	}
+	p.load, p.behind = load, behind
+	p.l.Unlock()
+}
+
+// checkLoad returns the backend's write queue (from serverStatus) and replication
+// lag (from replSetGetStatus; 0 if the backend isn't a replica set)
+func checkLoad(ctx context.Context, cr plugins.CommandRunner) (backendLoad, error) {
+	load := backendLoad{checked: time.Now()}
+
+	status, err := cr.RunCommand(ctx, "admin", bson.D{{"serverStatus", 1}})
+	if err != nil {
+		monitorErrorsTotal.WithLabelValues("serverStatus").Inc()
+		return load, err
+	}
+	if v, ok := bsonutil.Lookup(status, "globalLock", "currentQueue", "writers"); ok {
+		load.writeQueue = toInt64(v)
+	}
+
+	replStatus, err := cr.RunCommand(ctx, "admin", bson.D{{"replSetGetStatus", 1}})
+	var derr driver.Error
+	if errors.As(err, &derr) && derr.Code == int32(mongoerror.NoReplicationEnabled) {
+		// Not a replica set (e.g. a standalone) so there's no lag
+		return load, nil
+	}
+	if err != nil {
+		monitorErrorsTotal.WithLabelValues("replSetGetStatus").Inc()
+		return load, err
+	}
+	load.replicationLag = replicationLag(replStatus)
+	return load, nil
+}
+
+// replicationLag returns how far the most lagged healthy secondary is behind the
+// primary
+func replicationLag(replStatus bson.D) time.Duration {
+	v, _ := bsonutil.Lookup(replStatus, "members")
+	members, _ := v.(bson.A)
+
+	var primary primitive.DateTime
+	var secondaries []primitive.DateTime
+	for _, m := range members {
+		member, ok := m.(bson.D)
+		if !ok {
+			continue
+		}
+		if health, ok := bsonutil.Lookup(member, "health"); ok && !bsonutil.BoolNumber(health) {
+			continue
+		}
+		state, _ := bsonutil.Lookup(member, "stateStr")
+		optime, _ := bsonutil.Lookup(member, "optimeDate")
+		optimeDate, ok := optime.(primitive.DateTime)
+		if !ok {
+			continue
+		}
+		switch state {
+		case "PRIMARY":
+			primary = optimeDate
+		case "SECONDARY":
+			secondaries = append(secondaries, optimeDate)
+		}
+	}
+	if primary == 0 {
+		return 0
+	}
+
+	var lag time.Duration
+	for _, s := range secondaries {
+		if d := primary.Time().Sub(s.Time()); d > lag {
+			lag = d
+		}
+	}
+	return lag
+}
+
+// burst returns the burst of the pace: a second's worth of documents
+func burst(limit float64) int {
+	return int(math.Ceil(limit))
+}
+
+func toInt64(v interface{}) int64 {
+	switch v := v.(type) {
+	case int32:
+		return int64(v)
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *BulkImportPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	if r.CC == nil {
+		return next(ctx, r)
+	}
+	appName := r.CC.AppName
+	if _, ok := p.appNames[appName]; !ok {
+		return next(ctx, r)
+	}
+	cmd, ok := r.Command.(*command.Insert)
+	if !ok || cmd.DocumentCount() == 0 {
+		return next(ctx, r)
+	}
+
+	delay, ok := p.reserve(cmd.DocumentCount())
+	if !ok {
+		rejectedTotal.WithLabelValues(appName).Inc()
+		return append(mongoerror.ExceededTimeLimit.ErrMessage("import paced as the backend is behind; retry later"),
+			bson.E{"errorLabels", bson.A{"RetryableWriteError"}}), nil
+	}
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+		pacedSecondsTotal.WithLabelValues(appName).Add(delay.Seconds())
+	}
+	documentsTotal.WithLabelValues(appName).Add(float64(cmd.DocumentCount()))
+
+	return next(ctx, r)
+}
+
+// reserve reserves the pace for the documents, returning how long to wait before
+// inserting them, or false if that's longer than maxWait. Batches larger than the
+// limiter's burst are reserved in burst sized chunks.
+func (p *BulkImportPlugin) reserve(documents int) (time.Duration, bool) {
+	now := time.Now()
+	burst := p.limiter.Burst()
+	var (
+		reservations []*rate.Reservation
+		delay        time.Duration
+	)
+	for documents > 0 {
+		n := documents
+		if n > burst {
+			n = burst
+		}
+		documents -= n
+		res := p.limiter.ReserveN(now, n)
+		reservations = append(reservations, res)
+		delay = res.DelayFrom(now)
+		if !res.OK() || delay > p.conf.maxWait {
+			for i := len(reservations) - 1; i >= 0; i-- {
+				reservations[i].CancelAt(now)
+			}
+			return 0, false
+		}
+	}
+	return delay, true
+}
+
+// Stats returns the current pace and the backend's load at the last check
+func (p *BulkImportPlugin) Stats() bson.D {
+	p.l.Lock()
+	defer p.l.Unlock()
+	return bson.D{
+		{"rate", float64(p.limiter.Limit())},
+		{"behind", p.behind},
+		{"replicationLagSeconds", p.load.replicationLag.Seconds()},
+		{"writeQueue", p.load.writeQueue},
+		{"checked", p.load.checked},
+	}
+}
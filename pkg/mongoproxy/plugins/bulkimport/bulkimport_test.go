@@ -0,0 +1,149 @@
+package bulkimport
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+// fakeBackend answers serverStatus and replSetGetStatus with the given load
+type fakeBackend struct {
+	lag     time.Duration
+	writers int32
+	// standalone backends aren't replica sets
+	standalone bool
+}
+
+func (b *fakeBackend) RunCommand(ctx context.Context, db string, cmd bson.D) (bson.D, error) {
+	switch cmd[0].Key {
+	case "serverStatus":
+		return bson.D{{"ok", 1}, {"globalLock", bson.D{{"currentQueue", bson.D{{"readers", int32(0)}, {"writers", b.writers}}}}}}, nil
+	case "replSetGetStatus":
+		if b.standalone {
+			return nil, driver.Error{Code: int32(mongoerror.NoReplicationEnabled), Message: "not running with --replSet"}
+		}
+		now := time.Now()
+		return bson.D{{"ok", 1}, {"members", bson.A{
+			bson.D{{"stateStr", "PRIMARY"}, {"health", 1.0}, {"optimeDate", primitive.NewDateTimeFromTime(now)}},
+			bson.D{{"stateStr", "SECONDARY"}, {"health", 1.0}, {"optimeDate", primitive.NewDateTimeFromTime(now.Add(-b.lag))}},
+			// Unhealthy members aren't lagging, they're down
+			bson.D{{"stateStr", "SECONDARY"}, {"health", 0.0}, {"optimeDate", primitive.NewDateTimeFromTime(now.Add(-time.Hour))}},
+		}}}, nil
+	}
+	return bson.D{{"ok", 0}}, nil
+}
+
+func newPlugin(t *testing.T, cfg bson.D) *BulkImportPlugin {
+	plugin, _ := plugins.GetPlugin(Name)
+	p := plugin.(*BulkImportPlugin)
+	if err := p.Configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPace(t *testing.T) {
+	p := newPlugin(t, bson.D{
+		{"appNames", bson.A{"etl"}},
+		{"maxRate", 1000.0},
+		{"minRate", 100.0},
+		{"maxReplicationLag", "5s"},
+		{"maxWriteQueue", int64(10)},
+		{"rampUp", 0.5},
+	})
+	backend := &fakeBackend{}
+	p.SetCommandRunner(backend)
+
+	tests := []struct {
+		lag        time.Duration
+		writers    int32
+		standalone bool
+		rate       float64
+		behind     bool
+	}{
+		// Ramps up while the backend keeps up, to maxRate
+		{rate: 600},
+		{rate: 1000},
+		{rate: 1000},
+		// Backs off while the backend is behind, to minRate
+		{lag: 10 * time.Second, rate: 500, behind: true},
+		{writers: 20, rate: 250, behind: true},
+		{lag: time.Minute, writers: 20, rate: 125, behind: true},
+		{lag: time.Minute, rate: 100, behind: true},
+		// Standalones have no lag
+		{standalone: true, rate: 600},
+	}
+	for i, test := range tests {
+		backend.lag, backend.writers, backend.standalone = test.lag, test.writers, test.standalone
+		p.check(context.Background())
+		if rate := float64(p.limiter.Limit()); rate != test.rate || p.behind != test.behind {
+			t.Fatalf("%d: expected rate %v (behind %v), got %v (behind %v)", i, test.rate, test.behind, rate, p.behind)
+		}
+	}
+}
+
+func TestProcess(t *testing.T) {
+	p := newPlugin(t, bson.D{
+		{"appNames", bson.A{"etl"}},
+		{"maxRate", 1000.0},
+		{"minRate", 10.0},
+		{"maxWait", "200ms"},
+	})
+
+	next := func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+		return bson.D{{"ok", 1}}, nil
+	}
+	insert := func(appName string, documents int) (bson.D, time.Duration) {
+		cmd := &command.Insert{Collection: "c", Documents: make([]bson.D, documents)}
+		r := &plugins.Request{CC: &plugins.ClientConnection{AppName: appName}}
+		r.SetCommand("insert", cmd, nil)
+		start := time.Now()
+		result, err := p.Process(context.Background(), r, next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result, time.Since(start)
+	}
+
+	// The burst (a second at 10 documents/s) isn't paced
+	if result, took := insert("etl", 10); !bsonutil.Ok(result) || took > 50*time.Millisecond {
+		t.Fatalf("unexpected result %v after %s", result, took)
+	}
+	// The next document waits for its share
+	if result, took := insert("etl", 1); !bsonutil.Ok(result) || took < 50*time.Millisecond {
+		t.Fatalf("expected the insert to be paced: %v after %s", result, took)
+	}
+	// Batches which would wait longer than maxWait are rejected (over several bursts)
+	if result, _ := insert("etl", 25); bsonutil.Ok(result) {
+		t.Fatalf("expected the insert to be rejected: %v", result)
+	}
+	// Other clients aren't paced
+	if result, took := insert("web", 1000); !bsonutil.Ok(result) || took > 50*time.Millisecond {
+		t.Fatalf("unexpected result %v after %s", result, took)
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	tests := []bson.D{
+		{{"maxRate", 100.0}},
+		{{"appNames", bson.A{"etl"}}},
+		{{"appNames", bson.A{"etl"}}, {"maxRate", 100.0}, {"minRate", 200.0}},
+		{{"appNames", bson.A{"etl"}}, {"maxRate", 100.0}, {"backoff", 1.0}},
+		{{"appNames", bson.A{"etl"}}, {"maxRate", 100.0}, {"checkInterval", "0s"}},
+	}
+	for i, cfg := range tests {
+		p, _ := plugins.GetPlugin(Name)
+		if err := p.Configure(cfg); err == nil {
+			t.Fatalf("%d: expected an error", i)
+		}
+	}
+}
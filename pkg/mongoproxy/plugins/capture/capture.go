@@ -0,0 +1,525 @@
+package capture
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "capture"
+
+var (
+	capturedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_capture_requests_total",
+		Help: "The total requests captured",
+	})
+	activeGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongoproxy_plugins_capture_active",
+		Help: "The number of running captures",
+	})
+)
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &CapturePlugin{
+			conf: CapturePluginConfig{
+				Dir:         os.TempDir(),
+				MaxDuration: "10m",
+				MaxRequests: 10000,
+				MaxActive:   4,
+				MaxTaps:     4,
+			},
+			captures: make(map[int64]*Capture),
+		}
+	})
+}
+
+type CapturePluginConfig struct {
+	// Dir is the directory capture files are written to (default the temp dir)
+	Dir string `bson:"dir"`
+	// RedactFields are the fields whose values are replaced in captured requests and
+	// responses; either a field name (matched at any depth) or a dotted path
+	RedactFields []string `bson:"redactFields"`
+	// MaxDuration is the longest a capture can run (default "10m")
+	MaxDuration string `bson:"maxDuration"`
+	// MaxRequests is the most requests a capture can record (default 10000)
+	MaxRequests int `bson:"maxRequests"`
+	// MaxActive is the most captures running at once (default 4)
+	MaxActive int `bson:"maxActive"`
+	// MaxTaps is the most live taps streaming at once (default 4)
+	MaxTaps int `bson:"maxTaps"`
+	// TapValues allows taps to stream the values of requests (redacted); taps
+	// only stream the shape of requests otherwise
+	TapValues bool `bson:"tapValues"`
+
+	maxDuration time.Duration
+}
+
+// Filter selects the requests a capture records; empty fields match all requests
+type Filter struct {
+	// Scope selects the namespaces and commands
+	Scope *plugins.Scope `json:"scope,omitempty"`
+	// Fingerprint is the fingerprint of the command (see Fingerprint)
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Client is the client's address (with or without port), appName or user
+	Client string `json:"client,omitempty"`
+}
+
+// Capture records the requests (and responses) matching its filter to a file
+type Capture struct {
+	ID     int64  `json:"id"`
+	Filter Filter `json:"filter"`
+	// Duration and Requests limit the capture
+	Duration string `json:"duration"`
+	Requests int    `json:"requests"`
+
+	File     string     `json:"file"`
+	Started  time.Time  `json:"started"`
+	Stopped  *time.Time `json:"stopped,omitempty"`
+	Captured int        `json:"captured"`
+	Error    string     `json:"error,omitempty"`
+
+	lock  sync.Mutex
+	f     *os.File
+	enc   *json.Encoder
+	timer *time.Timer
+}
+
+// Record is a captured request
+type Record struct {
+	Time        time.Time       `json:"time"`
+	Duration    string          `json:"duration"`
+	Client      string          `json:"client,omitempty"`
+	AppName     string          `json:"appName,omitempty"`
+	User        string          `json:"user,omitempty"`
+	Database    string          `json:"db"`
+	Collection  string          `json:"collection,omitempty"`
+	CommandName string          `json:"command"`
+	Fingerprint string          `json:"fingerprint"`
+	Request     json.RawMessage `json:"request"`
+	Response    json.RawMessage `json:"response,omitempty"`
+	Error       string          `json:"error,omitempty"`
+}
+
+// This is a plugin that records requests and responses matching a filter to a file
+// on demand (through the admin API), for debugging
+type CapturePlugin struct {
+	conf     CapturePluginConfig
+	redactor redactor
+
+	lock     sync.RWMutex
+	nextID   int64
+	captures map[int64]*Capture
+	// active are the running captures
+	active []*Capture
+	// taps are the live streams of requests
+	taps []*tap
+}
+
+func (p *CapturePlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *CapturePlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	if p.conf.maxDuration, err = time.ParseDuration(p.conf.MaxDuration); err != nil {
+		return err
+	}
+	if p.conf.maxDuration <= 0 {
+		return fmt.Errorf("maxDuration must be positive: %s", p.conf.MaxDuration)
+	}
+	if p.conf.MaxRequests <= 0 {
+		return fmt.Errorf("maxRequests must be positive: %d", p.conf.MaxRequests)
+	}
+	if p.conf.MaxActive <= 0 {
+		return fmt.Errorf("maxActive must be positive: %d", p.conf.MaxActive)
+	}
+	if p.conf.MaxTaps <= 0 {
+		return fmt.Errorf("maxTaps must be positive: %d", p.conf.MaxTaps)
+	}
+	if info, err := os.Stat(p.conf.Dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("dir %s is not a directory", p.conf.Dir)
+	}
+	p.redactor = newRedactor(p.conf.RedactFields)
+
+	return nil
+}
+
+// ReadsBatches returns false as captured responses are decoded when recorded
+func (p *CapturePlugin) ReadsBatches() bool { return false }
+
+// StartCapture starts a capture with the filter for the duration (or the max duration)
+// or number of requests (or the max requests)
+func (p *CapturePlugin) StartCapture(filter Filter, duration time.Duration, requests int) (*Capture, error) {
+	if duration <= 0 || duration > p.conf.maxDuration {
+		duration = p.conf.maxDuration
+	}
+	if requests <= 0 || requests > p.conf.MaxRequests {
+		requests = p.conf.MaxRequests
+	}
+	if filter.Scope != nil {
+		filter.Scope.Compile()
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.active) >= p.conf.MaxActive {
+		return nil, fmt.Errorf("%d captures are already running", len(p.active))
+	}
+
+	p.nextID++
+	c := &Capture{
+		ID:       p.nextID,
+		Filter:   filter,
+		Duration: duration.String(),
+		Requests: requests,
+		Started:  time.Now(),
+	}
+	c.File = filepath.Join(p.conf.Dir, fmt.Sprintf("mongoproxy-capture-%d-%s.jsonl", c.ID, c.Started.Format("20060102T150405")))
+	f, err := os.OpenFile(c.File, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	c.f = f
+	c.enc = json.NewEncoder(f)
+	c.timer = time.AfterFunc(duration, func() { p.StopCapture(c.ID) })
+
+	p.captures[c.ID] = c
+	p.active = append(p.active, c)
+	activeGauge.Inc()
+	logrus.Infof("Capture %d started: file=%s duration=%s requests=%d", c.ID, c.File, c.Duration, c.Requests)
+	return c.copy(), nil
+}
+
+// StopCapture stops the capture (if running)
+func (p *CapturePlugin) StopCapture(id int64) (*Capture, error) {
+	p.lock.Lock()
+	c, ok := p.captures[id]
+	if !ok {
+		p.lock.Unlock()
+		return nil, fmt.Errorf("no capture %d", id)
+	}
+	for i, a := range p.active {
+		if a == c {
+			p.active = append(p.active[:i:i], p.active[i+1:]...)
+			activeGauge.Dec()
+			break
+		}
+	}
+	p.lock.Unlock()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.close(nil)
+	return c.copyLocked(), nil
+}
+
+// Stop stops the running captures and taps
+func (p *CapturePlugin) Stop(ctx context.Context) error {
+	p.lock.RLock()
+	active := append([]*Capture(nil), p.active...)
+	taps := append([]*tap(nil), p.taps...)
+	p.lock.RUnlock()
+	for _, c := range active {
+		p.StopCapture(c.ID)
+	}
+	for _, t := range taps {
+		t.cancel()
+	}
+	return nil
+}
+
+// Captures returns the captures (by ID)
+func (p *CapturePlugin) Captures() []*Capture {
+	p.lock.RLock()
+	captures := make([]*Capture, 0, len(p.captures))
+	for _, c := range p.captures {
+		captures = append(captures, c.copy())
+	}
+	p.lock.RUnlock()
+	sort.Slice(captures, func(i, j int) bool { return captures[i].ID < captures[j].ID })
+	return captures
+}
+
+// close closes the capture's file; c.lock must be held
+func (c *Capture) close(err error) {
+	if c.Stopped != nil {
+		return
+	}
+	now := time.Now()
+	c.Stopped = &now
+	c.timer.Stop()
+	if closeErr := c.f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	logrus.Infof("Capture %d stopped: captured=%d", c.ID, c.Captured)
+}
+
+func (c *Capture) copy() *Capture {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.copyLocked()
+}
+
+func (c *Capture) copyLocked() *Capture {
+	return &Capture{
+		ID:       c.ID,
+		Filter:   c.Filter,
+		Duration: c.Duration,
+		Requests: c.Requests,
+		File:     c.File,
+		Started:  c.Started,
+		Stopped:  c.Stopped,
+		Captured: c.Captured,
+		Error:    c.Error,
+	}
+}
+
+// write writes the record; returns whether the capture is done
+func (c *Capture) write(rec *Record) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.Stopped != nil {
+		return false
+	}
+	if err := c.enc.Encode(rec); err != nil {
+		c.close(err)
+		return true
+	}
+	c.Captured++
+	capturedTotal.Inc()
+	return c.Captured >= c.Requests
+}
+
+// client is the client of a request
+type client struct {
+	addr, host, appName, user string
+}
+
+func (f *Filter) match(r *plugins.Request, cl *client, fingerprint func() string) bool {
+	if f.Scope != nil && !f.Scope.Match(r) {
+		return false
+	}
+	if f.Client != "" && f.Client != cl.addr && f.Client != cl.host && f.Client != cl.appName && f.Client != cl.user {
+		return false
+	}
+	return f.Fingerprint == "" || f.Fingerprint == fingerprint()
+}
+
+// extJSON returns the (redacted) document as relaxed extended JSON
+func (p *CapturePlugin) extJSON(v interface{}) (bson.D, json.RawMessage) {
+	b, err := bson.Marshal(v)
+	if err != nil {
+		return nil, nil
+	}
+	var d bson.D
+	if err := bson.Unmarshal(b, &d); err != nil {
+		return nil, nil
+	}
+	js, err := bson.MarshalExtJSON(p.redactor.redact(d, ""), false, false)
+	if err != nil {
+		return d, nil
+	}
+	return d, js
+}
+
+// AdminHandler returns the handler for the capture admin endpoints:
+//
+//	GET captures                  the captures
+//	POST captures                 start a capture; the body is {"filter": {...}, "duration": "30s", "requests": 100}
+//	POST captures/{id}/stop       stop the capture
+//	GET captures/{id}/file        download the capture's records
+//	GET tap                       stream a sample of the requests live (see ServeTap)
+func (p *CapturePlugin) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tap", p.ServeTap)
+	mux.HandleFunc("/captures", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(p.Captures())
+		case http.MethodPost:
+			var req struct {
+				Filter   Filter `json:"filter"`
+				Duration string `json:"duration"`
+				Requests int    `json:"requests"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var duration time.Duration
+			if req.Duration != "" {
+				var err error
+				if duration, err = time.ParseDuration(req.Duration); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			c, err := p.StartCapture(req.Filter, duration, req.Requests)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(c)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/captures/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/captures/"), "/")
+		if len(parts) != 2 {
+			http.NotFound(w, r)
+			return
+		}
+		id, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case parts[1] == "stop" && r.Method == http.MethodPost:
+			c, err := p.StopCapture(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(c)
+		case parts[1] == "file" && r.Method == http.MethodGet:
+			p.lock.RLock()
+			c, ok := p.captures[id]
+			p.lock.RUnlock()
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			http.ServeFile(w, r, c.File)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	return mux
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *CapturePlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	p.lock.RLock()
+	if len(p.active) == 0 && len(p.taps) == 0 {
+		p.lock.RUnlock()
+		return next(ctx, r)
+	}
+	active := append([]*Capture(nil), p.active...)
+	taps := append([]*tap(nil), p.taps...)
+	p.lock.RUnlock()
+
+	cl := &client{}
+	if r.CC != nil {
+		cl.addr, cl.appName = r.CC.GetAddr(), r.CC.AppName
+		cl.host, _, _ = net.SplitHostPort(cl.addr)
+	}
+	if identity := plugins.GetMetadata(ctx).Identity(); identity != nil {
+		cl.user = identity.User()
+	}
+
+	var (
+		cmd         bson.D
+		request     json.RawMessage
+		fingerprint string
+		encoded     bool
+	)
+	// The command is only encoded when a capture's filter needs it
+	encode := func() {
+		if !encoded {
+			encoded = true
+			cmd, request = p.extJSON(r.Command)
+			fingerprint = Fingerprint(cmd)
+		}
+	}
+	var matched []*Capture
+	for _, c := range active {
+		if c.Filter.match(r, cl, func() string { encode(); return fingerprint }) {
+			matched = append(matched, c)
+		}
+	}
+	var tapped []*tap
+	for _, t := range taps {
+		if t.sampled() && t.filter.match(r, cl, func() string { encode(); return fingerprint }) {
+			tapped = append(tapped, t)
+		}
+	}
+	if len(matched) == 0 && len(tapped) == 0 {
+		return next(ctx, r)
+	}
+	// The database is cleared from the command by the mongo plugin; so we grab it first
+	encode()
+	rec := &Record{
+		Client:      cl.addr,
+		AppName:     cl.appName,
+		User:        cl.user,
+		Database:    command.GetCommandDatabase(r.Command),
+		Collection:  command.GetCommandCollection(r.Command),
+		CommandName: r.CommandName,
+		Fingerprint: fingerprint,
+		Request:     request,
+	}
+
+	rec.Time = time.Now()
+	result, err := next(ctx, r)
+	took := time.Since(rec.Time)
+	rec.Duration = took.String()
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if len(tapped) > 0 {
+		publishTap(tapped, rec, cmd, took, result)
+	}
+	if len(matched) == 0 {
+		return result, err
+	}
+	if result != nil {
+		_, rec.Response = p.extJSON(result)
+	}
+
+	for _, c := range matched {
+		if c.write(rec) {
+			p.StopCapture(c.ID)
+		}
+	}
+	return result, err
+}
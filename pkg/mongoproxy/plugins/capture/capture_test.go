@@ -0,0 +1,226 @@
+package capture
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func TestFingerprint(t *testing.T) {
+	tests := []struct {
+		a, b bson.D
+		same bool
+	}{
+		{
+			bson.D{{"find", "coll"}, {"filter", bson.D{{"a", 1}}}, {"$db", "db"}},
+			bson.D{{"find", "coll"}, {"filter", bson.D{{"a", "x"}}}, {"$db", "db"}, {"lsid", bson.D{{"id", 1}}}},
+			true,
+		},
+		{
+			bson.D{{"find", "coll"}, {"filter", bson.D{{"a", bson.D{{"$in", bson.A{1, 2, 3}}}}}}},
+			bson.D{{"find", "coll"}, {"filter", bson.D{{"a", bson.D{{"$in", bson.A{4}}}}}}},
+			true,
+		},
+		{
+			bson.D{{"find", "coll"}, {"filter", bson.D{{"a", 1}}}},
+			bson.D{{"find", "coll"}, {"filter", bson.D{{"b", 1}}}},
+			false,
+		},
+		{
+			bson.D{{"find", "coll"}, {"filter", bson.D{{"a", 1}}}},
+			bson.D{{"find", "other"}, {"filter", bson.D{{"a", 1}}}},
+			false,
+		},
+	}
+
+	for i, test := range tests {
+		if same := Fingerprint(test.a) == Fingerprint(test.b); same != test.same {
+			t.Fatalf("%d: expected same=%v for %v and %v", i, test.same, test.a, test.b)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	r := newRedactor([]string{"password", "user.email"})
+	d := r.redact(bson.D{
+		{"password", "secret"},
+		{"user", bson.D{{"email", "a@b.c"}, {"name", "a"}}},
+		{"items", bson.A{bson.D{{"password", "secret"}}}},
+		{"email", "kept"},
+	}, "")
+	expected := bson.D{
+		{"password", redacted},
+		{"user", bson.D{{"email", redacted}, {"name", "a"}}},
+		{"items", bson.A{bson.D{{"password", redacted}}}},
+		{"email", "kept"},
+	}
+	b1, _ := bson.MarshalExtJSON(d, false, false)
+	b2, _ := bson.MarshalExtJSON(expected, false, false)
+	if string(b1) != string(b2) {
+		t.Fatalf("mismatch\nexpected=%s\nactual=%s", b2, b1)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	pl, _ := plugins.GetPlugin(Name)
+	d := pl.(*CapturePlugin)
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := d.Configure(bson.D{{"dir", dir}, {"redactFields", bson.A{"password"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	p := plugins.BuildPipeline([]plugins.Plugin{d}, func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+		return bson.D{{"n", 1}, {"ok", 1}}, nil
+	})
+	run := func(coll, appName string) {
+		cmd := &command.Insert{}
+		if err := cmd.FromBSOND(bson.D{{"insert", coll}, {"documents", bson.A{bson.D{{"_id", 1}, {"password", "secret"}}}}, {"$db", "db"}}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p(context.TODO(), &plugins.Request{CommandName: "insert", Command: cmd, CC: &plugins.ClientConnection{AppName: appName}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing is captured without a capture running
+	run("coll", "app")
+
+	c, err := d.StartCapture(Filter{Scope: &plugins.Scope{Collections: []string{"db.coll"}}, Client: "app"}, time.Minute, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run("other", "app")
+	run("coll", "other")
+	run("coll", "app")
+	run("coll", "app")
+	// The capture stopped after 2 requests
+	run("coll", "app")
+
+	captures := d.Captures()
+	if len(captures) != 1 || captures[0].Captured != 2 || captures[0].Stopped == nil {
+		t.Fatalf("unexpected captures: %+v", captures)
+	}
+
+	f, err := os.Open(c.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	rec := records[0]
+	if rec.Database != "db" || rec.Collection != "coll" || rec.AppName != "app" || rec.Fingerprint == "" {
+		t.Fatalf("unexpected record: %+v", rec)
+	}
+	if strings.Contains(string(rec.Request), "secret") || !strings.Contains(string(rec.Request), redacted) {
+		t.Fatalf("request not redacted: %s", rec.Request)
+	}
+	if !strings.Contains(string(rec.Response), `"ok"`) {
+		t.Fatalf("unexpected response: %s", rec.Response)
+	}
+
+	// Captures can be filtered by the fingerprint of the records
+	c, err = d.StartCapture(Filter{Fingerprint: rec.Fingerprint}, time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run("other", "app")
+	run("coll", "other")
+	if c, _ = d.StopCapture(c.ID); c.Captured != 1 {
+		t.Fatalf("expected 1 captured request, got %d", c.Captured)
+	}
+}
+
+func TestTap(t *testing.T) {
+	pl, _ := plugins.GetPlugin(Name)
+	d := pl.(*CapturePlugin)
+	if err := d.Configure(bson.D{{"redactFields", bson.A{"password"}}}); err != nil {
+		t.Fatal(err)
+	}
+	p := plugins.BuildPipeline([]plugins.Plugin{d}, func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+		return bson.D{{"n", 1}, {"ok", 1}}, nil
+	})
+	run := func(coll string) {
+		cmd := &command.Insert{}
+		if err := cmd.FromBSOND(bson.D{{"insert", coll}, {"documents", bson.A{bson.D{{"_id", 1}, {"password", "secret"}}}}, {"$db", "db"}}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p(context.TODO(), &plugins.Request{CommandName: "insert", Command: cmd}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := httptest.NewServer(d.AdminHandler())
+	defer srv.Close()
+
+	// Values are only streamed if allowed
+	resp, err := http.Get(srv.URL + "/tap?values=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(srv.URL + "/tap?collections=db.coll&duration=10s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	for i := 0; ; i++ {
+		d.lock.RLock()
+		n := len(d.taps)
+		d.lock.RUnlock()
+		if n == 1 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("expected the tap to start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	run("other")
+	run("coll")
+
+	scanner := bufio.NewScanner(resp.Body)
+	if !scanner.Scan() {
+		t.Fatalf("expected a record: %v", scanner.Err())
+	}
+	var rec plugins.TapRecord
+	if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Database != "db" || rec.Collection != "coll" || !rec.OK || rec.Docs != 1 || rec.Duration == "" {
+		t.Fatalf("unexpected record: %+v", rec)
+	}
+	if strings.Contains(string(rec.Request), "secret") || strings.Contains(string(rec.Request), "$db") || !strings.Contains(string(rec.Request), `"?"`) {
+		t.Fatalf("expected the shape of the request: %s", rec.Request)
+	}
+}
@@ -0,0 +1,137 @@
+package capture
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ignoredKeys are the command fields left out of fingerprints as they don't change
+// what the command does
+var ignoredKeys = map[string]struct{}{
+	"$db":              {},
+	"$clusterTime":     {},
+	"$readPreference":  {},
+	"lsid":             {},
+	"txnNumber":        {},
+	"autocommit":       {},
+	"startTransaction": {},
+	"comment":          {},
+	"maxTimeMS":        {},
+	"readConcern":      {},
+	"writeConcern":     {},
+}
+
+// Fingerprint returns the fingerprint of a command: a hash of its shape (the
+// command, collection and the fields it has, ignoring their values), so that the
+// same query with different values has the same fingerprint
+func Fingerprint(cmd bson.D) string {
+	if len(cmd) == 0 {
+		return ""
+	}
+	b, err := bson.MarshalExtJSON(commandShape(cmd), true, false)
+	if err != nil {
+		return ""
+	}
+	sum := sha1.Sum(b)
+	return hex.EncodeToString(sum[:8])
+}
+
+// commandShape returns the command and its collection with the shape of the
+// other fields (but the ignoredKeys)
+func commandShape(cmd bson.D) bson.D {
+	// The first element is the command and its collection
+	s := bson.D{cmd[0]}
+	for _, e := range cmd[1:] {
+		if _, ok := ignoredKeys[e.Key]; ok {
+			continue
+		}
+		s = append(s, bson.E{e.Key, shape(e.Value)})
+	}
+	return s
+}
+
+// shape returns the value with leaf values replaced by a placeholder; arrays are
+// reduced to their distinct element shapes
+func shape(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.D:
+		d := make(bson.D, len(v))
+		for i, e := range v {
+			d[i] = bson.E{e.Key, shape(e.Value)}
+		}
+		return d
+	case primitive.A:
+		var (
+			a    primitive.A
+			seen = make(map[string]struct{})
+		)
+		for _, item := range v {
+			s := shape(item)
+			b, _ := bson.MarshalExtJSON(bson.D{{"v", s}}, true, false)
+			if _, ok := seen[string(b)]; ok {
+				continue
+			}
+			seen[string(b)] = struct{}{}
+			a = append(a, s)
+		}
+		return a
+	default:
+		return "?"
+	}
+}
+
+// redactor replaces the values of fields, matched by name at any depth or by
+// their dotted path (ignoring array indexes)
+type redactor map[string]struct{}
+
+// redacted is the value of redacted fields
+const redacted = "REDACTED"
+
+func (r redactor) redact(d bson.D, prefix string) bson.D {
+	if len(r) == 0 {
+		return d
+	}
+	out := make(bson.D, len(d))
+	for i, e := range d {
+		path := e.Key
+		if prefix != "" {
+			path = prefix + "." + e.Key
+		}
+		_, byName := r[e.Key]
+		_, byPath := r[path]
+		if byName || byPath {
+			out[i] = bson.E{e.Key, redacted}
+			continue
+		}
+		out[i] = bson.E{e.Key, r.redactValue(e.Value, path)}
+	}
+	return out
+}
+
+func (r redactor) redactValue(v interface{}, path string) interface{} {
+	switch v := v.(type) {
+	case bson.D:
+		return r.redact(v, path)
+	case primitive.A:
+		a := make(primitive.A, len(v))
+		for i, item := range v {
+			a[i] = r.redactValue(item, path)
+		}
+		return a
+	default:
+		return v
+	}
+}
+
+// newRedactor returns the redactor of the fields
+func newRedactor(fields []string) redactor {
+	r := make(redactor, len(fields))
+	for _, f := range fields {
+		r[strings.TrimSpace(f)] = struct{}{}
+	}
+	return r
+}
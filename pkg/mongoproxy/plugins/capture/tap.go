@@ -0,0 +1,249 @@
+package capture
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+var (
+	tapsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongoproxy_plugins_capture_taps",
+		Help: "The number of live taps streaming requests",
+	})
+	tapDroppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_capture_tap_dropped_total",
+		Help: "The total requests not streamed to a tap as it was too slow",
+	})
+)
+
+// tap streams a sample of the requests matching its filter
+type tap struct {
+	filter Filter
+	// sample is the fraction of the matching requests streamed
+	sample float64
+	values bool
+	ch     chan *plugins.TapRecord
+	ctx    context.Context
+	cancel context.CancelFunc
+	plugin *CapturePlugin
+}
+
+func (t *tap) Records() <-chan *plugins.TapRecord { return t.ch }
+
+func (t *tap) Done() <-chan struct{} { return t.ctx.Done() }
+
+func (t *tap) Close() { t.plugin.stopTap(t) }
+
+func (t *tap) sampled() bool {
+	return t.sample >= 1 || rand.Float64() < t.sample
+}
+
+// publishTap sends the request to the taps, dropping it for the taps which
+// aren't keeping up
+func publishTap(taps []*tap, rec *Record, cmd bson.D, took time.Duration, result bson.D) {
+	tr := &plugins.TapRecord{
+		Time:        rec.Time,
+		Duration:    rec.Duration,
+		DurationMS:  float64(took) / float64(time.Millisecond),
+		Client:      rec.Client,
+		AppName:     rec.AppName,
+		User:        rec.User,
+		Database:    rec.Database,
+		Collection:  rec.Collection,
+		CommandName: rec.CommandName,
+		Fingerprint: rec.Fingerprint,
+		OK:          rec.Error == "" && bsonutil.Ok(result),
+		Docs:        responseDocs(result),
+		Error:       rec.Error,
+	}
+	if codeName, ok := bsonutil.Lookup(result, "codeName"); ok {
+		tr.CodeName, _ = codeName.(string)
+	}
+
+	var shaped json.RawMessage
+	for _, t := range taps {
+		tr := *tr
+		if t.values {
+			tr.Request = rec.Request
+		} else {
+			if shaped == nil && len(cmd) > 0 {
+				shaped, _ = bson.MarshalExtJSON(commandShape(cmd), false, false)
+			}
+			tr.Request = shaped
+		}
+		select {
+		case t.ch <- &tr:
+		default:
+			tapDroppedTotal.Inc()
+		}
+	}
+}
+
+// responseDocs returns the documents returned (in the first batch) or written
+// (n) by the response
+func responseDocs(resp bson.D) int {
+	for _, key := range []string{"firstBatch", "nextBatch"} {
+		if batch, ok := bsonutil.Lookup(resp, "cursor", key); ok {
+			if a, ok := batch.(bson.A); ok {
+				return len(a)
+			}
+		}
+	}
+	switch n, _ := bsonutil.Lookup(resp, "n"); n := n.(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case int:
+		return n
+	case float64:
+		return int(n)
+	}
+	return 0
+}
+
+// StartTap adds a tap streaming until the context is done (or the duration,
+// capped by maxDuration, passed)
+func (p *CapturePlugin) StartTap(ctx context.Context, opts plugins.TapOptions) (plugins.Tap, error) {
+	if opts.Values && !p.conf.TapValues {
+		return nil, fmt.Errorf("tapValues is disabled")
+	}
+	if opts.Sample < 0 || opts.Sample > 1 {
+		return nil, fmt.Errorf("sample must be in (0, 1]: %v", opts.Sample)
+	}
+	sample := opts.Sample
+	if sample == 0 {
+		sample = 1
+	}
+	duration := opts.Duration
+	if duration <= 0 || duration > p.conf.maxDuration {
+		duration = p.conf.maxDuration
+	}
+	filter := Filter{Client: opts.Client, Fingerprint: opts.Fingerprint}
+	if len(opts.Collections) > 0 || len(opts.Commands) > 0 {
+		filter.Scope = &plugins.Scope{Collections: opts.Collections, Commands: opts.Commands}
+		filter.Scope.Compile()
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.taps) >= p.conf.MaxTaps {
+		return nil, fmt.Errorf("%d taps are already streaming", len(p.taps))
+	}
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	t := &tap{
+		filter: filter,
+		sample: sample,
+		values: opts.Values,
+		ch:     make(chan *plugins.TapRecord, 100),
+		ctx:    ctx,
+		cancel: cancel,
+		plugin: p,
+	}
+	p.taps = append(p.taps, t)
+	tapsGauge.Inc()
+	return t, nil
+}
+
+func (p *CapturePlugin) stopTap(t *tap) {
+	t.cancel()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, a := range p.taps {
+		if a == t {
+			p.taps = append(p.taps[:i:i], p.taps[i+1:]...)
+			tapsGauge.Dec()
+			break
+		}
+	}
+}
+
+// ServeTap streams a sample of the requests as they complete (one plugins.TapRecord per
+// line) until the client disconnects or the duration (capped by maxDuration)
+// passed. The query params select the requests:
+//
+//	collections   comma separated namespaces (as in a scope, e.g. db.coll or db.*)
+//	commands      comma separated commands
+//	client        the client's address (with or without port), appName or user
+//	fingerprint   the fingerprint of the command
+//	sample        the fraction of the matching requests streamed (default 1)
+//	values        stream the redacted values of requests rather than their shape
+//	              (requires tapValues)
+//	duration      how long to stream for
+func (p *CapturePlugin) ServeTap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	q := r.URL.Query()
+	opts := plugins.TapOptions{
+		Client:      q.Get("client"),
+		Fingerprint: q.Get("fingerprint"),
+		Values:      q.Get("values") == "true",
+	}
+	if v := q.Get("collections"); v != "" {
+		opts.Collections = strings.Split(v, ",")
+	}
+	if v := q.Get("commands"); v != "" {
+		opts.Commands = strings.Split(v, ",")
+	}
+	if v := q.Get("sample"); v != "" {
+		var err error
+		if opts.Sample, err = strconv.ParseFloat(v, 64); err != nil || opts.Sample <= 0 || opts.Sample > 1 {
+			http.Error(w, "sample must be in (0, 1]: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("duration"); v != "" {
+		var err error
+		if opts.Duration, err = time.ParseDuration(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	t, err := p.StartTap(r.Context(), opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	defer t.Close()
+	logrus.Infof("Tap started: client=%s sample=%v values=%v", r.RemoteAddr, opts.Sample, opts.Values)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-t.Done():
+			return
+		case rec := <-t.Records():
+			if err := enc.Encode(rec); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
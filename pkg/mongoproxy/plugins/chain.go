@@ -8,6 +8,8 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
 )
 
 var (
@@ -17,6 +19,12 @@ var (
 		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001, 1.0: 0.0},
 		MaxAge:     time.Minute,
 	}, []string{"i", "plugin", "status"})
+	pluginSelfSummary = promauto.NewSummaryVec(prometheus.SummaryOpts{
+		Name:       "mongoproxy_plugins_self_duration_seconds",
+		Help:       "Summary of time spent in each plugin (excluding the rest of the pipeline)",
+		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001, 1.0: 0.0},
+		MaxAge:     time.Minute,
+	}, []string{"i", "plugin"})
 )
 
 type ChainFunc func(PipelineFunc) PipelineFunc
@@ -39,16 +47,78 @@ func BuildPipeline(m []Plugin, base PipelineFunc) PipelineFunc {
 // wrapPlugin returns a closure ChainFunc that wraps over the plugin p, which
 // can input and output PipelineFuncs to help with chaining.
 func wrapPlugin(i int, p Plugin) ChainFunc {
+	process := processFunc(p)
 	return ChainFunc(func(next PipelineFunc) PipelineFunc {
 		return PipelineFunc(func(ctx context.Context, req *Request) (bson.D, error) {
+			// The trace's backend time is excluded from the plugin's (as some plugins
+			// call the backend themselves)
+			trace := GetRequestTrace(ctx)
+			backendStart := trace.backendTotal()
+			var downstream, downstreamBackend time.Duration
 			start := time.Now()
-			d, err := p.Process(ctx, req, next)
-			pluginSummary.WithLabelValues(strconv.Itoa(i), p.Name(), statusForErr(err)).Observe(time.Since(start).Seconds())
+			d, err := process(ctx, req, func(ctx context.Context, req *Request) (bson.D, error) {
+				nextStart, nextBackendStart := time.Now(), trace.backendTotal()
+				defer func() {
+					downstream += time.Since(nextStart)
+					downstreamBackend += trace.backendTotal() - nextBackendStart
+				}()
+				return next(ctx, req)
+			})
+			took := time.Since(start)
+			pluginSummary.WithLabelValues(strconv.Itoa(i), p.Name(), statusForErr(err)).Observe(took.Seconds())
+			pluginSelfSummary.WithLabelValues(strconv.Itoa(i), p.Name()).Observe((took - downstream).Seconds())
+			if trace != nil {
+				backend := trace.backendTotal() - backendStart - downstreamBackend
+				trace.addPlugin(i, p.Name(), took-downstream-backend)
+				trace.Cancel(ctx, PhasePlugin, p.Name())
+			}
 			return d, err
 		})
 	})
 }
 
+// processFunc returns the ProcessFunc for the plugin, including any response or
+// error hooks the plugin implements.
+func processFunc(p Plugin) ProcessFunc {
+	// Scoped plugins need to check the scope before running any of the hooks
+	if sp, ok := p.(*scopedPlugin); ok {
+		process := processFunc(sp.Plugin)
+		return func(ctx context.Context, r *Request, next PipelineFunc) (bson.D, error) {
+			if !sp.scope.Match(r) {
+				return next(ctx, r)
+			}
+			return process(ctx, r, next)
+		}
+	}
+
+	// Timeouts include the time spent in the plugin's hooks
+	if tp, ok := p.(*timeoutPlugin); ok {
+		return tp.wrap(processFunc(tp.Plugin))
+	}
+
+	responseHook, hasResponseHook := p.(ResponseHook)
+	errorHook, hasErrorHook := p.(ErrorHook)
+	if !hasResponseHook && !hasErrorHook {
+		return p.Process
+	}
+
+	return func(ctx context.Context, r *Request, next PipelineFunc) (bson.D, error) {
+		return p.Process(ctx, r, func(ctx context.Context, r *Request) (bson.D, error) {
+			d, err := next(ctx, r)
+			if err != nil || !bsonutil.Ok(d) {
+				if hasErrorHook {
+					return errorHook.ProcessError(ctx, r, d, err)
+				}
+				return d, err
+			}
+			if hasResponseHook {
+				return responseHook.ProcessResponse(ctx, r, d)
+			}
+			return d, err
+		})
+	}
+}
+
 func statusForErr(err error) string {
 	if err == nil {
 		return "success"
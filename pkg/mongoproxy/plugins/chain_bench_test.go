@@ -0,0 +1,47 @@
+package plugins
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/command"
+)
+
+type noopPlugin struct{}
+
+func (p *noopPlugin) Name() string           { return "noop" }
+func (p *noopPlugin) Configure(bson.D) error { return nil }
+func (p *noopPlugin) Process(ctx context.Context, r *Request, next PipelineFunc) (bson.D, error) {
+	return next(ctx, r)
+}
+
+func BenchmarkPipeline(b *testing.B) {
+	base := func(context.Context, *Request) (bson.D, error) {
+		return bson.D{{"ok", 1}}, nil
+	}
+
+	for _, n := range []int{0, 1, 5, 10} {
+		ps := make([]Plugin, n)
+		for i := range ps {
+			ps[i] = &noopPlugin{}
+		}
+		pipe := BuildPipeline(ps, base)
+
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			r := &Request{
+				CC:          NewClientConnection(),
+				CommandName: "find",
+				Command:     &command.Find{Collection: "testcollection", Common: command.Common{Database: "testdb"}},
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := pipe(context.TODO(), r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+)
+
+type hookPlugin struct {
+	noopPlugin
+	responses, errors int
+}
+
+func (p *hookPlugin) ProcessResponse(ctx context.Context, r *Request, d bson.D) (bson.D, error) {
+	p.responses++
+	return append(d, bson.E{"hooked", true}), nil
+}
+
+func (p *hookPlugin) ProcessError(ctx context.Context, r *Request, d bson.D, err error) (bson.D, error) {
+	p.errors++
+	return bson.D{{"ok", 0}, {"errmsg", "translated"}}, nil
+}
+
+func TestPipelineHooks(t *testing.T) {
+	var (
+		backendResp bson.D
+		backendErr  error
+	)
+	p := &hookPlugin{}
+	pipe := BuildPipeline([]Plugin{p}, func(context.Context, *Request) (bson.D, error) {
+		return backendResp, backendErr
+	})
+	r := &Request{CommandName: "find", Command: &command.Find{}}
+
+	// successful response
+	backendResp, backendErr = bson.D{{"ok", 1}}, nil
+	d, err := pipe(context.TODO(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := bsonutil.Lookup(d, "hooked"); v != true {
+		t.Fatalf("response hook not applied: %v", d)
+	}
+
+	// ok: 0 response
+	backendResp, backendErr = bson.D{{"ok", 0}, {"errmsg", "orig"}}, nil
+	d, err = pipe(context.TODO(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := bsonutil.Lookup(d, "errmsg"); v != "translated" {
+		t.Fatalf("error hook not applied: %v", d)
+	}
+
+	// error
+	backendResp, backendErr = nil, errors.New("some error")
+	d, err = pipe(context.TODO(), r)
+	if err != nil {
+		t.Fatalf("error hook should have translated error: %v", err)
+	}
+
+	if p.responses != 1 || p.errors != 2 {
+		t.Fatalf("unexpected hook counts responses=%d errors=%d", p.responses, p.errors)
+	}
+
+	// Hooks shouldn't run if the plugin is out of scope
+	scoped := &hookPlugin{}
+	pipe = BuildPipeline([]Plugin{Scoped(scoped, &Scope{Commands: []string{"insert"}})}, func(context.Context, *Request) (bson.D, error) {
+		return bson.D{{"ok", 1}}, nil
+	})
+	if _, err := pipe(context.TODO(), r); err != nil {
+		t.Fatal(err)
+	}
+	if scoped.responses != 0 {
+		t.Fatalf("response hook ran for out of scope plugin")
+	}
+}
@@ -0,0 +1,479 @@
+package changeevents
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "changeevents"
+
+var (
+	eventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_changeevents_events_total",
+		Help: "The total change events by the result of publishing them",
+	}, []string{"result"})
+)
+
+// Operations of an event
+const (
+	OpInsert = "insert"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &ChangeEventsPlugin{
+			conf: ChangeEventsPluginConfig{
+				BatchSize:     100,
+				FlushInterval: "1s",
+				QueueSize:     10000,
+				Timeout:       "10s",
+			},
+		}
+	})
+}
+
+type ChangeEventsPluginConfig struct {
+	// Brokers are the Kafka brokers events are published to (e.g.
+	// ["kafka-1:9092"]); either them or RestProxyURL is required
+	Brokers []string `bson:"brokers"`
+	// TLS connects to the brokers with TLS
+	TLS bool `bson:"tls"`
+	// SASLUsername and SASLPassword authenticate to the brokers (SASL/PLAIN)
+	SASLUsername string `bson:"saslUsername"`
+	SASLPassword string `bson:"saslPassword"`
+	// RestProxyURL is the URL of a Kafka REST proxy to publish events through
+	// rather than to the brokers
+	RestProxyURL string `bson:"restProxyURL"`
+	// Topic is the topic events are published to; "{db}" and "{collection}" are
+	// replaced by the namespace of the event (required)
+	Topic string `bson:"topic"`
+	// IncludeFields includes the fields written (set, created or removed) in events
+	IncludeFields bool `bson:"includeFields"`
+	// BatchSize is the maximum events published in one request (default 100)
+	BatchSize int `bson:"batchSize"`
+	// FlushInterval is the maximum time events wait to be published (default "1s")
+	FlushInterval string `bson:"flushInterval"`
+	// QueueSize is the number of events waiting to be published; further events are
+	// dropped (default 10000)
+	QueueSize int `bson:"queueSize"`
+	// Timeout is the timeout of publishing a batch (default "10s")
+	Timeout string `bson:"timeout"`
+
+	flushInterval time.Duration
+	timeout       time.Duration
+}
+
+// Event is a change to a document written through the proxy
+type Event struct {
+	Database   string `json:"db"`
+	Collection string `json:"collection"`
+	Op         string `json:"op"`
+	// ID is the _id of the document (extended JSON); when the write selected the
+	// documents with another filter, Filter is set instead
+	ID     json.RawMessage `json:"_id,omitempty"`
+	Filter json.RawMessage `json:"filter,omitempty"`
+	// Multi is set for updates and deletes of (possibly) multiple documents
+	Multi bool `json:"multi,omitempty"`
+	// Upserted is set for updates inserting the document
+	Upserted bool     `json:"upserted,omitempty"`
+	Fields   []string `json:"fields,omitempty"`
+	AppName  string   `json:"appName,omitempty"`
+	Time     string   `json:"time"`
+
+	topic string
+	key   string
+}
+
+// This is a plugin that publishes the changes written through the proxy to Kafka
+type ChangeEventsPlugin struct {
+	conf ChangeEventsPluginConfig
+
+	pub    publisher
+	events chan *Event
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (p *ChangeEventsPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *ChangeEventsPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	switch {
+	case len(p.conf.Brokers) > 0 && p.conf.RestProxyURL != "":
+		return fmt.Errorf("brokers and restProxyURL are exclusive")
+	case len(p.conf.Brokers) == 0 && p.conf.RestProxyURL == "":
+		return fmt.Errorf("brokers or restProxyURL is required")
+	case p.conf.RestProxyURL != "":
+		if u, err := url.Parse(p.conf.RestProxyURL); err != nil || u.Host == "" {
+			return fmt.Errorf("invalid restProxyURL %q", p.conf.RestProxyURL)
+		}
+	}
+	if p.conf.Topic == "" {
+		return fmt.Errorf("topic is required")
+	}
+	if p.conf.BatchSize <= 0 {
+		return fmt.Errorf("batchSize must be positive: %d", p.conf.BatchSize)
+	}
+	if p.conf.QueueSize <= 0 {
+		return fmt.Errorf("queueSize must be positive: %d", p.conf.QueueSize)
+	}
+	if p.conf.flushInterval, err = time.ParseDuration(p.conf.FlushInterval); err != nil {
+		return err
+	}
+	if p.conf.flushInterval <= 0 {
+		return fmt.Errorf("flushInterval must be positive: %s", p.conf.FlushInterval)
+	}
+	if p.conf.timeout, err = time.ParseDuration(p.conf.Timeout); err != nil {
+		return err
+	}
+
+	p.events = make(chan *Event, p.conf.QueueSize)
+
+	return nil
+}
+
+// ReadsBatches returns false as events are built from the write commands
+func (p *ChangeEventsPlugin) ReadsBatches() bool { return false }
+
+// ReadsDocuments returns true as events include the inserted documents
+func (p *ChangeEventsPlugin) ReadsDocuments() bool { return true }
+
+// Start connects to Kafka (or its REST proxy) and starts publishing the queued
+// events
+func (p *ChangeEventsPlugin) Start(ctx context.Context) error {
+	if p.pub == nil {
+		if p.conf.RestProxyURL != "" {
+			p.pub = &restPublisher{url: p.conf.RestProxyURL, client: &http.Client{Timeout: p.conf.timeout}}
+		} else {
+			k, err := newKafkaPublisher(&p.conf)
+			if err != nil {
+				return fmt.Errorf("error connecting to Kafka: %w", err)
+			}
+			p.pub = k
+		}
+	}
+	p.stop = make(chan struct{})
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(p.conf.flushInterval)
+		defer ticker.Stop()
+
+		batch := make([]*Event, 0, p.conf.BatchSize)
+		for {
+			select {
+			case <-p.stop:
+				// Publish the events queued before stopping
+				for {
+					select {
+					case e := <-p.events:
+						batch = append(batch, e)
+						if len(batch) == p.conf.BatchSize {
+							p.publish(batch)
+							batch = batch[:0]
+						}
+					default:
+						p.publish(batch)
+						return
+					}
+				}
+			case e := <-p.events:
+				batch = append(batch, e)
+				if len(batch) == p.conf.BatchSize {
+					p.publish(batch)
+					batch = batch[:0]
+				}
+			case <-ticker.C:
+				p.publish(batch)
+				batch = batch[:0]
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop publishes the queued events and stops publishing
+func (p *ChangeEventsPlugin) Stop(ctx context.Context) error {
+	if p.stop == nil {
+		return nil
+	}
+	close(p.stop)
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return p.pub.close()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// publish publishes the events (one batch per topic)
+func (p *ChangeEventsPlugin) publish(events []*Event) {
+	if len(events) == 0 {
+		return
+	}
+	byTopic := make(map[string][]record)
+	for _, e := range events {
+		byTopic[e.topic] = append(byTopic[e.topic], record{Key: e.key, Value: e})
+	}
+
+	for topic, records := range byTopic {
+		published, err := p.pub.send(topic, records)
+		eventsTotal.WithLabelValues("published").Add(float64(published))
+		if err != nil {
+			eventsTotal.WithLabelValues("failed").Add(float64(len(records) - published))
+			logrus.Errorf("CHANGE EVENTS ERROR: publishing %d events to %s: %s", len(records)-published, topic, err.Error())
+		}
+	}
+}
+
+// extJSON returns the value as (relaxed) extended JSON
+func extJSON(v interface{}) json.RawMessage {
+	b, err := bson.MarshalExtJSON(bson.D{{"v", v}}, false, false)
+	if err != nil {
+		return nil
+	}
+	// Unwrap the value from {"v":...}
+	return json.RawMessage(b[len(`{"v":`) : len(b)-1])
+}
+
+// queryID returns the _id the query selects by equality
+func queryID(query bson.D) (interface{}, bool) {
+	id, ok := bsonutil.Lookup(query, "_id")
+	if !ok {
+		return nil, false
+	}
+	if ops, isDoc := id.(bson.D); isDoc && len(ops) > 0 && strings.HasPrefix(ops[0].Key, "$") {
+		return bsonutil.Lookup(ops, "$eq")
+	}
+	return id, true
+}
+
+// failedWrites returns the indexes of the statements with write errors, and the
+// first statement not run (len(statements) if all ran)
+func failedWrites(response bson.D, ordered bool, statements int) (map[int]struct{}, int) {
+	failed := make(map[int]struct{})
+	end := statements
+	v, _ := bsonutil.Lookup(response, "writeErrors")
+	writeErrors, _ := v.(primitive.A)
+	for _, we := range writeErrors {
+		weD, _ := we.(bson.D)
+		index, _ := bsonutil.Lookup(weD, "index")
+		var i int
+		switch n := index.(type) {
+		case int32:
+			i = int(n)
+		case int64:
+			i = int(n)
+		default:
+			continue
+		}
+		failed[i] = struct{}{}
+		// Ordered writes stop at the first error
+		if ordered && i+1 < end {
+			end = i + 1
+		}
+	}
+	return failed, end
+}
+
+// changes returns the changes of the successful write
+func (p *ChangeEventsPlugin) changes(e *plugins.PostCommitEvent) []*Event {
+	var events []*Event
+	add := func(op string, id interface{}, hasID bool, filter bson.D) *Event {
+		ev := &Event{Op: op}
+		if hasID {
+			ev.ID = extJSON(id)
+		} else {
+			ev.Filter = extJSON(filter)
+		}
+		events = append(events, ev)
+		return ev
+	}
+
+	switch cmd := e.Request.Command.(type) {
+	case *command.Insert:
+		failed, end := failedWrites(e.Response, bsonutil.GetBoolDefault(cmd.Ordered, true), len(cmd.Documents))
+		for i, doc := range cmd.Documents[:end] {
+			if _, ok := failed[i]; ok {
+				continue
+			}
+			id, hasID := bsonutil.Lookup(doc, "_id")
+			ev := add(OpInsert, id, hasID, nil)
+			if p.conf.IncludeFields {
+				for _, f := range doc {
+					ev.Fields = append(ev.Fields, f.Key)
+				}
+			}
+		}
+
+	case *command.Update:
+		upserted := make(map[int]interface{})
+		v, _ := bsonutil.Lookup(e.Response, "upserted")
+		items, _ := v.(primitive.A)
+		for _, item := range items {
+			itemD, _ := item.(bson.D)
+			index, _ := bsonutil.Lookup(itemD, "index")
+			id, _ := bsonutil.Lookup(itemD, "_id")
+			switch n := index.(type) {
+			case int32:
+				upserted[int(n)] = id
+			case int64:
+				upserted[int(n)] = id
+			}
+		}
+
+		failed, end := failedWrites(e.Response, bsonutil.GetBoolDefault(cmd.Ordered, true), len(cmd.Updates))
+		for i, u := range cmd.Updates[:end] {
+			if _, ok := failed[i]; ok {
+				continue
+			}
+			var ev *Event
+			if id, ok := upserted[i]; ok {
+				ev = add(OpUpdate, id, true, nil)
+				ev.Upserted = true
+			} else {
+				id, hasID := queryID(u.Query)
+				ev = add(OpUpdate, id, hasID, u.Query)
+				ev.Multi = bsonutil.GetBoolDefault(u.Multi, false)
+			}
+			if p.conf.IncludeFields {
+				ev.Fields = updatedFields(u.U, u.Upsert)
+			}
+		}
+
+	case *command.Delete:
+		if n, _ := bsonutil.Lookup(e.Response, "n"); n == int32(0) || n == int64(0) {
+			return nil
+		}
+		failed, end := failedWrites(e.Response, bsonutil.GetBoolDefault(cmd.Ordered, true), len(cmd.Deletes))
+		for i, deleteDoc := range cmd.Deletes[:end] {
+			if _, ok := failed[i]; ok {
+				continue
+			}
+			q, _ := bsonutil.Lookup(deleteDoc, "q")
+			query, _ := q.(bson.D)
+			limit, _ := bsonutil.Lookup(deleteDoc, "limit")
+			id, hasID := queryID(query)
+			ev := add(OpDelete, id, hasID, query)
+			ev.Multi = !bsonutil.BoolNumber(limit)
+		}
+
+	case *command.FindAndModify:
+		// The response has the document (before or after the change)
+		value, _ := bsonutil.Lookup(e.Response, "value")
+		upsertedID, upserted := bsonutil.Lookup(e.Response, "lastErrorObject", "upserted")
+		valueD, _ := value.(bson.D)
+		if valueD == nil && !upserted {
+			return nil
+		}
+		id, hasID := bsonutil.Lookup(valueD, "_id")
+		if upserted {
+			id, hasID = upsertedID, true
+		}
+
+		op := OpUpdate
+		if bsonutil.GetBoolDefault(cmd.Remove, false) {
+			op = OpDelete
+		}
+		ev := add(op, id, hasID, cmd.Query)
+		ev.Upserted = upserted
+		if p.conf.IncludeFields && op == OpUpdate {
+			ev.Fields = updatedFields(cmd.Update, cmd.Upsert)
+		}
+	}
+	return events
+}
+
+// updatedFields returns the fields written by the update
+func updatedFields(update bson.D, upsert *bool) []string {
+	f := bsonutil.ExpandUpdate(update, upsert)
+	fields := make([]string, 0, len(f.Update)+len(f.Delete))
+	seen := make(map[string]struct{})
+	for _, list := range [][]string{f.Create, f.Update, f.Delete} {
+		for _, field := range list {
+			if _, ok := seen[field]; !ok {
+				seen[field] = struct{}{}
+				fields = append(fields, field)
+			}
+		}
+	}
+	return fields
+}
+
+// PostCommit queues the changes of successful writes to be published
+func (p *ChangeEventsPlugin) PostCommit(ctx context.Context, e *plugins.PostCommitEvent) {
+	if e.Err != nil || !bsonutil.Ok(e.Response) {
+		return
+	}
+
+	events := p.changes(e)
+	if len(events) == 0 {
+		return
+	}
+	topic := strings.NewReplacer("{db}", e.Database, "{collection}", e.Collection).Replace(p.conf.Topic)
+	var appName string
+	if e.Request.CC != nil {
+		appName = e.Request.CC.AppName
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+
+	for _, ev := range events {
+		ev.Database, ev.Collection = e.Database, e.Collection
+		ev.AppName = appName
+		ev.Time = now
+		ev.topic = topic
+		// Changes of a document have the same key (so they are in order in a partition)
+		ev.key = e.Database + "." + e.Collection
+		if ev.ID != nil {
+			ev.key += ":" + string(ev.ID)
+		}
+
+		select {
+		case p.events <- ev:
+		default:
+			eventsTotal.WithLabelValues("dropped").Inc()
+		}
+	}
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *ChangeEventsPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	return next(ctx, r)
+}
@@ -0,0 +1,341 @@
+package changeevents
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func newPlugin(t *testing.T) *ChangeEventsPlugin {
+	p, ok := plugins.GetPlugin(Name)
+	if !ok {
+		t.Fatal("plugin not registered")
+	}
+	return p.(*ChangeEventsPlugin)
+}
+
+func TestChanges(t *testing.T) {
+	p := newPlugin(t)
+	if err := p.Configure(bson.D{{"restProxyURL", "http://localhost:8082"}, {"topic", "changes"}, {"includeFields", true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		cmd      bson.D
+		response bson.D
+		// expected events as op, _id or filter (extended JSON) and fields
+		events [][3]interface{}
+	}{
+		{
+			bson.D{{"insert", "coll"}, {"documents", bson.A{bson.D{{"_id", 1}, {"a", 1}}, bson.D{{"_id", 2}}, bson.D{{"_id", 3}}}}, {"$db", "db"}},
+			bson.D{{"n", int32(3)}, {"ok", 1}},
+			[][3]interface{}{{OpInsert, `1`, []string{"_id", "a"}}, {OpInsert, `2`, []string{"_id"}}, {OpInsert, `3`, []string{"_id"}}},
+		},
+		// ordered inserts stop at the first error
+		{
+			bson.D{{"insert", "coll"}, {"documents", bson.A{bson.D{{"_id", 1}}, bson.D{{"_id", 2}}, bson.D{{"_id", 3}}}}, {"$db", "db"}},
+			bson.D{{"n", int32(1)}, {"writeErrors", bson.A{bson.D{{"index", int32(1)}, {"code", int32(11000)}}}}, {"ok", 1}},
+			[][3]interface{}{{OpInsert, `1`, []string{"_id"}}},
+		},
+		{
+			bson.D{{"insert", "coll"}, {"documents", bson.A{bson.D{{"_id", 1}}, bson.D{{"_id", 2}}, bson.D{{"_id", 3}}}}, {"ordered", false}, {"$db", "db"}},
+			bson.D{{"n", int32(2)}, {"writeErrors", bson.A{bson.D{{"index", int32(1)}, {"code", int32(11000)}}}}, {"ok", 1}},
+			[][3]interface{}{{OpInsert, `1`, []string{"_id"}}, {OpInsert, `3`, []string{"_id"}}},
+		},
+		{
+			bson.D{{"insert", "coll"}, {"documents", bson.A{bson.D{{"_id", 1}}}}, {"$db", "db"}},
+			bson.D{{"ok", 0}, {"errmsg", "failed"}},
+			nil,
+		},
+		{
+			bson.D{{"update", "coll"}, {"updates", bson.A{
+				bson.D{{"q", bson.D{{"_id", "a"}}}, {"u", bson.D{{"$set", bson.D{{"x", 1}}}, {"$unset", bson.D{{"y", ""}}}}}},
+				bson.D{{"q", bson.D{{"x", bson.D{{"$gt", 1}}}}}, {"u", bson.D{{"$inc", bson.D{{"n", 1}}}}}, {"multi", true}},
+				bson.D{{"q", bson.D{{"_id", bson.D{{"$eq", "b"}}}}}, {"u", bson.D{{"x", 2}}}, {"upsert", true}},
+			}}, {"$db", "db"}},
+			bson.D{{"n", int32(3)}, {"upserted", bson.A{bson.D{{"index", int32(2)}, {"_id", "b"}}}}, {"ok", 1}},
+			[][3]interface{}{{OpUpdate, `"a"`, []string{"x", "y"}}, {OpUpdate, `{"x":{"$gt":1}}`, []string{"n"}}, {OpUpdate, `"b"`, []string{"x"}}},
+		},
+		{
+			bson.D{{"delete", "coll"}, {"deletes", bson.A{
+				bson.D{{"q", bson.D{{"_id", 1}}}, {"limit", 1}},
+				bson.D{{"q", bson.D{{"a", 1}}}, {"limit", 0}},
+			}}, {"$db", "db"}},
+			bson.D{{"n", int32(2)}, {"ok", 1}},
+			[][3]interface{}{{OpDelete, `1`, nil}, {OpDelete, `{"a":1}`, nil}},
+		},
+		{
+			bson.D{{"delete", "coll"}, {"deletes", bson.A{bson.D{{"q", bson.D{{"_id", 1}}}, {"limit", 1}}}}, {"$db", "db"}},
+			bson.D{{"n", int32(0)}, {"ok", 1}},
+			nil,
+		},
+		{
+			bson.D{{"findAndModify", "coll"}, {"query", bson.D{{"a", 1}}}, {"update", bson.D{{"$set", bson.D{{"b", 1}}}}}, {"$db", "db"}},
+			bson.D{{"lastErrorObject", bson.D{{"n", int32(1)}, {"updatedExisting", true}}}, {"value", bson.D{{"_id", 5}, {"a", 1}}}, {"ok", 1}},
+			[][3]interface{}{{OpUpdate, `5`, []string{"b"}}},
+		},
+		{
+			bson.D{{"findAndModify", "coll"}, {"query", bson.D{{"a", 1}}}, {"update", bson.D{{"$set", bson.D{{"b", 1}}}}}, {"upsert", true}, {"$db", "db"}},
+			bson.D{{"lastErrorObject", bson.D{{"n", int32(1)}, {"upserted", 6}}}, {"value", nil}, {"ok", 1}},
+			[][3]interface{}{{OpUpdate, `6`, []string{"b"}}},
+		},
+		{
+			bson.D{{"findAndModify", "coll"}, {"query", bson.D{{"a", 1}}}, {"remove", true}, {"$db", "db"}},
+			bson.D{{"lastErrorObject", bson.D{{"n", int32(0)}}}, {"value", nil}, {"ok", 1}},
+			nil,
+		},
+		{
+			bson.D{{"findAndModify", "coll"}, {"query", bson.D{{"a", 1}}}, {"remove", true}, {"$db", "db"}},
+			bson.D{{"lastErrorObject", bson.D{{"n", int32(1)}}}, {"value", bson.D{{"_id", 7}}}, {"ok", 1}},
+			[][3]interface{}{{OpDelete, `7`, nil}},
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			cmd, ok := command.GetCommand(test.cmd[0].Key)
+			if !ok {
+				t.Fatalf("no such command: %s", test.cmd[0].Key)
+			}
+			if err := cmd.FromBSOND(test.cmd); err != nil {
+				t.Fatal(err)
+			}
+
+			p.events = make(chan *Event, 10)
+			p.PostCommit(context.TODO(), &plugins.PostCommitEvent{
+				Request:    &plugins.Request{CommandName: test.cmd[0].Key, Command: cmd},
+				Database:   "db",
+				Collection: "coll",
+				Response:   test.response,
+			})
+			close(p.events)
+
+			var events [][3]interface{}
+			for e := range p.events {
+				target := e.ID
+				if target == nil {
+					target = e.Filter
+				}
+				var fields interface{}
+				if e.Fields != nil {
+					fields = e.Fields
+				}
+				events = append(events, [3]interface{}{e.Op, string(target), fields})
+			}
+			if !reflect.DeepEqual(events, test.events) {
+				t.Fatalf("mismatch in events\nexpected=%v\nactual=%v", test.events, events)
+			}
+		})
+	}
+}
+
+func TestPublish(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		paths    []string
+		received []json.RawMessage
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != contentType {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		var body struct {
+			Records []struct {
+				Key   string          `json:"key"`
+				Value json.RawMessage `json:"value"`
+			} `json:"records"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		paths = append(paths, r.URL.Path)
+		for _, record := range body.Records {
+			received = append(received, record.Value)
+		}
+	}))
+	defer srv.Close()
+
+	p := newPlugin(t)
+	if err := p.Configure(bson.D{{"restProxyURL", srv.URL}, {"topic", "changes.{db}.{collection}"}, {"flushInterval", "1h"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Start(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := &command.Insert{}
+	if err := cmd.FromBSOND(bson.D{{"insert", "coll"}, {"documents", bson.A{bson.D{{"_id", 1}}, bson.D{{"_id", 2}}}}, {"$db", "db"}}); err != nil {
+		t.Fatal(err)
+	}
+	p.PostCommit(context.TODO(), &plugins.PostCommitEvent{
+		Request:    &plugins.Request{CommandName: "insert", Command: cmd},
+		Database:   "db",
+		Collection: "coll",
+		Response:   bson.D{{"n", int32(2)}, {"ok", 1}},
+	})
+
+	// Stopping publishes the queued events
+	if err := p.Stop(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if !reflect.DeepEqual(paths, []string{"/topics/changes.db.coll"}) {
+		t.Fatalf("unexpected requests: %v", paths)
+	}
+	if len(received) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(received))
+	}
+	var e Event
+	if err := json.Unmarshal(received[1], &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Database != "db" || e.Collection != "coll" || e.Op != OpInsert || string(e.ID) != `2` {
+		t.Fatalf("unexpected event: %s", received[1])
+	}
+}
+
+// commitInsert passes the plugin the commit of an insert of the _ids to db.coll
+func commitInsert(t *testing.T, p *ChangeEventsPlugin, ids ...int) {
+	docs := make(bson.A, len(ids))
+	for i, id := range ids {
+		docs[i] = bson.D{{"_id", id}}
+	}
+	cmd := &command.Insert{}
+	if err := cmd.FromBSOND(bson.D{{"insert", "coll"}, {"documents", docs}, {"$db", "db"}}); err != nil {
+		t.Fatal(err)
+	}
+	p.PostCommit(context.TODO(), &plugins.PostCommitEvent{
+		Request:    &plugins.Request{CommandName: "insert", Command: cmd},
+		Database:   "db",
+		Collection: "coll",
+		Response:   bson.D{{"n", int32(len(ids))}, {"ok", 1}},
+	})
+}
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		config bson.D
+		ok     bool
+	}{
+		{bson.D{{"brokers", bson.A{"kafka:9092"}}, {"topic", "changes"}}, true},
+		{bson.D{{"brokers", bson.A{"kafka:9092"}}, {"topic", "changes"}, {"tls", true}, {"saslUsername", "proxy"}, {"saslPassword", "secret"}}, true},
+		{bson.D{{"restProxyURL", "http://kafka-rest:8082"}, {"topic", "changes"}}, true},
+		{bson.D{{"topic", "changes"}}, false},
+		{bson.D{{"brokers", bson.A{"kafka:9092"}}, {"restProxyURL", "http://kafka-rest:8082"}, {"topic", "changes"}}, false},
+		{bson.D{{"restProxyURL", "kafka-rest"}, {"topic", "changes"}}, false},
+		{bson.D{{"brokers", bson.A{"kafka:9092"}}}, false},
+	}
+	for i, test := range tests {
+		if err := newPlugin(t).Configure(test.config); (err == nil) != test.ok {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestPublishKafka(t *testing.T) {
+	const topic = "changes.db.coll"
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	// The version of the produce requests of Kafka 1.0
+	produce := sarama.NewMockProduceResponse(t).SetVersion(3)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(topic, 0, broker.BrokerID()),
+		"ProduceRequest": produce,
+	})
+
+	p := newPlugin(t)
+	if err := p.Configure(bson.D{{"brokers", bson.A{broker.Addr()}}, {"topic", "changes.{db}.{collection}"}, {"flushInterval", "1h"}, {"timeout", "1s"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Start(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	commitInsert(t, p, 1, 2)
+	// Stopping publishes the queued events
+	if err := p.Stop(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	produced := 0
+	for _, rr := range broker.History() {
+		if _, ok := rr.Request.(*sarama.ProduceRequest); ok {
+			produced++
+		}
+	}
+	if produced == 0 {
+		t.Fatalf("expected the events to be produced")
+	}
+
+	k, err := newKafkaPublisher(&p.conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.close()
+	records := []record{{Key: "db.coll:1", Value: &Event{Op: OpInsert}}, {Key: "db.coll:2", Value: &Event{Op: OpInsert}}}
+	if published, err := k.send(topic, records); published != 2 || err != nil {
+		t.Fatalf("expected the records to be published, got %d %v", published, err)
+	}
+	// Records rejected by the broker aren't published
+	produce.SetError(topic, 0, sarama.ErrMessageSizeTooLarge)
+	published, err := k.send(topic, records[:1])
+	if published != 0 || err != sarama.ErrMessageSizeTooLarge {
+		t.Fatalf("expected the record to be rejected, got %d %v", published, err)
+	}
+}
+
+func TestKafkaRecords(t *testing.T) {
+	p := newPlugin(t)
+	if err := p.Configure(bson.D{{"brokers", bson.A{"kafka:9092"}}, {"topic", "changes.{db}.{collection}"}, {"flushInterval", "1h"}}); err != nil {
+		t.Fatal(err)
+	}
+	producer := mocks.NewSyncProducer(t, nil)
+	p.pub = &kafkaPublisher{producer: producer}
+	for _, id := range []int{1, 2} {
+		id := id
+		producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+			key, _ := msg.Key.Encode()
+			value, _ := msg.Value.Encode()
+			var e Event
+			if err := json.Unmarshal(value, &e); err != nil {
+				return err
+			}
+			// Records are keyed by document
+			if msg.Topic != "changes.db.coll" || string(key) != "db.coll:"+strconv.Itoa(id) {
+				return fmt.Errorf("unexpected record %s %s", msg.Topic, key)
+			}
+			if e.Op != OpInsert || string(e.ID) != strconv.Itoa(id) {
+				return fmt.Errorf("unexpected event %s", value)
+			}
+			return nil
+		})
+	}
+
+	if err := p.Start(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	commitInsert(t, p, 1, 2)
+	// Stopping closes the producer, which fails the test on unmet expectations
+	if err := p.Stop(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+}
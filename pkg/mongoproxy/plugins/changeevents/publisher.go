@@ -0,0 +1,116 @@
+package changeevents
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
+// contentType is the content type of the Kafka REST proxy (v2) for JSON records
+const contentType = "application/vnd.kafka.json.v2+json"
+
+type record struct {
+	Key   string `json:"key"`
+	Value *Event `json:"value"`
+}
+
+// publisher publishes the records of a topic; it returns the number of records
+// published (all of them unless there is an error)
+type publisher interface {
+	send(topic string, records []record) (int, error)
+	close() error
+}
+
+// kafkaPublisher produces the records to the Kafka brokers, keyed so the records
+// of a key go to the same partition
+type kafkaPublisher struct {
+	producer sarama.SyncProducer
+}
+
+func newKafkaPublisher(conf *ChangeEventsPluginConfig) (*kafkaPublisher, error) {
+	cfg := sarama.NewConfig()
+	cfg.ClientID = "mongoproxy"
+	// The brokers are Kafka 1.0 or later
+	cfg.Version = sarama.V1_0_0_0
+	cfg.Net.DialTimeout = conf.timeout
+	cfg.Net.ReadTimeout = conf.timeout
+	cfg.Net.WriteTimeout = conf.timeout
+	if conf.TLS {
+		cfg.Net.TLS.Enable = true
+		cfg.Net.TLS.Config = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if conf.SASLUsername != "" {
+		cfg.Net.SASL.Enable = true
+		cfg.Net.SASL.User = conf.SASLUsername
+		cfg.Net.SASL.Password = conf.SASLPassword
+	}
+	// Only the metadata of the topics published to is needed
+	cfg.Metadata.Full = false
+	cfg.Producer.RequiredAcks = sarama.WaitForAll
+	cfg.Producer.Timeout = conf.timeout
+	cfg.Producer.Return.Successes = true
+	cfg.Producer.Partitioner = sarama.NewHashPartitioner
+
+	producer, err := sarama.NewSyncProducer(conf.Brokers, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaPublisher{producer: producer}, nil
+}
+
+func (k *kafkaPublisher) send(topic string, records []record) (int, error) {
+	msgs := make([]*sarama.ProducerMessage, len(records))
+	for i, r := range records {
+		b, err := json.Marshal(r.Value)
+		if err != nil {
+			return 0, err
+		}
+		msgs[i] = &sarama.ProducerMessage{Topic: topic, Key: sarama.StringEncoder(r.Key), Value: sarama.ByteEncoder(b)}
+	}
+	if err := k.producer.SendMessages(msgs); err != nil {
+		if errs, ok := err.(sarama.ProducerErrors); ok {
+			return len(records) - len(errs), errs[0].Err
+		}
+		return 0, err
+	}
+	return len(records), nil
+}
+
+func (k *kafkaPublisher) close() error { return k.producer.Close() }
+
+// restPublisher posts the records to the Kafka REST proxy
+type restPublisher struct {
+	url    string
+	client *http.Client
+}
+
+func (r *restPublisher) send(topic string, records []record) (int, error) {
+	b, err := json.Marshal(struct {
+		Records []record `json:"records"`
+	}{records})
+	if err != nil {
+		return 0, err
+	}
+	u := strings.TrimSuffix(r.url, "/") + "/topics/" + url.PathEscape(topic)
+	resp, err := r.client.Post(u, contentType, bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return 0, fmt.Errorf("%s: %s", resp.Status, body)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return len(records), nil
+}
+
+func (r *restPublisher) close() error { return nil }
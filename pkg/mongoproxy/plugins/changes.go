@@ -0,0 +1,78 @@
+package plugins
+
+import (
+	"time"
+)
+
+// Change is a configuration (or schema) change applied to the running proxy
+type Change struct {
+	ID   int64     `json:"id"`
+	Time time.Time `json:"time"`
+	// Kind is what changed: "plugins", "readOnly" or a plugin's own (e.g. "schema")
+	Kind string `json:"kind"`
+	// Source is how the change was made, e.g. "admin", "reload" or "file"
+	Source string `json:"source"`
+	// User is who made the change, if known
+	User string `json:"user,omitempty"`
+	// Diff is the lines removed ("- ") and added ("+ ") by the change
+	Diff []string `json:"diff"`
+}
+
+// ChangeRecorder records changes in the proxy's change history; the ID and Time
+// of the change are set by the recorder
+type ChangeRecorder interface {
+	RecordChange(Change)
+}
+
+// ChangeRecorderUser is an optional interface a Plugin can implement to record
+// the changes it applies itself (e.g. reloading a file) in the change history
+type ChangeRecorderUser interface {
+	SetChangeRecorder(ChangeRecorder)
+}
+
+// SetChangeRecorders gives the change recorder to the plugins which use one
+func SetChangeRecorders(ps []Plugin, r ChangeRecorder) {
+	for _, p := range ps {
+		if u, ok := Unwrap(p).(ChangeRecorderUser); ok {
+			u.SetChangeRecorder(r)
+		}
+	}
+}
+
+// DiffLines returns the lines removed from a ("- ") and added in b ("+ ") based
+// on their longest common subsequence; nil if they are the same
+func DiffLines(a, b []string) []string {
+	// lcs[i][j] is the length of the LCS of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var diff []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "- "+a[i])
+			i++
+		default:
+			diff = append(diff, "+ "+b[j])
+			j++
+		}
+	}
+	return diff
+}
@@ -0,0 +1,25 @@
+package plugins
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		a, b     []string
+		expected []string
+	}{
+		{nil, nil, nil},
+		{[]string{"a", "b"}, []string{"a", "b"}, nil},
+		{nil, []string{"a"}, []string{"+ a"}},
+		{[]string{"a"}, nil, []string{"- a"}},
+		{[]string{"a", "b", "c"}, []string{"a", "x", "c"}, []string{"- b", "+ x"}},
+		{[]string{"a", "b", "c"}, []string{"b", "c", "d"}, []string{"- a", "+ d"}},
+	}
+	for _, test := range tests {
+		if diff := DiffLines(test.a, test.b); !reflect.DeepEqual(diff, test.expected) {
+			t.Fatalf("%v -> %v: expected %v, got %v", test.a, test.b, test.expected, diff)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package plugins
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ClientMetadata is the metadata a client sends in the "client" field of its
+// first isMaster (see the MongoDB handshake spec)
+type ClientMetadata struct {
+	Application struct {
+		Name string `bson:"name" json:"name,omitempty"`
+	} `bson:"application" json:"application"`
+	Driver struct {
+		Name    string `bson:"name" json:"name,omitempty"`
+		Version string `bson:"version" json:"version,omitempty"`
+	} `bson:"driver" json:"driver"`
+	OS struct {
+		Type         string `bson:"type" json:"type,omitempty"`
+		Name         string `bson:"name" json:"name,omitempty"`
+		Architecture string `bson:"architecture" json:"architecture,omitempty"`
+		Version      string `bson:"version" json:"version,omitempty"`
+	} `bson:"os" json:"os"`
+	Platform string `bson:"platform" json:"platform,omitempty"`
+}
+
+// ParseClientMetadata parses the client metadata document; unknown fields are
+// ignored as drivers are free to add their own.
+func ParseClientMetadata(d bson.D) (*ClientMetadata, error) {
+	b, err := bson.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	var m ClientMetadata
+	if err := bson.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
@@ -0,0 +1,24 @@
+package plugins
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestParseClientMetadata(t *testing.T) {
+	md, err := ParseClientMetadata(bson.D{
+		{"application", bson.D{{"name", "app"}}},
+		{"driver", bson.D{{"name", "mongo-go-driver"}, {"version", "v1.5.1"}}},
+		{"os", bson.D{{"type", "linux"}, {"architecture", "amd64"}}},
+		{"platform", "go1.16"},
+		{"extra", 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Application.Name != "app" || md.Driver.Name != "mongo-go-driver" || md.Driver.Version != "v1.5.1" ||
+		md.OS.Type != "linux" || md.OS.Architecture != "amd64" || md.Platform != "go1.16" {
+		t.Fatalf("mismatch in metadata: %+v", md)
+	}
+}
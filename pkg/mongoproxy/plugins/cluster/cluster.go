@@ -0,0 +1,505 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "cluster"
+
+var (
+	membersGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongoproxy_plugins_cluster_members",
+		Help: "The number of live proxies in the fleet as of the last sync",
+	})
+	syncTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_cluster_sync_total",
+		Help: "The total syncs of the shared state with Redis",
+	}, []string{"success"})
+	leaderGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mongoproxy_plugins_cluster_leader",
+		Help: "Whether the proxy leads the singleton task (1) as of the last sync",
+	}, []string{"task"})
+)
+
+// Keys of the shared state in Redis (after the key prefix)
+const (
+	// membersKey is the hash of the members' heartbeats by id
+	membersKey = "members"
+	// valuesKey is the hash of the shared values by key
+	valuesKey = "values"
+	// leasePrefix prefixes the keys of the leases, holding the id of their
+	// holder until they expire
+	leasePrefix = "lease:"
+)
+
+var (
+	// acquireScript acquires (or renews) the lease of KEYS[1] for the proxy
+	// ARGV[1] for ARGV[2] milliseconds, returning 1 if the proxy holds it
+	acquireScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return 1
+end
+return 0`)
+	// releaseScript releases the lease of KEYS[1] if held by the proxy ARGV[1]
+	releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+)
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &ClusterPlugin{
+			conf: ClusterPluginConfig{
+				KeyPrefix:     "mongoproxy:cluster:",
+				SyncInterval:  "5s",
+				MemberTimeout: "30s",
+			},
+		}
+	})
+}
+
+type ClusterPluginConfig struct {
+	// RedisURL is the Redis the shared state is kept in (e.g.
+	// "redis://:password@host:6379/0", or "rediss://" for TLS)
+	RedisURL string `bson:"redisURL"`
+	// KeyPrefix prefixes the keys of the shared state (default
+	// "mongoproxy:cluster:"); proxies using the same Redis and prefix are a fleet
+	KeyPrefix string `bson:"keyPrefix"`
+	// SyncInterval is how often the proxy heartbeats and reads the shared state
+	// (default "5s")
+	SyncInterval string `bson:"syncInterval"`
+	// MemberTimeout is how long after its last heartbeat a proxy is considered
+	// gone, and how long leases are held without being renewed (default "30s")
+	MemberTimeout string `bson:"memberTimeout"`
+
+	syncInterval  time.Duration
+	memberTimeout time.Duration
+}
+
+// Member is a live proxy of the fleet
+type Member struct {
+	ID        string    `json:"id" bson:"-"`
+	Host      string    `json:"host" bson:"host"`
+	Heartbeat time.Time `json:"heartbeat" bson:"heartbeat"`
+}
+
+// Lease is the leadership of a singleton task
+type Lease struct {
+	Task    string    `json:"task"`
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// This is a plugin that shares state between the proxies of a fleet through
+// Redis (see plugins.Coordinator)
+type ClusterPlugin struct {
+	conf   ClusterPluginConfig
+	id     string
+	opts   *redis.Options
+	client *redis.Client
+
+	l       sync.RWMutex
+	members []Member
+	values  map[string]interface{}
+	leases  []Lease
+	// leading are the singleton tasks asked about, and whether the proxy leads them
+	leading map[string]bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (p *ClusterPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *ClusterPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	if p.conf.RedisURL == "" {
+		return fmt.Errorf("redisURL is required")
+	}
+	if p.opts, err = redis.ParseURL(p.conf.RedisURL); err != nil {
+		return fmt.Errorf("invalid redisURL: %w", err)
+	}
+	if p.conf.syncInterval, err = time.ParseDuration(p.conf.SyncInterval); err != nil {
+		return fmt.Errorf("invalid syncInterval: %w", err)
+	}
+	if p.conf.syncInterval <= 0 {
+		return fmt.Errorf("syncInterval must be positive: %s", p.conf.SyncInterval)
+	}
+	if p.conf.memberTimeout, err = time.ParseDuration(p.conf.MemberTimeout); err != nil {
+		return fmt.Errorf("invalid memberTimeout: %w", err)
+	}
+	if p.conf.memberTimeout <= p.conf.syncInterval {
+		return fmt.Errorf("memberTimeout (%s) must be longer than syncInterval (%s)", p.conf.MemberTimeout, p.conf.SyncInterval)
+	}
+
+	host, _ := os.Hostname()
+	p.id = fmt.Sprintf("%s-%d-%x", host, os.Getpid(), time.Now().UnixNano())
+	p.values = make(map[string]interface{})
+	p.leading = make(map[string]bool)
+
+	return nil
+}
+
+func (p *ClusterPlugin) key(k string) string { return p.conf.KeyPrefix + k }
+
+// acquire acquires (or renews) the lease of the task; it returns whether the
+// proxy holds it
+func (p *ClusterPlugin) acquire(ctx context.Context, task string) (bool, error) {
+	held, err := acquireScript.Run(ctx, p.client, []string{p.key(leasePrefix + task)}, p.id, p.conf.memberTimeout.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return held == 1, nil
+}
+
+// readLeases returns the leases held (of any task), which expire by the clock of
+// Redis (now)
+func (p *ClusterPlugin) readLeases(ctx context.Context, now time.Time) ([]Lease, error) {
+	var leases []Lease
+	prefix := p.key(leasePrefix)
+	iter := p.client.Scan(ctx, 0, prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		holder, err := p.client.Get(ctx, key).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ttl, err := p.client.PTTL(ctx, key).Result()
+		if err != nil {
+			return nil, err
+		}
+		leases = append(leases, Lease{Task: strings.TrimPrefix(key, prefix), Holder: holder, Expires: now.Add(ttl)})
+	}
+	return leases, iter.Err()
+}
+
+// sync heartbeats, renews the leases and reads the members, shared values and
+// leases from Redis
+func (p *ClusterPlugin) sync(ctx context.Context) (err error) {
+	defer func() {
+		syncTotal.WithLabelValues(fmt.Sprint(err == nil)).Inc()
+		if err != nil {
+			// Without Redis the leases can't be renewed
+			p.l.Lock()
+			for task := range p.leading {
+				p.leading[task] = false
+				leaderGauge.WithLabelValues(task).Set(0)
+			}
+			p.l.Unlock()
+		}
+	}()
+
+	// Heartbeats use the clock of Redis so the proxies' clocks needn't agree
+	now, err := p.client.Time(ctx).Result()
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	heartbeat, err := bson.Marshal(Member{Host: host, Heartbeat: now})
+	if err != nil {
+		return err
+	}
+	if err := p.client.HSet(ctx, p.key(membersKey), p.id, heartbeat).Err(); err != nil {
+		return err
+	}
+
+	p.l.RLock()
+	tasks := make([]string, 0, len(p.leading))
+	for task := range p.leading {
+		tasks = append(tasks, task)
+	}
+	p.l.RUnlock()
+	leading := make(map[string]bool, len(tasks))
+	for _, task := range tasks {
+		if leading[task], err = p.acquire(ctx, task); err != nil {
+			return err
+		}
+	}
+
+	heartbeats, err := p.client.HGetAll(ctx, p.key(membersKey)).Result()
+	if err != nil {
+		return err
+	}
+	var (
+		members []Member
+		gone    []string
+	)
+	for id, b := range heartbeats {
+		m := Member{ID: id}
+		if err := bson.Unmarshal([]byte(b), &m); err != nil {
+			logrus.Warningf("invalid heartbeat of cluster member %s: %v", id, err)
+		}
+		if now.Sub(m.Heartbeat) < p.conf.memberTimeout {
+			members = append(members, m)
+		} else {
+			gone = append(gone, id)
+		}
+	}
+	if len(gone) > 0 {
+		if err := p.client.HDel(ctx, p.key(membersKey), gone...).Err(); err != nil {
+			return err
+		}
+	}
+
+	encoded, err := p.client.HGetAll(ctx, p.key(valuesKey)).Result()
+	if err != nil {
+		return err
+	}
+	values := make(map[string]interface{}, len(encoded))
+	for key, b := range encoded {
+		var doc bson.D
+		if err := bson.Unmarshal([]byte(b), &doc); err != nil {
+			logrus.Warningf("invalid cluster value %s: %v", key, err)
+			continue
+		}
+		values[key], _ = bsonutil.Lookup(doc, "value")
+	}
+
+	leases, err := p.readLeases(ctx, now)
+	if err != nil {
+		return err
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	sort.Slice(leases, func(i, j int) bool { return leases[i].Task < leases[j].Task })
+
+	p.l.Lock()
+	p.members = members
+	p.values = values
+	p.leases = leases
+	for task, leader := range leading {
+		p.leading[task] = leader
+		if leader {
+			leaderGauge.WithLabelValues(task).Set(1)
+		} else {
+			leaderGauge.WithLabelValues(task).Set(0)
+		}
+	}
+	p.l.Unlock()
+	membersGauge.Set(float64(p.Members()))
+	return nil
+}
+
+// Start connects to Redis and starts syncing with the fleet every syncInterval
+func (p *ClusterPlugin) Start(ctx context.Context) error {
+	p.client = redis.NewClient(p.opts)
+	p.stop = make(chan struct{})
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(p.conf.syncInterval)
+		defer ticker.Stop()
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), p.conf.syncInterval)
+			if err := p.sync(ctx); err != nil {
+				logrus.Errorf("Error syncing the cluster state: %v", err)
+			}
+			cancel()
+
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// WarmUp syncs with the fleet so its state is known before the proxy is ready
+func (p *ClusterPlugin) WarmUp(ctx context.Context) error {
+	return p.sync(ctx)
+}
+
+// Stop stops syncing and leaves the fleet, releasing its leases
+func (p *ClusterPlugin) Stop(ctx context.Context) error {
+	if p.stop == nil {
+		return nil
+	}
+	close(p.stop)
+	p.wg.Wait()
+	defer p.client.Close()
+
+	if err := p.client.HDel(ctx, p.key(membersKey), p.id).Err(); err != nil {
+		return err
+	}
+	p.l.RLock()
+	tasks := make([]string, 0, len(p.leading))
+	for task := range p.leading {
+		tasks = append(tasks, task)
+	}
+	p.l.RUnlock()
+	for _, task := range tasks {
+		if err := releaseScript.Run(ctx, p.client, []string{p.key(leasePrefix + task)}, p.id).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Members returns the number of live proxies as of the last sync (1 before the
+// first one)
+func (p *ClusterPlugin) Members() int {
+	p.l.RLock()
+	defer p.l.RUnlock()
+	if len(p.members) == 0 {
+		return 1
+	}
+	return len(p.members)
+}
+
+// Value returns the shared value of the key as of the last sync
+func (p *ClusterPlugin) Value(key string) (interface{}, bool) {
+	p.l.RLock()
+	defer p.l.RUnlock()
+	v, ok := p.values[key]
+	return v, ok
+}
+
+// SetValue sets the shared value of the key in Redis (and locally; the other
+// proxies see it after their next sync)
+func (p *ClusterPlugin) SetValue(ctx context.Context, key string, value interface{}) error {
+	if value == nil {
+		if err := p.client.HDel(ctx, p.key(valuesKey), key).Err(); err != nil {
+			return err
+		}
+	} else {
+		// Values are kept as BSON so they keep their types
+		b, err := bson.Marshal(bson.D{{"value", value}})
+		if err != nil {
+			return err
+		}
+		if err := p.client.HSet(ctx, p.key(valuesKey), key, b).Err(); err != nil {
+			return err
+		}
+	}
+
+	p.l.Lock()
+	defer p.l.Unlock()
+	if value == nil {
+		delete(p.values, key)
+	} else {
+		p.values[key] = value
+	}
+	return nil
+}
+
+// Leader returns whether the proxy leads the task as of the last sync; the lease
+// of a task is acquired from the sync after it's first asked about
+func (p *ClusterPlugin) Leader(task string) bool {
+	p.l.RLock()
+	leader, ok := p.leading[task]
+	p.l.RUnlock()
+	if !ok {
+		p.l.Lock()
+		if _, ok := p.leading[task]; !ok {
+			p.leading[task] = false
+		}
+		p.l.Unlock()
+	}
+	return leader
+}
+
+// Stats returns the fleet size (for serverStatus)
+func (p *ClusterPlugin) Stats() bson.D {
+	return bson.D{{"members", p.Members()}}
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *ClusterPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	return next(ctx, r)
+}
+
+// AdminHandler serves the members of the fleet, the leases of the singleton tasks
+// and the shared values (as
+// {"value": ...}); values are set with a PUT of their JSON and unset with a DELETE
+func (p *ClusterPlugin) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/members", func(w http.ResponseWriter, r *http.Request) {
+		p.l.RLock()
+		members := append([]Member{}, p.members...)
+		p.l.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(members)
+	})
+	mux.HandleFunc("/leases", func(w http.ResponseWriter, r *http.Request) {
+		p.l.RLock()
+		leases := append([]Lease{}, p.leases...)
+		p.l.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(leases)
+	})
+	mux.HandleFunc("/values/", func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/values/")
+		if key == "" {
+			http.Error(w, "missing key", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			v, ok := p.Value(key)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			b, err := bson.MarshalExtJSON(bson.D{{"value", v}}, false, false)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		case http.MethodPut, http.MethodDelete:
+			var v interface{}
+			if r.Method == http.MethodPut {
+				if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if err := p.SetValue(r.Context(), key, v); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
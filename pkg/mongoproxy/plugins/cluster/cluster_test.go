@@ -0,0 +1,232 @@
+package cluster
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+// newPlugin returns a plugin connected to the Redis (without syncing in the
+// background, so the tests sync explicitly)
+func newPlugin(t *testing.T, mr *miniredis.Miniredis) *ClusterPlugin {
+	pl, _ := plugins.GetPlugin(Name)
+	p := pl.(*ClusterPlugin)
+	if err := p.Configure(bson.D{{"redisURL", "redis://" + mr.Addr()}, {"syncInterval", "1h"}, {"memberTimeout", "2h"}}); err != nil {
+		t.Fatal(err)
+	}
+	p.client = redis.NewClient(p.opts)
+	p.stop = make(chan struct{})
+	return p
+}
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		config bson.D
+		ok     bool
+	}{
+		{bson.D{{"redisURL", "redis://localhost:6379/0"}}, true},
+		{bson.D{{"redisURL", "rediss://:secret@localhost:6379"}, {"keyPrefix", "fleet:"}}, true},
+		{bson.D{}, false},
+		{bson.D{{"redisURL", "http://localhost"}}, false},
+		{bson.D{{"redisURL", "redis://localhost"}, {"memberTimeout", "1s"}}, false},
+	}
+	for i, test := range tests {
+		pl, _ := plugins.GetPlugin(Name)
+		if err := pl.Configure(test.config); (err == nil) != test.ok {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestCluster(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	now := time.Now()
+	mr.SetTime(now)
+	a, c := newPlugin(t, mr), newPlugin(t, mr)
+	if a.id == c.id {
+		t.Fatalf("expected the proxies to have different ids")
+	}
+
+	if a.Members() != 1 {
+		t.Fatalf("expected 1 member before the first sync, got %d", a.Members())
+	}
+	for _, p := range []*ClusterPlugin{a, c, a} {
+		if err := p.sync(context.TODO()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a.Members() != 2 {
+		t.Fatalf("expected 2 members, got %d", a.Members())
+	}
+
+	// Values are shared after a sync
+	if err := c.SetValue(context.TODO(), "denylist", bson.A{"db.coll"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.Value("denylist"); ok {
+		t.Fatalf("expected the value to be seen after the next sync")
+	}
+	if err := a.sync(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := a.Value("denylist"); !ok || len(v.(bson.A)) != 1 {
+		t.Fatalf("expected the shared value, got %v", v)
+	}
+	if err := c.SetValue(context.TODO(), "denylist", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.sync(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.Value("denylist"); ok {
+		t.Fatalf("expected the value to be unset")
+	}
+
+	// A proxy which stops heartbeating leaves the fleet after the member timeout
+	// (by the clock of Redis)
+	mr.SetTime(now.Add(3 * time.Hour))
+	if err := a.sync(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if a.Members() != 1 {
+		t.Fatalf("expected 1 member after c timed out, got %d", a.Members())
+	}
+	// And one which stops leaves right away
+	if err := c.sync(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Stop(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if members, err := mr.HKeys(a.key(membersKey)); err != nil || len(members) != 1 || members[0] != a.id {
+		t.Fatalf("expected only a's heartbeat, got %v %v", members, err)
+	}
+}
+
+func TestLeader(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	a, c := newPlugin(t, mr), newPlugin(t, mr)
+	sync := func(p *ClusterPlugin) {
+		if err := p.sync(context.TODO()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Leases are acquired from the sync after the task is asked about
+	if a.Leader("task") || c.Leader("task") {
+		t.Fatalf("expected no leader before a sync")
+	}
+	sync(a)
+	sync(c)
+	if !a.Leader("task") || c.Leader("task") {
+		t.Fatalf("expected a to lead")
+	}
+	if len(c.leases) != 1 || c.leases[0].Holder != a.id {
+		t.Fatalf("expected a's lease to be listed, got %v", c.leases)
+	}
+	// The leader renews its lease
+	mr.FastForward(time.Hour)
+	sync(a)
+	mr.FastForward(90 * time.Minute)
+	sync(c)
+	if !a.Leader("task") || c.Leader("task") {
+		t.Fatalf("expected a to still lead")
+	}
+	// Once a stops renewing it another proxy takes over
+	mr.FastForward(time.Hour)
+	sync(c)
+	if !c.Leader("task") {
+		t.Fatalf("expected c to lead once a's lease expired")
+	}
+	sync(a)
+	if a.Leader("task") {
+		t.Fatalf("expected a to have lost the lease")
+	}
+
+	// A proxy that stops releases its leases
+	if err := c.Stop(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	sync(a)
+	if !a.Leader("task") {
+		t.Fatalf("expected a to lead once c stopped")
+	}
+
+	// Without Redis the leases can't be renewed
+	mr.Close()
+	if err := a.sync(context.TODO()); err == nil {
+		t.Fatal("expected the sync to fail")
+	}
+	if a.Leader("task") {
+		t.Fatalf("expected a to stop leading")
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	p := newPlugin(t, mr)
+	srv := httptest.NewServer(p.AdminHandler())
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/values/breaker", strings.NewReader(`{"open": true}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	if v := mr.HGet(p.key(valuesKey), "breaker"); v == "" {
+		t.Fatalf("expected the value to be stored in Redis")
+	}
+
+	resp, err = http.Get(srv.URL + "/values/breaker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bson.D
+	if err := bson.UnmarshalExtJSON(b, false, &body); err != nil {
+		t.Fatal(err)
+	}
+	if open, _ := bsonutil.Lookup(body, "value", "open"); open != true {
+		t.Fatalf("expected the value to be served, got %v", body)
+	}
+
+	resp, err = http.Get(srv.URL + "/values/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", resp.StatusCode)
+	}
+}
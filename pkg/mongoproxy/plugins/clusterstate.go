@@ -0,0 +1,58 @@
+package plugins
+
+import "time"
+
+// ClusterState is the state of a backend cluster as reported by the service
+// hosting it (e.g. the atlas plugin)
+type ClusterState struct {
+	// Tier is the size of the cluster's instances (e.g. "M30")
+	Tier string
+	// Maintenance is set during the cluster's maintenance window, and while its
+	// maintenance is pending to start as soon as possible
+	Maintenance bool
+	// Changing is set while the cluster's topology changes (e.g. scaling to
+	// another tier or replacing a node)
+	Changing bool
+	// NextMaintenance is the start of the next maintenance window (zero if unknown)
+	NextMaintenance time.Time
+}
+
+// Degraded returns whether the cluster is expected to be degraded: its members
+// may restart or be replaced, so requests may be slower or fail over
+func (s ClusterState) Degraded() bool {
+	return s.Maintenance || s.Changing
+}
+
+// ClusterStateProvider is an optional interface a Plugin can implement to report
+// the state of the backend clusters, so that other plugins adapt to it (e.g. the
+// router sends reads to other clusters while one is degraded)
+type ClusterStateProvider interface {
+	// ClusterState returns the state of the cluster (by its name in the router
+	// plugin, or "" for the backend of a chain without one), and false if unknown
+	ClusterState(cluster string) (ClusterState, bool)
+}
+
+// ClusterStateUser is an optional interface a Plugin can implement to be passed
+// the ClusterStateProvider of its chain (the first plugin implementing
+// ClusterStateProvider) when the chain is built, like CoordinatorUser; it is
+// passed nil if the chain has none.
+type ClusterStateUser interface {
+	SetClusterStateProvider(ClusterStateProvider)
+}
+
+// SetClusterStateProviders passes the first ClusterStateProvider in the plugins
+// to all the plugins implementing ClusterStateUser
+func SetClusterStateProviders(ps []Plugin) {
+	var c ClusterStateProvider
+	for _, p := range ps {
+		if cp, ok := Unwrap(p).(ClusterStateProvider); ok {
+			c = cp
+			break
+		}
+	}
+	for _, p := range ps {
+		if u, ok := Unwrap(p).(ClusterStateUser); ok {
+			u.SetClusterStateProvider(c)
+		}
+	}
+}
@@ -0,0 +1,444 @@
+package compat
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "compat"
+
+var (
+	featuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_compat_features_total",
+		Help: "The total unsupported features in requests by result (rewritten, rejected)",
+	}, []string{"feature", "result"})
+	errorCodesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_compat_error_codes_total",
+		Help: "The total backend error codes mapped by the profile",
+	}, []string{"from", "to"})
+)
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &CompatPlugin{
+			conf: CompatPluginConfig{
+				Rewrite: true,
+			},
+		}
+	})
+}
+
+// Profile is the capabilities of a backend
+type Profile struct {
+	// MaxWireVersion is the wire version of the backend; features introduced
+	// later are unsupported (default detected from the backend when started)
+	MaxWireVersion int32 `bson:"maxWireVersion"`
+	// UnsupportedCommands are commands the backend doesn't support
+	UnsupportedCommands []string `bson:"unsupportedCommands"`
+	// UnsupportedStages are aggregation stages the backend doesn't support
+	UnsupportedStages []string `bson:"unsupportedStages"`
+	// UnsupportedOperators are query operators the backend doesn't support
+	UnsupportedOperators []string `bson:"unsupportedOperators"`
+	// UnsupportedOptions are command options ("{command}.{option}", e.g.
+	// "find.allowDiskUse") the backend doesn't support
+	UnsupportedOptions []string `bson:"unsupportedOptions"`
+	// ErrorCodes map the error codes of the backend to the codes mongo uses
+	ErrorCodes []ErrorCodeMapping `bson:"errorCodes"`
+	// Hello are fields set in the proxy's isMaster/hello response (a null value
+	// removes the field) so drivers only use what the backend supports
+	Hello bson.D `bson:"hello"`
+}
+
+// ErrorCodeMapping maps an error code of the backend to another code
+type ErrorCodeMapping struct {
+	From int32 `bson:"from"`
+	To   int32 `bson:"to"`
+}
+
+type CompatPluginConfig struct {
+	// Profile is the name of a built-in profile (documentdb, cosmosdb, ferretdb)
+	// the fields below are added to
+	Profile string `bson:"profile"`
+	// Capabilities are the capabilities of the backend
+	Capabilities Profile `bson:",inline"`
+	// Rewrite rewrites unsupported features with a supported equivalent (e.g. $set
+	// to $addFields) instead of rejecting them (default true)
+	Rewrite bool `bson:"rewrite"`
+
+	unsupportedCommands, unsupportedStages   map[string]struct{}
+	unsupportedOperators, unsupportedOptions map[string]struct{}
+	errorCodes                               map[int32]int32
+	// profile is the built-in profile merged with the capabilities
+	profile Profile
+}
+
+func toSet(items []string) map[string]struct{} {
+	m := make(map[string]struct{}, len(items))
+	for _, item := range items {
+		m[item] = struct{}{}
+	}
+	return m
+}
+
+// This is a plugin that adapts requests to the capabilities of the backend (older
+// mongo versions or mongo compatible databases): unsupported features are
+// rewritten into supported equivalents or rejected with an error listing them
+type CompatPlugin struct {
+	conf CompatPluginConfig
+
+	lock        sync.RWMutex
+	cr          plugins.CommandRunner
+	wireVersion int32
+}
+
+func (p *CompatPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *CompatPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	p.conf.profile = p.conf.Capabilities
+	if p.conf.Profile != "" {
+		profile, ok := Profiles[p.conf.Profile]
+		if !ok {
+			return fmt.Errorf("unknown profile %q", p.conf.Profile)
+		}
+		p.conf.profile = profile.merge(p.conf.Capabilities)
+	}
+	profile := &p.conf.profile
+
+	if profile.MaxWireVersion < 0 {
+		return fmt.Errorf("invalid maxWireVersion: %d", profile.MaxWireVersion)
+	}
+	for _, option := range profile.UnsupportedOptions {
+		if parts := strings.Split(option, "."); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("invalid option %q; must be {command}.{option}", option)
+		}
+	}
+	p.conf.unsupportedCommands = toSet(profile.UnsupportedCommands)
+	p.conf.unsupportedStages = toSet(profile.UnsupportedStages)
+	p.conf.unsupportedOperators = toSet(profile.UnsupportedOperators)
+	p.conf.unsupportedOptions = toSet(profile.UnsupportedOptions)
+	p.conf.errorCodes = make(map[int32]int32, len(profile.ErrorCodes))
+	for _, m := range profile.ErrorCodes {
+		if !mongoerror.ErrorCode(m.To).Known() {
+			return fmt.Errorf("unknown error code to map %d to", m.To)
+		}
+		p.conf.errorCodes[m.From] = m.To
+	}
+	p.wireVersion = profile.MaxWireVersion
+
+	return nil
+}
+
+// SetCommandRunner sets the runner used to detect the wire version of the backend
+func (p *CompatPlugin) SetCommandRunner(cr plugins.CommandRunner) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.cr = cr
+}
+
+// Start detects the wire version of the backend (unless configured); if it can't
+// be detected only the configured unsupported features are handled
+func (p *CompatPlugin) Start(ctx context.Context) error {
+	if p.conf.profile.MaxWireVersion > 0 {
+		return nil
+	}
+	cr := p.commandRunner()
+	if cr == nil {
+		logrus.Warningf("Compat: no backend to detect the wire version from")
+		return nil
+	}
+
+	hello, err := cr.RunCommand(ctx, "admin", bson.D{{"isMaster", 1}})
+	if err != nil {
+		logrus.Warningf("Compat: error detecting the backend wire version: %v", err)
+		return nil
+	}
+	v, _ := bsonutil.Lookup(hello, "maxWireVersion")
+	switch v := v.(type) {
+	case int32:
+		p.setWireVersion(v)
+	case int64:
+		p.setWireVersion(int32(v))
+	}
+	logrus.Infof("Compat: backend wire version %d", p.getWireVersion())
+	return nil
+}
+
+func (p *CompatPlugin) commandRunner() plugins.CommandRunner {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.cr
+}
+
+// ServerInfo returns the server info of the backend with the hello fields of the
+// profile set in the proxy's handshake
+func (p *CompatPlugin) ServerInfo(ctx context.Context) (*plugins.ServerInfo, error) {
+	cr := p.commandRunner()
+	if cr == nil {
+		return nil, fmt.Errorf("no backend to get the server info from")
+	}
+	buildInfo, err := cr.RunCommand(ctx, "admin", bson.D{{"buildInfo", 1}})
+	if err != nil {
+		return nil, err
+	}
+	hello, err := cr.RunCommand(ctx, "admin", bson.D{{"isMaster", 1}})
+	if err != nil {
+		return nil, err
+	}
+	return &plugins.ServerInfo{BuildInfo: buildInfo, Hello: hello, HelloOverrides: p.conf.profile.Hello}, nil
+}
+
+func (p *CompatPlugin) setWireVersion(v int32) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.wireVersion = v
+}
+
+func (p *CompatPlugin) getWireVersion() int32 {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.wireVersion
+}
+
+// checker finds (and rewrites) the unsupported features of a request
+type checker struct {
+	conf        *CompatPluginConfig
+	wireVersion int32
+	// unsupported are the features that couldn't be rewritten
+	unsupported map[string]struct{}
+	// rewritten is whether options were removed from the command
+	rewritten bool
+}
+
+// supported returns whether the feature is supported by the backend
+func (c *checker) supported(name string, f feature, hasFeature bool, configured map[string]struct{}) bool {
+	if _, ok := configured[name]; ok {
+		return false
+	}
+	return !hasFeature || c.wireVersion == 0 || f.minWireVersion <= c.wireVersion
+}
+
+func (c *checker) reject(name string) {
+	c.unsupported[name] = struct{}{}
+	featuresTotal.WithLabelValues(name, "rejected").Inc()
+}
+
+// option removes the option if it is set and unsupported (or rejects it if not
+// rewriting)
+func (c *checker) option(name string, set bool, remove func()) {
+	if !set {
+		return
+	}
+	f, ok := options[name]
+	if c.supported(name, f, ok, c.conf.unsupportedOptions) {
+		return
+	}
+	if c.conf.Rewrite {
+		remove()
+		c.rewritten = true
+		featuresTotal.WithLabelValues(name, "rewritten").Inc()
+		return
+	}
+	c.reject(name)
+}
+
+// operators finds the unsupported query operators in the value
+func (c *checker) operators(v interface{}) {
+	switch v := v.(type) {
+	case bson.D:
+		for _, e := range v {
+			if strings.HasPrefix(e.Key, "$") {
+				f, ok := operators[e.Key]
+				if !c.supported(e.Key, f, ok, c.conf.unsupportedOperators) {
+					c.reject(e.Key)
+				}
+			}
+			c.operators(e.Value)
+		}
+	case primitive.A:
+		for _, item := range v {
+			c.operators(item)
+		}
+	}
+}
+
+// pipeline rewrites the unsupported stages of the pipeline (and its sub-pipelines)
+func (c *checker) pipeline(pipeline primitive.A) {
+	for i, raw := range pipeline {
+		stageDoc, ok := raw.(bson.D)
+		if !ok || len(stageDoc) != 1 {
+			// The backend returns the error
+			continue
+		}
+		name := stageDoc[0].Key
+		if f, ok := stages[name]; !c.supported(name, f, ok, c.conf.unsupportedStages) {
+			rewritten, ok := bson.D(nil), false
+			if f.rewrite != nil && c.conf.Rewrite {
+				rewritten, ok = f.rewrite(stageDoc[0].Value)
+			}
+			if !ok {
+				c.reject(name)
+				continue
+			}
+			featuresTotal.WithLabelValues(name, "rewritten").Inc()
+			pipeline[i], stageDoc = rewritten, rewritten
+		}
+
+		spec, _ := stageDoc[0].Value.(bson.D)
+		switch stageDoc[0].Key {
+		case "$match":
+			c.operators(spec)
+		case "$lookup", "$unionWith":
+			for _, e := range spec {
+				if sub, ok := e.Value.(primitive.A); ok && e.Key == "pipeline" {
+					c.pipeline(sub)
+				}
+			}
+		case "$facet":
+			for _, e := range spec {
+				if sub, ok := e.Value.(primitive.A); ok {
+					c.pipeline(sub)
+				}
+			}
+		}
+	}
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *CompatPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	if _, ok := p.conf.unsupportedCommands[r.CommandName]; ok {
+		featuresTotal.WithLabelValues(r.CommandName, "rejected").Inc()
+		return mongoerror.CommandNotFound.ErrMessage(fmt.Sprintf("no such command: '%s' (not supported by the backend)", r.CommandName)), nil
+	}
+
+	c := &checker{conf: &p.conf, wireVersion: p.getWireVersion(), unsupported: make(map[string]struct{})}
+	switch cmd := r.Command.(type) {
+	case *command.Find:
+		c.operators(cmd.Filter)
+		c.option("find.allowDiskUse", cmd.AllowDiskUse != nil, func() { cmd.AllowDiskUse = nil })
+	case *command.Aggregate:
+		c.pipeline(cmd.Pipeline)
+	case *command.Count:
+		c.operators(cmd.Query)
+	case *command.Distinct:
+		c.operators(cmd.Query)
+	case *command.FindAndModify:
+		c.operators(cmd.Query)
+	case *command.Update:
+		for i := range cmd.Updates {
+			u := &cmd.Updates[i]
+			c.operators(u.Query)
+			c.option("update.hint", u.Hint != nil, func() { u.Hint = nil })
+		}
+		c.option("update.comment", cmd.Comment != nil, func() { cmd.Comment = nil })
+	case *command.Delete:
+		for i, deleteDoc := range cmd.Deletes {
+			q, _ := bsonutil.Lookup(deleteDoc, "q")
+			c.operators(q)
+			i := i
+			hint, _ := bsonutil.Lookup(deleteDoc, "hint")
+			c.option("delete.hint", hint != nil, func() { cmd.Deletes[i], _, _ = bsonutil.Pop(cmd.Deletes[i], "hint") })
+		}
+		c.option("delete.hint", cmd.Hint != nil, func() { cmd.Hint = nil })
+		c.option("delete.comment", cmd.Comment != nil, func() { cmd.Comment = nil })
+	}
+	if c.rewritten {
+		r.Modified()
+	}
+
+	if len(c.unsupported) > 0 {
+		unsupported := make([]string, 0, len(c.unsupported))
+		for name := range c.unsupported {
+			unsupported = append(unsupported, name)
+		}
+		sort.Strings(unsupported)
+		backend := "the backend"
+		if c.wireVersion > 0 {
+			backend = fmt.Sprintf("the backend (wire version %d)", c.wireVersion)
+		}
+		return mongoerror.CommandNotSupported.ErrMessage(fmt.Sprintf("%s doesn't support: %s", backend, strings.Join(unsupported, ", "))), nil
+	}
+
+	result, err := next(ctx, r)
+	if len(p.conf.errorCodes) > 0 {
+		p.mapErrorCodes(result)
+	}
+	return result, err
+}
+
+// mapErrorCodes maps the error codes of the response (including write errors)
+func (p *CompatPlugin) mapErrorCodes(result bson.D) {
+	mapCode := func(d bson.D) {
+		for i, e := range d {
+			if e.Key != "code" {
+				continue
+			}
+			var code int32
+			switch v := e.Value.(type) {
+			case int32:
+				code = v
+			case int64:
+				code = int32(v)
+			case float64:
+				code = int32(v)
+			default:
+				return
+			}
+			to, ok := p.conf.errorCodes[code]
+			if !ok {
+				return
+			}
+			d[i].Value = to
+			errorCodesTotal.WithLabelValues(strconv.Itoa(int(code)), strconv.Itoa(int(to))).Inc()
+			for j := range d {
+				if d[j].Key == "codeName" {
+					d[j].Value = mongoerror.ErrorCode(to).String()
+				}
+			}
+			return
+		}
+	}
+
+	mapCode(result)
+	for _, e := range result {
+		switch e.Key {
+		case "writeErrors":
+			writeErrors, _ := e.Value.(primitive.A)
+			for _, we := range writeErrors {
+				if we, ok := we.(bson.D); ok {
+					mapCode(we)
+				}
+			}
+		case "writeConcernError":
+			if wce, ok := e.Value.(bson.D); ok {
+				mapCode(wce)
+			}
+		}
+	}
+}
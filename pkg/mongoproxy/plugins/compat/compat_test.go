@@ -0,0 +1,224 @@
+package compat
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+type helloRunner struct {
+	wireVersion int32
+}
+
+func (r *helloRunner) RunCommand(ctx context.Context, db string, cmd bson.D) (bson.D, error) {
+	return bson.D{{"ismaster", true}, {"maxWireVersion", r.wireVersion}, {"ok", 1}}, nil
+}
+
+func TestCompat(t *testing.T) {
+	tests := []struct {
+		conf bson.D
+		cmd  bson.D
+		ok   bool
+		// substring of the error
+		err string
+		// expected command sent to the backend (nil to not check)
+		expected bson.D
+	}{
+		{
+			conf:     bson.D{{"maxWireVersion", WireVersion40}},
+			cmd:      bson.D{{"aggregate", "coll"}, {"pipeline", bson.A{bson.D{{"$set", bson.D{{"a", 1}}}}, bson.D{{"$unset", bson.A{"b", "c"}}}, bson.D{{"$replaceWith", "$d"}}}}, {"cursor", bson.D{}}, {"$db", "db"}},
+			ok:       true,
+			expected: bson.D{{"aggregate", "coll"}, {"pipeline", bson.A{bson.D{{"$addFields", bson.D{{"a", int64(1)}}}}, bson.D{{"$project", bson.D{{"b", int32(0)}, {"c", int32(0)}}}}, bson.D{{"$replaceRoot", bson.D{{"newRoot", "$d"}}}}}}, {"cursor", bson.D{}}, {"$db", "db"}},
+		},
+		// Supported stages are kept
+		{
+			conf:     bson.D{{"maxWireVersion", WireVersion42}},
+			cmd:      bson.D{{"aggregate", "coll"}, {"pipeline", bson.A{bson.D{{"$set", bson.D{{"a", 1}}}}}}, {"cursor", bson.D{}}, {"$db", "db"}},
+			ok:       true,
+			expected: bson.D{{"aggregate", "coll"}, {"pipeline", bson.A{bson.D{{"$set", bson.D{{"a", int64(1)}}}}}}, {"cursor", bson.D{}}, {"$db", "db"}},
+		},
+		{
+			conf: bson.D{{"maxWireVersion", WireVersion40}, {"rewrite", false}},
+			cmd:  bson.D{{"aggregate", "coll"}, {"pipeline", bson.A{bson.D{{"$set", bson.D{{"a", 1}}}}}}, {"cursor", bson.D{}}, {"$db", "db"}},
+			err:  "the backend (wire version 7) doesn't support: $set",
+		},
+		// Sub-pipelines are checked
+		{
+			conf: bson.D{{"maxWireVersion", WireVersion42}},
+			cmd:  bson.D{{"aggregate", "coll"}, {"pipeline", bson.A{bson.D{{"$facet", bson.D{{"a", bson.A{bson.D{{"$unionWith", "other"}}}}}}}}}, {"cursor", bson.D{}}, {"$db", "db"}},
+			err:  "doesn't support: $unionWith",
+		},
+		{
+			conf: bson.D{{"unsupportedOperators", bson.A{"$where", "$text"}}},
+			cmd:  bson.D{{"find", "coll"}, {"filter", bson.D{{"$or", bson.A{bson.D{{"$where", "true"}}, bson.D{{"$text", bson.D{{"$search", "a"}}}}}}}}, {"$db", "db"}},
+			err:  "the backend doesn't support: $text, $where",
+		},
+		{
+			conf:     bson.D{{"maxWireVersion", WireVersion42}},
+			cmd:      bson.D{{"find", "coll"}, {"filter", bson.D{{"$expr", bson.D{{"$gt", bson.A{"$a", "$b"}}}}}}, {"allowDiskUse", true}, {"$db", "db"}},
+			ok:       true,
+			expected: bson.D{{"find", "coll"}, {"filter", bson.D{{"$expr", bson.D{{"$gt", bson.A{"$a", "$b"}}}}}}, {"$db", "db"}},
+		},
+		{
+			conf:     bson.D{{"maxWireVersion", WireVersion42}},
+			cmd:      bson.D{{"delete", "coll"}, {"deletes", bson.A{bson.D{{"q", bson.D{{"a", 1}}}, {"limit", 1}, {"hint", "a_1"}}}}, {"$db", "db"}},
+			ok:       true,
+			expected: bson.D{{"delete", "coll"}, {"deletes", bson.A{bson.D{{"q", bson.D{{"a", int64(1)}}}, {"limit", int64(1)}}}}, {"$db", "db"}},
+		},
+		{
+			conf: bson.D{{"unsupportedCommands", bson.A{"mapReduce"}}},
+			cmd:  bson.D{{"mapReduce", "coll"}, {"map", "function() {}"}, {"reduce", "function() {}"}, {"out", bson.D{{"inline", 1}}}, {"$db", "db"}},
+			err:  "no such command: 'mapReduce'",
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			pl, _ := plugins.GetPlugin(Name)
+			d := pl.(*CompatPlugin)
+			if err := d.Configure(test.conf); err != nil {
+				t.Fatal(err)
+			}
+
+			var last command.Command
+			p := plugins.BuildPipeline([]plugins.Plugin{d}, func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+				last = r.Command
+				return bson.D{{"ok", 1}}, nil
+			})
+
+			cmd, ok := command.GetCommand(test.cmd[0].Key)
+			if !ok {
+				t.Fatalf("no such command: %s", test.cmd[0].Key)
+			}
+			if err := cmd.FromBSOND(test.cmd); err != nil {
+				t.Fatal(err)
+			}
+			result, err := p(context.TODO(), &plugins.Request{CommandName: test.cmd[0].Key, Command: cmd})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.err != "" {
+				errmsg, _ := bsonutil.Lookup(result, "errmsg")
+				if s, _ := errmsg.(string); !strings.Contains(s, test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, result)
+				}
+				return
+			}
+			if !bsonutil.Ok(result) {
+				t.Fatalf("unexpected error: %v", result)
+			}
+			if test.expected != nil {
+				b1, _ := bson.MarshalExtJSON(last, false, false)
+				b2, _ := bson.MarshalExtJSON(test.expected, false, false)
+				if string(b1) != string(b2) {
+					t.Fatalf("mismatch\nexpected=%s\nactual=%s", b2, b1)
+				}
+			}
+		})
+	}
+}
+
+func TestDetectWireVersion(t *testing.T) {
+	pl, _ := plugins.GetPlugin(Name)
+	d := pl.(*CompatPlugin)
+	if err := d.Configure(bson.D{}); err != nil {
+		t.Fatal(err)
+	}
+	plugins.SetCommandRunners([]plugins.Plugin{d})
+	// Without a backend nothing is unsupported
+	if err := d.Start(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if v := d.getWireVersion(); v != 0 {
+		t.Fatalf("expected no wire version, got %d", v)
+	}
+
+	d.SetCommandRunner(&helloRunner{wireVersion: WireVersion44})
+	if err := d.Start(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if v := d.getWireVersion(); v != WireVersion44 {
+		t.Fatalf("expected wire version %d, got %d", WireVersion44, v)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	pl, _ := plugins.GetPlugin(Name)
+	d := pl.(*CompatPlugin)
+	conf := bson.D{
+		{"profile", "ferretdb"},
+		{"unsupportedStages", bson.A{"$sortByCount"}},
+		{"errorCodes", bson.A{bson.D{{"from", 1000}, {"to", 2}}}},
+		{"hello", bson.D{{"maxWireVersion", 13}}},
+	}
+	if err := d.Configure(conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Configure(bson.D{{"profile", "nope"}}); err == nil {
+		t.Fatalf("expected an error for an unknown profile")
+	}
+	if err := d.Configure(bson.D{{"errorCodes", bson.A{bson.D{{"from", 1000}, {"to", 999999}}}}}); err == nil {
+		t.Fatalf("expected an error for an unknown error code")
+	}
+	if err := d.Configure(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	var response bson.D
+	p := plugins.BuildPipeline([]plugins.Plugin{d}, func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+		return response, nil
+	})
+	run := func(cmd bson.D) bson.D {
+		c, _ := command.GetCommand(cmd[0].Key)
+		if err := c.FromBSOND(cmd); err != nil {
+			t.Fatal(err)
+		}
+		result, err := p(context.TODO(), &plugins.Request{CommandName: cmd[0].Key, Command: c})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	// The profile's and the configured stages are unsupported
+	result := run(bson.D{{"aggregate", "coll"}, {"pipeline", bson.A{bson.D{{"$facet", bson.D{}}}, bson.D{{"$sortByCount", "$a"}}}}, {"cursor", bson.D{}}, {"$db", "db"}})
+	if errmsg, _ := bsonutil.Lookup(result, "errmsg"); errmsg != "the backend doesn't support: $facet, $sortByCount" {
+		t.Fatalf("unexpected result: %v", result)
+	}
+
+	// Error codes are mapped
+	response = bson.D{{"ok", 0}, {"errmsg", "not implemented"}, {"code", int32(238)}, {"codeName", "NotImplemented"}}
+	result = run(bson.D{{"find", "coll"}, {"$db", "db"}})
+	if code, _ := bsonutil.Lookup(result, "code"); code != int32(115) {
+		t.Fatalf("unexpected result: %v", result)
+	}
+	if codeName, _ := bsonutil.Lookup(result, "codeName"); codeName != "CommandNotSupported" {
+		t.Fatalf("unexpected result: %v", result)
+	}
+	response = bson.D{{"n", 0}, {"writeErrors", bson.A{bson.D{{"index", 0}, {"code", int32(1000)}, {"errmsg", "bad"}}}}, {"ok", 1}}
+	result = run(bson.D{{"insert", "coll"}, {"documents", bson.A{bson.D{{"a", 1}}}}, {"$db", "db"}})
+	writeErrors, _ := bsonutil.Lookup(result, "writeErrors")
+	if code, _ := bsonutil.Lookup(writeErrors.(bson.A)[0].(bson.D), "code"); code != int32(2) {
+		t.Fatalf("unexpected result: %v", result)
+	}
+
+	// The hello fields of the profile are set in the handshake
+	d.SetCommandRunner(&helloRunner{wireVersion: 17})
+	info, err := d.ServerInfo(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.D{{"logicalSessionTimeoutMinutes", nil}, {"maxWireVersion", int64(13)}}
+	b1, _ := bson.MarshalExtJSON(bson.D{{"o", info.HelloOverrides}}, false, false)
+	b2, _ := bson.MarshalExtJSON(bson.D{{"o", expected}}, false, false)
+	if string(b1) != string(b2) {
+		t.Fatalf("mismatch\nexpected=%s\nactual=%s", b2, b1)
+	}
+}
@@ -0,0 +1,88 @@
+package compat
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Wire versions of the mongo releases introducing features
+const (
+	WireVersion36 = 6
+	WireVersion40 = 7
+	WireVersion42 = 8
+	WireVersion44 = 9
+	WireVersion50 = 13
+	WireVersion51 = 14
+	WireVersion53 = 16
+)
+
+// stageRewrite returns the equivalent of a stage supported by older backends
+type stageRewrite func(spec interface{}) (bson.D, bool)
+
+// feature is a feature only supported by backends since a wire version
+type feature struct {
+	minWireVersion int32
+	// rewrite is the rewrite of stages to a supported equivalent (nil if there is none)
+	rewrite stageRewrite
+}
+
+// stages are the aggregation stages introduced since 3.6
+var stages = map[string]feature{
+	"$set":             {WireVersion42, rewriteSet},
+	"$unset":           {WireVersion42, rewriteUnset},
+	"$replaceWith":     {WireVersion42, rewriteReplaceWith},
+	"$merge":           {WireVersion42, nil},
+	"$unionWith":       {WireVersion44, nil},
+	"$setWindowFields": {WireVersion50, nil},
+	"$densify":         {WireVersion51, nil},
+	"$documents":       {WireVersion51, nil},
+	"$fill":            {WireVersion53, nil},
+}
+
+// operators are the query operators introduced since 3.6
+var operators = map[string]feature{
+	"$expr":       {WireVersion36, nil},
+	"$jsonSchema": {WireVersion36, nil},
+}
+
+// Options are named "{command}.{option}"; unsupported options are removed from
+// the command when rewriting as they are only hints to the backend.
+var options = map[string]feature{
+	"find.allowDiskUse": {WireVersion44, nil},
+	"update.hint":       {WireVersion42, nil},
+	"delete.hint":       {WireVersion44, nil},
+	"update.comment":    {WireVersion44, nil},
+	"delete.comment":    {WireVersion44, nil},
+}
+
+// rewriteSet rewrites {$set: {...}} to its alias {$addFields: {...}}
+func rewriteSet(spec interface{}) (bson.D, bool) {
+	return bson.D{{"$addFields", spec}}, true
+}
+
+// rewriteUnset rewrites {$unset: ["a", "b"]} to {$project: {a: 0, b: 0}}
+func rewriteUnset(spec interface{}) (bson.D, bool) {
+	var fields []interface{}
+	switch spec := spec.(type) {
+	case string:
+		fields = []interface{}{spec}
+	case primitive.A:
+		fields = spec
+	default:
+		return nil, false
+	}
+	projection := make(bson.D, 0, len(fields))
+	for _, f := range fields {
+		s, ok := f.(string)
+		if !ok {
+			return nil, false
+		}
+		projection = append(projection, bson.E{s, int32(0)})
+	}
+	return bson.D{{"$project", projection}}, true
+}
+
+// rewriteReplaceWith rewrites {$replaceWith: x} to {$replaceRoot: {newRoot: x}}
+func rewriteReplaceWith(spec interface{}) (bson.D, bool) {
+	return bson.D{{"$replaceRoot", bson.D{{"newRoot", spec}}}}, true
+}
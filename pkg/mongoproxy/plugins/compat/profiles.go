@@ -0,0 +1,63 @@
+package compat
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+)
+
+// Profiles are the built-in profiles of mongo compatible databases. They list the
+// known gaps of the databases' mongo API; configured fields are added to them.
+var Profiles = map[string]Profile{
+	// Amazon DocumentDB (4.0 API)
+	"documentdb": {
+		MaxWireVersion:       WireVersion40,
+		UnsupportedCommands:  []string{"mapReduce", "eval"},
+		UnsupportedStages:    []string{"$graphLookup"},
+		UnsupportedOperators: []string{"$where"},
+		ErrorCodes: []ErrorCodeMapping{
+			// "Feature not supported"
+			{From: 303, To: int32(mongoerror.CommandNotSupported)},
+		},
+		Hello: bson.D{{"maxWireVersion", int32(WireVersion40)}},
+	},
+	// Azure Cosmos DB for MongoDB (4.2 API)
+	"cosmosdb": {
+		MaxWireVersion:       WireVersion42,
+		UnsupportedCommands:  []string{"mapReduce", "eval"},
+		UnsupportedStages:    []string{"$graphLookup", "$merge"},
+		UnsupportedOperators: []string{"$where"},
+		ErrorCodes: []ErrorCodeMapping{
+			// "Request rate is large": mapped to a code drivers retry
+			{From: 16500, To: int32(mongoerror.ExceededTimeLimit)},
+		},
+	},
+	// FerretDB (1.x)
+	"ferretdb": {
+		UnsupportedCommands:  []string{"mapReduce", "eval"},
+		UnsupportedStages:    []string{"$graphLookup", "$facet", "$bucketAuto"},
+		UnsupportedOperators: []string{"$where", "$jsonSchema", "$text"},
+		ErrorCodes: []ErrorCodeMapping{
+			// "not implemented" is returned for unsupported parameters
+			{From: int32(mongoerror.NotImplemented), To: int32(mongoerror.CommandNotSupported)},
+		},
+		// Sessions (and so retryable writes) aren't supported
+		Hello: bson.D{{"logicalSessionTimeoutMinutes", nil}},
+	},
+}
+
+// merge returns the profile with the fields of o added (o's maxWireVersion takes
+// precedence if set)
+func (p Profile) merge(o Profile) Profile {
+	if o.MaxWireVersion > 0 {
+		p.MaxWireVersion = o.MaxWireVersion
+	}
+	p.UnsupportedCommands = append(append([]string(nil), p.UnsupportedCommands...), o.UnsupportedCommands...)
+	p.UnsupportedStages = append(append([]string(nil), p.UnsupportedStages...), o.UnsupportedStages...)
+	p.UnsupportedOperators = append(append([]string(nil), p.UnsupportedOperators...), o.UnsupportedOperators...)
+	p.UnsupportedOptions = append(append([]string(nil), p.UnsupportedOptions...), o.UnsupportedOptions...)
+	// Later mappings and hello fields take precedence
+	p.ErrorCodes = append(append([]ErrorCodeMapping(nil), p.ErrorCodes...), o.ErrorCodes...)
+	p.Hello = append(append(bson.D(nil), p.Hello...), o.Hello...)
+	return p
+}
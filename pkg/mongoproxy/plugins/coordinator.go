@@ -0,0 +1,44 @@
+package plugins
+
+import "context"
+
+// Coordinator is an optional interface a Plugin can implement to share state
+// between the proxies of a fleet (e.g. the cluster plugin) so that limits and
+// policies are enforced consistently across them
+type Coordinator interface {
+	// Members returns the number of live proxies in the fleet (including this one)
+	Members() int
+	// Value returns the shared value of the key as of the last sync, and false if
+	// it isn't set
+	Value(key string) (interface{}, bool)
+	// SetValue sets the shared value of the key for all the proxies (nil unsets it)
+	SetValue(ctx context.Context, key string, value interface{}) error
+	// Leader returns whether this proxy leads the singleton task (see RunSingleton);
+	// leadership is acquired in the background once a task has been asked about
+	Leader(task string) bool
+}
+
+// CoordinatorUser is an optional interface a Plugin can implement to be passed
+// the Coordinator of its chain (the first plugin implementing Coordinator) when
+// the chain is built, like CommandRunnerUser; it is passed nil if the chain has
+// none, in which case the plugin should only enforce local state.
+type CoordinatorUser interface {
+	SetCoordinator(Coordinator)
+}
+
+// SetCoordinators passes the first Coordinator in the plugins to all the plugins
+// implementing CoordinatorUser
+func SetCoordinators(ps []Plugin) {
+	var c Coordinator
+	for _, p := range ps {
+		if co, ok := Unwrap(p).(Coordinator); ok {
+			c = co
+			break
+		}
+	}
+	for _, p := range ps {
+		if u, ok := Unwrap(p).(CoordinatorUser); ok {
+			u.SetCoordinator(c)
+		}
+	}
+}
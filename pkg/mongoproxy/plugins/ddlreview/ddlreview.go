@@ -0,0 +1,404 @@
+package ddlreview
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "ddlreview"
+
+var (
+	changesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_ddlreview_changes_total",
+		Help: "The total DDL changes held for approval, by the status they reached",
+	}, []string{"db", "collection", "command", "status"})
+	pendingGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongoproxy_plugins_ddlreview_pending",
+		Help: "The DDL changes pending approval",
+	})
+)
+
+// Statuses of a change
+const (
+	StatusPending  = "pending"
+	StatusApplied  = "applied"
+	StatusFailed   = "failed"
+	StatusRejected = "rejected"
+	StatusExpired  = "expired"
+)
+
+// reviewableCommands are the commands which can be held for approval
+var reviewableCommands = map[string]struct{}{
+	"createIndexes": {},
+	"dropIndexes":   {},
+	"collMod":       {},
+	"create":        {},
+	"drop":          {},
+	"dropDatabase":  {},
+}
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &DDLReviewPlugin{
+			conf: DDLReviewPluginConfig{
+				Commands:   []string{"createIndexes", "collMod", "create", "drop"},
+				Expiry:     "168h",
+				MaxPending: 100,
+			},
+		}
+	})
+}
+
+type DDLReviewPluginConfig struct {
+	// Commands are the commands held for approval; any of createIndexes, dropIndexes,
+	// collMod, create, drop and dropDatabase (default createIndexes, collMod, create, drop)
+	Commands []string `bson:"commands"`
+	// Expiry is how long changes wait for approval before they expire, and how long
+	// reviewed changes are kept (default "168h")
+	Expiry string `bson:"expiry"`
+	// MaxPending caps the changes pending approval; further changes are rejected
+	// (default 100)
+	MaxPending int `bson:"maxPending"`
+
+	commands map[string]struct{}
+	expiry   time.Duration
+}
+
+// Change is a DDL command held for approval
+type Change struct {
+	ID          int64           `json:"id"`
+	Database    string          `json:"database"`
+	Collection  string          `json:"collection,omitempty"`
+	CommandName string          `json:"commandName"`
+	Command     json.RawMessage `json:"command"`
+	AppName     string          `json:"appName,omitempty"`
+	User        string          `json:"user,omitempty"`
+	RequestedAt time.Time       `json:"requestedAt"`
+	Status      string          `json:"status"`
+	Reviewer    string          `json:"reviewer,omitempty"`
+	ReviewedAt  *time.Time      `json:"reviewedAt,omitempty"`
+	// Result is the backend's response to the applied command
+	Result json.RawMessage `json:"result,omitempty"`
+
+	cmd bson.D
+	key string
+}
+
+// This is a plugin that holds DDL commands until an operator approves them through
+// the admin API
+type DDLReviewPlugin struct {
+	conf DDLReviewPluginConfig
+
+	crLock sync.RWMutex
+	cr     plugins.CommandRunner
+
+	lock    sync.Mutex
+	nextID  int64
+	changes map[int64]*Change
+}
+
+func (p *DDLReviewPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *DDLReviewPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	p.conf.commands = make(map[string]struct{}, len(p.conf.Commands))
+	for _, c := range p.conf.Commands {
+		if _, ok := reviewableCommands[c]; !ok {
+			return fmt.Errorf("invalid command %q; must be one of createIndexes, dropIndexes, collMod, create, drop, dropDatabase", c)
+		}
+		p.conf.commands[c] = struct{}{}
+	}
+	if p.conf.expiry, err = time.ParseDuration(p.conf.Expiry); err != nil {
+		return err
+	}
+	if p.conf.expiry <= 0 {
+		return fmt.Errorf("expiry must be positive: %s", p.conf.Expiry)
+	}
+	if p.conf.MaxPending <= 0 {
+		return fmt.Errorf("maxPending must be positive: %d", p.conf.MaxPending)
+	}
+
+	p.changes = make(map[int64]*Change)
+
+	return nil
+}
+
+// SetCommandRunner sets the runner used to apply approved changes
+func (p *DDLReviewPlugin) SetCommandRunner(cr plugins.CommandRunner) {
+	p.crLock.Lock()
+	defer p.crLock.Unlock()
+	p.cr = cr
+}
+
+func (p *DDLReviewPlugin) commandRunner() plugins.CommandRunner {
+	p.crLock.RLock()
+	defer p.crLock.RUnlock()
+	return p.cr
+}
+
+// prune expires pending changes and drops reviewed changes older than the expiry;
+// the lock must be held
+func (p *DDLReviewPlugin) prune(now time.Time) {
+	var pending int
+	for id, c := range p.changes {
+		switch {
+		case c.Status == StatusPending && now.Sub(c.RequestedAt) > p.conf.expiry:
+			c.Status = StatusExpired
+			c.ReviewedAt = &now
+			changesTotal.WithLabelValues(c.Database, c.Collection, c.CommandName, StatusExpired).Inc()
+		case c.Status == StatusPending:
+			pending++
+		case now.Sub(*c.ReviewedAt) > p.conf.expiry:
+			delete(p.changes, id)
+		}
+	}
+	pendingGauge.Set(float64(pending))
+}
+
+// hold adds the command to the pending changes, returning the existing change if
+// the same command is already pending
+func (p *DDLReviewPlugin) hold(ctx context.Context, r *plugins.Request) (*Change, error) {
+	d, err := r.Document()
+	if err != nil {
+		return nil, err
+	}
+	// Drop the generic fields ($db, $readPreference, session, ...) which aren't part
+	// of the change
+	cmd := make(bson.D, 0, len(d))
+	for _, e := range d {
+		switch {
+		case strings.HasPrefix(e.Key, "$"), e.Key == "lsid", e.Key == "txnNumber", e.Key == "stmtIds":
+		default:
+			cmd = append(cmd, e)
+		}
+	}
+	js, err := bson.MarshalExtJSON(cmd, false, false)
+	if err != nil {
+		return nil, err
+	}
+
+	db := command.GetCommandDatabase(r.Command)
+	key := db + " " + string(js)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	p.prune(now)
+
+	var pending int
+	for _, c := range p.changes {
+		if c.Status != StatusPending {
+			continue
+		}
+		if c.key == key {
+			return c, nil
+		}
+		pending++
+	}
+	if pending >= p.conf.MaxPending {
+		return nil, fmt.Errorf("too many changes pending approval (%d)", pending)
+	}
+
+	p.nextID++
+	c := &Change{
+		ID:          p.nextID,
+		Database:    db,
+		Collection:  command.GetCommandCollection(r.Command),
+		CommandName: r.CommandName,
+		Command:     js,
+		RequestedAt: now,
+		Status:      StatusPending,
+		cmd:         cmd,
+		key:         key,
+	}
+	if r.CC != nil {
+		c.AppName = r.CC.AppName
+	}
+	if ident := plugins.GetMetadata(ctx).Identity(); ident != nil {
+		c.User = ident.User()
+	}
+	p.changes[c.ID] = c
+	pendingGauge.Set(float64(pending + 1))
+	changesTotal.WithLabelValues(c.Database, c.Collection, c.CommandName, StatusPending).Inc()
+	logrus.Infof("DDL CHANGE PENDING: change %d %s on %s.%s from appName %q user %q: %s",
+		c.ID, c.CommandName, c.Database, c.Collection, c.AppName, c.User, js)
+
+	return c, nil
+}
+
+// Changes returns the changes (oldest first), optionally filtered by status
+func (p *DDLReviewPlugin) Changes(status string) []*Change {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.prune(time.Now())
+
+	changes := make([]*Change, 0, len(p.changes))
+	for _, c := range p.changes {
+		if status == "" || c.Status == status {
+			cp := *c
+			changes = append(changes, &cp)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].ID < changes[j].ID })
+	return changes
+}
+
+// review takes the pending change for review, marking it with the status
+func (p *DDLReviewPlugin) review(id int64, status, reviewer string) (*Change, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	p.prune(now)
+
+	c, ok := p.changes[id]
+	if !ok {
+		return nil, fmt.Errorf("change %d not found", id)
+	}
+	if c.Status != StatusPending {
+		return nil, fmt.Errorf("change %d is %s", id, c.Status)
+	}
+	c.Status = status
+	c.Reviewer = reviewer
+	c.ReviewedAt = &now
+	cp := *c
+	return &cp, nil
+}
+
+// Approve applies the pending change on the backend, returning the change (with
+// the backend's error if it failed)
+func (p *DDLReviewPlugin) Approve(ctx context.Context, id int64, reviewer string) (*Change, error) {
+	cr := p.commandRunner()
+	if cr == nil {
+		return nil, fmt.Errorf("no backend to apply changes")
+	}
+	// Mark the change as applied first so it can't be applied twice
+	reviewed, err := p.review(id, StatusApplied, reviewer)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := cr.RunCommand(ctx, reviewed.Database, reviewed.cmd)
+	var js []byte
+	if len(result) > 0 {
+		js, _ = bson.MarshalExtJSON(result, false, false)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	c := p.changes[id]
+	c.Result = js
+	if err != nil || !bsonutil.Ok(result) {
+		c.Status = StatusFailed
+	}
+	changesTotal.WithLabelValues(c.Database, c.Collection, c.CommandName, c.Status).Inc()
+	logrus.Infof("DDL CHANGE %s: change %d %s on %s.%s approved by %q: %s",
+		strings.ToUpper(c.Status), c.ID, c.CommandName, c.Database, c.Collection, reviewer, js)
+	cp := *c
+	return &cp, err
+}
+
+// Reject rejects the pending change
+func (p *DDLReviewPlugin) Reject(id int64, reviewer string) (*Change, error) {
+	c, err := p.review(id, StatusRejected, reviewer)
+	if err != nil {
+		return nil, err
+	}
+	changesTotal.WithLabelValues(c.Database, c.Collection, c.CommandName, StatusRejected).Inc()
+	logrus.Infof("DDL CHANGE REJECTED: change %d %s on %s.%s rejected by %q",
+		c.ID, c.CommandName, c.Database, c.Collection, reviewer)
+	return c, nil
+}
+
+// AdminHandler returns the handler for the ddlreview admin endpoints:
+//
+//	GET changes?status=pending                 changes (optionally filtered by status)
+//	POST changes/{id}/approve?reviewer=name    apply the pending change on the backend
+//	POST changes/{id}/reject?reviewer=name     reject the pending change
+func (p *DDLReviewPlugin) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/changes", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.Changes(r.URL.Query().Get("status")))
+	})
+	mux.HandleFunc("/changes/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/changes/"), "/")
+		if len(parts) != 2 || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		id, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reviewer := r.URL.Query().Get("reviewer")
+
+		var c *Change
+		switch parts[1] {
+		case "approve":
+			c, err = p.Approve(r.Context(), id, reviewer)
+		case "reject":
+			c, err = p.Reject(id, reviewer)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if c == nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c)
+	})
+	return mux
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *DDLReviewPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	if _, ok := p.conf.commands[r.CommandName]; !ok {
+		return next(ctx, r)
+	}
+
+	c, err := p.hold(ctx, r)
+	if err != nil {
+		return mongoerror.IllegalOperation.ErrMessage(fmt.Sprintf("%s requires approval: %s", r.CommandName, err.Error())), nil
+	}
+	return mongoerror.IllegalOperation.ErrMessage(fmt.Sprintf(
+		"%s on %s is pending approval as change %d", c.CommandName, namespace(c), c.ID)), nil
+}
+
+func namespace(c *Change) string {
+	if c.Collection == "" {
+		return c.Database
+	}
+	return c.Database + "." + c.Collection
+}
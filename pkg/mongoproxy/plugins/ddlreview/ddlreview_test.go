@@ -0,0 +1,128 @@
+package ddlreview
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+type recordingRunner struct {
+	db  string
+	cmd bson.D
+}
+
+func (r *recordingRunner) RunCommand(ctx context.Context, db string, cmd bson.D) (bson.D, error) {
+	r.db, r.cmd = db, cmd
+	return bson.D{{"ok", 1}}, nil
+}
+
+func TestDDLReview(t *testing.T) {
+	d := &DDLReviewPlugin{
+		conf: DDLReviewPluginConfig{Expiry: "1h", MaxPending: 2},
+	}
+	if err := d.Configure(bson.D{{"commands", bson.A{"createIndexes", "drop"}}}); err != nil {
+		t.Fatal(err)
+	}
+	runner := &recordingRunner{}
+	d.SetCommandRunner(runner)
+
+	p := plugins.BuildPipeline([]plugins.Plugin{d}, func(context.Context, *plugins.Request) (bson.D, error) {
+		return bson.D{{"ok", 1}}, nil
+	})
+	run := func(cmdD bson.D) bson.D {
+		t.Helper()
+		cmd, ok := command.GetCommand(cmdD[0].Key)
+		if !ok {
+			t.Fatalf("no such command: %s", cmdD[0].Key)
+		}
+		if err := cmd.FromBSOND(cmdD); err != nil {
+			t.Fatal(err)
+		}
+		result, err := p(context.TODO(), &plugins.Request{CommandName: cmdD[0].Key, Command: cmd})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	createIndexes := bson.D{
+		{"createIndexes", "coll"},
+		{"indexes", bson.A{bson.D{{"key", bson.D{{"a", 1}}}, {"name", "a_1"}}}},
+		{"$db", "db"},
+	}
+	for i := 0; i < 2; i++ {
+		if result := run(createIndexes); bsonutil.Ok(result) {
+			t.Fatalf("expected createIndexes to be held, got %v", result)
+		}
+	}
+	if result := run(bson.D{{"find", "coll"}, {"$db", "db"}}); !bsonutil.Ok(result) {
+		t.Fatalf("expected find to pass, got %v", result)
+	}
+	if result := run(bson.D{{"create", "coll2"}, {"$db", "db"}}); !bsonutil.Ok(result) {
+		t.Fatalf("expected create to pass, got %v", result)
+	}
+	run(bson.D{{"drop", "coll"}, {"$db", "db"}})
+	if result := run(bson.D{{"drop", "coll3"}, {"$db", "db"}}); bsonutil.Ok(result) {
+		t.Fatalf("expected drop over maxPending to be rejected, got %v", result)
+	}
+
+	// The same command is only held once
+	changes := d.Changes(StatusPending)
+	if len(changes) != 2 {
+		t.Fatalf("expected 2 pending changes, got %d", len(changes))
+	}
+
+	admin := httptest.NewServer(d.AdminHandler())
+	defer admin.Close()
+	post := func(path string) (*Change, int) {
+		t.Helper()
+		resp, err := http.Post(admin.URL+path, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, resp.StatusCode
+		}
+		var c Change
+		if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+			t.Fatal(err)
+		}
+		return &c, resp.StatusCode
+	}
+
+	c, code := post("/changes/1/approve?reviewer=alice")
+	if code != http.StatusOK {
+		t.Fatalf("approve failed: %d", code)
+	}
+	if c.Status != StatusApplied || c.Reviewer != "alice" {
+		t.Fatalf("unexpected change: %+v", c)
+	}
+	if runner.db != "db" || runner.cmd[0].Key != "createIndexes" {
+		t.Fatalf("unexpected command run: %s %v", runner.db, runner.cmd)
+	}
+	for _, e := range runner.cmd {
+		if strings.HasPrefix(e.Key, "$") {
+			t.Fatalf("unexpected field in applied command: %s", e.Key)
+		}
+	}
+	if _, code := post("/changes/1/approve"); code != http.StatusConflict {
+		t.Fatalf("expected applied change to conflict, got %d", code)
+	}
+
+	if c, _ := post("/changes/2/reject"); c == nil || c.Status != StatusRejected {
+		t.Fatalf("unexpected change: %+v", c)
+	}
+	if len(d.Changes(StatusPending)) != 0 {
+		t.Fatalf("expected no pending changes")
+	}
+}
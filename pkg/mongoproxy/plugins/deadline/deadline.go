@@ -0,0 +1,346 @@
+package deadline
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "deadline"
+
+var (
+	deadlineTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_deadline_requests_total",
+		Help: "The total requests with a deadline in their comment by result",
+	}, []string{"db", "collection", "command", "result"})
+)
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &DeadlinePlugin{
+			conf: DeadlinePluginConfig{
+				DeadlineKey: "deadline",
+				BudgetKey:   "budget",
+				TraceIDKey:  "traceId",
+			},
+		}
+	})
+}
+
+type DeadlinePluginConfig struct {
+	// DeadlineKey is the comment key of the deadline: a date, RFC3339 time or unix
+	// time in milliseconds (default "deadline")
+	DeadlineKey string `bson:"deadlineKey"`
+	// BudgetKey is the comment key of the time left when the request is sent: a
+	// duration ("250ms") or milliseconds (default "budget")
+	BudgetKey string `bson:"budgetKey"`
+	// TraceIDKey is the comment key of the trace ID (default "traceId")
+	TraceIDKey string `bson:"traceIdKey"`
+	// StripComment removes these keys from the comment before it is sent to the
+	// backend (the rest of the comment is preserved)
+	StripComment bool `bson:"stripComment"`
+}
+
+// This is a plugin that enforces the deadline (latency budget) clients pass in the
+// comment of their requests, and propagates their trace ID
+type DeadlinePlugin struct {
+	conf DeadlinePluginConfig
+}
+
+func (p *DeadlinePlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *DeadlinePlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	for _, key := range []string{p.conf.DeadlineKey, p.conf.BudgetKey, p.conf.TraceIDKey} {
+		if key == "" || strings.ContainsAny(key, " \t\n=:;,") {
+			return fmt.Errorf("invalid key %q", key)
+		}
+	}
+
+	return nil
+}
+
+// comment is a comment of a command; either the command's comment or a filter's $comment
+type comment struct {
+	get func() interface{}
+	set func(interface{})
+}
+
+func stringComment(c *string) comment {
+	return comment{
+		get: func() interface{} { return *c },
+		set: func(v interface{}) { *c, _ = v.(string) },
+	}
+}
+
+func valueComment(c *interface{}) comment {
+	return comment{
+		get: func() interface{} { return *c },
+		set: func(v interface{}) { *c = v },
+	}
+}
+
+func filterComment(filter *bson.D) comment {
+	return comment{
+		get: func() interface{} {
+			v, _ := bsonutil.Lookup(*filter, "$comment")
+			return v
+		},
+		set: func(v interface{}) {
+			for i, e := range *filter {
+				if e.Key != "$comment" {
+					continue
+				}
+				if v == nil || v == "" {
+					*filter = append((*filter)[:i:i], (*filter)[i+1:]...)
+				} else {
+					(*filter)[i].Value = v
+				}
+				return
+			}
+		},
+	}
+}
+
+// comments returns the comments of the command
+func comments(cmd command.Command) []comment {
+	switch cmd := cmd.(type) {
+	case *command.Find:
+		return []comment{stringComment(&cmd.Comment), filterComment(&cmd.Filter)}
+	case *command.Aggregate:
+		return []comment{stringComment(&cmd.Comment)}
+	case *command.Count:
+		return []comment{filterComment(&cmd.Query)}
+	case *command.Distinct:
+		return []comment{filterComment(&cmd.Query)}
+	case *command.FindAndModify:
+		return []comment{filterComment(&cmd.Query)}
+	case *command.Update:
+		c := []comment{valueComment(&cmd.Comment)}
+		for i := range cmd.Updates {
+			c = append(c, filterComment(&cmd.Updates[i].Query))
+		}
+		return c
+	case *command.Delete:
+		c := []comment{valueComment(&cmd.Comment)}
+		for _, deleteDoc := range cmd.Deletes {
+			for i := range deleteDoc {
+				q, ok := deleteDoc[i].Value.(bson.D)
+				if deleteDoc[i].Key != "q" || !ok {
+					continue
+				}
+				// The filter is written back to the statement as removing $comment
+				// changes the slice
+				e, fc := &deleteDoc[i], filterComment(&q)
+				set := fc.set
+				fc.set = func(v interface{}) {
+					set(v)
+					e.Value = q
+				}
+				c = append(c, fc)
+			}
+		}
+		return c
+	}
+	return nil
+}
+
+// budget is what the comments of a request specify
+type budget struct {
+	deadline time.Time
+	traceID  string
+}
+
+// parseTime returns the deadline of the value
+func parseTime(v interface{}) (time.Time, bool) {
+	switch v := v.(type) {
+	case primitive.DateTime:
+		return v.Time(), true
+	case time.Time:
+		return v, true
+	case int32:
+		return time.Unix(0, int64(v)*int64(time.Millisecond)), true
+	case int64:
+		return time.Unix(0, v*int64(time.Millisecond)), true
+	case float64:
+		return time.Unix(0, int64(v)*int64(time.Millisecond)), true
+	case string:
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.Unix(0, ms*int64(time.Millisecond)), true
+		}
+		t, err := time.Parse(time.RFC3339Nano, v)
+		return t, err == nil
+	}
+	return time.Time{}, false
+}
+
+// parseDuration returns the budget of the value
+func parseDuration(v interface{}) (time.Duration, bool) {
+	switch v := v.(type) {
+	case int32:
+		return time.Duration(v) * time.Millisecond, true
+	case int64:
+		return time.Duration(v) * time.Millisecond, true
+	case float64:
+		return time.Duration(v * float64(time.Millisecond)), true
+	case string:
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.Duration(ms) * time.Millisecond, true
+		}
+		d, err := time.ParseDuration(v)
+		return d, err == nil
+	}
+	return 0, false
+}
+
+// splitToken returns the key and value of a "key=value" (or "key:value") token
+func splitToken(token string) (string, string, bool) {
+	i := strings.IndexAny(token, "=:")
+	if i <= 0 {
+		return "", "", false
+	}
+	return token[:i], token[i+1:], true
+}
+
+// parse adds what the comment specifies to the budget, and returns the comment
+// without the budget's keys (and whether it had any)
+func (p *DeadlinePlugin) parse(now time.Time, c interface{}, b *budget) (interface{}, bool) {
+	set := func(key string, v interface{}) bool {
+		switch key {
+		case p.conf.DeadlineKey:
+			if t, ok := parseTime(v); ok && (b.deadline.IsZero() || t.Before(b.deadline)) {
+				b.deadline = t
+			}
+		case p.conf.BudgetKey:
+			if d, ok := parseDuration(v); ok {
+				if t := now.Add(d); b.deadline.IsZero() || t.Before(b.deadline) {
+					b.deadline = t
+				}
+			}
+		case p.conf.TraceIDKey:
+			if s, ok := v.(string); ok && b.traceID == "" {
+				b.traceID = s
+			}
+		default:
+			return false
+		}
+		return true
+	}
+
+	switch c := c.(type) {
+	case string:
+		var (
+			rest  []string
+			found bool
+		)
+		for _, token := range strings.FieldsFunc(c, func(r rune) bool { return r == ' ' || r == ';' || r == ',' }) {
+			if key, v, ok := splitToken(token); ok && set(key, v) {
+				found = true
+				continue
+			}
+			rest = append(rest, token)
+		}
+		return strings.Join(rest, " "), found
+	case bson.D:
+		var rest bson.D
+		for _, e := range c {
+			if !set(e.Key, e.Value) {
+				rest = append(rest, e)
+			}
+		}
+		if len(rest) == 0 {
+			return nil, len(c) > 0
+		}
+		return rest, len(rest) < len(c)
+	}
+	return c, false
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *DeadlinePlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	now := time.Now()
+	var b budget
+	for _, c := range comments(r.Command) {
+		v := c.get()
+		if v == nil || v == "" {
+			continue
+		}
+		if stripped, found := p.parse(now, v, &b); found && p.conf.StripComment {
+			c.set(stripped)
+		}
+	}
+
+	if b.traceID != "" {
+		plugins.GetMetadata(ctx).SetTraceID(b.traceID)
+		if span := opentracing.SpanFromContext(ctx); span != nil {
+			span.SetTag("mongoproxy.trace_id", b.traceID)
+		}
+	}
+	if b.deadline.IsZero() {
+		return next(ctx, r)
+	}
+
+	db, collection := command.GetCommandDatabase(r.Command), command.GetCommandCollection(r.Command)
+	remaining := b.deadline.Sub(now)
+	if remaining <= 0 {
+		deadlineTotal.WithLabelValues(db, collection, r.CommandName, "expired").Inc()
+		logrus.WithField("traceID", b.traceID).Debugf("Deadline: %s on %s.%s rejected, deadline passed %s ago", r.CommandName, db, collection, -remaining)
+		return mongoerror.ExceededTimeLimit.ErrMessage(fmt.Sprintf("deadline from the comment passed %s ago", -remaining)), nil
+	}
+
+	// The backend stops the operation at the deadline if it supports maxTimeMS
+	maxTimeMS := remaining.Milliseconds()
+	if maxTimeMS == 0 {
+		maxTimeMS = 1
+	}
+	var current **int64
+	switch cmd := r.Command.(type) {
+	case *command.Find:
+		current = &cmd.MaxTimeMS
+	case *command.Aggregate:
+		current = &cmd.MaxTimeMS
+	case *command.Count:
+		current = &cmd.MaxTimeMS
+	case *command.Distinct:
+		current = &cmd.MaxTimeMS
+	}
+	if current != nil && (*current == nil || **current <= 0 || **current > maxTimeMS) {
+		*current = &maxTimeMS
+		r.Modified()
+	}
+
+	ctx, cancel := context.WithDeadline(ctx, b.deadline)
+	defer cancel()
+	result, err := next(ctx, r)
+	if (err != nil || !bsonutil.Ok(result)) && !time.Now().Before(b.deadline) {
+		deadlineTotal.WithLabelValues(db, collection, r.CommandName, "exceeded").Inc()
+		return mongoerror.ExceededTimeLimit.ErrMessage(fmt.Sprintf("operation exceeded the deadline from the comment (budget %s)", remaining)), nil
+	}
+	deadlineTotal.WithLabelValues(db, collection, r.CommandName, "ok").Inc()
+	return result, err
+}
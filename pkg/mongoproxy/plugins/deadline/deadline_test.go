@@ -0,0 +1,195 @@
+package deadline
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func TestDeadline(t *testing.T) {
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Second)
+
+	tests := []struct {
+		strip bool
+		cmd   bson.D
+		ok    bool
+		// maxTimeMS of the find sent to the backend (-1 to not check, 0 for unset);
+		// checked as a max as the budget is counting down
+		maxTimeMS int64
+		traceID   string
+		// comment of the command sent to the backend (nil to not check)
+		check func(command.Command) interface{}
+		// expected result of check
+		comment interface{}
+	}{
+		{
+			cmd: bson.D{{"find", "coll"}, {"filter", bson.D{{"a", 1}}}, {"$db", "db"}},
+			ok:  true,
+		},
+		{
+			cmd:       bson.D{{"find", "coll"}, {"comment", "budget=250ms traceId=abc"}, {"$db", "db"}},
+			ok:        true,
+			maxTimeMS: 250,
+			traceID:   "abc",
+			check:     func(c command.Command) interface{} { return c.(*command.Find).Comment },
+			comment:   "budget=250ms traceId=abc",
+		},
+		// the budget is stripped and the rest of the comment preserved
+		{
+			strip:     true,
+			cmd:       bson.D{{"find", "coll"}, {"comment", "checkout;budget=250;traceId=abc"}, {"$db", "db"}},
+			ok:        true,
+			maxTimeMS: 250,
+			traceID:   "abc",
+			check:     func(c command.Command) interface{} { return c.(*command.Find).Comment },
+			comment:   "checkout",
+		},
+		// a lower maxTimeMS is kept
+		{
+			cmd:       bson.D{{"find", "coll"}, {"comment", "budget=10s"}, {"maxTimeMS", int64(100)}, {"$db", "db"}},
+			ok:        true,
+			maxTimeMS: 100,
+		},
+		{
+			cmd:       bson.D{{"find", "coll"}, {"filter", bson.D{{"a", 1}, {"$comment", bson.D{{"deadline", primitive.NewDateTimeFromTime(future)}}}}}, {"$db", "db"}},
+			ok:        true,
+			maxTimeMS: time.Hour.Milliseconds(),
+		},
+		{
+			strip:     true,
+			cmd:       bson.D{{"find", "coll"}, {"filter", bson.D{{"a", 1}, {"$comment", bson.D{{"deadline", primitive.NewDateTimeFromTime(future)}}}}}, {"$db", "db"}},
+			ok:        true,
+			maxTimeMS: -1,
+			check:     func(c command.Command) interface{} { return c.(*command.Find).Filter },
+			comment:   bson.D{{"a", int64(1)}},
+		},
+		{
+			cmd: bson.D{{"find", "coll"}, {"comment", "deadline=" + past.Format(time.RFC3339Nano)}, {"$db", "db"}},
+			ok:  false,
+		},
+		{
+			cmd: bson.D{{"find", "coll"}, {"comment", "deadline=" + strconv.FormatInt(past.UnixNano()/int64(time.Millisecond), 10)}, {"$db", "db"}},
+			ok:  false,
+		},
+		{
+			strip:   true,
+			cmd:     bson.D{{"update", "coll"}, {"updates", bson.A{bson.D{{"q", bson.D{{"a", 1}}}, {"u", bson.D{{"a", 2}}}}}}, {"comment", bson.D{{"traceId", "xyz"}, {"app", "a"}}}, {"$db", "db"}},
+			ok:      true,
+			traceID: "xyz",
+			check:   func(c command.Command) interface{} { return c.(*command.Update).Comment },
+			comment: bson.D{{"app", "a"}},
+		},
+		{
+			strip:   true,
+			cmd:     bson.D{{"delete", "coll"}, {"deletes", bson.A{bson.D{{"q", bson.D{{"a", 1}, {"$comment", "traceId=del"}}}, {"limit", 1}}}}, {"$db", "db"}},
+			ok:      true,
+			traceID: "del",
+			check: func(c command.Command) interface{} {
+				q, _ := bsonutil.Lookup(c.(*command.Delete).Deletes[0], "q")
+				return q
+			},
+			comment: bson.D{{"a", int64(1)}},
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			pl, _ := plugins.GetPlugin(Name)
+			d := pl.(*DeadlinePlugin)
+			if err := d.Configure(bson.D{{"stripComment", test.strip}}); err != nil {
+				t.Fatal(err)
+			}
+
+			var (
+				last    command.Command
+				traceID string
+			)
+			p := plugins.BuildPipeline([]plugins.Plugin{d}, func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+				last = r.Command
+				traceID = plugins.GetMetadata(ctx).TraceID()
+				return bson.D{{"ok", 1}}, nil
+			})
+
+			cmd, ok := command.GetCommand(test.cmd[0].Key)
+			if !ok {
+				t.Fatalf("no such command: %s", test.cmd[0].Key)
+			}
+			if err := cmd.FromBSOND(test.cmd); err != nil {
+				t.Fatal(err)
+			}
+			ctx, _ := plugins.WithMetadata(context.TODO())
+			result, err := p(ctx, &plugins.Request{CommandName: test.cmd[0].Key, Command: cmd})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bsonutil.Ok(result) != test.ok {
+				t.Fatalf("expected ok=%v: %v", test.ok, result)
+			}
+			if !test.ok {
+				return
+			}
+
+			if find, ok := last.(*command.Find); ok {
+				switch {
+				case test.maxTimeMS == 0 && find.MaxTimeMS != nil:
+					t.Fatalf("unexpected maxTimeMS %d", *find.MaxTimeMS)
+				case test.maxTimeMS > 0 && (find.MaxTimeMS == nil || *find.MaxTimeMS > test.maxTimeMS || *find.MaxTimeMS < test.maxTimeMS-1000):
+					t.Fatalf("expected maxTimeMS %d: %v", test.maxTimeMS, find.MaxTimeMS)
+				}
+			}
+			if traceID != test.traceID {
+				t.Fatalf("expected traceID %q, got %q", test.traceID, traceID)
+			}
+			if test.check != nil {
+				if comment := test.check(last); !reflect.DeepEqual(comment, test.comment) {
+					t.Fatalf("expected comment %v, got %v", test.comment, comment)
+				}
+			}
+		})
+	}
+}
+
+func TestDeadlineExceeded(t *testing.T) {
+	pl, _ := plugins.GetPlugin(Name)
+	d := pl.(*DeadlinePlugin)
+	if err := d.Configure(bson.D{}); err != nil {
+		t.Fatal(err)
+	}
+	p := plugins.BuildPipeline([]plugins.Plugin{d}, func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	cmd := &command.Insert{}
+	if err := cmd.FromBSOND(bson.D{{"insert", "coll"}, {"documents", bson.A{bson.D{{"a", 1}}}}, {"$db", "db"}}); err != nil {
+		t.Fatal(err)
+	}
+	// Inserts have no comment to take the deadline from
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p(ctx, &plugins.Request{CommandName: "insert", Command: cmd}); err == nil {
+		t.Fatalf("expected the context error")
+	}
+
+	find := &command.Find{}
+	if err := find.FromBSOND(bson.D{{"find", "coll"}, {"comment", "budget=10ms"}, {"$db", "db"}}); err != nil {
+		t.Fatal(err)
+	}
+	result, err := p(context.TODO(), &plugins.Request{CommandName: "find", Command: find})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codeName, _ := bsonutil.Lookup(result, "codeName"); codeName != "ExceededTimeLimit" {
+		t.Fatalf("expected ExceededTimeLimit: %v", result)
+	}
+}
@@ -55,37 +55,45 @@ func (p *DefaultPlugin) Process(ctx context.Context, r *plugins.Request, next pl
 		if p.conf.DefaultReadConcern != nil && cmd.ReadConcern == nil {
 			tmp := *p.conf.DefaultReadConcern
 			cmd.ReadConcern = &tmp
+			r.Modified()
 		}
 		if p.conf.DefaultMaxTimeMS != nil && cmd.MaxTimeMS == nil {
 			tmp := *p.conf.DefaultMaxTimeMS
 			cmd.MaxTimeMS = &tmp
+			r.Modified()
 		}
 	case *command.Count:
 		if p.conf.DefaultReadConcern != nil && cmd.ReadConcern == nil {
 			tmp := *p.conf.DefaultReadConcern
 			cmd.ReadConcern = &tmp
+			r.Modified()
 		}
 		if p.conf.DefaultMaxTimeMS != nil && cmd.MaxTimeMS == nil {
 			tmp := *p.conf.DefaultMaxTimeMS
 			cmd.MaxTimeMS = &tmp
+			r.Modified()
 		}
 	case *command.Distinct:
 		if p.conf.DefaultReadConcern != nil && cmd.ReadConcern == nil {
 			tmp := *p.conf.DefaultReadConcern
 			cmd.ReadConcern = &tmp
+			r.Modified()
 		}
 		if p.conf.DefaultMaxTimeMS != nil && cmd.MaxTimeMS == nil {
 			tmp := *p.conf.DefaultMaxTimeMS
 			cmd.MaxTimeMS = &tmp
+			r.Modified()
 		}
 	case *command.Find:
 		if p.conf.DefaultReadConcern != nil && cmd.ReadConcern == nil {
 			tmp := *p.conf.DefaultReadConcern
 			cmd.ReadConcern = &tmp
+			r.Modified()
 		}
 		if p.conf.DefaultMaxTimeMS != nil && cmd.MaxTimeMS == nil {
 			tmp := *p.conf.DefaultMaxTimeMS
 			cmd.MaxTimeMS = &tmp
+			r.Modified()
 		}
 
 	}
@@ -0,0 +1,227 @@
+package deprecation
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "deprecation"
+
+var (
+	deprecatedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_deprecation_requests_total",
+		Help: "The total requests to deprecated namespaces",
+	}, []string{"db", "collection", "app_name", "action"})
+)
+
+// Actions of a policy
+const (
+	// ActionWarn only logs (and counts) requests to the namespace
+	ActionWarn = "warn"
+	// ActionBlockInserts rejects inserts and upserts (reads, updates and deletes are allowed)
+	ActionBlockInserts = "blockInserts"
+	// ActionReadOnly rejects all writes
+	ActionReadOnly = "readOnly"
+	// ActionBlock rejects all requests
+	ActionBlock = "block"
+	// ActionRewrite sends requests to the replacement namespace
+	ActionRewrite = "rewrite"
+)
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &DeprecationPlugin{
+			conf: DeprecationPluginConfig{},
+		}
+	})
+}
+
+type DeprecationPluginConfig struct {
+	// Policies are the deprecation policies; the first policy matching the request applies
+	Policies []*Policy `bson:"policies"`
+}
+
+// Policy deprecates a set of namespaces
+type Policy struct {
+	// Scope are the namespaces the policy applies to (same format as a plugin scope; required)
+	Scope *plugins.Scope `bson:"scope"`
+	// Action is one of warn, blockInserts, readOnly, block or rewrite
+	Action string `bson:"action"`
+	// After is the time (RFC3339) the action applies from; before it requests are
+	// only warned about (default: immediately)
+	After string `bson:"after"`
+	// RewriteTo is the namespace ("db.collection") requests are sent to with the
+	// rewrite action
+	RewriteTo string `bson:"rewriteTo"`
+	// Message is the error returned to clients when a request is rejected (default
+	// "<db>.<collection> is deprecated")
+	Message string `bson:"message"`
+
+	after                  time.Time
+	rewriteDB, rewriteColl string
+}
+
+func (p *Policy) load() error {
+	if p.Scope.IsZero() {
+		return fmt.Errorf("scope is required")
+	}
+	p.Scope.Compile()
+
+	switch p.Action {
+	case ActionWarn, ActionBlockInserts, ActionReadOnly, ActionBlock:
+		if p.RewriteTo != "" {
+			return fmt.Errorf("rewriteTo is only valid with the rewrite action")
+		}
+	case ActionRewrite:
+		i := strings.IndexByte(p.RewriteTo, '.')
+		if i <= 0 || i == len(p.RewriteTo)-1 {
+			return fmt.Errorf("rewriteTo must be a namespace (db.collection): %q", p.RewriteTo)
+		}
+		p.rewriteDB, p.rewriteColl = p.RewriteTo[:i], p.RewriteTo[i+1:]
+	default:
+		return fmt.Errorf("invalid action %q; must be one of warn, blockInserts, readOnly, block, rewrite", p.Action)
+	}
+
+	if p.After != "" {
+		t, err := time.Parse(time.RFC3339, p.After)
+		if err != nil {
+			return fmt.Errorf("invalid after: %w", err)
+		}
+		p.after = t
+	}
+	return nil
+}
+
+// This is a plugin that applies deprecation policies to namespaces
+type DeprecationPlugin struct {
+	conf DeprecationPluginConfig
+}
+
+func (p *DeprecationPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *DeprecationPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	for i, policy := range p.conf.Policies {
+		if policy == nil {
+			return fmt.Errorf("empty policy %d", i)
+		}
+		if err := policy.load(); err != nil {
+			return fmt.Errorf("invalid policy %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (p *DeprecationPlugin) policy(r *plugins.Request) *Policy {
+	for _, policy := range p.conf.Policies {
+		if policy.Scope.Match(r) {
+			return policy
+		}
+	}
+	return nil
+}
+
+// isWrite returns whether the command writes to its namespace
+func isWrite(c command.Command) bool {
+	switch c.(type) {
+	case *command.Insert, *command.Update, *command.Delete, *command.FindAndModify, *command.FindAndModifyLegacy,
+		*command.CreateIndexes, *command.DropIndexes, *command.DeleteIndexes, *command.Create, *command.Drop, *command.CollMod:
+		return true
+	}
+	return false
+}
+
+// isInsert returns whether the command may insert documents (including upserts)
+func isInsert(c command.Command) bool {
+	switch cmd := c.(type) {
+	case *command.Insert:
+		return true
+	case *command.Update:
+		for _, u := range cmd.Updates {
+			if bsonutil.GetBoolDefault(u.Upsert, false) {
+				return true
+			}
+		}
+	case *command.FindAndModify:
+		return bsonutil.GetBoolDefault(cmd.Upsert, false)
+	case *command.FindAndModifyLegacy:
+		return bsonutil.GetBoolDefault(cmd.Upsert, false)
+	}
+	return false
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *DeprecationPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	// Policies only apply to commands on collections (not e.g. handshakes)
+	db, collection := command.GetCommandDatabase(r.Command), command.GetCommandCollection(r.Command)
+	if collection == "" {
+		return next(ctx, r)
+	}
+	policy := p.policy(r)
+	if policy == nil {
+		return next(ctx, r)
+	}
+
+	var appName string
+	if r.CC != nil {
+		appName = r.CC.AppName
+	}
+
+	action := policy.Action
+	if time.Now().Before(policy.after) {
+		action = ActionWarn
+	}
+
+	var blocked bool
+	switch action {
+	case ActionBlockInserts:
+		blocked = isInsert(r.Command)
+	case ActionReadOnly:
+		blocked = isWrite(r.Command)
+	case ActionBlock:
+		blocked = true
+	case ActionRewrite:
+		blocked = !r.SetNamespace(policy.rewriteDB, policy.rewriteColl)
+	}
+
+	switch {
+	case blocked:
+		deprecatedTotal.WithLabelValues(db, collection, appName, "blocked").Inc()
+		logrus.Warningf("DEPRECATED NAMESPACE: blocked %s on %s.%s from appName %q", r.CommandName, db, collection, appName)
+		msg := policy.Message
+		if msg == "" {
+			msg = fmt.Sprintf("%s.%s is deprecated", db, collection)
+		}
+		return mongoerror.IllegalOperation.ErrMessage(msg), nil
+	case action == ActionRewrite:
+		deprecatedTotal.WithLabelValues(db, collection, appName, "rewritten").Inc()
+	default:
+		deprecatedTotal.WithLabelValues(db, collection, appName, "allowed").Inc()
+	}
+
+	return next(ctx, r)
+}
@@ -0,0 +1,78 @@
+package deprecation
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func TestDeprecation(t *testing.T) {
+	d := &DeprecationPlugin{}
+	if err := d.Configure(bson.D{{"policies", bson.A{
+		bson.D{{"scope", bson.D{{"collections", bson.A{"db.frozen"}}}}, {"action", "blockInserts"}},
+		bson.D{{"scope", bson.D{{"collections", bson.A{"db.archive"}}}}, {"action", "readOnly"}, {"message", "db.archive is read-only; write to db.events instead"}},
+		bson.D{{"scope", bson.D{{"collections", bson.A{"db.gone"}}}}, {"action", "block"}, {"after", "2000-01-01T00:00:00Z"}},
+		bson.D{{"scope", bson.D{{"collections", bson.A{"db.later"}}}}, {"action", "block"}, {"after", "2999-01-01T00:00:00Z"}},
+		bson.D{{"scope", bson.D{{"collections", bson.A{"db.old"}}}}, {"action", "rewrite"}, {"rewriteTo", "newdb.new"}},
+	}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var last command.Command
+	p := plugins.BuildPipeline([]plugins.Plugin{d}, func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+		last = r.Command
+		return bson.D{{"ok", 1}}, nil
+	})
+
+	tests := []struct {
+		cmd bson.D
+		ok  bool
+		// ns is the namespace the command is sent with (if ok)
+		ns string
+	}{
+		{bson.D{{"find", "frozen"}, {"$db", "db"}}, true, "db.frozen"},
+		{bson.D{{"insert", "frozen"}, {"documents", bson.A{bson.D{{"a", 1}}}}, {"$db", "db"}}, false, ""},
+		{bson.D{{"update", "frozen"}, {"updates", bson.A{bson.D{{"q", bson.D{}}, {"u", bson.D{{"$set", bson.D{{"a", 1}}}}}}}}, {"$db", "db"}}, true, "db.frozen"},
+		{bson.D{{"update", "frozen"}, {"updates", bson.A{bson.D{{"q", bson.D{}}, {"u", bson.D{{"$set", bson.D{{"a", 1}}}}}, {"upsert", true}}}}, {"$db", "db"}}, false, ""},
+		{bson.D{{"find", "archive"}, {"$db", "db"}}, true, "db.archive"},
+		{bson.D{{"delete", "archive"}, {"deletes", bson.A{bson.D{{"q", bson.D{}}, {"limit", 0}}}}, {"$db", "db"}}, false, ""},
+		{bson.D{{"find", "gone"}, {"$db", "db"}}, false, ""},
+		{bson.D{{"find", "later"}, {"$db", "db"}}, true, "db.later"},
+		{bson.D{{"find", "old"}, {"$db", "db"}}, true, "newdb.new"},
+		{bson.D{{"aggregate", "old"}, {"pipeline", bson.A{}}, {"cursor", bson.D{}}, {"$db", "db"}}, true, "newdb.new"},
+		{bson.D{{"getMore", int64(1)}, {"collection", "old"}, {"$db", "db"}}, true, "newdb.new"},
+		{bson.D{{"find", "other"}, {"$db", "db"}}, true, "db.other"},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			cmd, ok := command.GetCommand(test.cmd[0].Key)
+			if !ok {
+				t.Fatalf("no such command: %s", test.cmd[0].Key)
+			}
+			if err := cmd.FromBSOND(test.cmd); err != nil {
+				t.Fatal(err)
+			}
+			last = nil
+			result, err := p(context.TODO(), &plugins.Request{CommandName: test.cmd[0].Key, Command: cmd})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok := bsonutil.Ok(result); ok != test.ok {
+				t.Fatalf("expected ok=%v, got %v", test.ok, result)
+			}
+			if !test.ok {
+				return
+			}
+			if ns := command.GetCommandDatabase(last) + "." + command.GetCommandCollection(last); ns != test.ns {
+				t.Fatalf("expected namespace %s, got %s", test.ns, ns)
+			}
+		})
+	}
+}
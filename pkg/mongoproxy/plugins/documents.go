@@ -0,0 +1,23 @@
+package plugins
+
+// DocumentReader is an optional interface a Plugin can implement to declare
+// whether it reads the documents of inserts from the command
+// (command.Insert.Documents). Plugins not implementing it are assumed not to;
+// Request.Documents decodes the documents when called.
+//
+// If no plugin in the chain reads them the documents sent in a document
+// sequence are kept as raw BSON (command.Insert.RawDocuments) and sent to the
+// backend without being decoded and re-encoded.
+type DocumentReader interface {
+	ReadsDocuments() bool
+}
+
+// ReadsDocuments returns whether any of the plugins read the documents of inserts
+func ReadsDocuments(ps []Plugin) bool {
+	for _, p := range ps {
+		if dr, ok := Unwrap(p).(DocumentReader); ok && dr.ReadsDocuments() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,309 @@
+package errormap
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "errormap"
+
+var (
+	mappedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_errormap_errors_total",
+		Help: "The total errors matched by each rule",
+	}, []string{"rule", "code"})
+)
+
+// DefaultFieldPatterns extract the field path from the messages of the proxy's
+// plugins and common backend errors
+var DefaultFieldPatterns = []string{
+	`unknown field: ([^\s,;]+)`,
+	`filter on ([^\s,;]+) of type`,
+	`unset required field ([^\s,;]+)`,
+	`find field in collection: ([^\s,;]+)`,
+	`dup key: \{ ?([^:\s]+):`,
+	`field '([^']+)'`,
+}
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &ErrorMapPlugin{
+			conf: ErrorMapPluginConfig{
+				FieldPatterns:   DefaultFieldPatterns,
+				AppendToMessage: true,
+			},
+		}
+	})
+}
+
+type ErrorMapPluginConfig struct {
+	// Rules are the error rules; the first rule matching an error applies
+	Rules []*Rule `bson:"rules"`
+	// FieldPatterns are regular expressions extracting the offending field path
+	// (their first group) from error messages (default DefaultFieldPatterns)
+	FieldPatterns []string `bson:"fieldPatterns"`
+	// AppendToMessage appends the field path and runbook to the error message
+	// (they are always added to errInfo) (default true)
+	AppendToMessage bool `bson:"appendToMessage"`
+
+	fieldPatterns []*regexp.Regexp
+}
+
+// Rule rewrites and enriches the errors it matches
+type Rule struct {
+	// Name is the name of the rule (default its index)
+	Name string `bson:"name"`
+
+	// Codes and CodeNames match the error's code (either)
+	Codes     []int32  `bson:"codes"`
+	CodeNames []string `bson:"codeNames"`
+	// Message is a regular expression matching the error message
+	Message string `bson:"message"`
+	// Scope limits the rule to some requests
+	Scope *plugins.Scope `bson:"scope"`
+
+	// Code replaces the error's code (and codeName)
+	Code int32 `bson:"code"`
+	// Replace replaces the error message; {message}, {code}, {codeName} and
+	// {field} are replaced with the original message, code, code name and field
+	Replace string `bson:"replace"`
+	// Runbook is the link to the runbook of the error ({code}, {codeName} and
+	// {field} are replaced as in Replace)
+	Runbook string `bson:"runbook"`
+
+	// codes holds Codes and CodeNames
+	codes   map[interface{}]struct{}
+	message *regexp.Regexp
+}
+
+// This is a plugin that rewrites the errors of the backend and the proxy's
+// plugins (e.g. to map the codes of a mongo compatible backend to mongo's) and
+// enriches them with the offending field path and a link to their runbook
+type ErrorMapPlugin struct {
+	conf ErrorMapPluginConfig
+}
+
+func (p *ErrorMapPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *ErrorMapPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	if len(p.conf.Rules) == 0 {
+		return fmt.Errorf("rules are required")
+	}
+	for i, rule := range p.conf.Rules {
+		if rule.Name == "" {
+			rule.Name = strconv.Itoa(i)
+		}
+		rule.codes = make(map[interface{}]struct{}, len(rule.Codes)+len(rule.CodeNames))
+		for _, code := range rule.Codes {
+			rule.codes[code] = struct{}{}
+		}
+		for _, codeName := range rule.CodeNames {
+			rule.codes[codeName] = struct{}{}
+		}
+		if rule.Message != "" {
+			if rule.message, err = regexp.Compile(rule.Message); err != nil {
+				return fmt.Errorf("rule %s: invalid message: %w", rule.Name, err)
+			}
+		}
+		if rule.Scope != nil {
+			rule.Scope.Compile()
+		}
+		if rule.Code != 0 && !mongoerror.ErrorCode(rule.Code).Known() {
+			return fmt.Errorf("rule %s: unknown code %d", rule.Name, rule.Code)
+		}
+	}
+
+	p.conf.fieldPatterns = make([]*regexp.Regexp, len(p.conf.FieldPatterns))
+	for i, pattern := range p.conf.FieldPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid fieldPattern %q: %w", pattern, err)
+		}
+		if re.NumSubexp() < 1 {
+			return fmt.Errorf("fieldPattern %q has no group for the field", pattern)
+		}
+		p.conf.fieldPatterns[i] = re
+	}
+
+	return nil
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *ErrorMapPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	return next(ctx, r)
+}
+
+// ProcessError rewrites the error of the response
+func (p *ErrorMapPlugin) ProcessError(ctx context.Context, r *plugins.Request, d bson.D, err error) (bson.D, error) {
+	if len(d) > 0 {
+		d = p.mapError(r, d)
+	}
+	return d, err
+}
+
+// ProcessResponse rewrites the write errors of the response
+func (p *ErrorMapPlugin) ProcessResponse(ctx context.Context, r *plugins.Request, d bson.D) (bson.D, error) {
+	for i, e := range d {
+		if e.Key != "writeErrors" && e.Key != "writeConcernError" {
+			continue
+		}
+		switch v := e.Value.(type) {
+		case primitive.A:
+			for j, we := range v {
+				if we, ok := we.(bson.D); ok {
+					v[j] = p.mapError(r, we)
+				}
+			}
+		case bson.D:
+			d[i].Value = p.mapError(r, v)
+		}
+	}
+	return d, nil
+}
+
+// errorCode returns the code of the error document
+func errorCode(d bson.D) int32 {
+	v, _ := bsonutil.Lookup(d, "code")
+	switch v := v.(type) {
+	case int32:
+		return v
+	case int64:
+		return int32(v)
+	case int:
+		return int32(v)
+	case float64:
+		return int32(v)
+	}
+	return 0
+}
+
+// match returns the first rule matching the error
+func (p *ErrorMapPlugin) match(r *plugins.Request, code int32, codeName, message string) *Rule {
+	for _, rule := range p.conf.Rules {
+		if len(rule.codes) > 0 {
+			_, byCode := rule.codes[code]
+			_, byName := rule.codes[codeName]
+			if !byCode && !byName {
+				continue
+			}
+		}
+		if rule.message != nil && !rule.message.MatchString(message) {
+			continue
+		}
+		if rule.Scope != nil && !rule.Scope.Match(r) {
+			continue
+		}
+		return rule
+	}
+	return nil
+}
+
+// fieldPath returns the field path in the error message ("" if none)
+func (p *ErrorMapPlugin) fieldPath(message string) string {
+	for _, re := range p.conf.fieldPatterns {
+		if m := re.FindStringSubmatch(message); len(m) > 1 && m[1] != "" {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// set sets the key of the document (appending it if it isn't there)
+func set(d bson.D, key string, value interface{}) bson.D {
+	for i := range d {
+		if d[i].Key == key {
+			d[i].Value = value
+			return d
+		}
+	}
+	return append(d, bson.E{key, value})
+}
+
+// mapError applies the first matching rule to the error document
+func (p *ErrorMapPlugin) mapError(r *plugins.Request, d bson.D) bson.D {
+	code := errorCode(d)
+	codeNameV, _ := bsonutil.Lookup(d, "codeName")
+	codeName, _ := codeNameV.(string)
+	messageV, _ := bsonutil.Lookup(d, "errmsg")
+	message, _ := messageV.(string)
+
+	rule := p.match(r, code, codeName, message)
+	if rule == nil {
+		return d
+	}
+	mappedTotal.WithLabelValues(rule.Name, strconv.Itoa(int(code))).Inc()
+
+	field := p.fieldPath(message)
+	if rule.Code != 0 {
+		code, codeName = rule.Code, mongoerror.ErrorCode(rule.Code).String()
+		d = set(d, "code", code)
+		d = set(d, "codeName", codeName)
+	}
+	replacer := strings.NewReplacer(
+		"{message}", message,
+		"{code}", strconv.Itoa(int(code)),
+		"{codeName}", codeName,
+		"{field}", field,
+	)
+	if rule.Replace != "" {
+		message = replacer.Replace(rule.Replace)
+	}
+	runbook := ""
+	if rule.Runbook != "" {
+		runbook = replacer.Replace(rule.Runbook)
+	}
+
+	var info bson.D
+	if field != "" {
+		info = append(info, bson.E{"fieldPath", field})
+	}
+	if runbook != "" {
+		info = append(info, bson.E{"runbook", runbook})
+	}
+	if len(info) > 0 {
+		errInfo, _ := bsonutil.Lookup(d, "errInfo")
+		existing, _ := errInfo.(bson.D)
+		for _, e := range info {
+			existing = set(existing, e.Key, e.Value)
+		}
+		d = set(d, "errInfo", existing)
+
+		if p.conf.AppendToMessage {
+			var extra []string
+			if field != "" && !strings.Contains(rule.Replace, "{field}") {
+				extra = append(extra, "field: "+field)
+			}
+			if runbook != "" {
+				extra = append(extra, "runbook: "+runbook)
+			}
+			if len(extra) > 0 {
+				message += " (" + strings.Join(extra, "; ") + ")"
+			}
+		}
+	}
+	return set(d, "errmsg", message)
+}
@@ -0,0 +1,104 @@
+package errormap
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func TestErrorMap(t *testing.T) {
+	conf := bson.D{
+		{"rules", bson.A{
+			bson.D{{"name", "docdb"}, {"codes", bson.A{303}}, {"code", 115}, {"replace", "not supported by the backend: {message}"}},
+			bson.D{{"name", "scoped"}, {"codeNames", bson.A{"BadValue"}}, {"scope", bson.D{{"collections", bson.A{"db.scoped"}}}}, {"runbook", "https://runbooks/{codeName}"}},
+			bson.D{{"name", "schema"}, {"message", "unknown field"}, {"runbook", "https://runbooks/schema#{field}"}},
+			bson.D{{"name", "dup"}, {"codes", bson.A{11000}}, {"replace", "duplicate {field}"}},
+		}},
+	}
+
+	tests := []struct {
+		collection string
+		response   bson.D
+		expected   bson.D
+	}{
+		// Backend code mapped
+		{
+			response: bson.D{{"ok", 0}, {"errmsg", "Feature not supported: $where"}, {"code", int32(303)}},
+			expected: bson.D{{"ok", 0}, {"errmsg", "not supported by the backend: Feature not supported: $where"}, {"code", int32(115)}, {"codeName", "CommandNotSupported"}},
+		},
+		// Not in the rule's scope
+		{
+			response: bson.D{{"ok", 0}, {"errmsg", "bad"}, {"code", int32(2)}, {"codeName", "BadValue"}},
+			expected: bson.D{{"ok", 0}, {"errmsg", "bad"}, {"code", int32(2)}, {"codeName", "BadValue"}},
+		},
+		{
+			collection: "scoped",
+			response:   bson.D{{"ok", 0}, {"errmsg", "bad"}, {"code", int32(2)}, {"codeName", "BadValue"}},
+			expected:   bson.D{{"ok", 0}, {"errmsg", "bad (runbook: https://runbooks/BadValue)"}, {"code", int32(2)}, {"codeName", "BadValue"}, {"errInfo", bson.D{{"runbook", "https://runbooks/BadValue"}}}},
+		},
+		// Proxy error enriched with the field
+		{
+			response: bson.D{{"ok", 0}, {"errmsg", "filter on unknown field: a.b"}, {"code", int32(2)}, {"codeName", "DocumentValidationFailure"}},
+			expected: bson.D{{"ok", 0}, {"errmsg", "filter on unknown field: a.b (field: a.b; runbook: https://runbooks/schema#a.b)"}, {"code", int32(2)}, {"codeName", "DocumentValidationFailure"}, {"errInfo", bson.D{{"fieldPath", "a.b"}, {"runbook", "https://runbooks/schema#a.b"}}}},
+		},
+		// Write errors
+		{
+			response: bson.D{{"n", 0}, {"writeErrors", bson.A{bson.D{{"index", 0}, {"code", int32(11000)}, {"errmsg", "E11000 duplicate key error collection: db.coll index: a_1 dup key: { a: 1 }"}}}}, {"ok", 1}},
+			expected: bson.D{{"n", 0}, {"writeErrors", bson.A{bson.D{{"index", 0}, {"code", int32(11000)}, {"errmsg", "duplicate a"}, {"errInfo", bson.D{{"fieldPath", "a"}}}}}}, {"ok", 1}},
+		},
+		// No rule
+		{
+			response: bson.D{{"ok", 0}, {"errmsg", "other"}, {"code", int32(1)}},
+			expected: bson.D{{"ok", 0}, {"errmsg", "other"}, {"code", int32(1)}},
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			pl, _ := plugins.GetPlugin(Name)
+			d := pl.(*ErrorMapPlugin)
+			if err := d.Configure(conf); err != nil {
+				t.Fatal(err)
+			}
+
+			p := plugins.BuildPipeline([]plugins.Plugin{d}, func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+				return test.response, nil
+			})
+
+			collection := test.collection
+			if collection == "" {
+				collection = "coll"
+			}
+			cmd := &command.Find{Collection: collection, Common: command.Common{Database: "db"}}
+			result, err := p(context.TODO(), &plugins.Request{CommandName: "find", Command: cmd})
+			if err != nil {
+				t.Fatal(err)
+			}
+			b1, _ := bson.MarshalExtJSON(result, false, false)
+			b2, _ := bson.MarshalExtJSON(test.expected, false, false)
+			if string(b1) != string(b2) {
+				t.Fatalf("mismatch\nexpected=%s\nactual=%s", b2, b1)
+			}
+		})
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	tests := []bson.D{
+		{},
+		{{"rules", bson.A{bson.D{{"code", 999999}}}}},
+		{{"rules", bson.A{bson.D{{"message", "("}}}}},
+		{{"rules", bson.A{bson.D{{"codes", bson.A{1}}}}}, {"fieldPatterns", bson.A{"no group"}}},
+	}
+	for i, conf := range tests {
+		pl, _ := plugins.GetPlugin(Name)
+		if err := pl.Configure(conf); err == nil {
+			t.Fatalf("%d: expected an error", i)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package plugins
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The types of events streamed to subscribers
+const (
+	// EventSlowQuery is a request slower than the slowlog threshold
+	EventSlowQuery = "slowQuery"
+	// EventViolation is a request rejected by a policy (see ViolationCodes)
+	EventViolation = "violation"
+	// EventTopology is a change of the backend topology (e.g. a new primary)
+	EventTopology = "topology"
+)
+
+// ViolationCodes are the names of the error codes returned for requests rejected
+// by a policy: schema violations, commands blocked by policies and requests shed
+// by limits
+var ViolationCodes = []string{
+	"DocumentValidationFailure",
+	"Unauthorized",
+	"IllegalOperation",
+	"CannotCreateIndex",
+	"ExceededTimeLimit",
+}
+
+var eventsDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "mongoproxy_events_dropped_total",
+	Help: "The total number of events not sent to a subscriber as it was too slow",
+})
+
+// Event is a notable event in the proxy, streamed live to subscribers (e.g. the
+// /admin/events endpoint)
+type Event struct {
+	Time time.Time `json:"time"`
+	// Type is the kind of event, e.g. EventSlowQuery
+	Type string `json:"type"`
+	// Source is what emitted the event: a plugin's name or "proxy"
+	Source      string `json:"source"`
+	Message     string `json:"message"`
+	Database    string `json:"db,omitempty"`
+	Collection  string `json:"collection,omitempty"`
+	CommandName string `json:"commandName,omitempty"`
+	// Fields are the details specific to the type of event
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// EventSubscription receives the published events (of its types) on C until closed.
+// Events are dropped rather than blocking the publisher if C isn't drained.
+type EventSubscription struct {
+	C <-chan *Event
+
+	ch    chan *Event
+	types map[string]struct{}
+}
+
+// Close stops the subscription
+func (s *EventSubscription) Close() {
+	events.l.Lock()
+	defer events.l.Unlock()
+	delete(events.subs, s)
+}
+
+var events struct {
+	l    sync.RWMutex
+	subs map[*EventSubscription]struct{}
+}
+
+// SubscribeEvents subscribes to the events of the types (all if none)
+func SubscribeEvents(types ...string) *EventSubscription {
+	ch := make(chan *Event, 100)
+	s := &EventSubscription{C: ch, ch: ch}
+	if len(types) > 0 {
+		s.types = make(map[string]struct{}, len(types))
+		for _, t := range types {
+			s.types[t] = struct{}{}
+		}
+	}
+
+	events.l.Lock()
+	defer events.l.Unlock()
+	if events.subs == nil {
+		events.subs = make(map[*EventSubscription]struct{})
+	}
+	events.subs[s] = struct{}{}
+	return s
+}
+
+// EventSubscribers returns whether there are event subscribers, for publishers to
+// skip building events nobody receives
+func EventSubscribers() bool {
+	events.l.RLock()
+	defer events.l.RUnlock()
+	return len(events.subs) > 0
+}
+
+// PublishEvent sends the event to the subscribers of its type; its Time defaults
+// to now
+func PublishEvent(e *Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	events.l.RLock()
+	defer events.l.RUnlock()
+	for s := range events.subs {
+		if s.types != nil {
+			if _, ok := s.types[e.Type]; !ok {
+				continue
+			}
+		}
+		select {
+		case s.ch <- e:
+		default:
+			eventsDropped.Inc()
+		}
+	}
+}
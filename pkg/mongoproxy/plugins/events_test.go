@@ -0,0 +1,40 @@
+package plugins
+
+import (
+	"testing"
+)
+
+func TestEvents(t *testing.T) {
+	if EventSubscribers() {
+		t.Fatalf("expected no subscribers")
+	}
+	all, violations := SubscribeEvents(), SubscribeEvents(EventViolation)
+	defer violations.Close()
+	if !EventSubscribers() {
+		t.Fatalf("expected subscribers")
+	}
+
+	PublishEvent(&Event{Type: EventSlowQuery})
+	PublishEvent(&Event{Type: EventViolation})
+	if e := <-all.C; e.Type != EventSlowQuery || e.Time.IsZero() {
+		t.Fatalf("expected the slow query with its time, got %v", e)
+	}
+	if e := <-all.C; e.Type != EventViolation {
+		t.Fatalf("expected the violation, got %v", e)
+	}
+	if e := <-violations.C; e.Type != EventViolation {
+		t.Fatalf("expected only the violation, got %v", e)
+	}
+
+	// Slow subscribers miss events rather than blocking
+	all.Close()
+	for i := 0; i < 200; i++ {
+		PublishEvent(&Event{Type: EventViolation})
+	}
+	if n := len(violations.C); n != cap(violations.C) {
+		t.Fatalf("expected a full buffer, got %d events", n)
+	}
+	if len(all.C) != 0 {
+		t.Fatalf("expected no events after closing")
+	}
+}
@@ -0,0 +1,558 @@
+package export
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+	"github.com/wish/mongoproxy/pkg/objectstore"
+)
+
+const Name = "export"
+
+const (
+	// FormatBSON exports concatenated BSON documents (as mongodump writes them)
+	FormatBSON = "bson"
+	// FormatJSONL exports a relaxed extended JSON document per line (as
+	// mongoexport writes them)
+	FormatJSONL = "jsonl"
+	// FormatParquet exports a Parquet file, with a column per top-level field
+	FormatParquet = "parquet"
+
+	StatusRunning  = "running"
+	StatusDone     = "done"
+	StatusFailed   = "failed"
+	StatusCanceled = "canceled"
+)
+
+var (
+	jobsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_export_jobs_total",
+		Help: "The total export jobs finished",
+	}, []string{"db", "collection", "status"})
+	documentsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_export_documents_total",
+		Help: "The total documents exported",
+	}, []string{"db", "collection"})
+	bytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_export_bytes_total",
+		Help: "The total bytes exported",
+	}, []string{"db", "collection"})
+)
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &ExportPlugin{
+			conf: ExportPluginConfig{
+				MaxJobs:   2,
+				BatchSize: 1000,
+				Timeout:   "6h",
+				History:   100,
+			},
+			jobs: make(map[int64]*Job),
+		}
+	})
+}
+
+type ExportPluginConfig struct {
+	// S3 is the bucket results are exported to (required); GCS buckets are
+	// supported with their S3 compatible endpoint
+	S3 *objectstore.S3Config `bson:"s3"`
+	// MaxJobs is the maximum number of jobs running at once (default 2)
+	MaxJobs int `bson:"maxJobs"`
+	// BatchSize is the batch size of the cursors of the jobs (default 1000)
+	BatchSize int32 `bson:"batchSize"`
+	// Timeout is the timeout of a job (default "6h")
+	Timeout string `bson:"timeout"`
+	timeout time.Duration
+	// History is the number of finished jobs kept to be listed (default 100)
+	History int `bson:"history"`
+}
+
+// JobSpec is what a job exports: the results of a find (filter, projection, sort,
+// limit) or of an aggregation pipeline
+type JobSpec struct {
+	Database   string `bson:"db"`
+	Collection string `bson:"collection"`
+	Filter     bson.D `bson:"filter"`
+	Projection bson.D `bson:"projection"`
+	Sort       bson.D `bson:"sort"`
+	Limit      int64  `bson:"limit"`
+	Pipeline   bson.A `bson:"pipeline"`
+	// Format is the format of the export: bson, jsonl or parquet (default bson)
+	Format string `bson:"format"`
+	// Key is the key of the export (default
+	// "<db>/<collection>/<unix time>-<job id>.<format>")
+	Key string `bson:"key"`
+}
+
+func (s *JobSpec) load() error {
+	if s.Database == "" || s.Collection == "" {
+		return fmt.Errorf("db and collection are required")
+	}
+	if s.Pipeline != nil && (s.Filter != nil || s.Projection != nil || s.Sort != nil || s.Limit != 0) {
+		return fmt.Errorf("pipeline can't be used with filter, projection, sort or limit")
+	}
+	for _, stage := range s.Pipeline {
+		d, ok := stage.(bson.D)
+		if !ok || len(d) != 1 {
+			return fmt.Errorf("invalid pipeline stage %v", stage)
+		}
+		if d[0].Key == "$out" || d[0].Key == "$merge" {
+			return fmt.Errorf("%s stages can't be exported", d[0].Key)
+		}
+	}
+	if s.Limit < 0 {
+		return fmt.Errorf("limit must not be negative")
+	}
+	switch s.Format {
+	case "":
+		s.Format = FormatBSON
+	case FormatBSON, FormatJSONL, FormatParquet:
+	default:
+		return fmt.Errorf("invalid format %q; must be one of bson, jsonl, parquet", s.Format)
+	}
+	return nil
+}
+
+// command returns the command of the first batch of the export
+func (s *JobSpec) command(batchSize int32) bson.D {
+	if s.Pipeline != nil {
+		return bson.D{
+			{"aggregate", s.Collection},
+			{"pipeline", s.Pipeline},
+			{"cursor", bson.D{{"batchSize", batchSize}}},
+		}
+	}
+	filter := s.Filter
+	if filter == nil {
+		filter = bson.D{}
+	}
+	cmd := bson.D{{"find", s.Collection}, {"filter", filter}, {"batchSize", batchSize}}
+	if s.Projection != nil {
+		cmd = append(cmd, bson.E{"projection", s.Projection})
+	}
+	if s.Sort != nil {
+		cmd = append(cmd, bson.E{"sort", s.Sort})
+	}
+	if s.Limit > 0 {
+		cmd = append(cmd, bson.E{"limit", s.Limit})
+	}
+	return cmd
+}
+
+// Job is an export of query results
+type Job struct {
+	ID          int64      `json:"id"`
+	Database    string     `json:"db"`
+	Collection  string     `json:"collection"`
+	Format      string     `json:"format"`
+	URL         string     `json:"url"`
+	RequestedBy string     `json:"requestedBy"`
+	Status      string     `json:"status"`
+	Documents   int64      `json:"documents"`
+	Bytes       int64      `json:"bytes"`
+	Error       string     `json:"error,omitempty"`
+	StartedAt   time.Time  `json:"startedAt"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty"`
+
+	cancel context.CancelFunc
+}
+
+// This is a plugin that exports the results of queries to S3 (or GCS) on request
+// of the admin API, streaming them from the backend so large exports don't go
+// through application hosts
+type ExportPlugin struct {
+	conf ExportPluginConfig
+	s3   *objectstore.S3Client
+
+	crLock sync.RWMutex
+	cr     plugins.CommandRunner
+
+	lock   sync.Mutex
+	jobs   map[int64]*Job
+	nextID int64
+	wg     sync.WaitGroup
+}
+
+func (p *ExportPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *ExportPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	if p.conf.S3 == nil {
+		return fmt.Errorf("s3 is required")
+	}
+	if err := p.conf.S3.Load(); err != nil {
+		return fmt.Errorf("invalid s3: %w", err)
+	}
+	p.s3 = objectstore.NewS3Client(p.conf.S3, nil)
+	if p.conf.MaxJobs <= 0 || p.conf.BatchSize <= 0 || p.conf.History < 0 {
+		return fmt.Errorf("maxJobs and batchSize must be positive, and history not negative")
+	}
+	if p.conf.timeout, err = time.ParseDuration(p.conf.Timeout); err != nil {
+		return fmt.Errorf("invalid timeout: %w", err)
+	}
+	if p.conf.timeout <= 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+
+	return nil
+}
+
+// SetCommandRunner sets the runner the results are read with
+func (p *ExportPlugin) SetCommandRunner(cr plugins.CommandRunner) {
+	p.crLock.Lock()
+	defer p.crLock.Unlock()
+	p.cr = cr
+}
+
+func (p *ExportPlugin) commandRunner() plugins.CommandRunner {
+	p.crLock.RLock()
+	defer p.crLock.RUnlock()
+	return p.cr
+}
+
+// Stop cancels the running jobs and waits for them to finish
+func (p *ExportPlugin) Stop(ctx context.Context) error {
+	p.lock.Lock()
+	for _, job := range p.jobs {
+		if job.Status == StatusRunning {
+			job.cancel()
+		}
+	}
+	p.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Jobs returns the jobs, newest first
+func (p *ExportPlugin) Jobs() []Job {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	jobs := make([]Job, 0, len(p.jobs))
+	for _, job := range p.jobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID > jobs[j].ID })
+	return jobs
+}
+
+// Job returns the job (false if there's none)
+func (p *ExportPlugin) Job(id int64) (Job, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	job, ok := p.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// StartJob starts a job exporting the results of the spec
+func (p *ExportPlugin) StartJob(spec *JobSpec, requestedBy string) (Job, error) {
+	if err := spec.load(); err != nil {
+		return Job{}, err
+	}
+	cr := p.commandRunner()
+	if cr == nil {
+		return Job{}, fmt.Errorf("no plugin in the chain can run commands on the backend")
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	running := 0
+	for _, job := range p.jobs {
+		if job.Status == StatusRunning {
+			running++
+		}
+	}
+	if running >= p.conf.MaxJobs {
+		return Job{}, fmt.Errorf("%d jobs are already running", running)
+	}
+
+	p.nextID++
+	key := spec.Key
+	if key == "" {
+		key = fmt.Sprintf("%s/%s/%d-%d.%s", spec.Database, spec.Collection, time.Now().Unix(), p.nextID, spec.Format)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.conf.timeout)
+	job := &Job{
+		ID:          p.nextID,
+		Database:    spec.Database,
+		Collection:  spec.Collection,
+		Format:      spec.Format,
+		URL:         p.s3.URL(key),
+		RequestedBy: requestedBy,
+		Status:      StatusRunning,
+		StartedAt:   time.Now(),
+		cancel:      cancel,
+	}
+	p.jobs[job.ID] = job
+	logrus.Infof("EXPORT STARTED: job %d of %s.%s to %s requested by %q", job.ID, job.Database, job.Collection, job.URL, requestedBy)
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer cancel()
+		err := p.run(ctx, cr, job, spec, key)
+		p.finish(ctx, job, err)
+	}()
+	return *job, nil
+}
+
+// CancelJob cancels the running job; it returns false if there's no such job
+func (p *ExportPlugin) CancelJob(id int64) (Job, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	job, ok := p.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	if job.Status == StatusRunning {
+		job.cancel()
+	}
+	return *job, true
+}
+
+// run streams the results of the spec to the object of the key
+func (p *ExportPlugin) run(ctx context.Context, cr plugins.CommandRunner, job *Job, spec *JobSpec, key string) error {
+	upload := p.s3.Upload(key, map[string]string{
+		"Ns":     spec.Database + "." + spec.Collection,
+		"Format": spec.Format,
+	})
+	cmd := spec.command(p.conf.BatchSize)
+	enc := newEncoder(spec.Format)
+	var cursorID int64
+	err := func() error {
+		for {
+			result, err := cr.RunCommand(ctx, spec.Database, cmd)
+			if err != nil {
+				return err
+			}
+			if !bsonutil.Ok(result) {
+				msg, _ := bsonutil.Lookup(result, "errmsg")
+				return fmt.Errorf("%s failed: %v", cmd[0].Key, msg)
+			}
+			batch, _ := bsonutil.Lookup(result, "cursor", "firstBatch")
+			if batch == nil {
+				batch, _ = bsonutil.Lookup(result, "cursor", "nextBatch")
+			}
+			items, _ := batch.(primitive.A)
+			id, _ := bsonutil.Lookup(result, "cursor", "id")
+			cursorID, _ = id.(int64)
+
+			docs := make([]bson.Raw, len(items))
+			for i, item := range items {
+				if docs[i], err = bson.Marshal(item); err != nil {
+					return err
+				}
+			}
+			buf, err := enc.encode(docs)
+			if err != nil {
+				return err
+			}
+			if err := upload.Write(ctx, buf); err != nil {
+				return err
+			}
+			p.progress(job, int64(len(items)), int64(len(buf)))
+			if cursorID == 0 {
+				buf, err := enc.close()
+				if err != nil {
+					return err
+				}
+				if err := upload.Write(ctx, buf); err != nil {
+					return err
+				}
+				p.progress(job, 0, int64(len(buf)))
+				return nil
+			}
+			cmd = bson.D{{"getMore", cursorID}, {"collection", spec.Collection}, {"batchSize", p.conf.BatchSize}}
+		}
+	}()
+	if err == nil {
+		return upload.Close(ctx)
+	}
+
+	// Clean up with a new context, the job's may be canceled
+	cleanup, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if cursorID != 0 {
+		if result, err := cr.RunCommand(cleanup, spec.Database, bson.D{{"killCursors", spec.Collection}, {"cursors", bson.A{cursorID}}}); err != nil || !bsonutil.Ok(result) {
+			logrus.Debugf("Error killing cursor %d on %s.%s: %v %v", cursorID, spec.Database, spec.Collection, err, result)
+		}
+	}
+	if abortErr := upload.Abort(cleanup); abortErr != nil {
+		logrus.Warningf("Error aborting the upload of %s: %v", job.URL, abortErr)
+	}
+	return err
+}
+
+func (p *ExportPlugin) progress(job *Job, documents, bytes int64) {
+	p.lock.Lock()
+	job.Documents += documents
+	job.Bytes += bytes
+	p.lock.Unlock()
+	documentsTotal.WithLabelValues(job.Database, job.Collection).Add(float64(documents))
+	bytesTotal.WithLabelValues(job.Database, job.Collection).Add(float64(bytes))
+}
+
+// finish records the result of the job, and forgets the oldest finished jobs
+// beyond the history
+func (p *ExportPlugin) finish(ctx context.Context, job *Job, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	job.FinishedAt = &now
+	switch {
+	case err == nil:
+		job.Status = StatusDone
+	case ctx.Err() == context.Canceled:
+		job.Status = StatusCanceled
+		job.Error = err.Error()
+	default:
+		job.Status = StatusFailed
+		job.Error = err.Error()
+	}
+	jobsTotal.WithLabelValues(job.Database, job.Collection, job.Status).Inc()
+	if err != nil {
+		logrus.Warningf("EXPORT %s: job %d of %s.%s to %s after %d documents: %v",
+			strings.ToUpper(job.Status), job.ID, job.Database, job.Collection, job.URL, job.Documents, err)
+	} else {
+		logrus.Infof("EXPORT DONE: job %d of %s.%s to %s: %d documents, %d bytes",
+			job.ID, job.Database, job.Collection, job.URL, job.Documents, job.Bytes)
+	}
+
+	var finished []int64
+	for id, j := range p.jobs {
+		if j.Status != StatusRunning {
+			finished = append(finished, id)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i] < finished[j] })
+	for i := 0; i < len(finished)-p.conf.History; i++ {
+		delete(p.jobs, finished[i])
+	}
+}
+
+// adminUser returns the basic auth user of the request, or its remote address
+func adminUser(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok {
+		return user
+	}
+	return r.RemoteAddr
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// AdminHandler returns the handler for the export admin endpoints:
+//
+//	GET  jobs                the jobs, newest first
+//	POST jobs                start a job exporting the results of the JobSpec of the
+//	                         (extended JSON) body
+//	GET  jobs/{id}           the job
+//	POST jobs/{id}/cancel    cancel the running job
+func (p *ExportPlugin) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, p.Jobs())
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var d bson.D
+		if err := bson.UnmarshalExtJSON(b, false, &d); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var spec JobSpec
+		dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+		if err == nil {
+			err = dec.Decode(&spec)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		job, err := p.StartJob(&spec, adminUser(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeJSON(w, job)
+	})
+	mux.HandleFunc("/jobs/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+		id, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var (
+			job Job
+			ok  bool
+		)
+		switch {
+		case len(parts) == 1:
+			job, ok = p.Job(id)
+		case len(parts) == 2 && parts[1] == "cancel" && r.Method == http.MethodPost:
+			job, ok = p.CancelJob(id)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if !ok {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, job)
+	})
+	return mux
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *ExportPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	return next(ctx, r)
+}
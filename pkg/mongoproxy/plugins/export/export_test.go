@@ -0,0 +1,309 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v7/arrow"
+	"github.com/apache/arrow/go/v7/arrow/array"
+	"github.com/apache/arrow/go/v7/arrow/memory"
+	"github.com/apache/arrow/go/v7/parquet/pqarrow"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+	"github.com/wish/mongoproxy/pkg/objectstore"
+)
+
+// backend is a plugins.CommandRunner returning 5 documents in batches of 2, or
+// blocking until canceled for the "slow" collection
+type backend struct {
+	lock sync.Mutex
+	cmds []bson.D
+	// next is the first document of the next batch of the open cursor
+	next int
+}
+
+func (b *backend) RunCommand(ctx context.Context, db string, cmd bson.D) (bson.D, error) {
+	if cmd[0].Value == "slow" {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.cmds = append(b.cmds, cmd)
+
+	key := "nextBatch"
+	switch cmd[0].Key {
+	case "find", "aggregate":
+		key, b.next = "firstBatch", 0
+	case "getMore":
+	default:
+		return bson.D{{"ok", 1}}, nil
+	}
+	var docs primitive.A
+	for ; b.next < 5 && len(docs) < 2; b.next++ {
+		docs = append(docs, bson.D{{"_id", int32(b.next)}, {"at", primitive.NewDateTimeFromTime(time.Unix(0, 0))}})
+	}
+	id := int64(7)
+	if b.next == 5 {
+		id = 0
+	}
+	return bson.D{{"cursor", bson.D{{key, docs}, {"id", id}}}, {"ok", 1}}, nil
+}
+
+func newPlugin(t *testing.T) (*ExportPlugin, *backend, map[string][]byte, func()) {
+	var lock sync.Mutex
+	objects := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		objects[r.URL.Path] = body
+		lock.Unlock()
+	}))
+
+	plugin, _ := plugins.GetPlugin(Name)
+	p := plugin.(*ExportPlugin)
+	if err := p.Configure(bson.D{
+		{"s3", bson.D{{"bucket", "bucket"}, {"region", "us-west-1"}, {"endpoint", server.URL}}},
+		{"history", 2},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	p.s3 = objectstore.NewS3Client(p.conf.S3, credentials.NewStaticCredentials("AKID", "SECRET", ""))
+	b := &backend{}
+	p.SetCommandRunner(b)
+	return p, b, objects, server.Close
+}
+
+// wait waits for the job to finish
+func wait(t *testing.T, p *ExportPlugin, id int64) Job {
+	for i := 0; i < 500; i++ {
+		job, _ := p.Job(id)
+		if job.Status != StatusRunning {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %d didn't finish", id)
+	return Job{}
+}
+
+func TestExport(t *testing.T) {
+	p, b, objects, stop := newPlugin(t)
+	defer stop()
+
+	job, err := p.StartJob(&JobSpec{
+		Database:   "db",
+		Collection: "coll",
+		Filter:     bson.D{{"a", 1}},
+		Sort:       bson.D{{"_id", 1}},
+		Format:     FormatJSONL,
+		Key:        "exports/coll.jsonl",
+	}, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job = wait(t, p, job.ID); job.Status != StatusDone || job.Documents != 5 || job.URL != "s3://bucket/exports/coll.jsonl" {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(objects["/bucket/exports/coll.jsonl"]), "\n"), "\n")
+	if len(lines) != 5 || lines[4] != `{"_id":4,"at":{"$date":"1970-01-01T00:00:00Z"}}` {
+		t.Fatalf("unexpected export %q", lines)
+	}
+	if int64(len(objects["/bucket/exports/coll.jsonl"])) != job.Bytes {
+		t.Fatalf("expected %d bytes, got %d", len(objects["/bucket/exports/coll.jsonl"]), job.Bytes)
+	}
+	if find := b.cmds[0]; find[0].Key != "find" {
+		t.Fatalf("unexpected command %v", find)
+	} else if sort, _ := bsonutil.Lookup(find, "sort"); sort == nil {
+		t.Fatalf("expected the sort in the find, got %v", find)
+	}
+
+	job, err = p.StartJob(&JobSpec{
+		Database:   "db",
+		Collection: "coll",
+		Pipeline:   bson.A{bson.D{{"$match", bson.D{{"a", 1}}}}},
+	}, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = wait(t, p, job.ID)
+	if job.Status != StatusDone || !strings.HasPrefix(job.URL, "s3://bucket/db/coll/") || !strings.HasSuffix(job.URL, ".bson") {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	body := objects[strings.TrimPrefix(job.URL, "s3:/")]
+	for i := 0; i < 5; i++ {
+		doc := bson.Raw(body[:binary.LittleEndian.Uint32(body)])
+		if err := doc.Validate(); err != nil {
+			t.Fatalf("invalid document %d: %v", i, err)
+		}
+		if id := doc.Lookup("_id").Int32(); id != int32(i) {
+			t.Fatalf("expected document %d, got %v", i, doc)
+		}
+		body = body[len(doc):]
+	}
+	if len(body) != 0 {
+		t.Fatalf("unexpected trailing bytes %v", body)
+	}
+}
+
+func TestExportParquet(t *testing.T) {
+	p, _, objects, stop := newPlugin(t)
+	defer stop()
+
+	job, err := p.StartJob(&JobSpec{Database: "db", Collection: "coll", Format: FormatParquet}, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = wait(t, p, job.ID)
+	if job.Status != StatusDone || !strings.HasSuffix(job.URL, ".parquet") || job.Documents != 5 {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	body := objects[strings.TrimPrefix(job.URL, "s3:/")]
+	if int64(len(body)) != job.Bytes {
+		t.Fatalf("expected %d bytes, got %d", len(body), job.Bytes)
+	}
+
+	tbl, err := pqarrow.ReadTable(context.TODO(), bytes.NewReader(body), nil, pqarrow.ArrowReadProperties{}, memory.NewGoAllocator())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Release()
+	if tbl.NumRows() != 5 || tbl.NumCols() != 2 || tbl.Schema().Field(0).Name != "_id" || tbl.Schema().Field(1).Name != "at" {
+		t.Fatalf("unexpected table %v", tbl.Schema())
+	}
+	var ids []int32
+	for _, chunk := range tbl.Column(0).Data().Chunks() {
+		ids = append(ids, chunk.(*array.Int32).Int32Values()...)
+	}
+	if !reflect.DeepEqual(ids, []int32{0, 1, 2, 3, 4}) {
+		t.Fatalf("unexpected ids %v", ids)
+	}
+	at := tbl.Column(1).Data().Chunk(0).(*array.Timestamp)
+	if at.DataType().ID() != arrow.TIMESTAMP || at.Value(0) != 0 {
+		t.Fatalf("unexpected dates %v", at)
+	}
+
+	// An export without documents is a valid file
+	enc := newEncoder(FormatParquet)
+	b, err := enc.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tbl, err := pqarrow.ReadTable(context.TODO(), bytes.NewReader(b), nil, pqarrow.ArrowReadProperties{}, memory.NewGoAllocator()); err != nil || tbl.NumRows() != 0 {
+		t.Fatalf("unexpected empty export: %v", err)
+	}
+}
+
+func TestExportCancel(t *testing.T) {
+	p, _, objects, stop := newPlugin(t)
+	defer stop()
+
+	var ids []int64
+	for i := 0; i < 2; i++ {
+		job, err := p.StartJob(&JobSpec{Database: "db", Collection: "slow"}, "admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, job.ID)
+	}
+	if _, err := p.StartJob(&JobSpec{Database: "db", Collection: "slow"}, "admin"); err == nil {
+		t.Fatal("expected at most 2 jobs to run")
+	}
+
+	if _, ok := p.CancelJob(ids[0]); !ok {
+		t.Fatal("expected the job to be canceled")
+	}
+	if job := wait(t, p, ids[0]); job.Status != StatusCanceled {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	if err := p.Stop(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if job, _ := p.Job(ids[1]); job.Status != StatusCanceled {
+		t.Fatalf("expected stopping to cancel the job, got %+v", job)
+	}
+	if len(objects) != 0 {
+		t.Fatalf("expected no export, got %v", objects)
+	}
+
+	// Only the history of finished jobs is kept
+	for i := 0; i < 2; i++ {
+		job, _ := p.StartJob(&JobSpec{Database: "db", Collection: "coll"}, "admin")
+		wait(t, p, job.ID)
+	}
+	if jobs := p.Jobs(); len(jobs) != 2 || jobs[0].ID != 4 {
+		t.Fatalf("unexpected jobs %+v", jobs)
+	}
+}
+
+func TestExportAdmin(t *testing.T) {
+	p, _, _, stop := newPlugin(t)
+	defer stop()
+	h := p.AdminHandler()
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{http.MethodPost, "/jobs", `{"db": "db", "collection": "coll", "filter": {"at": {"$gte": {"$date": "2021-01-01T00:00:00Z"}}}, "format": "jsonl"}`, http.StatusOK},
+		{http.MethodPost, "/jobs", `{"db": "db", "collection": "coll", "unknown": 1}`, http.StatusBadRequest},
+		{http.MethodPost, "/jobs", `{"db": "db", "collection": "coll", "pipeline": [{"$out": "other"}]}`, http.StatusConflict},
+		{http.MethodPost, "/jobs", `{"db": "db", "collection": "coll", "format": "csv"}`, http.StatusConflict},
+		{http.MethodGet, "/jobs", "", http.StatusOK},
+		{http.MethodGet, "/jobs/1", "", http.StatusOK},
+		{http.MethodGet, "/jobs/9", "", http.StatusNotFound},
+		{http.MethodPost, "/jobs/1/cancel", "", http.StatusOK},
+		{http.MethodGet, "/jobs/1/cancel", "", http.StatusNotFound},
+	}
+	for i, test := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(test.method, test.path, strings.NewReader(test.body)))
+		if w.Code != test.code {
+			t.Fatalf("%d: expected %d, got %d: %s", i, test.code, w.Code, w.Body)
+		}
+		if i == 0 {
+			var job Job
+			if err := json.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode(&job); err != nil || job.ID != 1 || job.Format != FormatJSONL {
+				t.Fatalf("unexpected job %s: %v", w.Body, err)
+			}
+			wait(t, p, job.ID)
+		}
+	}
+}
+
+func TestExportConfig(t *testing.T) {
+	s3 := bson.E{"s3", bson.D{{"bucket", "b"}, {"region", "us-west-1"}}}
+	tests := []struct {
+		config bson.D
+		ok     bool
+	}{
+		{bson.D{s3}, true},
+		{bson.D{s3, {"maxJobs", 4}, {"batchSize", 100}, {"timeout", "1h"}}, true},
+		{bson.D{}, false},
+		{bson.D{{"s3", bson.D{{"bucket", "b"}}}}, false},
+		{bson.D{s3, {"maxJobs", 0}}, false},
+		{bson.D{s3, {"timeout", "never"}}, false},
+	}
+	for i, test := range tests {
+		plugin, _ := plugins.GetPlugin(Name)
+		if err := plugin.Configure(test.config); (err == nil) != test.ok {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+}
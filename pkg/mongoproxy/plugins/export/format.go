@@ -0,0 +1,130 @@
+package export
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/apache/arrow/go/v7/arrow/memory"
+	"github.com/apache/arrow/go/v7/parquet"
+	"github.com/apache/arrow/go/v7/parquet/compress"
+	"github.com/apache/arrow/go/v7/parquet/pqarrow"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonarrow"
+)
+
+// encoder encodes the batches of an export
+type encoder interface {
+	// encode returns the encoding of the batch
+	encode(batch []bson.Raw) ([]byte, error)
+	// close returns the encoding of the end of the export
+	close() ([]byte, error)
+}
+
+func newEncoder(format string) encoder {
+	switch format {
+	case FormatJSONL:
+		return jsonlEncoder{}
+	case FormatParquet:
+		return &parquetEncoder{mem: memory.NewGoAllocator()}
+	default:
+		return bsonEncoder{}
+	}
+}
+
+// bsonEncoder encodes concatenated BSON documents
+type bsonEncoder struct{}
+
+func (bsonEncoder) encode(batch []bson.Raw) ([]byte, error) {
+	var buf []byte
+	for _, doc := range batch {
+		buf = append(buf, doc...)
+	}
+	return buf, nil
+}
+
+func (bsonEncoder) close() ([]byte, error) { return nil, nil }
+
+// jsonlEncoder encodes a relaxed extended JSON document per line
+type jsonlEncoder struct{}
+
+func (jsonlEncoder) encode(batch []bson.Raw) ([]byte, error) {
+	var buf []byte
+	for _, doc := range batch {
+		b, err := bson.MarshalExtJSON(doc, false, false)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(append(buf, b...), '\n')
+	}
+	return buf, nil
+}
+
+func (jsonlEncoder) close() ([]byte, error) { return nil, nil }
+
+// parquetEncoder encodes a Parquet file with a (snappy compressed) row group per
+// batch. The columns are typed by the first batch, as the data API's Arrow
+// streams are: a later document with another field, or a value that doesn't fit
+// its column, fails the export.
+type parquetEncoder struct {
+	mem    memory.Allocator
+	schema *bsonarrow.Schema
+	w      *pqarrow.FileWriter
+	// buf is the output of w not returned yet
+	buf bytes.Buffer
+}
+
+// open opens the writer of the file, with the schema of the batch
+func (e *parquetEncoder) open(batch []bson.Raw) error {
+	schema, err := bsonarrow.NewSchema(batch)
+	if err != nil {
+		return err
+	}
+	props := parquet.NewWriterProperties(parquet.WithCompression(compress.Codecs.Snappy))
+	w, err := pqarrow.NewFileWriter(schema.Arrow(), &e.buf, props, pqarrow.NewArrowWriterProperties(pqarrow.WithStoreSchema()))
+	if err != nil {
+		return err
+	}
+	e.schema, e.w = schema, w
+	return nil
+}
+
+func (e *parquetEncoder) encode(batch []bson.Raw) ([]byte, error) {
+	if len(batch) == 0 {
+		return nil, nil
+	}
+	if e.w == nil {
+		if err := e.open(batch); err != nil {
+			return nil, err
+		}
+	}
+	rec, err := e.schema.Record(e.mem, batch)
+	if err != nil {
+		return nil, fmt.Errorf("documents don't fit the parquet schema of the first batch: %w", err)
+	}
+	defer rec.Release()
+	if err := e.w.Write(rec); err != nil {
+		return nil, err
+	}
+	return e.flush(), nil
+}
+
+func (e *parquetEncoder) close() ([]byte, error) {
+	// An export without documents is a file without columns
+	if e.w == nil {
+		if err := e.open(nil); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.w.Close(); err != nil {
+		return nil, err
+	}
+	return e.flush(), nil
+}
+
+// flush returns (and forgets) the output of the writer so far
+func (e *parquetEncoder) flush() []byte {
+	b := append([]byte(nil), e.buf.Bytes()...)
+	e.buf.Reset()
+	return b
+}
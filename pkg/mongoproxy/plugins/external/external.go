@@ -0,0 +1,421 @@
+package external
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	mongoproxyv1 "github.com/wish/mongoproxy/api/mongoproxy/v1"
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+var (
+	externalCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_external_calls_total",
+		Help: "The total number of calls to external plugin processes",
+	}, []string{"method", "result"})
+)
+
+const (
+	Name = "external"
+
+	// CoreProtocolVersion is the version of the handshake (as in go-plugin)
+	CoreProtocolVersion = 1
+	// ProtocolVersion is the version of the plugin's gRPC API (see
+	// api/mongoproxy/v1/plugin.proto)
+	ProtocolVersion = 2
+
+	// HealthService is the service name plugin processes report their health
+	// for with the gRPC health service
+	HealthService = "mongoproxy.v1.ExternalPlugin"
+
+	// MagicCookieKey is the environment variable set for processes started by
+	// the plugin; processes can use this to detect they are being run as a plugin.
+	MagicCookieKey   = "MONGOPROXY_PLUGIN"
+	MagicCookieValue = "1"
+)
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &ExternalPlugin{
+			conf: ExternalPluginConfig{
+				Network:          "tcp",
+				Timeout:          "1s",
+				HandshakeTimeout: "10s",
+			},
+		}
+	})
+}
+
+// ExternalPluginConfig configures the external plugin. Either Command (a process
+// to start) or Address (an already running process) must be set.
+type ExternalPluginConfig struct {
+	// Command (and args) of the plugin process to start. The process must print
+	// a handshake line of the form "1|2|<network>|<address>|grpc" to stdout once
+	// listening.
+	Command []string `bson:"command"`
+
+	// Network and Address of an already running plugin process
+	Network string `bson:"network"`
+	Address string `bson:"address"`
+
+	// Timeout for each call to the plugin process
+	Timeout string `bson:"timeout"`
+	timeout time.Duration
+	// HandshakeTimeout is how long to wait for a started process to handshake
+	HandshakeTimeout string `bson:"handshakeTimeout"`
+	handshakeTimeout time.Duration
+
+	// ResponseHook enables sending responses to the plugin process
+	ResponseHook bool `bson:"responseHook"`
+	// FailOpen will pass requests through if the plugin process is unavailable
+	// (instead of returning an error to the client)
+	FailOpen bool `bson:"failOpen"`
+}
+
+// ExternalPlugin forwards requests (and optionally responses) to a plugin
+// running in another process over gRPC. This allows interceptors to be written
+// in other languages and isolates crashes from the proxy.
+type ExternalPlugin struct {
+	conf ExternalPluginConfig
+
+	l      sync.Mutex
+	cmd    *exec.Cmd
+	conn   *grpc.ClientConn
+	client mongoproxyv1.ExternalPluginClient
+}
+
+func (p *ExternalPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *ExternalPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	if len(p.conf.Command) == 0 && p.conf.Address == "" {
+		return fmt.Errorf("one of command or address must be set")
+	}
+
+	if p.conf.timeout, err = time.ParseDuration(p.conf.Timeout); err != nil {
+		return err
+	}
+	if p.conf.handshakeTimeout, err = time.ParseDuration(p.conf.HandshakeTimeout); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Start starts (or connects to) the plugin process
+func (p *ExternalPlugin) Start(ctx context.Context) error {
+	p.l.Lock()
+	defer p.l.Unlock()
+	_, err := p.getClient()
+	return err
+}
+
+// Stop disconnects from (and stops) the plugin process
+func (p *ExternalPlugin) Stop(ctx context.Context) error {
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.reset()
+	return nil
+}
+
+// ReadsBatches returns whether responses (including their cursor batches) are
+// sent to the plugin process
+func (p *ExternalPlugin) ReadsBatches() bool { return p.conf.ResponseHook }
+
+// Health checks that the plugin process is serving (with the gRPC health service)
+func (p *ExternalPlugin) Health(ctx context.Context) error {
+	return p.call(ctx, "Health", func(ctx context.Context, conn *grpc.ClientConn, _ mongoproxyv1.ExternalPluginClient) error {
+		resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: HealthService})
+		if err != nil {
+			return err
+		}
+		if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+			return fmt.Errorf("plugin process is %s", resp.Status)
+		}
+		return nil
+	})
+}
+
+// reset closes the connection and kills the process (if we started it); must be called with the lock held
+func (p *ExternalPlugin) reset() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+		p.client = nil
+	}
+	if p.cmd != nil {
+		p.cmd.Process.Kill()
+		p.cmd.Wait()
+		p.cmd = nil
+	}
+}
+
+// getClient returns the connection (starting/connecting if required); must be called with the lock held
+func (p *ExternalPlugin) getClient() (*grpc.ClientConn, error) {
+	if p.conn != nil {
+		return p.conn, nil
+	}
+	// Ensure a previous process is cleaned up
+	p.reset()
+
+	network, addr := p.conf.Network, p.conf.Address
+	if len(p.conf.Command) > 0 {
+		var err error
+		network, addr, err = p.startProcess()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.conf.handshakeTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, "passthrough:///"+addr,
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		// Fail (e.g. on connection refused) rather than retrying until the timeout
+		grpc.FailOnNonTempDialError(true),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}),
+	)
+	if err != nil {
+		p.reset()
+		return nil, err
+	}
+	p.conn = conn
+	p.client = mongoproxyv1.NewExternalPluginClient(conn)
+	return p.conn, nil
+}
+
+// startProcess starts the plugin process and reads the handshake from its stdout
+func (p *ExternalPlugin) startProcess() (string, string, error) {
+	cmd := exec.Command(p.conf.Command[0], p.conf.Command[1:]...)
+	cmd.Env = append(os.Environ(), MagicCookieKey+"="+MagicCookieValue)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", "", err
+	}
+	p.cmd = cmd
+
+	lineCh := make(chan string, 1)
+	go func() {
+		s := bufio.NewScanner(stdout)
+		if s.Scan() {
+			lineCh <- s.Text()
+		}
+		close(lineCh)
+		// Pass along the rest of the output to our logs
+		for s.Scan() {
+			logrus.Infof("external plugin %s: %s", p.conf.Command[0], s.Text())
+		}
+	}()
+
+	select {
+	case line, ok := <-lineCh:
+		if !ok {
+			p.reset()
+			return "", "", fmt.Errorf("plugin process exited before handshake")
+		}
+		return parseHandshake(line)
+	case <-time.After(p.conf.handshakeTimeout):
+		p.reset()
+		return "", "", fmt.Errorf("timeout waiting for plugin handshake")
+	}
+}
+
+// parseHandshake parses the handshake line of a plugin process, of the form
+// CORE-PROTOCOL-VERSION|APP-PROTOCOL-VERSION|NETWORK|ADDRESS|PROTOCOL (as of
+// go-plugin), returning its network and address
+func parseHandshake(line string) (string, string, error) {
+	parts := strings.Split(strings.TrimSpace(line), "|")
+	if len(parts) != 5 {
+		return "", "", fmt.Errorf("invalid plugin handshake: %q", line)
+	}
+	if parts[0] != fmt.Sprint(CoreProtocolVersion) {
+		return "", "", fmt.Errorf("unsupported plugin handshake version: %s", parts[0])
+	}
+	if parts[1] != fmt.Sprint(ProtocolVersion) {
+		return "", "", fmt.Errorf("unsupported plugin protocol version: %s", parts[1])
+	}
+	if parts[4] != "grpc" {
+		return "", "", fmt.Errorf("unsupported plugin protocol: %s", parts[4])
+	}
+	return parts[2], parts[3], nil
+}
+
+// isUnavailable returns whether the error of a call means the plugin process
+// is unavailable (rather than the plugin returning an error itself)
+func isUnavailable(err error) bool {
+	s, ok := status.FromError(err)
+	if !ok {
+		return true
+	}
+	switch s.Code() {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled:
+		return true
+	}
+	return false
+}
+
+// call calls the method on the plugin process, resetting the connection if the
+// process is unavailable so that the next call will reconnect (or restart the
+// process).
+func (p *ExternalPlugin) call(ctx context.Context, method string, f func(context.Context, *grpc.ClientConn, mongoproxyv1.ExternalPluginClient) error) (err error) {
+	defer func() {
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		externalCalls.WithLabelValues(method, result).Inc()
+	}()
+
+	p.l.Lock()
+	conn, err := p.getClient()
+	client := p.client
+	p.l.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.conf.timeout)
+	defer cancel()
+
+	// Errors with other codes are returned by the plugin itself; an unavailable
+	// process may have died, so reset it.
+	if err = f(ctx, conn, client); err != nil && isUnavailable(err) {
+		p.l.Lock()
+		if p.conn == conn {
+			p.reset()
+		}
+		p.l.Unlock()
+	}
+	return err
+}
+
+func (p *ExternalPlugin) unavailable(err error) (bson.D, error) {
+	logrus.Errorf("error calling external plugin: %v", err)
+	return mongoerror.InternalError.ErrMessage("external plugin unavailable"), nil
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *ExternalPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	cmd, err := bson.Marshal(r.Command)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &mongoproxyv1.ProcessRequestRequest{
+		CommandName: r.CommandName,
+		Database:    command.GetCommandDatabase(r.Command),
+		Collection:  command.GetCommandCollection(r.Command),
+		Command:     cmd,
+	}
+	var reply *mongoproxyv1.ProcessRequestResponse
+	if err := p.call(ctx, "ProcessRequest", func(ctx context.Context, _ *grpc.ClientConn, client mongoproxyv1.ExternalPluginClient) (err error) {
+		reply, err = client.ProcessRequest(ctx, req)
+		return err
+	}); err != nil {
+		if isUnavailable(err) && p.conf.FailOpen {
+			return next(ctx, r)
+		}
+		return p.unavailable(err)
+	}
+
+	if len(reply.Response) > 0 {
+		var resp bson.D
+		if err := bson.Unmarshal(reply.Response, &resp); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+
+	if len(reply.Command) > 0 {
+		var d bson.D
+		if err := bson.Unmarshal(reply.Command, &d); err != nil {
+			return nil, err
+		}
+		cmd, ok := command.GetCommand(r.CommandName)
+		if !ok {
+			return nil, fmt.Errorf("unknown command %s", r.CommandName)
+		}
+		if err := cmd.FromBSOND(d); err != nil {
+			return nil, err
+		}
+		r.SetCommand(r.CommandName, cmd, d)
+	}
+
+	result, err := next(ctx, r)
+	if err != nil || !p.conf.ResponseHook {
+		return result, err
+	}
+	return p.processResponse(ctx, req, result)
+}
+
+// processResponse sends the response to the plugin process
+func (p *ExternalPlugin) processResponse(ctx context.Context, args *mongoproxyv1.ProcessRequestRequest, d bson.D) (bson.D, error) {
+	b, err := bson.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &mongoproxyv1.ProcessResponseRequest{
+		CommandName: args.CommandName,
+		Database:    args.Database,
+		Collection:  args.Collection,
+		Response:    b,
+	}
+	var reply *mongoproxyv1.ProcessResponseResponse
+	if err := p.call(ctx, "ProcessResponse", func(ctx context.Context, _ *grpc.ClientConn, client mongoproxyv1.ExternalPluginClient) (err error) {
+		reply, err = client.ProcessResponse(ctx, req)
+		return err
+	}); err != nil {
+		if isUnavailable(err) && p.conf.FailOpen {
+			return d, nil
+		}
+		return p.unavailable(err)
+	}
+
+	if len(reply.Response) > 0 {
+		var resp bson.D
+		if err := bson.Unmarshal(reply.Response, &resp); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+	return d, nil
+}
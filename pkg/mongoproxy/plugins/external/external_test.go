@@ -0,0 +1,183 @@
+package external
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	mongoproxyv1 "github.com/wish/mongoproxy/api/mongoproxy/v1"
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+// testPlugin is an external plugin implementation which rejects commands against
+// the "secret" collection and limits all finds to 1 document
+type testPlugin struct {
+	mongoproxyv1.UnimplementedExternalPluginServer
+}
+
+func (testPlugin) ProcessRequest(ctx context.Context, req *mongoproxyv1.ProcessRequestRequest) (*mongoproxyv1.ProcessRequestResponse, error) {
+	reply := &mongoproxyv1.ProcessRequestResponse{}
+	switch {
+	case req.Collection == "secret":
+		b, err := bson.Marshal(bson.D{{"ok", 0}, {"errmsg", "rejected"}, {"code", 13}})
+		if err != nil {
+			return nil, err
+		}
+		reply.Response = b
+	case req.CommandName == "find":
+		var d bson.D
+		if err := bson.Unmarshal(req.Command, &d); err != nil {
+			return nil, err
+		}
+		d = append(d, bson.E{"limit", int64(1)})
+		b, err := bson.Marshal(d)
+		if err != nil {
+			return nil, err
+		}
+		reply.Command = b
+	case req.CommandName == "insert":
+		return nil, status.Error(codes.PermissionDenied, "plugin error")
+	}
+	return reply, nil
+}
+
+func (testPlugin) ProcessResponse(ctx context.Context, req *mongoproxyv1.ProcessResponseRequest) (*mongoproxyv1.ProcessResponseResponse, error) {
+	b, err := bson.Marshal(bson.D{{"ok", 1}, {"rewritten", true}})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoproxyv1.ProcessResponseResponse{Response: b}, nil
+}
+
+func serve(t *testing.T) (net.Listener, *grpc.Server) {
+	s := grpc.NewServer()
+	mongoproxyv1.RegisterExternalPluginServer(s, testPlugin{})
+	hs := health.NewServer()
+	hs.SetServingStatus(HealthService, grpc_health_v1.HealthCheckResponse_SERVING)
+	grpc_health_v1.RegisterHealthServer(s, hs)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return l, s
+}
+
+func TestExternal(t *testing.T) {
+	l, s := serve(t)
+
+	p := &ExternalPlugin{}
+	if err := p.Configure(bson.D{
+		{"address", l.Addr().String()},
+		{"network", "tcp"},
+		{"timeout", "1s"},
+		{"handshakeTimeout", "1s"},
+		{"responseHook", true},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Start(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop(context.TODO())
+
+	if err := p.Health(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+
+	var limit *int64
+	pipe := plugins.BuildPipeline([]plugins.Plugin{p}, func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+		if find, ok := r.Command.(*command.Find); ok {
+			limit = find.Limit
+		}
+		return bson.D{{"ok", 1}}, nil
+	})
+
+	// Rewritten command and response
+	result, err := pipe(context.TODO(), &plugins.Request{
+		CommandName: "find",
+		Command:     &command.Find{Collection: "foo", Common: command.Common{Database: "db"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit == nil || *limit != 1 {
+		t.Fatalf("command not rewritten: %v", limit)
+	}
+	if v, _ := bsonutil.Lookup(result, "rewritten"); v != true {
+		t.Fatalf("response not rewritten: %v", result)
+	}
+
+	// Rejected command
+	result, err = pipe(context.TODO(), &plugins.Request{
+		CommandName: "find",
+		Command:     &command.Find{Collection: "secret", Common: command.Common{Database: "db"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bsonutil.Ok(result) {
+		t.Fatalf("expected rejection: %v", result)
+	}
+
+	// Error from the plugin
+	result, err = pipe(context.TODO(), &plugins.Request{
+		CommandName: "insert",
+		Command:     &command.Insert{Collection: "foo", Common: command.Common{Database: "db"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bsonutil.Ok(result) {
+		t.Fatalf("expected error: %v", result)
+	}
+
+	// Plugin process down; failOpen passes through
+	s.Stop()
+	p.Stop(context.TODO())
+	if err := p.Health(context.TODO()); err == nil {
+		t.Fatalf("expected unhealthy")
+	}
+	result, _ = pipe(context.TODO(), &plugins.Request{
+		CommandName: "find",
+		Command:     &command.Find{Collection: "foo", Common: command.Common{Database: "db"}},
+	})
+	if bsonutil.Ok(result) {
+		t.Fatalf("expected error with plugin down: %v", result)
+	}
+	p.conf.FailOpen = true
+	result, _ = pipe(context.TODO(), &plugins.Request{
+		CommandName: "find",
+		Command:     &command.Find{Collection: "foo", Common: command.Common{Database: "db"}},
+	})
+	if !bsonutil.Ok(result) {
+		t.Fatalf("expected pass through with failOpen: %v", result)
+	}
+}
+
+func TestParseHandshake(t *testing.T) {
+	network, addr, err := parseHandshake("1|2|tcp|127.0.0.1:1234|grpc\n")
+	if err != nil || network != "tcp" || addr != "127.0.0.1:1234" {
+		t.Fatalf("mismatch: %s %s %v", network, addr, err)
+	}
+	for _, line := range []string{
+		"2|2|tcp|127.0.0.1:1234|grpc",
+		"1|1|tcp|127.0.0.1:1234|grpc",
+		"1|2|tcp|127.0.0.1:1234|netrpc",
+		"1|tcp|127.0.0.1:1234",
+		"garbage",
+	} {
+		if _, _, err := parseHandshake(line); err == nil {
+			t.Fatalf("expected an error for %q", line)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package plugins
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ForwardedClientField is the field of commands a proxy sends to another
+// (downstream) proxy carrying the client the command came from
+const ForwardedClientField = "$mongoproxyClient"
+
+// ForwardedClient is the original client of a command sent through a chain of
+// proxies. It is signed with a key shared by the proxies, so a downstream proxy
+// only trusts the clients forwarded by its upstream proxies.
+type ForwardedClient struct {
+	Addr       string              `bson:"addr"`
+	AppName    string              `bson:"appName,omitempty"`
+	Identities []ForwardedIdentity `bson:"identities,omitempty"`
+	TraceID    string              `bson:"traceId,omitempty"`
+	Tenant     string              `bson:"tenant,omitempty"`
+	// Time is when the command was forwarded; commands forwarded too long ago are
+	// rejected so a captured client can't be replayed indefinitely
+	Time      primitive.DateTime `bson:"time"`
+	Signature []byte             `bson:"sig,omitempty"`
+}
+
+// ForwardedIdentity is an identity of the original client
+type ForwardedIdentity struct {
+	Type  string   `bson:"type"`
+	User  string   `bson:"user"`
+	Roles []string `bson:"roles,omitempty"`
+}
+
+// NewForwardedClient returns the client of the request to forward
+func NewForwardedClient(ctx context.Context, r *Request) *ForwardedClient {
+	f := &ForwardedClient{Time: primitive.NewDateTimeFromTime(time.Now())}
+	if r.CC != nil {
+		f.Addr, f.AppName = r.CC.GetAddr(), r.CC.AppName
+		for _, ident := range r.CC.Identities {
+			f.Identities = append(f.Identities, ForwardedIdentity{Type: ident.Type(), User: ident.User(), Roles: ident.Roles()})
+		}
+	}
+	if md := GetMetadata(ctx); md != nil {
+		f.TraceID, f.Tenant = md.TraceID(), md.Tenant()
+	}
+	return f
+}
+
+// mac returns the signature of the client forwarded with the command (by name) on
+// the database
+func (f *ForwardedClient) mac(key []byte, commandName, db string) ([]byte, error) {
+	unsigned := *f
+	unsigned.Signature = nil
+	b, err := bson.Marshal(unsigned)
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write(b)
+	h.Write([]byte(commandName + "\x00" + db))
+	return h.Sum(nil), nil
+}
+
+// Sign signs the client forwarded with the command (by name) on the database
+func (f *ForwardedClient) Sign(key []byte, commandName, db string) error {
+	sig, err := f.mac(key, commandName, db)
+	if err != nil {
+		return err
+	}
+	f.Signature = sig
+	return nil
+}
+
+// Verify checks that the client was forwarded with the command on the database,
+// signed with one of the keys, within maxAge
+func (f *ForwardedClient) Verify(keys [][]byte, commandName, db string, maxAge time.Duration) error {
+	if age := time.Since(f.Time.Time()); age > maxAge || age < -maxAge {
+		return fmt.Errorf("forwarded %s ago", age)
+	}
+	for _, key := range keys {
+		sig, err := f.mac(key, commandName, db)
+		if err != nil {
+			return err
+		}
+		if hmac.Equal(sig, f.Signature) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid signature")
+}
+
+// ClientConnection returns the connection of the forwarded client: a copy of the
+// upstream proxy's connection cc with the client's address, appName and identities
+func (f *ForwardedClient) ClientConnection(cc *ClientConnection) *ClientConnection {
+	if cc == nil {
+		cc = NewClientConnection()
+	}
+	forwarded := *cc
+	forwarded.Addr = forwardedAddr(f.Addr)
+	forwarded.AppName = f.AppName
+	forwarded.Identities = nil
+	for _, ident := range f.Identities {
+		forwarded.Identities = append(forwarded.Identities, NewStaticIdentity(ident.Type, ident.User, ident.Roles...))
+	}
+	return &forwarded
+}
+
+// forwardedAddr is the address of a forwarded client
+type forwardedAddr string
+
+func (a forwardedAddr) Network() string { return "tcp" }
+func (a forwardedAddr) String() string  { return string(a) }
+
+// LoadForwardingKeys reads the keys clients are forwarded with from the files,
+// each holding a base64 encoded key (of at least 32 bytes)
+func LoadForwardingKeys(paths []string) ([][]byte, error) {
+	keys := make([][]byte, len(paths))
+	for i, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading forwarding key: %w", err)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid forwarding key %s: %w", path, err)
+		}
+		if len(key) < 32 {
+			return nil, fmt.Errorf("invalid forwarding key %s: must be at least 32 bytes, got %d", path, len(key))
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
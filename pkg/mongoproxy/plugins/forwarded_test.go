@@ -0,0 +1,76 @@
+package plugins
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestForwardedClient(t *testing.T) {
+	key, otherKey := make([]byte, 32), make([]byte, 32)
+	otherKey[0] = 1
+
+	cc := NewClientConnection()
+	cc.Addr = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	cc.AppName = "web"
+	cc.Identities = []ClientIdentity{NewStaticIdentity("x509", "alice", "readWrite")}
+	ctx, md := WithMetadata(context.Background())
+	md.SetTraceID("trace")
+
+	sign := func() *ForwardedClient {
+		f := NewForwardedClient(ctx, &Request{CC: cc})
+		if err := f.Sign(key, "find", "db"); err != nil {
+			t.Fatal(err)
+		}
+		// Forwarded clients are sent (and verified) encoded
+		b, err := bson.Marshal(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded ForwardedClient
+		if err := bson.Unmarshal(b, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		return &decoded
+	}
+
+	tests := []struct {
+		modify func(f *ForwardedClient)
+		keys   [][]byte
+		cmd    string
+		valid  bool
+	}{
+		{keys: [][]byte{key}, cmd: "find", valid: true},
+		// Keys are rotated by trusting the old and new ones
+		{keys: [][]byte{otherKey, key}, cmd: "find", valid: true},
+		{keys: [][]byte{otherKey}, cmd: "find"},
+		// The client can't be modified or reused with another command
+		{modify: func(f *ForwardedClient) { f.Identities[0].Roles = []string{"root"} }, keys: [][]byte{key}, cmd: "find"},
+		{keys: [][]byte{key}, cmd: "delete"},
+		{modify: func(f *ForwardedClient) { f.Time = primitive.NewDateTimeFromTime(time.Now().Add(-time.Hour)) }, keys: [][]byte{key}, cmd: "find"},
+	}
+	for i, test := range tests {
+		f := sign()
+		if test.modify != nil {
+			test.modify(f)
+		}
+		if err := f.Verify(test.keys, test.cmd, "db", time.Minute); (err == nil) != test.valid {
+			t.Fatalf("%d: unexpected verification error: %v", i, err)
+		}
+	}
+
+	forwarded := sign().ClientConnection(NewClientConnection())
+	if forwarded.GetAddr() != "10.0.0.1:5000" || forwarded.AppName != "web" {
+		t.Fatalf("unexpected client %s %s", forwarded.GetAddr(), forwarded.AppName)
+	}
+	if len(forwarded.Identities) != 1 || forwarded.Identities[0].User() != "alice" || forwarded.Identities[0].Roles()[0] != "readWrite" {
+		t.Fatalf("unexpected identities %v", forwarded.Identities)
+	}
+	if f := sign(); f.TraceID != "trace" {
+		t.Fatalf("expected the trace ID to be forwarded, got %q", f.TraceID)
+	}
+}
@@ -0,0 +1,21 @@
+package plugins
+
+import (
+	"context"
+
+	"github.com/wish/mongoproxy/pkg/graphql"
+)
+
+// GraphQLProvider is an optional interface a Plugin can implement to answer the
+// GraphQL queries of the data API (e.g. the schema plugin, with types generated
+// from the collection schemas). The proxy uses the first plugin of the chain
+// which answers queries.
+type GraphQLProvider interface {
+	// GraphQLSchema returns the schema of the queries answered in the GraphQL
+	// schema definition language, and false if the plugin doesn't answer queries
+	GraphQLSchema() (string, bool)
+	// ResolveGraphQL answers the query, running its commands with the runner
+	// (as the data API's client, through the chain) and returning at most
+	// maxLimit documents per field
+	ResolveGraphQL(ctx context.Context, req *graphql.Request, cr CommandRunner, maxLimit int64) *graphql.Response
+}
@@ -0,0 +1,393 @@
+package gridfs
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "gridfs"
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_gridfs_requests_total",
+		Help: "The total requests on the GridFS buckets by collection (files, chunks) and result",
+	}, []string{"db", "bucket", "collection", "result"})
+	chunkBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_gridfs_chunk_bytes_total",
+		Help: "The total bytes of the chunks inserted into the GridFS buckets",
+	}, []string{"db", "bucket"})
+)
+
+// Collections of a GridFS bucket
+const (
+	CollectionFiles  = "files"
+	CollectionChunks = "chunks"
+)
+
+// Results of the requests on a bucket
+const (
+	ResultAllowed  = "allowed"
+	ResultRouted   = "routed"
+	ResultRejected = "rejected"
+)
+
+// cursorKey is the CursorCacheEntry.Map key set for the cursors opened on the
+// chunks backend
+type cursorKey struct{}
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &GridFSPlugin{
+			conf: GridFSPluginConfig{
+				Buckets: []string{"fs"},
+			},
+		}
+	})
+}
+
+type GridFSPluginConfig struct {
+	// Buckets are the names of the GridFS buckets, whose collections are
+	// "<bucket>.files" and "<bucket>.chunks" (default ["fs"])
+	Buckets []string `bson:"buckets"`
+	// MaxFileSize is the maximum size of a file in bytes (0 for no maximum)
+	MaxFileSize int64 `bson:"maxFileSize"`
+	// ContentTypes are the allowed content types of the files (e.g. "image/png" or
+	// "image/*"); empty allows all, including files without a content type
+	ContentTypes []string `bson:"contentTypes"`
+	// ChunksBackend is the backend the requests on the chunks collections are sent
+	// to instead of the rest of the chain (e.g. a dedicated cluster)
+	ChunksBackend *Backend `bson:"chunksBackend"`
+}
+
+// Backend is a backend plugin and its config
+type Backend struct {
+	// Plugin is the backend plugin (default "mongo")
+	Plugin string `bson:"plugin"`
+	// Config is the config of the backend plugin
+	Config bson.D `bson:"config"`
+}
+
+// This is a plugin that recognizes the requests on GridFS buckets and enforces
+// policies on the files stored in them: their maximum size and allowed content
+// types, and sending the chunks to a dedicated backend, so large uploads don't
+// destabilize shared clusters
+type GridFSPlugin struct {
+	conf    GridFSPluginConfig
+	buckets map[string]struct{}
+	// contentTypes are the allowed content types and type prefixes ("image/")
+	contentTypes map[string]struct{}
+	chunks       plugins.Plugin
+}
+
+func (p *GridFSPlugin) Name() string { return Name }
+
+// ReadsDocuments returns true as the files and chunks inserted are checked
+func (p *GridFSPlugin) ReadsDocuments() bool { return true }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *GridFSPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	if len(p.conf.Buckets) == 0 {
+		return fmt.Errorf("buckets are required")
+	}
+	p.buckets = make(map[string]struct{}, len(p.conf.Buckets))
+	for _, b := range p.conf.Buckets {
+		if b == "" || strings.HasPrefix(b, "$") {
+			return fmt.Errorf("invalid bucket %q", b)
+		}
+		p.buckets[b] = struct{}{}
+	}
+	if p.conf.MaxFileSize < 0 {
+		return fmt.Errorf("maxFileSize must not be negative")
+	}
+	p.contentTypes = make(map[string]struct{}, len(p.conf.ContentTypes))
+	for _, ct := range p.conf.ContentTypes {
+		ct = strings.ToLower(ct)
+		if strings.HasSuffix(ct, "/*") {
+			ct = strings.TrimSuffix(ct, "*")
+		}
+		if i := strings.IndexByte(ct, '/'); i <= 0 || strings.ContainsAny(ct, "*; ") {
+			return fmt.Errorf("invalid content type %q", ct)
+		}
+		p.contentTypes[ct] = struct{}{}
+	}
+
+	p.chunks = nil
+	if b := p.conf.ChunksBackend; b != nil {
+		if b.Plugin == "" {
+			b.Plugin = "mongo"
+		}
+		if b.Plugin == Name {
+			return fmt.Errorf("chunksBackend can't be a %s", Name)
+		}
+		backend, ok := plugins.GetPlugin(b.Plugin)
+		if !ok {
+			return fmt.Errorf("chunksBackend: unknown plugin %s", b.Plugin)
+		}
+		if err := backend.Configure(b.Config); err != nil {
+			return fmt.Errorf("chunksBackend: %w", err)
+		}
+		p.chunks = backend
+	}
+	return nil
+}
+
+// Start starts the chunks backend
+func (p *GridFSPlugin) Start(ctx context.Context) error {
+	if p.chunks == nil {
+		return nil
+	}
+	return plugins.StartPlugins(ctx, []plugins.Plugin{p.chunks})
+}
+
+// Stop stops the chunks backend
+func (p *GridFSPlugin) Stop(ctx context.Context) error {
+	if p.chunks == nil {
+		return nil
+	}
+	return plugins.StopPlugins(ctx, []plugins.Plugin{p.chunks})
+}
+
+// Health checks the health of the chunks backend
+func (p *GridFSPlugin) Health(ctx context.Context) error {
+	if p.chunks == nil {
+		return nil
+	}
+	if h, ok := plugins.Unwrap(p.chunks).(plugins.HealthChecker); ok {
+		if err := h.Health(ctx); err != nil {
+			return fmt.Errorf("chunksBackend: %w", err)
+		}
+	}
+	return nil
+}
+
+// bucket returns the bucket and the collection of the bucket ("files" or "chunks")
+// of the namespace, if it is one of a bucket
+func (p *GridFSPlugin) bucket(collection string) (string, string, bool) {
+	i := strings.LastIndexByte(collection, '.')
+	if i == -1 {
+		return "", "", false
+	}
+	bucket, c := collection[:i], collection[i+1:]
+	if c != CollectionFiles && c != CollectionChunks {
+		return "", "", false
+	}
+	_, ok := p.buckets[bucket]
+	return bucket, c, ok
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case float64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// allowedContentType returns whether the content type is allowed
+func (p *GridFSPlugin) allowedContentType(ct string) bool {
+	if mediaType, _, err := mime.ParseMediaType(ct); err == nil {
+		ct = mediaType
+	}
+	ct = strings.ToLower(ct)
+	if _, ok := p.contentTypes[ct]; ok {
+		return true
+	}
+	if i := strings.IndexByte(ct, '/'); i > 0 {
+		_, ok := p.contentTypes[ct[:i+1]]
+		return ok
+	}
+	return false
+}
+
+// checkFile checks the fields of a files document set by a write; a partial
+// document (the fields set by an update) may leave the content type out
+func (p *GridFSPlugin) checkFile(doc bson.D, partial bool) error {
+	if p.conf.MaxFileSize > 0 {
+		if v, ok := bsonutil.Lookup(doc, "length"); ok {
+			if length, ok := toInt64(v); ok && length > p.conf.MaxFileSize {
+				return fmt.Errorf("file of %d bytes exceeds the maximum file size of %d bytes", length, p.conf.MaxFileSize)
+			}
+		}
+	}
+	if len(p.contentTypes) > 0 {
+		// Drivers set the deprecated contentType, or the metadata's
+		var v interface{}
+		for _, e := range doc {
+			switch e.Key {
+			case "contentType", "metadata.contentType":
+				v = e.Value
+			case "metadata":
+				if metadata, ok := e.Value.(bson.D); ok && v == nil {
+					v, _ = bsonutil.Lookup(metadata, "contentType")
+				}
+			}
+		}
+		ct, _ := v.(string)
+		if ct == "" {
+			if partial && v == nil {
+				return nil
+			}
+			return fmt.Errorf("file has no content type")
+		}
+		if !p.allowedContentType(ct) {
+			return fmt.Errorf("content type %q is not allowed", ct)
+		}
+	}
+	return nil
+}
+
+// checkChunk checks the size of the file of an inserted chunk. Every chunk but the
+// last has the file's chunkSize, so a chunk n of size s is of a file of at least
+// (n+1)*s bytes; the files document being inserted once all the chunks are, this
+// stops an upload as soon as it exceeds the maximum.
+func (p *GridFSPlugin) checkChunk(doc bson.D) (int, error) {
+	v, _ := bsonutil.Lookup(doc, "data")
+	data, _ := v.(primitive.Binary)
+	if p.conf.MaxFileSize > 0 {
+		v, _ := bsonutil.Lookup(doc, "n")
+		if n, ok := toInt64(v); ok && (n+1)*int64(len(data.Data)) > p.conf.MaxFileSize {
+			return len(data.Data), fmt.Errorf("chunk %d of %d bytes exceeds the maximum file size of %d bytes", n, len(data.Data), p.conf.MaxFileSize)
+		}
+	}
+	return len(data.Data), nil
+}
+
+// updatedFields returns the fields set by the update (the replacement document or
+// its $set and $setOnInsert), and whether they are only some of the fields
+func updatedFields(u bson.D) (bson.D, bool) {
+	if len(u) == 0 || !strings.HasPrefix(u[0].Key, "$") {
+		return u, false
+	}
+	var fields bson.D
+	for _, e := range u {
+		if e.Key != "$set" && e.Key != "$setOnInsert" {
+			continue
+		}
+		if set, ok := e.Value.(bson.D); ok {
+			fields = append(fields, set...)
+		}
+	}
+	return fields, true
+}
+
+// check checks the write to the collection of the bucket
+func (p *GridFSPlugin) check(r *plugins.Request, db, bucket, collection string) error {
+	switch cmd := r.Command.(type) {
+	case *command.Insert:
+		for _, doc := range cmd.Documents {
+			if collection == CollectionFiles {
+				if err := p.checkFile(doc, false); err != nil {
+					return err
+				}
+				continue
+			}
+			size, err := p.checkChunk(doc)
+			if err != nil {
+				return err
+			}
+			chunkBytesTotal.WithLabelValues(db, bucket).Add(float64(size))
+		}
+	case *command.Update:
+		if collection != CollectionFiles {
+			return nil
+		}
+		for _, u := range cmd.Updates {
+			if err := p.checkFile(updatedFields(u.U)); err != nil {
+				return err
+			}
+		}
+	case *command.FindAndModify:
+		if collection != CollectionFiles {
+			return nil
+		}
+		return p.checkFile(updatedFields(cmd.Update))
+	}
+	return nil
+}
+
+// chunksCursor returns whether the command continues a cursor opened on the
+// chunks backend
+func chunksCursor(r *plugins.Request) bool {
+	if r.CursorCache == nil {
+		return false
+	}
+	var id int64
+	switch cmd := r.Command.(type) {
+	case *command.GetMore:
+		id = cmd.CursorID
+	case *command.KillCursors:
+		for _, c := range cmd.Cursors {
+			if c, ok := c.(int64); ok {
+				id = c
+				break
+			}
+		}
+	}
+	if id == 0 {
+		return false
+	}
+	_, ok := r.CursorCache.GetCursor(id).Map[cursorKey{}]
+	return ok
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *GridFSPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	if p.chunks != nil && chunksCursor(r) {
+		return p.chunks.Process(ctx, r, next)
+	}
+	bucket, collection, ok := p.bucket(r.Collection())
+	if !ok {
+		return next(ctx, r)
+	}
+	db := r.Database()
+
+	if err := p.check(r, db, bucket, collection); err != nil {
+		requestsTotal.WithLabelValues(db, bucket, collection, ResultRejected).Inc()
+		logrus.Warningf("GRIDFS ERROR: %s, in db: %s, bucket: %s, with cmd: %s", err.Error(), db, bucket, r.CommandName)
+		return mongoerror.DocumentValidationFailure.ErrMessage(err.Error()), nil
+	}
+
+	if collection != CollectionChunks || p.chunks == nil {
+		requestsTotal.WithLabelValues(db, bucket, collection, ResultAllowed).Inc()
+		return next(ctx, r)
+	}
+	requestsTotal.WithLabelValues(db, bucket, collection, ResultRouted).Inc()
+	result, err := p.chunks.Process(ctx, r, next)
+	// getMores of the cursor must go to the chunks backend too
+	if r.CursorCache != nil {
+		if id, ok := bsonutil.Lookup(result, "cursor", "id"); ok {
+			if id, ok := id.(int64); ok && id > 0 {
+				r.CursorCache.GetCursor(id).Map[cursorKey{}] = true
+			}
+		}
+	}
+	return result, err
+}
@@ -0,0 +1,165 @@
+package gridfs
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+type testCursorCache struct {
+	cursors map[int64]*plugins.CursorCacheEntry
+}
+
+func (c *testCursorCache) GetCursor(id int64) *plugins.CursorCacheEntry {
+	if _, ok := c.cursors[id]; !ok {
+		c.cursors[id] = plugins.NewCursorCacheEntry(id)
+	}
+	return c.cursors[id]
+}
+
+func (c *testCursorCache) CloseCursor(id int64) { delete(c.cursors, id) }
+
+// testBackend answers with its name, opening a cursor for finds
+type testBackend struct {
+	name string
+}
+
+func (b *testBackend) Name() string             { return b.name }
+func (b *testBackend) Configure(d bson.D) error { return nil }
+func (b *testBackend) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	return respond(b.name, r), nil
+}
+
+func respond(name string, r *plugins.Request) bson.D {
+	if _, ok := r.Command.(*command.Find); ok {
+		return bson.D{{"cursor", bson.D{{"firstBatch", bson.A{}}, {"id", int64(7)}}}, {"backend", name}, {"ok", 1}}
+	}
+	return bson.D{{"backend", name}, {"ok", 1}}
+}
+
+func chunk(n int32, size int) bson.D {
+	return bson.D{{"files_id", 1}, {"n", n}, {"data", primitive.Binary{Data: make([]byte, size)}}}
+}
+
+func TestGridFS(t *testing.T) {
+	tests := []struct {
+		cmd     bson.D
+		backend string
+	}{
+		{
+			cmd:     bson.D{{"insert", "fs.files"}, {"documents", bson.A{bson.D{{"_id", 1}, {"length", int64(100)}, {"contentType", "image/png"}}}}, {"$db", "media"}},
+			backend: "main",
+		},
+		{
+			cmd:     bson.D{{"insert", "fs.files"}, {"documents", bson.A{bson.D{{"_id", 1}, {"length", int64(100)}, {"metadata", bson.D{{"contentType", "application/pdf; charset=binary"}}}}}}, {"$db", "media"}},
+			backend: "main",
+		},
+		// Files exceeding the maximum size
+		{
+			cmd: bson.D{{"insert", "fs.files"}, {"documents", bson.A{bson.D{{"_id", 1}, {"length", int64(2000)}, {"contentType", "image/png"}}}}, {"$db", "media"}},
+		},
+		// Files without an allowed content type
+		{
+			cmd: bson.D{{"insert", "fs.files"}, {"documents", bson.A{bson.D{{"_id", 1}, {"length", int64(100)}, {"contentType", "video/mp4"}}}}, {"$db", "media"}},
+		},
+		{
+			cmd: bson.D{{"insert", "fs.files"}, {"documents", bson.A{bson.D{{"_id", 1}, {"length", int64(100)}}}}, {"$db", "media"}},
+		},
+		{
+			cmd: bson.D{{"update", "fs.files"}, {"updates", bson.A{bson.D{{"q", bson.D{{"_id", 1}}}, {"u", bson.D{{"$set", bson.D{{"contentType", "video/mp4"}}}}}}}}, {"$db", "media"}},
+		},
+		// Updates leaving the content type are allowed
+		{
+			cmd:     bson.D{{"update", "fs.files"}, {"updates", bson.A{bson.D{{"q", bson.D{{"_id", 1}}}, {"u", bson.D{{"$set", bson.D{{"filename", "b.png"}}}}}}}}, {"$db", "media"}},
+			backend: "main",
+		},
+		// Chunks are sent to the chunks backend
+		{
+			cmd:     bson.D{{"insert", "fs.chunks"}, {"documents", bson.A{chunk(0, 255), chunk(1, 255)}}, {"$db", "media"}},
+			backend: "chunks",
+		},
+		{
+			cmd:     bson.D{{"find", "images.chunks"}, {"filter", bson.D{{"files_id", 1}}}, {"$db", "media"}},
+			backend: "chunks",
+		},
+		// getMores of the chunks' cursors too
+		{
+			cmd:     bson.D{{"getMore", int64(7)}, {"collection", "images.chunks"}, {"$db", "media"}},
+			backend: "chunks",
+		},
+		// Chunks of a file exceeding the maximum size
+		{
+			cmd: bson.D{{"insert", "fs.chunks"}, {"documents", bson.A{chunk(3, 255)}}, {"$db", "media"}},
+		},
+		// Other collections aren't buckets
+		{
+			cmd:     bson.D{{"insert", "other.files"}, {"documents", bson.A{bson.D{{"_id", 1}, {"length", int64(2000)}}}}, {"$db", "media"}},
+			backend: "main",
+		},
+	}
+
+	pl, _ := plugins.GetPlugin(Name)
+	p := pl.(*GridFSPlugin)
+	if err := p.Configure(bson.D{
+		{"buckets", bson.A{"fs", "images"}},
+		{"maxFileSize", 1000},
+		{"contentTypes", bson.A{"image/*", "application/pdf"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	p.chunks = &testBackend{name: "chunks"}
+	pipeline := plugins.BuildPipeline([]plugins.Plugin{p}, func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+		return respond("main", r), nil
+	})
+
+	cursors := &testCursorCache{cursors: map[int64]*plugins.CursorCacheEntry{}}
+	for i, test := range tests {
+		cmd, _ := command.GetCommand(test.cmd[0].Key)
+		if err := cmd.FromBSOND(test.cmd); err != nil {
+			t.Fatal(err)
+		}
+		result, err := pipeline(context.TODO(), &plugins.Request{CommandName: test.cmd[0].Key, Command: cmd, CursorCache: cursors})
+		if err != nil {
+			t.Fatal(err)
+		}
+		backend, _ := bsonutil.Lookup(result, "backend")
+		if test.backend == "" {
+			if bsonutil.Ok(result) {
+				t.Fatalf("%d: expected the write to be rejected, got %v", i, result)
+			}
+			continue
+		}
+		if backend != test.backend {
+			t.Fatalf("%d: expected the %s backend, got %v", i, test.backend, result)
+		}
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		conf bson.D
+		ok   bool
+	}{
+		{conf: bson.D{}, ok: true},
+		{conf: bson.D{{"buckets", bson.A{"fs", "images"}}, {"maxFileSize", 1 << 20}, {"contentTypes", bson.A{"image/*", "text/plain"}}}, ok: true},
+		{conf: bson.D{{"buckets", bson.A{}}}},
+		{conf: bson.D{{"buckets", bson.A{""}}}},
+		{conf: bson.D{{"maxFileSize", -1}}},
+		{conf: bson.D{{"contentTypes", bson.A{"image"}}}},
+		{conf: bson.D{{"contentTypes", bson.A{"*/png"}}}},
+		{conf: bson.D{{"chunksBackend", bson.D{{"plugin", "unknown"}}}}},
+		{conf: bson.D{{"chunksBackend", bson.D{{"plugin", Name}}}}},
+	}
+	for i, test := range tests {
+		pl, _ := plugins.GetPlugin(Name)
+		if err := pl.Configure(test.conf); (err == nil) != test.ok {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package guardrails
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const (
+	// FanOutActionReject rejects writes exceeding their fan-out limit
+	FanOutActionReject = "reject"
+	// FanOutActionConfirm requires writes exceeding their fan-out limit to be confirmed
+	FanOutActionConfirm = "confirm"
+
+	// confirmPrefix prefixes the confirmation token in string comments ("confirm:<token>"),
+	// and is its key in document comments
+	confirmPrefix = "confirm"
+)
+
+var (
+	confirmTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_guardrails_confirmations_total",
+		Help: "The total operations requiring confirmation",
+	}, []string{"db", "collection", "command", "result"})
+)
+
+// ConfirmRule requires commands on its namespaces to be confirmed: they're rejected
+// with a confirmation token and only run when resubmitted with it
+type ConfirmRule struct {
+	// Scope are the namespaces the rule applies to (same format as a plugin scope;
+	// default all namespaces)
+	Scope *plugins.Scope `bson:"scope"`
+	// Commands are the commands requiring confirmation: drop and/or dropDatabase
+	Commands []string `bson:"commands"`
+}
+
+func (c *ConfirmRule) load() error {
+	if c.Scope != nil {
+		c.Scope.Compile()
+	}
+	if len(c.Commands) == 0 {
+		return fmt.Errorf("commands is required")
+	}
+	for _, name := range c.Commands {
+		switch name {
+		case "drop", "dropDatabase":
+		default:
+			return fmt.Errorf("invalid command %q; must be one of drop, dropDatabase", name)
+		}
+	}
+	return nil
+}
+
+func (c *ConfirmRule) match(r *plugins.Request) bool {
+	if c.Scope != nil && !c.Scope.MatchNamespace(r.Database(), r.Collection()) {
+		return false
+	}
+	for _, name := range c.Commands {
+		if name == r.CommandName {
+			return true
+		}
+	}
+	return false
+}
+
+// loadConfirmKey returns the key confirmation tokens are signed with: the base64
+// key of the file (of at least 32 bytes), or a random one if there's none
+func loadConfirmKey(path string) ([]byte, error) {
+	if path == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading confirmKeyPath: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid confirm key %s: %w", path, err)
+	}
+	if len(key) < 32 {
+		return nil, fmt.Errorf("invalid confirm key %s: must be at least 32 bytes, got %d", path, len(key))
+	}
+	return key, nil
+}
+
+// namespace returns "db.collection", or the database for database commands
+func namespace(db, collection string) string {
+	if collection == "" {
+		return db
+	}
+	return db + "." + collection
+}
+
+// withoutComment returns the filter without its $comment, which may hold the token
+func withoutComment(filter bson.D) bson.D {
+	out := make(bson.D, 0, len(filter))
+	for _, e := range filter {
+		if e.Key != "$comment" {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// fingerprint returns what a confirmation token is bound to: the command, its
+// namespace and its statements (without comments)
+func fingerprint(r *plugins.Request) ([]byte, error) {
+	h := sha256.New()
+	h.Write([]byte(r.CommandName + "\x00" + r.Database() + "\x00" + r.Collection() + "\x00"))
+
+	var statements bson.A
+	switch cmd := r.Command.(type) {
+	case *command.Update:
+		for _, u := range cmd.Updates {
+			statements = append(statements, bson.D{
+				{"q", withoutComment(u.Query)},
+				{"u", u.U},
+				{"multi", bsonutil.GetBoolDefault(u.Multi, false)},
+				{"upsert", bsonutil.GetBoolDefault(u.Upsert, false)},
+				{"arrayFilters", u.ArrayFilters},
+			})
+		}
+	case *command.Delete:
+		for _, d := range cmd.Deletes {
+			statement := make(bson.D, len(d))
+			for i, e := range d {
+				if filter, ok := e.Value.(bson.D); ok && e.Key == "q" {
+					e.Value = withoutComment(filter)
+				}
+				statement[i] = e
+			}
+			statements = append(statements, statement)
+		}
+	}
+	if len(statements) > 0 {
+		b, err := bson.Marshal(bson.D{{"s", statements}})
+		if err != nil {
+			return nil, err
+		}
+		h.Write(b)
+	}
+	return h.Sum(nil), nil
+}
+
+// confirmToken returns the token confirming the operation until expiry:
+// "<expiry in unix seconds, base 36>.<signature>"
+func (p *GuardrailsPlugin) confirmToken(fp []byte, expiry time.Time) string {
+	exp := strconv.FormatInt(expiry.Unix(), 36)
+	h := hmac.New(sha256.New, p.confirmKey)
+	h.Write(fp)
+	h.Write([]byte(exp))
+	return exp + "." + hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// verifyToken returns whether the token confirms the operation now
+func (p *GuardrailsPlugin) verifyToken(fp []byte, token string, now time.Time) bool {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	exp, err := strconv.ParseInt(parts[0], 36, 64)
+	if err != nil {
+		return false
+	}
+	expiry := time.Unix(exp, 0)
+	if now.After(expiry) || expiry.Sub(now) > p.conf.confirmWindow {
+		return false
+	}
+	return hmac.Equal([]byte(p.confirmToken(fp, expiry)), []byte(token))
+}
+
+// comments returns the comments of the command: its comment and the $comment of
+// its filters
+func comments(c command.Command) []interface{} {
+	switch cmd := c.(type) {
+	case *command.Drop:
+		return []interface{}{cmd.Comment}
+	case *command.DropDatabase:
+		return []interface{}{cmd.Comment}
+	case *command.Update:
+		all := []interface{}{cmd.Comment}
+		for _, u := range cmd.Updates {
+			comment, _ := bsonutil.Lookup(u.Query, "$comment")
+			all = append(all, comment)
+		}
+		return all
+	case *command.Delete:
+		all := []interface{}{cmd.Comment}
+		for _, d := range cmd.Deletes {
+			q, _ := bsonutil.Lookup(d, "q")
+			filter, _ := q.(bson.D)
+			comment, _ := bsonutil.Lookup(filter, "$comment")
+			all = append(all, comment)
+		}
+		return all
+	}
+	return nil
+}
+
+// submittedToken returns the confirmation token of the command's comments ("" if none)
+func submittedToken(c command.Command) string {
+	for _, comment := range comments(c) {
+		switch comment := comment.(type) {
+		case string:
+			for _, word := range strings.Fields(comment) {
+				if strings.HasPrefix(word, confirmPrefix+":") {
+					return strings.TrimPrefix(word, confirmPrefix+":")
+				}
+			}
+		case bson.D:
+			v, _ := bsonutil.Lookup(comment, confirmPrefix)
+			if token, ok := v.(string); ok {
+				return token
+			}
+		}
+	}
+	return ""
+}
+
+// confirmed returns whether the request was resubmitted with its confirmation token
+func (p *GuardrailsPlugin) confirmed(r *plugins.Request) bool {
+	token := submittedToken(r.Command)
+	if token == "" {
+		return false
+	}
+	fp, err := fingerprint(r)
+	if err != nil {
+		return false
+	}
+	return p.verifyToken(fp, token, time.Now())
+}
+
+// requestConfirmation returns the error response asking to resubmit the request
+// with a confirmation token (or an internal error if the request can't be
+// fingerprinted). reason describes why the request needs confirmation.
+func (p *GuardrailsPlugin) requestConfirmation(r *plugins.Request, reason string) bson.D {
+	db, collection := r.Database(), r.Collection()
+	ns := namespace(db, collection)
+	fp, err := fingerprint(r)
+	if err != nil {
+		return mongoerror.InternalError.ErrMessage(err.Error())
+	}
+
+	result := "requested"
+	if submittedToken(r.Command) != "" {
+		// Expired, or for another operation
+		result = "invalid"
+	}
+	confirmTotal.WithLabelValues(db, collection, r.CommandName, result).Inc()
+
+	token := p.confirmToken(fp, time.Now().Add(p.conf.confirmWindow))
+	logrus.Warningf("CONFIRMATION REQUESTED: %s on %s: %s", r.CommandName, ns, reason)
+	errDoc := mongoerror.IllegalOperation.ErrMessage(fmt.Sprintf(
+		"%s on %s requires confirmation (%s); resubmit the same command within %s with the comment %q",
+		r.CommandName, ns, reason, p.conf.confirmWindow, confirmPrefix+":"+token))
+	return append(errDoc, bson.E{"confirmationToken", token})
+}
+
+// processConfirm requires the commands matching a confirm rule to be confirmed
+func (p *GuardrailsPlugin) processConfirm(r *plugins.Request) (bson.D, bool) {
+	var rule *ConfirmRule
+	for _, c := range p.conf.Confirm {
+		if c.match(r) {
+			rule = c
+			break
+		}
+	}
+	if rule == nil {
+		return nil, true
+	}
+
+	db, collection := r.Database(), r.Collection()
+	if p.confirmed(r) {
+		confirmTotal.WithLabelValues(db, collection, r.CommandName, "confirmed").Inc()
+		logrus.Warningf("CONFIRMED: %s on %s", r.CommandName, namespace(db, collection))
+		return nil, true
+	}
+	if p.conf.LogOnly {
+		confirmTotal.WithLabelValues(db, collection, r.CommandName, "allowed").Inc()
+		logrus.Warningf("UNCONFIRMED: %s on %s", r.CommandName, namespace(db, collection))
+		return nil, true
+	}
+	return p.requestConfirmation(r, r.CommandName+" is destructive"), false
+}
@@ -0,0 +1,224 @@
+package guardrails
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+// confirmPipeline returns a pipeline of the plugin, and a func running a command
+// through it returning its result and whether it reached the backend
+func confirmPipeline(t *testing.T, d *GuardrailsPlugin) func(cmd bson.D) (bson.D, bool) {
+	var ran bool
+	p := plugins.BuildPipeline([]plugins.Plugin{d}, func(context.Context, *plugins.Request) (bson.D, error) {
+		ran = true
+		return bson.D{{"ok", 1}}, nil
+	})
+	return func(doc bson.D) (bson.D, bool) {
+		ran = false
+		cmd, ok := command.GetCommand(doc[0].Key)
+		if !ok {
+			t.Fatalf("no such command: %s", doc[0].Key)
+		}
+		if err := cmd.FromBSOND(doc); err != nil {
+			t.Fatal(err)
+		}
+		result, err := p(context.TODO(), &plugins.Request{CommandName: doc[0].Key, Command: cmd})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result, ran
+	}
+}
+
+func token(t *testing.T, result bson.D) string {
+	v, _ := bsonutil.Lookup(result, "confirmationToken")
+	s, ok := v.(string)
+	if !ok || bsonutil.Ok(result) {
+		t.Fatalf("expected a confirmation request, got %v", result)
+	}
+	if errmsg, _ := bsonutil.Lookup(result, "errmsg"); !strings.Contains(errmsg.(string), "confirm:"+s) {
+		t.Fatalf("expected the error to include the token, got %v", result)
+	}
+	return s
+}
+
+func TestConfirm(t *testing.T) {
+	d := &GuardrailsPlugin{}
+	if err := d.Configure(bson.D{{"confirm", bson.A{
+		bson.D{{"scope", bson.D{{"databases", bson.A{"prod"}}}}, {"commands", bson.A{"drop", "dropDatabase"}}},
+	}}}); err != nil {
+		t.Fatal(err)
+	}
+	run := confirmPipeline(t, d)
+
+	drop := func(coll string, comment ...string) bson.D {
+		cmd := bson.D{{"drop", coll}, {"$db", "prod"}}
+		if len(comment) > 0 {
+			cmd = append(cmd, bson.E{"comment", comment[0]})
+		}
+		return cmd
+	}
+
+	result, ran := run(drop("users"))
+	if ran {
+		t.Fatal("expected the drop to need confirmation")
+	}
+	tok := token(t, result)
+
+	// The token only confirms the same operation
+	if _, ran := run(drop("orders", "confirm:"+tok)); ran {
+		t.Fatal("expected the token not to confirm another drop")
+	}
+	if _, ran := run(bson.D{{"dropDatabase", 1}, {"comment", "confirm:" + tok}, {"$db", "prod"}}); ran {
+		t.Fatal("expected the token not to confirm another command")
+	}
+	if _, ran := run(drop("users", "cleanup confirm:"+tok)); !ran {
+		t.Fatal("expected the confirmed drop to run")
+	}
+
+	// Invalid tokens request a new confirmation
+	result, ran = run(drop("users", "confirm:"+tok+"x"))
+	if ran {
+		t.Fatal("expected an invalid token not to confirm the drop")
+	}
+	if token(t, result) == "" {
+		t.Fatal("expected a new token")
+	}
+
+	// Out of scope
+	if _, ran := run(bson.D{{"drop", "users"}, {"$db", "staging"}}); !ran {
+		t.Fatal("expected drops out of scope to run")
+	}
+
+	result, _ = run(bson.D{{"dropDatabase", 1}, {"$db", "prod"}})
+	tok = token(t, result)
+	if _, ran := run(bson.D{{"dropDatabase", 1}, {"comment", "confirm:" + tok}, {"$db", "prod"}}); !ran {
+		t.Fatal("expected the confirmed dropDatabase to run")
+	}
+}
+
+func TestConfirmToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guardrails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "key")
+	key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+	if err := ioutil.WriteFile(path, []byte(key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Proxies sharing the key accept each other's tokens
+	plugin := func(path string) *GuardrailsPlugin {
+		d := &GuardrailsPlugin{}
+		if err := d.Configure(bson.D{{"confirmWindow", "1m"}, {"confirmKeyPath", path}}); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	a, b, other := plugin(path), plugin(path), plugin("")
+
+	fp := []byte("fingerprint")
+	now := time.Now()
+	tok := a.confirmToken(fp, now.Add(time.Minute))
+	tests := []struct {
+		p     *GuardrailsPlugin
+		fp    []byte
+		token string
+		now   time.Time
+		ok    bool
+	}{
+		{p: a, fp: fp, token: tok, now: now, ok: true},
+		{p: b, fp: fp, token: tok, now: now, ok: true},
+		{p: other, fp: fp, token: tok, now: now},
+		{p: a, fp: []byte("other"), token: tok, now: now},
+		// Expired
+		{p: a, fp: fp, token: tok, now: now.Add(2 * time.Minute)},
+		// Expiring later than the window
+		{p: a, fp: fp, token: a.confirmToken(fp, now.Add(time.Hour)), now: now},
+		{p: a, fp: fp, token: "", now: now},
+		{p: a, fp: fp, token: "zz", now: now},
+	}
+	for i, test := range tests {
+		if ok := test.p.verifyToken(test.fp, test.token, test.now); ok != test.ok {
+			t.Fatalf("%d: expected %v, got %v", i, test.ok, ok)
+		}
+	}
+}
+
+func TestConfirmFanOut(t *testing.T) {
+	d := &GuardrailsPlugin{}
+	if err := d.Configure(bson.D{{"fanOut", bson.A{
+		bson.D{{"maxDocuments", 100}, {"action", "confirm"}},
+	}}}); err != nil {
+		t.Fatal(err)
+	}
+	cr := &counter{}
+	d.SetCommandRunner(cr)
+	run := confirmPipeline(t, d)
+
+	update := func(n int, comment string) bson.D {
+		return bson.D{
+			{"update", "coll"},
+			{"updates", bson.A{bson.D{{"q", bson.D{{"n", n}, {"$comment", comment}}}, {"u", bson.D{{"$set", bson.D{{"a", 1}}}}}, {"multi", true}}}},
+			{"$db", "db"},
+		}
+	}
+
+	if _, ran := run(update(10, "")); !ran {
+		t.Fatal("expected the update within the limit to run")
+	}
+	result, ran := run(update(500, "bulk fix"))
+	if ran {
+		t.Fatal("expected the update exceeding the limit to need confirmation")
+	}
+	if errmsg, _ := bsonutil.Lookup(result, "errmsg"); !strings.Contains(errmsg.(string), "estimated 500 documents") {
+		t.Fatalf("expected the count in the error, got %v", result)
+	}
+	tok := token(t, result)
+
+	if _, ran := run(update(501, "confirm:"+tok)); ran {
+		t.Fatal("expected the token not to confirm another update")
+	}
+	counts := len(cr.cmds)
+	if _, ran := run(update(500, "confirm:"+tok)); !ran {
+		t.Fatal("expected the confirmed update to run")
+	}
+	if len(cr.cmds) != counts {
+		t.Fatal("expected the confirmed update not to be counted again")
+	}
+}
+
+func TestConfirmConfig(t *testing.T) {
+	tests := []struct {
+		config bson.D
+		ok     bool
+	}{
+		{bson.D{{"confirm", bson.A{bson.D{{"commands", bson.A{"drop"}}}}}}, true},
+		{bson.D{{"confirm", bson.A{bson.D{}}}}, false},
+		{bson.D{{"confirm", bson.A{bson.D{{"commands", bson.A{"insert"}}}}}}, false},
+		{bson.D{{"confirmWindow", "0s"}}, false},
+		{bson.D{{"confirmWindow", "later"}}, false},
+		{bson.D{{"confirmKeyPath", "/nonexistent"}}, false},
+		{bson.D{{"fanOut", bson.A{bson.D{{"maxDocuments", 1}, {"action", "delay"}}}}}, false},
+	}
+	for i, test := range tests {
+		d := &GuardrailsPlugin{}
+		if err := d.Configure(test.config); (err == nil) != test.ok {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package guardrails
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const (
+	// CursorActionError kills the cursor and returns an error to the client
+	CursorActionError = "error"
+	// CursorActionTruncate returns the documents up to the limit and closes the cursor
+	CursorActionTruncate = "truncate"
+)
+
+var (
+	cursorLimitTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_guardrails_cursor_limits_total",
+		Help: "The total cursors exceeding their result size limits",
+	}, []string{"db", "collection", "result"})
+)
+
+// CursorLimit caps the results a single cursor may return
+type CursorLimit struct {
+	// Scope are the namespaces the limit applies to (same format as a plugin scope;
+	// default all namespaces)
+	Scope *plugins.Scope `bson:"scope"`
+	// MaxDocuments is the maximum number of documents a cursor may return (0 for no limit)
+	MaxDocuments int64 `bson:"maxDocuments"`
+	// MaxBytes is the maximum size of the documents a cursor may return (0 for no limit)
+	MaxBytes int64 `bson:"maxBytes"`
+	// Action is either error or truncate (default error)
+	Action string `bson:"action"`
+}
+
+func (l *CursorLimit) load() error {
+	if l.Scope != nil {
+		l.Scope.Compile()
+	}
+	if l.MaxDocuments < 0 || l.MaxBytes < 0 {
+		return fmt.Errorf("maxDocuments and maxBytes can't be negative")
+	}
+	if l.MaxDocuments == 0 && l.MaxBytes == 0 {
+		return fmt.Errorf("one of maxDocuments or maxBytes is required")
+	}
+	switch l.Action {
+	case "":
+		l.Action = CursorActionError
+	case CursorActionError, CursorActionTruncate:
+	default:
+		return fmt.Errorf("invalid action %q; must be one of error, truncate", l.Action)
+	}
+	return nil
+}
+
+// String returns a description of the limit for errors and logs
+func (l *CursorLimit) String() string {
+	switch {
+	case l.MaxDocuments == 0:
+		return fmt.Sprintf("%d bytes", l.MaxBytes)
+	case l.MaxBytes == 0:
+		return fmt.Sprintf("%d documents", l.MaxDocuments)
+	default:
+		return fmt.Sprintf("%d documents or %d bytes", l.MaxDocuments, l.MaxBytes)
+	}
+}
+
+// cursorUsageKey is the CursorCacheEntry.Map key of a cursor's usage
+type cursorUsageKey struct{}
+
+// cursorUsage is what a cursor returned so far
+type cursorUsage struct {
+	limit          *CursorLimit
+	db, collection string
+	documents      int64
+	bytes          int64
+	// exceeded is set once the limit was exceeded with logOnly
+	exceeded bool
+}
+
+// cursorLimit returns the limit of the request's namespace (nil if none)
+func (p *GuardrailsPlugin) cursorLimit(r *plugins.Request) *CursorLimit {
+	for _, l := range p.conf.Cursors {
+		if l.Scope == nil || l.Scope.MatchNamespace(r.Database(), r.Collection()) {
+			return l
+		}
+	}
+	return nil
+}
+
+// batchSizes returns the size of each document of a cursor batch, decoded or raw
+func batchSizes(batch interface{}) []int64 {
+	switch batch := batch.(type) {
+	case bson.A:
+		sizes := make([]int64, len(batch))
+		for i, doc := range batch {
+			b, err := bson.Marshal(doc)
+			if err == nil {
+				sizes[i] = int64(len(b))
+			}
+		}
+		return sizes
+	case bson.RawValue:
+		if batch.Type != bsontype.Array {
+			return nil
+		}
+		values, err := batch.Array().Values()
+		if err != nil {
+			return nil
+		}
+		sizes := make([]int64, len(values))
+		for i, v := range values {
+			sizes[i] = int64(len(v.Value))
+		}
+		return sizes
+	}
+	return nil
+}
+
+// truncateBatch returns the first n documents of a cursor batch
+func truncateBatch(batch interface{}, n int) interface{} {
+	switch batch := batch.(type) {
+	case bson.A:
+		return batch[:n]
+	case bson.RawValue:
+		values, _ := batch.Array().Values()
+		docs := make(bson.A, n)
+		for i := range docs {
+			docs[i] = bson.Raw(values[i].Value)
+		}
+		return docs
+	}
+	return batch
+}
+
+// setCursorField sets a field of the cursor document of the response in place
+func setCursorField(result bson.D, key string, value interface{}) {
+	cursor, _ := bsonutil.Lookup(result, "cursor")
+	doc, _ := cursor.(bson.D)
+	for i := range doc {
+		if doc[i].Key == key {
+			doc[i].Value = value
+			return
+		}
+	}
+}
+
+// killCursor kills the backend cursor of a cursor exceeding its limit
+func killCursor(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc, usage *cursorUsage, cursorID int64) {
+	result, err := next(ctx, &plugins.Request{
+		CC:          r.CC,
+		CursorCache: r.CursorCache,
+		CommandName: "killCursors",
+		Command: &command.KillCursors{
+			Collection: usage.collection,
+			Cursors:    bson.A{cursorID},
+			Common:     command.Common{Database: usage.db},
+		},
+		Map: make(map[string]interface{}),
+	})
+	if err != nil || !bsonutil.Ok(result) {
+		logrus.Debugf("Error killing cursor %d on %s.%s: %v %v", cursorID, usage.db, usage.collection, err, result)
+	}
+}
+
+// processCursor enforces the cursor limits on the batches returned to the client
+func (p *GuardrailsPlugin) processCursor(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	var (
+		usage    *cursorUsage
+		batchKey = "firstBatch"
+	)
+	if cmd, ok := r.Command.(*command.GetMore); ok {
+		if r.CursorCache != nil {
+			usage, _ = r.CursorCache.GetCursor(cmd.CursorID).Map[cursorUsageKey{}].(*cursorUsage)
+		}
+		batchKey = "nextBatch"
+	} else if l := p.cursorLimit(r); l != nil {
+		// The namespace is captured before the backend plugins reset it
+		usage = &cursorUsage{limit: l, db: r.Database(), collection: r.Collection()}
+	}
+	if usage == nil || usage.exceeded {
+		return next(ctx, r)
+	}
+
+	// The batch may be truncated, so can't be streamed to the client
+	r.ReplyStream = nil
+	result, err := next(ctx, r)
+	if err != nil || !bsonutil.Ok(result) {
+		return result, err
+	}
+	id, _ := bsonutil.Lookup(result, "cursor", "id")
+	cursorID, _ := id.(int64)
+	batch, _ := bsonutil.Lookup(result, "cursor", batchKey)
+	sizes := batchSizes(batch)
+
+	// n is the number of documents of the batch within the limit
+	n := 0
+	for _, size := range sizes {
+		if (usage.limit.MaxDocuments > 0 && usage.documents+1 > usage.limit.MaxDocuments) ||
+			(usage.limit.MaxBytes > 0 && usage.bytes+size > usage.limit.MaxBytes) {
+			break
+		}
+		usage.documents++
+		usage.bytes += size
+		n++
+	}
+	if n == len(sizes) {
+		if cursorID != 0 && batchKey == "firstBatch" && r.CursorCache != nil {
+			r.CursorCache.GetCursor(cursorID).Map[cursorUsageKey{}] = usage
+		}
+		return result, nil
+	}
+
+	if p.conf.LogOnly {
+		usage.exceeded = true
+		if cursorID != 0 && batchKey == "firstBatch" && r.CursorCache != nil {
+			r.CursorCache.GetCursor(cursorID).Map[cursorUsageKey{}] = usage
+		}
+		cursorLimitTotal.WithLabelValues(usage.db, usage.collection, "allowed").Inc()
+		logrus.Warningf("CURSOR LIMIT EXCEEDED: %s on %s.%s returned more than %s", r.CommandName, usage.db, usage.collection, usage.limit)
+		return result, nil
+	}
+
+	if cursorID != 0 {
+		killCursor(ctx, r, next, usage, cursorID)
+	}
+	if usage.limit.Action == CursorActionTruncate {
+		cursorLimitTotal.WithLabelValues(usage.db, usage.collection, "truncated").Inc()
+		logrus.Warningf("CURSOR TRUNCATED: %s on %s.%s returned more than %s", r.CommandName, usage.db, usage.collection, usage.limit)
+		setCursorField(result, batchKey, truncateBatch(batch, n))
+		setCursorField(result, "id", int64(0))
+		return append(result, bson.E{"resultsTruncated", true}), nil
+	}
+
+	cursorLimitTotal.WithLabelValues(usage.db, usage.collection, "killed").Inc()
+	logrus.Warningf("CURSOR KILLED: %s on %s.%s returned more than %s", r.CommandName, usage.db, usage.collection, usage.limit)
+	return mongoerror.CursorKilled.ErrMessage(fmt.Sprintf(
+		"cursor on %s.%s exceeded the limit of %s; narrow the filter or add a limit",
+		usage.db, usage.collection, usage.limit)), nil
+}
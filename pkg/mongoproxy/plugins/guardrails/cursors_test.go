@@ -0,0 +1,202 @@
+package guardrails
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+type testCursorCache struct {
+	cursors map[int64]*plugins.CursorCacheEntry
+}
+
+func (c *testCursorCache) GetCursor(id int64) *plugins.CursorCacheEntry {
+	if _, ok := c.cursors[id]; !ok {
+		c.cursors[id] = plugins.NewCursorCacheEntry(id)
+	}
+	return c.cursors[id]
+}
+
+func (c *testCursorCache) CloseCursor(id int64) { delete(c.cursors, id) }
+
+// testBatch returns a batch of n documents, raw or decoded
+func testBatch(n int, raw bool) interface{} {
+	docs := make(bson.A, n)
+	for i := range docs {
+		docs[i] = bson.D{{"_id", int32(i)}}
+	}
+	if !raw {
+		return docs
+	}
+	b, _ := bson.Marshal(bson.D{{"batch", docs}})
+	return bson.Raw(b).Lookup("batch")
+}
+
+func TestCursorLimits(t *testing.T) {
+	// Each test document ({_id: int32}) is 14 bytes
+	tests := []struct {
+		conf    bson.D
+		logOnly bool
+		// batches are the sizes of the batches of the backend cursor
+		batches []int
+		raw     bool
+		// returned is the number of documents returned in each batch (-1 for an error)
+		returned  []int
+		truncated bool
+		killed    bool
+	}{
+		{
+			conf:     bson.D{{"maxDocuments", 10}},
+			batches:  []int{4, 4, 2},
+			returned: []int{4, 4, 2},
+		},
+		{
+			conf:     bson.D{{"maxDocuments", 10}},
+			batches:  []int{4, 4, 4, 4},
+			returned: []int{4, 4, -1},
+			killed:   true,
+		},
+		{
+			conf:     bson.D{{"maxDocuments", 10}},
+			batches:  []int{12, 1},
+			raw:      true,
+			returned: []int{-1},
+			killed:   true,
+		},
+		{
+			conf:      bson.D{{"maxDocuments", 10}, {"action", "truncate"}},
+			batches:   []int{4, 4, 4, 4},
+			returned:  []int{4, 4, 2},
+			truncated: true,
+			killed:    true,
+		},
+		{
+			conf:      bson.D{{"maxBytes", 14 * 5}, {"action", "truncate"}},
+			batches:   []int{4, 4, 4},
+			raw:       true,
+			returned:  []int{4, 1},
+			truncated: true,
+			killed:    true,
+		},
+		// The last batch of the backend cursor doesn't need to be killed
+		{
+			conf:      bson.D{{"maxDocuments", 10}, {"action", "truncate"}},
+			batches:   []int{4, 4, 4},
+			returned:  []int{4, 4, 2},
+			truncated: true,
+		},
+		// Other namespaces aren't limited
+		{
+			conf:     bson.D{{"scope", bson.D{{"collections", bson.A{"db.other"}}}}, {"maxDocuments", 1}},
+			batches:  []int{4, 4},
+			returned: []int{4, 4},
+		},
+		{
+			conf:     bson.D{{"maxDocuments", 5}},
+			logOnly:  true,
+			batches:  []int{4, 4, 4},
+			returned: []int{4, 4, 4},
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			d := &GuardrailsPlugin{}
+			if err := d.Configure(bson.D{{"logOnly", test.logOnly}, {"cursors", bson.A{test.conf}}}); err != nil {
+				t.Fatal(err)
+			}
+
+			batch, killed := 0, false
+			p := plugins.BuildPipeline([]plugins.Plugin{d}, func(_ context.Context, r *plugins.Request) (bson.D, error) {
+				key := "nextBatch"
+				switch cmd := r.Command.(type) {
+				case *command.KillCursors:
+					if cmd.Database != "db" || cmd.Collection != "coll" || cmd.Cursors[0] != int64(1) {
+						t.Fatalf("unexpected killCursors: %+v", cmd)
+					}
+					killed = true
+					return bson.D{{"cursorsKilled", bson.A{int64(1)}}, {"ok", 1}}, nil
+				case *command.Find:
+					key = "firstBatch"
+				}
+				id := int64(1)
+				if batch == len(test.batches)-1 {
+					id = 0
+				}
+				n := test.batches[batch]
+				batch++
+				return bson.D{
+					{"cursor", bson.D{{"id", id}, {"ns", "db.coll"}, {key, testBatch(n, test.raw)}}},
+					{"ok", 1},
+				}, nil
+			})
+
+			cc := &testCursorCache{cursors: make(map[int64]*plugins.CursorCacheEntry)}
+			for j, expected := range test.returned {
+				var cmd command.Command
+				if j == 0 {
+					cmd = &command.Find{Collection: "coll", Common: command.Common{Database: "db"}}
+				} else {
+					cmd = &command.GetMore{CursorID: 1, Collection: "coll", Common: command.Common{Database: "db"}}
+				}
+				result, err := p(context.TODO(), &plugins.Request{CursorCache: cc, CommandName: "find", Command: cmd})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if expected == -1 {
+					if bsonutil.Ok(result) {
+						t.Fatalf("%d: expected an error, got %v", j, result)
+					}
+					break
+				}
+				if !bsonutil.Ok(result) {
+					t.Fatalf("%d: unexpected error: %v", j, result)
+				}
+				key := "nextBatch"
+				if j == 0 {
+					key = "firstBatch"
+				}
+				docs, _ := bsonutil.Lookup(result, "cursor", key)
+				if n := len(batchSizes(docs)); n != expected {
+					t.Fatalf("%d: expected %d documents, got %d", j, expected, n)
+				}
+				// The cursor ends with the backend cursor or once truncated
+				last := j == len(test.returned)-1
+				if id, _ := bsonutil.Lookup(result, "cursor", "id"); (id == int64(0)) != (last && (test.truncated || len(test.returned) == len(test.batches))) {
+					t.Fatalf("%d: unexpected cursor id %v", j, id)
+				}
+				if truncated, _ := bsonutil.Lookup(result, "resultsTruncated"); (truncated == true) != (test.truncated && last) {
+					t.Fatalf("%d: unexpected resultsTruncated: %v", j, truncated)
+				}
+			}
+			if killed != test.killed {
+				t.Fatalf("expected killed=%v, got %v", test.killed, killed)
+			}
+		})
+	}
+}
+
+func TestCursorLimitsConfigure(t *testing.T) {
+	tests := []struct {
+		conf bson.D
+		ok   bool
+	}{
+		{conf: bson.D{{"maxDocuments", 1}}, ok: true},
+		{conf: bson.D{{"maxBytes", 1}, {"action", "truncate"}}, ok: true},
+		{conf: bson.D{}},
+		{conf: bson.D{{"maxDocuments", -1}}},
+		{conf: bson.D{{"maxDocuments", 1}, {"action", "drop"}}},
+	}
+	for i, test := range tests {
+		d := &GuardrailsPlugin{}
+		if err := d.Configure(bson.D{{"cursors", bson.A{test.conf}}}); (err == nil) != test.ok {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package guardrails
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+var (
+	fanOutTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_guardrails_fanout_total",
+		Help: "The total multi deletes and updates exceeding their fan-out limits (or which couldn't be counted)",
+	}, []string{"db", "collection", "command", "result"})
+)
+
+// FanOutLimit caps the documents a single updateMany or deleteMany may touch, which
+// are counted (with the same filter) before running it
+type FanOutLimit struct {
+	// Scope are the namespaces the limit applies to (same format as a plugin scope;
+	// default all namespaces)
+	Scope *plugins.Scope `bson:"scope"`
+	// MaxDocuments is the maximum number of documents a write may touch
+	MaxDocuments int64 `bson:"maxDocuments"`
+	// CountTimeout is the maxTimeMS of the count (default 1s)
+	CountTimeout string `bson:"countTimeout"`
+	// RejectOnCountError rejects writes which couldn't be counted (e.g. the count
+	// timed out) instead of running them
+	RejectOnCountError bool `bson:"rejectOnCountError"`
+	// Action is either reject or confirm, to run writes exceeding the limit once
+	// confirmed (default reject)
+	Action string `bson:"action"`
+
+	countTimeout time.Duration
+}
+
+func (l *FanOutLimit) load() error {
+	if l.Scope != nil {
+		l.Scope.Compile()
+	}
+	if l.MaxDocuments <= 0 {
+		return fmt.Errorf("maxDocuments must be positive")
+	}
+	if l.CountTimeout == "" {
+		l.CountTimeout = "1s"
+	}
+	d, err := time.ParseDuration(l.CountTimeout)
+	if err != nil {
+		return fmt.Errorf("invalid countTimeout: %w", err)
+	}
+	if d < time.Millisecond {
+		return fmt.Errorf("countTimeout must be at least 1ms")
+	}
+	l.countTimeout = d
+	switch l.Action {
+	case "":
+		l.Action = FanOutActionReject
+	case FanOutActionReject, FanOutActionConfirm:
+	default:
+		return fmt.Errorf("invalid action %q; must be one of reject, confirm", l.Action)
+	}
+	return nil
+}
+
+// fanOutLimit returns the fan-out limit of the request's namespace (nil if none)
+func (p *GuardrailsPlugin) fanOutLimit(r *plugins.Request) *FanOutLimit {
+	for _, l := range p.conf.FanOut {
+		if l.Scope == nil || l.Scope.MatchNamespace(r.Database(), r.Collection()) {
+			return l
+		}
+	}
+	return nil
+}
+
+// multiWrite is the filter (and its options) of an updateMany or deleteMany
+type multiWrite struct {
+	filter    bson.D
+	collation interface{}
+	hint      interface{}
+}
+
+// multiWrites returns the multi updates and deletes of the command, and whether
+// it's forced with the command's comment or a filter's $comment
+func (p *GuardrailsPlugin) multiWrites(c command.Command) ([]multiWrite, bool) {
+	var (
+		writes []multiWrite
+		forced bool
+	)
+	switch cmd := c.(type) {
+	case *command.Delete:
+		forced = p.forced(cmd.Comment)
+		for _, deleteDoc := range cmd.Deletes {
+			if limit, _ := bsonutil.Lookup(deleteDoc, "limit"); bsonutil.BoolNumber(limit) {
+				continue
+			}
+			q, _ := bsonutil.Lookup(deleteDoc, "q")
+			filter, _ := q.(bson.D)
+			collation, _ := bsonutil.Lookup(deleteDoc, "collation")
+			hint, _ := bsonutil.Lookup(deleteDoc, "hint")
+			writes = append(writes, multiWrite{filter: filter, collation: collation, hint: hint})
+		}
+	case *command.Update:
+		forced = p.forced(cmd.Comment)
+		for _, updateDoc := range cmd.Updates {
+			if !bsonutil.GetBoolDefault(updateDoc.Multi, false) {
+				continue
+			}
+			w := multiWrite{filter: updateDoc.Query, hint: updateDoc.Hint}
+			if updateDoc.Collation != nil {
+				w.collation = updateDoc.Collation
+			}
+			writes = append(writes, w)
+		}
+	}
+	for _, w := range writes {
+		comment, _ := bsonutil.Lookup(w.filter, "$comment")
+		forced = forced || p.forced(comment)
+	}
+	return writes, forced
+}
+
+// countDocuments counts the documents matching the filter of the write, as the
+// drivers' countDocuments does
+func countDocuments(ctx context.Context, cr plugins.CommandRunner, db, collection string, w multiWrite, timeout time.Duration) (int64, error) {
+	filter := w.filter
+	if filter == nil {
+		filter = bson.D{}
+	}
+	cmd := bson.D{
+		{"aggregate", collection},
+		{"pipeline", bson.A{
+			bson.D{{"$match", filter}},
+			bson.D{{"$group", bson.D{{"_id", 1}, {"n", bson.D{{"$sum", 1}}}}}},
+		}},
+		{"cursor", bson.D{}},
+		{"maxTimeMS", timeout.Milliseconds()},
+	}
+	if w.collation != nil {
+		cmd = append(cmd, bson.E{"collation", w.collation})
+	}
+	if w.hint != nil {
+		cmd = append(cmd, bson.E{"hint", w.hint})
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout+time.Second)
+	defer cancel()
+	result, err := cr.RunCommand(ctx, db, cmd)
+	if err != nil {
+		return 0, err
+	}
+	if !bsonutil.Ok(result) {
+		msg, _ := bsonutil.Lookup(result, "errmsg")
+		return 0, fmt.Errorf("count failed: %v", msg)
+	}
+	batch, _ := bsonutil.Lookup(result, "cursor", "firstBatch")
+	items, _ := batch.(primitive.A)
+	if len(items) == 0 {
+		return 0, nil
+	}
+	doc, _ := items[0].(bson.D)
+	n, _ := bsonutil.Lookup(doc, "n")
+	switch n := n.(type) {
+	case int32:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	case float64:
+		return int64(n), nil
+	}
+	return 0, fmt.Errorf("unexpected count %v", n)
+}
+
+// processFanOut rejects multi deletes and updates which would touch more documents
+// than their namespace's fan-out limit
+func (p *GuardrailsPlugin) processFanOut(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	l := p.fanOutLimit(r)
+	if l == nil {
+		return next(ctx, r)
+	}
+	writes, forced := p.multiWrites(r.Command)
+	if len(writes) == 0 || forced {
+		return next(ctx, r)
+	}
+
+	db, collection := r.Database(), r.Collection()
+	// Confirmed writes were counted when their token was issued
+	if l.Action == FanOutActionConfirm && p.confirmed(r) {
+		confirmTotal.WithLabelValues(db, collection, r.CommandName, "confirmed").Inc()
+		logrus.Warningf("CONFIRMED: %s on %s.%s", r.CommandName, db, collection)
+		return next(ctx, r)
+	}
+	cr := p.commandRunner()
+	for _, w := range writes {
+		var (
+			n   int64
+			err error
+		)
+		if cr == nil {
+			err = fmt.Errorf("no plugin in the chain can run commands on the backend")
+		} else {
+			n, err = countDocuments(ctx, cr, db, collection, w, l.countTimeout)
+		}
+		if err != nil {
+			logrus.Warningf("FAN-OUT COUNT FAILED: %s on %s.%s: %v", r.CommandName, db, collection, err)
+			if !l.RejectOnCountError {
+				fanOutTotal.WithLabelValues(db, collection, r.CommandName, "count_failed").Inc()
+				continue
+			}
+			fanOutTotal.WithLabelValues(db, collection, r.CommandName, "rejected").Inc()
+			return mongoerror.IllegalOperation.ErrMessage(fmt.Sprintf(
+				"%s on %s.%s couldn't be counted to check it touches at most %d documents: %v; add the comment %q to run it anyway",
+				r.CommandName, db, collection, l.MaxDocuments, err, p.conf.ForceComment)), nil
+		}
+		if n <= l.MaxDocuments {
+			continue
+		}
+
+		if p.conf.LogOnly {
+			fanOutTotal.WithLabelValues(db, collection, r.CommandName, "allowed").Inc()
+			logrus.Warningf("FAN-OUT LIMIT EXCEEDED: %s on %s.%s would touch %d documents (limit %d)",
+				r.CommandName, db, collection, n, l.MaxDocuments)
+			continue
+		}
+		if l.Action == FanOutActionConfirm {
+			fanOutTotal.WithLabelValues(db, collection, r.CommandName, "confirm").Inc()
+			return p.requestConfirmation(r, fmt.Sprintf(
+				"it would touch an estimated %d documents, more than the limit of %d", n, l.MaxDocuments)), nil
+		}
+		fanOutTotal.WithLabelValues(db, collection, r.CommandName, "rejected").Inc()
+		logrus.Warningf("FAN-OUT LIMIT REJECTED: %s on %s.%s would touch %d documents (limit %d)",
+			r.CommandName, db, collection, n, l.MaxDocuments)
+		return mongoerror.IllegalOperation.ErrMessage(fmt.Sprintf(
+			"%s on %s.%s would touch an estimated %d documents, more than the limit of %d; add the comment %q to run it anyway",
+			r.CommandName, db, collection, n, l.MaxDocuments, p.conf.ForceComment)), nil
+	}
+	return next(ctx, r)
+}
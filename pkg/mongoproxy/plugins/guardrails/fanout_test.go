@@ -0,0 +1,163 @@
+package guardrails
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+// counter is a plugins.CommandRunner counting the documents of the "n" field of
+// the $match filters (or failing for "fail")
+type counter struct {
+	cmds []bson.D
+}
+
+func (c *counter) RunCommand(ctx context.Context, db string, cmd bson.D) (bson.D, error) {
+	c.cmds = append(c.cmds, cmd)
+	pipeline, _ := bsonutil.Lookup(cmd, "pipeline")
+	match, _ := bsonutil.Lookup(pipeline.(bson.A)[0].(bson.D), "$match")
+	if _, ok := bsonutil.Lookup(match.(bson.D), "fail"); ok {
+		return nil, fmt.Errorf("operation exceeded time limit")
+	}
+	n, _ := bsonutil.Lookup(match.(bson.D), "n")
+	if n == nil {
+		return bson.D{{"cursor", bson.D{{"firstBatch", primitive.A{}}, {"id", int64(0)}}}, {"ok", 1}}, nil
+	}
+	return bson.D{{"cursor", bson.D{
+		{"firstBatch", primitive.A{bson.D{{"_id", int32(1)}, {"n", n}}}},
+		{"id", int64(0)},
+	}}, {"ok", 1}}, nil
+}
+
+func TestFanOut(t *testing.T) {
+	configs := map[string]bson.D{
+		"default": {{"fanOut", bson.A{
+			bson.D{{"scope", bson.D{{"collections", bson.A{"db.other"}}}}, {"maxDocuments", 1000000}},
+			bson.D{{"maxDocuments", 100}, {"countTimeout", "2s"}},
+		}}},
+		"reject": {{"fanOut", bson.A{
+			bson.D{{"maxDocuments", 100}, {"rejectOnCountError", true}},
+		}}},
+		"logOnly": {{"logOnly", true}, {"fanOut", bson.A{
+			bson.D{{"maxDocuments", 100}},
+		}}},
+	}
+
+	deleteMany := func(coll string, q bson.D, extra ...bson.E) bson.D {
+		return append(bson.D{{"delete", coll}, {"deletes", bson.A{bson.D{{"q", q}, {"limit", 0}}}}, {"$db", "db"}}, extra...)
+	}
+	updateMany := func(q bson.D, multi bool) bson.D {
+		return bson.D{{"update", "coll"}, {"updates", bson.A{bson.D{{"q", q}, {"u", bson.D{{"$set", bson.D{{"a", 1}}}}}, {"multi", multi}}}}, {"$db", "db"}}
+	}
+
+	tests := []struct {
+		config string
+		cmd    bson.D
+		ok     bool
+		counts int
+		errmsg string
+	}{
+		{config: "default", cmd: deleteMany("coll", bson.D{{"n", 100}}), ok: true, counts: 1},
+		{config: "default", cmd: deleteMany("coll", bson.D{{"n", 101}}), counts: 1, errmsg: "estimated 101 documents, more than the limit of 100"},
+		{config: "default", cmd: deleteMany("coll", bson.D{{"a", 1}}), ok: true, counts: 1},
+		{config: "default", cmd: updateMany(bson.D{{"n", int64(5000)}}, true), counts: 1, errmsg: "estimated 5000 documents"},
+		// Single updates and deletes aren't counted
+		{config: "default", cmd: updateMany(bson.D{{"n", 5000}}, false), ok: true},
+		{config: "default", cmd: bson.D{{"delete", "coll"}, {"deletes", bson.A{bson.D{{"q", bson.D{{"n", 5000}}}, {"limit", 1}}}}, {"$db", "db"}}, ok: true},
+		// The first limit matching the namespace applies
+		{config: "default", cmd: deleteMany("other", bson.D{{"n", 5000}}), ok: true, counts: 1},
+		// Forced writes aren't counted
+		{config: "default", cmd: deleteMany("coll", bson.D{{"n", 5000}}, bson.E{"comment", "force"}), ok: true},
+		{config: "default", cmd: deleteMany("coll", bson.D{{"n", 5000}, {"$comment", "JIRA-1 force"}}), ok: true},
+		// Writes which can't be counted run unless rejectOnCountError
+		{config: "default", cmd: deleteMany("coll", bson.D{{"fail", 1}}), ok: true, counts: 1},
+		{config: "reject", cmd: deleteMany("coll", bson.D{{"fail", 1}}), counts: 1, errmsg: "couldn't be counted"},
+		{config: "logOnly", cmd: deleteMany("coll", bson.D{{"n", 5000}}), ok: true, counts: 1},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			d := &GuardrailsPlugin{}
+			if err := d.Configure(configs[test.config]); err != nil {
+				t.Fatal(err)
+			}
+			cr := &counter{}
+			d.SetCommandRunner(cr)
+			p := plugins.BuildPipeline([]plugins.Plugin{d}, func(context.Context, *plugins.Request) (bson.D, error) {
+				return bson.D{{"ok", 1}}, nil
+			})
+
+			cmd, ok := command.GetCommand(test.cmd[0].Key)
+			if !ok {
+				t.Fatalf("no such command: %s", test.cmd[0].Key)
+			}
+			if err := cmd.FromBSOND(test.cmd); err != nil {
+				t.Fatal(err)
+			}
+			result, err := p(context.TODO(), &plugins.Request{CommandName: test.cmd[0].Key, Command: cmd})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok := bsonutil.Ok(result); ok != test.ok {
+				t.Fatalf("expected ok=%v, got %v", test.ok, result)
+			}
+			if len(cr.cmds) != test.counts {
+				t.Fatalf("expected %d counts, got %v", test.counts, cr.cmds)
+			}
+			if errmsg, _ := bsonutil.Lookup(result, "errmsg"); !strings.Contains(fmt.Sprint(errmsg), test.errmsg) {
+				t.Fatalf("expected an error containing %q, got %v", test.errmsg, result)
+			}
+		})
+	}
+}
+
+func TestFanOutCount(t *testing.T) {
+	cr := &counter{}
+	w := multiWrite{filter: bson.D{{"n", int32(3)}}, collation: bson.D{{"locale", "fr"}}, hint: "a_1"}
+	n, err := countDocuments(context.TODO(), cr, "db", "coll", w, 1500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3, got %d", n)
+	}
+	cmd := cr.cmds[0]
+	for key, expected := range map[string]interface{}{"aggregate": "coll", "maxTimeMS": int64(1500), "hint": "a_1"} {
+		if v, _ := bsonutil.Lookup(cmd, key); v != expected {
+			t.Fatalf("expected %s %v, got %v", key, expected, cmd)
+		}
+	}
+	if _, ok := bsonutil.Lookup(cmd, "collation"); !ok {
+		t.Fatalf("expected the collation to be passed, got %v", cmd)
+	}
+}
+
+func TestFanOutConfig(t *testing.T) {
+	tests := []struct {
+		limit bson.D
+		ok    bool
+	}{
+		{bson.D{{"maxDocuments", 10}}, true},
+		{bson.D{{"maxDocuments", 10}, {"countTimeout", "500ms"}}, true},
+		{bson.D{}, false},
+		{bson.D{{"maxDocuments", -1}}, false},
+		{bson.D{{"maxDocuments", 10}, {"countTimeout", "soon"}}, false},
+		{bson.D{{"maxDocuments", 10}, {"countTimeout", "1us"}}, false},
+	}
+	for i, test := range tests {
+		d := &GuardrailsPlugin{}
+		if err := d.Configure(bson.D{{"fanOut", bson.A{test.limit}}}); (err == nil) != test.ok {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package guardrails
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "guardrails"
+
+var (
+	unfilteredTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_guardrails_unfiltered_writes_total",
+		Help: "The total multi deletes and updates without a filter",
+	}, []string{"db", "collection", "command", "result"})
+)
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &GuardrailsPlugin{
+			conf: GuardrailsPluginConfig{},
+		}
+	})
+}
+
+type GuardrailsPluginConfig struct {
+	// ForceComment is the comment (the command's comment or the filter's $comment)
+	// which allows an unfiltered write; a string comment containing it as a word or
+	// a document comment with it set to true (default "force")
+	ForceComment string `bson:"forceComment"`
+	// LogOnly logs unfiltered writes and cursors exceeding their limits instead of
+	// rejecting them
+	LogOnly bool `bson:"logOnly"`
+	// Cursors are the limits on the results of a single cursor; the first limit
+	// matching the namespace applies
+	Cursors []*CursorLimit `bson:"cursors"`
+	// FanOut are the limits on the documents a single multi delete or update may
+	// touch; the first limit matching the namespace applies
+	FanOut []*FanOutLimit `bson:"fanOut"`
+	// Confirm are the rules of the commands requiring confirmation; the first rule
+	// matching the namespace and command applies
+	Confirm []*ConfirmRule `bson:"confirm"`
+	// ConfirmWindow is how long confirmation tokens are valid (default 5m)
+	ConfirmWindow string `bson:"confirmWindow"`
+	// ConfirmKeyPath is the path of the base64 key confirmation tokens are signed
+	// with, to share tokens between proxies (default a random key per proxy)
+	ConfirmKeyPath string `bson:"confirmKeyPath"`
+
+	confirmWindow time.Duration
+}
+
+// This is a plugin that rejects deleteMany and updateMany with filters matching the
+// whole collection (or too many documents), to prevent accidentally wiping
+// collections, and caps the results of cursors, to prevent accidental
+// full-collection dumps
+type GuardrailsPlugin struct {
+	conf       GuardrailsPluginConfig
+	confirmKey []byte
+
+	crLock sync.RWMutex
+	cr     plugins.CommandRunner
+}
+
+func (p *GuardrailsPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *GuardrailsPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	if p.conf.ForceComment == "" {
+		p.conf.ForceComment = "force"
+	}
+	if strings.ContainsAny(p.conf.ForceComment, " \t\n") {
+		return fmt.Errorf("forceComment must be a single word: %q", p.conf.ForceComment)
+	}
+	for i, l := range p.conf.Cursors {
+		if l == nil {
+			return fmt.Errorf("empty cursor limit %d", i)
+		}
+		if err := l.load(); err != nil {
+			return fmt.Errorf("invalid cursor limit %d: %w", i, err)
+		}
+	}
+	for i, l := range p.conf.FanOut {
+		if l == nil {
+			return fmt.Errorf("empty fan-out limit %d", i)
+		}
+		if err := l.load(); err != nil {
+			return fmt.Errorf("invalid fan-out limit %d: %w", i, err)
+		}
+	}
+	for i, c := range p.conf.Confirm {
+		if c == nil {
+			return fmt.Errorf("empty confirm rule %d", i)
+		}
+		if err := c.load(); err != nil {
+			return fmt.Errorf("invalid confirm rule %d: %w", i, err)
+		}
+	}
+	if p.conf.ConfirmWindow == "" {
+		p.conf.ConfirmWindow = "5m"
+	}
+	if p.conf.confirmWindow, err = time.ParseDuration(p.conf.ConfirmWindow); err != nil {
+		return fmt.Errorf("invalid confirmWindow: %w", err)
+	}
+	if p.conf.confirmWindow <= 0 {
+		return fmt.Errorf("confirmWindow must be positive")
+	}
+	if p.confirmKey, err = loadConfirmKey(p.conf.ConfirmKeyPath); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SetCommandRunner sets the runner the documents touched by multi writes are
+// counted with
+func (p *GuardrailsPlugin) SetCommandRunner(cr plugins.CommandRunner) {
+	p.crLock.Lock()
+	defer p.crLock.Unlock()
+	p.cr = cr
+}
+
+func (p *GuardrailsPlugin) commandRunner() plugins.CommandRunner {
+	p.crLock.RLock()
+	defer p.crLock.RUnlock()
+	return p.cr
+}
+
+// forced returns whether the comment has the force flag
+func (p *GuardrailsPlugin) forced(comment interface{}) bool {
+	switch c := comment.(type) {
+	case string:
+		for _, word := range strings.Fields(c) {
+			if word == p.conf.ForceComment {
+				return true
+			}
+		}
+	case bson.D:
+		v, _ := bsonutil.Lookup(c, p.conf.ForceComment)
+		b, _ := v.(bool)
+		return b
+	}
+	return false
+}
+
+// trivial returns whether the filter matches every document
+func trivial(filter bson.D) bool {
+	for _, e := range filter {
+		switch e.Key {
+		case "$comment":
+		case "$and":
+			items, _ := e.Value.(primitive.A)
+			for _, item := range items {
+				if sub, ok := item.(bson.D); !ok || !trivial(sub) {
+					return false
+				}
+			}
+		case "$or":
+			items, _ := e.Value.(primitive.A)
+			var any bool
+			for _, item := range items {
+				if sub, ok := item.(bson.D); ok && trivial(sub) {
+					any = true
+					break
+				}
+			}
+			if !any {
+				return false
+			}
+		case "$expr":
+			if b, ok := e.Value.(bool); !ok || !b {
+				return false
+			}
+		case "$where":
+			s, _ := e.Value.(string)
+			s = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), ";"))
+			if s != "true" && s != "return true" {
+				return false
+			}
+		case "_id":
+			// Every document has an _id
+			ops, ok := e.Value.(bson.D)
+			if !ok || len(ops) != 1 {
+				return false
+			}
+			switch ops[0].Key {
+			case "$exists":
+				if b, ok := ops[0].Value.(bool); !ok || !b {
+					return false
+				}
+			case "$ne":
+				if ops[0].Value != nil {
+					return false
+				}
+			default:
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *GuardrailsPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	switch r.Command.(type) {
+	case *command.Find, *command.Aggregate, *command.GetMore:
+		if len(p.conf.Cursors) > 0 {
+			return p.processCursor(ctx, r, next)
+		}
+	case *command.Drop, *command.DropDatabase:
+		if errDoc, ok := p.processConfirm(r); !ok {
+			return errDoc, nil
+		}
+		return next(ctx, r)
+	}
+	return p.processWrite(ctx, r, next)
+}
+
+// processWrite rejects unfiltered multi deletes and updates (and those exceeding
+// their fan-out limit)
+func (p *GuardrailsPlugin) processWrite(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	var (
+		unfiltered bool
+		forced     bool
+	)
+	switch cmd := r.Command.(type) {
+	case *command.Delete:
+		forced = p.forced(cmd.Comment)
+		for _, deleteDoc := range cmd.Deletes {
+			// A limit of 1 deletes a single document (deleteOne)
+			if limit, _ := bsonutil.Lookup(deleteDoc, "limit"); bsonutil.BoolNumber(limit) {
+				continue
+			}
+			q, _ := bsonutil.Lookup(deleteDoc, "q")
+			filter, _ := q.(bson.D)
+			if trivial(filter) {
+				unfiltered = true
+				comment, _ := bsonutil.Lookup(filter, "$comment")
+				forced = forced || p.forced(comment)
+			}
+		}
+	case *command.Update:
+		forced = p.forced(cmd.Comment)
+		for _, updateDoc := range cmd.Updates {
+			if !bsonutil.GetBoolDefault(updateDoc.Multi, false) {
+				continue
+			}
+			if trivial(updateDoc.Query) {
+				unfiltered = true
+				comment, _ := bsonutil.Lookup(updateDoc.Query, "$comment")
+				forced = forced || p.forced(comment)
+			}
+		}
+	}
+	if !unfiltered {
+		return p.processFanOut(ctx, r, next)
+	}
+
+	db, collection := command.GetCommandDatabase(r.Command), command.GetCommandCollection(r.Command)
+	if forced {
+		unfilteredTotal.WithLabelValues(db, collection, r.CommandName, "forced").Inc()
+		logrus.Warningf("UNFILTERED WRITE FORCED: %s on %s.%s", r.CommandName, db, collection)
+		return next(ctx, r)
+	}
+	if p.conf.LogOnly {
+		unfilteredTotal.WithLabelValues(db, collection, r.CommandName, "allowed").Inc()
+		logrus.Warningf("UNFILTERED WRITE: %s on %s.%s", r.CommandName, db, collection)
+		return next(ctx, r)
+	}
+
+	unfilteredTotal.WithLabelValues(db, collection, r.CommandName, "rejected").Inc()
+	logrus.Warningf("UNFILTERED WRITE REJECTED: %s on %s.%s", r.CommandName, db, collection)
+	return mongoerror.IllegalOperation.ErrMessage(fmt.Sprintf(
+		"%s on %s.%s with a filter matching every document is not allowed; add the comment %q to run it anyway",
+		r.CommandName, db, collection, p.conf.ForceComment)), nil
+}
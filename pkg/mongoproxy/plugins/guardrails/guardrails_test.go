@@ -0,0 +1,70 @@
+package guardrails
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func TestGuardrails(t *testing.T) {
+	d := &GuardrailsPlugin{}
+	if err := d.Configure(bson.D{}); err != nil {
+		t.Fatal(err)
+	}
+
+	p := plugins.BuildPipeline([]plugins.Plugin{d}, func(context.Context, *plugins.Request) (bson.D, error) {
+		return bson.D{{"ok", 1}}, nil
+	})
+
+	tests := []struct {
+		cmd bson.D
+		ok  bool
+	}{
+		{bson.D{{"delete", "coll"}, {"deletes", bson.A{bson.D{{"q", bson.D{}}, {"limit", 0}}}}, {"$db", "db"}}, false},
+		{bson.D{{"delete", "coll"}, {"deletes", bson.A{bson.D{{"q", bson.D{}}, {"limit", 1}}}}, {"$db", "db"}}, true},
+		{bson.D{{"delete", "coll"}, {"deletes", bson.A{bson.D{{"q", bson.D{{"a", 1}}}, {"limit", 0}}}}, {"$db", "db"}}, true},
+		{bson.D{{"delete", "coll"}, {"deletes", bson.A{
+			bson.D{{"q", bson.D{{"a", 1}}}, {"limit", 0}},
+			bson.D{{"q", bson.D{{"_id", bson.D{{"$exists", true}}}}}, {"limit", 0}},
+		}}, {"$db", "db"}}, false},
+		{bson.D{{"delete", "coll"}, {"deletes", bson.A{bson.D{{"q", bson.D{{"$and", bson.A{bson.D{}}}}}, {"limit", 0}}}}, {"$db", "db"}}, false},
+		{bson.D{{"delete", "coll"}, {"deletes", bson.A{bson.D{{"q", bson.D{{"$or", bson.A{bson.D{{"a", 1}}, bson.D{}}}}}, {"limit", 0}}}}, {"$db", "db"}}, false},
+		{bson.D{{"delete", "coll"}, {"deletes", bson.A{bson.D{{"q", bson.D{{"$expr", true}}}, {"limit", 0}}}}, {"$db", "db"}}, false},
+		{bson.D{{"delete", "coll"}, {"deletes", bson.A{bson.D{{"q", bson.D{{"$where", "return true;"}}}, {"limit", 0}}}}, {"$db", "db"}}, false},
+		// Forced with the command's comment or the filter's $comment
+		{bson.D{{"delete", "coll"}, {"deletes", bson.A{bson.D{{"q", bson.D{}}, {"limit", 0}}}}, {"comment", "cleanup force"}, {"$db", "db"}}, true},
+		{bson.D{{"delete", "coll"}, {"deletes", bson.A{bson.D{{"q", bson.D{}}, {"limit", 0}}}}, {"comment", bson.D{{"force", true}}}, {"$db", "db"}}, true},
+		{bson.D{{"delete", "coll"}, {"deletes", bson.A{bson.D{{"q", bson.D{{"$comment", "force"}}}, {"limit", 0}}}}, {"$db", "db"}}, true},
+		{bson.D{{"delete", "coll"}, {"deletes", bson.A{bson.D{{"q", bson.D{{"$comment", "forced"}}}, {"limit", 0}}}}, {"$db", "db"}}, false},
+		{bson.D{{"update", "coll"}, {"updates", bson.A{bson.D{{"q", bson.D{}}, {"u", bson.D{{"$set", bson.D{{"a", 1}}}}}, {"multi", true}}}}, {"$db", "db"}}, false},
+		{bson.D{{"update", "coll"}, {"updates", bson.A{bson.D{{"q", bson.D{}}, {"u", bson.D{{"$set", bson.D{{"a", 1}}}}}}}}, {"$db", "db"}}, true},
+		{bson.D{{"update", "coll"}, {"updates", bson.A{bson.D{{"q", bson.D{{"_id", bson.D{{"$ne", nil}}}}}, {"u", bson.D{{"$set", bson.D{{"a", 1}}}}}, {"multi", true}}}}, {"$db", "db"}}, false},
+		{bson.D{{"update", "coll"}, {"updates", bson.A{bson.D{{"q", bson.D{{"_id", bson.D{{"$ne", 1}}}}}, {"u", bson.D{{"$set", bson.D{{"a", 1}}}}}, {"multi", true}}}}, {"$db", "db"}}, true},
+		{bson.D{{"update", "coll"}, {"updates", bson.A{bson.D{{"q", bson.D{}}, {"u", bson.D{{"$set", bson.D{{"a", 1}}}}}, {"multi", true}}}}, {"comment", "force"}, {"$db", "db"}}, true},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			cmd, ok := command.GetCommand(test.cmd[0].Key)
+			if !ok {
+				t.Fatalf("no such command: %s", test.cmd[0].Key)
+			}
+			if err := cmd.FromBSOND(test.cmd); err != nil {
+				t.Fatal(err)
+			}
+			result, err := p(context.TODO(), &plugins.Request{CommandName: test.cmd[0].Key, Command: cmd})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok := bsonutil.Ok(result); ok != test.ok {
+				t.Fatalf("expected ok=%v, got %v", test.ok, result)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package idempotency
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "idempotency"
+
+var (
+	duplicatesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_idempotency_duplicates_total",
+		Help: "The total duplicate writes answered with the result of the original write",
+	}, []string{"db", "collection", "command"})
+	keysGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongoproxy_plugins_idempotency_keys",
+		Help: "The number of idempotency keys remembered",
+	})
+)
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &IdempotencyPlugin{
+			conf: IdempotencyPluginConfig{
+				Field:   "idempotencyKey",
+				TTL:     "10m",
+				MaxKeys: 100000,
+			},
+		}
+	})
+}
+
+type IdempotencyPluginConfig struct {
+	// Field is the field of a document comment (the command's comment or a filter's
+	// $comment) holding the idempotency key of a write; a string comment may hold it
+	// as a "<field>:<key>" word (default "idempotencyKey")
+	Field string `bson:"field"`
+	// TTL is how long the result of a write is kept to answer its duplicates (default "10m")
+	TTL string `bson:"ttl"`
+	// MaxKeys is the maximum number of keys remembered; the oldest are forgotten
+	// first (default 100000)
+	MaxKeys int `bson:"maxKeys"`
+
+	ttl time.Duration
+}
+
+// write is a write with an idempotency key, running or done
+type write struct {
+	key string
+	// done is closed once the write is done; result is its result, or nil if it
+	// failed and may be retried
+	done    chan struct{}
+	result  bson.D
+	expires time.Time
+}
+
+// This is a plugin that answers writes with an idempotency key seen recently with
+// the result of the original write, to protect against client retry bugs
+type IdempotencyPlugin struct {
+	conf IdempotencyPluginConfig
+	now  func() time.Time
+
+	l      sync.Mutex
+	writes map[string]*write
+	// expiries are the completed writes in the order they expire (the TTL is the
+	// same for all)
+	expiries *list.List
+}
+
+func (p *IdempotencyPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *IdempotencyPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	if p.conf.Field == "" || strings.ContainsAny(p.conf.Field, " \t\n:") {
+		return fmt.Errorf("field must be a single word without ':': %q", p.conf.Field)
+	}
+	if p.conf.ttl, err = time.ParseDuration(p.conf.TTL); err != nil {
+		return err
+	}
+	if p.conf.ttl <= 0 {
+		return fmt.Errorf("ttl must be positive: %s", p.conf.TTL)
+	}
+	if p.conf.MaxKeys <= 0 {
+		return fmt.Errorf("maxKeys must be positive: %d", p.conf.MaxKeys)
+	}
+
+	p.now = time.Now
+	p.writes = make(map[string]*write)
+	p.expiries = list.New()
+	return nil
+}
+
+// commentKey returns the idempotency key of a comment ("" if none)
+func (p *IdempotencyPlugin) commentKey(comment interface{}) string {
+	switch c := comment.(type) {
+	case string:
+		prefix := p.conf.Field + ":"
+		for _, word := range strings.Fields(c) {
+			if strings.HasPrefix(word, prefix) {
+				return strings.TrimPrefix(word, prefix)
+			}
+		}
+	case bson.D:
+		v, _ := bsonutil.Lookup(c, p.conf.Field)
+		key, _ := v.(string)
+		return key
+	}
+	return ""
+}
+
+// key returns the idempotency key of the write ("" if none)
+func (p *IdempotencyPlugin) key(r *plugins.Request) string {
+	var comment interface{}
+	switch cmd := r.Command.(type) {
+	case *command.Insert:
+		comment = cmd.Comment
+	case *command.Update:
+		comment = cmd.Comment
+	case *command.Delete:
+		comment = cmd.Comment
+	case *command.FindAndModify:
+		comment = cmd.Comment
+	default:
+		return ""
+	}
+	if key := p.commentKey(comment); key != "" {
+		return key
+	}
+	for _, filter := range r.Filters() {
+		c, _ := bsonutil.Lookup(filter, "$comment")
+		if key := p.commentKey(c); key != "" {
+			return key
+		}
+	}
+	return ""
+}
+
+// writeKey returns the key of a write: the same idempotency key is only a duplicate
+// for the same user, command and namespace
+func writeKey(r *plugins.Request, key string) string {
+	var user string
+	if r.CC != nil && len(r.CC.Identities) > 0 {
+		user = r.CC.Identities[0].User()
+	}
+	return strings.Join([]string{user, r.CommandName, r.Database(), r.Collection(), key}, "\x00")
+}
+
+// expire forgets the expired writes and the oldest over maxKeys; p.l must be held
+func (p *IdempotencyPlugin) expire(now time.Time) {
+	for e := p.expiries.Front(); e != nil; e = p.expiries.Front() {
+		w := e.Value.(*write)
+		if p.expiries.Len() <= p.conf.MaxKeys && w.expires.After(now) {
+			break
+		}
+		p.expiries.Remove(e)
+		if p.writes[w.key] == w {
+			delete(p.writes, w.key)
+		}
+	}
+	keysGauge.Set(float64(len(p.writes)))
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *IdempotencyPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	key := p.key(r)
+	if key == "" {
+		return next(ctx, r)
+	}
+	k := writeKey(r, key)
+	db, collection := r.Database(), r.Collection()
+
+	var w *write
+	for {
+		p.l.Lock()
+		p.expire(p.now())
+		original, ok := p.writes[k]
+		if !ok {
+			w = &write{key: k, done: make(chan struct{})}
+			p.writes[k] = w
+			p.l.Unlock()
+			break
+		}
+		p.l.Unlock()
+
+		// A duplicate waits for the original write, and runs if it failed
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-original.done:
+		}
+		if original.result != nil {
+			duplicatesTotal.WithLabelValues(db, collection, r.CommandName).Inc()
+			logrus.Debugf("Duplicate %s on %s.%s with idempotency key %q", r.CommandName, db, collection, key)
+			return append(bson.D(nil), original.result...), nil
+		}
+	}
+
+	// The write is done even if next panics, failed then, so that duplicates
+	// don't wait on it forever
+	defer func() {
+		p.l.Lock()
+		if w.result == nil {
+			delete(p.writes, k)
+		}
+		p.l.Unlock()
+		close(w.done)
+	}()
+
+	result, err := next(ctx, r)
+
+	if err == nil && bsonutil.Ok(result) {
+		p.l.Lock()
+		w.result = append(bson.D(nil), result...)
+		w.expires = p.now().Add(p.conf.ttl)
+		p.expiries.PushBack(w)
+		p.expire(p.now())
+		p.l.Unlock()
+	}
+	return result, err
+}
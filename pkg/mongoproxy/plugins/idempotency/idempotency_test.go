@@ -0,0 +1,198 @@
+package idempotency
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func newRequest(t *testing.T, user string, d bson.D) *plugins.Request {
+	cmd, ok := command.GetCommand(d[0].Key)
+	if !ok {
+		t.Fatalf("no such command: %s", d[0].Key)
+	}
+	if err := cmd.FromBSOND(d); err != nil {
+		t.Fatal(err)
+	}
+	cc := plugins.NewClientConnection()
+	if user != "" {
+		cc.Identities = []plugins.ClientIdentity{plugins.NewStaticIdentity("test", user)}
+	}
+	return &plugins.Request{CC: cc, CommandName: d[0].Key, Command: cmd}
+}
+
+func TestIdempotency(t *testing.T) {
+	pl, _ := plugins.GetPlugin(Name)
+	d := pl.(*IdempotencyPlugin)
+	if err := d.Configure(bson.D{{"ttl", "1m"}, {"maxKeys", 3}}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	d.now = func() time.Time { return now }
+
+	writes, fail := 0, false
+	p := plugins.BuildPipeline([]plugins.Plugin{d}, func(context.Context, *plugins.Request) (bson.D, error) {
+		if fail {
+			return bson.D{{"ok", 0}, {"errmsg", "failed"}}, nil
+		}
+		writes++
+		return bson.D{{"n", writes}, {"ok", 1}}, nil
+	})
+
+	insert := func(comment interface{}) bson.D {
+		return bson.D{{"insert", "coll"}, {"documents", bson.A{bson.D{{"a", 1}}}}, {"comment", comment}, {"$db", "db"}}
+	}
+	tests := []struct {
+		setup func()
+		user  string
+		cmd   bson.D
+		// n is the write answering the command (0 for an error)
+		n int
+	}{
+		{cmd: insert(bson.D{{"idempotencyKey", "a"}}), n: 1},
+		{cmd: insert(bson.D{{"idempotencyKey", "a"}}), n: 1},
+		{cmd: insert("retry idempotencyKey:a"), n: 1},
+		// Writes without a key always run
+		{cmd: insert("a"), n: 2},
+		{cmd: bson.D{{"insert", "coll"}, {"documents", bson.A{bson.D{{"a", 1}}}}, {"$db", "db"}}, n: 3},
+		// Keys are per user, command and namespace
+		{user: "alice", cmd: insert(bson.D{{"idempotencyKey", "a"}}), n: 4},
+		{cmd: bson.D{{"insert", "other"}, {"documents", bson.A{bson.D{{"a", 1}}}}, {"comment", bson.D{{"idempotencyKey", "a"}}}, {"$db", "db"}}, n: 5},
+		{cmd: bson.D{{"delete", "coll"}, {"deletes", bson.A{bson.D{{"q", bson.D{{"$comment", "idempotencyKey:a"}}}, {"limit", 1}}}}, {"$db", "db"}}, n: 6},
+		{cmd: bson.D{{"delete", "coll"}, {"deletes", bson.A{bson.D{{"q", bson.D{{"$comment", "idempotencyKey:a"}}}, {"limit", 1}}}}, {"$db", "db"}}, n: 6},
+		// The oldest keys are forgotten over maxKeys
+		{cmd: insert(bson.D{{"idempotencyKey", "a"}}), n: 7},
+		// Keys are forgotten after the TTL
+		{setup: func() { now = now.Add(2 * time.Minute) }, user: "alice", cmd: insert(bson.D{{"idempotencyKey", "a"}}), n: 8},
+		// Failed writes aren't remembered
+		{setup: func() { fail = true }, cmd: insert(bson.D{{"idempotencyKey", "b"}})},
+		{setup: func() { fail = false }, cmd: insert(bson.D{{"idempotencyKey", "b"}}), n: 9},
+	}
+	for i, test := range tests {
+		if test.setup != nil {
+			test.setup()
+		}
+		result, err := p(context.TODO(), newRequest(t, test.user, test.cmd))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.n == 0 {
+			if bsonutil.Ok(result) {
+				t.Fatalf("%d: expected an error, got %v", i, result)
+			}
+			continue
+		}
+		if n, _ := bsonutil.Lookup(result, "n"); n != test.n {
+			t.Fatalf("%d: expected the result of write %d, got %v", i, test.n, result)
+		}
+	}
+}
+
+func TestIdempotencyConcurrent(t *testing.T) {
+	pl, _ := plugins.GetPlugin(Name)
+	d := pl.(*IdempotencyPlugin)
+	if err := d.Configure(bson.D{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		l      sync.Mutex
+		writes int
+	)
+	p := plugins.BuildPipeline([]plugins.Plugin{d}, func(context.Context, *plugins.Request) (bson.D, error) {
+		time.Sleep(10 * time.Millisecond) // mimic slow-ish backend
+		l.Lock()
+		defer l.Unlock()
+		writes++
+		return bson.D{{"n", writes}, {"ok", 1}}, nil
+	})
+
+	// Duplicates sent while the original write runs wait for its result
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := newRequest(t, "", bson.D{{"update", "coll"}, {"updates", bson.A{bson.D{{"q", bson.D{}}, {"u", bson.D{{"$inc", bson.D{{"a", 1}}}}}}}}, {"comment", "idempotencyKey:x"}, {"$db", "db"}})
+			if _, err := p(context.TODO(), r); err != nil {
+				t.Error(strconv.Itoa(i), err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if writes != 1 {
+		t.Fatalf("expected a single write, got %d", writes)
+	}
+}
+
+func TestIdempotencyPanic(t *testing.T) {
+	pl, _ := plugins.GetPlugin(Name)
+	d := pl.(*IdempotencyPlugin)
+	if err := d.Configure(bson.D{}); err != nil {
+		t.Fatal(err)
+	}
+
+	started, panics := make(chan struct{}), make(chan struct{})
+	writes := 0
+	p := plugins.BuildPipeline([]plugins.Plugin{d}, func(context.Context, *plugins.Request) (bson.D, error) {
+		writes++
+		if writes == 1 {
+			close(started)
+			<-panics
+			panic("write failed")
+		}
+		return bson.D{{"n", writes}, {"ok", 1}}, nil
+	})
+	insert := bson.D{{"insert", "coll"}, {"documents", bson.A{bson.D{{"a", 1}}}}, {"comment", "idempotencyKey:p"}, {"$db", "db"}}
+
+	go func() {
+		defer func() { recover() }()
+		p(context.TODO(), newRequest(t, "", insert))
+	}()
+	<-started
+
+	// A duplicate waiting for a write which panics runs once it's done
+	result := make(chan bson.D)
+	go func() {
+		r, _ := p(context.TODO(), newRequest(t, "", insert))
+		result <- r
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(panics)
+
+	select {
+	case r := <-result:
+		if n, _ := bsonutil.Lookup(r, "n"); n != 2 {
+			t.Fatalf("expected the result of write 2, got %v", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("duplicate still waiting for the write which panicked")
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		conf bson.D
+		ok   bool
+	}{
+		{conf: bson.D{}, ok: true},
+		{conf: bson.D{{"field", "requestId"}, {"ttl", "1h"}}, ok: true},
+		{conf: bson.D{{"field", "request:id"}}},
+		{conf: bson.D{{"ttl", "0s"}}},
+		{conf: bson.D{{"maxKeys", 0}}},
+	}
+	for i, test := range tests {
+		pl, _ := plugins.GetPlugin(Name)
+		if err := pl.Configure(test.conf); (err == nil) != test.ok {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package idpolicy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/uuid"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "idpolicy"
+
+var (
+	rejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_idpolicy_rejected_total",
+		Help: "The total writes rejected for the _id of a document",
+	}, []string{"db", "collection"})
+	generatedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_idpolicy_generated_total",
+		Help: "The total _ids generated by the proxy",
+	}, []string{"db", "collection"})
+)
+
+// Types of _id
+const (
+	TypeObjectID = "objectID"
+	TypeUUID     = "uuid"
+	TypeString   = "string"
+	TypeInt      = "int"
+	TypeLong     = "long"
+	TypeBinData  = "binData"
+)
+
+// Binary subtypes of UUIDs
+const (
+	binaryUUIDOld byte = 0x03
+	binaryUUID    byte = 0x04
+)
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &IDPolicyPlugin{
+			conf: IDPolicyPluginConfig{},
+		}
+	})
+}
+
+type IDPolicyPluginConfig struct {
+	// Rules are the _id rules of collections; the first rule matching the request applies
+	Rules []*Rule `bson:"rules"`
+}
+
+// Rule is the _id strategy of a set of collections
+type Rule struct {
+	// Scope are the collections the rule applies to (same format as a plugin scope; required)
+	Scope *plugins.Scope `bson:"scope"`
+	// Type is the type of _id; one of objectID, uuid, string, int, long or binData
+	Type string `bson:"type"`
+	// Generate has the proxy generate the _id (objectID or uuid) of documents without
+	// one; otherwise documents must have an _id
+	Generate bool `bson:"generate"`
+}
+
+func (r *Rule) load() error {
+	if r.Scope.IsZero() {
+		return fmt.Errorf("scope is required")
+	}
+	r.Scope.Compile()
+
+	switch r.Type {
+	case TypeObjectID, TypeUUID:
+	case TypeString, TypeInt, TypeLong, TypeBinData:
+		if r.Generate {
+			return fmt.Errorf("only objectID and uuid _ids can be generated")
+		}
+	default:
+		return fmt.Errorf("invalid type %q; must be one of objectID, uuid, string, int, long, binData", r.Type)
+	}
+	return nil
+}
+
+// checkType returns whether the _id is of the rule's type
+func (r *Rule) checkType(id interface{}) bool {
+	switch r.Type {
+	case TypeObjectID:
+		_, ok := id.(primitive.ObjectID)
+		return ok
+	case TypeUUID:
+		b, ok := id.(primitive.Binary)
+		return ok && (b.Subtype == binaryUUID || b.Subtype == binaryUUIDOld) && len(b.Data) == 16
+	case TypeString:
+		_, ok := id.(string)
+		return ok
+	case TypeInt, TypeLong:
+		switch id.(type) {
+		case int, int32, int64:
+			return true
+		}
+	case TypeBinData:
+		_, ok := id.(primitive.Binary)
+		return ok
+	}
+	return false
+}
+
+// newID returns a new _id of the rule's type
+func (r *Rule) newID() (interface{}, error) {
+	if r.Type == TypeUUID {
+		u, err := uuid.New()
+		if err != nil {
+			return nil, err
+		}
+		return primitive.Binary{Subtype: binaryUUID, Data: u[:]}, nil
+	}
+	return primitive.NewObjectID(), nil
+}
+
+// This is a plugin that enforces the _id strategy of collections
+type IDPolicyPlugin struct {
+	conf IDPolicyPluginConfig
+}
+
+func (p *IDPolicyPlugin) Name() string { return Name }
+
+// ReadsDocuments returns true as the _id of inserted documents is checked
+func (p *IDPolicyPlugin) ReadsDocuments() bool { return true }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *IDPolicyPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	for i, rule := range p.conf.Rules {
+		if rule == nil {
+			return fmt.Errorf("empty rule %d", i)
+		}
+		if err := rule.load(); err != nil {
+			return fmt.Errorf("invalid rule %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (p *IDPolicyPlugin) rule(r *plugins.Request) *Rule {
+	for _, rule := range p.conf.Rules {
+		if rule.Scope.Match(r) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// checkDocument checks the _id of a document to insert, returning the document
+// with a generated _id if it had none
+func (r *Rule) checkDocument(doc bson.D) (bson.D, bool, error) {
+	id, ok := bsonutil.Lookup(doc, "_id")
+	if ok {
+		if !r.checkType(id) {
+			return nil, false, fmt.Errorf("_id must be of type %s, got %T", r.Type, id)
+		}
+		return doc, false, nil
+	}
+	if !r.Generate {
+		return nil, false, fmt.Errorf("_id of type %s is required", r.Type)
+	}
+	id, err := r.newID()
+	if err != nil {
+		return nil, false, err
+	}
+	return append(bson.D{{"_id", id}}, doc...), true, nil
+}
+
+// checkUpsert checks the _id an upsert with the query and update would insert,
+// returning the update with a generated _id if needed
+func (r *Rule) checkUpsert(query, update bson.D) (bson.D, bool, error) {
+	// Replacement documents are inserted as is (with the query's _id if they have none)
+	if len(update) == 0 || !strings.HasPrefix(update[0].Key, "$") {
+		if _, ok := bsonutil.Lookup(update, "_id"); ok || !hasQueryID(query) {
+			return r.checkDocument(update)
+		}
+	}
+
+	id, ok := bsonutil.Lookup(update, "$setOnInsert", "_id")
+	if !ok {
+		id, ok = bsonutil.Lookup(update, "$set", "_id")
+	}
+	if !ok {
+		id, ok = queryID(query)
+	}
+	if ok {
+		if !r.checkType(id) {
+			return nil, false, fmt.Errorf("_id must be of type %s, got %T", r.Type, id)
+		}
+		return update, false, nil
+	}
+
+	if !r.Generate {
+		return nil, false, fmt.Errorf("_id of type %s is required for upserts", r.Type)
+	}
+	// The server generates ObjectIDs itself
+	if r.Type == TypeObjectID {
+		return update, false, nil
+	}
+	newID, err := r.newID()
+	if err != nil {
+		return nil, false, err
+	}
+	out := make(bson.D, 0, len(update)+1)
+	var added bool
+	for _, e := range update {
+		if e.Key == "$setOnInsert" {
+			if setOnInsert, ok := e.Value.(bson.D); ok {
+				e.Value = append(bson.D{{"_id", newID}}, setOnInsert...)
+				added = true
+			}
+		}
+		out = append(out, e)
+	}
+	if !added {
+		out = append(out, bson.E{"$setOnInsert", bson.D{{"_id", newID}}})
+	}
+	return out, true, nil
+}
+
+// queryID returns the _id an upsert with the query inserts (from an equality match)
+func queryID(query bson.D) (interface{}, bool) {
+	id, ok := bsonutil.Lookup(query, "_id")
+	if !ok {
+		return nil, false
+	}
+	if ops, isDoc := id.(bson.D); isDoc && len(ops) > 0 && strings.HasPrefix(ops[0].Key, "$") {
+		return bsonutil.Lookup(ops, "$eq")
+	}
+	return id, true
+}
+
+func hasQueryID(query bson.D) bool {
+	_, ok := queryID(query)
+	return ok
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *IDPolicyPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	rule := p.rule(r)
+	if rule == nil {
+		return next(ctx, r)
+	}
+	db, collection := command.GetCommandDatabase(r.Command), command.GetCommandCollection(r.Command)
+
+	var generated int
+	err := func() error {
+		switch cmd := r.Command.(type) {
+		case *command.Insert:
+			for i, doc := range cmd.Documents {
+				doc, gen, err := rule.checkDocument(doc)
+				if err != nil {
+					return fmt.Errorf("document %d: %w", i, err)
+				}
+				if gen {
+					r.SetDocument(i, doc)
+					generated++
+				}
+			}
+		case *command.Update:
+			for i, u := range cmd.Updates {
+				if !bsonutil.GetBoolDefault(u.Upsert, false) {
+					continue
+				}
+				update, gen, err := rule.checkUpsert(u.Query, u.U)
+				if err != nil {
+					return fmt.Errorf("update %d: %w", i, err)
+				}
+				if gen {
+					r.SetUpdate(i, update)
+					generated++
+				}
+			}
+		case *command.FindAndModify:
+			if !bsonutil.GetBoolDefault(cmd.Upsert, false) {
+				return nil
+			}
+			update, gen, err := rule.checkUpsert(cmd.Query, cmd.Update)
+			if err != nil {
+				return err
+			}
+			if gen {
+				r.SetUpdate(0, update)
+				generated++
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		rejectedTotal.WithLabelValues(db, collection).Inc()
+		logrus.Warningf("ID POLICY ERROR: %s, in db: %s, collection: %s, with cmd: %s", err.Error(), db, collection, r.CommandName)
+		return mongoerror.DocumentValidationFailure.ErrMessage(err.Error()), nil
+	}
+	if generated > 0 {
+		generatedTotal.WithLabelValues(db, collection).Add(float64(generated))
+	}
+
+	return next(ctx, r)
+}
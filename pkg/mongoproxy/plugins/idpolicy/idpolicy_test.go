@@ -0,0 +1,92 @@
+package idpolicy
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func TestIDPolicy(t *testing.T) {
+	d := &IDPolicyPlugin{}
+	if err := d.Configure(bson.D{{"rules", bson.A{
+		bson.D{{"scope", bson.D{{"collections", bson.A{"db.users"}}}}, {"type", "string"}},
+		bson.D{{"scope", bson.D{{"collections", bson.A{"db.events"}}}}, {"type", "uuid"}, {"generate", true}},
+		bson.D{{"scope", bson.D{{"collections", bson.A{"db.orders"}}}}, {"type", "objectID"}, {"generate", true}},
+	}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var last command.Command
+	p := plugins.BuildPipeline([]plugins.Plugin{d}, func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+		last = r.Command
+		return bson.D{{"ok", 1}}, nil
+	})
+
+	uuid := primitive.Binary{Subtype: binaryUUID, Data: make([]byte, 16)}
+	tests := []struct {
+		cmd bson.D
+		ok  bool
+		// check checks the command sent (if ok)
+		check func(command.Command) bool
+	}{
+		{cmd: bson.D{{"insert", "users"}, {"documents", bson.A{bson.D{{"_id", "alice"}}}}, {"$db", "db"}}, ok: true},
+		{cmd: bson.D{{"insert", "users"}, {"documents", bson.A{bson.D{{"_id", "alice"}}, bson.D{{"_id", 1}}}}, {"$db", "db"}}},
+		{cmd: bson.D{{"insert", "users"}, {"documents", bson.A{bson.D{{"name", "alice"}}}}, {"$db", "db"}}},
+		{cmd: bson.D{{"update", "users"}, {"updates", bson.A{
+			bson.D{{"q", bson.D{{"_id", "alice"}}}, {"u", bson.D{{"$set", bson.D{{"a", 1}}}}}, {"upsert", true}},
+		}}, {"$db", "db"}}, ok: true},
+		{cmd: bson.D{{"update", "users"}, {"updates", bson.A{
+			bson.D{{"q", bson.D{{"name", "alice"}}}, {"u", bson.D{{"$set", bson.D{{"a", 1}}}}}, {"upsert", true}},
+		}}, {"$db", "db"}}},
+		// Updates which don't upsert don't insert
+		{cmd: bson.D{{"update", "users"}, {"updates", bson.A{
+			bson.D{{"q", bson.D{{"name", "alice"}}}, {"u", bson.D{{"$set", bson.D{{"a", 1}}}}}},
+		}}, {"$db", "db"}}, ok: true},
+		{cmd: bson.D{{"insert", "events"}, {"documents", bson.A{bson.D{{"_id", uuid}}, bson.D{{"a", 1}}}}, {"$db", "db"}}, ok: true, check: func(c command.Command) bool {
+			id, _ := bsonutil.Lookup(c.(*command.Insert).Documents[1], "_id")
+			b, ok := id.(primitive.Binary)
+			return ok && b.Subtype == binaryUUID && len(b.Data) == 16
+		}},
+		{cmd: bson.D{{"insert", "events"}, {"documents", bson.A{bson.D{{"_id", primitive.NewObjectID()}}}}, {"$db", "db"}}},
+		{cmd: bson.D{{"findAndModify", "events"}, {"query", bson.D{{"a", 1}}}, {"update", bson.D{{"$setOnInsert", bson.D{{"b", 1}}}}}, {"upsert", true}, {"$db", "db"}}, ok: true, check: func(c command.Command) bool {
+			id, _ := bsonutil.Lookup(c.(*command.FindAndModify).Update, "$setOnInsert", "_id")
+			_, ok := id.(primitive.Binary)
+			return ok
+		}},
+		{cmd: bson.D{{"insert", "orders"}, {"documents", bson.A{bson.D{{"a", 1}}}}, {"$db", "db"}}, ok: true, check: func(c command.Command) bool {
+			id, _ := bsonutil.Lookup(c.(*command.Insert).Documents[0], "_id")
+			_, ok := id.(primitive.ObjectID)
+			return ok
+		}},
+		{cmd: bson.D{{"insert", "other"}, {"documents", bson.A{bson.D{{"_id", 1}}}}, {"$db", "db"}}, ok: true},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			cmd, ok := command.GetCommand(test.cmd[0].Key)
+			if !ok {
+				t.Fatalf("no such command: %s", test.cmd[0].Key)
+			}
+			if err := cmd.FromBSOND(test.cmd); err != nil {
+				t.Fatal(err)
+			}
+			result, err := p(context.TODO(), &plugins.Request{CommandName: test.cmd[0].Key, Command: cmd})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok := bsonutil.Ok(result); ok != test.ok {
+				t.Fatalf("expected ok=%v, got %v", test.ok, result)
+			}
+			if test.check != nil && !test.check(last) {
+				t.Fatalf("unexpected command: %v", last)
+			}
+		})
+	}
+}
@@ -0,0 +1,690 @@
+package indexadvisor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "indexadvisor"
+
+var (
+	suggestionsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mongoproxy_plugins_indexadvisor_suggestions",
+		Help: "The number of indexes suggested for a collection in the last analysis",
+	}, []string{"db", "collection"})
+	unusedIndexesGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mongoproxy_plugins_indexadvisor_unused_indexes",
+		Help: "The number of indexes of a collection no query used in the last analysis",
+	}, []string{"db", "collection"})
+	explainsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_indexadvisor_explains_total",
+		Help: "The total sampled queries explained on the backend",
+	}, []string{"result"})
+	planAlertsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_indexadvisor_plan_alerts_total",
+		Help: "The total high-traffic query shapes whose plan has a collection scan or in-memory sort",
+	}, []string{"db", "collection", "stage"})
+)
+
+const (
+	// explainQueueSize is the number of sampled queries waiting to be explained;
+	// further samples are dropped
+	explainQueueSize = 64
+	// explainTimeout is the timeout of an explain on the backend
+	explainTimeout = 10 * time.Second
+)
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &IndexAdvisorPlugin{
+			conf: IndexAdvisorPluginConfig{
+				Interval:     "10m",
+				IndexRefresh: "1h",
+				MinQueries:   100,
+				MaxShapes:    100,
+			},
+		}
+	})
+}
+
+type IndexAdvisorPluginConfig struct {
+	// Interval is how often the queries observed (since the last analysis) are
+	// analyzed (default "10m")
+	Interval string `bson:"interval"`
+	interval time.Duration
+	// IndexRefresh is how long the indexes of a collection (from listIndexes on the
+	// backend) are cached (default "1h")
+	IndexRefresh string `bson:"indexRefresh"`
+	indexRefresh time.Duration
+	// MinQueries is the number of queries of a shape in an interval needed to suggest
+	// an index for it, and of a collection to report its unused indexes (default 100)
+	MinQueries int64 `bson:"minQueries"`
+	// MaxShapes caps the query shapes tracked per collection in an interval (default 100)
+	MaxShapes int `bson:"maxShapes"`
+	// ExplainSampleRate is the fraction of reads sampled to be explained on the
+	// backend (asynchronously, and at most once per shape each interval); shapes with
+	// at least MinQueries queries whose plan has a COLLSCAN or in-memory SORT are
+	// alerted on (default 0; off)
+	ExplainSampleRate float64 `bson:"explainSampleRate"`
+	// WarmUpNamespaces are the collections ("db.collection") whose indexes are
+	// listed during the proxy's warm-up rather than at the first analysis
+	WarmUpNamespaces []string `bson:"warmUpNamespaces"`
+	warmUpNamespaces []namespace
+}
+
+// namespace is a collection
+type namespace struct {
+	db, collection string
+}
+
+// collectionStats are the query shapes observed on a collection
+type collectionStats struct {
+	queries int64
+	shapes  map[string]*shapeStats
+	// dropped is the number of queries whose shapes weren't tracked (see MaxShapes)
+	dropped int64
+}
+
+type shapeStats struct {
+	shape   *shape
+	queries int64
+}
+
+// explainJob is a sampled query to explain
+type explainJob struct {
+	ns  namespace
+	key string
+	cmd bson.D
+}
+
+// indexes are the (cached) indexes of a collection
+type indexes struct {
+	keys    map[string]bson.D
+	fetched time.Time
+}
+
+// Suggestion is an index suggested for queries not served well by the existing ones
+type Suggestion struct {
+	Index   string `json:"index"`
+	Queries int64  `json:"queries"`
+}
+
+// PlanAlert is a query shape whose plan scans the collection or sorts in memory
+type PlanAlert struct {
+	Shape   string   `json:"shape"`
+	Queries int64    `json:"queries"`
+	Stages  []string `json:"stages"`
+}
+
+// Report is the result of analyzing the queries observed on a collection
+type Report struct {
+	Database   string    `json:"database"`
+	Collection string    `json:"collection"`
+	Time       time.Time `json:"time"`
+	Queries    int64     `json:"queries"`
+	// Untracked is the number of queries whose shapes weren't tracked (see MaxShapes)
+	Untracked     int64        `json:"untracked,omitempty"`
+	Suggestions   []Suggestion `json:"suggestions,omitempty"`
+	UnusedIndexes []string     `json:"unusedIndexes,omitempty"`
+	PlanAlerts    []PlanAlert  `json:"planAlerts,omitempty"`
+}
+
+// This is a plugin that suggests indexes based on the queries it sees
+type IndexAdvisorPlugin struct {
+	conf IndexAdvisorPluginConfig
+
+	l     sync.Mutex
+	stats map[namespace]*collectionStats
+	// explained are the shapes sampled to be explained this interval
+	explained map[namespace]map[string]struct{}
+	// plans are the problematic stages of the plans of the explained shapes
+	plans map[namespace]map[string][]string
+
+	explains chan *explainJob
+
+	crLock sync.RWMutex
+	cr     plugins.CommandRunner
+
+	// indexes is only accessed by the analysis (and the warm-up)
+	indexesLock sync.Mutex
+	indexes     map[namespace]*indexes
+
+	reportsLock sync.RWMutex
+	reports     []*Report
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (p *IndexAdvisorPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *IndexAdvisorPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	if p.conf.interval, err = time.ParseDuration(p.conf.Interval); err != nil {
+		return err
+	}
+	if p.conf.interval <= 0 {
+		return fmt.Errorf("interval must be positive: %s", p.conf.Interval)
+	}
+	if p.conf.indexRefresh, err = time.ParseDuration(p.conf.IndexRefresh); err != nil {
+		return err
+	}
+	if p.conf.MaxShapes <= 0 {
+		return fmt.Errorf("maxShapes must be positive: %d", p.conf.MaxShapes)
+	}
+	if p.conf.ExplainSampleRate < 0 || p.conf.ExplainSampleRate > 1 {
+		return fmt.Errorf("explainSampleRate must be between 0 and 1: %v", p.conf.ExplainSampleRate)
+	}
+	p.conf.warmUpNamespaces = make([]namespace, len(p.conf.WarmUpNamespaces))
+	for i, ns := range p.conf.WarmUpNamespaces {
+		parts := strings.SplitN(ns, ".", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("invalid warmUpNamespaces %q; must be db.collection", ns)
+		}
+		p.conf.warmUpNamespaces[i] = namespace{parts[0], parts[1]}
+	}
+
+	p.stats = make(map[namespace]*collectionStats)
+	p.explained = make(map[namespace]map[string]struct{})
+	p.plans = make(map[namespace]map[string][]string)
+	p.indexes = make(map[namespace]*indexes)
+	p.explains = make(chan *explainJob, explainQueueSize)
+
+	return nil
+}
+
+// SetCommandRunner sets the runner used to list the backend's indexes (and explain
+// sampled queries)
+func (p *IndexAdvisorPlugin) SetCommandRunner(cr plugins.CommandRunner) {
+	p.crLock.Lock()
+	defer p.crLock.Unlock()
+	p.cr = cr
+}
+
+func (p *IndexAdvisorPlugin) commandRunner() plugins.CommandRunner {
+	p.crLock.RLock()
+	defer p.crLock.RUnlock()
+	return p.cr
+}
+
+// Start starts analyzing the observed queries every interval (and explaining the
+// sampled ones)
+func (p *IndexAdvisorPlugin) Start(ctx context.Context) error {
+	p.stop = make(chan struct{})
+
+	p.wg.Add(2)
+	go func() {
+		defer p.wg.Done()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case job := <-p.explains:
+				ctx, cancel := context.WithTimeout(context.Background(), explainTimeout)
+				p.explain(ctx, job)
+				cancel()
+			}
+		}
+	}()
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(p.conf.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), p.conf.interval)
+				p.analyze(ctx, time.Now())
+				cancel()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops the analysis
+func (p *IndexAdvisorPlugin) Stop(ctx context.Context) error {
+	if p.stop == nil {
+		return nil
+	}
+	close(p.stop)
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// observe records the shape of a query on the collection; reads (with explain
+// set) are sampled to be explained
+func (p *IndexAdvisorPlugin) observe(r *plugins.Request, db, collection string, filter, sortSpec bson.D, explain bool) {
+	s := newShape(filter, sortSpec)
+	if s == nil {
+		return
+	}
+	key := s.String()
+	ns := namespace{db, collection}
+
+	if explain && p.conf.ExplainSampleRate > 0 && rand.Float64() < p.conf.ExplainSampleRate && p.sample(ns, key) {
+		p.enqueueExplain(r, ns, key)
+	}
+
+	p.l.Lock()
+	defer p.l.Unlock()
+	c, ok := p.stats[ns]
+	if !ok {
+		c = &collectionStats{shapes: make(map[string]*shapeStats)}
+		p.stats[ns] = c
+	}
+	c.queries++
+	ss, ok := c.shapes[key]
+	if !ok {
+		if len(c.shapes) >= p.conf.MaxShapes {
+			c.dropped++
+			return
+		}
+		ss = &shapeStats{shape: s}
+		c.shapes[key] = ss
+	}
+	ss.queries++
+}
+
+// sample returns whether the shape should be explained (it hasn't been this interval)
+func (p *IndexAdvisorPlugin) sample(ns namespace, key string) bool {
+	p.l.Lock()
+	defer p.l.Unlock()
+	explained, ok := p.explained[ns]
+	if !ok {
+		explained = make(map[string]struct{})
+		p.explained[ns] = explained
+	}
+	if _, ok := explained[key]; ok {
+		return false
+	}
+	explained[key] = struct{}{}
+	return true
+}
+
+// enqueueExplain queues the request's command to be explained, dropping it if the
+// queue is full
+func (p *IndexAdvisorPlugin) enqueueExplain(r *plugins.Request, ns namespace, key string) {
+	d, err := r.Document()
+	if err != nil {
+		return
+	}
+	// Drop the generic fields ($db, $readPreference, session, ...) which aren't part
+	// of the explained command
+	cmd := make(bson.D, 0, len(d))
+	for _, e := range d {
+		switch {
+		case strings.HasPrefix(e.Key, "$"), e.Key == "lsid", e.Key == "txnNumber", e.Key == "stmtIds":
+		default:
+			cmd = append(cmd, e)
+		}
+	}
+
+	select {
+	case p.explains <- &explainJob{ns: ns, key: key, cmd: cmd}:
+	default:
+		explainsTotal.WithLabelValues("dropped").Inc()
+	}
+}
+
+// explain runs explain for the sampled query on the backend and records the
+// problematic stages of its plan
+func (p *IndexAdvisorPlugin) explain(ctx context.Context, job *explainJob) {
+	cr := p.commandRunner()
+	if cr == nil {
+		explainsTotal.WithLabelValues("error").Inc()
+		return
+	}
+	result, err := cr.RunCommand(ctx, job.ns.db, bson.D{{"explain", job.cmd}, {"verbosity", "queryPlanner"}})
+	if err != nil {
+		explainsTotal.WithLabelValues("error").Inc()
+		logrus.Debugf("Error explaining query on %s.%s: %v", job.ns.db, job.ns.collection, err)
+		return
+	}
+	explainsTotal.WithLabelValues("ok").Inc()
+
+	found := make(map[string]struct{})
+	planStages(result, false, found)
+	stages := make([]string, 0, len(found))
+	for stage := range found {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+
+	p.l.Lock()
+	defer p.l.Unlock()
+	plans, ok := p.plans[job.ns]
+	if !ok {
+		plans = make(map[string][]string)
+		p.plans[job.ns] = plans
+	}
+	plans[job.key] = stages
+}
+
+// alertStages are the plan stages which are alerted on
+var alertStages = map[string]struct{}{
+	"COLLSCAN": {},
+	// A blocking (in-memory) sort
+	"SORT": {},
+}
+
+// planStages adds the alerted stages in the winning plans of the explain output to found
+func planStages(v interface{}, inPlan bool, found map[string]struct{}) {
+	switch vTyped := v.(type) {
+	case bson.D:
+		for _, e := range vTyped {
+			if stage, ok := e.Value.(string); ok && inPlan && e.Key == "stage" {
+				if _, ok := alertStages[stage]; ok {
+					found[stage] = struct{}{}
+				}
+			}
+			planStages(e.Value, inPlan || e.Key == "winningPlan", found)
+		}
+	case primitive.A:
+		for _, item := range vTyped {
+			planStages(item, inPlan, found)
+		}
+	}
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *IndexAdvisorPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	switch cmd := r.Command.(type) {
+	case *command.Find:
+		p.observe(r, cmd.Database, cmd.Collection, cmd.Filter, cmd.Sort, true)
+	case *command.Count:
+		p.observe(r, cmd.Database, cmd.Collection, cmd.Query, nil, true)
+	case *command.Distinct:
+		p.observe(r, cmd.Database, cmd.Collection, cmd.Query, nil, true)
+	case *command.Aggregate:
+		if filter, sortSpec := leadingMatch(cmd.Pipeline); filter != nil || sortSpec != nil {
+			p.observe(r, cmd.Database, cmd.GetCollection(), filter, sortSpec, true)
+		}
+	case *command.FindAndModify:
+		p.observe(r, cmd.Database, cmd.Collection, cmd.Query, cmd.Sort, false)
+	case *command.Update:
+		for _, u := range cmd.Updates {
+			p.observe(r, cmd.Database, cmd.Collection, u.Query, nil, false)
+		}
+	case *command.Delete:
+		for _, d := range cmd.Deletes {
+			q, _ := bsonutil.Lookup(d, "q")
+			filter, _ := q.(bson.D)
+			p.observe(r, cmd.Database, cmd.Collection, filter, nil, false)
+		}
+	}
+
+	return next(ctx, r)
+}
+
+// leadingMatch returns the filter and sort of the leading $match and $sort stages
+// of the pipeline (which can use indexes)
+func leadingMatch(pipeline primitive.A) (filter, sortSpec bson.D) {
+	for _, raw := range pipeline {
+		stage, ok := raw.(bson.D)
+		if !ok || len(stage) != 1 {
+			break
+		}
+		spec, _ := stage[0].Value.(bson.D)
+		switch {
+		case stage[0].Key == "$match" && filter == nil && sortSpec == nil:
+			filter = spec
+			continue
+		case stage[0].Key == "$sort" && sortSpec == nil:
+			sortSpec = spec
+			continue
+		}
+		break
+	}
+	return filter, sortSpec
+}
+
+// getIndexes returns the indexes of the collection, listing them on the backend if
+// they aren't cached (or are stale)
+func (p *IndexAdvisorPlugin) getIndexes(ctx context.Context, ns namespace, now time.Time) (map[string]bson.D, error) {
+	p.indexesLock.Lock()
+	idx, ok := p.indexes[ns]
+	p.indexesLock.Unlock()
+	if ok && now.Sub(idx.fetched) < p.conf.indexRefresh {
+		return idx.keys, nil
+	}
+
+	cr := p.commandRunner()
+	if cr == nil {
+		return nil, fmt.Errorf("no plugin in the chain can run commands on the backend")
+	}
+	result, err := cr.RunCommand(ctx, ns.db, bson.D{{"listIndexes", ns.collection}})
+	if err != nil {
+		return nil, err
+	}
+	batch, _ := bsonutil.Lookup(result, "cursor", "firstBatch")
+	items, _ := batch.(primitive.A)
+
+	keys := make(map[string]bson.D, len(items))
+	for _, item := range items {
+		spec, ok := item.(bson.D)
+		if !ok {
+			continue
+		}
+		name, _ := bsonutil.Lookup(spec, "name")
+		key, _ := bsonutil.Lookup(spec, "key")
+		nameStr, _ := name.(string)
+		keyD, _ := key.(bson.D)
+		keys[nameStr] = keyD
+	}
+	p.indexesLock.Lock()
+	p.indexes[ns] = &indexes{keys: keys, fetched: now}
+	p.indexesLock.Unlock()
+	return keys, nil
+}
+
+// WarmUp lists the indexes of the warmUpNamespaces
+func (p *IndexAdvisorPlugin) WarmUp(ctx context.Context) error {
+	now := time.Now()
+	for _, ns := range p.conf.warmUpNamespaces {
+		if _, err := p.getIndexes(ctx, ns, now); err != nil {
+			return fmt.Errorf("error listing indexes of %s.%s: %w", ns.db, ns.collection, err)
+		}
+	}
+	return nil
+}
+
+// analyze reports index suggestions (and unused indexes) for the collections
+// with queries observed since the last analysis
+func (p *IndexAdvisorPlugin) analyze(ctx context.Context, now time.Time) {
+	p.l.Lock()
+	stats := p.stats
+	p.stats = make(map[namespace]*collectionStats, len(stats))
+	p.explained = make(map[namespace]map[string]struct{}, len(p.explained))
+	// Forget the plans of collections no longer queried
+	plans := make(map[namespace]map[string][]string, len(stats))
+	for ns, nsPlans := range p.plans {
+		if _, ok := stats[ns]; ok {
+			plans[ns] = nsPlans
+		}
+	}
+	p.plans = plans
+	p.l.Unlock()
+
+	reports := make([]*Report, 0, len(stats))
+	for ns, c := range stats {
+		keys, err := p.getIndexes(ctx, ns, now)
+		if err != nil {
+			logrus.Errorf("Error listing indexes of %s.%s: %v", ns.db, ns.collection, err)
+			continue
+		}
+		report := p.report(ns, c, keys, now)
+		p.l.Lock()
+		report.PlanAlerts = p.planAlerts(c, p.plans[ns])
+		p.l.Unlock()
+		reports = append(reports, report)
+	}
+	// Forget the indexes of collections no longer queried
+	p.indexesLock.Lock()
+	for ns := range p.indexes {
+		if _, ok := stats[ns]; !ok {
+			delete(p.indexes, ns)
+		}
+	}
+	p.indexesLock.Unlock()
+
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Database != reports[j].Database {
+			return reports[i].Database < reports[j].Database
+		}
+		return reports[i].Collection < reports[j].Collection
+	})
+
+	suggestionsGauge.Reset()
+	unusedIndexesGauge.Reset()
+	for _, report := range reports {
+		suggestionsGauge.WithLabelValues(report.Database, report.Collection).Set(float64(len(report.Suggestions)))
+		unusedIndexesGauge.WithLabelValues(report.Database, report.Collection).Set(float64(len(report.UnusedIndexes)))
+		for _, s := range report.Suggestions {
+			logrus.Infof("INDEX SUGGESTION: %s on %s.%s for %d queries", s.Index, report.Database, report.Collection, s.Queries)
+		}
+		if len(report.UnusedIndexes) > 0 {
+			logrus.Infof("UNUSED INDEXES: %v on %s.%s (over %d queries)", report.UnusedIndexes, report.Database, report.Collection, report.Queries)
+		}
+		for _, a := range report.PlanAlerts {
+			for _, stage := range a.Stages {
+				planAlertsTotal.WithLabelValues(report.Database, report.Collection, stage).Inc()
+			}
+			logrus.Warningf("QUERY PLAN ALERT: %v for %s on %s.%s with %d queries", a.Stages, a.Shape, report.Database, report.Collection, a.Queries)
+		}
+	}
+
+	p.reportsLock.Lock()
+	p.reports = reports
+	p.reportsLock.Unlock()
+}
+
+// report correlates the shapes observed on the collection with its indexes
+func (p *IndexAdvisorPlugin) report(ns namespace, c *collectionStats, keys map[string]bson.D, now time.Time) *Report {
+	report := &Report{
+		Database:   ns.db,
+		Collection: ns.collection,
+		Time:       now,
+		Queries:    c.queries,
+		Untracked:  c.dropped,
+	}
+
+	used := make(map[string]struct{}, len(keys))
+	for index, ss := range c.shapes {
+		covered := false
+		for name, key := range keys {
+			if ss.shape.uses(key) {
+				used[name] = struct{}{}
+			}
+			if ss.shape.coveredBy(key) {
+				covered = true
+			}
+		}
+		if !covered && ss.queries >= p.conf.MinQueries {
+			report.Suggestions = append(report.Suggestions, Suggestion{Index: index, Queries: ss.queries})
+		}
+	}
+	sort.Slice(report.Suggestions, func(i, j int) bool {
+		if report.Suggestions[i].Queries != report.Suggestions[j].Queries {
+			return report.Suggestions[i].Queries > report.Suggestions[j].Queries
+		}
+		return report.Suggestions[i].Index < report.Suggestions[j].Index
+	})
+
+	// Only report unused indexes if the collection saw enough queries (all of
+	// which were tracked) for it to mean something
+	if c.queries >= p.conf.MinQueries && c.dropped == 0 {
+		for name := range keys {
+			if _, ok := used[name]; !ok && name != "_id_" {
+				report.UnusedIndexes = append(report.UnusedIndexes, name)
+			}
+		}
+		sort.Strings(report.UnusedIndexes)
+	}
+	return report
+}
+
+// planAlerts returns the shapes with at least MinQueries queries whose plans have
+// alerted stages
+func (p *IndexAdvisorPlugin) planAlerts(c *collectionStats, plans map[string][]string) []PlanAlert {
+	var alerts []PlanAlert
+	for key, ss := range c.shapes {
+		if stages := plans[key]; len(stages) > 0 && ss.queries >= p.conf.MinQueries {
+			alerts = append(alerts, PlanAlert{Shape: key, Queries: ss.queries, Stages: stages})
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].Queries != alerts[j].Queries {
+			return alerts[i].Queries > alerts[j].Queries
+		}
+		return alerts[i].Shape < alerts[j].Shape
+	})
+	return alerts
+}
+
+// Reports returns the reports of the last analysis
+func (p *IndexAdvisorPlugin) Reports() []*Report {
+	p.reportsLock.RLock()
+	defer p.reportsLock.RUnlock()
+	return p.reports
+}
+
+// AdminHandler returns the handler for the indexadvisor admin endpoints:
+//
+//	GET reports?database=x&collection=y   reports of the last analysis (optionally filtered)
+func (p *IndexAdvisorPlugin) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reports", func(w http.ResponseWriter, r *http.Request) {
+		database, collection := r.URL.Query().Get("database"), r.URL.Query().Get("collection")
+		reports := make([]*Report, 0)
+		for _, report := range p.Reports() {
+			if (database == "" || report.Database == database) && (collection == "" || report.Collection == collection) {
+				reports = append(reports, report)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reports)
+	})
+	return mux
+}
@@ -0,0 +1,198 @@
+package indexadvisor
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func TestShape(t *testing.T) {
+	tests := []struct {
+		filter, sort bson.D
+		key          string
+		covered      []bson.D
+		notCovered   []bson.D
+	}{
+		{
+			filter:     bson.D{{"a", 1}, {"c", bson.D{{"$gt", 1}}}, {"b", bson.D{{"$in", bson.A{1, 2}}}}},
+			sort:       bson.D{{"d", -1}},
+			key:        "{a: 1, b: 1, d: -1, c: 1}",
+			covered:    []bson.D{{{"b", 1}, {"a", 1}, {"d", -1}}, {{"a", 1}, {"b", 1}, {"d", 1}, {"c", 1}}},
+			notCovered: []bson.D{{{"a", 1}, {"d", -1}}, {{"a", 1}, {"b", 1}, {"c", 1}, {"d", -1}}},
+		},
+		{
+			filter:     bson.D{{"$and", bson.A{bson.D{{"a", 1}}, bson.D{{"b", 1}}}}, {"$or", bson.A{bson.D{{"x", 1}}}}},
+			key:        "{a: 1, b: 1}",
+			covered:    []bson.D{{{"a", 1}, {"b", 1}, {"z", 1}}},
+			notCovered: []bson.D{{{"a", 1}, {"z", 1}, {"b", 1}}},
+		},
+		{
+			filter:     bson.D{{"a", bson.D{{"$exists", true}}}},
+			sort:       bson.D{{"b", 1}, {"c", -1}},
+			key:        "{b: 1, c: -1, a: 1}",
+			covered:    []bson.D{{{"b", -1}, {"c", 1}}},
+			notCovered: []bson.D{{{"b", 1}, {"c", 1}}, {{"a", 1}}},
+		},
+		{
+			filter:     bson.D{{"a", bson.D{{"$gt", 1}}}},
+			key:        "{a: 1}",
+			covered:    []bson.D{{{"a", 1}, {"b", 1}}},
+			notCovered: []bson.D{{{"b", 1}, {"a", 1}}},
+		},
+		// _id is always indexed
+		{filter: bson.D{{"_id", 1}, {"a", 1}}},
+		{filter: bson.D{}},
+	}
+
+	for _, test := range tests {
+		s := newShape(test.filter, test.sort)
+		if test.key == "" {
+			if s != nil {
+				t.Errorf("%v: expected no shape, got %s", test.filter, s)
+			}
+			continue
+		}
+		if s == nil || s.String() != test.key {
+			t.Errorf("%v: expected %s, got %v", test.filter, test.key, s)
+			continue
+		}
+		for _, key := range test.covered {
+			if !s.coveredBy(key) {
+				t.Errorf("%s: expected to be covered by %s", s, formatKey(key))
+			}
+		}
+		for _, key := range test.notCovered {
+			if s.coveredBy(key) {
+				t.Errorf("%s: expected not to be covered by %s", s, formatKey(key))
+			}
+		}
+	}
+}
+
+type listIndexesRunner map[string]bson.A
+
+func (r listIndexesRunner) RunCommand(ctx context.Context, db string, cmd bson.D) (bson.D, error) {
+	if cmd[0].Key == "explain" {
+		// Queries sorting by age scan the collection and sort in memory
+		explained := cmd[0].Value.(bson.D)
+		if _, ok := explained.Map()["sort"]; ok {
+			return bson.D{{"queryPlanner", bson.D{{"winningPlan", bson.D{
+				{"stage", "SORT"},
+				{"inputStage", bson.D{{"stage", "COLLSCAN"}}},
+			}}}}, {"ok", 1}}, nil
+		}
+		return bson.D{{"queryPlanner", bson.D{{"winningPlan", bson.D{
+			{"stage", "FETCH"},
+			{"inputStage", bson.D{{"stage", "IXSCAN"}}},
+		}}}}, {"ok", 1}}, nil
+	}
+	return bson.D{{"cursor", bson.D{{"firstBatch", r[db+"."+cmd[0].Value.(string)]}}}, {"ok", 1}}, nil
+}
+
+func TestAnalyze(t *testing.T) {
+	p := &IndexAdvisorPlugin{}
+	if err := p.Configure(bson.D{{"interval", "1m"}, {"indexRefresh", "1h"}, {"minQueries", 2}, {"maxShapes", 10}, {"explainSampleRate", 1.0}}); err != nil {
+		t.Fatal(err)
+	}
+	plugins.SetCommandRunners([]plugins.Plugin{p, &struct {
+		plugins.Plugin
+		listIndexesRunner
+	}{p, listIndexesRunner{
+		"db.users": bson.A{
+			bson.D{{"v", 2}, {"key", bson.D{{"_id", 1}}}, {"name", "_id_"}},
+			bson.D{{"v", 2}, {"key", bson.D{{"email", 1}}}, {"name", "email_1"}},
+			bson.D{{"v", 2}, {"key", bson.D{{"legacy", 1}}}, {"name", "legacy_1"}},
+		},
+	}}})
+
+	pipe := plugins.BuildPipeline([]plugins.Plugin{p}, func(context.Context, *plugins.Request) (bson.D, error) {
+		return bson.D{{"ok", 1}}, nil
+	})
+	cmds := []bson.D{
+		{{"find", "users"}, {"filter", bson.D{{"email", "a@b.c"}}}, {"$db", "db"}},
+		{{"find", "users"}, {"filter", bson.D{{"email", "d@e.f"}}}, {"$db", "db"}},
+		{{"find", "users"}, {"filter", bson.D{{"country", "us"}}}, {"sort", bson.D{{"age", -1}}}, {"$db", "db"}},
+		{{"aggregate", "users"}, {"pipeline", bson.A{
+			bson.D{{"$match", bson.D{{"country", "ca"}}}},
+			bson.D{{"$sort", bson.D{{"age", -1}}}},
+		}}, {"cursor", bson.D{}}, {"$db", "db"}},
+		// Only seen once
+		{{"count", "users"}, {"query", bson.D{{"name", "x"}}}, {"$db", "db"}},
+	}
+	for _, d := range cmds {
+		cmd, _ := command.GetCommand(d[0].Key)
+		if err := cmd.FromBSOND(d); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pipe(context.TODO(), &plugins.Request{CommandName: d[0].Key, Command: cmd}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each shape is explained once
+	if len(p.explains) != 3 {
+		t.Fatalf("expected 3 explains, got %d", len(p.explains))
+	}
+	for len(p.explains) > 0 {
+		p.explain(context.TODO(), <-p.explains)
+	}
+
+	p.analyze(context.TODO(), time.Now())
+	reports := p.Reports()
+	if len(reports) != 1 {
+		t.Fatalf("expected 1 report, got %v", reports)
+	}
+	r := reports[0]
+	if r.Queries != 5 {
+		t.Errorf("expected 5 queries, got %d", r.Queries)
+	}
+	if expected := []Suggestion{{"{country: 1, age: -1}", 2}}; !reflect.DeepEqual(r.Suggestions, expected) {
+		t.Errorf("expected suggestions %v, got %v", expected, r.Suggestions)
+	}
+	if expected := []string{"legacy_1"}; !reflect.DeepEqual(r.UnusedIndexes, expected) {
+		t.Errorf("expected unused indexes %v, got %v", expected, r.UnusedIndexes)
+	}
+	if expected := []PlanAlert{{"{country: 1, age: -1}", 2, []string{"COLLSCAN", "SORT"}}}; !reflect.DeepEqual(r.PlanAlerts, expected) {
+		t.Errorf("expected plan alerts %v, got %v", expected, r.PlanAlerts)
+	}
+
+	// The observed queries are reset after an analysis
+	p.analyze(context.TODO(), time.Now())
+	if reports := p.Reports(); len(reports) != 0 {
+		t.Fatalf("expected no reports, got %v", reports)
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	p := &IndexAdvisorPlugin{}
+	if err := p.Configure(bson.D{{"interval", "1m"}, {"indexRefresh", "1h"}, {"minQueries", 2}, {"maxShapes", 10}, {"warmUpNamespaces", bson.A{"db.users"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WarmUp(context.TODO()); err == nil {
+		t.Fatalf("expected an error without a command runner")
+	}
+	plugins.SetCommandRunners([]plugins.Plugin{p, &struct {
+		plugins.Plugin
+		listIndexesRunner
+	}{p, listIndexesRunner{
+		"db.users": bson.A{
+			bson.D{{"v", 2}, {"key", bson.D{{"_id", 1}}}, {"name", "_id_"}},
+		},
+	}}})
+	if err := p.WarmUp(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if idx, ok := p.indexes[namespace{"db", "users"}]; !ok || len(idx.keys) != 1 {
+		t.Fatalf("expected the indexes of db.users to be cached, got %v", p.indexes)
+	}
+
+	if err := p.Configure(bson.D{{"interval", "1m"}, {"indexRefresh", "1h"}, {"minQueries", 2}, {"maxShapes", 10}, {"warmUpNamespaces", bson.A{"users"}}}); err == nil {
+		t.Fatalf("expected an error for a namespace without a database")
+	}
+}
@@ -0,0 +1,228 @@
+package indexadvisor
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// shape is the shape of a query: the fields it matches by equality, sorts by and
+// matches by range (or other operators), ignoring the values
+type shape struct {
+	eq   []string
+	sort bson.D
+	rng  []string
+}
+
+// newShape returns the shape of a query with the filter and sort, or nil if it has
+// no fields an index would help with (or matches _id, which is always indexed)
+func newShape(filter, sortSpec bson.D) *shape {
+	eq := make(map[string]struct{})
+	rng := make(map[string]struct{})
+	addFilter(filter, eq, rng)
+	if _, ok := eq["_id"]; ok {
+		return nil
+	}
+
+	s := &shape{}
+	for _, e := range sortSpec {
+		dir, ok := direction(e.Value)
+		if !ok || strings.HasPrefix(e.Key, "$") {
+			// Sorts by $natural or text score can't use an index
+			s.sort = nil
+			break
+		}
+		if _, ok := eq[e.Key]; !ok {
+			s.sort = append(s.sort, bson.E{e.Key, dir})
+		}
+	}
+	for field := range eq {
+		s.eq = append(s.eq, field)
+		delete(rng, field)
+	}
+	for _, e := range s.sort {
+		delete(rng, e.Key)
+	}
+	for field := range rng {
+		s.rng = append(s.rng, field)
+	}
+	if len(s.eq) == 0 && len(s.sort) == 0 && len(s.rng) == 0 {
+		return nil
+	}
+	sort.Strings(s.eq)
+	sort.Strings(s.rng)
+	return s
+}
+
+// addFilter adds the fields of the filter to eq (equality matches) or rng (any
+// other condition). Fields under $or and $nor are skipped as each branch would need
+// its own index.
+func addFilter(filter bson.D, eq, rng map[string]struct{}) {
+	for _, e := range filter {
+		if e.Key == "$and" {
+			items, _ := e.Value.(primitive.A)
+			for _, item := range items {
+				if sub, ok := item.(bson.D); ok {
+					addFilter(sub, eq, rng)
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(e.Key, "$") {
+			continue
+		}
+
+		switch v := e.Value.(type) {
+		case bson.D:
+			if len(v) > 0 && strings.HasPrefix(v[0].Key, "$") {
+				for _, op := range v {
+					switch op.Key {
+					case "$eq", "$in":
+						eq[e.Key] = struct{}{}
+					case "$options", "$comment":
+					default:
+						rng[e.Key] = struct{}{}
+					}
+				}
+				continue
+			}
+		case primitive.Regex:
+			rng[e.Key] = struct{}{}
+			continue
+		}
+		eq[e.Key] = struct{}{}
+	}
+}
+
+// direction returns the direction (1 or -1) of a sort or index key value
+func direction(v interface{}) (int32, bool) {
+	var f float64
+	switch vTyped := v.(type) {
+	case int32:
+		f = float64(vTyped)
+	case int64:
+		f = float64(vTyped)
+	case int:
+		f = float64(vTyped)
+	case float64:
+		f = vTyped
+	default:
+		return 0, false
+	}
+	if f < 0 {
+		return -1, true
+	}
+	return 1, true
+}
+
+// key returns the index suggested for the shape: equality fields, then sort
+// fields, then range fields (the "ESR" rule)
+func (s *shape) key() bson.D {
+	key := make(bson.D, 0, len(s.eq)+len(s.sort)+len(s.rng))
+	for _, field := range s.eq {
+		key = append(key, bson.E{field, int32(1)})
+	}
+	key = append(key, s.sort...)
+	for _, field := range s.rng {
+		key = append(key, bson.E{field, int32(1)})
+	}
+	return key
+}
+
+// String returns the suggested index of the shape (which identifies the shape)
+func (s *shape) String() string {
+	return formatKey(s.key())
+}
+
+// formatKey formats an index key as in the mongo shell (e.g. "{a: 1, b: -1}")
+func formatKey(key bson.D) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, e := range key {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(e.Key)
+		b.WriteString(": ")
+		if dir, ok := direction(e.Value); ok {
+			b.WriteString(strconv.Itoa(int(dir)))
+		} else {
+			fmt.Fprintf(&b, "%q", fmt.Sprint(e.Value))
+		}
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// coveredBy returns whether an index with the key serves the shape well: its
+// leading fields are the shape's equality fields (in any order) followed by its
+// sort fields (in order, all in the same or all in the reverse direction). An
+// index for a shape with only range conditions must start with one of them.
+func (s *shape) coveredBy(key bson.D) bool {
+	if len(key) == 0 || len(key) < len(s.eq)+len(s.sort) {
+		return false
+	}
+	eq := make(map[string]struct{}, len(s.eq))
+	for _, field := range s.eq {
+		eq[field] = struct{}{}
+	}
+	for _, e := range key[:len(s.eq)] {
+		if _, ok := eq[e.Key]; !ok {
+			return false
+		}
+	}
+
+	var reversed bool
+	for i, e := range s.sort {
+		k := key[len(s.eq)+i]
+		dir, ok := direction(k.Value)
+		if !ok || k.Key != e.Key {
+			return false
+		}
+		same := dir == e.Value.(int32)
+		if i == 0 {
+			reversed = !same
+		} else if same == reversed {
+			return false
+		}
+	}
+
+	if len(s.eq) == 0 && len(s.sort) == 0 {
+		for _, field := range s.rng {
+			if key[0].Key == field {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// uses returns whether the shape could use an index with the key (its first field
+// is one of the shape's fields)
+func (s *shape) uses(key bson.D) bool {
+	if len(key) == 0 {
+		return false
+	}
+	first := key[0].Key
+	for _, field := range s.eq {
+		if field == first {
+			return true
+		}
+	}
+	for _, e := range s.sort {
+		if e.Key == first {
+			return true
+		}
+	}
+	for _, field := range s.rng {
+		if field == first {
+			return true
+		}
+	}
+	return false
+}
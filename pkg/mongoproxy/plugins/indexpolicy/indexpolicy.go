@@ -0,0 +1,368 @@
+package indexpolicy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "indexpolicy"
+
+var (
+	rejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_indexpolicy_rejected_total",
+		Help: "The total createIndexes rejected by the index policy",
+	}, []string{"db", "collection", "rule"})
+	buildsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_indexpolicy_builds_total",
+		Help: "The total createIndexes accepted by the index policy",
+	}, []string{"db", "collection", "result"})
+)
+
+// Rules of the policy (the label of rejections)
+const (
+	RuleBackground      = "background"
+	RuleHidden          = "hidden"
+	RuleMaxIndexes      = "maxIndexes"
+	RuleLargeCollection = "largeCollection"
+)
+
+var weekdays = map[string]time.Weekday{
+	"Sun": time.Sunday,
+	"Mon": time.Monday,
+	"Tue": time.Tuesday,
+	"Wed": time.Wednesday,
+	"Thu": time.Thursday,
+	"Fri": time.Friday,
+	"Sat": time.Saturday,
+}
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &IndexPolicyPlugin{
+			conf: IndexPolicyPluginConfig{},
+			now:  time.Now,
+		}
+	})
+}
+
+type IndexPolicyPluginConfig struct {
+	// RequireBackground requires indexes to be built with background: true
+	RequireBackground bool `bson:"requireBackground"`
+	// RequireHidden requires indexes to be created with hidden: true (so they can be
+	// checked before the planner uses them)
+	RequireHidden bool `bson:"requireHidden"`
+	// MaxIndexes caps the indexes per collection, including _id (default 0; unlimited)
+	MaxIndexes int `bson:"maxIndexes"`
+	// LargeCollectionDocuments is the number of documents from which non-partial
+	// indexes are rejected during BusinessHours (default 0; disabled)
+	LargeCollectionDocuments int64 `bson:"largeCollectionDocuments"`
+	// BusinessHours are the hours non-partial indexes on large collections are
+	// rejected in (default: always)
+	BusinessHours *BusinessHours `bson:"businessHours"`
+}
+
+// BusinessHours is a daily time window
+type BusinessHours struct {
+	// Days are the days of the week ("Mon", "Tue", ...; default Mon to Fri)
+	Days []string `bson:"days"`
+	// Start and End are the times of day ("15:04") the window starts and ends
+	Start string `bson:"start"`
+	End   string `bson:"end"`
+	// Timezone is the IANA timezone of the window (default UTC)
+	Timezone string `bson:"timezone"`
+
+	days       map[time.Weekday]struct{}
+	start, end time.Duration
+	loc        *time.Location
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (b *BusinessHours) load() error {
+	days := b.Days
+	if len(days) == 0 {
+		days = []string{"Mon", "Tue", "Wed", "Thu", "Fri"}
+	}
+	b.days = make(map[time.Weekday]struct{}, len(days))
+	for _, day := range days {
+		d, ok := weekdays[day]
+		if !ok {
+			return fmt.Errorf("invalid day %q; must be one of Mon, Tue, Wed, Thu, Fri, Sat, Sun", day)
+		}
+		b.days[d] = struct{}{}
+	}
+
+	var err error
+	if b.start, err = parseTimeOfDay(b.Start); err != nil {
+		return fmt.Errorf("invalid start: %w", err)
+	}
+	if b.end, err = parseTimeOfDay(b.End); err != nil {
+		return fmt.Errorf("invalid end: %w", err)
+	}
+	if b.end <= b.start {
+		return fmt.Errorf("end must be after start")
+	}
+
+	b.loc = time.UTC
+	if b.Timezone != "" {
+		if b.loc, err = time.LoadLocation(b.Timezone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contains returns whether t is in business hours
+func (b *BusinessHours) contains(t time.Time) bool {
+	t = t.In(b.loc)
+	if _, ok := b.days[t.Weekday()]; !ok {
+		return false
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, b.loc)
+	offset := t.Sub(midnight)
+	return offset >= b.start && offset < b.end
+}
+
+// This is a plugin that enforces policies on index builds (createIndexes)
+type IndexPolicyPlugin struct {
+	conf IndexPolicyPluginConfig
+
+	crLock sync.RWMutex
+	cr     plugins.CommandRunner
+
+	now func() time.Time
+}
+
+func (p *IndexPolicyPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *IndexPolicyPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	if p.conf.MaxIndexes < 0 {
+		return fmt.Errorf("maxIndexes must not be negative: %d", p.conf.MaxIndexes)
+	}
+	if p.conf.LargeCollectionDocuments < 0 {
+		return fmt.Errorf("largeCollectionDocuments must not be negative: %d", p.conf.LargeCollectionDocuments)
+	}
+	if p.conf.BusinessHours != nil {
+		if err := p.conf.BusinessHours.load(); err != nil {
+			return fmt.Errorf("invalid businessHours: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// SetCommandRunner sets the runner used to get the indexes and size of collections
+func (p *IndexPolicyPlugin) SetCommandRunner(cr plugins.CommandRunner) {
+	p.crLock.Lock()
+	defer p.crLock.Unlock()
+	p.cr = cr
+}
+
+func (p *IndexPolicyPlugin) commandRunner() plugins.CommandRunner {
+	p.crLock.RLock()
+	defer p.crLock.RUnlock()
+	return p.cr
+}
+
+// runCommand runs the command on the backend; a missing collection isn't an error
+// (the result is nil)
+func (p *IndexPolicyPlugin) runCommand(ctx context.Context, db string, cmd bson.D) (bson.D, error) {
+	cr := p.commandRunner()
+	if cr == nil {
+		return nil, fmt.Errorf("no plugin in the chain can run commands on the backend")
+	}
+	result, err := cr.RunCommand(ctx, db, cmd)
+	var derr driver.Error
+	if errors.As(err, &derr) && derr.Code == int32(mongoerror.NamespaceNotFound) {
+		return nil, nil
+	}
+	return result, err
+}
+
+// indexNames returns the names of the collection's indexes
+func (p *IndexPolicyPlugin) indexNames(ctx context.Context, db, collection string) (map[string]struct{}, error) {
+	result, err := p.runCommand(ctx, db, bson.D{{"listIndexes", collection}})
+	if err != nil {
+		return nil, err
+	}
+	batch, _ := bsonutil.Lookup(result, "cursor", "firstBatch")
+	items, _ := batch.(primitive.A)
+
+	names := make(map[string]struct{}, len(items))
+	for _, item := range items {
+		spec, ok := item.(bson.D)
+		if !ok {
+			continue
+		}
+		name, _ := bsonutil.Lookup(spec, "name")
+		if nameStr, ok := name.(string); ok {
+			names[nameStr] = struct{}{}
+		}
+	}
+	return names, nil
+}
+
+// documents returns the number of documents in the collection
+func (p *IndexPolicyPlugin) documents(ctx context.Context, db, collection string) (int64, error) {
+	result, err := p.runCommand(ctx, db, bson.D{{"collStats", collection}})
+	if err != nil {
+		return 0, err
+	}
+	count, _ := bsonutil.Lookup(result, "count")
+	switch c := count.(type) {
+	case int32:
+		return int64(c), nil
+	case int64:
+		return c, nil
+	case float64:
+		return int64(c), nil
+	}
+	return 0, nil
+}
+
+// check returns the rule the command violates (and why), or "" if it is accepted
+func (p *IndexPolicyPlugin) check(ctx context.Context, cmd *command.CreateIndexes) (string, error) {
+	partial := true
+	for _, index := range cmd.Indexes {
+		if p.conf.RequireBackground && !bsonutil.GetBoolDefault(index.Background, false) {
+			return RuleBackground, fmt.Errorf("index %s must be built with background: true", index.Name)
+		}
+		if p.conf.RequireHidden && !bsonutil.GetBoolDefault(index.Hidden, false) {
+			return RuleHidden, fmt.Errorf("index %s must be created with hidden: true", index.Name)
+		}
+		if len(index.PartialFilterExpression) == 0 {
+			partial = false
+		}
+	}
+
+	if p.conf.MaxIndexes > 0 {
+		names, err := p.indexNames(ctx, cmd.Database, cmd.Collection)
+		if err != nil {
+			return "", err
+		}
+		// A new collection gets an _id index
+		if len(names) == 0 {
+			names["_id_"] = struct{}{}
+		}
+		for _, index := range cmd.Indexes {
+			names[index.Name] = struct{}{}
+		}
+		if len(names) > p.conf.MaxIndexes {
+			return RuleMaxIndexes, fmt.Errorf("%s.%s would have %d indexes; at most %d are allowed",
+				cmd.Database, cmd.Collection, len(names), p.conf.MaxIndexes)
+		}
+	}
+
+	if p.conf.LargeCollectionDocuments > 0 && !partial {
+		if p.conf.BusinessHours != nil && !p.conf.BusinessHours.contains(p.now()) {
+			return "", nil
+		}
+		count, err := p.documents(ctx, cmd.Database, cmd.Collection)
+		if err != nil {
+			return "", err
+		}
+		if count >= p.conf.LargeCollectionDocuments {
+			return RuleLargeCollection, fmt.Errorf("%s.%s has %d documents; only partial indexes can be built on it during business hours",
+				cmd.Database, cmd.Collection, count)
+		}
+	}
+
+	return "", nil
+}
+
+// auditIndexBuild records an accepted index build in the audit log
+func auditIndexBuild(r *plugins.Request, cmd *command.CreateIndexes, db string, result bson.D, err error) {
+	ok := err == nil && bsonutil.Ok(result)
+	status := "ok"
+	if !ok {
+		status = "failed"
+	}
+	buildsTotal.WithLabelValues(db, cmd.Collection, status).Inc()
+
+	names := make([]string, len(cmd.Indexes))
+	keys := make([]string, len(cmd.Indexes))
+	for i, index := range cmd.Indexes {
+		names[i] = index.Name
+		b, _ := bson.MarshalExtJSON(index.Key, false, false)
+		keys[i] = string(b)
+	}
+	fields := logrus.Fields{
+		"audit":      "createIndexes",
+		"db":         db,
+		"collection": cmd.Collection,
+		"indexes":    names,
+		"keys":       keys,
+		"ok":         ok,
+	}
+	if cc := r.CC; cc != nil {
+		fields["client"] = cc.GetAddr()
+		if cc.AppName != "" {
+			fields["appName"] = cc.AppName
+		}
+		users := make([]string, 0, len(cc.Identities))
+		for _, ident := range cc.Identities {
+			users = append(users, ident.User())
+		}
+		fields["users"] = users
+	}
+	logrus.WithFields(fields).Infof("index build of %s on %s.%s", strings.Join(names, ", "), db, cmd.Collection)
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *IndexPolicyPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	cmd, ok := r.Command.(*command.CreateIndexes)
+	if !ok {
+		return next(ctx, r)
+	}
+	// The database is cleared from the command by the mongo plugin; so we grab it first
+	db := cmd.Database
+
+	rule, err := p.check(ctx, cmd)
+	if err != nil {
+		if rule == "" {
+			logrus.Errorf("INDEX POLICY ERROR: checking createIndexes on %s.%s: %s", db, cmd.Collection, err.Error())
+			return mongoerror.CannotCreateIndex.ErrMessage("unable to check the index policy: " + err.Error()), nil
+		}
+		rejectedTotal.WithLabelValues(db, cmd.Collection, rule).Inc()
+		logrus.Warningf("INDEX POLICY REJECTED: %s", err.Error())
+		return mongoerror.CannotCreateIndex.ErrMessage(err.Error()), nil
+	}
+
+	result, err := next(ctx, r)
+	auditIndexBuild(r, cmd, db, result, err)
+	return result, err
+}
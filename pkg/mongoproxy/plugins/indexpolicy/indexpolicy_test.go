@@ -0,0 +1,118 @@
+package indexpolicy
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+// statsRunner answers listIndexes and collStats for collections with the given
+// number of indexes and documents
+type statsRunner struct {
+	indexes   int
+	documents int32
+}
+
+func (r *statsRunner) RunCommand(ctx context.Context, db string, cmd bson.D) (bson.D, error) {
+	switch cmd[0].Key {
+	case "listIndexes":
+		batch := bson.A{bson.D{{"key", bson.D{{"_id", 1}}}, {"name", "_id_"}}}
+		for i := 1; i < r.indexes; i++ {
+			batch = append(batch, bson.D{{"key", bson.D{{"f" + strconv.Itoa(i), 1}}}, {"name", "f" + strconv.Itoa(i) + "_1"}})
+		}
+		return bson.D{{"cursor", bson.D{{"firstBatch", batch}}}, {"ok", 1}}, nil
+	case "collStats":
+		return bson.D{{"count", r.documents}, {"ok", 1}}, nil
+	}
+	return bson.D{{"ok", 0}}, nil
+}
+
+func createIndexes(indexes ...bson.D) bson.D {
+	a := make(bson.A, len(indexes))
+	for i, index := range indexes {
+		a[i] = index
+	}
+	return bson.D{{"createIndexes", "coll"}, {"indexes", a}, {"$db", "db"}}
+}
+
+func TestIndexPolicy(t *testing.T) {
+	// Monday 10:00 in Los Angeles
+	monday := time.Date(2021, 3, 1, 18, 0, 0, 0, time.UTC)
+	saturday := monday.AddDate(0, 0, 5)
+
+	background := bson.D{{"key", bson.D{{"a", 1}}}, {"name", "a_1"}, {"background", true}}
+	hidden := bson.D{{"key", bson.D{{"a", 1}}}, {"name", "a_1"}, {"background", true}, {"hidden", true}}
+	partial := bson.D{{"key", bson.D{{"a", 1}}}, {"name", "a_1"}, {"background", true}, {"partialFilterExpression", bson.D{{"a", bson.D{{"$exists", true}}}}}}
+
+	tests := []struct {
+		conf   bson.D
+		runner *statsRunner
+		now    time.Time
+		cmd    bson.D
+		ok     bool
+	}{
+		{bson.D{{"requireBackground", true}}, &statsRunner{}, monday, createIndexes(background), true},
+		{bson.D{{"requireBackground", true}}, &statsRunner{}, monday, createIndexes(bson.D{{"key", bson.D{{"a", 1}}}, {"name", "a_1"}}), false},
+		{bson.D{{"requireBackground", true}}, &statsRunner{}, monday, createIndexes(background, bson.D{{"key", bson.D{{"b", 1}}}, {"name", "b_1"}}), false},
+		{bson.D{{"requireHidden", true}}, &statsRunner{}, monday, createIndexes(background), false},
+		{bson.D{{"requireHidden", true}}, &statsRunner{}, monday, createIndexes(hidden), true},
+		// _id and 2 more indexes
+		{bson.D{{"maxIndexes", 4}}, &statsRunner{indexes: 3}, monday, createIndexes(background), true},
+		{bson.D{{"maxIndexes", 3}}, &statsRunner{indexes: 3}, monday, createIndexes(background), false},
+		// Existing indexes aren't counted twice
+		{bson.D{{"maxIndexes", 3}}, &statsRunner{indexes: 3}, monday, createIndexes(bson.D{{"key", bson.D{{"f1", 1}}}, {"name", "f1_1"}}), true},
+		{bson.D{{"maxIndexes", 2}}, &statsRunner{}, monday, createIndexes(background), true},
+		{bson.D{{"largeCollectionDocuments", 1000}}, &statsRunner{documents: 10}, monday, createIndexes(background), true},
+		{bson.D{{"largeCollectionDocuments", 1000}}, &statsRunner{documents: 1000}, monday, createIndexes(background), false},
+		{bson.D{{"largeCollectionDocuments", 1000}}, &statsRunner{documents: 1000}, monday, createIndexes(partial), true},
+		{bson.D{{"largeCollectionDocuments", 1000}}, &statsRunner{documents: 1000}, monday, createIndexes(partial, background), false},
+		{bson.D{
+			{"largeCollectionDocuments", 1000},
+			{"businessHours", bson.D{{"start", "09:00"}, {"end", "18:00"}, {"timezone", "America/Los_Angeles"}}},
+		}, &statsRunner{documents: 1000}, monday, createIndexes(background), false},
+		{bson.D{
+			{"largeCollectionDocuments", 1000},
+			{"businessHours", bson.D{{"start", "09:00"}, {"end", "18:00"}, {"timezone", "America/Los_Angeles"}}},
+		}, &statsRunner{documents: 1000}, saturday, createIndexes(background), true},
+		{bson.D{
+			{"largeCollectionDocuments", 1000},
+			{"businessHours", bson.D{{"start", "11:00"}, {"end", "18:00"}, {"timezone", "America/Los_Angeles"}}},
+		}, &statsRunner{documents: 1000}, monday, createIndexes(background), true},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			d := &IndexPolicyPlugin{now: func() time.Time { return test.now }}
+			if err := d.Configure(test.conf); err != nil {
+				t.Fatal(err)
+			}
+			d.SetCommandRunner(test.runner)
+
+			p := plugins.BuildPipeline([]plugins.Plugin{d}, func(context.Context, *plugins.Request) (bson.D, error) {
+				return bson.D{{"ok", 1}}, nil
+			})
+
+			cmd, ok := command.GetCommand(test.cmd[0].Key)
+			if !ok {
+				t.Fatalf("no such command: %s", test.cmd[0].Key)
+			}
+			if err := cmd.FromBSOND(test.cmd); err != nil {
+				t.Fatal(err)
+			}
+			result, err := p(context.TODO(), &plugins.Request{CommandName: test.cmd[0].Key, Command: cmd})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok := bsonutil.Ok(result); ok != test.ok {
+				t.Fatalf("expected ok=%v, got %v", test.ok, result)
+			}
+		})
+	}
+}
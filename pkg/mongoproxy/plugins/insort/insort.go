@@ -56,6 +56,7 @@ func (p *InSortPlugin) Process(ctx context.Context, r *plugins.Request, next plu
 				}
 				return nil, err
 			}
+			r.Modified()
 		}
 	case *command.FindAndModify:
 		if err := PreprocessFilter(cmd.Query, p.conf.InLimit); err != nil {
@@ -64,6 +65,7 @@ func (p *InSortPlugin) Process(ctx context.Context, r *plugins.Request, next plu
 			}
 			return nil, err
 		}
+		r.Modified()
 	case *command.Update:
 		for i := range cmd.Updates {
 			if err := PreprocessFilter(cmd.Updates[i].Query, p.conf.InLimit); err != nil {
@@ -73,6 +75,7 @@ func (p *InSortPlugin) Process(ctx context.Context, r *plugins.Request, next plu
 				return nil, err
 			}
 		}
+		r.Modified()
 	}
 
 	return next(ctx, r)
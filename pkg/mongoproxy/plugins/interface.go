@@ -7,6 +7,7 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 
 	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongowire"
 )
 
 // PipelineFunc is the function type for the built pipeline, and is called
@@ -25,6 +26,24 @@ type Plugin interface {
 	Process(context.Context, *Request, PipelineFunc) (bson.D, error)
 }
 
+// ProcessFunc is the function type of Plugin.Process
+type ProcessFunc func(context.Context, *Request, PipelineFunc) (bson.D, error)
+
+// ResponseHook is an optional interface a Plugin can implement to be called with
+// the (successful) response from the rest of the pipeline before it is returned
+// to the plugin (and ultimately the client).
+type ResponseHook interface {
+	// ProcessResponse returns the response to use in place of the given response
+	ProcessResponse(context.Context, *Request, bson.D) (bson.D, error)
+}
+
+// ErrorHook is an optional interface a Plugin can implement to be called when
+// the rest of the pipeline returns an error (either an error or an `ok: 0` response).
+type ErrorHook interface {
+	// ProcessError returns the response + error to use in place of the given ones
+	ProcessError(context.Context, *Request, bson.D, error) (bson.D, error)
+}
+
 func NewCursorCacheEntry(id int64) *CursorCacheEntry {
 	return &CursorCacheEntry{
 		ID:  id,
@@ -55,8 +74,23 @@ type Request struct {
 	CommandName string
 	Command     command.Command
 
+	// RawBatches is set if the cursor batches of the response may be returned as
+	// raw BSON (bson.RawValue) instead of being decoded (see BatchReader)
+	RawBatches bool
+	// ReplyStream (if set) is where the backend may stream a cursor reply to the
+	// client as it's read (see mongowire.ReplyStream). It is only set along with
+	// RawBatches; plugins changing cursor replies of find or getMore without
+	// reading their batches (so they could be streamed before being changed) clear
+	// it before calling next.
+	ReplyStream *mongowire.ReplyStream
+
 	// Map of arbitrary data for plugins to store stuff in
 	Map map[string]interface{}
+
+	// doc and raw are the command's document and its encoding, decoded/encoded
+	// on first use and reset when the command is modified (see Modified)
+	doc bson.D
+	raw bson.Raw
 }
 
 func (r *Request) Close() {}
@@ -73,6 +107,11 @@ type ClientConnection struct {
 	// According to the docs (https://docs.mongodb.com/manual/core/authentication/#authentication-methods) multiple logins should
 	// have the credentials for all until a logout happens; for now we aren't doing that.
 	Identities []ClientIdentity
+	// AppName is the application name the client sent in its handshake
+	AppName string
+	// ClientMetadata is the client metadata from the handshake (nil if the
+	// client didn't send any)
+	ClientMetadata *ClientMetadata
 
 	// Map is storage that resets on cursor change
 	Map map[interface{}]interface{}
@@ -0,0 +1,142 @@
+package jspolicy
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "jspolicy"
+
+var (
+	javaScriptTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_jspolicy_javascript_total",
+		Help: "The total requests running server-side JavaScript",
+	}, []string{"db", "collection", "app_name", "operator", "action"})
+)
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &JSPolicyPlugin{
+			conf: JSPolicyPluginConfig{},
+		}
+	})
+}
+
+type JSPolicyPluginConfig struct {
+	// Rules decide whether requests may run server-side JavaScript ($where,
+	// $function, $accumulator and mapReduce); the first rule matching the request applies
+	Rules []*Rule `bson:"rules"`
+	// Allow is whether requests matching no rule may run JavaScript (default false)
+	Allow bool `bson:"allow"`
+	// LogOnly logs (and counts) requests that would be blocked instead of blocking them
+	LogOnly bool `bson:"logOnly"`
+}
+
+// Rule allows or blocks JavaScript for a set of namespaces and clients
+type Rule struct {
+	// Scope limits the namespaces and commands of the rule (same format as a
+	// plugin scope; default all)
+	Scope *plugins.Scope `bson:"scope"`
+	// AppNames limits the client appNames of the rule (default all)
+	AppNames []string `bson:"appNames"`
+	// Allow is whether matching requests may run JavaScript
+	Allow bool `bson:"allow"`
+
+	appNames map[string]struct{}
+}
+
+func (r *Rule) match(req *plugins.Request, appName string) bool {
+	if r.appNames != nil {
+		if _, ok := r.appNames[appName]; !ok {
+			return false
+		}
+	}
+	return r.Scope.IsZero() || r.Scope.Match(req)
+}
+
+// This is a plugin that detects (and blocks) server-side JavaScript
+type JSPolicyPlugin struct {
+	conf JSPolicyPluginConfig
+}
+
+func (p *JSPolicyPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *JSPolicyPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	for i, rule := range p.conf.Rules {
+		if rule == nil {
+			return fmt.Errorf("empty rule %d", i)
+		}
+		if rule.Scope != nil {
+			rule.Scope.Compile()
+		}
+		if len(rule.AppNames) > 0 {
+			rule.appNames = make(map[string]struct{}, len(rule.AppNames))
+			for _, appName := range rule.AppNames {
+				rule.appNames[appName] = struct{}{}
+			}
+		}
+	}
+
+	return nil
+}
+
+// allowed returns whether the request may run JavaScript
+func (p *JSPolicyPlugin) allowed(r *plugins.Request, appName string) bool {
+	for _, rule := range p.conf.Rules {
+		if rule.match(r, appName) {
+			return rule.Allow
+		}
+	}
+	return p.conf.Allow
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *JSPolicyPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	op, ok := command.CommandJavaScript(r.Command)
+	if !ok {
+		return next(ctx, r)
+	}
+
+	var appName string
+	if r.CC != nil {
+		appName = r.CC.AppName
+	}
+	db, collection := command.GetCommandDatabase(r.Command), command.GetCommandCollection(r.Command)
+
+	action := "allowed"
+	if !p.allowed(r, appName) {
+		action = "blocked"
+		if p.conf.LogOnly {
+			action = "logged"
+		}
+		logrus.Warningf("SERVER-SIDE JAVASCRIPT %s: %s in %s on %s.%s from appName %q", action, op, r.CommandName, db, collection, appName)
+	}
+	javaScriptTotal.WithLabelValues(db, collection, appName, op, action).Inc()
+
+	if action == "blocked" {
+		return mongoerror.Unauthorized.ErrMessage(fmt.Sprintf("server-side JavaScript (%s) is not allowed on %s.%s", op, db, collection)), nil
+	}
+	return next(ctx, r)
+}
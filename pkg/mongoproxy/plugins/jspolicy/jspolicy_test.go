@@ -0,0 +1,69 @@
+package jspolicy
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func TestJSPolicy(t *testing.T) {
+	p := &JSPolicyPlugin{}
+	if err := p.Configure(bson.D{
+		{"rules", bson.A{
+			bson.D{{"appNames", bson.A{"reporting"}}, {"scope", bson.D{{"databases", bson.A{"analytics"}}}}, {"allow", true}},
+			bson.D{{"scope", bson.D{{"collections", bson.A{"legacy.*"}}}}, {"allow", true}},
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	pipe := plugins.BuildPipeline([]plugins.Plugin{p}, func(context.Context, *plugins.Request) (bson.D, error) {
+		return bson.D{{"ok", 1}}, nil
+	})
+
+	tests := []struct {
+		appName string
+		cmd     bson.D
+		ok      bool
+	}{
+		{"", bson.D{{"find", "c"}, {"filter", bson.D{{"a", 1}}}, {"$db", "db"}}, true},
+		{"", bson.D{{"find", "c"}, {"filter", bson.D{{"$where", "this.a == 1"}}}, {"$db", "db"}}, false},
+		{"", bson.D{{"find", "c"}, {"filter", bson.D{{"$or", bson.A{bson.D{{"$where", primitive.JavaScript("true")}}}}}}, {"$db", "db"}}, false},
+		{"", bson.D{{"aggregate", "c"}, {"pipeline", bson.A{bson.D{{"$group", bson.D{{"_id", nil}, {"a", bson.D{{"$accumulator", bson.D{}}}}}}}}}, {"cursor", bson.D{}}, {"$db", "db"}}, false},
+		{"", bson.D{{"count", "c"}, {"query", bson.D{{"$expr", bson.D{{"$function", bson.D{}}}}}}, {"$db", "db"}}, false},
+		{"", bson.D{{"delete", "c"}, {"deletes", bson.A{bson.D{{"q", bson.D{{"$where", "true"}}}, {"limit", 0}}}}, {"$db", "db"}}, false},
+		{"", bson.D{{"mapReduce", "c"}, {"map", primitive.JavaScript("function() {}")}, {"reduce", primitive.JavaScript("function() {}")}, {"out", bson.D{{"inline", 1}}}, {"$db", "db"}}, false},
+		// Allowed by rules
+		{"reporting", bson.D{{"mapReduce", "c"}, {"map", "function() {}"}, {"reduce", "function() {}"}, {"out", bson.D{{"inline", 1}}}, {"$db", "analytics"}}, true},
+		{"web", bson.D{{"mapReduce", "c"}, {"map", "function() {}"}, {"reduce", "function() {}"}, {"out", bson.D{{"inline", 1}}}, {"$db", "analytics"}}, false},
+		{"web", bson.D{{"find", "c"}, {"filter", bson.D{{"$where", "true"}}}, {"$db", "legacy"}}, true},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			cmd, ok := command.GetCommand(test.cmd[0].Key)
+			if !ok {
+				t.Fatalf("no such command: %s", test.cmd[0].Key)
+			}
+			if err := cmd.FromBSOND(test.cmd); err != nil {
+				t.Fatal(err)
+			}
+			cc := plugins.NewClientConnection()
+			cc.AppName = test.appName
+			d, err := pipe(context.TODO(), &plugins.Request{CC: cc, CommandName: test.cmd[0].Key, Command: cmd})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok := bsonutil.Ok(d); ok != test.ok {
+				t.Fatalf("expected ok=%v, got %v", test.ok, d)
+			}
+		})
+	}
+}
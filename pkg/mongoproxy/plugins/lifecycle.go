@@ -0,0 +1,107 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+)
+
+// Starter is an optional interface a Plugin can implement to open resources
+// (connections, files, producers, etc.) once the whole plugin chain has been
+// configured. An error from Start fails proxy startup.
+type Starter interface {
+	Start(context.Context) error
+}
+
+// Stopper is an optional interface a Plugin can implement to release its
+// resources when the proxy shuts down. Plugins are stopped in the reverse
+// order they were started (after client connections have drained).
+type Stopper interface {
+	Stop(context.Context) error
+}
+
+// HealthChecker is an optional interface a Plugin can implement to report
+// its health; an unhealthy plugin marks the proxy as not ready.
+type HealthChecker interface {
+	Health(context.Context) error
+}
+
+// WarmUpper is an optional interface a Plugin can implement to prepare for
+// traffic (e.g. open backend connections, fill caches) after it has started; the
+// proxy only reports ready once its plugins have warmed up (see the warmUp config).
+type WarmUpper interface {
+	WarmUp(context.Context) error
+}
+
+// Unwrap returns the underlying plugin of a wrapped (e.g. scoped) plugin
+func Unwrap(p Plugin) Plugin {
+	for {
+		u, ok := p.(interface{ Unwrap() Plugin })
+		if !ok {
+			return p
+		}
+		p = u.Unwrap()
+	}
+}
+
+// StartPlugins calls Start on all plugins that implement Starter. If a plugin
+// fails to start the plugins already started are stopped.
+func StartPlugins(ctx context.Context, ps []Plugin) error {
+	for i, p := range ps {
+		s, ok := Unwrap(p).(Starter)
+		if !ok {
+			continue
+		}
+		if err := s.Start(ctx); err != nil {
+			StopPlugins(ctx, ps[:i])
+			return fmt.Errorf("error starting plugin %s: %w", p.Name(), err)
+		}
+	}
+	return nil
+}
+
+// StopPlugins calls Stop on all plugins that implement Stopper (in reverse order)
+// returning the first error encountered.
+func StopPlugins(ctx context.Context, ps []Plugin) error {
+	var retErr error
+	for i := len(ps) - 1; i >= 0; i-- {
+		s, ok := Unwrap(ps[i]).(Stopper)
+		if !ok {
+			continue
+		}
+		if err := s.Stop(ctx); err != nil && retErr == nil {
+			retErr = fmt.Errorf("error stopping plugin %s: %w", ps[i].Name(), err)
+		}
+	}
+	return retErr
+}
+
+// CheckHealth calls Health on all plugins that implement HealthChecker returning
+// the first error encountered.
+func CheckHealth(ctx context.Context, ps []Plugin) error {
+	for _, p := range ps {
+		h, ok := Unwrap(p).(HealthChecker)
+		if !ok {
+			continue
+		}
+		if err := h.Health(ctx); err != nil {
+			return fmt.Errorf("plugin %s unhealthy: %w", p.Name(), err)
+		}
+	}
+	return nil
+}
+
+// WarmUpPlugins calls WarmUp on all plugins that implement WarmUpper. All plugins
+// are warmed up even if one fails; the first error encountered is returned.
+func WarmUpPlugins(ctx context.Context, ps []Plugin) error {
+	var retErr error
+	for _, p := range ps {
+		w, ok := Unwrap(p).(WarmUpper)
+		if !ok {
+			continue
+		}
+		if err := w.WarmUp(ctx); err != nil && retErr == nil {
+			retErr = fmt.Errorf("error warming up plugin %s: %w", p.Name(), err)
+		}
+	}
+	return retErr
+}
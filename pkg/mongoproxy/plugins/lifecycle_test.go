@@ -0,0 +1,91 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type lifecyclePlugin struct {
+	noopPlugin
+	startErr, healthErr, warmUpErr error
+	order                          *[]string
+	name                           string
+}
+
+func (p *lifecyclePlugin) Name() string { return p.name }
+
+func (p *lifecyclePlugin) Start(context.Context) error {
+	*p.order = append(*p.order, "start "+p.name)
+	return p.startErr
+}
+
+func (p *lifecyclePlugin) Stop(context.Context) error {
+	*p.order = append(*p.order, "stop "+p.name)
+	return nil
+}
+
+func (p *lifecyclePlugin) Health(context.Context) error { return p.healthErr }
+
+func (p *lifecyclePlugin) WarmUp(context.Context) error {
+	*p.order = append(*p.order, "warm up "+p.name)
+	return p.warmUpErr
+}
+
+func TestLifecycle(t *testing.T) {
+	var order []string
+	a := &lifecyclePlugin{name: "a", order: &order}
+	b := &lifecyclePlugin{name: "b", order: &order}
+	ps := []Plugin{a, &noopPlugin{}, Scoped(b, &Scope{Databases: []string{"x"}})}
+
+	if err := StartPlugins(context.TODO(), ps); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckHealth(context.TODO(), ps); err != nil {
+		t.Fatal(err)
+	}
+	b.healthErr = errors.New("unhealthy")
+	if err := CheckHealth(context.TODO(), ps); err == nil {
+		t.Fatalf("expected health error")
+	}
+	if err := StopPlugins(context.TODO(), ps); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"start a", "start b", "stop b", "stop a"}
+	if len(order) != len(expected) {
+		t.Fatalf("unexpected lifecycle calls: %v", order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("unexpected lifecycle calls: %v", order)
+		}
+	}
+
+	// If a plugin fails to start; the previous ones should be stopped
+	order = nil
+	b.startErr = errors.New("bad config")
+	if err := StartPlugins(context.TODO(), ps); err == nil {
+		t.Fatalf("expected start error")
+	}
+	expected = []string{"start a", "start b", "stop a"}
+	if len(order) != len(expected) {
+		t.Fatalf("unexpected lifecycle calls: %v", order)
+	}
+}
+
+func TestWarmUpPlugins(t *testing.T) {
+	var order []string
+	a := &lifecyclePlugin{name: "a", order: &order, warmUpErr: errors.New("backend down")}
+	b := &lifecyclePlugin{name: "b", order: &order}
+	ps := []Plugin{a, &noopPlugin{}, Scoped(b, &Scope{Databases: []string{"x"}})}
+
+	// A failing plugin doesn't stop the others from warming up
+	if err := WarmUpPlugins(context.TODO(), ps); err == nil {
+		t.Fatalf("expected warm up error")
+	}
+	expected := []string{"warm up a", "warm up b"}
+	if len(order) != len(expected) || order[0] != expected[0] || order[1] != expected[1] {
+		t.Fatalf("unexpected lifecycle calls: %v", order)
+	}
+}
@@ -0,0 +1,335 @@
+package luascript
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "luascript"
+
+var (
+	scriptRunsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_luascript_runs_total",
+		Help: "The total script runs by result",
+	}, []string{"script", "result"})
+)
+
+// processFunc is the global function scripts define, called for each request
+const processFunc = "process"
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &LuaScriptPlugin{
+			conf: LuaScriptPluginConfig{
+				Timeout: "10ms",
+			},
+		}
+	})
+}
+
+type LuaScriptPluginConfig struct {
+	// Scripts are run in order for the requests in their scope
+	Scripts []*Script `bson:"scripts"`
+	// Timeout is the time each script may take per request (default "10ms")
+	Timeout string `bson:"timeout"`
+	timeout time.Duration
+}
+
+// Script is a Lua script run for a set of namespaces
+type Script struct {
+	// Name identifies the script in logs and metrics (required)
+	Name string `bson:"name"`
+	// Scope limits the namespaces and commands of the script (same format as a
+	// plugin scope; default all)
+	Scope *plugins.Scope `bson:"scope"`
+	// Source is the script's code; either it or File is required
+	Source string `bson:"source"`
+	// File is a file the script is read from
+	File string `bson:"file"`
+
+	proto *lua.FunctionProto
+	// states are the Lua states the script is loaded in; a state is only used by
+	// one request at a time
+	states sync.Pool
+}
+
+func (s *Script) load() error {
+	if s.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if s.Scope != nil {
+		s.Scope.Compile()
+	}
+	if (s.Source == "") == (s.File == "") {
+		return fmt.Errorf("script %s: exactly one of source and file is required", s.Name)
+	}
+	source := s.Source
+	if s.File != "" {
+		b, err := ioutil.ReadFile(s.File)
+		if err != nil {
+			return err
+		}
+		source = string(b)
+	}
+
+	chunk, err := parse.Parse(strings.NewReader(source), s.Name)
+	if err != nil {
+		return fmt.Errorf("script %s: %w", s.Name, err)
+	}
+	if s.proto, err = lua.Compile(chunk, s.Name); err != nil {
+		return fmt.Errorf("script %s: %w", s.Name, err)
+	}
+
+	// Load the script once to catch errors now rather than on requests
+	L, err := s.newState()
+	if err != nil {
+		return fmt.Errorf("script %s: %w", s.Name, err)
+	}
+	s.states.Put(L)
+	return nil
+}
+
+// newState returns a Lua state with the script loaded. Only the base (without
+// file access and modules), string, table and math libraries are opened; print
+// logs.
+func (s *Script) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		if err := L.CallByParam(lua.P{Fn: L.NewFunction(lib.open), Protect: true}, lua.LString(lib.name)); err != nil {
+			L.Close()
+			return nil, err
+		}
+	}
+	for _, name := range []string{"dofile", "loadfile", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	L.SetGlobal("print", L.NewFunction(func(L *lua.LState) int {
+		args := make([]string, L.GetTop())
+		for i := range args {
+			args[i] = L.ToStringMeta(L.Get(i + 1)).String()
+		}
+		logrus.Infof("luascript %s: %s", s.Name, strings.Join(args, " "))
+		return 0
+	}))
+	L.SetField(L.NewTypeMetatable(valueTypeName), "__tostring", L.NewFunction(valueToString))
+	L.SetGlobal("null", newNull(L))
+
+	L.Push(L.NewFunctionFromProto(s.proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		L.Close()
+		return nil, err
+	}
+	if _, ok := L.GetGlobal(processFunc).(*lua.LFunction); !ok {
+		L.Close()
+		return nil, fmt.Errorf("the script must define a %s function", processFunc)
+	}
+	return L, nil
+}
+
+// This is a plugin that runs Lua scripts which can modify or reject requests
+type LuaScriptPlugin struct {
+	conf LuaScriptPluginConfig
+}
+
+func (p *LuaScriptPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *LuaScriptPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	if p.conf.timeout, err = time.ParseDuration(p.conf.Timeout); err != nil {
+		return err
+	}
+	if p.conf.timeout <= 0 {
+		return fmt.Errorf("timeout must be positive: %s", p.conf.Timeout)
+	}
+
+	names := make(map[string]struct{}, len(p.conf.Scripts))
+	for i, script := range p.conf.Scripts {
+		if script == nil {
+			return fmt.Errorf("empty script %d", i)
+		}
+		if err := script.load(); err != nil {
+			return err
+		}
+		if _, ok := names[script.Name]; ok {
+			return fmt.Errorf("duplicate script %s", script.Name)
+		}
+		names[script.Name] = struct{}{}
+	}
+
+	return nil
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *LuaScriptPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	for _, script := range p.conf.Scripts {
+		if !script.Scope.IsZero() && !script.Scope.Match(r) {
+			continue
+		}
+		rejected, err := p.run(ctx, script, r)
+		if err != nil {
+			scriptRunsTotal.WithLabelValues(script.Name, "failed").Inc()
+			logrus.Errorf("luascript %s failed on %s: %s", script.Name, r.CommandName, err.Error())
+			return mongoerror.InternalError.ErrMessage(fmt.Sprintf("script %s failed: %s", script.Name, err.Error())), nil
+		}
+		if rejected != "" {
+			scriptRunsTotal.WithLabelValues(script.Name, "rejected").Inc()
+			logrus.Debugf("luascript %s rejected %s on %s.%s: %s", script.Name, r.CommandName, r.Database(), r.Collection(), rejected)
+			return mongoerror.Unauthorized.ErrMessage(rejected), nil
+		}
+		scriptRunsTotal.WithLabelValues(script.Name, "ok").Inc()
+	}
+	return next(ctx, r)
+}
+
+// run runs the script's process function on the request, applying its changes.
+// Returns the message the request is rejected with ("" if it isn't).
+func (p *LuaScriptPlugin) run(ctx context.Context, script *Script, r *plugins.Request) (string, error) {
+	L, ok := script.states.Get().(*lua.LState)
+	if !ok {
+		var err error
+		if L, err = script.newState(); err != nil {
+			return "", err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.conf.timeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	req := newRequestTable(L, r)
+	err := L.CallByParam(lua.P{Fn: L.GetGlobal(processFunc), NRet: 1, Protect: true}, req)
+	L.RemoveContext()
+	if err != nil {
+		// The state may have been left mid-call
+		L.Close()
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("exceeded timeout of %s", p.conf.timeout)
+		}
+		// The error raised, without the traceback
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			return "", errors.New(apiErr.Object.String())
+		}
+		return "", err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	script.states.Put(L)
+
+	switch ret := ret.(type) {
+	case *lua.LNilType:
+	case lua.LString:
+		if ret == "" {
+			return "", fmt.Errorf("%s returned an empty rejection message", processFunc)
+		}
+		return string(ret), nil
+	default:
+		return "", fmt.Errorf("%s must return nil or a rejection message, got a %s", processFunc, ret.Type())
+	}
+
+	return "", applyRequestTable(req, r)
+}
+
+// newRequestTable returns the table passed to the process function: the
+// command's name, namespace and client appName, and its statements (see
+// applyRequestTable)
+func newRequestTable(L *lua.LState, r *plugins.Request) *lua.LTable {
+	req := L.NewTable()
+	req.RawSetString("command", lua.LString(r.CommandName))
+	req.RawSetString("db", lua.LString(r.Database()))
+	req.RawSetString("collection", lua.LString(r.Collection()))
+	if r.CC != nil {
+		req.RawSetString("appName", lua.LString(r.CC.AppName))
+	}
+	for _, field := range statementFields {
+		if docs := field.get(r); docs != nil {
+			req.RawSetString(field.name, toLua(L, docsArray(docs)))
+		}
+	}
+	return req
+}
+
+// statementFields are the statements of the request scripts can change
+var statementFields = []struct {
+	name string
+	get  func(*plugins.Request) []bson.D
+	set  func(*plugins.Request, int, bson.D) bool
+}{
+	{"filters", (*plugins.Request).Filters, (*plugins.Request).SetFilter},
+	{"updates", (*plugins.Request).Updates, (*plugins.Request).SetUpdate},
+	{"documents", (*plugins.Request).Documents, (*plugins.Request).SetDocument},
+}
+
+func docsArray(docs []bson.D) bson.A {
+	a := make(bson.A, len(docs))
+	for i, doc := range docs {
+		a[i] = doc
+	}
+	return a
+}
+
+// applyRequestTable sets the statements (filters, updates and documents) the
+// script changed on the request. Statements can be modified or replaced but
+// not added or removed.
+func applyRequestTable(req *lua.LTable, r *plugins.Request) error {
+	for _, field := range statementFields {
+		docs := field.get(r)
+		if docs == nil {
+			continue
+		}
+		lv := req.RawGetString(field.name)
+		t, ok := lv.(*lua.LTable)
+		if !ok || t.Len() != len(docs) {
+			return fmt.Errorf("%s can't be added or removed", field.name)
+		}
+		for i, doc := range docs {
+			v, err := fromLua(t.RawGetInt(i+1), doc, 0)
+			if err != nil {
+				return fmt.Errorf("%s[%d]: %w", field.name, i+1, err)
+			}
+			changed, ok := v.(bson.D)
+			if !ok {
+				return fmt.Errorf("%s[%d] must be a document", field.name, i+1)
+			}
+			if !reflect.DeepEqual(changed, doc) && !field.set(r, i, changed) {
+				return fmt.Errorf("%s[%d] can't be changed", field.name, i+1)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package luascript
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const tenantScript = `
+function process(req)
+	if req.command == "delete" then
+		return "deletes are disabled on " .. req.db .. "." .. req.collection
+	end
+	for _, filter in ipairs(req.filters or {}) do
+		filter.tenant = "a"
+	end
+	for _, doc in ipairs(req.documents or {}) do
+		doc.tenant = "a"
+		doc.owner = tostring(doc.owner)
+	end
+end
+`
+
+const updateScript = `
+function process(req)
+	for i, update in ipairs(req.updates or {}) do
+		if update["$set"] and update["$set"].limit then
+			update["$set"].limit = math.min(update["$set"].limit, 10)
+		end
+	end
+end
+`
+
+func TestLuaScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "luascript")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "update.lua")
+	if err := ioutil.WriteFile(file, []byte(updateScript), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &LuaScriptPlugin{conf: LuaScriptPluginConfig{Timeout: "100ms"}}
+	if err := p.Configure(bson.D{
+		{"scripts", bson.A{
+			bson.D{{"name", "tenant"}, {"scope", bson.D{{"collections", bson.A{"db.users"}}}}, {"source", tenantScript}},
+			bson.D{{"name", "update"}, {"file", file}},
+			bson.D{{"name", "failing"}, {"scope", bson.D{{"databases", bson.A{"failing"}}}}, {"source", `function process(req) error("boom") end`}},
+			bson.D{{"name", "slow"}, {"scope", bson.D{{"databases", bson.A{"slow"}}}}, {"source", `function process(req) while true do end end`}},
+			bson.D{{"name", "remove"}, {"scope", bson.D{{"databases", bson.A{"remove"}}}}, {"source", `function process(req) req.filters = {} end`}},
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got bson.D
+	pipe := plugins.BuildPipeline([]plugins.Plugin{p}, func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+		var err error
+		if got, err = r.Document(); err != nil {
+			return nil, err
+		}
+		return bson.D{{"ok", 1}}, nil
+	})
+
+	oid := primitive.NewObjectID()
+	tests := []struct {
+		cmd bson.D
+		// expected is the command the backend gets (nil if the request fails)
+		expected bson.D
+		errmsg   string
+	}{
+		// Filters are changed, keeping the order and types of their fields
+		{
+			cmd:      bson.D{{"find", "users"}, {"filter", bson.D{{"age", int32(3)}, {"deleted", nil}, {"_id", oid}}}, {"$db", "db"}},
+			expected: bson.D{{"find", "users"}, {"filter", bson.D{{"age", int32(3)}, {"deleted", nil}, {"_id", oid}, {"tenant", "a"}}}, {"$db", "db"}},
+		},
+		{
+			cmd:      bson.D{{"insert", "users"}, {"documents", bson.A{bson.D{{"_id", int64(1)}, {"owner", oid}, {"tags", bson.A{"x", 1.5}}}}}, {"$db", "db"}},
+			expected: bson.D{{"insert", "users"}, {"documents", bson.A{bson.D{{"_id", int64(1)}, {"owner", oid.String()}, {"tags", bson.A{"x", 1.5}}, {"tenant", "a"}}}}, {"$db", "db"}},
+		},
+		{
+			cmd:    bson.D{{"delete", "users"}, {"deletes", bson.A{bson.D{{"q", bson.D{}}, {"limit", int32(0)}}}}, {"$db", "db"}},
+			errmsg: "deletes are disabled on db.users",
+		},
+		// Scripts only run for their scope, and unchanged requests are left as is
+		{
+			cmd:      bson.D{{"find", "other"}, {"filter", bson.D{{"age", int32(3)}}}, {"$db", "db"}},
+			expected: bson.D{{"find", "other"}, {"filter", bson.D{{"age", int32(3)}}}, {"$db", "db"}},
+		},
+		{
+			cmd:      bson.D{{"update", "other"}, {"updates", bson.A{bson.D{{"q", bson.D{}}, {"u", bson.D{{"$set", bson.D{{"limit", int32(50)}, {"a", true}}}}}}}}, {"$db", "db"}},
+			expected: bson.D{{"update", "other"}, {"updates", bson.A{bson.D{{"q", bson.D{}}, {"u", bson.D{{"$set", bson.D{{"limit", int32(10)}, {"a", true}}}}}}}}, {"$db", "db"}},
+		},
+		// Failing scripts fail the request
+		{
+			cmd:    bson.D{{"find", "c"}, {"$db", "failing"}},
+			errmsg: "script failing failed: failing:1: boom",
+		},
+		{
+			cmd:    bson.D{{"find", "c"}, {"$db", "slow"}},
+			errmsg: "script slow failed: exceeded timeout of 100ms",
+		},
+		{
+			cmd:    bson.D{{"find", "c"}, {"$db", "remove"}},
+			errmsg: "script remove failed: filters can't be added or removed",
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			cmd, ok := command.GetCommand(test.cmd[0].Key)
+			if !ok {
+				t.Fatalf("no such command: %s", test.cmd[0].Key)
+			}
+			if err := cmd.FromBSOND(test.cmd); err != nil {
+				t.Fatal(err)
+			}
+			r := &plugins.Request{CC: plugins.NewClientConnection()}
+			r.SetCommand(test.cmd[0].Key, cmd, test.cmd)
+
+			got = nil
+			d, err := pipe(context.TODO(), r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.expected == nil {
+				if errmsg, _ := bsonutil.Lookup(d, "errmsg"); bsonutil.Ok(d) || errmsg != test.errmsg {
+					t.Fatalf("expected error %q, got %v", test.errmsg, d)
+				}
+				return
+			}
+			if !bsonutil.Ok(d) {
+				t.Fatalf("unexpected error: %v", d)
+			}
+			if !reflect.DeepEqual(got, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	tests := []bson.D{
+		{{"timeout", "0s"}},
+		{{"scripts", bson.A{bson.D{{"source", "function process(req) end"}}}}},
+		{{"scripts", bson.A{bson.D{{"name", "a"}}}}},
+		{{"scripts", bson.A{bson.D{{"name", "a"}, {"source", "function process(req) end"}, {"file", "a.lua"}}}}},
+		{{"scripts", bson.A{bson.D{{"name", "a"}, {"file", "/nonexistent.lua"}}}}},
+		// Syntax errors, failing scripts and scripts without a process function
+		{{"scripts", bson.A{bson.D{{"name", "a"}, {"source", "function process(req)"}}}}},
+		{{"scripts", bson.A{bson.D{{"name", "a"}, {"source", "error('boom')"}}}}},
+		{{"scripts", bson.A{bson.D{{"name", "a"}, {"source", "x = 1"}}}}},
+		// Scripts can't read files
+		{{"scripts", bson.A{bson.D{{"name", "a"}, {"source", "dofile('/etc/passwd')"}}}}},
+		{{"scripts", bson.A{
+			bson.D{{"name", "a"}, {"source", "function process(req) end"}},
+			bson.D{{"name", "a"}, {"source", "function process(req) end"}},
+		}}},
+	}
+	for i, cfg := range tests {
+		p, _ := plugins.GetPlugin(Name)
+		if err := p.Configure(cfg); err == nil {
+			t.Fatalf("%d: expected an error", i)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package luascript
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	lua "github.com/yuin/gopher-lua"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// valueTypeName is the type of the userdata wrapping the BSON values which have
+// no Lua equivalent (e.g. ObjectIDs and dates); they are passed back unchanged
+const valueTypeName = "bson"
+
+// nullKey is the registry key of null: BSON nulls can't be nil as fields set to
+// nil are removed from tables
+const nullKey = "mongoproxy.null"
+
+// nullValue is the value of null
+type nullValue struct{}
+
+// maxDepth is the maximum nesting of the values converted from Lua (tables
+// may reference themselves)
+const maxDepth = 100
+
+// newNull registers null (see nullKey) in the state, returning it
+func newNull(L *lua.LState) lua.LValue {
+	null := L.NewUserData()
+	null.Value = nullValue{}
+	L.SetMetatable(null, L.GetTypeMetatable(valueTypeName))
+	L.SetField(L.Get(lua.RegistryIndex), nullKey, null)
+	return null
+}
+
+// toLua converts a BSON value to Lua: documents and arrays to tables, numbers
+// to numbers, null to null and other types to userdata
+func toLua(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return L.GetField(L.Get(lua.RegistryIndex), nullKey)
+	case bool:
+		return lua.LBool(v)
+	case string:
+		return lua.LString(v)
+	case int32:
+		return lua.LNumber(v)
+	case int64:
+		return lua.LNumber(v)
+	case float64:
+		return lua.LNumber(v)
+	case bson.D:
+		t := L.CreateTable(0, len(v))
+		for _, e := range v {
+			t.RawSetString(e.Key, toLua(L, e.Value))
+		}
+		return t
+	case bson.A:
+		t := L.CreateTable(len(v), 0)
+		for i, e := range v {
+			t.RawSetInt(i+1, toLua(L, e))
+		}
+		return t
+	default:
+		ud := L.NewUserData()
+		ud.Value = v
+		L.SetMetatable(ud, L.GetTypeMetatable(valueTypeName))
+		return ud
+	}
+}
+
+// valueToString is the __tostring of wrapped BSON values
+func valueToString(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	if _, ok := ud.Value.(nullValue); ok {
+		L.Push(lua.LString("null"))
+		return 1
+	}
+	L.Push(lua.LString(fmt.Sprint(ud.Value)))
+	return 1
+}
+
+// fromLua converts a Lua value back to BSON. hint is the value it was converted
+// from (if any), which keeps the order of the fields of documents and the types
+// of numbers; new fields are appended in key order and new integers are int64s.
+func fromLua(lv lua.LValue, hint interface{}, depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("values nested deeper than %d", maxDepth)
+	}
+	switch lv := lv.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(lv), nil
+	case lua.LString:
+		return string(lv), nil
+	case lua.LNumber:
+		return fromLuaNumber(float64(lv), hint), nil
+	case *lua.LUserData:
+		if _, ok := lv.Value.(nullValue); ok {
+			return nil, nil
+		}
+		return lv.Value, nil
+	case *lua.LTable:
+		// Empty tables keep the type they were
+		if _, ok := hint.(bson.A); isArray(lv) || (ok && isEmpty(lv)) {
+			return fromLuaArray(lv, hint, depth)
+		}
+		return fromLuaDocument(lv, hint, depth)
+	default:
+		return nil, fmt.Errorf("unsupported value of type %s", lv.Type())
+	}
+}
+
+func fromLuaNumber(f float64, hint interface{}) interface{} {
+	integral := f == math.Trunc(f) && !math.IsInf(f, 0)
+	switch hint.(type) {
+	case int32:
+		if integral && f >= math.MinInt32 && f <= math.MaxInt32 {
+			return int32(f)
+		}
+	case int64:
+		if integral && f >= math.MinInt64 && f <= math.MaxInt64 {
+			return int64(f)
+		}
+	case float64:
+		return f
+	default:
+		if integral && f >= math.MinInt64 && f <= math.MaxInt64 {
+			return int64(f)
+		}
+	}
+	return f
+}
+
+// isArray returns whether the table is a (non-empty) sequence
+func isArray(t *lua.LTable) bool {
+	n := t.Len()
+	if n == 0 {
+		return false
+	}
+	keys := 0
+	t.ForEach(func(lua.LValue, lua.LValue) { keys++ })
+	return keys == n
+}
+
+func isEmpty(t *lua.LTable) bool {
+	k, _ := t.Next(lua.LNil)
+	return k == lua.LNil
+}
+
+func fromLuaArray(t *lua.LTable, hint interface{}, depth int) (interface{}, error) {
+	hintArray, _ := hint.(bson.A)
+	a := make(bson.A, t.Len())
+	for i := range a {
+		var elemHint interface{}
+		if i < len(hintArray) {
+			elemHint = hintArray[i]
+		}
+		v, err := fromLua(t.RawGetInt(i+1), elemHint, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		a[i] = v
+	}
+	return a, nil
+}
+
+func fromLuaDocument(t *lua.LTable, hint interface{}, depth int) (interface{}, error) {
+	hintDoc, _ := hint.(bson.D)
+
+	var (
+		keys    []string
+		keysErr error
+	)
+	t.ForEach(func(k, _ lua.LValue) {
+		if s, ok := k.(lua.LString); ok {
+			keys = append(keys, string(s))
+		} else if keysErr == nil {
+			keysErr = fmt.Errorf("document keys must be strings, got a %s", k.Type())
+		}
+	})
+	if keysErr != nil {
+		return nil, keysErr
+	}
+	if len(keys) == 0 && len(hintDoc) == 0 {
+		// Keep empty documents as they were (e.g. unset filters)
+		if _, ok := hint.(bson.D); ok {
+			return hintDoc, nil
+		}
+		return bson.D{}, nil
+	}
+
+	// Existing fields keep their position, new ones follow in key order
+	d := make(bson.D, 0, len(keys))
+	seen := make(map[string]struct{}, len(hintDoc))
+	for _, e := range hintDoc {
+		lv := t.RawGetString(e.Key)
+		if lv == lua.LNil {
+			continue
+		}
+		v, err := fromLua(lv, e.Value, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		d = append(d, bson.E{e.Key, v})
+		seen[e.Key] = struct{}{}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		v, err := fromLua(t.RawGetString(key), nil, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		d = append(d, bson.E{key, v})
+	}
+	return d, nil
+}
@@ -0,0 +1,333 @@
+package maintenancewindow
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "maintenancewindow"
+
+var (
+	rejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_maintenancewindow_rejected_total",
+		Help: "The total operations rejected outside of maintenance windows",
+	}, []string{"db", "collection", "operation"})
+)
+
+// Operations restricted to maintenance windows
+const (
+	OpBulkDelete    = "bulkDelete"
+	OpBulkUpdate    = "bulkUpdate"
+	OpCreateIndexes = "createIndexes"
+	OpDrop          = "drop"
+	OpDropDatabase  = "dropDatabase"
+	OpDropIndexes   = "dropIndexes"
+)
+
+// DefaultOperations are the operations restricted by default
+var DefaultOperations = []string{OpBulkDelete, OpCreateIndexes, OpDrop, OpDropDatabase, OpDropIndexes}
+
+var weekdays = map[string]time.Weekday{
+	"Sun": time.Sunday,
+	"Mon": time.Monday,
+	"Tue": time.Tuesday,
+	"Wed": time.Wednesday,
+	"Thu": time.Thursday,
+	"Fri": time.Friday,
+	"Sat": time.Saturday,
+}
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &MaintenanceWindowPlugin{
+			conf: MaintenanceWindowPluginConfig{
+				Operations: DefaultOperations,
+			},
+			now: time.Now,
+		}
+	})
+}
+
+type MaintenanceWindowPluginConfig struct {
+	// Windows are the maintenance windows (required)
+	Windows []*Window `bson:"windows"`
+	// Operations are the operations only allowed in windows: bulkDelete, bulkUpdate,
+	// createIndexes, drop, dropDatabase and dropIndexes (default all but bulkUpdate)
+	Operations []string `bson:"operations"`
+	// LogOnly logs operations outside of windows instead of rejecting them
+	LogOnly bool `bson:"logOnly"`
+	// AvoidDegradedCluster also restricts the operations while the backend cluster
+	// is degraded (e.g. in its Atlas maintenance), even during windows; the state
+	// of the cluster comes from the chain's cluster state provider (e.g. the atlas
+	// plugin)
+	AvoidDegradedCluster bool `bson:"avoidDegradedCluster"`
+	// Cluster is the name of the backend cluster in the router plugin (default "",
+	// the backend of a chain without a router)
+	Cluster string `bson:"cluster"`
+
+	operations map[string]struct{}
+}
+
+// Window is a weekly time window
+type Window struct {
+	// Days are the days of the week the window starts on ("Mon", "Tue", ...; default
+	// every day)
+	Days []string `bson:"days"`
+	// Start and End are the times of day ("15:04") the window starts and ends; an
+	// End before Start ends the window on the next day
+	Start string `bson:"start"`
+	End   string `bson:"end"`
+	// Timezone is the IANA timezone of the window (default UTC)
+	Timezone string `bson:"timezone"`
+
+	days       map[time.Weekday]struct{}
+	start, end time.Duration
+	loc        *time.Location
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w *Window) load() error {
+	days := w.Days
+	if len(days) == 0 {
+		days = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+	}
+	w.days = make(map[time.Weekday]struct{}, len(days))
+	for _, day := range days {
+		d, ok := weekdays[day]
+		if !ok {
+			return fmt.Errorf("invalid day %q; must be one of Mon, Tue, Wed, Thu, Fri, Sat, Sun", day)
+		}
+		w.days[d] = struct{}{}
+	}
+
+	var err error
+	if w.start, err = parseTimeOfDay(w.Start); err != nil {
+		return fmt.Errorf("invalid start: %w", err)
+	}
+	if w.end, err = parseTimeOfDay(w.End); err != nil {
+		return fmt.Errorf("invalid end: %w", err)
+	}
+	if w.end == w.start {
+		return fmt.Errorf("end must differ from start")
+	}
+
+	w.loc = time.UTC
+	if w.Timezone != "" {
+		if w.loc, err = time.LoadLocation(w.Timezone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// day returns the midnight of the day i days after t's
+func (w *Window) day(t time.Time, i int) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day()+i, 0, 0, 0, 0, w.loc)
+}
+
+// contains returns whether t is in the window
+func (w *Window) contains(t time.Time) bool {
+	t = t.In(w.loc)
+	offset := t.Sub(w.day(t, 0))
+	_, today := w.days[t.Weekday()]
+	if w.start < w.end {
+		return today && offset >= w.start && offset < w.end
+	}
+	// The window wraps past midnight; it either started today or yesterday
+	_, yesterday := w.days[w.day(t, -1).Weekday()]
+	return (today && offset >= w.start) || (yesterday && offset < w.end)
+}
+
+// next returns the next start of the window after t
+func (w *Window) next(t time.Time) time.Time {
+	t = t.In(w.loc)
+	for i := 0; i <= 7; i++ {
+		day := w.day(t, i)
+		if _, ok := w.days[day.Weekday()]; !ok {
+			continue
+		}
+		if start := day.Add(w.start); start.After(t) {
+			return start
+		}
+	}
+	return time.Time{}
+}
+
+func (w *Window) String() string {
+	days := "daily"
+	if len(w.Days) > 0 {
+		days = strings.Join(w.Days, ",")
+	}
+	return fmt.Sprintf("%s %s-%s %s", days, w.Start, w.End, w.loc)
+}
+
+// This is a plugin that only allows destructive operations (bulk deletes, index
+// builds, drops) during maintenance windows
+type MaintenanceWindowPlugin struct {
+	conf MaintenanceWindowPluginConfig
+
+	now func() time.Time
+
+	statesLock sync.RWMutex
+	states     plugins.ClusterStateProvider
+}
+
+func (p *MaintenanceWindowPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *MaintenanceWindowPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	if len(p.conf.Windows) == 0 {
+		return fmt.Errorf("windows are required")
+	}
+	for i, w := range p.conf.Windows {
+		if err := w.load(); err != nil {
+			return fmt.Errorf("invalid window %d: %w", i, err)
+		}
+	}
+
+	p.conf.operations = make(map[string]struct{}, len(p.conf.Operations))
+	for _, op := range p.conf.Operations {
+		switch op {
+		case OpBulkDelete, OpBulkUpdate, OpCreateIndexes, OpDrop, OpDropDatabase, OpDropIndexes:
+			p.conf.operations[op] = struct{}{}
+		default:
+			return fmt.Errorf("invalid operation %q", op)
+		}
+	}
+
+	return nil
+}
+
+// SetClusterStateProvider sets the provider of the backend cluster's state
+func (p *MaintenanceWindowPlugin) SetClusterStateProvider(c plugins.ClusterStateProvider) {
+	p.statesLock.Lock()
+	defer p.statesLock.Unlock()
+	p.states = c
+}
+
+// degraded returns whether operations are restricted as the backend cluster is
+// degraded
+func (p *MaintenanceWindowPlugin) degraded() bool {
+	if !p.conf.AvoidDegradedCluster {
+		return false
+	}
+	p.statesLock.RLock()
+	states := p.states
+	p.statesLock.RUnlock()
+	if states == nil {
+		return false
+	}
+	state, ok := states.ClusterState(p.conf.Cluster)
+	return ok && state.Degraded()
+}
+
+// operation returns the restricted operation of the command ("" if none)
+func operation(cmd command.Command) string {
+	switch cmd := cmd.(type) {
+	case *command.Delete:
+		for _, deleteDoc := range cmd.Deletes {
+			// A limit of 1 deletes a single document (deleteOne)
+			if limit, _ := bsonutil.Lookup(deleteDoc, "limit"); !bsonutil.BoolNumber(limit) {
+				return OpBulkDelete
+			}
+		}
+	case *command.Update:
+		for _, u := range cmd.Updates {
+			if bsonutil.GetBoolDefault(u.Multi, false) {
+				return OpBulkUpdate
+			}
+		}
+	case *command.CreateIndexes:
+		return OpCreateIndexes
+	case *command.Drop:
+		return OpDrop
+	case *command.DropDatabase:
+		return OpDropDatabase
+	case *command.DropIndexes, *command.DeleteIndexes:
+		return OpDropIndexes
+	}
+	return ""
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *MaintenanceWindowPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	op := operation(r.Command)
+	if _, ok := p.conf.operations[op]; !ok {
+		return next(ctx, r)
+	}
+
+	db, collection := command.GetCommandDatabase(r.Command), command.GetCommandCollection(r.Command)
+	ns := db
+	if collection != "" {
+		ns += "." + collection
+	}
+
+	if p.degraded() {
+		if p.conf.LogOnly {
+			logrus.Warningf("DEGRADED CLUSTER: %s (%s) on %s", r.CommandName, op, ns)
+			return next(ctx, r)
+		}
+		rejectedTotal.WithLabelValues(db, collection, op).Inc()
+		logrus.Warningf("DEGRADED CLUSTER REJECTED: %s (%s) on %s", r.CommandName, op, ns)
+		return mongoerror.IllegalOperation.ErrMessage(fmt.Sprintf(
+			"%s (%s) on %s isn't allowed while the cluster is degraded (in maintenance or changing topology)",
+			r.CommandName, op, ns)), nil
+	}
+
+	now := p.now()
+	var nextStart time.Time
+	for _, w := range p.conf.Windows {
+		if w.contains(now) {
+			return next(ctx, r)
+		}
+		if n := w.next(now); !n.IsZero() && (nextStart.IsZero() || n.Before(nextStart)) {
+			nextStart = n
+		}
+	}
+
+	if p.conf.LogOnly {
+		logrus.Warningf("OUTSIDE MAINTENANCE WINDOW: %s (%s) on %s", r.CommandName, op, ns)
+		return next(ctx, r)
+	}
+
+	rejectedTotal.WithLabelValues(db, collection, op).Inc()
+	logrus.Warningf("OUTSIDE MAINTENANCE WINDOW REJECTED: %s (%s) on %s", r.CommandName, op, ns)
+	windows := make([]string, len(p.conf.Windows))
+	for i, w := range p.conf.Windows {
+		windows[i] = w.String()
+	}
+	return mongoerror.IllegalOperation.ErrMessage(fmt.Sprintf(
+		"%s (%s) on %s is only allowed during maintenance windows (%s); the next window starts at %s",
+		r.CommandName, op, ns, strings.Join(windows, "; "), nextStart.Format(time.RFC3339))), nil
+}
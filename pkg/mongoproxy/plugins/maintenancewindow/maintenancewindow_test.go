@@ -0,0 +1,142 @@
+package maintenancewindow
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func TestMaintenanceWindow(t *testing.T) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skip(err)
+	}
+	// 2026-10-17 is a Saturday
+	sat := func(hour, minute int) time.Time { return time.Date(2026, 10, 17, hour, minute, 0, 0, la) }
+	sun := func(hour, minute int) time.Time { return time.Date(2026, 10, 18, hour, minute, 0, 0, la) }
+	wed := func(hour, minute int) time.Time { return time.Date(2026, 10, 14, hour, minute, 0, 0, la) }
+
+	conf := bson.D{{"windows", bson.A{
+		// Saturday night to Sunday morning
+		bson.D{{"days", bson.A{"Sat"}}, {"start", "22:00"}, {"end", "04:00"}, {"timezone", "America/Los_Angeles"}},
+		bson.D{{"days", bson.A{"Wed"}}, {"start", "02:00"}, {"end", "03:00"}, {"timezone", "America/Los_Angeles"}},
+	}}}
+
+	dropCmd := bson.D{{"drop", "coll"}, {"$db", "db"}}
+	deleteMany := bson.D{{"delete", "coll"}, {"deletes", bson.A{bson.D{{"q", bson.D{{"a", 1}}}, {"limit", 0}}}}, {"$db", "db"}}
+	deleteOne := bson.D{{"delete", "coll"}, {"deletes", bson.A{bson.D{{"q", bson.D{{"a", 1}}}, {"limit", 1}}}}, {"$db", "db"}}
+	updateMany := bson.D{{"update", "coll"}, {"updates", bson.A{bson.D{{"q", bson.D{{"a", 1}}}, {"u", bson.D{{"$set", bson.D{{"b", 1}}}}}, {"multi", true}}}}, {"$db", "db"}}
+	createIndexes := bson.D{{"createIndexes", "coll"}, {"indexes", bson.A{bson.D{{"key", bson.D{{"a", 1}}}, {"name", "a_1"}}}}, {"$db", "db"}}
+
+	tests := []struct {
+		now time.Time
+		cmd bson.D
+		ok  bool
+		// substring of the error
+		err string
+	}{
+		{sat(12, 0), dropCmd, false, "the next window starts at 2026-10-17T22:00:00-07:00"},
+		{sat(22, 0), dropCmd, true, ""},
+		{sun(3, 59), dropCmd, true, ""},
+		{sun(4, 0), dropCmd, false, "the next window starts at 2026-10-21T02:00:00-07:00"},
+		{wed(2, 30), dropCmd, true, ""},
+		{wed(3, 0), deleteMany, false, "delete (bulkDelete) on db.coll"},
+		{wed(3, 0), deleteOne, true, ""},
+		// bulkUpdate isn't restricted by default
+		{wed(3, 0), updateMany, true, ""},
+		{wed(3, 0), createIndexes, false, "createIndexes (createIndexes) on db.coll"},
+		{wed(3, 0), bson.D{{"find", "coll"}, {"$db", "db"}}, true, ""},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			d := &MaintenanceWindowPlugin{now: func() time.Time { return test.now }}
+			pl, _ := plugins.GetPlugin(Name)
+			d.conf = pl.(*MaintenanceWindowPlugin).conf
+			if err := d.Configure(conf); err != nil {
+				t.Fatal(err)
+			}
+			p := plugins.BuildPipeline([]plugins.Plugin{d}, func(context.Context, *plugins.Request) (bson.D, error) {
+				return bson.D{{"ok", 1}}, nil
+			})
+
+			cmd, ok := command.GetCommand(test.cmd[0].Key)
+			if !ok {
+				t.Fatalf("no such command: %s", test.cmd[0].Key)
+			}
+			if err := cmd.FromBSOND(test.cmd); err != nil {
+				t.Fatal(err)
+			}
+			result, err := p(context.TODO(), &plugins.Request{CommandName: test.cmd[0].Key, Command: cmd})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bsonutil.Ok(result) != test.ok {
+				t.Fatalf("expected ok=%v: %v", test.ok, result)
+			}
+			if test.err != "" {
+				errmsg, _ := bsonutil.Lookup(result, "errmsg")
+				if s, _ := errmsg.(string); !strings.Contains(s, test.err) {
+					t.Fatalf("expected error containing %q, got %q", test.err, s)
+				}
+			}
+		})
+	}
+}
+
+// testClusterState reports the cluster as degraded (or not)
+type testClusterState bool
+
+func (s testClusterState) ClusterState(cluster string) (plugins.ClusterState, bool) {
+	return plugins.ClusterState{Changing: bool(s)}, cluster == "us-west"
+}
+
+func TestDegradedCluster(t *testing.T) {
+	conf := bson.D{
+		{"windows", bson.A{bson.D{{"start", "00:00"}, {"end", "23:59"}}}},
+		{"avoidDegradedCluster", true},
+		{"cluster", "us-west"},
+	}
+	dropCmd := bson.D{{"drop", "coll"}, {"$db", "db"}}
+
+	tests := []struct {
+		states plugins.ClusterStateProvider
+		ok     bool
+	}{
+		{states: nil, ok: true},
+		{states: testClusterState(false), ok: true},
+		// Restricted operations are rejected during windows while the cluster is degraded
+		{states: testClusterState(true)},
+	}
+	for i, test := range tests {
+		pl, _ := plugins.GetPlugin(Name)
+		d := pl.(*MaintenanceWindowPlugin)
+		d.now = func() time.Time { return time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC) }
+		if err := d.Configure(conf); err != nil {
+			t.Fatal(err)
+		}
+		d.SetClusterStateProvider(test.states)
+
+		cmd, _ := command.GetCommand(dropCmd[0].Key)
+		if err := cmd.FromBSOND(dropCmd); err != nil {
+			t.Fatal(err)
+		}
+		result, err := d.Process(context.TODO(), &plugins.Request{CommandName: dropCmd[0].Key, Command: cmd}, func(context.Context, *plugins.Request) (bson.D, error) {
+			return bson.D{{"ok", 1}}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bsonutil.Ok(result) != test.ok {
+			t.Fatalf("%d: expected ok=%v: %v", i, test.ok, result)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package plugins
+
+import (
+	"context"
+	"sync"
+)
+
+type metadataContextKey struct{}
+
+// MetadataKey is a key in the request Metadata. Keys are compared by identity so
+// plugins should create them once (as package level variables) with NewMetadataKey.
+type MetadataKey struct {
+	name string
+}
+
+// NewMetadataKey returns a new MetadataKey with the given (descriptive) name
+func NewMetadataKey(name string) *MetadataKey {
+	return &MetadataKey{name: name}
+}
+
+// String returns the name of the key
+func (k *MetadataKey) String() string {
+	return "metadata key " + k.name
+}
+
+var (
+	// IdentityKey is the key for the resolved ClientIdentity of the request
+	IdentityKey = NewMetadataKey("identity")
+	// TenantKey is the key for the resolved tenant (string) of the request
+	TenantKey = NewMetadataKey("tenant")
+	// TraceIDKey is the key for the client's trace ID (string) of the request
+	TraceIDKey = NewMetadataKey("traceID")
+)
+
+// Metadata is a per-request bag of values which plugins can use to share
+// information (such as the resolved identity or tenant) with plugins later in
+// the pipeline (and post-commit hooks) instead of re-deriving it.
+type Metadata struct {
+	l sync.RWMutex
+	m map[*MetadataKey]interface{}
+}
+
+// NewMetadata returns an empty Metadata
+func NewMetadata() *Metadata {
+	return &Metadata{m: make(map[*MetadataKey]interface{})}
+}
+
+// Set sets the value for the key
+func (m *Metadata) Set(k *MetadataKey, v interface{}) {
+	if m == nil {
+		return
+	}
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.m[k] = v
+}
+
+// Get returns the value for the key (and whether it was set)
+func (m *Metadata) Get(k *MetadataKey) (interface{}, bool) {
+	if m == nil {
+		return nil, false
+	}
+	m.l.RLock()
+	defer m.l.RUnlock()
+	v, ok := m.m[k]
+	return v, ok
+}
+
+// Identity returns the identity set by an earlier plugin (nil if unset)
+func (m *Metadata) Identity() ClientIdentity {
+	v, _ := m.Get(IdentityKey)
+	ident, _ := v.(ClientIdentity)
+	return ident
+}
+
+// SetIdentity sets the resolved identity of the request
+func (m *Metadata) SetIdentity(ident ClientIdentity) {
+	m.Set(IdentityKey, ident)
+}
+
+// Tenant returns the tenant set by an earlier plugin ("" if unset)
+func (m *Metadata) Tenant() string {
+	v, _ := m.Get(TenantKey)
+	tenant, _ := v.(string)
+	return tenant
+}
+
+// SetTenant sets the resolved tenant of the request
+func (m *Metadata) SetTenant(tenant string) {
+	m.Set(TenantKey, tenant)
+}
+
+// TraceID returns the trace ID set by an earlier plugin ("" if unset)
+func (m *Metadata) TraceID() string {
+	v, _ := m.Get(TraceIDKey)
+	traceID, _ := v.(string)
+	return traceID
+}
+
+// SetTraceID sets the client's trace ID of the request
+func (m *Metadata) SetTraceID(traceID string) {
+	m.Set(TraceIDKey, traceID)
+}
+
+// WithMetadata returns a context carrying a new Metadata. If the context already
+// has a Metadata that is returned instead.
+func WithMetadata(ctx context.Context) (context.Context, *Metadata) {
+	if m := GetMetadata(ctx); m != nil {
+		return ctx, m
+	}
+	m := NewMetadata()
+	return context.WithValue(ctx, metadataContextKey{}, m), m
+}
+
+// GetMetadata returns the Metadata of the request (nil if the context has none).
+// Getters on a nil Metadata return zero values and setters are no-ops.
+func GetMetadata(ctx context.Context) *Metadata {
+	m, _ := ctx.Value(metadataContextKey{}).(*Metadata)
+	return m
+}
@@ -0,0 +1,62 @@
+package plugins
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type metadataPlugin struct {
+	noopPlugin
+	tenant string
+}
+
+func (p *metadataPlugin) Process(ctx context.Context, r *Request, next PipelineFunc) (bson.D, error) {
+	GetMetadata(ctx).SetTenant(p.tenant)
+	return next(ctx, r)
+}
+
+func TestMetadata(t *testing.T) {
+	if md := GetMetadata(context.TODO()); md != nil {
+		t.Fatalf("unexpected metadata: %v", md)
+	}
+	// nil metadata is safe to use
+	var md *Metadata
+	md.SetTenant("a")
+	if md.Tenant() != "" || md.Identity() != nil {
+		t.Fatalf("expected zero values from nil metadata")
+	}
+
+	ctx, md := WithMetadata(context.TODO())
+	if ctx2, md2 := WithMetadata(ctx); ctx2 != ctx || md2 != md {
+		t.Fatalf("WithMetadata should reuse existing metadata")
+	}
+
+	var seen string
+	pipe := BuildPipeline([]Plugin{&metadataPlugin{tenant: "tenantA"}}, func(ctx context.Context, r *Request) (bson.D, error) {
+		seen = GetMetadata(ctx).Tenant()
+		return bson.D{{"ok", 1}}, nil
+	})
+	if _, err := pipe(ctx, &Request{}); err != nil {
+		t.Fatal(err)
+	}
+	if seen != "tenantA" || md.Tenant() != "tenantA" {
+		t.Fatalf("tenant not propagated: seen=%q md=%q", seen, md.Tenant())
+	}
+
+	ident := NewStaticIdentity("test", "user", "role")
+	md.SetIdentity(ident)
+	if md.Identity() != ident {
+		t.Fatalf("mismatch in identity")
+	}
+
+	key := NewMetadataKey("custom")
+	if _, ok := md.Get(key); ok {
+		t.Fatalf("unexpected value for unset key")
+	}
+	md.Set(key, 1)
+	if v, ok := md.Get(key); !ok || v != 1 {
+		t.Fatalf("mismatch in custom value: %v", v)
+	}
+}
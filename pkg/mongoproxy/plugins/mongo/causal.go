@@ -0,0 +1,224 @@
+package mongo
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+)
+
+var causalReadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mongoproxy_plugins_mongo_causal_reads_total",
+	Help: "The total reads whose afterClusterTime was raised (raised) or set (added) to the session's latest operationTime",
+}, []string{"result"})
+
+// CausalConsistencyConfig makes reads the proxy routes (to any member of the
+// backend) wait for the operations their session already saw
+type CausalConsistencyConfig struct {
+	// AllSessions makes the reads of every session wait for the session's
+	// operations, not only those of causally consistent sessions (which send
+	// afterClusterTime)
+	AllSessions bool `bson:"allSessions"`
+	// MaxSessions is the maximum number of sessions tracked (default 100000)
+	MaxSessions *int `bson:"maxSessions"`
+	// SessionTimeout is how long unused sessions are tracked (default "30m", the
+	// server's logical session timeout)
+	SessionTimeout string `bson:"sessionTimeout"`
+}
+
+// causalTracker tracks the latest operationTime returned to each session
+type causalTracker struct {
+	allSessions bool
+	maxSessions int
+	timeout     time.Duration
+
+	l        sync.Mutex
+	sessions map[string]*sessionTime
+}
+
+type sessionTime struct {
+	operationTime primitive.Timestamp
+	lastUsed      time.Time
+}
+
+func newCausalTracker(conf *CausalConsistencyConfig) (*causalTracker, error) {
+	c := &causalTracker{
+		allSessions: conf.AllSessions,
+		maxSessions: 100000,
+		timeout:     30 * time.Minute,
+		sessions:    make(map[string]*sessionTime),
+	}
+	if conf.MaxSessions != nil {
+		if *conf.MaxSessions <= 0 {
+			return nil, fmt.Errorf("causalConsistency.maxSessions must be positive")
+		}
+		c.maxSessions = *conf.MaxSessions
+	}
+	if conf.SessionTimeout != "" {
+		var err error
+		if c.timeout, err = time.ParseDuration(conf.SessionTimeout); err != nil {
+			return nil, fmt.Errorf("invalid causalConsistency.sessionTimeout: %w", err)
+		}
+		if c.timeout <= 0 {
+			return nil, fmt.Errorf("causalConsistency.sessionTimeout must be positive")
+		}
+	}
+	return c, nil
+}
+
+// sessionKey returns the key of the command's session ("" if it has none)
+func sessionKey(cmd command.Command) string {
+	session := cmd.GetSession()
+	if session == nil {
+		return ""
+	}
+	if id, ok := bsonutil.Lookup(session.LSID, "id"); ok {
+		if b, ok := id.(primitive.Binary); ok {
+			return string(b.Data)
+		}
+	}
+	return ""
+}
+
+// observe records the operationTime of the command's result for its session
+func (c *causalTracker) observe(cmd command.Command, result bson.D) {
+	key := sessionKey(cmd)
+	if key == "" {
+		return
+	}
+	v, ok := bsonutil.Lookup(result, "operationTime")
+	if !ok {
+		return
+	}
+	operationTime, ok := v.(primitive.Timestamp)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	c.l.Lock()
+	defer c.l.Unlock()
+	s, ok := c.sessions[key]
+	if !ok {
+		if len(c.sessions) >= c.maxSessions {
+			c.evict(now)
+		}
+		s = &sessionTime{}
+		c.sessions[key] = s
+	}
+	if timestampAfter(operationTime, s.operationTime) {
+		s.operationTime = operationTime
+	}
+	s.lastUsed = now
+}
+
+// evict removes the expired sessions, or an arbitrary one if none are; the lock
+// must be held
+func (c *causalTracker) evict(now time.Time) {
+	for key, s := range c.sessions {
+		if now.Sub(s.lastUsed) > c.timeout {
+			delete(c.sessions, key)
+		}
+	}
+	if len(c.sessions) < c.maxSessions {
+		return
+	}
+	for key := range c.sessions {
+		delete(c.sessions, key)
+		break
+	}
+}
+
+// operationTime returns the latest operationTime of the command's session
+func (c *causalTracker) operationTime(cmd command.Command) (primitive.Timestamp, bool) {
+	key := sessionKey(cmd)
+	if key == "" {
+		return primitive.Timestamp{}, false
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+	s, ok := c.sessions[key]
+	if !ok || time.Since(s.lastUsed) > c.timeout {
+		return primitive.Timestamp{}, false
+	}
+	return s.operationTime, true
+}
+
+// readConcern returns the read concern of the reads which accept one
+func readConcern(cmd command.Command) (**command.ReadConcern, bool) {
+	switch cmd := cmd.(type) {
+	case *command.Find:
+		return &cmd.ReadConcern, true
+	case *command.Aggregate:
+		return &cmd.ReadConcern, true
+	case *command.Count:
+		return &cmd.ReadConcern, true
+	case *command.Distinct:
+		return &cmd.ReadConcern, true
+	}
+	return nil, false
+}
+
+// raise raises the afterClusterTime of the read to the latest operationTime of
+// its session (setting it if the session isn't causally consistent and all
+// sessions are tracked), so the read waits for the session's operations on
+// whichever member it's sent to. It returns whether the read was modified.
+func (c *causalTracker) raise(cmd command.Command) bool {
+	rc, ok := readConcern(cmd)
+	if !ok {
+		return false
+	}
+	// Transactions read from their own snapshot
+	if session := cmd.GetSession(); session == nil || session.TxnNumber != nil {
+		return false
+	}
+	operationTime, ok := c.operationTime(cmd)
+	if !ok {
+		return false
+	}
+
+	switch {
+	case *rc != nil && (*rc).AfterClusterTime != nil:
+		if !timestampAfter(operationTime, *(*rc).AfterClusterTime) {
+			return false
+		}
+		tmp := **rc
+		tmp.AfterClusterTime = &operationTime
+		*rc = &tmp
+		causalReadsTotal.WithLabelValues("raised").Inc()
+		return true
+
+	case c.allSessions:
+		// afterClusterTime isn't allowed with these levels
+		if *rc != nil && ((*rc).AtClusterTime != nil || (*rc).Level == "available" || (*rc).Level == "linearizable") {
+			return false
+		}
+		var tmp command.ReadConcern
+		if *rc != nil {
+			tmp = **rc
+		}
+		tmp.AfterClusterTime = &operationTime
+		*rc = &tmp
+		causalReadsTotal.WithLabelValues("added").Inc()
+		return true
+	}
+	return false
+}
+
+func (c *causalTracker) size() int {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return len(c.sessions)
+}
+
+// timestampAfter returns whether the timestamp a is after b
+func timestampAfter(a, b primitive.Timestamp) bool {
+	return a.T > b.T || (a.T == b.T && a.I > b.I)
+}
@@ -0,0 +1,60 @@
+package mongo
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/command"
+)
+
+func TestCausalConsistency(t *testing.T) {
+	session := func(id byte) command.Session {
+		return command.Session{LSID: bson.D{{"id", primitive.Binary{Subtype: 4, Data: []byte{id}}}}}
+	}
+	ts := func(t uint32) *primitive.Timestamp { return &primitive.Timestamp{T: t} }
+	find := func(s command.Session, rc *command.ReadConcern) *command.Find {
+		return &command.Find{Collection: "c", ReadConcern: rc, Common: command.Common{Session: s}}
+	}
+
+	tests := []struct {
+		allSessions bool
+		cmd         *command.Find
+		// afterClusterTime is the expected afterClusterTime of the read (nil if unset)
+		afterClusterTime *primitive.Timestamp
+	}{
+		// Causally consistent reads wait for the session's latest operation
+		{cmd: find(session(1), &command.ReadConcern{AfterClusterTime: ts(5)}), afterClusterTime: ts(10)},
+		{cmd: find(session(1), &command.ReadConcern{AfterClusterTime: ts(20)}), afterClusterTime: ts(20)},
+		// Other sessions' reads only if all sessions are tracked
+		{cmd: find(session(1), nil)},
+		{allSessions: true, cmd: find(session(1), nil), afterClusterTime: ts(10)},
+		{allSessions: true, cmd: find(session(1), &command.ReadConcern{Level: "available"})},
+		// Unknown sessions and reads without one aren't changed
+		{allSessions: true, cmd: find(session(2), nil)},
+		{allSessions: true, cmd: find(command.Session{}, nil)},
+	}
+	for i, test := range tests {
+		c, err := newCausalTracker(&CausalConsistencyConfig{AllSessions: test.allSessions})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.observe(find(session(1), nil), bson.D{{"ok", 1}, {"operationTime", primitive.Timestamp{T: 10}}})
+		// Older responses don't move the session back
+		c.observe(find(session(1), nil), bson.D{{"ok", 1}, {"operationTime", primitive.Timestamp{T: 8}}})
+
+		original := test.cmd.ReadConcern
+		modified := c.raise(test.cmd)
+		var got *primitive.Timestamp
+		if test.cmd.ReadConcern != nil {
+			got = test.cmd.ReadConcern.AfterClusterTime
+		}
+		if modified && test.cmd.ReadConcern == original {
+			t.Fatalf("%d: the client's read concern was modified in place", i)
+		}
+		if (got == nil) != (test.afterClusterTime == nil) || (got != nil && *got != *test.afterClusterTime) {
+			t.Fatalf("%d: expected afterClusterTime %v, got %v", i, test.afterClusterTime, got)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/description"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+var (
+	hedgedReads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_mongo_hedged_reads_total",
+		Help: "The total finds exceeding the hedge delay by outcome",
+	}, []string{"result"})
+)
+
+// HedgedReadsConfig configures hedged reads: finds still running after Delay are
+// sent to another eligible server too and the first response is returned.
+type HedgedReadsConfig struct {
+	// Delay after which a find is hedged (e.g. "50ms"; required)
+	Delay string `bson:"delay"`
+	// BudgetRatio is the ratio of finds which may be hedged (default 0.1)
+	BudgetRatio *float64 `bson:"budgetRatio"`
+	// BudgetBurst is the number of hedges allowed above the ratio in a burst
+	// (default 10)
+	BudgetBurst *float64 `bson:"budgetBurst"`
+}
+
+// hedger sends finds to a second server once they exceed the delay, within the
+// budget
+type hedger struct {
+	delay  time.Duration
+	budget *hedgeBudget
+}
+
+func newHedger(conf *HedgedReadsConfig) (*hedger, error) {
+	if conf.Delay == "" {
+		return nil, fmt.Errorf("hedgedReads.delay is required")
+	}
+	delay, err := time.ParseDuration(conf.Delay)
+	if err != nil {
+		return nil, err
+	}
+	if delay <= 0 {
+		return nil, fmt.Errorf("hedgedReads.delay must be positive")
+	}
+	ratio, burst := 0.1, 10.0
+	if conf.BudgetRatio != nil {
+		ratio = *conf.BudgetRatio
+	}
+	if conf.BudgetBurst != nil {
+		burst = *conf.BudgetBurst
+	}
+	if ratio < 0 || ratio > 1 {
+		return nil, fmt.Errorf("hedgedReads.budgetRatio must be between 0 and 1")
+	}
+	if burst < 1 {
+		return nil, fmt.Errorf("hedgedReads.budgetBurst must be at least 1")
+	}
+	return &hedger{delay: delay, budget: &hedgeBudget{ratio: ratio, burst: burst, tokens: burst}}, nil
+}
+
+// hedgeBudget limits hedges to a ratio of the eligible finds (so a slow backend
+// doesn't get twice the load): every find deposits ratio tokens (up to burst) and
+// every hedge withdraws one
+type hedgeBudget struct {
+	lock                 sync.Mutex
+	ratio, burst, tokens float64
+}
+
+func (b *hedgeBudget) deposit() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.tokens += b.ratio; b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+func (b *hedgeBudget) withdraw() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// hedgeable returns whether the command is an idempotent find which can be hedged
+func hedgeable(cmd command.Command) bool {
+	find, ok := cmd.(*command.Find)
+	if !ok {
+		return false
+	}
+	if (find.Tailable != nil && *find.Tailable) || (find.AwaitData != nil && *find.AwaitData) {
+		return false
+	}
+	// Reads in a transaction have to go to the transaction's server
+	if session := find.GetSession(); session != nil && session.TxnNumber != nil {
+		return false
+	}
+	return true
+}
+
+// pinnedDeployment is the topology with the given server selected, so commands
+// are sent the same way as to the topology
+type pinnedDeployment struct {
+	*topology.Topology
+	server driver.Server
+}
+
+func (d pinnedDeployment) SelectServer(context.Context, description.ServerSelector) (driver.Server, error) {
+	return d.server, nil
+}
+
+type hedgeResult struct {
+	d      bsoncore.Document
+	server driver.Server
+	err    error
+}
+
+// serverAddr returns the address of the server selected from the topology
+func serverAddr(server driver.Server) string {
+	if s, ok := server.(*topology.SelectedServer); ok {
+		return s.Description().Addr.String()
+	}
+	return ""
+}
+
+// otherServer returns another server than the given one eligible by the selector
+// (nil if there is none); unlike the topology's selection it doesn't wait for one
+func (p *MongoPlugin) otherServer(server driver.Server, selector description.ServerSelector) driver.Server {
+	addr := serverAddr(server)
+	desc := p.t.Description()
+	var allowed []description.Server
+	for _, s := range desc.Servers {
+		if s.Kind != description.Unknown && s.Addr.String() != addr {
+			allowed = append(allowed, s)
+		}
+	}
+	suitable, err := selector.SelectServer(desc, allowed)
+	if err != nil || len(suitable) == 0 {
+		return nil
+	}
+	other, err := p.t.FindServer(suitable[rand.Intn(len(suitable))])
+	if err != nil || other == nil {
+		return nil
+	}
+	return other
+}
+
+// hedgedRunCommand runs the find on a server and, if it hasn't responded after
+// the hedge delay, on another one too, returning the first response
+func (p *MongoPlugin) hedgedRunCommand(ctx context.Context, db string, cmd command.Command) (bsoncore.Document, driver.Server, error) {
+	cmdDoc, err := marshal(ctx, cmd)
+	if err != nil {
+		return nil, nil, err
+	}
+	var selector description.ServerSelector = readSelector
+	if gated := p.gatedSelector(db, cmd); gated != nil {
+		selector = gated
+		defer gated.count(db, cmd)
+	}
+	first, err := p.t.SelectServer(ctx, selector)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.hedge.budget.deposit()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan hedgeResult, 2)
+	attempt := func(server driver.Server) {
+		d, s, err := p.execute(ctx, db, cmdDoc, pinnedDeployment{p.t, server}, readSelector)
+		results <- hedgeResult{d, s, err}
+	}
+	go attempt(first)
+
+	timer := time.NewTimer(p.hedge.delay)
+	defer timer.Stop()
+	select {
+	case res := <-results:
+		return res.d, res.server, res.err
+	case <-timer.C:
+	}
+
+	second := p.otherServer(first, selector)
+	if second == nil {
+		hedgedReads.WithLabelValues("no_server").Inc()
+		res := <-results
+		return res.d, res.server, res.err
+	}
+	if !p.hedge.budget.withdraw() {
+		hedgedReads.WithLabelValues("budget_exhausted").Inc()
+		res := <-results
+		return res.d, res.server, res.err
+	}
+	go attempt(second)
+
+	res := <-results
+	// A failed attempt (e.g. the server is down) doesn't win over the other
+	if res.err != nil && len(res.d) == 0 && ctx.Err() == nil {
+		res = <-results
+	} else {
+		go p.discard(db, command.GetCommandCollection(cmd), results)
+	}
+	if serverAddr(res.server) == serverAddr(second) {
+		hedgedReads.WithLabelValues("hedge_won").Inc()
+	} else {
+		hedgedReads.WithLabelValues("hedge_lost").Inc()
+	}
+	return res.d, res.server, res.err
+}
+
+// discard waits for the losing attempt of a hedged find (cancelled when the
+// winner returned) and kills its cursor if it got one
+func (p *MongoPlugin) discard(db, collection string, results chan hedgeResult) {
+	res := <-results
+	cursorID, ok := bsoncore.Document(res.d).Lookup("cursor", "id").Int64OK()
+	if !ok || cursorID == 0 || res.server == nil {
+		return
+	}
+	cmdDoc, err := bson.Marshal(bson.D{{"killCursors", collection}, {"cursors", bson.A{cursorID}}})
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, _, err := p.execute(ctx, db, cmdDoc, pinnedDeployment{p.t, res.server}, readSelector); err != nil {
+		logrus.Debugf("error killing the cursor of a hedged find: %v", err)
+	}
+}
+
+// useHedge returns whether the request should be hedged
+func (p *MongoPlugin) useHedge(r *plugins.Request) bool {
+	return p.hedge != nil && hedgeable(r.Command)
+}
@@ -0,0 +1,232 @@
+package mongo
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/mongo/description"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+
+	"github.com/wish/mongoproxy/pkg/command"
+)
+
+var (
+	memberLagGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mongoproxy_plugins_mongo_member_replication_lag_seconds",
+		Help: "The estimated replication lag of each secondary of the backend replica set",
+	}, []string{"member"})
+	readGatingTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_mongo_read_gating_total",
+		Help: "The total secondary reads by whether they were sent to a secondary within the max lag or fell back to the primary",
+	}, []string{"db", "collection", "result"})
+)
+
+// ReadGatingConfig gates the reads sent to the secondaries of a replica set by
+// their replication lag: secondaries lagging more than the max lag of the read's
+// namespace aren't read from, and reads fall back to the primary if all are.
+type ReadGatingConfig struct {
+	// MaxLag is the replication lag above which secondaries aren't read from
+	// (default "10s")
+	MaxLag string `bson:"maxLag"`
+	// Namespaces are the max lags of databases ("db") and collections
+	// ("db.collection"), overriding MaxLag
+	Namespaces map[string]string `bson:"namespaces"`
+	// MonitorInterval is how often the lag of the members is exported (default "5s")
+	MonitorInterval string `bson:"monitorInterval"`
+}
+
+// readGate selects the secondaries within the max lag of reads
+type readGate struct {
+	maxLag     time.Duration
+	namespaces map[string]time.Duration
+	interval   time.Duration
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newReadGate(conf *ReadGatingConfig) (*readGate, error) {
+	g := &readGate{maxLag: 10 * time.Second, interval: 5 * time.Second, namespaces: make(map[string]time.Duration)}
+	var err error
+	if conf.MaxLag != "" {
+		if g.maxLag, err = time.ParseDuration(conf.MaxLag); err != nil {
+			return nil, fmt.Errorf("invalid readGating.maxLag: %w", err)
+		}
+	}
+	for ns, maxLag := range conf.Namespaces {
+		if ns == "" || strings.HasPrefix(ns, ".") || strings.HasSuffix(ns, ".") {
+			return nil, fmt.Errorf("invalid readGating namespace %q; must be db or db.collection", ns)
+		}
+		if g.namespaces[ns], err = time.ParseDuration(maxLag); err != nil {
+			return nil, fmt.Errorf("invalid readGating maxLag of %s: %w", ns, err)
+		}
+	}
+	if conf.MonitorInterval != "" {
+		if g.interval, err = time.ParseDuration(conf.MonitorInterval); err != nil {
+			return nil, fmt.Errorf("invalid readGating.monitorInterval: %w", err)
+		}
+		if g.interval <= 0 {
+			return nil, fmt.Errorf("readGating.monitorInterval must be positive")
+		}
+	}
+	return g, nil
+}
+
+// maxLagOf returns the max lag of the collection, that of its database, or the default
+func (g *readGate) maxLagOf(db, collection string) time.Duration {
+	if maxLag, ok := g.namespaces[db+"."+collection]; ok {
+		return maxLag
+	}
+	if maxLag, ok := g.namespaces[db]; ok {
+		return maxLag
+	}
+	return g.maxLag
+}
+
+// gatedReadModes are the read preference modes which may read from secondaries
+var gatedReadModes = map[string]struct{}{
+	"secondary":          {},
+	"secondaryPreferred": {},
+	"nearest":            {},
+}
+
+// gatedSelector selects the servers a read may be sent to; fallback is set if
+// the last selection fell back to the primary
+type gatedSelector struct {
+	maxLag   time.Duration
+	nearest  bool
+	fallback bool
+}
+
+// selector returns the selector of the command run on the database, or nil if
+// it isn't gated
+func (g *readGate) selector(db string, cmd command.Command) *gatedSelector {
+	mode := command.GetCommandReadPreferenceMode(cmd)
+	if _, ok := gatedReadModes[mode]; !ok {
+		return nil
+	}
+	return &gatedSelector{
+		maxLag:  g.maxLagOf(db, command.GetCommandCollection(cmd)),
+		nearest: mode == "nearest",
+	}
+}
+
+// SelectServer selects the secondaries within the max lag (and the primary for
+// nearest reads), or the primary if there are none. Servers of other topologies
+// (e.g. mongos) aren't gated as they route reads themselves.
+func (s *gatedSelector) SelectServer(t description.Topology, candidates []description.Server) ([]description.Server, error) {
+	if t.Kind != description.ReplicaSetWithPrimary && t.Kind != description.ReplicaSetNoPrimary {
+		return candidates, nil
+	}
+	var primary, fresh []description.Server
+	for _, c := range candidates {
+		switch c.Kind {
+		case description.RSPrimary:
+			primary = append(primary, c)
+		case description.RSSecondary:
+			if replicationLag(t, c) <= s.maxLag {
+				fresh = append(fresh, c)
+			}
+		}
+	}
+	s.fallback = len(fresh) == 0
+	if s.fallback || s.nearest {
+		return append(fresh, primary...), nil
+	}
+	return fresh, nil
+}
+
+// replicationLag estimates how far the secondary is behind the primary from the
+// last writes they reported in their heartbeats (or behind the most up to date
+// secondary if there is no primary)
+func replicationLag(t description.Topology, s description.Server) time.Duration {
+	var lag time.Duration
+	primary, ok := topologyPrimary(t)
+	if ok {
+		lag = s.LastUpdateTime.Sub(s.LastWriteTime) - primary.LastUpdateTime.Sub(primary.LastWriteTime)
+	} else {
+		var latest time.Time
+		for _, other := range t.Servers {
+			if other.Kind == description.RSSecondary && other.LastWriteTime.After(latest) {
+				latest = other.LastWriteTime
+			}
+		}
+		lag = latest.Sub(s.LastWriteTime)
+	}
+	if lag < 0 {
+		return 0
+	}
+	return lag
+}
+
+func topologyPrimary(t description.Topology) (description.Server, bool) {
+	for _, s := range t.Servers {
+		if s.Kind == description.RSPrimary {
+			return s, true
+		}
+	}
+	return description.Server{}, false
+}
+
+// start exports the lag of the members of the topology every interval until stopped
+func (g *readGate) start(t *topology.Topology) {
+	g.stop = make(chan struct{})
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		ticker := time.NewTicker(g.interval)
+		defer ticker.Stop()
+		members := make(map[string]struct{})
+		for {
+			select {
+			case <-g.stop:
+				for member := range members {
+					memberLagGauge.DeleteLabelValues(member)
+				}
+				return
+			case <-ticker.C:
+				members = exportLags(t.Description(), members)
+			}
+		}
+	}()
+}
+
+// exportLags sets the lag of the secondaries of the topology, removing those of
+// the previous members which no longer are secondaries
+func exportLags(t description.Topology, previous map[string]struct{}) map[string]struct{} {
+	members := make(map[string]struct{})
+	for _, s := range t.Servers {
+		if s.Kind != description.RSSecondary {
+			continue
+		}
+		member := s.Addr.String()
+		members[member] = struct{}{}
+		memberLagGauge.WithLabelValues(member).Set(replicationLag(t, s).Seconds())
+	}
+	for member := range previous {
+		if _, ok := members[member]; !ok {
+			memberLagGauge.DeleteLabelValues(member)
+		}
+	}
+	return members
+}
+
+func (g *readGate) close() {
+	if g.stop != nil {
+		close(g.stop)
+		g.wg.Wait()
+	}
+}
+
+// count counts the read by whether its last selection fell back to the primary
+func (s *gatedSelector) count(db string, cmd command.Command) {
+	result := "secondary"
+	if s.fallback {
+		result = "primary_fallback"
+	}
+	readGatingTotal.WithLabelValues(db, command.GetCommandCollection(cmd), result).Inc()
+}
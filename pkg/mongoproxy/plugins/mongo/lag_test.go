@@ -0,0 +1,91 @@
+package mongo
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/address"
+	"go.mongodb.org/mongo-driver/mongo/description"
+
+	"github.com/wish/mongoproxy/pkg/command"
+)
+
+func TestReadGating(t *testing.T) {
+	g, err := newReadGate(&ReadGatingConfig{
+		MaxLag:     "5s",
+		Namespaces: map[string]string{"reports": "1m", "orders.payments": "1s"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	member := func(addr string, kind description.ServerKind, lag time.Duration) description.Server {
+		return description.Server{Addr: address.Address(addr), Kind: kind, LastUpdateTime: now, LastWriteTime: now.Add(-lag)}
+	}
+	topo := description.Topology{
+		Kind: description.ReplicaSetWithPrimary,
+		Servers: []description.Server{
+			member("primary:27017", description.RSPrimary, 0),
+			member("fresh:27017", description.RSSecondary, 2*time.Second),
+			member("lagging:27017", description.RSSecondary, 30*time.Second),
+		},
+	}
+	find := func(db, collection, mode string) command.Command {
+		return &command.Find{Collection: collection, Common: command.Common{ReadPreference: &command.ReadPreference{Mode: mode}}}
+	}
+
+	tests := []struct {
+		db, collection, mode string
+		// selected are the addresses selected (nil if the read isn't gated)
+		selected []string
+		fallback bool
+	}{
+		{db: "orders", collection: "items", mode: "primary"},
+		{db: "orders", collection: "items", mode: "secondary", selected: []string{"fresh:27017"}},
+		{db: "orders", collection: "items", mode: "nearest", selected: []string{"fresh:27017", "primary:27017"}},
+		// The collection's max lag overrides the default
+		{db: "orders", collection: "payments", mode: "secondaryPreferred", selected: []string{"primary:27017"}, fallback: true},
+		// And the database's
+		{db: "reports", collection: "daily", mode: "secondary", selected: []string{"fresh:27017", "lagging:27017"}},
+	}
+	for i, test := range tests {
+		s := g.selector(test.db, find(test.db, test.collection, test.mode))
+		if test.selected == nil {
+			if s != nil {
+				t.Fatalf("%d: expected the read not to be gated", i)
+			}
+			continue
+		}
+		selected, err := s.SelectServer(topo, topo.Servers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var addrs []string
+		for _, server := range selected {
+			addrs = append(addrs, server.Addr.String())
+		}
+		if len(addrs) != len(test.selected) || s.fallback != test.fallback {
+			t.Fatalf("%d: expected %v (fallback %v), got %v (fallback %v)", i, test.selected, test.fallback, addrs, s.fallback)
+		}
+		for j := range addrs {
+			if addrs[j] != test.selected[j] {
+				t.Fatalf("%d: expected %v, got %v", i, test.selected, addrs)
+			}
+		}
+	}
+
+	// Without a primary secondaries lag behind the most up to date one
+	topo.Kind = description.ReplicaSetNoPrimary
+	topo.Servers = topo.Servers[1:]
+	if lag := replicationLag(topo, topo.Servers[1]); lag != 28*time.Second {
+		t.Fatalf("unexpected lag %s", lag)
+	}
+
+	// Other topologies (e.g. mongos) aren't gated
+	mongos := []description.Server{member("mongos:27017", description.Mongos, 0)}
+	s := g.selector("orders", find("orders", "items", "secondary"))
+	if selected, _ := s.SelectServer(description.Topology{Kind: description.Sharded, Servers: mongos}, mongos); len(selected) != 1 {
+		t.Fatalf("expected mongos to be selected, got %v", selected)
+	}
+}
@@ -2,10 +2,16 @@ package mongo
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/event"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
 )
 
 var (
@@ -19,6 +25,11 @@ var (
 		Help: "The duration of mongo commands",
 	}, []string{"address"})
 
+	connectionsIdleClosedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_mongo_connection_idle_closed_total",
+		Help: "The total connections closed for exceeding maxConnIdleTime",
+	}, []string{"address"})
+
 	connectionPoolSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "mongoproxy_plugins_mongo_connection_pool_available_count",
 		Help: "The current number of available connections in the pool",
@@ -30,6 +41,48 @@ var (
 	}, []string{"address"})
 )
 
+// poolStats tracks the connection pools per address (for serverStatus)
+var poolStats = &pools{m: make(map[string]*pool)}
+
+type pool struct {
+	Created   int64 `bson:"totalCreated"`
+	Closed    int64 `bson:"totalClosed"`
+	Available int64 `bson:"available"`
+	InUse     int64 `bson:"inUse"`
+}
+
+type pools struct {
+	l sync.Mutex
+	m map[string]*pool
+}
+
+func (p *pools) update(address string, f func(*pool)) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	s, ok := p.m[address]
+	if !ok {
+		s = &pool{}
+		p.m[address] = s
+	}
+	f(s)
+}
+
+// get returns the stats keyed by address
+func (p *pools) get() bson.D {
+	p.l.Lock()
+	defer p.l.Unlock()
+	addresses := make([]string, 0, len(p.m))
+	for address := range p.m {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	d := make(bson.D, len(addresses))
+	for i, address := range addresses {
+		d[i] = bson.E{address, *p.m[address]}
+	}
+	return d
+}
+
 // Pool Metrics
 var PoolMonitor = event.PoolMonitor{
 	Event: func(e *event.PoolEvent) {
@@ -37,15 +90,22 @@ var PoolMonitor = event.PoolMonitor{
 		case "ConnectionCreated":
 			connectionsCreatedTotal.WithLabelValues(e.Address).Inc()
 			connectionPoolSize.WithLabelValues(e.Address).Inc()
-		case "ConnectionClosedEvent":
+			poolStats.update(e.Address, func(s *pool) { s.Created++; s.Available++ })
+		case event.ConnectionClosed:
 			connectionsClosedTotal.WithLabelValues(e.Address).Inc()
+			if e.Reason == event.ReasonIdle {
+				connectionsIdleClosedTotal.WithLabelValues(e.Address).Inc()
+			}
 			connectionPoolSize.WithLabelValues(e.Address).Dec()
+			poolStats.update(e.Address, func(s *pool) { s.Closed++; s.Available-- })
 		case "ConnectionCheckedOut":
 			connectionPoolSize.WithLabelValues(e.Address).Dec()
 			inUseConnections.WithLabelValues(e.Address).Inc()
+			poolStats.update(e.Address, func(s *pool) { s.Available--; s.InUse++ })
 		case "ConnectionCheckedIn":
 			connectionPoolSize.WithLabelValues(e.Address).Inc()
 			inUseConnections.WithLabelValues(e.Address).Dec()
+			poolStats.update(e.Address, func(s *pool) { s.Available++; s.InUse-- })
 		}
 	},
 }
@@ -60,34 +120,29 @@ var CommandMonitor = event.CommandMonitor{
 	},
 }
 
-/*
+// ServerMonitor publishes a topology event when a server's kind changes (e.g. a
+// new primary or an unreachable server)
 var ServerMonitor = event.ServerMonitor{
 	ServerDescriptionChanged: func(e *event.ServerDescriptionChangedEvent) {
-		fmt.Println("HandleServerDescriptionChanged", e)
-	},
-	ServerOpening: func(e *event.ServerOpeningEvent) {
-		fmt.Println("HandleServerOpening", e)
-	},
-	ServerClosed: func(e *event.ServerClosedEvent) {
-		fmt.Println("HandleServerClosed", e)
-	},
-	TopologyDescriptionChanged: func(e *event.TopologyDescriptionChangedEvent) {
-		fmt.Println("HandleTopologyDescriptionChanged", e)
-	},
-	TopologyOpening: func(e *event.TopologyOpeningEvent) {
-		fmt.Println("HandleTopologyOpening", e)
-	},
-	TopologyClosed: func(e *event.TopologyClosedEvent) {
-		fmt.Println("HandleTopologyClosed", e)
-	},
-	ServerHeartbeatStarted: func(e *event.ServerHeartbeatStartedEvent) {
-		fmt.Println("HandleServerHeartbeatStarted", e)
-	},
-	ServerHeartbeatSucceeded: func(e *event.ServerHeartbeatSucceededEvent) {
-		fmt.Println("HandleServerHeartbeatSucceeded", e)
-	},
-	ServerHeartbeatFailed: func(e *event.ServerHeartbeatFailedEvent) {
-		fmt.Println("HandleServerHeartbeatFailed", e)
+		if e.PreviousDescription.Kind == e.NewDescription.Kind || !plugins.EventSubscribers() {
+			return
+		}
+		fields := map[string]interface{}{
+			"address":      e.Address.String(),
+			"previousKind": e.PreviousDescription.Kind.String(),
+			"kind":         e.NewDescription.Kind.String(),
+		}
+		if e.NewDescription.SetName != "" {
+			fields["setName"] = e.NewDescription.SetName
+		}
+		if e.NewDescription.LastError != nil {
+			fields["error"] = e.NewDescription.LastError.Error()
+		}
+		plugins.PublishEvent(&plugins.Event{
+			Type:    plugins.EventTopology,
+			Source:  Name,
+			Message: fmt.Sprintf("%s changed from %s to %s", e.Address, e.PreviousDescription.Kind, e.NewDescription.Kind),
+			Fields:  fields,
+		})
 	},
 }
-*/
@@ -57,6 +57,11 @@ func (c contextKey) String() string {
 
 var (
 	contextKeyServer = contextKey("mongo.server")
+	// contextKeyForwarded is the marshalled client forwarded with the commands
+	contextKeyForwarded = contextKey("mongo.forwarded")
+	// contextKeyReplyStream is the stream the reply of the command run is
+	// streamed to (see streamConn)
+	contextKeyReplyStream = contextKey("mongo.replyStream")
 )
 
 const Name = "mongo"
@@ -87,13 +92,46 @@ type MongoPluginConfig struct {
 	SocketTimeout *string `bson:"socketTimeout"`
 	// EnableDNSDiscovery enables background resolution of the DNS results to set the host list of the mongo driver
 	EnableDNSDiscovery bool `bson:"enableDNSDiscovery"`
+	// How often the SRV records of a mongodb+srv:// mongoAddr are resolved again. Default 60s, 0s disables
+	SRVRescanInterval *string `bson:"srvRescanInterval"`
+	// HedgedReads sends slow finds to another server too (disabled by default)
+	HedgedReads *HedgedReadsConfig `bson:"hedgedReads"`
+	// Connections opened to each server during the proxy's warm-up. Default is minPoolSize
+	WarmUpConnections *uint64 `bson:"warmUpConnections"`
+	// ReadGating keeps secondary reads off lagging secondaries (disabled by default)
+	ReadGating *ReadGatingConfig `bson:"readGating"`
+	// CausalConsistency makes reads wait for their session's operations (disabled by default)
+	CausalConsistency *CausalConsistencyConfig `bson:"causalConsistency"`
+	// ForwardClient forwards the client of each command to the backend, another
+	// mongoproxy trusting this one (disabled by default)
+	ForwardClient *ForwardClientConfig `bson:"forwardClient"`
+	// StreamReplies streams the cursor replies of finds and getMores to clients as
+	// they are read from the backend, when the chain allows it (default true; not
+	// over TLS)
+	StreamReplies *bool `bson:"streamReplies"`
+}
+
+// ForwardClientConfig configures forwarding the original client of commands to a
+// downstream proxy
+type ForwardClientConfig struct {
+	// KeyFile holds the base64 encoded key the forwarded clients are signed with,
+	// one of the downstream proxy's trustedProxies keys (required)
+	KeyFile string `bson:"keyFile"`
 }
 
 // This is a plugin that handles sending the request to the acutual downstream mongo
 type MongoPlugin struct {
-	conf MongoPluginConfig
-	c    *mongo.Client
-	t    *topology.Topology
+	conf  MongoPluginConfig
+	c     *mongo.Client
+	t     *topology.Topology
+	hedge *hedger
+	gate  *readGate
+	// causal tracks the operationTime of sessions
+	causal *causalTracker
+	// forwardKey signs the forwarded clients (nil if they aren't forwarded)
+	forwardKey []byte
+	// srv rescans the SRV records of a mongodb+srv:// backend
+	srv *srvRescanner
 }
 
 func (p *MongoPlugin) Name() string { return Name }
@@ -113,8 +151,9 @@ func (p *MongoPlugin) Configure(d bson.D) error {
 
 	// Do setup
 	opts := &options.ClientOptions{
-		PoolMonitor: &PoolMonitor,
-		Monitor:     &CommandMonitor,
+		PoolMonitor:   &PoolMonitor,
+		Monitor:       &CommandMonitor,
+		ServerMonitor: &ServerMonitor,
 	}
 
 	if p.conf.ConnectTimeout != nil {
@@ -129,6 +168,10 @@ func (p *MongoPlugin) Configure(d bson.D) error {
 		opts.Compressors = p.conf.Compressors
 	}
 
+	if p.conf.StreamReplies == nil || *p.conf.StreamReplies {
+		opts.Dialer = &streamDialer{}
+	}
+
 	if p.conf.HeartbeatInterval != nil {
 		d, err := time.ParseDuration(*p.conf.HeartbeatInterval)
 		if err != nil {
@@ -169,6 +212,45 @@ func (p *MongoPlugin) Configure(d bson.D) error {
 		opts.SocketTimeout = &d
 	}
 
+	if p.conf.HedgedReads != nil {
+		if p.hedge, err = newHedger(p.conf.HedgedReads); err != nil {
+			return err
+		}
+	}
+
+	if p.conf.ReadGating != nil {
+		if p.gate, err = newReadGate(p.conf.ReadGating); err != nil {
+			return err
+		}
+	}
+
+	if p.conf.CausalConsistency != nil {
+		if p.causal, err = newCausalTracker(p.conf.CausalConsistency); err != nil {
+			return err
+		}
+	}
+
+	if p.conf.ForwardClient != nil {
+		if p.conf.ForwardClient.KeyFile == "" {
+			return fmt.Errorf("forwardClient.keyFile is required")
+		}
+		keys, err := plugins.LoadForwardingKeys([]string{p.conf.ForwardClient.KeyFile})
+		if err != nil {
+			return err
+		}
+		p.forwardKey = keys[0]
+	}
+
+	if isSRV(p.conf.MongoAddr) {
+		if p.conf.EnableDNSDiscovery {
+			return fmt.Errorf("enableDNSDiscovery can't be used with a mongodb+srv address")
+		}
+		if p.srv, err = newSRVRescanner(p.conf.MongoAddr, p.conf.SRVRescanInterval); err != nil {
+			return err
+		}
+	}
+
+	// SRV addresses are resolved (with their TXT options) here
 	opts = opts.ApplyURI(p.conf.MongoAddr)
 	// If we have EnableDNSDiscovery we will be overriding the IPs etc. but we want to continue
 	// asking for the same ServerName
@@ -187,6 +269,12 @@ func (p *MongoPlugin) Configure(d bson.D) error {
 
 	p.c = client
 	p.t = extractTopology(client)
+	if p.gate != nil {
+		p.gate.start(p.t)
+	}
+	if p.srv != nil {
+		p.srv.start(opts.Hosts, p.t.ProcessSRVResults)
+	}
 
 	if p.conf.EnableDNSDiscovery {
 		discoveryClient, err := discovery.NewDiscoveryFromEnv()
@@ -230,31 +318,140 @@ func (p *MongoPlugin) Configure(d bson.D) error {
 	return nil
 }
 
+// Stop disconnects from the downstream mongo
+func (p *MongoPlugin) Stop(ctx context.Context) error {
+	if p.gate != nil {
+		p.gate.close()
+	}
+	if p.srv != nil {
+		p.srv.close()
+	}
+	return p.c.Disconnect(ctx)
+}
+
+// Health checks that the downstream mongo is reachable
+func (p *MongoPlugin) Health(ctx context.Context) error {
+	return p.c.Ping(ctx, nil)
+}
+
+// ServerInfo runs buildInfo and isMaster on the downstream mongo
+func (p *MongoPlugin) ServerInfo(ctx context.Context) (*plugins.ServerInfo, error) {
+	buildInfo, err := p.RunCommand(ctx, "admin", bson.D{{"buildInfo", 1}})
+	if err != nil {
+		return nil, err
+	}
+	hello, err := p.RunCommand(ctx, "admin", bson.D{{"isMaster", 1}})
+	if err != nil {
+		return nil, err
+	}
+	return &plugins.ServerInfo{BuildInfo: buildInfo, Hello: hello}, nil
+}
+
+// RunCommand runs the command on the downstream mongo (on the primary)
+func (p *MongoPlugin) RunCommand(ctx context.Context, db string, cmd bson.D) (bson.D, error) {
+	cmdDoc, err := bson.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	op := operation.NewCommand(cmdDoc).Database(db).Deployment(p.t)
+	if err := op.Execute(ctx); err != nil {
+		return nil, err
+	}
+	var result bson.D
+	if err := bson.Unmarshal(op.Result(), &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Stats returns the connection pool stats (and the sessions tracked for causal
+// consistency)
+func (p *MongoPlugin) Stats() bson.D {
+	stats := bson.D{{"pools", poolStats.get()}}
+	if p.causal != nil {
+		stats = append(stats, bson.E{"causalSessions", p.causal.size()})
+	}
+	return stats
+}
+
+// readSelector selects the servers commands may be sent to
+// TODO: read preference and latency window?
+var readSelector = description.CompositeSelector([]description.ServerSelector{
+	//description.ReadPrefSelector(ro.ReadPreference),
+	//description.LatencySelector(db.client.localThreshold),
+})
+
+// marshal marshals the command, with the forwarded client of the request (if any)
+func marshal(ctx context.Context, cmd command.Command) (bsoncore.Document, error) {
+	cmdDoc, err := bson.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	forwarded, ok := ctx.Value(contextKeyForwarded).(bsoncore.Document)
+	if !ok {
+		return cmdDoc, nil
+	}
+	idx, doc := bsoncore.AppendDocumentStart(nil)
+	doc = append(doc, cmdDoc[4:len(cmdDoc)-1]...)
+	doc = bsoncore.AppendDocumentElement(doc, plugins.ForwardedClientField, forwarded)
+	return bsoncore.AppendDocumentEnd(doc, idx)
+}
+
+// forwarded returns the context with the request's client to forward (signed)
+func (p *MongoPlugin) forwarded(ctx context.Context, r *plugins.Request) (context.Context, error) {
+	f := plugins.NewForwardedClient(ctx, r)
+	if err := f.Sign(p.forwardKey, r.CommandName, r.Database()); err != nil {
+		return ctx, err
+	}
+	d, err := bson.Marshal(f)
+	if err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, contextKeyForwarded, bsoncore.Document(d)), nil
+}
+
 func (p *MongoPlugin) runCommand(ctx context.Context, db string, cmd command.Command, server driver.Server) (bsoncore.Document, driver.Server, error) {
-	runCmdDoc, err := bson.Marshal(cmd)
+	runCmdDoc, err := marshal(ctx, cmd)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	op := operation.NewCommand(runCmdDoc).
-		Database(db).
-		CommandMonitor(&CommandMonitor)
-
 	if server != nil {
-		op = op.Deployment(driver.SingleServerDeployment{Server: server})
-	} else {
-		// TODO:?
-		readSelect := description.CompositeSelector([]description.ServerSelector{
-			//description.ReadPrefSelector(ro.ReadPreference),
-			//description.LatencySelector(db.client.localThreshold),
-		})
+		return p.execute(ctx, db, runCmdDoc, driver.SingleServerDeployment{Server: server}, readSelector)
+	}
+	// Reads which may go to secondaries are kept off the lagging ones
+	gated := p.gatedSelector(db, cmd)
+	if gated == nil {
+		return p.execute(ctx, db, runCmdDoc, p.t, readSelector)
+	}
+	d, cmdServer, err := p.execute(ctx, db, runCmdDoc, p.t, gated)
+	gated.count(db, cmd)
+	return d, cmdServer, err
+}
+
+// gatedSelector returns the lag gated selector of the command run on the
+// database (nil if it isn't gated)
+func (p *MongoPlugin) gatedSelector(db string, cmd command.Command) *gatedSelector {
+	if p.gate == nil {
+		return nil
+	}
+	return p.gate.selector(db, cmd)
+}
 
-		op = op.ServerSelector(readSelect).Deployment(p.t)
+// execute runs the marshalled command on the deployment, returning the server it ran on
+func (p *MongoPlugin) execute(ctx context.Context, db string, cmdDoc bsoncore.Document, deployment driver.Deployment, selector description.ServerSelector) (bsoncore.Document, driver.Server, error) {
+	if s := getReplyStream(ctx); s != nil {
+		deployment = &streamDeployment{Deployment: deployment, stream: s}
 	}
+	op := operation.NewCommand(cmdDoc).
+		Database(db).
+		CommandMonitor(&CommandMonitor).
+		ServerSelector(selector).
+		Deployment(deployment)
 
-	err = op.Execute(ctx)
+	err := op.Execute(ctx)
 
-	return op.Result(), extractServer(op), err
+	return op.Result(), unwrapServer(extractServer(op)), err
 }
 
 // Process is the function executed when a message is called in the pipeline.
@@ -274,14 +471,63 @@ func (p *MongoPlugin) Process(ctx context.Context, r *plugins.Request, next plug
 		commandSummary.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
 	}()
 
+	// The client is signed with the command before the backend plugin clears its
+	// database
+	if p.forwardKey != nil {
+		var err error
+		if ctx, err = p.forwarded(ctx, r); err != nil {
+			return nil, err
+		}
+	}
+
 	// Wrap handleCommand to output b/w metrics
 	runCommand := func(ctx context.Context, db string, cmd command.Command, server driver.Server) (bson.D, error) {
-		d, cmdServer, err := p.runCommand(ctx, db, cmd, server)
+		var (
+			d         bsoncore.Document
+			cmdServer driver.Server
+			err       error
+		)
+		// Reads the proxy routes may go to any member, so they have to wait for
+		// their session's operations
+		if server == nil && p.causal != nil && p.causal.raise(cmd) {
+			r.Modified()
+		}
+
+		backendStart := time.Now()
+		if server == nil && p.useHedge(r) {
+			d, cmdServer, err = p.hedgedRunCommand(ctx, db, cmd)
+		} else {
+			runCtx := ctx
+			// Hedged reads may get two replies, so only others are streamed
+			if stream := replyStream(r); stream != nil {
+				runCtx = context.WithValue(ctx, contextKeyReplyStream, stream)
+			}
+			d, cmdServer, err = p.runCommand(runCtx, db, cmd, server)
+			if r.ReplyStream != nil && r.ReplyStream.Started() {
+				streamedReplies.WithLabelValues(r.CommandName).Inc()
+			}
+		}
+		trace := plugins.GetRequestTrace(ctx)
+		trace.AddBackend(time.Since(backendStart))
+		trace.Cancel(ctx, plugins.PhaseBackend, "")
 		commandReceiveBytes.WithLabelValues(labels...).Add(float64(len(d)))
 
+		// There is no result if the command failed before getting a response (e.g.
+		// the context was cancelled)
 		var result bson.D
-		if unmarshalErr := bson.Unmarshal(d, &result); unmarshalErr != nil {
-			return result, unmarshalErr
+		if len(d) > 0 {
+			var unmarshalErr error
+			if r.RawBatches {
+				result, unmarshalErr = unmarshalRawBatches(bson.Raw(d))
+			} else {
+				unmarshalErr = bson.Unmarshal(d, &result)
+			}
+			if unmarshalErr != nil {
+				return result, unmarshalErr
+			}
+		}
+		if p.causal != nil {
+			p.causal.observe(cmd, result)
 		}
 
 		if err != nil {
@@ -323,6 +569,13 @@ func (p *MongoPlugin) Process(ctx context.Context, r *plugins.Request, next plug
 		// connections for various clients separated.
 		return mongoerror.AuthenticationFailed.ErrMessage("Authentication failed."), nil
 
+	case *command.CollMod:
+		// TODO: some other way to not double-send the DB
+		dbName := cmd.Database
+		cmd.Database = ""
+
+		return runCommand(ctx, dbName, cmd, nil)
+
 	case *command.Count:
 		// TODO: some other way to not double-send the DB
 		dbName := cmd.Database
@@ -496,7 +749,6 @@ func (p *MongoPlugin) Process(ctx context.Context, r *plugins.Request, next plug
 
 		return runCommand(ctx, dbName, cmd, nil)
 
-	// TODO: clear cursor entry from cache?
 	case *command.KillCursors:
 		// TODO: some other way to not double-send the DB
 		dbName := cmd.Database
@@ -507,6 +759,9 @@ func (p *MongoPlugin) Process(ctx context.Context, r *plugins.Request, next plug
 			cursorsNotFound primitive.A
 			cursorsAlive    primitive.A
 			cursorsUnknown  primitive.A
+			// The latest operationTime and $clusterTime of the backends
+			operationTime primitive.Timestamp
+			clusterTime   interface{}
 		)
 
 		// TODO: optional based on the number of downstreams!
@@ -522,6 +777,12 @@ func (p *MongoPlugin) Process(ctx context.Context, r *plugins.Request, next plug
 			}
 
 			result, err := runCommand(ctx, dbName, cmd, v.(driver.Server))
+			if v, ok := bsonutil.Lookup(result, "operationTime"); ok {
+				if ts, ok := v.(primitive.Timestamp); ok && timestampAfter(ts, operationTime) {
+					operationTime = ts
+					clusterTime, _ = bsonutil.Lookup(result, "$clusterTime")
+				}
+			}
 			if err != nil || !bsonutil.Ok(result) {
 				cursorsUnknown = append(cursorsUnknown, cursorID)
 				continue
@@ -530,6 +791,7 @@ func (p *MongoPlugin) Process(ctx context.Context, r *plugins.Request, next plug
 			v, ok = bsonutil.Lookup(result, "cursorsKilled")
 			if ok {
 				cursorsKilled = append(cursorsKilled, v.(primitive.A)...)
+				r.CursorCache.CloseCursor(cursorID)
 			}
 			v, ok = bsonutil.Lookup(result, "cursorsNotFound")
 			if ok {
@@ -545,16 +807,28 @@ func (p *MongoPlugin) Process(ctx context.Context, r *plugins.Request, next plug
 			}
 		}
 
-		return bson.D{
+		result := bson.D{
 			{"cursorsKilled", cursorsKilled},
 			{"cursorsNotFound", cursorsNotFound},
 			{"cursorsAlive", cursorsAlive},
 			{"cursorsUnknown", cursorsUnknown},
 			{"ok", 1},
-			// TODO: operationTime and $clusterTime
-		}, nil
+		}
+		// Causally consistent sessions advance their time from every response
+		if !operationTime.IsZero() {
+			result = append(result, bson.E{"operationTime", operationTime})
+		}
+		if clusterTime != nil {
+			result = append(result, bson.E{"$clusterTime", clusterTime})
+		}
+		return result, nil
 
 	case *command.KillOp:
+		// Proxy ops are killed by the proxy itself
+		if _, ok := plugins.ProxyOpID(cmd.OpID); ok {
+			return next(ctx, r)
+		}
+
 		// TODO: some other way to not double-send the DB
 		dbName := cmd.Database
 		cmd.Database = ""
@@ -0,0 +1,115 @@
+package mongo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/description"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+	"github.com/wish/mongoproxy/pkg/mongotest"
+)
+
+// newMongos returns a fake mongos answering finds with its name after the delay
+func newMongos(t *testing.T, name string, delay time.Duration) *mongotest.Server {
+	s, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	isMaster := func(string, bson.D) bson.D {
+		return bson.D{{"ismaster", true}, {"msg", "isdbgrid"}, {"maxWireVersion", mongotest.MaxWireVersion}, {"ok", 1}}
+	}
+	s.Handle("isMaster", isMaster)
+	s.Handle("ismaster", isMaster)
+	s.Handle("find", func(db string, cmd bson.D) bson.D {
+		time.Sleep(delay)
+		return bson.D{{"cursor", bson.D{{"firstBatch", bson.A{bson.D{{"server", name}}}}, {"id", int64(0)}, {"ns", db + ".coll"}}}, {"ok", 1}}
+	})
+	return s
+}
+
+func TestHedgedReads(t *testing.T) {
+	slow := newMongos(t, "slow", 300*time.Millisecond)
+	defer slow.Close()
+	fast := newMongos(t, "fast", 0)
+	defer fast.Close()
+
+	pl, _ := plugins.GetPlugin(Name)
+	p := pl.(*MongoPlugin)
+	conf := bson.D{
+		{"mongoAddr", "mongodb://" + slow.Addr() + "," + fast.Addr()},
+		{"connectTimeout", "1s"},
+		{"hedgedReads", bson.D{{"delay", "20ms"}, {"budgetRatio", 0.5}, {"budgetBurst", 4}}},
+	}
+	if err := p.Configure(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop(context.TODO())
+	if err := p.Health(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		known := 0
+		for _, s := range p.t.Description().Servers {
+			if s.Kind == description.Mongos {
+				known++
+			}
+		}
+		if known == 2 {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("servers not discovered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	pipeline := plugins.BuildPipeline([]plugins.Plugin{p}, func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+		return nil, nil
+	})
+	run := func(cmd bson.D) (string, time.Duration) {
+		t.Helper()
+		c, _ := command.GetCommand(cmd[0].Key)
+		if err := c.FromBSOND(cmd); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		result, err := pipeline(context.TODO(), &plugins.Request{CommandName: cmd[0].Key, Command: c, CC: plugins.NewClientConnection()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch, _ := bsonutil.Lookup(result, "cursor", "firstBatch")
+		server, _ := bsonutil.Lookup(batch.(bson.A)[0].(bson.D), "server")
+		return server.(string), time.Since(start)
+	}
+
+	// Every find is answered quickly while the budget lasts
+	for i := 0; i < 4; i++ {
+		if server, took := run(bson.D{{"find", "coll"}, {"$db", "db"}}); server != "fast" || took > 200*time.Millisecond {
+			t.Fatalf("find %d answered by %s in %s", i, server, took)
+		}
+	}
+
+	// Finds sent to the slow server aren't hedged once it is exhausted
+	p.hedge.budget.lock.Lock()
+	p.hedge.budget.tokens, p.hedge.budget.ratio = 0, 0
+	p.hedge.budget.lock.Unlock()
+	for i := 0; ; i++ {
+		if server, _ := run(bson.D{{"find", "coll"}, {"$db", "db"}}); server == "slow" {
+			break
+		}
+		if i > 20 {
+			t.Fatalf("finds hedged without a budget")
+		}
+	}
+
+	// Tailable finds aren't hedged
+	tailable := true
+	if hedgeable(&command.Find{Tailable: &tailable}) {
+		t.Fatalf("expected a tailable find not to be hedgeable")
+	}
+}
@@ -0,0 +1,157 @@
+package mongo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/dns"
+)
+
+var srvRescansTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mongoproxy_plugins_mongo_srv_rescans_total",
+	Help: "The total resolutions of the SRV records of the backend by whether its servers changed (changed, unchanged) or the resolution failed (failed)",
+}, []string{"result"})
+
+// isSRV returns whether the address is a mongodb+srv:// seedlist
+func isSRV(addr string) bool {
+	return strings.HasPrefix(addr, connstring.SchemeMongoDBSRV+"://")
+}
+
+// srvHost returns the name whose SRV (and TXT) records list the servers (and
+// options) of the mongodb+srv:// address
+func srvHost(addr string) (string, error) {
+	host := strings.TrimPrefix(addr, connstring.SchemeMongoDBSRV+"://")
+	if idx := strings.IndexAny(host, "/?"); idx != -1 {
+		host = host[:idx]
+	}
+	// The credentials are percent encoded, so the last @ ends them
+	if idx := strings.LastIndex(host, "@"); idx != -1 {
+		host = host[idx+1:]
+	}
+	if host == "" || strings.Contains(host, ",") {
+		return "", fmt.Errorf("invalid mongodb+srv address; must have one host")
+	}
+	return host, nil
+}
+
+// srvRescanner resolves the SRV records of a mongodb+srv:// address every
+// interval, updating the servers of the topology when they change. The driver
+// resolves them once when connecting (and rescans sharded clusters only), so
+// this picks up the members added to and removed from replica sets (e.g. on an
+// Atlas node replacement) without a restart.
+type srvRescanner struct {
+	resolver *dns.Resolver
+	host     string
+	interval time.Duration
+
+	// hosts are the servers of the last resolution (sorted)
+	hosts []string
+	// txt are the options of the TXT record when the backend was connected to;
+	// they only apply on connect, so changes are logged
+	txt []string
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newSRVRescanner returns the rescanner of the mongodb+srv:// address, or nil if
+// rescans are disabled (with a zero interval)
+func newSRVRescanner(addr string, interval *string) (*srvRescanner, error) {
+	host, err := srvHost(addr)
+	if err != nil {
+		return nil, err
+	}
+	r := &srvRescanner{resolver: dns.DefaultResolver, host: host, interval: time.Minute}
+	if interval != nil {
+		if r.interval, err = time.ParseDuration(*interval); err != nil {
+			return nil, fmt.Errorf("invalid srvRescanInterval: %w", err)
+		}
+		if r.interval < 0 {
+			return nil, fmt.Errorf("srvRescanInterval must not be negative")
+		}
+		if r.interval == 0 {
+			return nil, nil
+		}
+	}
+	return r, nil
+}
+
+// rescan resolves the SRV records, passing the servers to update if they changed
+// since the last resolution; the servers are kept if the resolution fails (or
+// finds none)
+func (r *srvRescanner) rescan(update func(hosts []string) bool) string {
+	hosts, err := r.resolver.ParseHosts(r.host, false)
+	if err == nil && len(hosts) == 0 {
+		err = fmt.Errorf("no valid SRV records")
+	}
+	if err != nil {
+		logrus.Warnf("error resolving the SRV records of %s: %v", r.host, err)
+		return "failed"
+	}
+
+	if txt, err := r.resolver.GetConnectionArgsFromTXT(r.host); err == nil && !equalStrings(txt, r.txt) {
+		logrus.Warnf("TXT options of %s changed from %v to %v; they apply when the proxy reconnects", r.host, r.txt, txt)
+		r.txt = txt
+	}
+
+	sort.Strings(hosts)
+	if equalStrings(hosts, r.hosts) {
+		return "unchanged"
+	}
+	if !update(hosts) {
+		return "failed"
+	}
+	logrus.Infof("servers of %s changed from %v to %v", r.host, r.hosts, hosts)
+	r.hosts = hosts
+	return "changed"
+}
+
+// start rescans every interval until closed, starting from the servers and TXT
+// options the backend was connected with
+func (r *srvRescanner) start(hosts []string, update func(hosts []string) bool) {
+	r.hosts = append([]string(nil), hosts...)
+	sort.Strings(r.hosts)
+	r.txt, _ = r.resolver.GetConnectionArgsFromTXT(r.host)
+
+	r.stop = make(chan struct{})
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				srvRescansTotal.WithLabelValues(r.rescan(update)).Inc()
+			}
+		}
+	}()
+}
+
+func (r *srvRescanner) close() {
+	if r.stop != nil {
+		close(r.stop)
+		r.wg.Wait()
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
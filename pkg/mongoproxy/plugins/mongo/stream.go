@@ -0,0 +1,189 @@
+package mongo
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"unsafe"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/mongo/address"
+	"go.mongodb.org/mongo-driver/mongo/description"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+	"github.com/wish/mongoproxy/pkg/mongowire"
+)
+
+var (
+	streamedReplies = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_mongo_streamed_replies_total",
+		Help: "The total cursor replies streamed to clients as they were read from the backend",
+	}, []string{"command"})
+)
+
+// streamDialer dials backend connections whose reads can be streamed to clients
+// (see streamConn)
+type streamDialer struct {
+	net.Dialer
+}
+
+func (d *streamDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	c, err := d.Dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &streamConn{Conn: c}, nil
+}
+
+// streamConn is a backend connection whose reads are also written to the reply
+// stream of the request using it (if any). TLS connections wrap it, so their
+// replies aren't streamed.
+type streamConn struct {
+	net.Conn
+
+	lock   sync.Mutex
+	stream *mongowire.ReplyStream
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.lock.Lock()
+		if c.stream != nil {
+			c.stream.Write(b[:n])
+		}
+		c.lock.Unlock()
+	}
+	return n, err
+}
+
+func (c *streamConn) setStream(s *mongowire.ReplyStream) {
+	c.lock.Lock()
+	c.stream = s
+	c.lock.Unlock()
+}
+
+// extractNetConn returns the network connection of the driver's connection (nil
+// if there is none)
+func extractNetConn(c driver.Connection) net.Conn {
+	tc, ok := c.(*topology.Connection)
+	if !ok {
+		return nil
+	}
+	conn := reflect.ValueOf(tc).Elem().FieldByName("connection")
+	if conn.IsNil() {
+		return nil
+	}
+	nc := conn.Elem().FieldByName("nc")
+	nc = reflect.NewAt(nc.Type(), unsafe.Pointer(nc.UnsafeAddr())).Elem() // #nosec G103
+	if nc.IsNil() {
+		return nil
+	}
+	return nc.Interface().(net.Conn)
+}
+
+// streamDeployment is a deployment whose servers stream the reply of the
+// command run to the reply stream
+type streamDeployment struct {
+	driver.Deployment
+	stream *mongowire.ReplyStream
+}
+
+func (d *streamDeployment) SelectServer(ctx context.Context, selector description.ServerSelector) (driver.Server, error) {
+	server, err := d.Deployment.SelectServer(ctx, selector)
+	if err != nil {
+		return nil, err
+	}
+	return &streamServer{Server: server, stream: d.stream}, nil
+}
+
+// streamServer is a server whose connections stream their reads to the reply
+// stream until they are returned
+type streamServer struct {
+	driver.Server
+	stream *mongowire.ReplyStream
+}
+
+func (s *streamServer) Connection(ctx context.Context) (driver.Connection, error) {
+	conn, err := s.Server.Connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sc, ok := extractNetConn(conn).(*streamConn)
+	if !ok {
+		return conn, nil
+	}
+	sc.setStream(s.stream)
+	return &streamedConnection{Connection: conn, sc: sc, stream: s.stream}, nil
+}
+
+// ProcessError lets the server handle the errors of its commands (e.g. marking
+// itself unknown)
+func (s *streamServer) ProcessError(err error, conn driver.Connection) driver.ProcessErrorResult {
+	if ep, ok := s.Server.(driver.ErrorProcessor); ok {
+		if sc, ok := conn.(*streamedConnection); ok {
+			conn = sc.Connection
+		}
+		return ep.ProcessError(err, conn)
+	}
+	return driver.NoChange
+}
+
+// unwrapServer returns the server the streamServer wraps
+func unwrapServer(server driver.Server) driver.Server {
+	if s, ok := server.(*streamServer); ok {
+		return s.Server
+	}
+	return server
+}
+
+// streamedConnection is a connection streaming its reads until it's returned
+type streamedConnection struct {
+	driver.Connection
+	sc     *streamConn
+	stream *mongowire.ReplyStream
+}
+
+// Close stops streaming before returning the connection to the pool
+func (c *streamedConnection) Close() error {
+	c.sc.setStream(nil)
+	// A reply not read whole by now isn't streamed
+	c.stream.Decline()
+	return c.Connection.Close()
+}
+
+func (c *streamedConnection) CompressWireMessage(src, dst []byte) ([]byte, error) {
+	if cmp, ok := c.Connection.(driver.Compressor); ok {
+		return cmp.CompressWireMessage(src, dst)
+	}
+	return append(dst, src...), nil
+}
+
+func (c *streamedConnection) LocalAddress() address.Address {
+	if la, ok := c.Connection.(driver.LocalAddresser); ok {
+		return la.LocalAddress()
+	}
+	return ""
+}
+
+// replyStream returns the stream the reply of the request may be streamed to:
+// only those of finds and getMores are
+func replyStream(r *plugins.Request) *mongowire.ReplyStream {
+	switch r.Command.(type) {
+	case *command.Find, *command.GetMore:
+		return r.ReplyStream
+	}
+	return nil
+}
+
+// getReplyStream returns the stream the reply of the command run is streamed to
+// (nil if none)
+func getReplyStream(ctx context.Context) *mongowire.ReplyStream {
+	s, _ := ctx.Value(contextKeyReplyStream).(*mongowire.ReplyStream)
+	return s
+}
@@ -0,0 +1,146 @@
+package mongo
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/description"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/operation"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+// transactionCleanupTimeout is the timeout of aborting a transaction and ending
+// its session
+const transactionCleanupTimeout = 5 * time.Second
+
+// sessionFields are the fields of a command's document replaced in transactions
+var sessionFields = map[string]struct{}{
+	"lsid":             {},
+	"txnNumber":        {},
+	"stmtIds":          {},
+	"startTransaction": {},
+	"autocommit":       {},
+	"writeConcern":     {},
+	"readConcern":      {},
+	"$clusterTime":     {},
+	"$readPreference":  {},
+	"$db":              {},
+}
+
+// transaction is a transaction of the proxy's own session on a server
+type transaction struct {
+	server driver.Deployment
+	lsid   bson.D
+	// started is set once the transaction's first command was sent
+	started bool
+}
+
+// command returns the command's document in the transaction
+func (t *transaction) command(cmd bson.D) bson.D {
+	d := make(bson.D, 0, len(cmd)+4)
+	for _, e := range cmd {
+		if _, ok := sessionFields[e.Key]; !ok {
+			d = append(d, e)
+		}
+	}
+	d = append(d, bson.E{"lsid", t.lsid}, bson.E{"txnNumber", int64(1)})
+	if !t.started {
+		d = append(d, bson.E{"startTransaction", true})
+	}
+	return append(d, bson.E{"autocommit", false})
+}
+
+// run runs the command in the transaction, returning its response
+func (t *transaction) run(ctx context.Context, db string, cmd bson.D) (bson.D, error) {
+	cmdDoc, err := bson.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	t.started = true
+	op := operation.NewCommand(cmdDoc).
+		Database(db).
+		CommandMonitor(&CommandMonitor).
+		Deployment(t.server)
+	err = op.Execute(ctx)
+
+	var result bson.D
+	if len(op.Result()) > 0 {
+		if unmarshalErr := bson.Unmarshal(op.Result(), &result); unmarshalErr != nil && err == nil {
+			err = unmarshalErr
+		}
+	}
+	return result, err
+}
+
+// end aborts the transaction unless it was committed and ends the session
+func (t *transaction) end(committed bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), transactionCleanupTimeout)
+	defer cancel()
+	if t.started && !committed {
+		if _, err := t.run(ctx, "admin", bson.D{{"abortTransaction", 1}, {"lsid", t.lsid}, {"txnNumber", int64(1)}, {"autocommit", false}}); err != nil {
+			logrus.Debugf("Error aborting transaction: %v", err)
+		}
+	}
+	if _, err := t.run(ctx, "admin", bson.D{{"endSessions", bson.A{t.lsid}}}); err != nil {
+		logrus.Debugf("Error ending transaction session: %v", err)
+	}
+}
+
+// RunTransaction runs the commands in a transaction of a new session on the primary
+// (or a single mongos), so the writes of the commands are committed together
+func (p *MongoPlugin) RunTransaction(ctx context.Context, cmds []plugins.TransactionCommand, writeConcern interface{}) ([]bson.D, error) {
+	server, err := p.t.SelectServer(ctx, description.WriteSelector())
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	// A random (version 4) UUID
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	t := &transaction{
+		server: driver.SingleServerDeployment{Server: server},
+		lsid:   bson.D{{"id", primitive.Binary{Subtype: bsontype.BinaryUUID, Data: id}}},
+	}
+
+	committed := false
+	defer func() { t.end(committed) }()
+
+	results := make([]bson.D, 0, len(cmds))
+	for _, c := range cmds {
+		if len(c.Command) == 0 {
+			return results, fmt.Errorf("empty transaction command")
+		}
+		// The session fields are replaced, so a command of a client's transaction
+		// would be committed here regardless of the client's transaction
+		if _, ok := bsonutil.Lookup(c.Command, "autocommit"); ok {
+			return results, fmt.Errorf("commands of another transaction can't be run in a transaction")
+		}
+		result, err := t.run(ctx, c.Database, t.command(c.Command))
+		results = append(results, result)
+		if err != nil {
+			return results, err
+		}
+	}
+
+	commit := bson.D{{"commitTransaction", 1}, {"lsid", t.lsid}, {"txnNumber", int64(1)}, {"autocommit", false}}
+	if writeConcern != nil {
+		commit = append(commit, bson.E{"writeConcern", writeConcern})
+	}
+	if _, err := t.run(ctx, "admin", commit); err != nil {
+		return results, fmt.Errorf("committing the transaction: %w", err)
+	}
+	committed = true
+	return results, nil
+}
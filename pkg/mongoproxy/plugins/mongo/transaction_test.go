@@ -0,0 +1,127 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/description"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func TestRunTransaction(t *testing.T) {
+	s := newMongos(t, "mongos", 0)
+	defer s.Close()
+
+	var (
+		l        sync.Mutex
+		commands []string
+	)
+	// record records the command with its transaction fields
+	record := func(name string, response bson.D) func(string, bson.D) bson.D {
+		return func(db string, cmd bson.D) bson.D {
+			_, hasSession := bsonutil.Lookup(cmd, "lsid")
+			start, _ := bsonutil.Lookup(cmd, "startTransaction")
+			autocommit, _ := bsonutil.Lookup(cmd, "autocommit")
+			_, hasStmtIds := bsonutil.Lookup(cmd, "stmtIds")
+			l.Lock()
+			commands = append(commands, fmt.Sprintf("%s.%s session=%v start=%v autocommit=%v stmtIds=%v", db, name, hasSession, start, autocommit, hasStmtIds))
+			l.Unlock()
+			return response
+		}
+	}
+	s.Handle("insert", func(db string, cmd bson.D) bson.D {
+		coll, _ := bsonutil.Lookup(cmd, "insert")
+		response := bson.D{{"n", 1}, {"ok", 1}}
+		if coll == "fail" {
+			response = bson.D{{"n", 0}, {"writeErrors", bson.A{bson.D{{"index", 0}, {"code", 11000}, {"errmsg", "duplicate key"}}}}, {"ok", 1}}
+		}
+		return record("insert "+coll.(string), response)(db, cmd)
+	})
+	s.Handle("commitTransaction", record("commitTransaction", bson.D{{"ok", 1}}))
+	s.Handle("abortTransaction", record("abortTransaction", bson.D{{"ok", 1}}))
+	s.Handle("endSessions", record("endSessions", bson.D{{"ok", 1}}))
+
+	pl, _ := plugins.GetPlugin(Name)
+	p := pl.(*MongoPlugin)
+	if err := p.Configure(bson.D{{"mongoAddr", "mongodb://" + s.Addr()}, {"connectTimeout", "1s"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop(context.TODO())
+	for i := 0; ; i++ {
+		if servers := p.t.Description().Servers; len(servers) == 1 && servers[0].Kind == description.Mongos {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("server not discovered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tests := []struct {
+		collections []string
+		ok          bool
+		results     int
+		commands    []string
+	}{
+		{
+			collections: []string{"orders", "outbox"},
+			ok:          true,
+			results:     2,
+			commands: []string{
+				"shop.insert orders session=true start=true autocommit=false stmtIds=false",
+				"shop.insert outbox session=true start=<nil> autocommit=false stmtIds=false",
+				"admin.commitTransaction session=true start=<nil> autocommit=false stmtIds=false",
+				"admin.endSessions session=false start=<nil> autocommit=<nil> stmtIds=false",
+			},
+		},
+		// A command with write errors aborts the transaction
+		{
+			collections: []string{"fail", "outbox"},
+			results:     1,
+			commands: []string{
+				"shop.insert fail session=true start=true autocommit=false stmtIds=false",
+				"admin.abortTransaction session=true start=<nil> autocommit=false stmtIds=false",
+				"admin.endSessions session=false start=<nil> autocommit=<nil> stmtIds=false",
+			},
+		},
+		// Commands of the client's transactions aren't run
+		{
+			collections: []string{"clientTransaction"},
+			commands: []string{
+				"admin.endSessions session=false start=<nil> autocommit=<nil> stmtIds=false",
+			},
+		},
+	}
+	for i, test := range tests {
+		commands = nil
+		var cmds []plugins.TransactionCommand
+		for _, coll := range test.collections {
+			cmds = append(cmds, plugins.TransactionCommand{
+				Database: "shop",
+				Command:  bson.D{{"insert", coll}, {"documents", bson.A{bson.D{{"_id", 1}}}}, {"lsid", bson.D{{"id", 1}}}, {"stmtIds", bson.A{0}}},
+			})
+			if coll == "clientTransaction" {
+				cmds[len(cmds)-1].Command = append(cmds[len(cmds)-1].Command, bson.E{"autocommit", false})
+			}
+		}
+		results, err := p.RunTransaction(context.TODO(), cmds, bson.D{{"w", "majority"}})
+		if (err == nil) != test.ok {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if len(results) != test.results {
+			t.Fatalf("%d: expected %d results, got %v", i, test.results, results)
+		}
+		l.Lock()
+		if !reflect.DeepEqual(commands, test.commands) {
+			t.Fatalf("%d: expected commands %q, got %q", i, test.commands, commands)
+		}
+		l.Unlock()
+	}
+}
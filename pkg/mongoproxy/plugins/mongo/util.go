@@ -5,6 +5,7 @@ import (
 	"unsafe"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/x/mongo/driver"
@@ -147,6 +148,51 @@ func ErrorToDoc(err error) (bson.D, error) {
 	}
 }
 
+// unmarshalRawBatches unmarshals a command response keeping the cursor batches
+// (cursor.firstBatch/nextBatch) as bson.RawValue so they can be written to the
+// client without being decoded
+func unmarshalRawBatches(b bson.Raw) (bson.D, error) {
+	elems, err := b.Elements()
+	if err != nil {
+		return nil, err
+	}
+	d := make(bson.D, len(elems))
+	for i, elem := range elems {
+		d[i].Key = elem.Key()
+		v := elem.Value()
+		if d[i].Key == "cursor" && v.Type == bsontype.EmbeddedDocument {
+			d[i].Value, err = unmarshalCursor(v.Document())
+		} else {
+			err = v.Unmarshal(&d[i].Value)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func unmarshalCursor(b bson.Raw) (bson.D, error) {
+	elems, err := b.Elements()
+	if err != nil {
+		return nil, err
+	}
+	d := make(bson.D, len(elems))
+	for i, elem := range elems {
+		d[i].Key = elem.Key()
+		v := elem.Value()
+		switch d[i].Key {
+		case "firstBatch", "nextBatch":
+			d[i].Value = v
+		default:
+			if err := v.Unmarshal(&d[i].Value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return d, nil
+}
+
 func extractTopology(c *mongo.Client) *topology.Topology {
 	e := reflect.ValueOf(c).Elem()
 	d := e.FieldByName("deployment")
@@ -0,0 +1,82 @@
+package mongo
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/mongo/description"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+)
+
+// warmUpConnections returns the number of connections to open to each server
+// during the warm-up (capped by the pool size)
+func (p *MongoPlugin) warmUpConnections() uint64 {
+	var n uint64
+	if p.conf.WarmUpConnections != nil {
+		n = *p.conf.WarmUpConnections
+	} else if p.conf.MinPoolSize != nil {
+		n = *p.conf.MinPoolSize
+	}
+	maxPoolSize := uint64(100)
+	if p.conf.MaxPoolSize != nil && *p.conf.MaxPoolSize > 0 {
+		maxPoolSize = *p.conf.MaxPoolSize
+	}
+	if n > maxPoolSize {
+		n = maxPoolSize
+	}
+	return n
+}
+
+// WarmUp waits for the downstream mongo to be reachable and then fills the
+// connection pools of its servers so the first requests don't pay for the
+// connection handshakes
+func (p *MongoPlugin) WarmUp(ctx context.Context) error {
+	if err := p.c.Ping(ctx, nil); err != nil {
+		return err
+	}
+	n := p.warmUpConnections()
+	if n == 0 {
+		return nil
+	}
+
+	var (
+		wg     sync.WaitGroup
+		l      sync.Mutex
+		conns  []driver.Connection
+		retErr error
+	)
+	for _, s := range p.t.Description().Servers {
+		if s.Kind == description.Unknown {
+			continue
+		}
+		server, err := p.t.FindServer(s)
+		if err != nil || server == nil {
+			continue
+		}
+		// The connections are all checked out at once so the pool has to open new
+		// ones (rather than reuse the first)
+		for i := uint64(0); i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, err := server.Connection(ctx)
+				l.Lock()
+				defer l.Unlock()
+				if err != nil {
+					if retErr == nil {
+						retErr = err
+					}
+					return
+				}
+				conns = append(conns, conn)
+			}()
+		}
+	}
+	wg.Wait()
+
+	// Return the connections to the pools
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return retErr
+}
@@ -0,0 +1,436 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/time/rate"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "notify"
+
+var (
+	eventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_notify_events_total",
+		Help: "The total policy violation events by webhook and the result of notifying them",
+	}, []string{"webhook", "result"})
+)
+
+// Webhook types
+const (
+	TypeSlack     = "slack"
+	TypePagerDuty = "pagerduty"
+	TypeJSON      = "json"
+)
+
+// pagerDutyURL is the PagerDuty events API (v2)
+const pagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// DefaultCodes are the errors notified by default: schema violations, commands
+// blocked by policies and requests shed by limits
+var DefaultCodes = plugins.ViolationCodes
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &NotifyPlugin{
+			conf: NotifyPluginConfig{
+				Codes:         DefaultCodes,
+				FlushInterval: "10s",
+				BatchSize:     50,
+				QueueSize:     1000,
+				Timeout:       "10s",
+			},
+		}
+	})
+}
+
+type WebhookConfig struct {
+	// Name identifies the webhook in metrics and logs (default the type)
+	Name string `bson:"name"`
+	// Type is the format of the notifications: slack, pagerduty or json
+	Type string `bson:"type"`
+	// URL is the URL notifications are posted to (default the PagerDuty events
+	// API for pagerduty)
+	URL string `bson:"url"`
+	// RoutingKey is the integration key of the PagerDuty service (pagerduty only)
+	RoutingKey string `bson:"routingKey"`
+	// Severity of the PagerDuty alerts: critical, error, warning (default) or info
+	Severity string `bson:"severity"`
+	// Codes limits the errors notified to this webhook (default all the plugin's codes)
+	Codes []string `bson:"codes"`
+	// RateLimit is the max notifications per minute; events are batched into the
+	// next notification when it is exceeded (default 6)
+	RateLimit float64 `bson:"rateLimit"`
+}
+
+type NotifyPluginConfig struct {
+	// Codes are the error code names notified (default DefaultCodes)
+	Codes []string `bson:"codes"`
+	// Webhooks are the webhooks notified (required)
+	Webhooks []WebhookConfig `bson:"webhooks"`
+	// FlushInterval is the max time events wait to be notified (default "10s")
+	FlushInterval string `bson:"flushInterval"`
+	// BatchSize is the max events in one notification (default 50)
+	BatchSize int `bson:"batchSize"`
+	// QueueSize is the max events waiting per webhook; further events are dropped
+	// (default 1000)
+	QueueSize int `bson:"queueSize"`
+	// Timeout is the timeout of posting a notification (default "10s")
+	Timeout string `bson:"timeout"`
+
+	flushInterval time.Duration
+	timeout       time.Duration
+}
+
+// Event is a policy violation (an error returned to a client)
+type Event struct {
+	Time       time.Time `json:"time"`
+	Code       int       `json:"code"`
+	CodeName   string    `json:"codeName"`
+	Message    string    `json:"message"`
+	Command    string    `json:"command"`
+	Database   string    `json:"db,omitempty"`
+	Collection string    `json:"collection,omitempty"`
+	AppName    string    `json:"appName,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Client     string    `json:"client,omitempty"`
+}
+
+func (e *Event) namespace() string {
+	if e.Collection == "" {
+		return e.Database
+	}
+	return e.Database + "." + e.Collection
+}
+
+type webhook struct {
+	WebhookConfig
+	codes   map[string]struct{}
+	limiter *rate.Limiter
+	pending []*Event
+}
+
+// This is a plugin that notifies webhooks of requests rejected by policies
+type NotifyPlugin struct {
+	conf NotifyPluginConfig
+
+	codes    map[string]struct{}
+	webhooks []*webhook
+	client   *http.Client
+	source   string
+	events   chan *Event
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (p *NotifyPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *NotifyPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	if p.conf.flushInterval, err = time.ParseDuration(p.conf.FlushInterval); err != nil {
+		return err
+	}
+	if p.conf.flushInterval <= 0 {
+		return fmt.Errorf("flushInterval must be positive: %s", p.conf.FlushInterval)
+	}
+	if p.conf.timeout, err = time.ParseDuration(p.conf.Timeout); err != nil {
+		return err
+	}
+	if p.conf.BatchSize <= 0 {
+		return fmt.Errorf("batchSize must be positive: %d", p.conf.BatchSize)
+	}
+	if p.conf.QueueSize <= 0 {
+		return fmt.Errorf("queueSize must be positive: %d", p.conf.QueueSize)
+	}
+
+	p.codes = make(map[string]struct{}, len(p.conf.Codes))
+	for _, code := range p.conf.Codes {
+		p.codes[code] = struct{}{}
+	}
+
+	if len(p.conf.Webhooks) == 0 {
+		return fmt.Errorf("webhooks are required")
+	}
+	p.webhooks = make([]*webhook, len(p.conf.Webhooks))
+	names := make(map[string]struct{}, len(p.conf.Webhooks))
+	for i, c := range p.conf.Webhooks {
+		if c.Name == "" {
+			c.Name = c.Type
+		}
+		if _, ok := names[c.Name]; ok {
+			return fmt.Errorf("duplicate webhook %q (set a name)", c.Name)
+		}
+		names[c.Name] = struct{}{}
+
+		switch c.Type {
+		case TypeSlack, TypeJSON:
+		case TypePagerDuty:
+			if c.RoutingKey == "" {
+				return fmt.Errorf("webhook %s: routingKey is required", c.Name)
+			}
+			if c.URL == "" {
+				c.URL = pagerDutyURL
+			}
+			switch c.Severity {
+			case "":
+				c.Severity = "warning"
+			case "critical", "error", "warning", "info":
+			default:
+				return fmt.Errorf("webhook %s: invalid severity %q", c.Name, c.Severity)
+			}
+		default:
+			return fmt.Errorf("webhook %s: invalid type %q", c.Name, c.Type)
+		}
+		if c.URL == "" {
+			return fmt.Errorf("webhook %s: url is required", c.Name)
+		}
+
+		w := &webhook{WebhookConfig: c}
+		if len(c.Codes) > 0 {
+			w.codes = make(map[string]struct{}, len(c.Codes))
+			for _, code := range c.Codes {
+				if _, ok := p.codes[code]; !ok {
+					return fmt.Errorf("webhook %s: code %s is not in the plugin's codes", c.Name, code)
+				}
+				w.codes[code] = struct{}{}
+			}
+		}
+		if c.RateLimit < 0 {
+			return fmt.Errorf("webhook %s: rateLimit must be positive: %v", c.Name, c.RateLimit)
+		}
+		if c.RateLimit == 0 {
+			c.RateLimit = 6
+		}
+		w.limiter = rate.NewLimiter(rate.Limit(c.RateLimit/60), 1)
+		p.webhooks[i] = w
+	}
+
+	p.client = &http.Client{Timeout: p.conf.timeout}
+	p.source, _ = os.Hostname()
+	p.events = make(chan *Event, p.conf.QueueSize)
+
+	return nil
+}
+
+// ReadsBatches returns false as only errors are looked at
+func (p *NotifyPlugin) ReadsBatches() bool { return false }
+
+// Start starts notifying the queued events
+func (p *NotifyPlugin) Start(ctx context.Context) error {
+	p.stop = make(chan struct{})
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(p.conf.flushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-p.stop:
+				for {
+					select {
+					case e := <-p.events:
+						p.add(e)
+					default:
+						p.flush()
+						return
+					}
+				}
+			case e := <-p.events:
+				p.add(e)
+			case <-ticker.C:
+				p.flush()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop notifies the queued events (within the rate limits) and stops notifying
+func (p *NotifyPlugin) Stop(ctx context.Context) error {
+	if p.stop == nil {
+		return nil
+	}
+	close(p.stop)
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// add adds the event to the webhooks it is notified to
+func (p *NotifyPlugin) add(e *Event) {
+	for _, w := range p.webhooks {
+		if w.codes != nil {
+			if _, ok := w.codes[e.CodeName]; !ok {
+				continue
+			}
+		}
+		if len(w.pending) >= p.conf.QueueSize {
+			eventsTotal.WithLabelValues(w.Name, "dropped").Inc()
+			continue
+		}
+		w.pending = append(w.pending, e)
+	}
+}
+
+// flush notifies each webhook of its pending events (if its rate limit allows)
+func (p *NotifyPlugin) flush() {
+	for _, w := range p.webhooks {
+		if len(w.pending) == 0 || !w.limiter.Allow() {
+			continue
+		}
+		n := len(w.pending)
+		if n > p.conf.BatchSize {
+			n = p.conf.BatchSize
+		}
+		batch := w.pending[:n]
+
+		if err := p.post(w, batch); err != nil {
+			eventsTotal.WithLabelValues(w.Name, "failed").Add(float64(n))
+			logrus.Errorf("NOTIFY ERROR: notifying %s of %d events: %s", w.Name, n, err.Error())
+		} else {
+			eventsTotal.WithLabelValues(w.Name, "sent").Add(float64(n))
+		}
+		w.pending = append(w.pending[:0], w.pending[n:]...)
+	}
+}
+
+// payload returns the body notifying the webhook of the events
+func (p *NotifyPlugin) payload(w *webhook, events []*Event) interface{} {
+	switch w.Type {
+	case TypeSlack:
+		var b strings.Builder
+		fmt.Fprintf(&b, "mongoproxy %s: %d policy violations", p.source, len(events))
+		for _, e := range events {
+			fmt.Fprintf(&b, "\n• `%s` %s on %s", e.CodeName, e.Command, e.namespace())
+			if e.AppName != "" || e.User != "" {
+				fmt.Fprintf(&b, " (app %q, user %q)", e.AppName, e.User)
+			}
+			fmt.Fprintf(&b, ": %s", e.Message)
+		}
+		return map[string]interface{}{"text": b.String()}
+
+	case TypePagerDuty:
+		return map[string]interface{}{
+			"routing_key":  w.RoutingKey,
+			"event_action": "trigger",
+			"payload": map[string]interface{}{
+				"summary":        fmt.Sprintf("mongoproxy: %d policy violations (first: %s %s on %s)", len(events), events[0].CodeName, events[0].Command, events[0].namespace()),
+				"source":         p.source,
+				"severity":       w.Severity,
+				"component":      "mongoproxy",
+				"class":          events[0].CodeName,
+				"custom_details": map[string]interface{}{"events": events},
+			},
+		}
+
+	default:
+		return map[string]interface{}{"source": p.source, "events": events}
+	}
+}
+
+func (p *NotifyPlugin) post(w *webhook, events []*Event) error {
+	b, err := json.Marshal(p.payload(w, events))
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Post(w.URL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, body)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// ProcessError queues errors with the configured codes to be notified
+func (p *NotifyPlugin) ProcessError(ctx context.Context, r *plugins.Request, d bson.D, err error) (bson.D, error) {
+	if err != nil {
+		return d, err
+	}
+	codeName, _ := bsonutil.Lookup(d, "codeName")
+	name, _ := codeName.(string)
+	if _, ok := p.codes[name]; !ok {
+		return d, err
+	}
+
+	e := &Event{
+		Time:       time.Now().UTC(),
+		CodeName:   name,
+		Command:    r.CommandName,
+		Database:   command.GetCommandDatabase(r.Command),
+		Collection: command.GetCommandCollection(r.Command),
+	}
+	switch code, _ := bsonutil.Lookup(d, "code"); c := code.(type) {
+	case int:
+		e.Code = c
+	case int32:
+		e.Code = int(c)
+	case int64:
+		e.Code = int(c)
+	}
+	msg, _ := bsonutil.Lookup(d, "errmsg")
+	e.Message, _ = msg.(string)
+	if r.CC != nil {
+		e.AppName = r.CC.AppName
+		e.Client = r.CC.GetAddr()
+	}
+	if identity := plugins.GetMetadata(ctx).Identity(); identity != nil {
+		e.User = identity.User()
+	}
+
+	select {
+	case p.events <- e:
+	default:
+		eventsTotal.WithLabelValues("*", "dropped").Inc()
+	}
+	return d, err
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *NotifyPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	return next(ctx, r)
+}
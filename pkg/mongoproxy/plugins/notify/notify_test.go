@@ -0,0 +1,115 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func TestNotify(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		received = make(map[string][]map[string]interface{})
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		received[r.URL.Path] = append(received[r.URL.Path], body)
+	}))
+	defer srv.Close()
+
+	pl, _ := plugins.GetPlugin(Name)
+	d := pl.(*NotifyPlugin)
+	if err := d.Configure(bson.D{
+		{"webhooks", bson.A{
+			bson.D{{"type", "slack"}, {"url", srv.URL + "/slack"}},
+			bson.D{{"type", "json"}, {"url", srv.URL + "/json"}, {"codes", bson.A{"IllegalOperation"}}},
+			bson.D{{"type", "pagerduty"}, {"url", srv.URL + "/pagerduty"}, {"routingKey", "key"}, {"codes", bson.A{"DocumentValidationFailure"}}},
+		}},
+		{"flushInterval", "1h"},
+		{"batchSize", 2},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+
+	responses := map[string]bson.D{
+		"a": mongoerror.IllegalOperation.ErrMessage("blocked"),
+		"b": mongoerror.DocumentValidationFailure.ErrMessage("schema violation"),
+		"c": mongoerror.CursorNotFound.ErrMessage("not notified"),
+		"d": mongoerror.IllegalOperation.ErrMessage("blocked again"),
+		"e": {{"ok", 1}},
+	}
+	p := plugins.BuildPipeline([]plugins.Plugin{d}, func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+		return responses[command.GetCommandCollection(r.Command)], nil
+	})
+
+	for _, coll := range []string{"a", "b", "c", "d", "e"} {
+		cmd := &command.Insert{}
+		if err := cmd.FromBSOND(bson.D{{"insert", coll}, {"documents", bson.A{bson.D{{"_id", 1}}}}, {"$db", "db"}}); err != nil {
+			t.Fatal(err)
+		}
+		result, err := p(context.TODO(), &plugins.Request{CommandName: "insert", Command: cmd, CC: &plugins.ClientConnection{AppName: "app"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Responses are returned as-is
+		if !(len(result) > 0 && result[0].Key == "ok") {
+			t.Fatalf("unexpected response: %v", result)
+		}
+	}
+
+	if err := d.Stop(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	// slack gets one batch (of batchSize) as it is rate limited
+	if len(received["/slack"]) != 1 {
+		t.Fatalf("expected 1 slack notification, got %v", received["/slack"])
+	}
+	text, _ := received["/slack"][0]["text"].(string)
+	if !strings.Contains(text, "2 policy violations") || !strings.Contains(text, "db.a") || !strings.Contains(text, "db.b") {
+		t.Fatalf("unexpected slack notification: %s", text)
+	}
+
+	if len(received["/json"]) != 1 {
+		t.Fatalf("expected 1 json notification, got %v", received["/json"])
+	}
+	events, _ := received["/json"][0]["events"].([]interface{})
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %v", events)
+	}
+	for _, e := range events {
+		event := e.(map[string]interface{})
+		if event["codeName"] != "IllegalOperation" || event["appName"] != "app" {
+			t.Fatalf("unexpected event: %v", event)
+		}
+	}
+
+	if len(received["/pagerduty"]) != 1 {
+		t.Fatalf("expected 1 pagerduty notification, got %v", received["/pagerduty"])
+	}
+	if pd := received["/pagerduty"][0]; pd["routing_key"] != "key" || pd["event_action"] != "trigger" {
+		t.Fatalf("unexpected pagerduty notification: %v", pd)
+	}
+}
@@ -0,0 +1,23 @@
+package plugins
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ProxyOpPrefix prefixes the ids of ops running through the proxy (as listed by the
+// admin API) so a killOp can tell them from backend opids; e.g. {killOp: 1, op: "mongoproxy:12"}
+const ProxyOpPrefix = "mongoproxy:"
+
+// ProxyOpID returns the id of the proxy op if op (the op of a killOp) refers to one
+func ProxyOpID(op interface{}) (int64, bool) {
+	s, ok := op.(string)
+	if !ok || !strings.HasPrefix(s, ProxyOpPrefix) {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(s, ProxyOpPrefix), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
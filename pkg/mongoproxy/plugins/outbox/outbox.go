@@ -0,0 +1,298 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "outbox"
+
+var (
+	writesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_outbox_writes_total",
+		Help: "The total writes run in a transaction with their outbox events by result",
+	}, []string{"db", "collection", "result"})
+)
+
+// Operations of an event
+const (
+	OpInsert = "insert"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &OutboxPlugin{
+			conf: OutboxPluginConfig{},
+		}
+	})
+}
+
+type OutboxPluginConfig struct {
+	// Rules are the outboxes of collections; the first rule matching the namespace of
+	// a write applies
+	Rules []*Rule `bson:"rules"`
+}
+
+// Rule publishes the writes to a set of collections as events in an outbox collection
+type Rule struct {
+	// Scope are the collections (and commands) whose writes publish events (same
+	// format as a plugin scope; required)
+	Scope *plugins.Scope `bson:"scope"`
+	// Outbox is the outbox collection: "db.collection", or "collection" in the
+	// database of the write (required)
+	Outbox string `bson:"outbox"`
+	// Event are fields added to every event (e.g. {type: "order"})
+	Event bson.D `bson:"event"`
+	// IncludeDocuments includes the inserted documents, and the update documents, in
+	// the events
+	IncludeDocuments bool `bson:"includeDocuments"`
+
+	outboxDB, outboxCollection string
+}
+
+func (r *Rule) load() error {
+	if r.Scope.IsZero() {
+		return fmt.Errorf("scope is required")
+	}
+	r.Scope.Compile()
+
+	if r.Outbox == "" || strings.HasPrefix(r.Outbox, ".") || strings.HasSuffix(r.Outbox, ".") {
+		return fmt.Errorf("invalid outbox %q", r.Outbox)
+	}
+	if i := strings.IndexByte(r.Outbox, '.'); i != -1 {
+		r.outboxDB, r.outboxCollection = r.Outbox[:i], r.Outbox[i+1:]
+	} else {
+		r.outboxCollection = r.Outbox
+	}
+	for _, e := range r.Event {
+		if _, ok := generatedFields[e.Key]; ok {
+			return fmt.Errorf("event field %q is set by the plugin", e.Key)
+		}
+	}
+	return nil
+}
+
+// outbox returns the namespace of the outbox of the database
+func (r *Rule) outbox(db string) (string, string) {
+	if r.outboxDB != "" {
+		return r.outboxDB, r.outboxCollection
+	}
+	return db, r.outboxCollection
+}
+
+// generatedFields are the fields of the events set by the plugin
+var generatedFields = map[string]struct{}{
+	"_id": {}, "ns": {}, "op": {}, "documentKey": {}, "filter": {}, "document": {},
+	"update": {}, "appName": {}, "user": {}, "time": {},
+}
+
+// This is a plugin that inserts events for the writes to collections into an outbox
+// collection in the same transaction as the write, so applications get
+// transactional event publishing without code changes
+type OutboxPlugin struct {
+	conf OutboxPluginConfig
+	now  func() time.Time
+
+	trLock sync.RWMutex
+	tr     plugins.TransactionRunner
+}
+
+func (p *OutboxPlugin) Name() string { return Name }
+
+// ReadsDocuments returns true as events include the inserted documents
+func (p *OutboxPlugin) ReadsDocuments() bool { return true }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *OutboxPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	if len(p.conf.Rules) == 0 {
+		return fmt.Errorf("rules are required")
+	}
+	for i, rule := range p.conf.Rules {
+		if rule == nil {
+			return fmt.Errorf("empty rule %d", i)
+		}
+		if err := rule.load(); err != nil {
+			return fmt.Errorf("invalid rule %d: %w", i, err)
+		}
+	}
+
+	p.now = time.Now
+	return nil
+}
+
+// SetTransactionRunner sets the runner of the transactions of the writes
+func (p *OutboxPlugin) SetTransactionRunner(tr plugins.TransactionRunner) {
+	p.trLock.Lock()
+	defer p.trLock.Unlock()
+	p.tr = tr
+}
+
+func (p *OutboxPlugin) transactionRunner() plugins.TransactionRunner {
+	p.trLock.RLock()
+	defer p.trLock.RUnlock()
+	return p.tr
+}
+
+// rule returns the rule of the request (nil if none)
+func (p *OutboxPlugin) rule(r *plugins.Request) *Rule {
+	for _, rule := range p.conf.Rules {
+		if rule.Scope.Match(r) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// events returns the events of the write, and its write concern
+func (p *OutboxPlugin) events(r *plugins.Request, rule *Rule) ([]interface{}, interface{}) {
+	var (
+		events       []interface{}
+		writeConcern interface{}
+	)
+	var user string
+	if r.CC != nil && len(r.CC.Identities) > 0 {
+		user = r.CC.Identities[0].User()
+	}
+	now := p.now()
+	add := func(op string) bson.D {
+		ev := bson.D{
+			{"_id", primitive.NewObjectID()},
+			{"ns", r.Database() + "." + r.Collection()},
+			{"op", op},
+		}
+		events = append(events, ev)
+		return ev
+	}
+	// finish adds the client and the configured fields to the event
+	finish := func(ev bson.D) bson.D {
+		if r.CC != nil && r.CC.AppName != "" {
+			ev = append(ev, bson.E{"appName", r.CC.AppName})
+		}
+		if user != "" {
+			ev = append(ev, bson.E{"user", user})
+		}
+		ev = append(ev, bson.E{"time", primitive.NewDateTimeFromTime(now)})
+		return append(ev, rule.Event...)
+	}
+
+	switch cmd := r.Command.(type) {
+	case *command.Insert:
+		writeConcern = cmd.WriteConcern
+		for _, doc := range cmd.Documents {
+			ev := add(OpInsert)
+			if id, ok := bsonutil.Lookup(doc, "_id"); ok {
+				ev = append(ev, bson.E{"documentKey", bson.D{{"_id", id}}})
+			}
+			if rule.IncludeDocuments {
+				ev = append(ev, bson.E{"document", doc})
+			}
+			events[len(events)-1] = finish(ev)
+		}
+	case *command.Update:
+		writeConcern = cmd.WriteConcern
+		for _, u := range cmd.Updates {
+			ev := append(add(OpUpdate), bson.E{"filter", u.Query})
+			if rule.IncludeDocuments {
+				ev = append(ev, bson.E{"update", u.U})
+			}
+			events[len(events)-1] = finish(ev)
+		}
+	case *command.Delete:
+		writeConcern = cmd.WriteConcern
+		for _, deleteDoc := range cmd.Deletes {
+			q, _ := bsonutil.Lookup(deleteDoc, "q")
+			ev := append(add(OpDelete), bson.E{"filter", q})
+			events[len(events)-1] = finish(ev)
+		}
+	case *command.FindAndModify:
+		writeConcern = cmd.WriteConcern
+		op := OpUpdate
+		if bsonutil.GetBoolDefault(cmd.Remove, false) {
+			op = OpDelete
+		}
+		ev := append(add(op), bson.E{"filter", cmd.Query})
+		if rule.IncludeDocuments && op == OpUpdate {
+			ev = append(ev, bson.E{"update", cmd.Update})
+		}
+		events[len(events)-1] = finish(ev)
+	}
+	return events, writeConcern
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *OutboxPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	switch r.Command.(type) {
+	case *command.Insert, *command.Update, *command.Delete, *command.FindAndModify:
+	default:
+		return next(ctx, r)
+	}
+	rule := p.rule(r)
+	if rule == nil {
+		return next(ctx, r)
+	}
+	db, collection := r.Database(), r.Collection()
+
+	// The write can't be run in the proxy's own transaction: it would be committed
+	// even if the client's transaction is then aborted
+	if s := r.Command.GetSession(); s != nil && s.InTransaction() {
+		writesTotal.WithLabelValues(db, collection, "failed").Inc()
+		return mongoerror.OperationNotSupportedInTransaction.ErrMessage(fmt.Sprintf("writes to %s.%s publish outbox events and can't be run in transactions", db, collection)), nil
+	}
+
+	tr := p.transactionRunner()
+	if tr == nil {
+		writesTotal.WithLabelValues(db, collection, "failed").Inc()
+		return mongoerror.InternalError.ErrMessage("no plugin in the chain can run transactions on the backend"), nil
+	}
+	doc, err := r.Document()
+	if err != nil {
+		return nil, err
+	}
+	events, writeConcern := p.events(r, rule)
+	outboxDB, outboxCollection := rule.outbox(db)
+
+	results, err := tr.RunTransaction(ctx, []plugins.TransactionCommand{
+		{Database: db, Command: doc},
+		{Database: outboxDB, Command: bson.D{{"insert", outboxCollection}, {"documents", events}}},
+	}, writeConcern)
+	if err == nil {
+		writesTotal.WithLabelValues(db, collection, "committed").Inc()
+		return results[0], nil
+	}
+
+	writesTotal.WithLabelValues(db, collection, "aborted").Inc()
+	// The write's own errors (e.g. write errors) are returned to the client as is,
+	// nothing was written
+	if len(results) == 1 && len(results[0]) > 0 {
+		return results[0], nil
+	}
+	logrus.Errorf("OUTBOX ERROR: %s on %s.%s with its events in %s.%s: %s", r.CommandName, db, collection, outboxDB, outboxCollection, err.Error())
+	return nil, err
+}
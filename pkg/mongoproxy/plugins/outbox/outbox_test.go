@@ -0,0 +1,196 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+// testRunner records the transactions, failing the commands on the "fail"
+// collections
+type testRunner struct {
+	transactions []string
+}
+
+func (r *testRunner) RunTransaction(ctx context.Context, cmds []plugins.TransactionCommand, writeConcern interface{}) ([]bson.D, error) {
+	var results []bson.D
+	for i, c := range cmds {
+		// The events are recorded without their generated fields
+		doc := c.Command
+		if docs, ok := bsonutil.Lookup(doc, "documents"); ok && i == 1 {
+			events := bson.A{}
+			for _, ev := range docs.([]interface{}) {
+				var e bson.D
+				for _, f := range ev.(bson.D) {
+					if f.Key != "_id" && f.Key != "time" {
+						e = append(e, f)
+					}
+				}
+				events = append(events, e)
+			}
+			doc = bson.D{doc[0], {"documents", events}}
+		}
+		r.transactions = append(r.transactions, fmt.Sprintf("%s %v", c.Database, doc[:2]))
+		if c.Command[0].Value == "fail" {
+			results = append(results, bson.D{{"n", 0}, {"writeErrors", bson.A{bson.D{{"index", 0}, {"code", 11000}}}}, {"ok", 1}})
+			return results, fmt.Errorf("write errors")
+		}
+		if c.Command[0].Value == "fail_outbox" {
+			results = append(results, bson.D{{"ok", 0}})
+			return results, fmt.Errorf("outbox failed")
+		}
+		results = append(results, bson.D{{"n", 1}, {"ok", 1}})
+	}
+	return results, nil
+}
+
+func TestOutbox(t *testing.T) {
+	tests := []struct {
+		cmd          bson.D
+		transactions []string
+		response     bson.D
+		err          bool
+	}{
+		{
+			cmd: bson.D{{"insert", "orders"}, {"documents", bson.A{bson.D{{"_id", 1}, {"total", 5}}}}, {"$db", "shop"}},
+			transactions: []string{
+				"shop [{insert orders} {documents [[{_id 1} {total 5}]]}]",
+				"shop [{insert outbox} {documents [[{ns shop.orders} {op insert} {documentKey [{_id 1}]} {document [{_id 1} {total 5}]} {type order}]]}]",
+			},
+			response: bson.D{{"n", 1}, {"ok", 1}},
+		},
+		{
+			cmd: bson.D{{"update", "orders"}, {"updates", bson.A{bson.D{{"q", bson.D{{"_id", 1}}}, {"u", bson.D{{"$set", bson.D{{"total", 6}}}}}}}}, {"$db", "shop"}},
+			transactions: []string{
+				"shop [{update orders} {updates [[{q [{_id 1}]} {u [{$set [{total 6}]}]}]]}]",
+				"shop [{insert outbox} {documents [[{ns shop.orders} {op update} {filter [{_id 1}]} {update [{$set [{total 6}]}]} {type order}]]}]",
+			},
+			response: bson.D{{"n", 1}, {"ok", 1}},
+		},
+		{
+			cmd: bson.D{{"delete", "orders"}, {"deletes", bson.A{bson.D{{"q", bson.D{{"_id", 1}}}, {"limit", 1}}}}, {"$db", "shop"}},
+			transactions: []string{
+				"shop [{delete orders} {deletes [[{q [{_id 1}]} {limit 1}]]}]",
+				"shop [{insert outbox} {documents [[{ns shop.orders} {op delete} {filter [{_id 1}]} {type order}]]}]",
+			},
+			response: bson.D{{"n", 1}, {"ok", 1}},
+		},
+		// Outboxes may be in another database
+		{
+			cmd: bson.D{{"findAndModify", "payments"}, {"query", bson.D{{"_id", 1}}}, {"remove", true}, {"$db", "shop"}},
+			transactions: []string{
+				"shop [{findAndModify payments} {query [{_id 1}]}]",
+				"events [{insert payments} {documents [[{ns shop.payments} {op delete} {filter [{_id 1}]}]]}]",
+			},
+			response: bson.D{{"n", 1}, {"ok", 1}},
+		},
+		// Writes in the client's transactions are rejected, but not retryable writes
+		{
+			cmd:      bson.D{{"insert", "orders"}, {"documents", bson.A{bson.D{{"_id", 1}}}}, {"lsid", bson.D{{"id", 1}}}, {"txnNumber", int64(2)}, {"startTransaction", true}, {"autocommit", false}, {"$db", "shop"}},
+			response: mongoerror.OperationNotSupportedInTransaction.ErrMessage("writes to shop.orders publish outbox events and can't be run in transactions"),
+		},
+		{
+			cmd:      bson.D{{"insert", "orders"}, {"documents", bson.A{bson.D{{"_id", 1}}}}, {"lsid", bson.D{{"id", 1}}}, {"txnNumber", int64(3)}, {"autocommit", false}, {"$db", "shop"}},
+			response: mongoerror.OperationNotSupportedInTransaction.ErrMessage("writes to shop.orders publish outbox events and can't be run in transactions"),
+		},
+		{
+			cmd: bson.D{{"insert", "orders"}, {"documents", bson.A{bson.D{{"_id", 1}}}}, {"lsid", bson.D{{"id", 1}}}, {"txnNumber", int64(4)}, {"$db", "shop"}},
+			transactions: []string{
+				"shop [{insert orders} {documents [[{_id 1}]]}]",
+				"shop [{insert outbox} {documents [[{ns shop.orders} {op insert} {documentKey [{_id 1}]} {document [{_id 1}]} {type order}]]}]",
+			},
+			response: bson.D{{"n", 1}, {"ok", 1}},
+		},
+		// Writes to other collections are passed through
+		{
+			cmd:      bson.D{{"insert", "users"}, {"documents", bson.A{bson.D{{"_id", 1}}}}, {"$db", "shop"}},
+			response: bson.D{{"passed", true}},
+		},
+		// The write's errors are returned as is
+		{
+			cmd: bson.D{{"insert", "fail"}, {"documents", bson.A{bson.D{{"_id", 1}}}}, {"$db", "shop"}},
+			transactions: []string{
+				"shop [{insert fail} {documents [[{_id 1}]]}]",
+			},
+			response: bson.D{{"n", 0}, {"writeErrors", bson.A{bson.D{{"index", 0}, {"code", 11000}}}}, {"ok", 1}},
+		},
+		{
+			cmd: bson.D{{"insert", "orders"}, {"documents", bson.A{bson.D{{"_id", 1}}}}, {"$db", "failing"}},
+			transactions: []string{
+				"failing [{insert orders} {documents [[{_id 1}]]}]",
+				"failing [{insert fail_outbox} {documents [[{ns failing.orders} {op insert} {documentKey [{_id 1}]}]]}]",
+			},
+			err: true,
+		},
+	}
+
+	pl, _ := plugins.GetPlugin(Name)
+	p := pl.(*OutboxPlugin)
+	if err := p.Configure(bson.D{{"rules", bson.A{
+		bson.D{{"scope", bson.D{{"collections", bson.A{"shop.orders", "shop.fail"}}}}, {"outbox", "outbox"}, {"event", bson.D{{"type", "order"}}}, {"includeDocuments", true}},
+		bson.D{{"scope", bson.D{{"collections", bson.A{"shop.payments"}}}}, {"outbox", "events.payments"}},
+		bson.D{{"scope", bson.D{{"collections", bson.A{"failing.orders"}}}}, {"outbox", "fail_outbox"}},
+	}}}); err != nil {
+		t.Fatal(err)
+	}
+	p.now = func() time.Time { return time.Unix(0, 0) }
+	pipeline := plugins.BuildPipeline([]plugins.Plugin{p}, func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+		return bson.D{{"passed", true}}, nil
+	})
+
+	for i, test := range tests {
+		r := &testRunner{}
+		p.SetTransactionRunner(r)
+		cmd, _ := command.GetCommand(test.cmd[0].Key)
+		if err := cmd.FromBSOND(test.cmd); err != nil {
+			t.Fatal(err)
+		}
+		response, err := pipeline(context.TODO(), &plugins.Request{CommandName: test.cmd[0].Key, Command: cmd, CC: plugins.NewClientConnection()})
+		if (err != nil) != test.err {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if !reflect.DeepEqual(r.transactions, test.transactions) {
+			t.Fatalf("%d: expected transactions %q, got %q", i, test.transactions, r.transactions)
+		}
+		if !reflect.DeepEqual(response, test.response) {
+			t.Fatalf("%d: expected response %v, got %v", i, test.response, response)
+		}
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	rule := func(outbox string, event bson.D) bson.D {
+		return bson.D{{"rules", bson.A{bson.D{
+			{"scope", bson.D{{"collections", bson.A{"shop.orders"}}}},
+			{"outbox", outbox},
+			{"event", event},
+		}}}}
+	}
+	tests := []struct {
+		conf bson.D
+		ok   bool
+	}{
+		{conf: rule("outbox", bson.D{{"type", "order"}}), ok: true},
+		{conf: rule("events.orders", nil), ok: true},
+		{conf: bson.D{}},
+		{conf: rule("", nil)},
+		{conf: rule("events.", nil)},
+		{conf: rule("outbox", bson.D{{"op", "x"}})},
+		{conf: bson.D{{"rules", bson.A{bson.D{{"outbox", "outbox"}}}}}},
+	}
+	for i, test := range tests {
+		pl, _ := plugins.GetPlugin(Name)
+		if err := pl.Configure(test.conf); (err == nil) != test.ok {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package plugins
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var (
+	postCommitDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_postcommit_dropped_total",
+		Help: "The total number of post-commit events dropped because the queue was full",
+	})
+	postCommitSummary = promauto.NewSummaryVec(prometheus.SummaryOpts{
+		Name:       "mongoproxy_plugins_postcommit_duration_seconds",
+		Help:       "Summary of PostCommit calls",
+		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001, 1.0: 0.0},
+		MaxAge:     time.Minute,
+	}, []string{"plugin"})
+)
+
+// PostCommitHook is an optional interface a Plugin can implement to be called
+// asynchronously (off the critical path of the request) after the pipeline has
+// completed. This is intended for things like audit logs, mirroring and analytics
+// which shouldn't add latency to the client.
+type PostCommitHook interface {
+	PostCommit(context.Context, *PostCommitEvent)
+}
+
+// PostCommitEvent is the information passed to PostCommitHooks. Hooks must
+// treat all fields as read-only as the event is shared between hooks.
+type PostCommitEvent struct {
+	Request *Request
+	// Database and Collection of the command (captured before the pipeline ran)
+	Database   string
+	Collection string
+	// Metadata set by plugins while processing the request
+	Metadata *Metadata
+
+	Response bson.D
+	Err      error
+
+	Start    time.Time
+	Duration time.Duration
+}
+
+// NewPostCommitDispatcher returns a dispatcher for all plugins in ps which
+// implement PostCommitHook. Returns nil if there are no such plugins.
+func NewPostCommitDispatcher(ps []Plugin, workers, queueSize int) *PostCommitDispatcher {
+	var hooks []postCommitHook
+	for _, p := range ps {
+		var scope *Scope
+		if sp, ok := p.(*scopedPlugin); ok {
+			scope = sp.scope
+		}
+		if h, ok := Unwrap(p).(PostCommitHook); ok {
+			hooks = append(hooks, postCommitHook{name: p.Name(), scope: scope, h: h})
+		}
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	if workers <= 0 {
+		workers = 1
+	}
+
+	d := &PostCommitDispatcher{
+		hooks: hooks,
+		ch:    make(chan *PostCommitEvent, queueSize),
+	}
+	d.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go d.worker()
+	}
+	return d
+}
+
+type postCommitHook struct {
+	name  string
+	scope *Scope
+	h     PostCommitHook
+}
+
+// PostCommitDispatcher runs PostCommitHooks on a pool of background workers
+type PostCommitDispatcher struct {
+	hooks []postCommitHook
+	ch    chan *PostCommitEvent
+	wg    sync.WaitGroup
+
+	l      sync.RWMutex
+	closed bool
+}
+
+// Dispatch queues the event for the hooks. This never blocks; if the queue is
+// full the event is dropped.
+func (d *PostCommitDispatcher) Dispatch(e *PostCommitEvent) {
+	if d == nil {
+		return
+	}
+	d.l.RLock()
+	defer d.l.RUnlock()
+	if d.closed {
+		postCommitDropped.Inc()
+		return
+	}
+	select {
+	case d.ch <- e:
+	default:
+		postCommitDropped.Inc()
+	}
+}
+
+func (d *PostCommitDispatcher) worker() {
+	defer d.wg.Done()
+	for e := range d.ch {
+		for _, h := range d.hooks {
+			if h.scope != nil && !h.scope.match(e.Request.CommandName, e.Database, e.Collection) {
+				continue
+			}
+			d.run(h, e)
+		}
+	}
+}
+
+func (d *PostCommitDispatcher) run(h postCommitHook, e *PostCommitEvent) {
+	start := time.Now()
+	defer func() {
+		postCommitSummary.WithLabelValues(h.name).Observe(time.Since(start).Seconds())
+		if err := recover(); err != nil {
+			logrus.Errorf("Panic in post-commit hook %s: %v", h.name, err)
+		}
+	}()
+	h.h.PostCommit(context.Background(), e)
+}
+
+// Close stops accepting events and waits for the queued events to be processed
+// (or the context to be done).
+func (d *PostCommitDispatcher) Close(ctx context.Context) error {
+	if d == nil {
+		return nil
+	}
+	d.l.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.ch)
+	}
+	d.l.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
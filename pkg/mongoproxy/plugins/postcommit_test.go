@@ -0,0 +1,53 @@
+package plugins
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wish/mongoproxy/pkg/command"
+)
+
+type postCommitPlugin struct {
+	noopPlugin
+	l      sync.Mutex
+	events []*PostCommitEvent
+}
+
+func (p *postCommitPlugin) PostCommit(ctx context.Context, e *PostCommitEvent) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.events = append(p.events, e)
+}
+
+func TestPostCommitDispatcher(t *testing.T) {
+	if d := NewPostCommitDispatcher([]Plugin{&noopPlugin{}}, 1, 10); d != nil {
+		t.Fatalf("expected no dispatcher without hooks")
+	}
+
+	all := &postCommitPlugin{}
+	scoped := &postCommitPlugin{}
+	d := NewPostCommitDispatcher([]Plugin{all, Scoped(scoped, &Scope{Databases: []string{"a"}})}, 2, 10)
+
+	for _, db := range []string{"a", "b"} {
+		d.Dispatch(&PostCommitEvent{
+			Request:  &Request{CommandName: "find", Command: &command.Find{}},
+			Database: db,
+			Start:    time.Now(),
+		})
+	}
+
+	if err := d.Close(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	// Dispatching after close is dropped (and doesn't panic)
+	d.Dispatch(&PostCommitEvent{Request: &Request{}})
+
+	if len(all.events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(all.events))
+	}
+	if len(scoped.events) != 1 || scoped.events[0].Database != "a" {
+		t.Fatalf("expected 1 scoped event, got %v", scoped.events)
+	}
+}
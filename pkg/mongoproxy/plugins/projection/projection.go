@@ -0,0 +1,577 @@
+package projection
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "projection"
+
+var (
+	syncsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_projection_syncs_total",
+		Help: "The total document syncs to projection collections by result",
+	}, []string{"target", "result"})
+)
+
+// Results of a sync
+const (
+	ResultSynced  = "synced"
+	ResultRetried = "retried"
+	ResultFailed  = "failed"
+	ResultDropped = "dropped"
+	ResultSkipped = "skipped"
+)
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &ProjectionPlugin{
+			conf: ProjectionPluginConfig{
+				Workers:       4,
+				QueueSize:     10000,
+				MaxRetries:    5,
+				RetryInterval: "1s",
+				Timeout:       "10s",
+			},
+		}
+	})
+}
+
+type ProjectionPluginConfig struct {
+	// Rules are the projections of collections; the first rule matching the
+	// namespace of a write applies
+	Rules []*Rule `bson:"rules"`
+	// Workers is the number of documents synced concurrently (default 4)
+	Workers int `bson:"workers"`
+	// QueueSize is the number of documents waiting to be synced; further writes
+	// aren't synced (default 10000)
+	QueueSize int `bson:"queueSize"`
+	// MaxRetries is the number of times a failed sync is retried (default 5)
+	MaxRetries int `bson:"maxRetries"`
+	// RetryInterval is the wait before the first retry, doubled on each retry (default "1s")
+	RetryInterval string `bson:"retryInterval"`
+	// Timeout is the timeout of syncing a document (default "10s")
+	Timeout string `bson:"timeout"`
+
+	retryInterval time.Duration
+	timeout       time.Duration
+}
+
+// Rule mirrors fields of the documents of a set of collections into a projection
+// collection
+type Rule struct {
+	// Scope are the source collections (same format as a plugin scope; required)
+	Scope *plugins.Scope `bson:"scope"`
+	// Target is the projection collection: "db.collection", or "collection" in the
+	// database of the source (required)
+	Target string `bson:"target"`
+	// Fields are the fields mirrored (dotted for embedded fields; required)
+	Fields []string `bson:"fields"`
+
+	targetDB, targetCollection string
+	projection                 bson.D
+}
+
+func (r *Rule) load() error {
+	if r.Scope.IsZero() {
+		return fmt.Errorf("scope is required")
+	}
+	r.Scope.Compile()
+
+	if r.Target == "" || strings.HasPrefix(r.Target, ".") || strings.HasSuffix(r.Target, ".") {
+		return fmt.Errorf("invalid target %q", r.Target)
+	}
+	if i := strings.IndexByte(r.Target, '.'); i != -1 {
+		r.targetDB, r.targetCollection = r.Target[:i], r.Target[i+1:]
+	} else {
+		r.targetCollection = r.Target
+	}
+
+	if len(r.Fields) == 0 {
+		return fmt.Errorf("fields are required")
+	}
+	r.projection = bson.D{{"_id", 1}}
+	for _, f := range r.Fields {
+		if f == "" || f == "_id" || strings.HasPrefix(f, "_id.") || strings.ContainsRune(f, '$') {
+			return fmt.Errorf("invalid field %q", f)
+		}
+		r.projection = append(r.projection, bson.E{f, 1})
+	}
+	return nil
+}
+
+// target returns the namespace of the projection of the source database
+func (r *Rule) target(db string) (string, string) {
+	if r.targetDB != "" {
+		return r.targetDB, r.targetCollection
+	}
+	return db, r.targetCollection
+}
+
+// touches returns whether the update may change the fields of the rule
+func (r *Rule) touches(update bson.D) bool {
+	var updated []string
+	for _, e := range update {
+		if !strings.HasPrefix(e.Key, "$") {
+			// A replacement removes the fields it doesn't have
+			return true
+		}
+		fields, _ := e.Value.(bson.D)
+		for _, f := range fields {
+			updated = append(updated, f.Key)
+			// $rename also writes the new field
+			if to, ok := f.Value.(string); ok && e.Key == "$rename" {
+				updated = append(updated, to)
+			}
+		}
+	}
+	for _, u := range updated {
+		// Positional updates (e.g. "tags.$") change the array
+		u = strings.SplitN(u, ".$", 2)[0]
+		for _, field := range r.Fields {
+			if u == field || strings.HasPrefix(field, u+".") || strings.HasPrefix(u, field+".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// job syncs the projection of a document
+type job struct {
+	rule           *Rule
+	db, collection string
+	id             interface{}
+	// doc is the inserted document; if nil the document is read from the source
+	doc bson.D
+	// deleted is set if the document was deleted
+	deleted bool
+}
+
+// This is a plugin that mirrors fields of the documents written to collections into
+// projection collections (e.g. a slim search collection), asynchronously with retries
+type ProjectionPlugin struct {
+	conf ProjectionPluginConfig
+
+	crLock sync.RWMutex
+	cr     plugins.CommandRunner
+
+	// queues are the jobs of each worker; the jobs of a document go to the same
+	// worker so its syncs are in order
+	queues []chan *job
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func (p *ProjectionPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *ProjectionPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	if len(p.conf.Rules) == 0 {
+		return fmt.Errorf("rules are required")
+	}
+	for i, rule := range p.conf.Rules {
+		if rule == nil {
+			return fmt.Errorf("empty rule %d", i)
+		}
+		if err := rule.load(); err != nil {
+			return fmt.Errorf("invalid rule %d: %w", i, err)
+		}
+	}
+	if p.conf.Workers <= 0 {
+		return fmt.Errorf("workers must be positive: %d", p.conf.Workers)
+	}
+	if p.conf.QueueSize <= 0 {
+		return fmt.Errorf("queueSize must be positive: %d", p.conf.QueueSize)
+	}
+	if p.conf.MaxRetries < 0 {
+		return fmt.Errorf("maxRetries can't be negative: %d", p.conf.MaxRetries)
+	}
+	if p.conf.retryInterval, err = time.ParseDuration(p.conf.RetryInterval); err != nil {
+		return err
+	}
+	if p.conf.timeout, err = time.ParseDuration(p.conf.Timeout); err != nil {
+		return err
+	}
+
+	p.queues = make([]chan *job, p.conf.Workers)
+	for i := range p.queues {
+		p.queues[i] = make(chan *job, p.conf.QueueSize/p.conf.Workers+1)
+	}
+	return nil
+}
+
+// SetCommandRunner sets the runner of the commands syncing the projections
+func (p *ProjectionPlugin) SetCommandRunner(cr plugins.CommandRunner) {
+	p.crLock.Lock()
+	defer p.crLock.Unlock()
+	p.cr = cr
+}
+
+func (p *ProjectionPlugin) commandRunner() plugins.CommandRunner {
+	p.crLock.RLock()
+	defer p.crLock.RUnlock()
+	return p.cr
+}
+
+// ReadsBatches returns false as projections are synced from the write commands
+func (p *ProjectionPlugin) ReadsBatches() bool { return false }
+
+// ReadsDocuments returns true as inserted documents are projected
+func (p *ProjectionPlugin) ReadsDocuments() bool { return true }
+
+// Start starts syncing the queued documents
+func (p *ProjectionPlugin) Start(ctx context.Context) error {
+	p.stop = make(chan struct{})
+	for _, q := range p.queues {
+		p.wg.Add(1)
+		go func(q chan *job) {
+			defer p.wg.Done()
+			for {
+				select {
+				case <-p.stop:
+					// Sync the documents queued before stopping
+					for {
+						select {
+						case j := <-q:
+							p.run(j)
+						default:
+							return
+						}
+					}
+				case j := <-q:
+					p.run(j)
+				}
+			}
+		}(q)
+	}
+	return nil
+}
+
+// Stop syncs the queued documents and stops syncing
+func (p *ProjectionPlugin) Stop(ctx context.Context) error {
+	if p.stop == nil {
+		return nil
+	}
+	close(p.stop)
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run syncs the document, retrying failures
+func (p *ProjectionPlugin) run(j *job) {
+	db, collection := j.rule.target(j.db)
+	target := db + "." + collection
+	interval := p.conf.retryInterval
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), p.conf.timeout)
+		err := p.sync(ctx, j)
+		cancel()
+		if err == nil {
+			syncsTotal.WithLabelValues(target, ResultSynced).Inc()
+			return
+		}
+
+		stopping := false
+		select {
+		case <-p.stop:
+			stopping = true
+		default:
+		}
+		if attempt == p.conf.MaxRetries || stopping {
+			syncsTotal.WithLabelValues(target, ResultFailed).Inc()
+			logrus.Errorf("PROJECTION ERROR: syncing %v from %s.%s to %s: %s", j.id, j.db, j.collection, target, err.Error())
+			return
+		}
+		syncsTotal.WithLabelValues(target, ResultRetried).Inc()
+		logrus.Debugf("Error syncing %v from %s.%s to %s, retrying: %v", j.id, j.db, j.collection, target, err)
+
+		select {
+		case <-time.After(interval):
+		case <-p.stop:
+		}
+		interval *= 2
+	}
+}
+
+// runCommand runs the command on the backend, returning write errors as errors
+func (p *ProjectionPlugin) runCommand(ctx context.Context, db string, cmd bson.D) (bson.D, error) {
+	cr := p.commandRunner()
+	if cr == nil {
+		return nil, fmt.Errorf("no plugin in the chain can run commands on the backend")
+	}
+	result, err := cr.RunCommand(ctx, db, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if !bsonutil.Ok(result) {
+		errmsg, _ := bsonutil.Lookup(result, "errmsg")
+		return nil, fmt.Errorf("%s failed: %v", cmd[0].Key, errmsg)
+	}
+	if v, ok := bsonutil.Lookup(result, "writeErrors"); ok {
+		return nil, fmt.Errorf("%s failed: %v", cmd[0].Key, v)
+	}
+	return result, nil
+}
+
+// sync writes the projection of the document (or deletes it if the document was deleted)
+func (p *ProjectionPlugin) sync(ctx context.Context, j *job) error {
+	db, collection := j.rule.target(j.db)
+	doc, deleted := j.doc, j.deleted
+	if doc == nil && !deleted {
+		result, err := p.runCommand(ctx, j.db, bson.D{
+			{"find", j.collection},
+			{"filter", bson.D{{"_id", j.id}}},
+			{"projection", j.rule.projection},
+			{"limit", 1},
+			{"singleBatch", true},
+		})
+		if err != nil {
+			return err
+		}
+		batch, _ := bsonutil.Lookup(result, "cursor", "firstBatch")
+		docs, _ := batch.(primitive.A)
+		if len(docs) == 0 {
+			// The document was deleted since the write
+			deleted = true
+		} else {
+			doc, _ = docs[0].(bson.D)
+		}
+	}
+
+	if deleted {
+		_, err := p.runCommand(ctx, db, bson.D{
+			{"delete", collection},
+			{"deletes", bson.A{bson.D{{"q", bson.D{{"_id", j.id}}}, {"limit", 1}}}},
+		})
+		return err
+	}
+
+	var set, unset bson.D
+	for _, f := range j.rule.Fields {
+		if v, ok := lookupField(doc, f); ok {
+			set = append(set, bson.E{f, v})
+		} else {
+			unset = append(unset, bson.E{f, ""})
+		}
+	}
+	// Every field is either set or unset, so the update isn't empty
+	var update bson.D
+	if len(set) > 0 {
+		update = append(update, bson.E{"$set", set})
+	}
+	if len(unset) > 0 {
+		update = append(update, bson.E{"$unset", unset})
+	}
+	_, err := p.runCommand(ctx, db, bson.D{
+		{"update", collection},
+		{"updates", bson.A{bson.D{{"q", bson.D{{"_id", j.id}}}, {"u", update}, {"upsert", true}}}},
+	})
+	return err
+}
+
+// lookupField returns the value of the (dotted) field of the document
+func lookupField(doc bson.D, field string) (interface{}, bool) {
+	var v interface{} = doc
+	for _, key := range strings.Split(field, ".") {
+		d, ok := v.(bson.D)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = bsonutil.Lookup(d, key); !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// rule returns the rule of the namespace (nil if none)
+func (p *ProjectionPlugin) rule(db, collection string) *Rule {
+	for _, rule := range p.conf.Rules {
+		if rule.Scope.MatchNamespace(db, collection) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// queryID returns the _id the query selects by equality
+func queryID(query bson.D) (interface{}, bool) {
+	id, ok := bsonutil.Lookup(query, "_id")
+	if !ok {
+		return nil, false
+	}
+	if ops, isDoc := id.(bson.D); isDoc && len(ops) > 0 && strings.HasPrefix(ops[0].Key, "$") {
+		return bsonutil.Lookup(ops, "$eq")
+	}
+	return id, true
+}
+
+// upsertedIDs returns the _id of the documents upserted by the statements of an update
+func upsertedIDs(response bson.D) map[int]interface{} {
+	upserted := make(map[int]interface{})
+	v, _ := bsonutil.Lookup(response, "upserted")
+	items, _ := v.(primitive.A)
+	for _, item := range items {
+		itemD, _ := item.(bson.D)
+		index, _ := bsonutil.Lookup(itemD, "index")
+		id, _ := bsonutil.Lookup(itemD, "_id")
+		switch n := index.(type) {
+		case int32:
+			upserted[int(n)] = id
+		case int64:
+			upserted[int(n)] = id
+		}
+	}
+	return upserted
+}
+
+// jobs returns the documents to sync after the write, and the number of writes
+// which can't be synced (not selecting documents by _id)
+func (p *ProjectionPlugin) jobs(e *plugins.PostCommitEvent, rule *Rule) ([]*job, int) {
+	var (
+		jobs    []*job
+		skipped int
+	)
+	add := func(id interface{}) *job {
+		j := &job{rule: rule, db: e.Database, collection: e.Collection, id: id}
+		jobs = append(jobs, j)
+		return j
+	}
+
+	_, writeErrors := bsonutil.Lookup(e.Response, "writeErrors")
+	switch cmd := e.Request.Command.(type) {
+	case *command.Insert:
+		for _, doc := range cmd.Documents {
+			id, ok := bsonutil.Lookup(doc, "_id")
+			if !ok {
+				skipped++
+				continue
+			}
+			j := add(id)
+			// With write errors the documents inserted are read from the source
+			if !writeErrors {
+				j.doc = doc
+			}
+		}
+
+	case *command.Update:
+		upserted := upsertedIDs(e.Response)
+		for i, u := range cmd.Updates {
+			if id, ok := upserted[i]; ok {
+				add(id)
+				continue
+			}
+			if !rule.touches(u.U) {
+				continue
+			}
+			if id, ok := queryID(u.Query); ok {
+				add(id)
+			} else {
+				skipped++
+			}
+		}
+
+	case *command.Delete:
+		for _, deleteDoc := range cmd.Deletes {
+			q, _ := bsonutil.Lookup(deleteDoc, "q")
+			query, _ := q.(bson.D)
+			if id, ok := queryID(query); ok {
+				add(id).deleted = true
+			} else {
+				skipped++
+			}
+		}
+
+	case *command.FindAndModify:
+		// The response has the document (before or after the change)
+		value, _ := bsonutil.Lookup(e.Response, "value")
+		upsertedID, upserted := bsonutil.Lookup(e.Response, "lastErrorObject", "upserted")
+		valueD, _ := value.(bson.D)
+		switch {
+		case upserted:
+			add(upsertedID)
+		case valueD == nil:
+		case bsonutil.GetBoolDefault(cmd.Remove, false):
+			id, _ := bsonutil.Lookup(valueD, "_id")
+			add(id).deleted = true
+		case rule.touches(cmd.Update):
+			id, _ := bsonutil.Lookup(valueD, "_id")
+			add(id)
+		}
+	}
+	return jobs, skipped
+}
+
+// queue returns the queue of the worker syncing the document
+func (p *ProjectionPlugin) queue(j *job) chan *job {
+	b, _ := bson.Marshal(bson.D{{"ns", j.db + "." + j.collection}, {"_id", j.id}})
+	h := fnv.New32a()
+	h.Write(b)
+	return p.queues[h.Sum32()%uint32(len(p.queues))]
+}
+
+// PostCommit queues the documents written to be synced to their projection
+func (p *ProjectionPlugin) PostCommit(ctx context.Context, e *plugins.PostCommitEvent) {
+	if e.Err != nil || !bsonutil.Ok(e.Response) {
+		return
+	}
+	rule := p.rule(e.Database, e.Collection)
+	if rule == nil {
+		return
+	}
+
+	db, collection := rule.target(e.Database)
+	target := db + "." + collection
+	jobs, skipped := p.jobs(e, rule)
+	if skipped > 0 {
+		syncsTotal.WithLabelValues(target, ResultSkipped).Add(float64(skipped))
+		logrus.Warningf("PROJECTION SKIPPED: %d %s statements on %s.%s don't select documents by _id", skipped, e.Request.CommandName, e.Database, e.Collection)
+	}
+	for _, j := range jobs {
+		select {
+		case p.queue(j) <- j:
+		default:
+			syncsTotal.WithLabelValues(target, ResultDropped).Inc()
+		}
+	}
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *ProjectionPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	return next(ctx, r)
+}
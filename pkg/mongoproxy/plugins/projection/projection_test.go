@@ -0,0 +1,213 @@
+package projection
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+// testRunner serves the source documents and records the projection writes
+type testRunner struct {
+	l        sync.Mutex
+	source   map[int32]bson.D
+	failures int
+	writes   []string
+}
+
+func (r *testRunner) RunCommand(ctx context.Context, db string, cmd bson.D) (bson.D, error) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	if r.failures > 0 {
+		r.failures--
+		return nil, fmt.Errorf("connection refused")
+	}
+	switch cmd[0].Key {
+	case "find":
+		id, _ := bsonutil.Lookup(cmd, "filter", "_id")
+		batch := bson.A{}
+		if doc, ok := r.source[id.(int32)]; ok {
+			batch = append(batch, doc)
+		}
+		return bson.D{{"cursor", bson.D{{"firstBatch", batch}}}, {"ok", 1}}, nil
+	case "update":
+		updates, _ := bsonutil.Lookup(cmd, "updates")
+		u, _ := bsonutil.Lookup(updates.(bson.A)[0].(bson.D), "u")
+		r.writes = append(r.writes, fmt.Sprintf("%s.%s %v", db, cmd[0].Value, u))
+	case "delete":
+		deletes, _ := bsonutil.Lookup(cmd, "deletes")
+		q, _ := bsonutil.Lookup(deletes.(bson.A)[0].(bson.D), "q")
+		r.writes = append(r.writes, fmt.Sprintf("%s.%s delete %v", db, cmd[0].Value, q))
+	}
+	return bson.D{{"ok", 1}}, nil
+}
+
+func newEvent(t *testing.T, d bson.D, response bson.D) *plugins.PostCommitEvent {
+	cmd, ok := command.GetCommand(d[0].Key)
+	if !ok {
+		t.Fatalf("no such command: %s", d[0].Key)
+	}
+	if err := cmd.FromBSOND(d); err != nil {
+		t.Fatal(err)
+	}
+	return &plugins.PostCommitEvent{
+		Request:    &plugins.Request{CommandName: d[0].Key, Command: cmd},
+		Database:   "shop",
+		Collection: command.GetCommandCollection(cmd),
+		Response:   response,
+	}
+}
+
+func TestProjection(t *testing.T) {
+	tests := []struct {
+		cmd      bson.D
+		response bson.D
+		source   map[int32]bson.D
+		failures int
+		writes   []string
+	}{
+		{
+			cmd:      bson.D{{"insert", "products"}, {"documents", bson.A{bson.D{{"_id", int32(1)}, {"name", "a"}, {"price", bson.D{{"amount", 1}}}, {"stock", 1}}}}},
+			response: bson.D{{"n", 1}, {"ok", 1}},
+			writes:   []string{`search.products [{$set [{name a} {price.amount 1}]} {$unset [{tags }]}]`},
+		},
+		// Other namespaces aren't projected
+		{
+			cmd:      bson.D{{"insert", "orders"}, {"documents", bson.A{bson.D{{"_id", int32(1)}, {"name", "a"}}}}},
+			response: bson.D{{"n", 1}, {"ok", 1}},
+		},
+		// Updates read the document from the source
+		{
+			cmd:      bson.D{{"update", "products"}, {"updates", bson.A{bson.D{{"q", bson.D{{"_id", int32(1)}}}, {"u", bson.D{{"$push", bson.D{{"tags", "b"}}}}}}}}},
+			response: bson.D{{"n", 1}, {"ok", 1}},
+			source:   map[int32]bson.D{1: {{"_id", int32(1)}, {"name", "a"}, {"price", bson.D{{"amount", 1}}}, {"tags", bson.A{"b"}}}},
+			writes:   []string{`search.products [{$set [{name a} {price.amount 1} {tags [b]}]}]`},
+		},
+		// Updates not touching the fields aren't projected
+		{
+			cmd:      bson.D{{"update", "products"}, {"updates", bson.A{bson.D{{"q", bson.D{{"_id", int32(1)}}}, {"u", bson.D{{"$inc", bson.D{{"stock", 1}}}}}}}}},
+			response: bson.D{{"n", 1}, {"ok", 1}},
+		},
+		{
+			cmd:      bson.D{{"update", "products"}, {"updates", bson.A{bson.D{{"q", bson.D{{"_id", int32(1)}}}, {"u", bson.D{{"$set", bson.D{{"price", 2}}}}}}}}},
+			response: bson.D{{"n", 1}, {"ok", 1}},
+			source:   map[int32]bson.D{1: {{"_id", int32(1)}, {"name", "a"}, {"price", 2}}},
+			writes:   []string{`search.products [{$set [{name a}]} {$unset [{price.amount } {tags }]}]`},
+		},
+		// Updates not selecting documents by _id are skipped
+		{
+			cmd:      bson.D{{"update", "products"}, {"updates", bson.A{bson.D{{"q", bson.D{{"name", "a"}}}, {"u", bson.D{{"$set", bson.D{{"name", "b"}}}}}, {"multi", true}}}}},
+			response: bson.D{{"n", 1}, {"ok", 1}},
+		},
+		{
+			cmd:      bson.D{{"update", "products"}, {"updates", bson.A{bson.D{{"q", bson.D{{"name", "c"}}}, {"u", bson.D{{"$set", bson.D{{"stock", 1}}}}}, {"upsert", true}}}}},
+			response: bson.D{{"n", 1}, {"upserted", bson.A{bson.D{{"index", int32(0)}, {"_id", int32(2)}}}}, {"ok", 1}},
+			source:   map[int32]bson.D{2: {{"_id", int32(2)}, {"name", "c"}, {"stock", 1}}},
+			writes:   []string{`search.products [{$set [{name c}]} {$unset [{price.amount } {tags }]}]`},
+		},
+		// Documents deleted since the write are deleted
+		{
+			cmd:      bson.D{{"update", "products"}, {"updates", bson.A{bson.D{{"q", bson.D{{"_id", int32(1)}}}, {"u", bson.D{{"name", "d"}}}}}}},
+			response: bson.D{{"n", 1}, {"ok", 1}},
+			writes:   []string{`search.products delete [{_id 1}]`},
+		},
+		{
+			cmd:      bson.D{{"delete", "products"}, {"deletes", bson.A{bson.D{{"q", bson.D{{"_id", bson.D{{"$eq", int32(1)}}}}}, {"limit", 1}}}}},
+			response: bson.D{{"n", 1}, {"ok", 1}},
+			writes:   []string{`search.products delete [{_id 1}]`},
+		},
+		{
+			cmd:      bson.D{{"findAndModify", "products"}, {"query", bson.D{{"name", "a"}}}, {"update", bson.D{{"$set", bson.D{{"name", "b"}}}}}},
+			response: bson.D{{"value", bson.D{{"_id", int32(1)}, {"name", "a"}}}, {"ok", 1}},
+			source:   map[int32]bson.D{1: {{"_id", int32(1)}, {"name", "b"}}},
+			writes:   []string{`search.products [{$set [{name b}]} {$unset [{price.amount } {tags }]}]`},
+		},
+		// Failed syncs are retried
+		{
+			cmd:      bson.D{{"insert", "products"}, {"documents", bson.A{bson.D{{"_id", int32(1)}, {"name", "a"}, {"price", bson.D{{"amount", 1}}}, {"tags", bson.A{}}}}}},
+			response: bson.D{{"n", 1}, {"ok", 1}},
+			failures: 2,
+			writes:   []string{`search.products [{$set [{name a} {price.amount 1} {tags []}]}]`},
+		},
+		// Failed writes aren't projected
+		{
+			cmd:      bson.D{{"insert", "products"}, {"documents", bson.A{bson.D{{"_id", int32(1)}, {"name", "a"}}}}},
+			response: bson.D{{"ok", 0}, {"errmsg", "failed"}},
+		},
+	}
+
+	for i, test := range tests {
+		pl, _ := plugins.GetPlugin(Name)
+		p := pl.(*ProjectionPlugin)
+		if err := p.Configure(bson.D{
+			{"rules", bson.A{bson.D{
+				{"scope", bson.D{{"collections", bson.A{"shop.products"}}}},
+				{"target", "search.products"},
+				{"fields", bson.A{"name", "price.amount", "tags"}},
+			}}},
+			{"retryInterval", "1ms"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		r := &testRunner{source: test.source, failures: test.failures}
+		p.SetCommandRunner(r)
+		if err := p.Start(context.TODO()); err != nil {
+			t.Fatal(err)
+		}
+		p.PostCommit(context.TODO(), newEvent(t, test.cmd, test.response))
+		// Syncs aren't retried once stopping, so wait for the retries
+		for deadline := time.Now().Add(time.Second); test.failures > 0 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			r.l.Lock()
+			n := len(r.writes)
+			r.l.Unlock()
+			if n > 0 {
+				break
+			}
+		}
+		if err := p.Stop(context.TODO()); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(r.writes, test.writes) {
+			t.Fatalf("%d: expected writes %q, got %q", i, test.writes, r.writes)
+		}
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	rule := func(target string, fields ...interface{}) bson.D {
+		return bson.D{{"rules", bson.A{bson.D{
+			{"scope", bson.D{{"collections", bson.A{"shop.products"}}}},
+			{"target", target},
+			{"fields", bson.A(fields)},
+		}}}}
+	}
+	tests := []struct {
+		conf bson.D
+		ok   bool
+	}{
+		{conf: rule("search.products", "name"), ok: true},
+		{conf: rule("products_search", "name", "price.amount"), ok: true},
+		{conf: bson.D{}},
+		{conf: rule("", "name")},
+		{conf: rule("search.", "name")},
+		{conf: rule("search.products")},
+		{conf: rule("search.products", "_id")},
+		{conf: rule("search.products", "$name")},
+		{conf: bson.D{{"rules", bson.A{bson.D{{"target", "search.products"}, {"fields", bson.A{"name"}}}}}}},
+		{conf: append(rule("search.products", "name"), bson.E{"workers", 0})},
+	}
+	for i, test := range tests {
+		pl, _ := plugins.GetPlugin(Name)
+		if err := pl.Configure(test.conf); (err == nil) != test.ok {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+}
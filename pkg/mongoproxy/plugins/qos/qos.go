@@ -0,0 +1,278 @@
+package qos
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "qos"
+
+var (
+	queueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mongoproxy_plugins_qos_queue_depth",
+		Help: "The current number of requests queued per priority class",
+	}, []string{"class"})
+	queueWaitSummary = promauto.NewSummaryVec(prometheus.SummaryOpts{
+		Name:       "mongoproxy_plugins_qos_queue_wait_seconds",
+		Help:       "Summary of the time requests were queued per priority class",
+		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001, 1.0: 0.0},
+		MaxAge:     time.Minute,
+	}, []string{"class"})
+	starvedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_qos_starved_total",
+		Help: "The total requests dispatched ahead of their weight by starvation protection",
+	}, []string{"class"})
+	rejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_qos_rejected_total",
+		Help: "The total requests rejected for exceeding maxQueueWait",
+	}, []string{"class"})
+	shedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_qos_shed_total",
+		Help: "The total requests shed while the backend was saturated",
+	}, []string{"class"})
+	saturatedGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongoproxy_plugins_qos_saturated",
+		Help: "Whether the backend was saturated (1) at the last shedding check",
+	})
+)
+
+// exemptCommands are connection management commands (handshakes, heartbeats, auth)
+// which are never queued
+var exemptCommands = map[string]struct{}{
+	"isMaster":     {},
+	"ismaster":     {},
+	"hello":        {},
+	"ping":         {},
+	"buildInfo":    {},
+	"buildinfo":    {},
+	"saslStart":    {},
+	"saslContinue": {},
+	"getnonce":     {},
+	"logout":       {},
+	"endSessions":  {},
+	"killOp":       {},
+	"killCursors":  {},
+}
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &QoSPlugin{
+			conf: QoSPluginConfig{
+				DefaultClass:  "default",
+				StarvationAge: "1s",
+			},
+		}
+	})
+}
+
+type QoSPluginConfig struct {
+	// MaxConcurrent is the max number of requests passed on to the rest of the
+	// chain at once; further requests are queued by class (required)
+	MaxConcurrent int `bson:"maxConcurrent"`
+	// Classes are the priority classes; a request is in the first class it matches
+	Classes []*ClassConfig `bson:"classes"`
+	// DefaultClass is the class of requests that match no class (default "default");
+	// it's created with weight 1 if it isn't in Classes
+	DefaultClass string `bson:"defaultClass"`
+	// StarvationAge is how long a request can be queued before it is dispatched
+	// ahead of all others regardless of weights (default "1s"; "0s" disables)
+	StarvationAge string `bson:"starvationAge"`
+	// MaxQueueWait is the max time a request is queued before it is rejected with
+	// a retryable error (default "0s"; wait until the request is cancelled)
+	MaxQueueWait string `bson:"maxQueueWait"`
+	// Shedding enables load shedding of the classes with a shed fraction
+	Shedding *SheddingConfig `bson:"shedding"`
+}
+
+// ClassConfig is a priority class
+type ClassConfig struct {
+	Name string `bson:"name"`
+	// Weight is the share of dispatches the class gets relative to the other
+	// classes while the proxy is saturated (default 1)
+	Weight int `bson:"weight"`
+	// Scope limits the namespaces and commands in the class (same format as a
+	// plugin scope; default all)
+	Scope *plugins.Scope `bson:"scope"`
+	// AppNames limits the client appNames in the class (default all)
+	AppNames []string `bson:"appNames"`
+	// Shed is the fraction (0-1) of the class's requests rejected while the
+	// backend is saturated (default 0; see Shedding)
+	Shed float64 `bson:"shed"`
+
+	appNames map[string]struct{}
+}
+
+func (c *ClassConfig) match(r *plugins.Request) bool {
+	if c.appNames != nil {
+		if r.CC == nil {
+			return false
+		}
+		if _, ok := c.appNames[r.CC.AppName]; !ok {
+			return false
+		}
+	}
+	return c.Scope.IsZero() || c.Scope.Match(r)
+}
+
+// This is a plugin that schedules requests by priority class when saturated
+type QoSPlugin struct {
+	conf QoSPluginConfig
+
+	classes      []*class
+	defaultClass *class
+	maxQueueWait time.Duration
+	s            *scheduler
+	shedder      *shedder
+}
+
+func (p *QoSPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *QoSPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	if p.conf.MaxConcurrent <= 0 {
+		return fmt.Errorf("maxConcurrent must be positive: %d", p.conf.MaxConcurrent)
+	}
+	starvationAge, err := time.ParseDuration(p.conf.StarvationAge)
+	if err != nil {
+		return fmt.Errorf("invalid starvationAge: %w", err)
+	}
+	if p.conf.MaxQueueWait != "" {
+		if p.maxQueueWait, err = time.ParseDuration(p.conf.MaxQueueWait); err != nil {
+			return fmt.Errorf("invalid maxQueueWait: %w", err)
+		}
+	}
+
+	p.classes = make([]*class, 0, len(p.conf.Classes)+1)
+	names := make(map[string]*class, len(p.conf.Classes)+1)
+	for _, c := range p.conf.Classes {
+		if c == nil || c.Name == "" {
+			return fmt.Errorf("classes must have a name")
+		}
+		if _, ok := names[c.Name]; ok {
+			return fmt.Errorf("duplicate class %s", c.Name)
+		}
+		if c.Weight < 0 {
+			return fmt.Errorf("weight of class %s must not be negative: %d", c.Name, c.Weight)
+		}
+		if c.Weight == 0 {
+			c.Weight = 1
+		}
+		if c.Shed < 0 || c.Shed > 1 {
+			return fmt.Errorf("shed of class %s must be between 0 and 1: %v", c.Name, c.Shed)
+		}
+		if c.Scope != nil {
+			c.Scope.Compile()
+		}
+		if len(c.AppNames) > 0 {
+			c.appNames = make(map[string]struct{}, len(c.AppNames))
+			for _, appName := range c.AppNames {
+				c.appNames[appName] = struct{}{}
+			}
+		}
+		names[c.Name] = &class{name: c.Name, stride: stride1 / uint64(c.Weight), shed: c.Shed}
+		p.classes = append(p.classes, names[c.Name])
+	}
+
+	p.defaultClass = names[p.conf.DefaultClass]
+	if p.defaultClass == nil {
+		p.defaultClass = &class{name: p.conf.DefaultClass, stride: stride1}
+		p.classes = append(p.classes, p.defaultClass)
+	}
+
+	if p.conf.Shedding != nil {
+		if p.shedder, err = newShedder(p.conf.Shedding); err != nil {
+			return err
+		}
+	}
+
+	p.s = &scheduler{
+		max:           p.conf.MaxConcurrent,
+		starvationAge: starvationAge,
+		classes:       p.classes,
+	}
+
+	return nil
+}
+
+// class returns the class of the request
+func (p *QoSPlugin) class(r *plugins.Request) *class {
+	for i, c := range p.conf.Classes {
+		if c.match(r) {
+			return p.classes[i]
+		}
+	}
+	return p.defaultClass
+}
+
+// Stats returns the scheduler state (for serverStatus)
+func (p *QoSPlugin) Stats() bson.D {
+	stats := p.s.stats()
+	if p.shedder != nil {
+		stats = append(stats, bson.E{"saturated", p.shedder.saturated(p.s.queuedCount())})
+	}
+	return stats
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *QoSPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	if _, ok := exemptCommands[r.CommandName]; ok {
+		return next(ctx, r)
+	}
+
+	c := p.class(r)
+	// Shed before queueing: the request would likely time out in the queue
+	if p.shedder != nil && c.shed > 0 {
+		saturated := p.shedder.saturated(p.s.queuedCount())
+		if saturated {
+			saturatedGauge.Set(1)
+		} else {
+			saturatedGauge.Set(0)
+		}
+		if saturated && c.shedRequest() {
+			shedTotal.WithLabelValues(c.name).Inc()
+			return shedError(c), nil
+		}
+	}
+
+	waitCtx := ctx
+	if p.maxQueueWait > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, p.maxQueueWait)
+		defer cancel()
+	}
+	if err := p.s.acquire(waitCtx, c); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		rejectedTotal.WithLabelValues(c.name).Inc()
+		return append(mongoerror.ExceededTimeLimit.ErrMessage(fmt.Sprintf("request queued for longer than maxQueueWait in class %q", c.name)),
+			bson.E{"errorLabels", bson.A{"RetryableWriteError"}}), nil
+	}
+	defer p.s.release()
+
+	if p.shedder != nil {
+		start := time.Now()
+		defer func() { p.shedder.observe(time.Since(start)) }()
+	}
+	return next(ctx, r)
+}
@@ -0,0 +1,267 @@
+package qos
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func newPlugin(t *testing.T, d bson.D) *QoSPlugin {
+	p := &QoSPlugin{conf: QoSPluginConfig{DefaultClass: "default", StarvationAge: "1s"}}
+	if err := p.Configure(d); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func find(appName, db string) *plugins.Request {
+	cc := plugins.NewClientConnection()
+	cc.AppName = appName
+	return &plugins.Request{
+		CC:          cc,
+		CommandName: "find",
+		Command: &command.Find{
+			Collection: "foo",
+			Common:     command.Common{Database: db},
+		},
+	}
+}
+
+func TestClass(t *testing.T) {
+	p := newPlugin(t, bson.D{
+		{"maxConcurrent", 1},
+		{"classes", bson.A{
+			bson.D{{"name", "interactive"}, {"weight", 10}, {"scope", bson.D{{"databases", bson.A{"orders"}}}}},
+			bson.D{{"name", "batch"}, {"appNames", bson.A{"nightly-export"}}},
+		}},
+	})
+
+	tests := []struct {
+		r     *plugins.Request
+		class string
+	}{
+		{find("", "orders"), "interactive"},
+		{find("nightly-export", "orders"), "interactive"},
+		{find("nightly-export", "users"), "batch"},
+		{find("web", "users"), "default"},
+	}
+	for _, test := range tests {
+		if c := p.class(test.r); c.name != test.class {
+			t.Errorf("expected class %s for %s, got %s", test.class, command.GetCommandDatabase(test.r.Command), c.name)
+		}
+	}
+}
+
+// dispatchOrder queues the given classes (in order) on a saturated scheduler,
+// waits for hold and returns the order they are dispatched in
+func dispatchOrder(t *testing.T, s *scheduler, classes []*class, hold time.Duration) []string {
+	if err := s.acquire(context.TODO(), classes[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		l     sync.Mutex
+		order []string
+		wg    sync.WaitGroup
+	)
+	for i, c := range classes {
+		wg.Add(1)
+		go func(c *class) {
+			defer wg.Done()
+			if err := s.acquire(context.TODO(), c); err != nil {
+				t.Error(err)
+				return
+			}
+			l.Lock()
+			order = append(order, c.name)
+			l.Unlock()
+			s.release()
+		}(c)
+		// Wait for the request to be queued so the queue order is deterministic
+		for {
+			s.l.Lock()
+			queued := s.queued
+			s.l.Unlock()
+			if queued == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	time.Sleep(hold)
+	s.release()
+	wg.Wait()
+	return order
+}
+
+func TestSchedulerWeights(t *testing.T) {
+	high := &class{name: "high", stride: stride1 / 3}
+	low := &class{name: "low", stride: stride1}
+	s := &scheduler{max: 1, classes: []*class{high, low}}
+
+	order := dispatchOrder(t, s, []*class{low, low, low, low, high, high, high, high, high, high}, 0)
+	// high gets 3 dispatches for each of low's until it runs out
+	expected := []string{"high", "low", "high", "high", "high", "low", "high", "high", "low", "low"}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, order)
+		}
+	}
+}
+
+func TestSchedulerStarvation(t *testing.T) {
+	high := &class{name: "high", stride: stride1 / 100}
+	low := &class{name: "low", stride: stride1}
+	s := &scheduler{max: 1, starvationAge: 20 * time.Millisecond, classes: []*class{high, low}}
+
+	// Without starvation protection the high requests would all go first; the
+	// queued requests are all older than starvationAge so they go in FIFO order
+	order := dispatchOrder(t, s, []*class{high, low, high, high}, 30*time.Millisecond)
+	if order[0] != "high" || order[1] != "low" {
+		t.Fatalf("expected the starved low request second, got %v", order)
+	}
+}
+
+func TestMaxQueueWait(t *testing.T) {
+	p := newPlugin(t, bson.D{
+		{"maxConcurrent", 1},
+		{"maxQueueWait", "10ms"},
+	})
+
+	release := make(chan struct{})
+	pipe := plugins.BuildPipeline([]plugins.Plugin{p}, func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+		<-release
+		return bson.D{{"ok", 1}}, nil
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if d, err := pipe(context.TODO(), find("", "db")); err != nil || !bsonutil.Ok(d) {
+			t.Errorf("unexpected response: %v %v", d, err)
+		}
+	}()
+	for {
+		p.s.l.Lock()
+		running := p.s.running
+		p.s.l.Unlock()
+		if running == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	d, err := pipe(context.TODO(), find("", "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := bsonutil.Lookup(d, "codeName"); v != "ExceededTimeLimit" {
+		t.Fatalf("expected ExceededTimeLimit, got %v", d)
+	}
+	if s := p.s.stats(); s[0].Value != 1 {
+		t.Fatalf("unexpected stats: %v", s)
+	}
+
+	// Handshakes are never queued
+	r := find("", "db")
+	r.CommandName = "ping"
+	pipe = plugins.BuildPipeline([]plugins.Plugin{p}, func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+		return bson.D{{"ok", 1}}, nil
+	})
+	if d, err := pipe(context.TODO(), r); err != nil || !bsonutil.Ok(d) {
+		t.Fatalf("unexpected response: %v %v", d, err)
+	}
+
+	close(release)
+	<-done
+}
+
+func TestShedding(t *testing.T) {
+	p := newPlugin(t, bson.D{
+		{"maxConcurrent", 1},
+		{"classes", bson.A{
+			bson.D{{"name", "batch"}, {"appNames", bson.A{"nightly-export"}}, {"shed", 1}},
+		}},
+		{"shedding", bson.D{{"queueThreshold", 1}}},
+	})
+
+	release := make(chan struct{})
+	pipe := plugins.BuildPipeline([]plugins.Plugin{p}, func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+		<-release
+		return bson.D{{"ok", 1}}, nil
+	})
+
+	// Not saturated: batch requests run
+	var wg sync.WaitGroup
+	for _, appName := range []string{"nightly-export", "web"} {
+		wg.Add(1)
+		go func(appName string) {
+			defer wg.Done()
+			if d, err := pipe(context.TODO(), find(appName, "db")); err != nil || !bsonutil.Ok(d) {
+				t.Errorf("unexpected response: %v %v", d, err)
+			}
+		}(appName)
+	}
+	for p.s.queuedCount() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Saturated: batch requests are shed, others are queued
+	d, err := pipe(context.TODO(), find("nightly-export", "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := bsonutil.Lookup(d, "codeName"); v != "ExceededTimeLimit" {
+		t.Fatalf("expected ExceededTimeLimit, got %v", d)
+	}
+	if v, _ := bsonutil.Lookup(d, "errorLabels"); len(v.(bson.A)) != 2 {
+		t.Fatalf("expected retryable error labels, got %v", d)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if d, err := pipe(context.TODO(), find("web", "db")); err != nil || !bsonutil.Ok(d) {
+			t.Errorf("unexpected response: %v %v", d, err)
+		}
+	}()
+	for p.s.queuedCount() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	wg.Wait()
+}
+
+func TestSheddingLatency(t *testing.T) {
+	s, err := newShedder(&SheddingConfig{LatencyThreshold: "10ms", LatencyWindow: "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		s.observe(time.Millisecond)
+	}
+	if s.saturated(0) {
+		t.Fatalf("unexpected saturation with a p99 of %s", s.latencyP99())
+	}
+
+	// The p99 is cached for a tenth of the window
+	s.p99Computed = time.Time{}
+	for i := 0; i < 20; i++ {
+		s.observe(50 * time.Millisecond)
+	}
+	if !s.saturated(0) {
+		t.Fatalf("expected saturation with a p99 of %s", s.latencyP99())
+	}
+
+	if _, err := newShedder(&SheddingConfig{}); err == nil {
+		t.Fatalf("expected an error without thresholds")
+	}
+}
@@ -0,0 +1,162 @@
+package qos
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// stride1 is the stride of a class with weight 1; a class with weight w advances
+// its pass by stride1/w per dispatched request
+const stride1 = 1 << 20
+
+type waiter struct {
+	ready    chan struct{}
+	enqueued time.Time
+}
+
+// class is a priority class; its requests are queued while the scheduler is saturated
+type class struct {
+	name   string
+	stride uint64
+	// shed is the fraction of requests shed while the backend is saturated
+	shed float64
+	// pass is the virtual time of the class's next dispatch (stride scheduling)
+	pass  uint64
+	queue list.List
+}
+
+// scheduler limits the requests running at once and, once saturated, dispatches
+// queued requests to the classes in proportion to their weights (stride
+// scheduling). Requests queued for longer than starvationAge are dispatched
+// first (oldest first) so that low weight classes are never starved.
+type scheduler struct {
+	max           int
+	starvationAge time.Duration
+	classes       []*class
+
+	l       sync.Mutex
+	running int
+	queued  int
+	// pass is the virtual time of the last dispatch; classes which become active
+	// start from it so they can't build up credit while idle
+	pass uint64
+}
+
+// acquire waits until the request can run (or ctx is done); release must be called
+// once a request which acquired finishes
+func (s *scheduler) acquire(ctx context.Context, c *class) error {
+	s.l.Lock()
+	if s.running < s.max && s.queued == 0 {
+		s.running++
+		s.l.Unlock()
+		return nil
+	}
+
+	w := &waiter{ready: make(chan struct{}), enqueued: time.Now()}
+	if c.queue.Len() == 0 && c.pass < s.pass {
+		c.pass = s.pass
+	}
+	e := c.queue.PushBack(w)
+	s.queued++
+	queueDepth.WithLabelValues(c.name).Inc()
+	s.l.Unlock()
+
+	select {
+	case <-w.ready:
+		queueWaitSummary.WithLabelValues(c.name).Observe(time.Since(w.enqueued).Seconds())
+		return nil
+	case <-ctx.Done():
+		s.l.Lock()
+		select {
+		case <-w.ready:
+			// Dispatched concurrently; hand the slot on
+			s.l.Unlock()
+			s.release()
+			return ctx.Err()
+		default:
+		}
+		c.queue.Remove(e)
+		s.queued--
+		queueDepth.WithLabelValues(c.name).Dec()
+		s.l.Unlock()
+		return ctx.Err()
+	}
+}
+
+// release frees the slot of a finished request and dispatches queued requests
+func (s *scheduler) release() {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.running--
+	s.dispatch(time.Now())
+}
+
+// dispatch runs queued requests while there are free slots; must be called with
+// the lock held
+func (s *scheduler) dispatch(now time.Time) {
+	for s.running < s.max && s.queued > 0 {
+		c, starved := s.next(now)
+		w := c.queue.Remove(c.queue.Front()).(*waiter)
+		s.queued--
+		queueDepth.WithLabelValues(c.name).Dec()
+		if starved {
+			starvedTotal.WithLabelValues(c.name).Inc()
+		}
+		if c.pass > s.pass {
+			s.pass = c.pass
+		}
+		c.pass += c.stride
+		s.running++
+		close(w.ready)
+	}
+}
+
+// next returns the class to dispatch from: the class with the oldest request
+// queued for longer than starvationAge if any, otherwise the class with the
+// lowest pass
+func (s *scheduler) next(now time.Time) (*class, bool) {
+	var oldest, lowest *class
+	var oldestEnqueued time.Time
+	for _, c := range s.classes {
+		if c.queue.Len() == 0 {
+			continue
+		}
+		enqueued := c.queue.Front().Value.(*waiter).enqueued
+		if s.starvationAge > 0 && now.Sub(enqueued) >= s.starvationAge && (oldest == nil || enqueued.Before(oldestEnqueued)) {
+			oldest, oldestEnqueued = c, enqueued
+		}
+		if lowest == nil || c.pass < lowest.pass {
+			lowest = c
+		}
+	}
+	if oldest != nil {
+		return oldest, oldest != lowest
+	}
+	return lowest, false
+}
+
+// queuedCount returns the number of queued requests
+func (s *scheduler) queuedCount() int {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.queued
+}
+
+// stats returns the running and queued requests (for serverStatus)
+func (s *scheduler) stats() bson.D {
+	s.l.Lock()
+	defer s.l.Unlock()
+	queued := make(bson.D, len(s.classes))
+	for i, c := range s.classes {
+		queued[i] = bson.E{c.name, c.queue.Len()}
+	}
+	return bson.D{
+		{"running", s.running},
+		{"maxConcurrent", s.max},
+		{"queued", queued},
+	}
+}
@@ -0,0 +1,146 @@
+package qos
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+)
+
+// SheddingConfig configures when the backend is considered saturated; while it is,
+// each class's Shed fraction of requests is rejected instead of being queued
+type SheddingConfig struct {
+	// LatencyThreshold: the backend is saturated while the p99 latency of the
+	// requests over LatencyWindow exceeds it (default "0s"; disabled)
+	LatencyThreshold string `bson:"latencyThreshold"`
+	// LatencyWindow is the window of the p99 latency (default "10s")
+	LatencyWindow string `bson:"latencyWindow"`
+	// QueueThreshold: the backend is saturated while at least this many requests
+	// are queued, i.e. all maxConcurrent slots are in use (default 0; disabled).
+	// With maxConcurrent set to the backend's pool size this sheds on pool
+	// exhaustion.
+	QueueThreshold int `bson:"queueThreshold"`
+}
+
+// maxLatencySamples is the max number of latencies kept per window half
+const maxLatencySamples = 1024
+
+// shedder tracks the saturation of the backend
+type shedder struct {
+	latencyThreshold time.Duration
+	window           time.Duration
+	queueThreshold   int
+
+	l sync.Mutex
+	// samples are the latencies of the current half window, previous those of
+	// the one before (sampled once more than maxLatencySamples were observed)
+	samples, previous []time.Duration
+	observed          int
+	halfStart         time.Time
+	// p99 is recomputed at most every tenth of the window
+	p99         time.Duration
+	p99Computed time.Time
+}
+
+func newShedder(conf *SheddingConfig) (*shedder, error) {
+	s := &shedder{window: 10 * time.Second, queueThreshold: conf.QueueThreshold}
+	var err error
+	if conf.LatencyThreshold != "" {
+		if s.latencyThreshold, err = time.ParseDuration(conf.LatencyThreshold); err != nil {
+			return nil, fmt.Errorf("invalid shedding.latencyThreshold: %w", err)
+		}
+	}
+	if conf.LatencyWindow != "" {
+		if s.window, err = time.ParseDuration(conf.LatencyWindow); err != nil {
+			return nil, fmt.Errorf("invalid shedding.latencyWindow: %w", err)
+		}
+		if s.window <= 0 {
+			return nil, fmt.Errorf("shedding.latencyWindow must be positive")
+		}
+	}
+	if s.queueThreshold < 0 {
+		return nil, fmt.Errorf("shedding.queueThreshold must not be negative: %d", s.queueThreshold)
+	}
+	if s.latencyThreshold <= 0 && s.queueThreshold == 0 {
+		return nil, fmt.Errorf("shedding needs a latencyThreshold or a queueThreshold")
+	}
+	return s, nil
+}
+
+// rotate starts a new half window if the current one is over; must be called
+// with the lock held
+func (s *shedder) rotate(now time.Time) {
+	if now.Sub(s.halfStart) < s.window/2 {
+		return
+	}
+	if now.Sub(s.halfStart) < s.window {
+		s.previous = s.samples
+	} else {
+		s.previous = nil
+	}
+	s.samples = nil
+	s.observed = 0
+	s.halfStart = now
+}
+
+// observe records the latency of a request
+func (s *shedder) observe(d time.Duration) {
+	if s.latencyThreshold <= 0 {
+		return
+	}
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.rotate(time.Now())
+	s.observed++
+	if len(s.samples) < maxLatencySamples {
+		s.samples = append(s.samples, d)
+	} else if i := rand.Intn(s.observed); i < maxLatencySamples {
+		// Reservoir sampling
+		s.samples[i] = d
+	}
+}
+
+// latencyP99 returns the p99 latency over the window
+func (s *shedder) latencyP99() time.Duration {
+	s.l.Lock()
+	defer s.l.Unlock()
+	now := time.Now()
+	if now.Sub(s.p99Computed) < s.window/10 {
+		return s.p99
+	}
+	s.rotate(now)
+	all := make([]time.Duration, 0, len(s.samples)+len(s.previous))
+	all = append(append(all, s.samples...), s.previous...)
+	s.p99 = 0
+	if len(all) > 0 {
+		sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+		s.p99 = all[len(all)*99/100]
+	}
+	s.p99Computed = now
+	return s.p99
+}
+
+// saturated returns whether the backend is saturated given the queued requests
+func (s *shedder) saturated(queued int) bool {
+	if s.queueThreshold > 0 && queued >= s.queueThreshold {
+		return true
+	}
+	return s.latencyThreshold > 0 && s.latencyP99() > s.latencyThreshold
+}
+
+// shedRequest returns whether to shed a request of the class while saturated
+func (c *class) shedRequest() bool {
+	return c.shed >= 1 || rand.Float64() < c.shed
+}
+
+// shedError is the response to shed requests: drivers retry ExceededTimeLimit (and
+// writes with the RetryableWriteError label) and back off on SystemOverloadedError
+func shedError(c *class) bson.D {
+	return append(mongoerror.ExceededTimeLimit.ErrMessage(fmt.Sprintf("backend overloaded; request in class %q shed, retry later", c.name)),
+		bson.E{"errorLabels", bson.A{"RetryableWriteError", "SystemOverloadedError"}})
+}
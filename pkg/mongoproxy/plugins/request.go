@@ -0,0 +1,353 @@
+package plugins
+
+import (
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+)
+
+// errNoCommand is returned when encoding a request without a command
+var errNoCommand = errors.New("request has no command")
+
+// The accessors below are shared by all plugins so the command is parsed once
+// (by the proxy, into Command) rather than each plugin re-parsing the document.
+// Plugins changing the command must do so through the Set* helpers, or call
+// Modified after changing the Command's fields, so Document and Raw re-encode it.
+
+// SetCommand sets the command of the request; d is the document it was parsed
+// from (nil if the command was built rather than parsed)
+func (r *Request) SetCommand(name string, cmd command.Command, d bson.D) {
+	r.CommandName = name
+	r.Command = cmd
+	r.doc, r.raw = d, nil
+}
+
+// Modified marks the command as changed by the plugin, so the document and
+// encoding of the request are re-encoded from the Command on next use
+func (r *Request) Modified() {
+	r.doc, r.raw = nil, nil
+}
+
+// Database returns the database the command runs on
+func (r *Request) Database() string {
+	return command.GetCommandDatabase(r.Command)
+}
+
+// Collection returns the collection the command runs on ("" if none)
+func (r *Request) Collection() string {
+	return command.GetCommandCollection(r.Command)
+}
+
+// Filters returns the query filters of the command: one for finds, counts,
+// distincts and findAndModifies, one per statement for updates and deletes (and
+// those of the explained command for explains)
+func (r *Request) Filters() []bson.D {
+	return commandFilters(r.Command)
+}
+
+func commandFilters(c command.Command) []bson.D {
+	switch cmd := c.(type) {
+	case *command.Find:
+		return []bson.D{cmd.Filter}
+	case *command.Count:
+		return []bson.D{cmd.Query}
+	case *command.Distinct:
+		return []bson.D{cmd.Query}
+	case *command.FindAndModify:
+		return []bson.D{cmd.Query}
+	case *command.FindAndModifyLegacy:
+		return []bson.D{cmd.Query}
+	case *command.Update:
+		filters := make([]bson.D, len(cmd.Updates))
+		for i, u := range cmd.Updates {
+			filters[i] = u.Query
+		}
+		return filters
+	case *command.Delete:
+		filters := make([]bson.D, len(cmd.Deletes))
+		for i, d := range cmd.Deletes {
+			filters[i], _ = lookupDoc(d, "q")
+		}
+		return filters
+	case *command.Explain:
+		return commandFilters(cmd.Cmd)
+	}
+	return nil
+}
+
+// Updates returns the update documents of the command: one per statement for
+// updates, and the update of findAndModifies (replacements included)
+func (r *Request) Updates() []bson.D {
+	switch cmd := r.Command.(type) {
+	case *command.Update:
+		updates := make([]bson.D, len(cmd.Updates))
+		for i, u := range cmd.Updates {
+			updates[i] = u.U
+		}
+		return updates
+	case *command.FindAndModify:
+		if len(cmd.Update) > 0 {
+			return []bson.D{cmd.Update}
+		}
+	case *command.FindAndModifyLegacy:
+		if update, ok := cmd.Update.(bson.D); ok {
+			return []bson.D{update}
+		}
+	}
+	return nil
+}
+
+// Documents returns the documents inserted by the command, decoding them if
+// they were kept raw (nil if they can't be)
+func (r *Request) Documents() []bson.D {
+	if cmd, ok := r.Command.(*command.Insert); ok {
+		if err := cmd.DecodeDocuments(); err != nil {
+			return nil
+		}
+		return cmd.Documents
+	}
+	return nil
+}
+
+// statementKeys are the keys of the statements (rather than the options) of commands
+var statementKeys = map[string]struct{}{
+	"filter":    {},
+	"query":     {},
+	"update":    {},
+	"documents": {},
+	"updates":   {},
+	"deletes":   {},
+	"pipeline":  {},
+}
+
+// genericKeys are the keys of the fields common to all commands
+var genericKeys = map[string]struct{}{
+	"$readPreference": {},
+	"$db":             {},
+	"lsid":            {},
+	"txnNumber":       {},
+	"stmtIds":         {},
+	"$clusterTime":    {},
+}
+
+// Options returns the options of the command: the fields of its document other
+// than the command name, its statements and the generic fields (such as $db and
+// the session)
+func (r *Request) Options() (bson.D, error) {
+	d, err := r.Document()
+	if err != nil {
+		return nil, err
+	}
+	var options bson.D
+	for i, e := range d {
+		if i == 0 {
+			continue
+		}
+		if _, ok := statementKeys[e.Key]; ok {
+			continue
+		}
+		if _, ok := genericKeys[e.Key]; ok {
+			continue
+		}
+		options = append(options, e)
+	}
+	return options, nil
+}
+
+// Document returns the command's document: the one it was parsed from, or (once
+// modified) the Command re-encoded. The document must not be modified.
+func (r *Request) Document() (bson.D, error) {
+	if r.doc != nil {
+		return r.doc, nil
+	}
+	raw, err := r.Raw()
+	if err != nil {
+		return nil, err
+	}
+	var d bson.D
+	if err := bson.Unmarshal(raw, &d); err != nil {
+		return nil, err
+	}
+	r.doc = d
+	return d, nil
+}
+
+// Raw returns the encoding of the command's document, encoded once until the
+// command is modified. The bytes must not be modified.
+func (r *Request) Raw() (bson.Raw, error) {
+	if r.raw != nil {
+		return r.raw, nil
+	}
+	var v interface{} = r.Command
+	if r.doc != nil {
+		v = r.doc
+	} else if r.Command == nil {
+		return nil, errNoCommand
+	}
+	b, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	r.raw = b
+	return r.raw, nil
+}
+
+// clone returns a copy of the request which can be modified without changing r:
+// the command is decoded again from r's encoding (the client connection and
+// cursor cache are shared)
+func (r *Request) clone() (*Request, error) {
+	c := *r
+	if r.Map != nil {
+		c.Map = make(map[string]interface{}, len(r.Map))
+		for k, v := range r.Map {
+			c.Map[k] = v
+		}
+	}
+	if r.Command == nil {
+		return &c, nil
+	}
+	raw, err := r.Raw()
+	if err != nil {
+		return nil, err
+	}
+	var d bson.D
+	if err := bson.Unmarshal(raw, &d); err != nil {
+		return nil, err
+	}
+	cmd, ok := command.GetCommand(r.CommandName)
+	if !ok {
+		return nil, fmt.Errorf("unknown command %s", r.CommandName)
+	}
+	if err := cmd.FromBSOND(d); err != nil {
+		return nil, err
+	}
+	c.Command, c.doc, c.raw = cmd, d, raw
+	return &c, nil
+}
+
+// SetNamespace changes the database and collection the command runs on (see
+// command.SetCommandNamespace), returning false if it can't be
+func (r *Request) SetNamespace(db, collection string) bool {
+	if !command.SetCommandNamespace(r.Command, db, collection) {
+		return false
+	}
+	r.Modified()
+	return true
+}
+
+// SetFilter replaces the i-th filter (see Filters), returning false if the
+// command has none
+func (r *Request) SetFilter(i int, filter bson.D) bool {
+	if !setFilter(r.Command, i, filter) {
+		return false
+	}
+	r.Modified()
+	return true
+}
+
+func setFilter(c command.Command, i int, filter bson.D) bool {
+	switch cmd := c.(type) {
+	case *command.Find:
+		if i == 0 {
+			cmd.Filter = filter
+			return true
+		}
+	case *command.Count:
+		if i == 0 {
+			cmd.Query = filter
+			return true
+		}
+	case *command.Distinct:
+		if i == 0 {
+			cmd.Query = filter
+			return true
+		}
+	case *command.FindAndModify:
+		if i == 0 {
+			cmd.Query = filter
+			return true
+		}
+	case *command.FindAndModifyLegacy:
+		if i == 0 {
+			cmd.Query = filter
+			return true
+		}
+	case *command.Update:
+		if i >= 0 && i < len(cmd.Updates) {
+			cmd.Updates[i].Query = filter
+			return true
+		}
+	case *command.Delete:
+		if i >= 0 && i < len(cmd.Deletes) {
+			cmd.Deletes[i] = replaceKey(cmd.Deletes[i], "q", filter)
+			return true
+		}
+	case *command.Explain:
+		return setFilter(cmd.Cmd, i, filter)
+	}
+	return false
+}
+
+// SetUpdate replaces the i-th update document (see Updates), returning false if
+// the command has none
+func (r *Request) SetUpdate(i int, update bson.D) bool {
+	switch cmd := r.Command.(type) {
+	case *command.Update:
+		if i < 0 || i >= len(cmd.Updates) {
+			return false
+		}
+		cmd.Updates[i].U = update
+	case *command.FindAndModify:
+		if i != 0 {
+			return false
+		}
+		cmd.Update = update
+	case *command.FindAndModifyLegacy:
+		if i != 0 {
+			return false
+		}
+		cmd.Update = update
+	default:
+		return false
+	}
+	r.Modified()
+	return true
+}
+
+// SetDocument replaces the i-th inserted document, returning false if there is none
+func (r *Request) SetDocument(i int, doc bson.D) bool {
+	cmd, ok := r.Command.(*command.Insert)
+	if !ok || cmd.DecodeDocuments() != nil || i < 0 || i >= len(cmd.Documents) {
+		return false
+	}
+	cmd.Documents[i] = doc
+	r.Modified()
+	return true
+}
+
+// lookupDoc returns the document value of the key
+func lookupDoc(d bson.D, key string) (bson.D, bool) {
+	v, ok := bsonutil.Lookup(d, key)
+	if !ok {
+		return nil, false
+	}
+	doc, ok := v.(bson.D)
+	return doc, ok
+}
+
+// replaceKey returns a copy of d with the key's value replaced (appended if unset)
+func replaceKey(d bson.D, key string, v interface{}) bson.D {
+	out := make(bson.D, len(d), len(d)+1)
+	copy(out, d)
+	for i, e := range out {
+		if e.Key == key {
+			out[i].Value = v
+			return out
+		}
+	}
+	return append(out, bson.E{key, v})
+}
@@ -0,0 +1,150 @@
+package plugins
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/command"
+)
+
+func parseRequest(t *testing.T, d bson.D) *Request {
+	cmd, ok := command.GetCommand(d[0].Key)
+	if !ok {
+		t.Fatalf("unknown command %s", d[0].Key)
+	}
+	if err := cmd.FromBSOND(d); err != nil {
+		t.Fatal(err)
+	}
+	r := &Request{}
+	r.SetCommand(d[0].Key, cmd, d)
+	return r
+}
+
+func TestRequestAccessors(t *testing.T) {
+	tests := []struct {
+		cmd         bson.D
+		collection  string
+		filters     []bson.D
+		updates     []bson.D
+		documents   []bson.D
+		options     bson.D
+		filterIndex int
+	}{
+		{
+			cmd:        bson.D{{"find", "a"}, {"filter", bson.D{{"x", 1}}}, {"limit", int64(2)}, {"$db", "db"}},
+			collection: "a",
+			filters:    []bson.D{{{"x", int64(1)}}},
+			options:    bson.D{{"limit", int64(2)}},
+		},
+		{
+			cmd: bson.D{{"update", "a"}, {"updates", bson.A{
+				bson.D{{"q", bson.D{{"x", 1}}}, {"u", bson.D{{"$set", bson.D{{"y", 1}}}}}},
+				bson.D{{"q", bson.D{{"x", 2}}}, {"u", bson.D{{"$set", bson.D{{"y", 2}}}}}},
+			}}, {"ordered", false}, {"$db", "db"}},
+			collection:  "a",
+			filters:     []bson.D{{{"x", int64(1)}}, {{"x", int64(2)}}},
+			updates:     []bson.D{{{"$set", bson.D{{"y", int64(1)}}}}, {{"$set", bson.D{{"y", int64(2)}}}}},
+			options:     bson.D{{"ordered", false}},
+			filterIndex: 1,
+		},
+		{
+			cmd:        bson.D{{"delete", "a"}, {"deletes", bson.A{bson.D{{"q", bson.D{{"x", 1}}}, {"limit", 1}}}}, {"$db", "db"}},
+			collection: "a",
+			filters:    []bson.D{{{"x", int64(1)}}},
+		},
+		{
+			cmd:         bson.D{{"insert", "a"}, {"documents", bson.A{bson.D{{"_id", 1}}}}, {"$db", "db"}},
+			collection:  "a",
+			documents:   []bson.D{{{"_id", int64(1)}}},
+			filterIndex: -1,
+		},
+	}
+
+	for i, test := range tests {
+		r := parseRequest(t, test.cmd)
+		if r.Database() != "db" || r.Collection() != test.collection {
+			t.Fatalf("%d: unexpected namespace %s.%s", i, r.Database(), r.Collection())
+		}
+		if filters := r.Filters(); !reflect.DeepEqual(filters, test.filters) {
+			t.Fatalf("%d: unexpected filters %v", i, filters)
+		}
+		if updates := r.Updates(); !reflect.DeepEqual(updates, test.updates) {
+			t.Fatalf("%d: unexpected updates %v", i, updates)
+		}
+		if documents := r.Documents(); !reflect.DeepEqual(documents, test.documents) {
+			t.Fatalf("%d: unexpected documents %v", i, documents)
+		}
+		if options, err := r.Options(); err != nil || !reflect.DeepEqual(options, test.options) {
+			t.Fatalf("%d: unexpected options %v: %v", i, options, err)
+		}
+
+		// Until modified the document is the one parsed
+		if d, err := r.Document(); err != nil || !reflect.DeepEqual(d, test.cmd) {
+			t.Fatalf("%d: unexpected document %v: %v", i, d, err)
+		}
+
+		filter := bson.D{{"z", 3}}
+		if ok := r.SetFilter(test.filterIndex, filter); ok != (test.filterIndex >= 0) {
+			t.Fatalf("%d: unexpected SetFilter %v", i, ok)
+		}
+		if test.filterIndex < 0 {
+			continue
+		}
+		// The filter is set on the command, and the document re-encoded from it
+		if got := r.Filters()[test.filterIndex]; !reflect.DeepEqual(got, filter) {
+			t.Fatalf("%d: unexpected filter %v", i, got)
+		}
+		raw, err := r.Raw()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reparsed := parseRequest(t, mustDocument(t, raw))
+		if got := reparsed.Filters()[test.filterIndex]; !reflect.DeepEqual(got, bson.D{{"z", int32(3)}}) {
+			t.Fatalf("%d: unexpected re-encoded filter %v", i, got)
+		}
+	}
+}
+
+func TestRequestModified(t *testing.T) {
+	r := parseRequest(t, bson.D{{"insert", "a"}, {"documents", bson.A{bson.D{{"_id", 1}}}}, {"$db", "db"}})
+	raw, err := r.Raw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := r.Raw(); &again[0] != &raw[0] {
+		t.Fatalf("expected the encoding to be cached")
+	}
+
+	if r.SetDocument(1, bson.D{}) {
+		t.Fatalf("expected no second document")
+	}
+	if !r.SetDocument(0, bson.D{{"_id", 2}}) || !r.SetNamespace("db2", "b") {
+		t.Fatalf("expected the command to be modified")
+	}
+	d, err := r.Document()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reparsed := parseRequest(t, d)
+	if reparsed.Database() != "db2" || reparsed.Collection() != "b" {
+		t.Fatalf("unexpected namespace %s.%s", reparsed.Database(), reparsed.Collection())
+	}
+	if docs := reparsed.Documents(); len(docs) != 1 || !reflect.DeepEqual(docs[0], bson.D{{"_id", int32(2)}}) {
+		t.Fatalf("unexpected documents %v", docs)
+	}
+
+	// Requests without a command have no encoding
+	if _, err := (&Request{}).Raw(); err != errNoCommand {
+		t.Fatalf("expected %v, got %v", errNoCommand, err)
+	}
+}
+
+func mustDocument(t *testing.T, raw bson.Raw) bson.D {
+	var d bson.D
+	if err := bson.Unmarshal(raw, &d); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
@@ -0,0 +1,736 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "router"
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_router_requests_total",
+		Help: "The total requests routed to each cluster by kind (read, write, cursor)",
+	}, []string{"cluster", "kind"})
+	clusterLatency = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mongoproxy_plugins_router_cluster_latency_seconds",
+		Help: "The (smoothed) probe latency of each cluster",
+	}, []string{"cluster"})
+	clusterHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mongoproxy_plugins_router_cluster_healthy",
+		Help: "Whether the last probe of each cluster succeeded",
+	}, []string{"cluster"})
+	splitRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_router_split_requests_total",
+		Help: "The total requests sent to the cluster of each split",
+	}, []string{"split", "cluster", "kind"})
+)
+
+// Kinds of routed requests
+const (
+	KindRead   = "read"
+	KindWrite  = "write"
+	KindCursor = "cursor"
+)
+
+// cursorKey is the CursorCacheEntry.Map key of the cluster a cursor is on
+type cursorKey struct{}
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &RouterPlugin{
+			conf: RouterPluginConfig{
+				ProbeInterval: "5s",
+				ProbeTimeout:  "2s",
+			},
+		}
+	})
+}
+
+type RouterPluginConfig struct {
+	// Clusters are the backend clusters (required)
+	Clusters []*ClusterConfig `bson:"clusters"`
+	// Primary is the name of the cluster writes are sent to (required)
+	Primary string `bson:"primary"`
+	// Splits send a percentage of the requests of some namespaces to another cluster
+	Splits []*Split `bson:"splits"`
+	// ProbeInterval is how often the clusters are probed (default 5s)
+	ProbeInterval string `bson:"probeInterval"`
+	// ProbeTimeout is how long a probe may take before the cluster is considered
+	// unhealthy (default 2s)
+	ProbeTimeout string `bson:"probeTimeout"`
+
+	probeInterval time.Duration
+	probeTimeout  time.Duration
+}
+
+// ClusterConfig is the config of a backend cluster
+type ClusterConfig struct {
+	// Name is the name of the cluster (required)
+	Name string `bson:"name"`
+	// Region is the region the cluster is in (informational)
+	Region string `bson:"region"`
+	// Plugin is the backend plugin sending the requests to the cluster (default "mongo")
+	Plugin string `bson:"plugin"`
+	// Config is the config of the backend plugin
+	Config bson.D `bson:"config"`
+}
+
+// Split sends a percentage of the requests in its scope to its cluster (e.g. to
+// gradually migrate namespaces to a new cluster)
+type Split struct {
+	// Name is the name of the split (required)
+	Name string `bson:"name"`
+	// Scope is the namespaces (and commands) the split applies to (required)
+	Scope *plugins.Scope `bson:"scope"`
+	// Cluster is the cluster the split requests are sent to (required)
+	Cluster string `bson:"cluster"`
+	// Reads and Writes are the percentages of the reads and writes sent to the
+	// cluster (0-100; default 0)
+	Reads  float64 `bson:"reads"`
+	Writes float64 `bson:"writes"`
+}
+
+// SplitStatus is the status of a split
+type SplitStatus struct {
+	Name    string  `json:"name"`
+	Scope   string  `json:"scope"`
+	Cluster string  `json:"cluster"`
+	Reads   float64 `json:"reads"`
+	Writes  float64 `json:"writes"`
+}
+
+// SplitPercents are the percentages of a split
+type SplitPercents struct {
+	Reads  float64 `json:"reads"`
+	Writes float64 `json:"writes"`
+}
+
+func validPercent(percent float64) bool {
+	return percent >= 0 && percent <= 100
+}
+
+// cluster is a configured backend cluster and its probe state
+type cluster struct {
+	conf    *ClusterConfig
+	backend plugins.Plugin
+
+	lock      sync.RWMutex
+	probed    bool
+	healthy   bool
+	latency   time.Duration
+	lastErr   error
+	lastProbe time.Time
+}
+
+// ClusterStatus is the status of a cluster
+type ClusterStatus struct {
+	Name      string    `json:"name"`
+	Region    string    `json:"region"`
+	Primary   bool      `json:"primary"`
+	Probed    bool      `json:"probed"`
+	Healthy   bool      `json:"healthy"`
+	Degraded  bool      `json:"degraded"`
+	Latency   string    `json:"latency"`
+	Error     string    `json:"error,omitempty"`
+	LastProbe time.Time `json:"lastProbe,omitempty"`
+}
+
+// Override overrides the clusters requests are routed to
+type Override struct {
+	// Reads is the cluster all reads are sent to (instead of the nearest)
+	Reads string `json:"reads,omitempty"`
+	// Writes is the cluster writes are sent to (instead of the primary)
+	Writes string `json:"writes,omitempty"`
+}
+
+// This is a plugin that sends requests to one of multiple backend clusters: reads
+// to the nearest healthy cluster (by probe latency) and writes to the primary,
+// except for the percentage of requests picked by a split
+type RouterPlugin struct {
+	conf     RouterPluginConfig
+	clusters []*cluster
+	byName   map[string]*cluster
+
+	lock     sync.RWMutex
+	override Override
+	// percents are the current percentages of the splits (by name)
+	percents map[string]SplitPercents
+	// states reports the clusters degraded by their hosting service (e.g. in
+	// maintenance), if the chain has a provider
+	states plugins.ClusterStateProvider
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (p *RouterPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *RouterPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	if p.conf.probeInterval, err = time.ParseDuration(p.conf.ProbeInterval); err != nil {
+		return fmt.Errorf("invalid probeInterval: %w", err)
+	}
+	if p.conf.probeTimeout, err = time.ParseDuration(p.conf.ProbeTimeout); err != nil {
+		return fmt.Errorf("invalid probeTimeout: %w", err)
+	}
+	if p.conf.probeInterval <= 0 || p.conf.probeTimeout <= 0 {
+		return fmt.Errorf("probeInterval and probeTimeout must be positive")
+	}
+
+	if len(p.conf.Clusters) == 0 {
+		return fmt.Errorf("clusters are required")
+	}
+	p.clusters = make([]*cluster, 0, len(p.conf.Clusters))
+	p.byName = make(map[string]*cluster, len(p.conf.Clusters))
+	for _, cc := range p.conf.Clusters {
+		if cc.Name == "" {
+			return fmt.Errorf("cluster name is required")
+		}
+		if _, ok := p.byName[cc.Name]; ok {
+			return fmt.Errorf("duplicate cluster %s", cc.Name)
+		}
+		if cc.Plugin == "" {
+			cc.Plugin = "mongo"
+		}
+		if cc.Plugin == Name {
+			return fmt.Errorf("cluster %s: the backend can't be a %s", cc.Name, Name)
+		}
+		backend, ok := plugins.GetPlugin(cc.Plugin)
+		if !ok {
+			return fmt.Errorf("cluster %s: unknown plugin %s", cc.Name, cc.Plugin)
+		}
+		if err := backend.Configure(cc.Config); err != nil {
+			return fmt.Errorf("cluster %s: %w", cc.Name, err)
+		}
+		c := &cluster{conf: cc, backend: backend}
+		p.clusters = append(p.clusters, c)
+		p.byName[cc.Name] = c
+	}
+	if _, ok := p.byName[p.conf.Primary]; !ok {
+		return fmt.Errorf("primary must be one of the clusters: %q", p.conf.Primary)
+	}
+
+	p.percents = make(map[string]SplitPercents, len(p.conf.Splits))
+	for _, split := range p.conf.Splits {
+		if split.Name == "" {
+			return fmt.Errorf("split name is required")
+		}
+		if _, ok := p.percents[split.Name]; ok {
+			return fmt.Errorf("duplicate split %s", split.Name)
+		}
+		if split.Scope.IsZero() {
+			return fmt.Errorf("split %s: scope is required", split.Name)
+		}
+		split.Scope.Compile()
+		if _, ok := p.byName[split.Cluster]; !ok {
+			return fmt.Errorf("split %s: cluster must be one of the clusters: %q", split.Name, split.Cluster)
+		}
+		if !validPercent(split.Reads) || !validPercent(split.Writes) {
+			return fmt.Errorf("split %s: reads and writes must be percentages (0-100)", split.Name)
+		}
+		p.percents[split.Name] = SplitPercents{Reads: split.Reads, Writes: split.Writes}
+	}
+
+	return nil
+}
+
+// Start starts the backends and probing the clusters
+func (p *RouterPlugin) Start(ctx context.Context) error {
+	backends := make([]plugins.Plugin, len(p.clusters))
+	for i, c := range p.clusters {
+		backends[i] = c.backend
+	}
+	if err := plugins.StartPlugins(ctx, backends); err != nil {
+		return err
+	}
+
+	p.stop = make(chan struct{})
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(p.conf.probeInterval)
+		defer ticker.Stop()
+		for {
+			p.probeAll()
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops probing and stops the backends
+func (p *RouterPlugin) Stop(ctx context.Context) error {
+	if p.stop != nil {
+		close(p.stop)
+		p.wg.Wait()
+		p.stop = nil
+	}
+	backends := make([]plugins.Plugin, len(p.clusters))
+	for i, c := range p.clusters {
+		backends[i] = c.backend
+	}
+	return plugins.StopPlugins(ctx, backends)
+}
+
+// probeAll probes all the clusters concurrently
+func (p *RouterPlugin) probeAll() {
+	var wg sync.WaitGroup
+	for _, c := range p.clusters {
+		wg.Add(1)
+		go func(c *cluster) {
+			defer wg.Done()
+			p.probe(c)
+		}(c)
+	}
+	wg.Wait()
+}
+
+// probe measures the latency of a ping to the cluster
+func (p *RouterPlugin) probe(c *cluster) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.conf.probeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	var err error
+	switch b := plugins.Unwrap(c.backend).(type) {
+	case plugins.CommandRunner:
+		var result bson.D
+		if result, err = b.RunCommand(ctx, "admin", bson.D{{"ping", 1}}); err == nil && !bsonutil.Ok(result) {
+			err = fmt.Errorf("ping failed: %v", result)
+		}
+	case plugins.HealthChecker:
+		err = b.Health(ctx)
+	}
+	took := time.Since(start)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lastProbe = start
+	c.lastErr = err
+	if err != nil {
+		if c.healthy || !c.probed {
+			logrus.Warningf("Router: cluster %s unhealthy: %v", c.conf.Name, err)
+		}
+		c.probed, c.healthy = true, false
+		clusterHealthy.WithLabelValues(c.conf.Name).Set(0)
+		return
+	}
+	if !c.healthy && c.probed {
+		logrus.Infof("Router: cluster %s healthy", c.conf.Name)
+	}
+	// The latency is smoothed so a single slow probe doesn't move the reads
+	if !c.probed || c.latency == 0 {
+		c.latency = took
+	} else {
+		c.latency = (c.latency*7 + took*3) / 10
+	}
+	c.probed, c.healthy = true, true
+	clusterHealthy.WithLabelValues(c.conf.Name).Set(1)
+	clusterLatency.WithLabelValues(c.conf.Name).Set(c.latency.Seconds())
+}
+
+// SetOverride sets (or with an empty Override clears) the manual override of the
+// clusters requests are routed to
+func (p *RouterPlugin) SetOverride(o Override) error {
+	for _, name := range []string{o.Reads, o.Writes} {
+		if _, ok := p.byName[name]; name != "" && !ok {
+			return fmt.Errorf("unknown cluster %q", name)
+		}
+	}
+	p.lock.Lock()
+	p.override = o
+	p.lock.Unlock()
+	logrus.Infof("Router: override set to %+v", o)
+	return nil
+}
+
+// Override returns the manual override
+func (p *RouterPlugin) Override() Override {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.override
+}
+
+// SetSplit sets the percentages of the split
+func (p *RouterPlugin) SetSplit(name string, percents SplitPercents) error {
+	if !validPercent(percents.Reads) || !validPercent(percents.Writes) {
+		return fmt.Errorf("reads and writes must be percentages (0-100)")
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.percents[name]; !ok {
+		return fmt.Errorf("unknown split %q", name)
+	}
+	p.percents[name] = percents
+	logrus.Infof("Router: split %s set to %+v", name, percents)
+	return nil
+}
+
+// Splits returns the status of the splits
+func (p *RouterPlugin) Splits() []SplitStatus {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	statuses := make([]SplitStatus, len(p.conf.Splits))
+	for i, split := range p.conf.Splits {
+		percents := p.percents[split.Name]
+		statuses[i] = SplitStatus{
+			Name:    split.Name,
+			Scope:   split.Scope.String(),
+			Cluster: split.Cluster,
+			Reads:   percents.Reads,
+			Writes:  percents.Writes,
+		}
+	}
+	return statuses
+}
+
+// split returns the cluster of the first split matching the request if the
+// request is picked for it (nil otherwise)
+func (p *RouterPlugin) split(r *plugins.Request, kind string) *cluster {
+	for _, split := range p.conf.Splits {
+		if !split.Scope.Match(r) {
+			continue
+		}
+		p.lock.RLock()
+		percents := p.percents[split.Name]
+		p.lock.RUnlock()
+		percent := percents.Writes
+		if kind == KindRead {
+			percent = percents.Reads
+		}
+		if percent <= 0 || rand.Float64()*100 >= percent {
+			return nil
+		}
+		c := p.byName[split.Cluster]
+		c.lock.RLock()
+		unhealthy := c.probed && !c.healthy
+		c.lock.RUnlock()
+		// Reads aren't sent to an unhealthy cluster (writes fail rather than
+		// going to another cluster than configured)
+		if unhealthy && kind == KindRead {
+			return nil
+		}
+		splitRequestsTotal.WithLabelValues(split.Name, c.conf.Name, kind).Inc()
+		return c
+	}
+	return nil
+}
+
+// primary returns the cluster writes are sent to
+func (p *RouterPlugin) primary() *cluster {
+	if o := p.Override(); o.Writes != "" {
+		return p.byName[o.Writes]
+	}
+	return p.byName[p.conf.Primary]
+}
+
+// SetClusterStateProvider sets the provider of the clusters' states
+func (p *RouterPlugin) SetClusterStateProvider(c plugins.ClusterStateProvider) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.states = c
+}
+
+// degraded returns whether the cluster is degraded according to the chain's
+// cluster state provider
+func (p *RouterPlugin) degraded(c *cluster) bool {
+	p.lock.RLock()
+	states := p.states
+	p.lock.RUnlock()
+	if states == nil {
+		return false
+	}
+	state, ok := states.ClusterState(c.conf.Name)
+	return ok && state.Degraded()
+}
+
+// nearest returns the healthy cluster with the lowest latency, preferring the
+// clusters which aren't degraded (the primary if no cluster has been probed
+// healthy)
+func (p *RouterPlugin) nearest() *cluster {
+	if o := p.Override(); o.Reads != "" {
+		return p.byName[o.Reads]
+	}
+	var (
+		best         *cluster
+		bestDegraded bool
+		latency      time.Duration
+	)
+	for _, c := range p.clusters {
+		c.lock.RLock()
+		healthy, l := c.healthy, c.latency
+		c.lock.RUnlock()
+		if !healthy {
+			continue
+		}
+		degraded := p.degraded(c)
+		if best == nil || (bestDegraded && !degraded) || (degraded == bestDegraded && l < latency) {
+			best, bestDegraded, latency = c, degraded, l
+		}
+	}
+	if best == nil {
+		return p.primary()
+	}
+	return best
+}
+
+// Clusters returns the status of the clusters
+func (p *RouterPlugin) Clusters() []ClusterStatus {
+	primary := p.primary()
+	statuses := make([]ClusterStatus, len(p.clusters))
+	for i, c := range p.clusters {
+		c.lock.RLock()
+		statuses[i] = ClusterStatus{
+			Name:      c.conf.Name,
+			Region:    c.conf.Region,
+			Primary:   c == primary,
+			Probed:    c.probed,
+			Healthy:   c.healthy,
+			Degraded:  p.degraded(c),
+			Latency:   c.latency.String(),
+			LastProbe: c.lastProbe,
+		}
+		if c.lastErr != nil {
+			statuses[i].Error = c.lastErr.Error()
+		}
+		c.lock.RUnlock()
+	}
+	return statuses
+}
+
+// isRead returns whether the command only reads (and so may be sent to any cluster)
+func isRead(r *plugins.Request) bool {
+	if s := r.Command.GetSession(); s != nil && s.TxnNumber != nil {
+		// Transactions are all sent to the primary
+		return false
+	}
+	switch cmd := r.Command.(type) {
+	case *command.Find, *command.Count, *command.Distinct, *command.ListCollections,
+		*command.ListIndexes, *command.CollStats:
+		return true
+	case *command.Aggregate:
+		for _, stage := range cmd.Pipeline {
+			if stageDoc, ok := stage.(bson.D); ok && len(stageDoc) > 0 && (stageDoc[0].Key == "$out" || stageDoc[0].Key == "$merge") {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// cursorID returns the ID of the cursor the command continues (0 if none)
+func cursorID(cmd command.Command) int64 {
+	switch cmd := cmd.(type) {
+	case *command.GetMore:
+		return cmd.CursorID
+	case *command.KillCursors:
+		for _, id := range cmd.Cursors {
+			if id, ok := id.(int64); ok {
+				return id
+			}
+		}
+	}
+	return 0
+}
+
+// route returns the cluster to send the request to and the kind of request
+func (p *RouterPlugin) route(r *plugins.Request) (*cluster, string) {
+	if id := cursorID(r.Command); id != 0 && r.CursorCache != nil {
+		if name, ok := r.CursorCache.GetCursor(id).Map[cursorKey{}].(string); ok {
+			if c, ok := p.byName[name]; ok {
+				return c, KindCursor
+			}
+		}
+	}
+	kind := KindWrite
+	if isRead(r) {
+		kind = KindRead
+	}
+	if c := p.split(r, kind); c != nil {
+		return c, kind
+	}
+	if kind == KindRead {
+		return p.nearest(), kind
+	}
+	return p.primary(), kind
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *RouterPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	c, kind := p.route(r)
+	requestsTotal.WithLabelValues(c.conf.Name, kind).Inc()
+
+	result, err := c.backend.Process(ctx, r, next)
+
+	// getMores of the cursor must go to the same cluster
+	if kind != KindCursor && r.CursorCache != nil {
+		if id, ok := bsonutil.Lookup(result, "cursor", "id"); ok {
+			if id, ok := id.(int64); ok && id > 0 {
+				r.CursorCache.GetCursor(id).Map[cursorKey{}] = c.conf.Name
+			}
+		}
+	}
+	return result, err
+}
+
+// Health checks the health of the primary cluster (reads fall back to it)
+func (p *RouterPlugin) Health(ctx context.Context) error {
+	if h, ok := plugins.Unwrap(p.primary().backend).(plugins.HealthChecker); ok {
+		return h.Health(ctx)
+	}
+	return nil
+}
+
+// ServerInfo returns the ServerInfo of the primary cluster
+func (p *RouterPlugin) ServerInfo(ctx context.Context) (*plugins.ServerInfo, error) {
+	sp, ok := plugins.Unwrap(p.primary().backend).(plugins.ServerInfoProvider)
+	if !ok {
+		return nil, fmt.Errorf("the backend of cluster %s provides no server info", p.primary().conf.Name)
+	}
+	return sp.ServerInfo(ctx)
+}
+
+// RunCommand runs the command on the primary cluster
+func (p *RouterPlugin) RunCommand(ctx context.Context, db string, cmd bson.D) (bson.D, error) {
+	cr, ok := plugins.Unwrap(p.primary().backend).(plugins.CommandRunner)
+	if !ok {
+		return nil, fmt.Errorf("the backend of cluster %s can't run commands", p.primary().conf.Name)
+	}
+	return cr.RunCommand(ctx, db, cmd)
+}
+
+// Stats returns the status and backend stats of the clusters
+func (p *RouterPlugin) Stats() bson.D {
+	statuses := p.Clusters()
+	clusters := make(bson.A, len(statuses))
+	for i, s := range statuses {
+		d := bson.D{
+			{"name", s.Name},
+			{"region", s.Region},
+			{"primary", s.Primary},
+			{"healthy", s.Healthy},
+			{"degraded", s.Degraded},
+			{"latency", s.Latency},
+		}
+		if sp, ok := plugins.Unwrap(p.clusters[i].backend).(plugins.StatsProvider); ok {
+			d = append(d, sp.Stats()...)
+		}
+		clusters[i] = d
+	}
+	o := p.Override()
+	splitStatuses := p.Splits()
+	splits := make(bson.A, len(splitStatuses))
+	for i, s := range splitStatuses {
+		splits[i] = bson.D{
+			{"name", s.Name},
+			{"cluster", s.Cluster},
+			{"reads", s.Reads},
+			{"writes", s.Writes},
+		}
+	}
+	return bson.D{
+		{"clusters", clusters},
+		{"override", bson.D{{"reads", o.Reads}, {"writes", o.Writes}}},
+		{"splits", splits},
+	}
+}
+
+// AdminHandler returns the handler for the router admin endpoints:
+//
+//	GET clusters        the status of the clusters
+//	GET override        the manual override
+//	POST override       set the override; the body is {"reads": "cluster", "writes": "cluster"}
+//	DELETE override     clear the override
+//	GET splits          the splits and their current percentages
+//	POST splits/{name}  set the percentages of the split; the body is {"reads": 5, "writes": 0}
+func (p *RouterPlugin) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clusters", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.Clusters())
+	})
+	mux.HandleFunc("/override", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var o Override
+			if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := p.SetOverride(o); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		case http.MethodDelete:
+			p.SetOverride(Override{})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.Override())
+	})
+	mux.HandleFunc("/splits", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.Splits())
+	})
+	mux.HandleFunc("/splits/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var percents SplitPercents
+		if err := json.NewDecoder(r.Body).Decode(&percents); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := p.SetSplit(strings.TrimPrefix(r.URL.Path, "/splits/"), percents); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.Splits())
+	})
+	return mux
+}
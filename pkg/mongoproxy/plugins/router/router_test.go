@@ -0,0 +1,251 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+// testBackend is a backend answering pings after its latency
+type testBackend struct {
+	name    string
+	latency time.Duration
+	down    bool
+}
+
+var (
+	testBackendsLock sync.Mutex
+	testBackends     = map[string]*testBackend{}
+)
+
+func init() {
+	plugins.Register(func() plugins.Plugin { return &testBackend{} })
+}
+
+func (b *testBackend) Name() string { return "routertest" }
+
+func (b *testBackend) Configure(d bson.D) error {
+	name, _ := bsonutil.Lookup(d, "name")
+	b.name, _ = name.(string)
+	latency, _ := bsonutil.Lookup(d, "latency")
+	b.latency, _ = time.ParseDuration(latency.(string))
+	testBackendsLock.Lock()
+	testBackends[b.name] = b
+	testBackendsLock.Unlock()
+	return nil
+}
+
+func (b *testBackend) RunCommand(ctx context.Context, db string, cmd bson.D) (bson.D, error) {
+	time.Sleep(b.latency)
+	testBackendsLock.Lock()
+	defer testBackendsLock.Unlock()
+	if b.down {
+		return nil, fmt.Errorf("%s is down", b.name)
+	}
+	return bson.D{{"ok", 1}}, nil
+}
+
+func (b *testBackend) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	result := bson.D{{"cluster", b.name}, {"ok", 1}}
+	if _, ok := r.Command.(*command.Find); ok {
+		result = append(result, bson.E{"cursor", bson.D{{"id", int64(42)}}})
+	}
+	return result, nil
+}
+
+type testCursorCache struct {
+	cursors map[int64]*plugins.CursorCacheEntry
+}
+
+func (c *testCursorCache) GetCursor(id int64) *plugins.CursorCacheEntry {
+	if _, ok := c.cursors[id]; !ok {
+		c.cursors[id] = plugins.NewCursorCacheEntry(id)
+	}
+	return c.cursors[id]
+}
+
+func (c *testCursorCache) CloseCursor(id int64) { delete(c.cursors, id) }
+
+// testClusterStates reports the clusters in it as degraded
+type testClusterStates map[string]bool
+
+func (s testClusterStates) ClusterState(cluster string) (plugins.ClusterState, bool) {
+	degraded, ok := s[cluster]
+	return plugins.ClusterState{Maintenance: degraded}, ok
+}
+
+func TestRouter(t *testing.T) {
+	pl, _ := plugins.GetPlugin(Name)
+	p := pl.(*RouterPlugin)
+	conf := bson.D{
+		{"clusters", bson.A{
+			bson.D{{"name", "us-west"}, {"region", "us-west-2"}, {"plugin", "routertest"}, {"config", bson.D{{"name", "us-west"}, {"latency", "30ms"}}}},
+			bson.D{{"name", "us-east"}, {"region", "us-east-1"}, {"plugin", "routertest"}, {"config", bson.D{{"name", "us-east"}, {"latency", "1ms"}}}},
+			bson.D{{"name", "eu"}, {"region", "eu-west-1"}, {"plugin", "routertest"}, {"config", bson.D{{"name", "eu"}, {"latency", "10ms"}}}},
+		}},
+		{"primary", "us-west"},
+		{"probeInterval", "1h"},
+	}
+	if err := p.Configure(conf); err != nil {
+		t.Fatal(err)
+	}
+	cursors := &testCursorCache{cursors: map[int64]*plugins.CursorCacheEntry{}}
+	pipe := plugins.BuildPipeline([]plugins.Plugin{p}, nil)
+	run := func(cmd bson.D) string {
+		c, ok := command.GetCommand(cmd[0].Key)
+		if !ok {
+			t.Fatalf("no such command: %s", cmd[0].Key)
+		}
+		if err := c.FromBSOND(cmd); err != nil {
+			t.Fatal(err)
+		}
+		result, err := pipe(context.TODO(), &plugins.Request{CommandName: cmd[0].Key, Command: c, CursorCache: cursors})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cluster, _ := bsonutil.Lookup(result, "cluster")
+		return cluster.(string)
+	}
+
+	find := bson.D{{"find", "coll"}, {"$db", "db"}}
+	insert := bson.D{{"insert", "coll"}, {"documents", bson.A{bson.D{{"a", 1}}}}, {"$db", "db"}}
+	getMore := bson.D{{"getMore", int64(42)}, {"collection", "coll"}, {"$db", "db"}}
+	tests := []struct {
+		name     string
+		setup    func()
+		cmd      bson.D
+		expected string
+	}{
+		// Nothing is probed yet
+		{"unprobed", func() {}, find, "us-west"},
+		{"nearest", func() { p.probeAll() }, find, "us-east"},
+		{"write", func() {}, insert, "us-west"},
+		{"cursor", func() {
+			testBackends["us-east"].latency = 50 * time.Millisecond
+			p.probeAll()
+			p.probeAll()
+		}, getMore, "us-east"},
+		{"slower", func() {}, find, "eu"},
+		{"aggregate", func() {}, bson.D{{"aggregate", "coll"}, {"pipeline", bson.A{bson.D{{"$match", bson.D{}}}}}, {"cursor", bson.D{}}, {"$db", "db"}}, "eu"},
+		{"aggregate $out", func() {}, bson.D{{"aggregate", "coll"}, {"pipeline", bson.A{bson.D{{"$out", "other"}}}}, {"cursor", bson.D{}}, {"$db", "db"}}, "us-west"},
+		{"transaction", func() {}, bson.D{{"find", "coll"}, {"txnNumber", int64(1)}, {"$db", "db"}}, "us-west"},
+		{"unhealthy", func() {
+			testBackendsLock.Lock()
+			testBackends["eu"].down = true
+			testBackendsLock.Unlock()
+			p.probeAll()
+		}, find, "us-west"},
+		// Reads avoid degraded clusters unless all are
+		{"degraded", func() {
+			p.SetClusterStateProvider(testClusterStates{"us-west": true, "us-east": false})
+		}, find, "us-east"},
+		{"all degraded", func() {
+			p.SetClusterStateProvider(testClusterStates{"us-west": true, "us-east": true})
+		}, find, "us-west"},
+		{"degraded write", func() {}, insert, "us-west"},
+		{"override reads", func() {
+			p.SetClusterStateProvider(nil)
+			if err := p.SetOverride(Override{Reads: "eu"}); err != nil {
+				t.Fatal(err)
+			}
+		}, find, "eu"},
+		{"override writes", func() {
+			if err := p.SetOverride(Override{Writes: "us-east"}); err != nil {
+				t.Fatal(err)
+			}
+		}, insert, "us-east"},
+	}
+
+	for _, test := range tests {
+		test.setup()
+		if cluster := run(test.cmd); cluster != test.expected {
+			t.Fatalf("%s: expected %s, got %s: %+v", test.name, test.expected, cluster, p.Clusters())
+		}
+	}
+
+	if err := p.SetOverride(Override{Reads: "nope"}); err == nil {
+		t.Fatalf("expected an error for an unknown cluster")
+	}
+}
+
+func TestSplit(t *testing.T) {
+	pl, _ := plugins.GetPlugin(Name)
+	p := pl.(*RouterPlugin)
+	conf := bson.D{
+		{"clusters", bson.A{
+			bson.D{{"name", "old"}, {"plugin", "routertest"}, {"config", bson.D{{"name", "old"}, {"latency", "0s"}}}},
+			bson.D{{"name", "new"}, {"plugin", "routertest"}, {"config", bson.D{{"name", "new"}, {"latency", "0s"}}}},
+		}},
+		{"primary", "old"},
+		{"splits", bson.A{
+			bson.D{{"name", "migration"}, {"scope", bson.D{{"collections", bson.A{"db.migrated"}}}}, {"cluster", "new"}, {"reads", 50}},
+		}},
+	}
+	if err := p.Configure(conf); err != nil {
+		t.Fatal(err)
+	}
+	pipe := plugins.BuildPipeline([]plugins.Plugin{p}, nil)
+	// count returns how many of 1000 requests were sent to the new cluster
+	count := func(cmd bson.D) int {
+		n := 0
+		for i := 0; i < 1000; i++ {
+			c, _ := command.GetCommand(cmd[0].Key)
+			if err := c.FromBSOND(cmd); err != nil {
+				t.Fatal(err)
+			}
+			result, err := pipe(context.TODO(), &plugins.Request{CommandName: cmd[0].Key, Command: c})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cluster, _ := bsonutil.Lookup(result, "cluster"); cluster == "new" {
+				n++
+			}
+		}
+		return n
+	}
+
+	find := bson.D{{"find", "migrated"}, {"$db", "db"}}
+	insert := bson.D{{"insert", "migrated"}, {"documents", bson.A{bson.D{{"a", 1}}}}, {"$db", "db"}}
+	if n := count(find); n < 400 || n > 600 {
+		t.Fatalf("expected about half the reads on the new cluster, got %d/1000", n)
+	}
+	if n := count(insert); n != 0 {
+		t.Fatalf("expected no writes on the new cluster, got %d/1000", n)
+	}
+	if n := count(bson.D{{"find", "other"}, {"$db", "db"}}); n != 0 {
+		t.Fatalf("expected no reads of other namespaces on the new cluster, got %d/1000", n)
+	}
+
+	if err := p.SetSplit("migration", SplitPercents{Reads: 100, Writes: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(find); n != 1000 {
+		t.Fatalf("expected all reads on the new cluster, got %d/1000", n)
+	}
+	if n := count(insert); n != 1000 {
+		t.Fatalf("expected all writes on the new cluster, got %d/1000", n)
+	}
+
+	// Rollback
+	if err := p.SetSplit("migration", SplitPercents{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(find); n != 0 {
+		t.Fatalf("expected no reads on the new cluster, got %d/1000", n)
+	}
+
+	if err := p.SetSplit("migration", SplitPercents{Reads: 101}); err == nil {
+		t.Fatalf("expected an error for an invalid percentage")
+	}
+	if err := p.SetSplit("nope", SplitPercents{}); err == nil {
+		t.Fatalf("expected an error for an unknown split")
+	}
+}
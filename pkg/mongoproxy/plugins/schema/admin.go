@@ -0,0 +1,143 @@
+package schema
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// EffectiveField is a field in the effective (flattened) schema of a collection
+type EffectiveField struct {
+	Type     BSONType `json:"type"`
+	Required bool     `json:"required,omitempty"`
+	IsArray  bool     `json:"isArray,omitempty"`
+}
+
+// EffectiveSchema returns the flattened schema of the collection keyed by dotted
+// path, with remote collection types resolved.
+func (c *Collection) EffectiveSchema() map[string]EffectiveField {
+	if c.paths == nil {
+		c.compile()
+	}
+	fields := make(map[string]EffectiveField, len(c.paths))
+	for path, f := range c.paths {
+		fields[path] = EffectiveField{Type: f.Type, Required: f.Required, IsArray: f.IsArray}
+	}
+	return fields
+}
+
+// AdminHandler returns the handler for the schema admin endpoints:
+//
+//	GET schema?database=x&collection=y   effective schema of the collection
+//	GET docs?database=x                  documentation of the schemas as HTML
+//	GET docs.md?database=x               documentation of the schemas as Markdown
+//	GET jsonschema?database=x            index of the collections' JSON Schemas
+//	GET jsonschema?database=x&collection=y   JSON Schema of the collection
+func (p *SchemaPlugin) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/schema", func(w http.ResponseWriter, r *http.Request) {
+		database, collection := r.URL.Query().Get("database"), r.URL.Query().Get("collection")
+		schema := p.GetSchema()
+		if schema == nil {
+			http.Error(w, "no schema loaded", http.StatusNotFound)
+			return
+		}
+		db, ok := schema.Databases[database]
+		if !ok {
+			http.Error(w, "unknown database "+database, http.StatusNotFound)
+			return
+		}
+		c, ok := db.Collections[collection]
+		if !ok {
+			http.Error(w, "unknown collection "+collection, http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Database          string                    `json:"database"`
+			Collection        string                    `json:"collection"`
+			DenyUnknownFields bool                      `json:"denyUnknownFields"`
+			EnforceSchema     bool                      `json:"enforceSchema"`
+			Fields            map[string]EffectiveField `json:"fields"`
+		}{
+			Database:          database,
+			Collection:        collection,
+			DenyUnknownFields: c.DenyUnknownFields,
+			EnforceSchema:     c.EnforceSchema,
+			Fields:            c.EffectiveSchema(),
+		})
+	})
+	mux.HandleFunc("/docs", p.serveDocs(false))
+	mux.HandleFunc("/docs.md", p.serveDocs(true))
+	mux.HandleFunc("/jsonschema", p.serveJSONSchema)
+	return mux
+}
+
+// VirtualCollections returns the "schemas" collection of the virtual admin
+// database: the effective schema of each collection
+func (p *SchemaPlugin) VirtualCollections() map[string]func() []bson.D {
+	return map[string]func() []bson.D{
+		"schemas": func() []bson.D {
+			schema := p.GetSchema()
+			if schema == nil {
+				return nil
+			}
+			var docs []bson.D
+			for dbName, db := range schema.Databases {
+				for collName, c := range db.Collections {
+					effective := c.EffectiveSchema()
+					paths := make([]string, 0, len(effective))
+					for path := range effective {
+						paths = append(paths, path)
+					}
+					sort.Strings(paths)
+					fields := make(bson.A, len(paths))
+					for i, path := range paths {
+						f := effective[path]
+						fields[i] = bson.D{
+							{"path", path},
+							{"type", string(f.Type)},
+							{"required", f.Required},
+							{"isArray", f.IsArray},
+						}
+					}
+					docs = append(docs, bson.D{
+						{"_id", dbName + "." + collName},
+						{"database", dbName},
+						{"collection", collName},
+						{"denyUnknownFields", c.DenyUnknownFields},
+						{"enforceSchema", c.EnforceSchema},
+						{"fields", fields},
+					})
+				}
+			}
+			sort.Slice(docs, func(i, j int) bool { return docs[i][0].Value.(string) < docs[j][0].Value.(string) })
+			return docs
+		},
+	}
+}
+
+// FieldType returns the type of the field in the collection's schema ("" if it
+// isn't declared), and false if the collection has no schema
+func (p *SchemaPlugin) FieldType(database, collection, field string) (string, bool) {
+	schema := p.GetSchema()
+	if schema == nil {
+		return "", false
+	}
+	db, ok := schema.Databases[database]
+	if !ok {
+		return "", false
+	}
+	c, ok := db.Collections[collection]
+	if !ok {
+		return "", false
+	}
+	f := c.lookupField(field)
+	if f == nil {
+		return "", true
+	}
+	return string(f.Type), true
+}
@@ -0,0 +1,108 @@
+package schema
+
+import (
+	"reflect"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// compile precompiles the loaded schema into the lookup structures used on the
+// request path. This is called once at load time (after all remote collection
+// references are resolved) so that validation doesn't have to split dotted
+// paths or walk nested field maps on every request.
+func (s *ClusterSchema) compile() {
+	for dbName, db := range s.Databases {
+		for collectionName, collection := range db.Collections {
+			collection.compile()
+			db.Collections[collectionName] = collection
+		}
+		s.Databases[dbName] = db
+	}
+}
+
+// compile builds the flattened path map for the collection
+func (c *Collection) compile() {
+	c.paths = make(map[string]*CollectionField)
+	compileFields(c.paths, "", c.Fields, map[uintptr]struct{}{})
+	c.raw, _ = compileRawFields(c.Fields)
+	c.valueChecks, c.transforms = false, false
+	for _, f := range c.paths {
+		if f.checksValues() {
+			c.valueChecks = true
+		}
+		if len(f.Transforms) > 0 {
+			c.transforms = true
+		}
+	}
+}
+
+// compileFields adds all fields (and their subfields) to paths keyed by their
+// dotted path. Remote collections are followed, but only once per path to
+// avoid looping on self-referential schemas.
+func compileFields(paths map[string]*CollectionField, prefix string, fields map[string]CollectionField, seen map[uintptr]struct{}) {
+	if len(fields) == 0 {
+		return
+	}
+	ptr := reflect.ValueOf(fields).Pointer()
+	if _, ok := seen[ptr]; ok {
+		return
+	}
+	seen[ptr] = struct{}{}
+	defer delete(seen, ptr)
+
+	for k, v := range fields {
+		v.elemType = elementType(v.Type)
+		fields[k] = v
+
+		// Index the field by its full dotted path (the key itself at the top level)
+		path := k
+		if prefix != "" {
+			path = prefix + "." + k
+		}
+		f := v
+		paths[path] = &f
+
+		if v.remoteCollection != nil {
+			compileFields(paths, path, v.remoteCollection.Fields, seen)
+		} else {
+			compileFields(paths, path, v.SubFields, seen)
+		}
+	}
+}
+
+// elementType returns the type of the elements of an array type (e.g. "[]int" -> "int")
+func elementType(t BSONType) BSONType {
+	return BSONType(strings.Trim(string(t), "[]"))
+}
+
+// lookupField returns the field for the given dotted path, using the compiled
+// path map if the collection has been compiled.
+func (c *Collection) lookupField(path string) *CollectionField {
+	if c.paths != nil {
+		if f, ok := c.paths[path]; ok {
+			return f
+		}
+		// A path that doesn't contain a "." can only be a top-level field, so if it
+		// isn't in the map it doesn't exist.
+		if strings.IndexByte(path, '.') < 0 {
+			return nil
+		}
+	}
+	return c.GetField(strings.Split(path, ".")...)
+}
+
+// isArrayValue returns whether v is an array value (primitive.A or an unnamed
+// slice type such as []interface{}). Named slice types (e.g. primitive.D or
+// primitive.Binary's data) are not arrays.
+func isArrayValue(v interface{}) bool {
+	switch v.(type) {
+	case primitive.A:
+		return true
+	case bson.D, primitive.M, nil:
+		return false
+	}
+	t := reflect.TypeOf(v)
+	return t.Kind() == reflect.Slice && t.Name() == ""
+}
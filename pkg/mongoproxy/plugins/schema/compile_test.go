@@ -0,0 +1,74 @@
+package schema
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCompiledLookup(t *testing.T) {
+	var schema ClusterSchema
+
+	buf, err := ioutil.ReadFile("example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := json.Unmarshal(buf, &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	for dbName, db := range schema.Databases {
+		for collectionName, collection := range db.Collections {
+			if collection.paths == nil {
+				t.Fatalf("%s.%s not compiled", dbName, collectionName)
+			}
+			for path, f := range collection.paths {
+				expected := collection.GetField(strings.Split(path, ".")...)
+				if expected == nil {
+					t.Fatalf("%s.%s: compiled path %s not found", dbName, collectionName, path)
+				}
+				if expected.Type != f.Type || expected.Required != f.Required {
+					t.Fatalf("%s.%s: mismatch for %s expected=%v actual=%v", dbName, collectionName, path, expected, f)
+				}
+			}
+			if f := collection.lookupField("notafield"); f != nil {
+				t.Fatalf("%s.%s: unexpected field %v", dbName, collectionName, f)
+			}
+		}
+	}
+}
+
+func TestIsArrayValue(t *testing.T) {
+	tests := []struct {
+		v   interface{}
+		out bool
+	}{
+		{v: primitive.A{1}, out: true},
+		{v: []interface{}{1}, out: true},
+		{v: []string{"a"}, out: true},
+		{v: bson.D{{"a", 1}}, out: false},
+		{v: primitive.Binary{}, out: false},
+		{v: "string", out: false},
+		{v: nil, out: false},
+	}
+
+	for _, test := range tests {
+		if out := isArrayValue(test.v); out != test.out {
+			t.Fatalf("mismatch for %T expected=%v actual=%v", test.v, test.out, out)
+		}
+		// Ensure we match the previous (reflect string based) check
+		if test.v != nil {
+			interfaceType := reflect.TypeOf(test.v).String()
+			legacy := strings.HasPrefix(interfaceType, "[]") || interfaceType == "primitive.A"
+			if legacy != test.out {
+				t.Fatalf("mismatch with legacy check for %T", test.v)
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package schema
+
+import (
+	"fmt"
+	"math/big"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxDecimalPrecision is the number of significant digits of a Decimal128
+const maxDecimalPrecision = 34
+
+var bigTen = big.NewInt(10)
+
+// checksValues returns whether validating the field depends on its values and not
+// only on their types (so documents can't be validated by their shape)
+func (c *CollectionField) checksValues() bool {
+	return isGeoType(elementType(c.Type)) || c.Precision != 0 || c.Scale != nil || c.Lookup != ""
+}
+
+// loadDecimal checks the precision and scale of the field
+func (c *CollectionField) loadDecimal() error {
+	if c.Precision == 0 && c.Scale == nil {
+		return nil
+	}
+	if elementType(c.Type) != DECIMAL128 {
+		return fmt.Errorf("precision and scale are only supported for %s fields", DECIMAL128)
+	}
+	if c.Precision < 0 || c.Precision > maxDecimalPrecision {
+		return fmt.Errorf("precision must be within [1, %d]", maxDecimalPrecision)
+	}
+	if c.Scale != nil && (*c.Scale < 0 || (c.Precision != 0 && *c.Scale > c.Precision)) {
+		return fmt.Errorf("scale must be within [0, precision]")
+	}
+	return nil
+}
+
+// decimalDigits returns the number of digits and of decimal places of the value,
+// ignoring trailing zeros (1.50 has 2 digits and 1 decimal place)
+func decimalDigits(d primitive.Decimal128) (int, int, error) {
+	coefficient, exp, err := d.BigInt()
+	if err != nil {
+		return 0, 0, err
+	}
+	coefficient.Abs(coefficient)
+	var m big.Int
+	for exp < 0 && coefficient.Sign() != 0 {
+		if m.Mod(coefficient, bigTen); m.Sign() != 0 {
+			break
+		}
+		coefficient.Quo(coefficient, bigTen)
+		exp++
+	}
+	digits := len(coefficient.String())
+	if coefficient.Sign() == 0 {
+		digits, exp = 1, 0
+	}
+	if exp >= 0 {
+		return digits + exp, 0, nil
+	}
+	scale := -exp
+	if scale > digits {
+		// e.g. 0.05
+		digits = scale
+	}
+	return digits, scale, nil
+}
+
+// validateDecimal validates the value against the precision (maximum number of
+// digits) and scale (maximum number of decimal places) of the field
+func (c *CollectionField) validateDecimal(v interface{}) error {
+	d, ok := v.(primitive.Decimal128)
+	if !ok || (c.Precision == 0 && c.Scale == nil) {
+		return nil
+	}
+	digits, scale, err := decimalDigits(d)
+	if err != nil {
+		return fmt.Errorf("%s: %s is not a finite decimal", c.Name, d)
+	}
+	if c.Scale != nil && scale > *c.Scale {
+		return fmt.Errorf("%s: %s has more than %d decimal places", c.Name, d, *c.Scale)
+	}
+	if c.Precision != 0 {
+		// The integer digits are limited to those not reserved for the decimal places
+		maxScale := scale
+		if c.Scale != nil {
+			maxScale = *c.Scale
+		}
+		if digits-scale > c.Precision-maxScale {
+			return fmt.Errorf("%s: %s has more than %d digits", c.Name, d, c.Precision)
+		}
+	}
+	return nil
+}
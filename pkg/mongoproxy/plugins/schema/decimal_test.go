@@ -0,0 +1,147 @@
+package schema
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const decimalSchema = `{
+	"dbs": {
+		"shop": {
+			"collections": {
+				"orders": {
+					"enforceSchema": true,
+					"fields": {
+						"total": {"type": "decimal", "required": true, "precision": 7, "scale": 2},
+						"rate": {"type": "decimal", "scale": 4},
+						"items": {
+							"type": "object",
+							"subfields": {
+								"price": {"type": "decimal", "precision": 5}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}`
+
+func decimal(t *testing.T, s string) primitive.Decimal128 {
+	d, err := primitive.ParseDecimal128(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestDecimalDigits(t *testing.T) {
+	tests := []struct {
+		in            string
+		digits, scale int
+	}{
+		{"0", 1, 0},
+		{"12", 2, 0},
+		{"1.5", 2, 1},
+		{"1.50", 2, 1},
+		{"-12.345", 5, 3},
+		{"0.05", 2, 2},
+		{"1.2E+3", 4, 0},
+		{"100", 3, 0},
+	}
+	for _, test := range tests {
+		digits, scale, err := decimalDigits(decimal(t, test.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if digits != test.digits || scale != test.scale {
+			t.Fatalf("%s: expected %d digits and scale %d, got %d and %d", test.in, test.digits, test.scale, digits, scale)
+		}
+	}
+}
+
+func TestDecimalConstraints(t *testing.T) {
+	var schema ClusterSchema
+	if err := json.Unmarshal([]byte(decimalSchema), &schema); err != nil {
+		t.Fatal(err)
+	}
+	schema.setShapeCaches(100)
+
+	inserts := []struct {
+		doc bson.D
+		err bool
+	}{
+		{doc: bson.D{{"total", decimal(t, "19.99")}}},
+		{doc: bson.D{{"total", decimal(t, "19.990")}}},
+		{doc: bson.D{{"total", decimal(t, "99999.99")}}},
+		// The shape of a valid document doesn't make its values valid
+		{doc: bson.D{{"total", decimal(t, "19.999")}}, err: true},
+		{doc: bson.D{{"total", decimal(t, "100000")}}, err: true},
+		{doc: bson.D{{"total", decimal(t, "NaN")}}, err: true},
+		// Floats aren't decimals
+		{doc: bson.D{{"total", 19.99}}, err: true},
+		{doc: bson.D{{"total", decimal(t, "1")}, {"rate", decimal(t, "0.0125")}}},
+		{doc: bson.D{{"total", decimal(t, "1")}, {"rate", decimal(t, "0.01255")}}, err: true},
+		{doc: bson.D{{"total", decimal(t, "1")}, {"items", bson.D{{"price", decimal(t, "123.45")}}}}},
+		{doc: bson.D{{"total", decimal(t, "1")}, {"items", bson.D{{"price", decimal(t, "1234.56")}}}}, err: true},
+	}
+	for i, test := range inserts {
+		err := schema.ValidateInsert(context.TODO(), "shop", "orders", test.doc)
+		if (err != nil) != test.err {
+			t.Fatalf("insert %d: expected err=%v, got %v", i, test.err, err)
+		}
+	}
+
+	updates := []struct {
+		u   bson.D
+		err bool
+	}{
+		{u: bson.D{{"$set", bson.D{{"total", decimal(t, "5.25")}}}}},
+		{u: bson.D{{"$set", bson.D{{"total", decimal(t, "5.255")}}}}, err: true},
+		{u: bson.D{{"$inc", bson.D{{"total", decimal(t, "0.01")}}}}},
+		{u: bson.D{{"$inc", bson.D{{"total", decimal(t, "0.001")}}}}, err: true},
+		{u: bson.D{{"$inc", bson.D{{"total", 0.01}}}}, err: true},
+		{u: bson.D{{"$set", bson.D{{"items.price", decimal(t, "123456")}}}}, err: true},
+	}
+	for i, test := range updates {
+		err := schema.ValidateUpdate(context.TODO(), "shop", "orders", test.u, false)
+		if (err != nil) != test.err {
+			t.Fatalf("update %d: expected err=%v, got %v", i, test.err, err)
+		}
+	}
+
+	// The raw path checks the values too
+	raw, err := bson.Marshal(bson.D{{"total", decimal(t, "19.999")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := schema.Databases["shop"].Collections["orders"]
+	if err := c.ValidateInsertRaw(context.TODO(), raw); err == nil {
+		t.Fatal("expected the raw document to be invalid")
+	}
+}
+
+func TestDecimalLoad(t *testing.T) {
+	tests := []struct {
+		field string
+		ok    bool
+	}{
+		{field: `{"type": "decimal", "precision": 10, "scale": 2}`, ok: true},
+		{field: `{"type": "decimal", "scale": 0}`, ok: true},
+		{field: `{"type": "double", "scale": 2}`},
+		{field: `{"type": "decimal", "precision": 35}`},
+		{field: `{"type": "decimal", "precision": 2, "scale": 3}`},
+		{field: `{"type": "decimal", "scale": -1}`},
+	}
+	for i, test := range tests {
+		var schema ClusterSchema
+		doc := `{"dbs": {"shop": {"collections": {"orders": {"fields": {"total": ` + test.field + `}}}}}}`
+		if err := json.Unmarshal([]byte(doc), &schema); (err == nil) != test.ok {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package schema
+
+import (
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// docField is a row of the field table of a collection's documentation
+type docField struct {
+	Path     string
+	Depth    int
+	Type     BSONType
+	Required bool
+	IsArray  bool
+	Alias    string
+	// Ref is the collection (db.collection) of a field typed by one
+	Ref         string
+	Annotations string
+}
+
+type docCollection struct {
+	Name                             string
+	Namespace                        string
+	EnforceSchema                    bool
+	EnforceSchemaByCollectionLogOnly bool
+	DenyUnknownFields                bool
+	Annotations                      string
+	Fields                           []docField
+	// Includes are the collections whose schemas fields of this one are typed by,
+	// and IncludedBy the collections with fields typed by this one
+	Includes   []string
+	IncludedBy []string
+}
+
+type docDatabase struct {
+	Name                   string
+	DenyUnknownCollections bool
+	Annotations            string
+	Collections            []docCollection
+}
+
+type schemaDocs struct {
+	MongosEndpoint       string
+	DenyUnknownDatabases bool
+	Databases            []docDatabase
+}
+
+// buildDocs returns the documentation of the schema's databases (all if database
+// is ""), sorted by name
+func buildDocs(s *ClusterSchema, database string) schemaDocs {
+	docs := schemaDocs{MongosEndpoint: s.MongosEndpoint, DenyUnknownDatabases: s.DenyUnknownDatabases}
+	includedBy := make(map[string][]string)
+	for dbName, db := range s.Databases {
+		for collName, c := range db.Collections {
+			for _, ref := range collectionRefs(c.Fields) {
+				includedBy[ref] = append(includedBy[ref], dbName+"."+collName)
+			}
+		}
+	}
+
+	for _, dbName := range sortedKeys(s.Databases) {
+		if database != "" && dbName != database {
+			continue
+		}
+		db := s.Databases[dbName]
+		d := docDatabase{
+			Name:                   dbName,
+			DenyUnknownCollections: db.DenyUnknownCollections,
+			Annotations:            formatAnnotations(db.Annotations),
+		}
+		for _, collName := range sortedCollectionKeys(db.Collections) {
+			c := db.Collections[collName]
+			ns := dbName + "." + collName
+			dc := docCollection{
+				Name:                             collName,
+				Namespace:                        ns,
+				EnforceSchema:                    c.EnforceSchema,
+				EnforceSchemaByCollectionLogOnly: c.EnforceSchemaByCollectionLogOnly,
+				DenyUnknownFields:                c.DenyUnknownFields,
+				Annotations:                      formatAnnotations(c.Annotations),
+				Fields:                           docFields(nil, "", 0, c.Fields),
+				Includes:                         collectionRefs(c.Fields),
+				IncludedBy:                       includedBy[ns],
+			}
+			sort.Strings(dc.IncludedBy)
+			d.Collections = append(d.Collections, dc)
+		}
+		docs.Databases = append(docs.Databases, d)
+	}
+	return docs
+}
+
+// docFields appends the rows of the fields (and their subfields, but not the
+// fields of the collections they're typed by) sorted by path
+func docFields(rows []docField, prefix string, depth int, fields map[string]CollectionField) []docField {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := fields[name]
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+		rows = append(rows, docField{
+			Path:        path,
+			Depth:       depth,
+			Type:        f.Type,
+			Required:    f.Required,
+			IsArray:     f.IsArray || strings.HasPrefix(string(f.Type), "[]"),
+			Alias:       f.Name,
+			Ref:         fieldRef(f.Type),
+			Annotations: formatAnnotations(f.Annotations),
+		})
+		rows = docFields(rows, path, depth+1, f.SubFields)
+	}
+	return rows
+}
+
+// fieldRef returns the collection of a field typed by one ("db.collection" or
+// "[]db.collection")
+func fieldRef(t BSONType) string {
+	ref := strings.TrimPrefix(string(t), "[]")
+	if !strings.Contains(ref, ".") {
+		return ""
+	}
+	return ref
+}
+
+// collectionRefs returns the sorted collections the fields are typed by
+func collectionRefs(fields map[string]CollectionField) []string {
+	set := make(map[string]struct{})
+	WalkCollectionFields(fields, func(_ string, f *CollectionField) error {
+		if ref := fieldRef(f.Type); ref != "" {
+			set[ref] = struct{}{}
+		}
+		return nil
+	})
+	refs := make([]string, 0, len(set))
+	for ref := range set {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+func formatAnnotations(annotations map[string]string) string {
+	pairs := make([]string, 0, len(annotations))
+	for k, v := range annotations {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// anchor returns the id of a namespace's section in the documentation
+func anchor(ns string) string {
+	return strings.NewReplacer(".", "-", " ", "-").Replace(ns)
+}
+
+// mdEscape escapes the text for a Markdown table cell
+func mdEscape(s string) string {
+	return strings.NewReplacer("|", `\|`, "\n", " ").Replace(s)
+}
+
+var markdownDocs = template.Must(template.New("markdown").Funcs(template.FuncMap{
+	"anchor": anchor,
+	"esc":    mdEscape,
+	"indent": func(depth int) string { return strings.Repeat("&nbsp;&nbsp;", depth) },
+}).Parse(`# Collection schemas
+{{if .MongosEndpoint}}
+Cluster: ` + "`{{.MongosEndpoint}}`" + `
+{{end}}{{if .DenyUnknownDatabases}}
+Databases not listed here are denied.
+{{end}}{{range .Databases}}
+## {{.Name}}
+{{if .DenyUnknownCollections}}
+Collections not listed here are denied.
+{{end}}{{if .Annotations}}
+Annotations: {{esc .Annotations}}
+{{end}}{{range .Collections}}
+### <a id="{{anchor .Namespace}}"></a>{{.Namespace}}
+
+{{if .EnforceSchema}}Enforced{{else if .EnforceSchemaByCollectionLogOnly}}Violations logged only{{else}}Not enforced{{end}}{{if .DenyUnknownFields}}; fields not listed are denied{{else}}; fields not listed are allowed{{end}}.
+{{if .Annotations}}
+Annotations: {{esc .Annotations}}
+{{end}}{{if .Includes}}
+Includes: {{range $i, $ns := .Includes}}{{if $i}}, {{end}}[{{$ns}}](#{{anchor $ns}}){{end}}
+{{end}}{{if .IncludedBy}}
+Included by: {{range $i, $ns := .IncludedBy}}{{if $i}}, {{end}}[{{$ns}}](#{{anchor $ns}}){{end}}
+{{end}}{{if .Fields}}
+| Field | Type | Required | Array | Alias | Annotations |
+| --- | --- | --- | --- | --- | --- |
+{{range .Fields}}| {{indent .Depth}}` + "`{{esc .Path}}`" + ` | {{if .Ref}}[{{esc (print .Type)}}](#{{anchor .Ref}}){{else}}{{esc (print .Type)}}{{end}} | {{if .Required}}yes{{end}} | {{if .IsArray}}yes{{end}} | {{esc .Alias}} | {{esc .Annotations}} |
+{{end}}{{else}}
+No fields.
+{{end}}{{end}}{{end}}`))
+
+var htmlDocs = htmltemplate.Must(htmltemplate.New("html").Funcs(htmltemplate.FuncMap{
+	"anchor": anchor,
+	"indent": func(depth int) int { return depth * 16 },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Collection schemas</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+th { background: #f4f4f4; }
+code { font-size: 0.95em; }
+nav li { margin: 2px 0; }
+.flags { color: #555; }
+</style>
+</head>
+<body>
+<h1>Collection schemas</h1>
+{{if .MongosEndpoint}}<p>Cluster: <code>{{.MongosEndpoint}}</code></p>{{end}}
+{{if .DenyUnknownDatabases}}<p>Databases not listed here are denied.</p>{{end}}
+<nav><ul>
+{{range .Databases}}<li>{{.Name}}<ul>{{range .Collections}}<li><a href="#{{anchor .Namespace}}">{{.Name}}</a></li>{{end}}</ul></li>
+{{end}}</ul></nav>
+{{range .Databases}}
+<h2>{{.Name}}</h2>
+{{if .DenyUnknownCollections}}<p>Collections not listed here are denied.</p>{{end}}
+{{if .Annotations}}<p>Annotations: {{.Annotations}}</p>{{end}}
+{{range .Collections}}
+<h3 id="{{anchor .Namespace}}">{{.Namespace}}</h3>
+<p class="flags">{{if .EnforceSchema}}Enforced{{else if .EnforceSchemaByCollectionLogOnly}}Violations logged only{{else}}Not enforced{{end}}{{if .DenyUnknownFields}}; fields not listed are denied{{else}}; fields not listed are allowed{{end}}.</p>
+{{if .Annotations}}<p>Annotations: {{.Annotations}}</p>{{end}}
+{{if .Includes}}<p>Includes: {{range $i, $ns := .Includes}}{{if $i}}, {{end}}<a href="#{{anchor $ns}}">{{$ns}}</a>{{end}}</p>{{end}}
+{{if .IncludedBy}}<p>Included by: {{range $i, $ns := .IncludedBy}}{{if $i}}, {{end}}<a href="#{{anchor $ns}}">{{$ns}}</a>{{end}}</p>{{end}}
+{{if .Fields}}<table>
+<tr><th>Field</th><th>Type</th><th>Required</th><th>Array</th><th>Alias</th><th>Annotations</th></tr>
+{{range .Fields}}<tr><td style="padding-left: {{indent .Depth}}px"><code>{{.Path}}</code></td><td>{{if .Ref}}<a href="#{{anchor .Ref}}">{{.Type}}</a>{{else}}{{.Type}}{{end}}</td><td>{{if .Required}}yes{{end}}</td><td>{{if .IsArray}}yes{{end}}</td><td>{{.Alias}}</td><td>{{.Annotations}}</td></tr>
+{{end}}</table>{{else}}<p>No fields.</p>{{end}}
+{{end}}{{end}}
+</body>
+</html>
+`))
+
+// WriteMarkdown writes the documentation of the schema's databases (all if
+// database is "") as Markdown: the field tables of the collections, with their
+// types, required flags and the collections they include
+func (s *ClusterSchema) WriteMarkdown(w io.Writer, database string) error {
+	return markdownDocs.Execute(w, buildDocs(s, database))
+}
+
+// WriteHTML writes the documentation of the schema's databases (all if database
+// is "") as an HTML page
+func (s *ClusterSchema) WriteHTML(w io.Writer, database string) error {
+	return htmlDocs.Execute(w, buildDocs(s, database))
+}
+
+// serveDocs serves the documentation of the loaded schema as HTML, or Markdown if
+// markdown is set
+func (p *SchemaPlugin) serveDocs(markdown bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		schema := p.GetSchema()
+		if schema == nil {
+			http.Error(w, "no schema loaded", http.StatusNotFound)
+			return
+		}
+		database := r.URL.Query().Get("database")
+		if _, ok := schema.Databases[database]; database != "" && !ok {
+			http.Error(w, "unknown database "+database, http.StatusNotFound)
+			return
+		}
+		if markdown {
+			w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+			schema.WriteMarkdown(w, database)
+		} else {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			schema.WriteHTML(w, database)
+		}
+	}
+}
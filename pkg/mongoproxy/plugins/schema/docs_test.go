@@ -0,0 +1,90 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDocs(t *testing.T) {
+	var s ClusterSchema
+	if err := json.Unmarshal([]byte(`{"dbs": {"db": {"denyUnknownCollections": true, "collections": {
+		"users": {"enforceSchema": true, "denyUnknownFields": true, "annotations": {"owner": "team|a"}, "fields": {
+			"name": {"type": "string", "required": true},
+			"address": {"type": "object", "subfields": {"city": {"type": "string"}}},
+			"orders": {"type": "[]db.orders"}
+		}},
+		"orders": {"fields": {"total": {"type": "double"}}}
+	}}}}`), &s); err != nil {
+		t.Fatal(err)
+	}
+
+	docs := buildDocs(&s, "")
+	if len(docs.Databases) != 1 || len(docs.Databases[0].Collections) != 2 {
+		t.Fatalf("unexpected docs: %+v", docs)
+	}
+	orders, users := docs.Databases[0].Collections[0], docs.Databases[0].Collections[1]
+	var paths []string
+	for _, f := range users.Fields {
+		paths = append(paths, f.Path)
+	}
+	if expected := "address address.city name orders"; strings.Join(paths, " ") != expected {
+		t.Fatalf("expected fields %s, got %v", expected, paths)
+	}
+	if f := users.Fields[3]; f.Ref != "db.orders" || !f.IsArray {
+		t.Fatalf("unexpected orders field: %+v", f)
+	}
+	if len(users.Includes) != 1 || users.Includes[0] != "db.orders" {
+		t.Fatalf("unexpected includes: %v", users.Includes)
+	}
+	if len(orders.IncludedBy) != 1 || orders.IncludedBy[0] != "db.users" {
+		t.Fatalf("unexpected included by: %v", orders.IncludedBy)
+	}
+	if docs := buildDocs(&s, "other"); len(docs.Databases) != 0 {
+		t.Fatalf("expected no databases, got %+v", docs)
+	}
+
+	tests := []struct {
+		path     string
+		status   int
+		contains []string
+	}{
+		{"/docs.md", http.StatusOK, []string{
+			"### <a id=\"db-users\"></a>db.users",
+			"Enforced; fields not listed are denied.",
+			"Annotations: owner=team\\|a",
+			"Includes: [db.orders](#db-orders)",
+			"| &nbsp;&nbsp;`address.city` | string |  |  |  |  |",
+			"| `name` | string | yes |  |  |  |",
+			"| `orders` | [[]db.orders](#db-orders) |  | yes |  |  |",
+		}},
+		{"/docs", http.StatusOK, []string{
+			`<h3 id="db-users">db.users</h3>`,
+			`<a href="#db-orders">[]db.orders</a>`,
+			`Annotations: owner=team|a`,
+		}},
+		{"/docs?database=db", http.StatusOK, []string{"db.orders"}},
+		{"/docs?database=other", http.StatusNotFound, nil},
+	}
+
+	p := &SchemaPlugin{}
+	p.s.Store(&s)
+	h := p.AdminHandler()
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+			if w.Code != test.status {
+				t.Fatalf("expected status %d, got %d: %s", test.status, w.Code, w.Body.String())
+			}
+			for _, s := range test.contains {
+				if !bytes.Contains(w.Body.Bytes(), []byte(s)) {
+					t.Fatalf("expected %q in:\n%s", s, w.Body.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package schema
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// walkFilter calls f with the (dotted) path, operator and value of each field
+// condition in the query filter; equality conditions have the operator "$eq"
+func walkFilter(filter bson.D, prefix string, f func(path, op string, v interface{}) error) error {
+	for _, e := range filter {
+		switch e.Key {
+		case "$and", "$or", "$nor":
+			items, _ := e.Value.(primitive.A)
+			for _, item := range items {
+				if sub, ok := item.(bson.D); ok {
+					if err := walkFilter(sub, prefix, f); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+		// Other top-level operators ($expr, $where, $text, $comment, ...) don't
+		// reference fields directly
+		if strings.HasPrefix(e.Key, "$") {
+			continue
+		}
+
+		path := prefix + e.Key
+		ops, ok := e.Value.(bson.D)
+		if !ok || len(ops) == 0 || !strings.HasPrefix(ops[0].Key, "$") {
+			if err := f(path, "$eq", e.Value); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := walkOperators(path, ops, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkOperators calls f for each operator condition on the path
+func walkOperators(path string, ops bson.D, f func(path, op string, v interface{}) error) error {
+	for _, op := range ops {
+		switch op.Key {
+		case "$not":
+			if sub, ok := op.Value.(bson.D); ok {
+				if err := walkOperators(path, sub, f); err != nil {
+					return err
+				}
+				continue
+			}
+		case "$elemMatch":
+			if sub, ok := op.Value.(bson.D); ok {
+				// $elemMatch either has conditions on the elements or a filter on
+				// the fields of the (document) elements
+				if len(sub) > 0 && strings.HasPrefix(sub[0].Key, "$") && sub[0].Key != "$and" && sub[0].Key != "$or" && sub[0].Key != "$nor" {
+					if err := walkOperators(path, sub, f); err != nil {
+						return err
+					}
+				} else if err := walkFilter(sub, path+".", f); err != nil {
+					return err
+				}
+				continue
+			}
+		case "$options":
+			// Options of $regex
+			continue
+		}
+		if err := f(path, op.Key, op.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaPath returns the path with array indexes and positional operators removed
+// (e.g. "a.0.b" -> "a.b")
+func schemaPath(path string) string {
+	if !strings.ContainsAny(path, "0123456789$") {
+		return path
+	}
+	parts := strings.Split(path, ".")
+	out := parts[:0]
+	for _, part := range parts {
+		if isArrayIndex(part) {
+			continue
+		}
+		out = append(out, part)
+	}
+	return strings.Join(out, ".")
+}
+
+func isArrayIndex(part string) bool {
+	if part == "$" || part == "$[]" || (strings.HasPrefix(part, "$[") && strings.HasSuffix(part, "]")) {
+		return true
+	}
+	if part == "" {
+		return false
+	}
+	for _, c := range part {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// knownField returns whether the (dotted) path is in the collection's schema
+func (c *Collection) knownField(path string) bool {
+	path = schemaPath(path)
+	if path == "_id" || strings.HasPrefix(path, "_id.") || c.lookupField(path) != nil {
+		return true
+	}
+	// Objects without subfields in the schema can have any fields
+	for i := strings.IndexByte(path, '.'); i >= 0; i = nextDot(path, i) {
+		if f := c.lookupField(path[:i]); f != nil {
+			return len(f.SubFields) == 0 && f.remoteCollection == nil && (f.Type == OBJECT || f.Type == OBJECT_ARRAY)
+		}
+	}
+	return false
+}
+
+// nextDot returns the index of the next "." in path after i (-1 if there is none)
+func nextDot(path string, i int) int {
+	j := strings.IndexByte(path[i+1:], '.')
+	if j < 0 {
+		return -1
+	}
+	return i + 1 + j
+}
+
+// ValidateFilterFields will validate that the fields referenced in the query filter
+// are in the collection's schema
+func (c *Collection) ValidateFilterFields(ctx context.Context, filter bson.D) error {
+	return walkFilter(filter, "", func(path, op string, v interface{}) error {
+		if !c.knownField(path) {
+			return fmt.Errorf("filter on unknown field: %s", path)
+		}
+		return nil
+	})
+}
+
+// ValidateFields will validate that the fields are in the collection's schema
+func (c *Collection) ValidateFields(ctx context.Context, fields ...string) error {
+	for _, field := range fields {
+		if !c.knownField(field) {
+			return fmt.Errorf("unknown field: %s", field)
+		}
+	}
+	return nil
+}
+
+// GetCollection returns the schema of the collection (nil if the collection isn't
+// in the schema or has no fields)
+func (s *ClusterSchema) GetCollection(database, collection string) *Collection {
+	db, ok := s.Databases[database]
+	if !ok {
+		return nil
+	}
+	c, ok := db.Collections[collection]
+	if !ok || len(c.Fields) == 0 {
+		return nil
+	}
+	return &c
+}
+
+// ValidateFilterTypes will validate that the values the query filter compares the
+// fields in the collection's schema against are of the fields' types; fields which
+// aren't in the schema aren't validated (see ValidateFilterFields)
+func (c *Collection) ValidateFilterTypes(ctx context.Context, filter bson.D) error {
+	return walkFilter(filter, "", func(path, op string, v interface{}) error {
+		f := c.lookupField(schemaPath(path))
+		if f == nil {
+			return nil
+		}
+		switch op {
+		case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+			return validateFilterValue(ctx, path, f, v)
+		case "$in", "$nin", "$all":
+			items, _ := v.(primitive.A)
+			for _, item := range items {
+				if err := validateFilterValue(ctx, path, f, item); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// validateFilterValue validates a value the filter compares the field against
+func validateFilterValue(ctx context.Context, path string, f *CollectionField, v interface{}) error {
+	switch v.(type) {
+	case nil, primitive.Regex, primitive.MinKey, primitive.MaxKey:
+		// null matches missing fields, regexes match strings (or arrays of them)
+		// and min/max keys are used for ranges
+		return nil
+	}
+	t := f.elemType
+	if t == "" {
+		t = elementType(f.Type)
+	}
+	if t == NULL {
+		return nil
+	}
+	// mongo compares numbers of different types by value
+	if isNumericType(t) && isNumeric(v) {
+		return nil
+	}
+	if err := f.Validate(ctx, v, false, true); err != nil {
+		return fmt.Errorf("filter on %s of type %s: %w", path, f.Type, err)
+	}
+	return nil
+}
+
+func isNumericType(t BSONType) bool {
+	switch t {
+	case INT, LONG, DOUBLE, DECIMAL128:
+		return true
+	}
+	return false
+}
+
+func isNumeric(v interface{}) bool {
+	switch v.(type) {
+	case int, int32, int64, float32, float64, primitive.Decimal128:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package schema
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+type filterTest struct {
+	cmd bson.D
+	ok  bool
+}
+
+func runFilterTests(t *testing.T, conf bson.D, tests []filterTest) {
+	d := &SchemaPlugin{}
+	if err := d.Configure(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	p := plugins.BuildPipeline([]plugins.Plugin{d}, func(context.Context, *plugins.Request) (bson.D, error) {
+		return bson.D{{"ok", 1}}, nil
+	})
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			cmd, ok := command.GetCommand(test.cmd[0].Key)
+			if !ok {
+				t.Fatalf("no such command: %s", test.cmd[0].Key)
+			}
+			if err := cmd.FromBSOND(test.cmd); err != nil {
+				t.Fatal(err)
+			}
+			result, err := p(context.TODO(), &plugins.Request{CommandName: test.cmd[0].Key, Command: cmd})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok := bsonutil.Ok(result); ok != test.ok {
+				t.Fatalf("expected ok=%v, got %v", test.ok, result)
+			}
+		})
+	}
+}
+
+func TestFilterFields(t *testing.T) {
+	runFilterTests(t, bson.D{
+		{"schemaPath", "example.json"},
+		{"filterFields", "strict"},
+	}, []filterTest{
+		{bson.D{{"find", "requireonlysuba"}, {"filter", bson.D{{"doc.a", "x"}}}, {"$db", "testdb"}}, true},
+		{bson.D{{"find", "requireonlysuba"}, {"filter", bson.D{{"_id", 1}, {"doc", bson.D{{"a", "x"}}}}}, {"$db", "testdb"}}, true},
+		{bson.D{{"find", "requireonlysuba"}, {"filter", bson.D{{"doc.typo", "x"}}}, {"$db", "testdb"}}, false},
+		{bson.D{{"find", "requireonlysuba"}, {"filter", bson.D{{"$or", bson.A{bson.D{{"doc.a", "x"}}, bson.D{{"dco.a", bson.D{{"$exists", true}}}}}}}}, {"$db", "testdb"}}, false},
+		{bson.D{{"find", "nonrequire"}, {"filter", bson.D{{"luckynumbers.0", bson.D{{"$gt", 1}}}}}, {"$db", "testdb"}}, true},
+		{bson.D{{"find", "nonrequire"}, {"filter", bson.D{{"$expr", bson.D{{"$eq", bson.A{"$typo", 1}}}}}}, {"$db", "testdb"}}, true},
+		// Collections without a schema aren't validated
+		{bson.D{{"find", "unknown"}, {"filter", bson.D{{"typo", 1}}}, {"$db", "otherdb"}}, true},
+		{bson.D{{"count", "nonrequire"}, {"query", bson.D{{"age", bson.D{{"$not", bson.D{{"$gt", 1}}}}}}}, {"$db", "testdb"}}, true},
+		{bson.D{{"count", "nonrequire"}, {"query", bson.D{{"agee", 1}}}, {"$db", "testdb"}}, false},
+		{bson.D{{"distinct", "nonrequire"}, {"key", "age"}, {"query", bson.D{}}, {"$db", "testdb"}}, true},
+		{bson.D{{"distinct", "nonrequire"}, {"key", "agee"}, {"query", bson.D{}}, {"$db", "testdb"}}, false},
+		// countDocuments
+		{bson.D{{"aggregate", "nonrequire"}, {"pipeline", bson.A{
+			bson.D{{"$match", bson.D{{"agee", 1}}}},
+			bson.D{{"$group", bson.D{{"_id", 1}, {"n", bson.D{{"$sum", 1}}}}}},
+		}}, {"cursor", bson.D{}}, {"$db", "testdb"}}, false},
+	})
+}
+
+func TestFilterTypes(t *testing.T) {
+	runFilterTests(t, bson.D{
+		{"schemaPath", "example.json"},
+		{"filterTypes", "strict"},
+	}, []filterTest{
+		{bson.D{{"find", "nonrequire"}, {"filter", bson.D{{"age", 1}}}, {"$db", "testdb"}}, true},
+		{bson.D{{"find", "nonrequire"}, {"filter", bson.D{{"age", "1"}}}, {"$db", "testdb"}}, false},
+		// Numbers of any type compare by value
+		{bson.D{{"find", "nonrequire"}, {"filter", bson.D{{"age", bson.D{{"$gte", 1.5}}}}}, {"$db", "testdb"}}, true},
+		{bson.D{{"find", "nonrequire"}, {"filter", bson.D{{"age", nil}}}, {"$db", "testdb"}}, true},
+		{bson.D{{"find", "nonrequire"}, {"filter", bson.D{{"age", bson.D{{"$in", bson.A{1, "2"}}}}}}, {"$db", "testdb"}}, false},
+		{bson.D{{"find", "nonrequire"}, {"filter", bson.D{{"age", bson.D{{"$exists", true}}}}}, {"$db", "testdb"}}, true},
+		{bson.D{{"find", "nonrequire"}, {"filter", bson.D{{"luckynumbers", 7}}}, {"$db", "testdb"}}, true},
+		{bson.D{{"find", "nonrequire"}, {"filter", bson.D{{"luckynumbers", bson.A{7, 8}}}}, {"$db", "testdb"}}, true},
+		{bson.D{{"find", "nonrequire"}, {"filter", bson.D{{"luckynumbers", bson.D{{"$elemMatch", bson.D{{"$gt", "7"}}}}}}}, {"$db", "testdb"}}, false},
+		{bson.D{{"find", "bsonobject"}, {"filter", bson.D{{"object.string", 1}}}, {"$db", "testdb"}}, false},
+		// Unknown fields are left to filterFields
+		{bson.D{{"find", "nonrequire"}, {"filter", bson.D{{"typo", "1"}}}, {"$db", "testdb"}}, true},
+		{bson.D{{"update", "nonrequire"}, {"updates", bson.A{
+			bson.D{{"q", bson.D{{"age", "1"}}}, {"u", bson.D{{"$set", bson.D{{"age", 2}}}}}},
+		}}, {"$db", "testdb"}}, false},
+		{bson.D{{"delete", "nonrequire"}, {"deletes", bson.A{
+			bson.D{{"q", bson.D{{"age", 1}}}, {"limit", 1}},
+			bson.D{{"q", bson.D{{"$or", bson.A{bson.D{{"age", true}}}}}}, {"limit", 1}},
+		}}, {"$db", "testdb"}}, false},
+		{bson.D{{"findAndModify", "nonrequire"}, {"query", bson.D{{"age", "1"}}}, {"remove", true}, {"$db", "testdb"}}, false},
+	})
+}
+
+func TestStrictUpserts(t *testing.T) {
+	runFilterTests(t, bson.D{
+		{"schemaPath", "example.json"},
+		{"strictUpserts", true},
+	}, []filterTest{
+		// Required fields can come from the query, $set or $setOnInsert
+		{bson.D{{"update", "bsonint"}, {"updates", bson.A{
+			bson.D{{"q", bson.D{{"int", 1}}}, {"u", bson.D{{"$inc", bson.D{{"count", 1}}}}}, {"upsert", true}},
+		}}, {"$db", "testdb"}}, true},
+		{bson.D{{"update", "bsonint"}, {"updates", bson.A{
+			bson.D{{"q", bson.D{{"int", bson.D{{"$eq", 1}}}}}, {"u", bson.D{{"$set", bson.D{{"other", 1}}}}}, {"upsert", true}},
+		}}, {"$db", "testdb"}}, true},
+		{bson.D{{"update", "bsonint"}, {"updates", bson.A{
+			bson.D{{"q", bson.D{{"other", 1}}}, {"u", bson.D{{"$setOnInsert", bson.D{{"int", 1}}}}}, {"upsert", true}},
+		}}, {"$db", "testdb"}}, true},
+		{bson.D{{"update", "bsonint"}, {"updates", bson.A{
+			bson.D{{"q", bson.D{{"other", 1}}}, {"u", bson.D{{"$set", bson.D{{"other", 2}}}}}, {"upsert", true}},
+		}}, {"$db", "testdb"}}, false},
+		// Non-equality matches aren't inserted
+		{bson.D{{"update", "bsonint"}, {"updates", bson.A{
+			bson.D{{"q", bson.D{{"int", bson.D{{"$gt", 1}}}}}, {"u", bson.D{{"$set", bson.D{{"other", 1}}}}}, {"upsert", true}},
+		}}, {"$db", "testdb"}}, false},
+		// Updates without upsert are unaffected
+		{bson.D{{"update", "bsonint"}, {"updates", bson.A{
+			bson.D{{"q", bson.D{{"other", 1}}}, {"u", bson.D{{"$set", bson.D{{"other", 2}}}}}},
+		}}, {"$db", "testdb"}}, true},
+		// Replacements don't get the query's fields
+		{bson.D{{"update", "bsonint"}, {"updates", bson.A{
+			bson.D{{"q", bson.D{{"int", 1}}}, {"u", bson.D{{"other", 1}}}, {"upsert", true}},
+		}}, {"$db", "testdb"}}, false},
+		{bson.D{{"update", "bsonint"}, {"updates", bson.A{
+			bson.D{{"q", bson.D{{"int", 1}}}, {"u", bson.D{{"int", 1}, {"other", 1}}}, {"upsert", true}},
+		}}, {"$db", "testdb"}}, true},
+		{bson.D{{"update", "requireonlysuba"}, {"updates", bson.A{
+			bson.D{{"q", bson.D{{"doc.notrequired", "x"}}}, {"u", bson.D{{"$set", bson.D{{"doc.a", "y"}}}}}, {"upsert", true}},
+		}}, {"$db", "testdb"}}, true},
+		{bson.D{{"update", "requireonlysuba"}, {"updates", bson.A{
+			bson.D{{"q", bson.D{{"doc.notrequired", "x"}}}, {"u", bson.D{{"$unset", bson.D{{"doc.other", ""}}}}}, {"upsert", true}},
+		}}, {"$db", "testdb"}}, false},
+		{bson.D{{"findAndModify", "bsonint"}, {"query", bson.D{{"other", 1}}}, {"update", bson.D{{"$set", bson.D{{"other", 2}}}}}, {"upsert", true}, {"$db", "testdb"}}, false},
+		{bson.D{{"findAndModify", "bsonint"}, {"query", bson.D{{"$and", bson.A{bson.D{{"int", 1}}}}}}, {"update", bson.D{{"$set", bson.D{{"other", 2}}}}}, {"upsert", true}, {"$db", "testdb"}}, true},
+	})
+}
@@ -0,0 +1,168 @@
+package schema
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// geoJSONTypes are the GeoJSON type of the geospatial types
+var geoJSONTypes = map[BSONType]string{
+	GEO_POINT:       "Point",
+	GEO_LINE_STRING: "LineString",
+	GEO_POLYGON:     "Polygon",
+}
+
+// isGeoType returns whether the type is a geospatial type, whose values are
+// validated by validateGeo
+func isGeoType(t BSONType) bool {
+	_, ok := geoJSONTypes[t]
+	return ok || t == LEGACY_POINT
+}
+
+// validateGeo validates the structure and coordinate ranges of a value of a
+// geospatial type, as a 2dsphere index would at insert time
+func validateGeo(t BSONType, v interface{}) error {
+	if t == LEGACY_POINT {
+		return validateLegacyPoint(v)
+	}
+	doc, ok := v.(bson.D)
+	if !ok {
+		return fmt.Errorf("GeoJSON %s must be an object, got %T", geoJSONTypes[t], v)
+	}
+	var (
+		geoType     interface{}
+		coordinates interface{}
+	)
+	for _, e := range doc {
+		switch e.Key {
+		case "type":
+			geoType = e.Value
+		case "coordinates":
+			coordinates = e.Value
+		}
+	}
+	if geoType != geoJSONTypes[t] {
+		return fmt.Errorf("GeoJSON type must be %q, got %v", geoJSONTypes[t], geoType)
+	}
+	if coordinates == nil {
+		return fmt.Errorf("GeoJSON %s has no coordinates", geoJSONTypes[t])
+	}
+
+	switch t {
+	case GEO_POINT:
+		return validatePosition(coordinates)
+	case GEO_LINE_STRING:
+		return validatePositions(coordinates, 2, false)
+	case GEO_POLYGON:
+		rings, ok := coordinates.(primitive.A)
+		if !ok || len(rings) == 0 {
+			return fmt.Errorf("GeoJSON Polygon coordinates must be a non-empty array of rings")
+		}
+		for i, ring := range rings {
+			if err := validatePositions(ring, 4, true); err != nil {
+				return fmt.Errorf("ring %d: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validatePositions validates an array of at least min positions, which is closed
+// (its last position being its first) for the rings of polygons
+func validatePositions(v interface{}, min int, closed bool) error {
+	positions, ok := v.(primitive.A)
+	if !ok || len(positions) < min {
+		return fmt.Errorf("GeoJSON coordinates must be an array of at least %d positions", min)
+	}
+	for _, p := range positions {
+		if err := validatePosition(p); err != nil {
+			return err
+		}
+	}
+	if closed {
+		first, last := positions[0].(primitive.A), positions[len(positions)-1].(primitive.A)
+		if !sameCoordinate(first[0], last[0]) || !sameCoordinate(first[1], last[1]) {
+			return fmt.Errorf("GeoJSON ring must be closed (end with its first position)")
+		}
+	}
+	return nil
+}
+
+// validatePosition validates a GeoJSON position: [longitude, latitude] with an
+// optional altitude
+func validatePosition(v interface{}) error {
+	position, ok := v.(primitive.A)
+	if !ok || len(position) < 2 || len(position) > 3 {
+		return fmt.Errorf("GeoJSON position must be an array of [longitude, latitude], got %v", v)
+	}
+	for _, c := range position {
+		if _, ok := toFloat(c); !ok {
+			return fmt.Errorf("GeoJSON position must be numbers, got %T", c)
+		}
+	}
+	longitude, _ := toFloat(position[0])
+	latitude, _ := toFloat(position[1])
+	return validateCoordinates(longitude, latitude)
+}
+
+// validateLegacyPoint validates a legacy coordinate pair: an array of two numbers
+// or an object of two numeric fields, the longitude first
+func validateLegacyPoint(v interface{}) error {
+	var pair []interface{}
+	switch v := v.(type) {
+	case primitive.A:
+		pair = v
+	case bson.D:
+		for _, e := range v {
+			pair = append(pair, e.Value)
+		}
+	default:
+		return fmt.Errorf("legacy coordinate pair must be an array or object, got %T", v)
+	}
+	if len(pair) != 2 {
+		return fmt.Errorf("legacy coordinate pair must have 2 coordinates, got %d", len(pair))
+	}
+	for _, c := range pair {
+		if _, ok := toFloat(c); !ok {
+			return fmt.Errorf("legacy coordinate pair must be numbers, got %T", c)
+		}
+	}
+	longitude, _ := toFloat(pair[0])
+	latitude, _ := toFloat(pair[1])
+	return validateCoordinates(longitude, latitude)
+}
+
+func validateCoordinates(longitude, latitude float64) error {
+	if longitude < -180 || longitude > 180 {
+		return fmt.Errorf("longitude %v out of range [-180, 180]", longitude)
+	}
+	if latitude < -90 || latitude > 90 {
+		return fmt.Errorf("latitude %v out of range [-90, 90]", latitude)
+	}
+	return nil
+}
+
+func sameCoordinate(a, b interface{}) bool {
+	x, _ := toFloat(a)
+	y, _ := toFloat(b)
+	return x == y
+}
+
+// toFloat returns the number as a float64, or false if it isn't one
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
@@ -0,0 +1,90 @@
+package schema
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const geoSchema = `{
+	"dbs": {
+		"maps": {
+			"collections": {
+				"places": {
+					"enforceSchema": true,
+					"fields": {
+						"location": {"type": "geoPoint", "required": true},
+						"route": {"type": "geoLineString"},
+						"area": {"type": "geoPolygon"},
+						"legacy": {"type": "legacyPoint"}
+					}
+				}
+			}
+		}
+	}
+}`
+
+func point(lng, lat interface{}) bson.D {
+	return bson.D{{"type", "Point"}, {"coordinates", bson.A{lng, lat}}}
+}
+
+func TestGeoTypes(t *testing.T) {
+	var schema ClusterSchema
+	if err := json.Unmarshal([]byte(geoSchema), &schema); err != nil {
+		t.Fatal(err)
+	}
+	if errs := schema.Lint(); len(errs) > 0 {
+		t.Fatalf("unexpected lint errors: %v", errs)
+	}
+	schema.setShapeCaches(100)
+
+	square := bson.A{bson.A{0, 0}, bson.A{1, 0}, bson.A{1, 1}, bson.A{0, 0}}
+	tests := []struct {
+		doc bson.D
+		err bool
+	}{
+		{doc: bson.D{{"location", point(-122.4, 37.8)}}},
+		{doc: bson.D{{"location", bson.D{{"type", "Point"}, {"coordinates", bson.A{int32(10), int32(20), 100.5}}}}}},
+		// The shape of a valid document doesn't make its values valid
+		{doc: bson.D{{"location", point(-222.4, 37.8)}}, err: true},
+		{doc: bson.D{{"location", point(10.0, 91.0)}}, err: true},
+		{doc: bson.D{{"location", point("10", 20)}}, err: true},
+		{doc: bson.D{{"location", bson.D{{"type", "Point"}, {"coordinates", bson.A{10}}}}}, err: true},
+		{doc: bson.D{{"location", bson.D{{"type", "LineString"}, {"coordinates", bson.A{10, 20}}}}}, err: true},
+		{doc: bson.D{{"location", bson.D{{"type", "Point"}}}}, err: true},
+		{doc: bson.D{{"location", bson.A{10, 20}}}, err: true},
+		{doc: bson.D{{"location", point(1, 2)}, {"route", bson.D{{"type", "LineString"}, {"coordinates", bson.A{bson.A{0, 0}, bson.A{1, 1}}}}}}},
+		{doc: bson.D{{"location", point(1, 2)}, {"route", bson.D{{"type", "LineString"}, {"coordinates", bson.A{bson.A{0, 0}}}}}}, err: true},
+		{doc: bson.D{{"location", point(1, 2)}, {"area", bson.D{{"type", "Polygon"}, {"coordinates", bson.A{square}}}}}},
+		// Rings must be closed
+		{doc: bson.D{{"location", point(1, 2)}, {"area", bson.D{{"type", "Polygon"}, {"coordinates", bson.A{square[:3]}}}}}, err: true},
+		{doc: bson.D{{"location", point(1, 2)}, {"area", bson.D{{"type", "Polygon"}, {"coordinates", bson.A{bson.A{bson.A{0, 0}, bson.A{1, 0}, bson.A{1, 1}, bson.A{0, 1}}}}}}}, err: true},
+		{doc: bson.D{{"location", point(1, 2)}, {"legacy", bson.A{-73.9, 40.7}}}},
+		{doc: bson.D{{"location", point(1, 2)}, {"legacy", bson.D{{"lng", -73.9}, {"lat", 40.7}}}}},
+		{doc: bson.D{{"location", point(1, 2)}, {"legacy", bson.A{-73.9, 140.7}}}, err: true},
+		{doc: bson.D{{"location", point(1, 2)}, {"legacy", bson.A{-73.9}}}, err: true},
+	}
+	for i, test := range tests {
+		err := schema.ValidateInsert(context.TODO(), "maps", "places", test.doc)
+		if (err != nil) != test.err {
+			t.Fatalf("insert %d: expected err=%v, got %v", i, test.err, err)
+		}
+	}
+
+	updates := []struct {
+		u   bson.D
+		err bool
+	}{
+		{u: bson.D{{"$set", bson.D{{"location", point(1, 2)}}}}},
+		{u: bson.D{{"$set", bson.D{{"location", point(1, 200)}}}}, err: true},
+		{u: bson.D{{"$set", bson.D{{"legacy", bson.A{1, 2, 3}}}}}, err: true},
+	}
+	for i, test := range updates {
+		err := schema.ValidateUpdate(context.TODO(), "maps", "places", test.u, false)
+		if (err != nil) != test.err {
+			t.Fatalf("update %d: expected err=%v, got %v", i, test.err, err)
+		}
+	}
+}
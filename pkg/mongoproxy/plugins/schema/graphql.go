@@ -0,0 +1,833 @@
+package schema
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/graphql"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+var graphQLQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mongoproxy_plugins_schema_graphql_queries_total",
+	Help: "The total GraphQL queries of collections by result",
+}, []string{"db", "collection", "result"})
+
+// graphQLScalars are the GraphQL types of the BSON types; the other types (e.g.
+// geospatial types, and objects without subfields) are JSON
+var graphQLScalars = map[BSONType]string{
+	INT:        "Int",
+	LONG:       "Long",
+	DOUBLE:     "Float",
+	STRING:     "String",
+	BOOL:       "Boolean",
+	OBJECT_ID:  "ObjectID",
+	DATE:       "Date",
+	DECIMAL128: "Decimal",
+	BIN_DATA:   "BinData",
+}
+
+// graphQLCustomScalars describe the scalars which aren't built into GraphQL
+var graphQLCustomScalars = [][2]string{
+	{"BinData", "Base64 encoded binary data"},
+	{"Date", "RFC 3339 date"},
+	{"Decimal", "128-bit decimal, as a string"},
+	{"JSON", "Any value, as relaxed extended JSON"},
+	{"Long", "64-bit integer"},
+	{"ObjectID", "Hex encoded ObjectId"},
+}
+
+// graphQLFindArgs are the arguments of the queries of documents, besides the
+// equality arguments of their collection's fields
+var graphQLFindArgs = []string{"filter: JSON", "sort: [String!]", "skip: Int", "limit: Int"}
+
+// graphQLSchema is the GraphQL schema generated from the collection schemas
+type graphQLSchema struct {
+	queries map[string]*graphQLQuery
+	types   map[string]*graphQLType
+	sdl     string
+}
+
+// graphQLQuery is a field of the Query type: the documents of a collection, or
+// their count
+type graphQLQuery struct {
+	name           string
+	db, collection string
+	count          bool
+	typ            *graphQLType
+	// args are the equality arguments: the collection's top-level scalar fields
+	args map[string]*graphQLField
+}
+
+type graphQLType struct {
+	name   string
+	fields map[string]*graphQLField
+}
+
+type graphQLField struct {
+	name string
+	list bool
+	// scalar is the type of scalar fields and object that of objects
+	scalar string
+	object *graphQLType
+}
+
+func (f *graphQLField) typeName() string {
+	t := f.scalar
+	if f.object != nil {
+		t = f.object.name
+	}
+	if f.list {
+		t = "[" + t + "]"
+	}
+	return t
+}
+
+// graphQLName returns the name as a GraphQL name, replacing the characters which
+// aren't allowed with _
+func graphQLName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 || (b[0] >= '0' && b[0] <= '9') {
+		b = append([]byte{'_'}, b...)
+	}
+	return string(b)
+}
+
+// newGraphQLSchema generates the GraphQL schema of the collections: the query
+// <db>_<collection> of each collection's documents and <db>_<collection>_count of
+// their count, typed by its fields. Fields whose names aren't GraphQL names are
+// left out.
+func newGraphQLSchema(s *ClusterSchema) *graphQLSchema {
+	g := &graphQLSchema{
+		queries: make(map[string]*graphQLQuery),
+		types:   make(map[string]*graphQLType),
+	}
+	collections := make(map[string]*graphQLType)
+	for _, dbName := range sortedKeys(s.Databases) {
+		for _, collName := range sortedCollectionKeys(s.Databases[dbName].Collections) {
+			typ := g.collectionType(s, collections, dbName+"."+collName)
+			args := make(map[string]*graphQLField)
+			for name, f := range typ.fields {
+				switch name {
+				case "filter", "sort", "skip", "limit":
+					continue
+				}
+				if !f.list && f.object == nil && f.scalar != "JSON" {
+					args[name] = f
+				}
+			}
+
+			name := graphQLName(dbName) + "_" + graphQLName(collName)
+			for _, q := range []*graphQLQuery{{name: name}, {name: name + "_count", count: true}} {
+				if _, ok := g.queries[q.name]; ok {
+					logrus.Warnf("GraphQL query %s of %s.%s is already defined, skipping", q.name, dbName, collName)
+					continue
+				}
+				q.db, q.collection, q.typ, q.args = dbName, collName, typ, args
+				g.queries[q.name] = q
+			}
+		}
+	}
+	g.sdl = g.printSDL(s.version)
+	return g
+}
+
+// typeName reserves a unique type name for the name
+func (g *graphQLSchema) typeName(name string) string {
+	name = strings.ToUpper(name[:1]) + name[1:]
+	unique := name
+	for i := 2; g.types[unique] != nil; i++ {
+		unique = fmt.Sprintf("%s_%d", name, i)
+	}
+	g.types[unique] = &graphQLType{name: unique}
+	return unique
+}
+
+// collectionType returns the type of the documents of the collection, which
+// have an _id (an ID unless the schema types it)
+func (g *graphQLSchema) collectionType(s *ClusterSchema, collections map[string]*graphQLType, ns string) *graphQLType {
+	if typ, ok := collections[ns]; ok {
+		return typ
+	}
+	parts := strings.SplitN(ns, ".", 2)
+	typ := g.types[g.typeName(graphQLName(parts[0])+"_"+graphQLName(parts[1]))]
+	// The type is known before its fields, as collections can reference themselves
+	collections[ns] = typ
+	var fields map[string]CollectionField
+	if len(parts) == 2 {
+		fields = s.Databases[parts[0]].Collections[parts[1]].Fields
+	}
+	typ.fields = g.fields(s, collections, typ.name, fields)
+	if _, ok := typ.fields["_id"]; !ok {
+		typ.fields["_id"] = &graphQLField{name: "_id", scalar: "ID"}
+	}
+	return typ
+}
+
+// objectType returns the type of objects with the fields, nil if none of them
+// has a GraphQL name
+func (g *graphQLSchema) objectType(s *ClusterSchema, collections map[string]*graphQLType, name string, fields map[string]CollectionField) *graphQLType {
+	typ := g.types[g.typeName(name)]
+	if typ.fields = g.fields(s, collections, typ.name, fields); len(typ.fields) == 0 {
+		delete(g.types, typ.name)
+		return nil
+	}
+	return typ
+}
+
+func (g *graphQLSchema) fields(s *ClusterSchema, collections map[string]*graphQLType, typeName string, fields map[string]CollectionField) map[string]*graphQLField {
+	ret := make(map[string]*graphQLField, len(fields))
+	for name, f := range fields {
+		if !graphql.IsName(name) || strings.HasPrefix(name, "__") {
+			continue
+		}
+		field := &graphQLField{name: name, list: f.IsArray || strings.HasPrefix(string(f.Type), "[]")}
+		elem := elementType(f.Type)
+		switch ref := fieldRef(f.Type); {
+		case ref != "":
+			field.object = g.collectionType(s, collections, ref)
+		case elem == OBJECT && len(f.SubFields) > 0:
+			field.object = g.objectType(s, collections, typeName+"_"+name, f.SubFields)
+		}
+		if field.object == nil {
+			if field.scalar = graphQLScalars[elem]; field.scalar == "" {
+				field.scalar = "JSON"
+			}
+		}
+		ret[name] = field
+	}
+	return ret
+}
+
+// printSDL returns the schema in the GraphQL schema definition language
+func (g *graphQLSchema) printSDL(version string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# Generated from the collection schemas (version %s)\n\n", version)
+	for _, scalar := range graphQLCustomScalars {
+		fmt.Fprintf(&sb, "\"%s\"\nscalar %s\n\n", scalar[1], scalar[0])
+	}
+
+	sb.WriteString("type Query {\n")
+	names := make([]string, 0, len(g.queries))
+	for name := range g.queries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		q := g.queries[name]
+		var args []string
+		if q.count {
+			args = append(args, graphQLFindArgs[0])
+		} else {
+			args = append(args, graphQLFindArgs...)
+		}
+		for _, arg := range sortedGraphQLFields(q.args) {
+			args = append(args, arg.name+": "+arg.typeName())
+		}
+		if q.count {
+			fmt.Fprintf(&sb, "  %s(%s): Int!\n", name, strings.Join(args, ", "))
+		} else {
+			fmt.Fprintf(&sb, "  %s(%s): [%s!]!\n", name, strings.Join(args, ", "), q.typ.name)
+		}
+	}
+	sb.WriteString("}\n")
+
+	names = names[:0]
+	for name := range g.types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&sb, "\ntype %s {\n", name)
+		for _, f := range sortedGraphQLFields(g.types[name].fields) {
+			fmt.Fprintf(&sb, "  %s: %s\n", f.name, f.typeName())
+		}
+		sb.WriteString("}\n")
+	}
+	return sb.String()
+}
+
+func sortedGraphQLFields(fields map[string]*graphQLField) []*graphQLField {
+	sorted := make([]*graphQLField, 0, len(fields))
+	for _, f := range fields {
+		sorted = append(sorted, f)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+	return sorted
+}
+
+// GraphQLSchema returns the GraphQL schema generated from the collection
+// schemas, if graphQL is enabled
+func (p *SchemaPlugin) GraphQLSchema() (string, bool) {
+	schema := p.GetSchema()
+	if schema == nil || schema.graphQL == nil {
+		return "", false
+	}
+	return schema.graphQL.sdl, true
+}
+
+// ResolveGraphQL answers the query with the collections' documents, with a find
+// (projecting the selected fields) or, for counts, an aggregate of each field of
+// the query. The whole query is validated before any command is run.
+func (p *SchemaPlugin) ResolveGraphQL(ctx context.Context, req *graphql.Request, cr plugins.CommandRunner, maxLimit int64) *graphql.Response {
+	schema := p.GetSchema()
+	if schema == nil || schema.graphQL == nil {
+		resp := &graphql.Response{}
+		resp.Errorf(nil, "GraphQL is not enabled")
+		return resp
+	}
+	return schema.graphQL.resolve(ctx, req, cr, maxLimit)
+}
+
+func (g *graphQLSchema) resolve(ctx context.Context, req *graphql.Request, cr plugins.CommandRunner, maxLimit int64) *graphql.Response {
+	resp := &graphql.Response{}
+	doc, err := graphql.Parse(req.Query)
+	if err != nil {
+		resp.Errorf(nil, "%v", err)
+		return resp
+	}
+	op, err := doc.Operation(req.OperationName)
+	if err != nil {
+		resp.Errorf(nil, "%v", err)
+		return resp
+	}
+	vars, err := op.CoerceVariables(req.Variables)
+	if err != nil {
+		resp.Errorf(nil, "%v", err)
+		return resp
+	}
+	fields, err := doc.CollectFields(op.SelectionSet, "Query", vars)
+	if err != nil {
+		resp.Errorf(nil, "%v", err)
+		return resp
+	}
+
+	plans := make([]*graphQLPlan, 0, len(fields))
+	for _, f := range fields {
+		plan, err := g.plan(doc, f, vars, maxLimit)
+		if err != nil {
+			resp.Errorf(nil, "%v", err)
+			continue
+		}
+		plans = append(plans, plan)
+	}
+	if len(resp.Errors) > 0 {
+		return resp
+	}
+
+	data := make(graphql.Object, 0, len(plans))
+	for _, plan := range plans {
+		v, gErr := plan.run(ctx, cr)
+		if gErr != nil {
+			gErr.Path = []interface{}{plan.key}
+			resp.Errors = append(resp.Errors, *gErr)
+		}
+		data = append(data, graphql.ObjectField{Key: plan.key, Value: v})
+	}
+	resp.Data = &data
+	return resp
+}
+
+// graphQLPlan is the command answering a field of the query
+type graphQLPlan struct {
+	key string
+	// query is nil for __typename
+	query *graphQLQuery
+	cmd   bson.D
+	sel   *graphQLSelection
+}
+
+func isNull(raw json.RawMessage) bool {
+	return strings.TrimSpace(string(raw)) == "null"
+}
+
+func (g *graphQLSchema) plan(doc *graphql.Document, f *graphql.Field, vars map[string]json.RawMessage, maxLimit int64) (*graphQLPlan, error) {
+	plan := &graphQLPlan{key: f.ResponseKey()}
+	if f.Name == "__typename" {
+		if len(f.Arguments) > 0 || len(f.SelectionSet) > 0 {
+			return nil, fmt.Errorf(`field "__typename" has no arguments nor subfields`)
+		}
+		return plan, nil
+	}
+	if f.Name == "__schema" || f.Name == "__type" {
+		return nil, fmt.Errorf("introspection is not supported, the schema is served by GET /v1/graphql/schema")
+	}
+	q, ok := g.queries[f.Name]
+	if !ok {
+		return nil, fmt.Errorf(`cannot query field "%s" on type "Query"`, f.Name)
+	}
+	plan.query = q
+
+	filter := bson.D{}
+	var userFilter, sortKeys bson.D
+	var skip, limit int64
+	for _, arg := range f.Arguments {
+		raw, err := graphql.ValueJSON(arg.Value, vars)
+		if err != nil {
+			return nil, err
+		}
+		if isNull(raw) {
+			continue
+		}
+		switch arg.Name {
+		case "filter":
+			// The filter is an object, or a string of extended JSON
+			var s string
+			if json.Unmarshal(raw, &s) == nil {
+				raw = json.RawMessage(s)
+			}
+			if err := bson.UnmarshalExtJSON(raw, false, &userFilter); err != nil {
+				return nil, fmt.Errorf("invalid filter of %s: %v", f.Name, err)
+			}
+			continue
+		case "sort", "skip", "limit":
+			if q.count {
+				break
+			}
+			var err error
+			switch arg.Name {
+			case "sort":
+				sortKeys, err = graphQLSort(raw)
+			case "skip":
+				err = json.Unmarshal(raw, &skip)
+			case "limit":
+				err = json.Unmarshal(raw, &limit)
+			}
+			if err != nil || skip < 0 || limit < 0 {
+				return nil, fmt.Errorf("invalid %s of %s: %s", arg.Name, f.Name, raw)
+			}
+			continue
+		}
+		field, ok := q.args[arg.Name]
+		if !ok {
+			return nil, fmt.Errorf(`unknown argument "%s" on field "Query.%s"`, arg.Name, f.Name)
+		}
+		v, err := graphQLArgument(field, raw)
+		if err != nil {
+			return nil, err
+		}
+		filter = append(filter, bson.E{Key: field.name, Value: v})
+	}
+	if userFilter != nil {
+		if len(filter) == 0 {
+			filter = userFilter
+		} else {
+			filter = bson.D{{"$and", bson.A{filter, userFilter}}}
+		}
+	}
+
+	if q.count {
+		if len(f.SelectionSet) > 0 {
+			return nil, fmt.Errorf(`field "%s" of type "Int!" must not have a selection`, f.Name)
+		}
+		plan.cmd = bson.D{
+			{"aggregate", q.collection},
+			{"pipeline", bson.A{bson.D{{"$match", filter}}, bson.D{{"$count", "n"}}}},
+			{"cursor", bson.D{}},
+		}
+		return plan, nil
+	}
+
+	if len(f.SelectionSet) == 0 {
+		return nil, fmt.Errorf(`field "%s" of type "[%s!]!" must have a selection of subfields`, f.Name, q.typ.name)
+	}
+	sel, err := g.selection(doc, q.typ, f.SelectionSet, vars)
+	if err != nil {
+		return nil, err
+	}
+	plan.sel = sel
+	if limit == 0 || limit > maxLimit {
+		limit = maxLimit
+	}
+	plan.cmd = bson.D{{"find", q.collection}, {"filter", filter}, {"projection", sel.projection()}}
+	if sortKeys != nil {
+		plan.cmd = append(plan.cmd, bson.E{"sort", sortKeys})
+	}
+	if skip > 0 {
+		plan.cmd = append(plan.cmd, bson.E{"skip", skip})
+	}
+	// A single batch closes the cursor, so none is left open on the backend
+	plan.cmd = append(plan.cmd, bson.E{"limit", limit}, bson.E{"batchSize", limit}, bson.E{"singleBatch", true})
+	return plan, nil
+}
+
+// graphQLSort returns the sort of the field names, descending for the names
+// prefixed with -
+func graphQLSort(raw json.RawMessage) (bson.D, error) {
+	var names []string
+	if err := json.Unmarshal(raw, &names); err != nil {
+		return nil, err
+	}
+	sortKeys := make(bson.D, 0, len(names))
+	for _, name := range names {
+		dir := 1
+		if strings.HasPrefix(name, "-") {
+			name, dir = name[1:], -1
+		}
+		if name == "" {
+			return nil, fmt.Errorf("empty sort field")
+		}
+		sortKeys = append(sortKeys, bson.E{name, dir})
+	}
+	return sortKeys, nil
+}
+
+// graphQLArgument returns the value of an equality argument of the field
+func graphQLArgument(f *graphQLField, raw json.RawMessage) (interface{}, error) {
+	var (
+		v   interface{}
+		s   string
+		err error
+	)
+	switch f.scalar {
+	case "Int":
+		var n int32
+		v, err = &n, json.Unmarshal(raw, &n)
+	case "Long":
+		var n int64
+		v, err = &n, json.Unmarshal(raw, &n)
+	case "Float":
+		var n float64
+		v, err = &n, json.Unmarshal(raw, &n)
+	case "Boolean":
+		var b bool
+		v, err = &b, json.Unmarshal(raw, &b)
+	case "String":
+		v, err = &s, json.Unmarshal(raw, &s)
+	case "ID":
+		// IDs are strings (ObjectIDs if they're hex encoded ObjectIDs) or ints
+		var n int64
+		if json.Unmarshal(raw, &n) == nil {
+			return n, nil
+		}
+		if err = json.Unmarshal(raw, &s); err == nil {
+			if oid, err := primitive.ObjectIDFromHex(s); err == nil {
+				return oid, nil
+			}
+			return s, nil
+		}
+	case "ObjectID":
+		if err = json.Unmarshal(raw, &s); err == nil {
+			v, err = primitive.ObjectIDFromHex(s)
+		}
+	case "Date":
+		if err = json.Unmarshal(raw, &s); err == nil {
+			var t time.Time
+			if t, err = time.Parse(time.RFC3339Nano, s); err == nil {
+				v = primitive.NewDateTimeFromTime(t)
+			}
+		}
+	case "Decimal":
+		if err = json.Unmarshal(raw, &s); err == nil {
+			v, err = primitive.ParseDecimal128(s)
+		}
+	case "BinData":
+		if err = json.Unmarshal(raw, &s); err == nil {
+			var b []byte
+			if b, err = base64.StdEncoding.DecodeString(s); err == nil {
+				v = primitive.Binary{Data: b}
+			}
+		}
+	default:
+		err = fmt.Errorf("unsupported type")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value of argument %s: %s", f.scalar, f.name, raw)
+	}
+	switch v := v.(type) {
+	case *int32:
+		return *v, nil
+	case *int64:
+		return *v, nil
+	case *float64:
+		return *v, nil
+	case *bool:
+		return *v, nil
+	case *string:
+		return *v, nil
+	}
+	return v, nil
+}
+
+// graphQLSelection is the selection of fields of an object type
+type graphQLSelection struct {
+	typ    *graphQLType
+	fields []graphQLSelected
+}
+
+type graphQLSelected struct {
+	key string
+	// field is nil for __typename
+	field *graphQLField
+	// sel is the selection of the subfields of object fields
+	sel *graphQLSelection
+}
+
+func (g *graphQLSchema) selection(doc *graphql.Document, typ *graphQLType, set graphql.SelectionSet, vars map[string]json.RawMessage) (*graphQLSelection, error) {
+	fields, err := doc.CollectFields(set, typ.name, vars)
+	if err != nil {
+		return nil, err
+	}
+	sel := &graphQLSelection{typ: typ}
+	for _, f := range fields {
+		if len(f.Arguments) > 0 {
+			return nil, fmt.Errorf(`field "%s.%s" has no arguments`, typ.name, f.Name)
+		}
+		selected := graphQLSelected{key: f.ResponseKey()}
+		if f.Name != "__typename" {
+			if selected.field = typ.fields[f.Name]; selected.field == nil {
+				return nil, fmt.Errorf(`cannot query field "%s" on type "%s"`, f.Name, typ.name)
+			}
+		}
+		switch {
+		case selected.field != nil && selected.field.object != nil:
+			if len(f.SelectionSet) == 0 {
+				return nil, fmt.Errorf(`field "%s.%s" of type "%s" must have a selection of subfields`, typ.name, f.Name, selected.field.typeName())
+			}
+			if selected.sel, err = g.selection(doc, selected.field.object, f.SelectionSet, vars); err != nil {
+				return nil, err
+			}
+		case len(f.SelectionSet) > 0:
+			return nil, fmt.Errorf(`field "%s.%s" must not have a selection`, typ.name, f.Name)
+		}
+		sel.fields = append(sel.fields, selected)
+	}
+	return sel, nil
+}
+
+// projection returns the projection of the selected fields; the _id is only
+// returned if it's selected
+func (s *graphQLSelection) projection() bson.D {
+	var paths []string
+	s.paths("", &paths)
+	sort.Strings(paths)
+
+	projection := bson.D{}
+	projected := make(map[string]struct{}, len(paths))
+	id := false
+paths:
+	for _, path := range paths {
+		// Paths must not collide with their parents (e.g. a and a.b), which sort
+		// before them
+		for i := range path {
+			if path[i] == '.' {
+				if _, ok := projected[path[:i]]; ok {
+					continue paths
+				}
+			}
+		}
+		if _, ok := projected[path]; ok {
+			continue
+		}
+		projected[path] = struct{}{}
+		projection = append(projection, bson.E{path, 1})
+		id = id || path == "_id"
+	}
+	switch {
+	case len(projection) == 0:
+		projection = bson.D{{"_id", 1}}
+	case !id:
+		projection = append(projection, bson.E{"_id", 0})
+	}
+	return projection
+}
+
+func (s *graphQLSelection) paths(prefix string, paths *[]string) {
+	for _, f := range s.fields {
+		if f.field == nil {
+			continue
+		}
+		path := prefix + f.field.name
+		if f.sel != nil && f.sel.hasFields() {
+			f.sel.paths(path+".", paths)
+		} else {
+			*paths = append(*paths, path)
+		}
+	}
+}
+
+// hasFields returns whether fields other than __typename are selected
+func (s *graphQLSelection) hasFields() bool {
+	for _, f := range s.fields {
+		if f.field != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// value returns the selected fields of the document
+func (s *graphQLSelection) value(doc bson.D) graphql.Object {
+	obj := make(graphql.Object, 0, len(s.fields))
+	for _, f := range s.fields {
+		var v interface{} = s.typ.name
+		if f.field != nil {
+			v = nil
+			for _, e := range doc {
+				if e.Key == f.field.name {
+					v = f.value(e.Value)
+					break
+				}
+			}
+		}
+		obj = append(obj, graphql.ObjectField{Key: f.key, Value: v})
+	}
+	return obj
+}
+
+func (f *graphQLSelected) value(v interface{}) interface{} {
+	if !f.field.list || v == nil {
+		return f.item(v)
+	}
+	a, ok := v.(primitive.A)
+	if !ok {
+		a = primitive.A{v}
+	}
+	list := make([]interface{}, len(a))
+	for i, item := range a {
+		list[i] = f.item(item)
+	}
+	return list
+}
+
+func (f *graphQLSelected) item(v interface{}) interface{} {
+	if f.sel == nil {
+		return graphQLScalar(f.field.scalar, v)
+	}
+	if d, ok := v.(bson.D); ok {
+		return f.sel.value(d)
+	}
+	return nil
+}
+
+// graphQLScalar returns the value of a scalar field; values of another type than
+// the field's are returned as their own type
+func graphQLScalar(scalar string, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	if scalar == "JSON" {
+		return extJSONValue(v)
+	}
+	switch v := v.(type) {
+	case primitive.ObjectID:
+		return v.Hex()
+	case primitive.DateTime:
+		return v.Time().UTC().Format(time.RFC3339Nano)
+	case primitive.Decimal128:
+		return v.String()
+	case primitive.Binary:
+		return base64.StdEncoding.EncodeToString(v.Data)
+	case string, bool, int32, int64:
+		if scalar == "ID" {
+			return fmt.Sprint(v)
+		}
+		return v
+	case float64:
+		if scalar == "ID" {
+			return fmt.Sprint(v)
+		}
+		if !math.IsNaN(v) && !math.IsInf(v, 0) {
+			return v
+		}
+	}
+	if scalar == "ID" {
+		return string(extJSONValue(v))
+	}
+	return extJSONValue(v)
+}
+
+// extJSONValue returns the value as relaxed extended JSON
+func extJSONValue(v interface{}) json.RawMessage {
+	b, err := bson.MarshalExtJSON(bson.D{{"v", v}}, false, false)
+	if err != nil {
+		return nil
+	}
+	var wrapper struct {
+		V json.RawMessage `json:"v"`
+	}
+	if err := json.Unmarshal(b, &wrapper); err != nil {
+		return nil
+	}
+	return wrapper.V
+}
+
+// run runs the command of the plan, returning the value of its field
+func (p *graphQLPlan) run(ctx context.Context, cr plugins.CommandRunner) (interface{}, *graphql.Error) {
+	if p.query == nil {
+		return "Query", nil
+	}
+	v, gErr := p.runCommand(ctx, cr)
+	result := "ok"
+	if gErr != nil {
+		result = "error"
+	}
+	graphQLQueries.WithLabelValues(p.query.db, p.query.collection, result).Inc()
+	return v, gErr
+}
+
+func (p *graphQLPlan) runCommand(ctx context.Context, cr plugins.CommandRunner) (interface{}, *graphql.Error) {
+	if cr == nil {
+		return nil, &graphql.Error{Message: "no backend to run the query on"}
+	}
+	resp, err := cr.RunCommand(ctx, p.query.db, p.cmd)
+	if err != nil {
+		return nil, &graphql.Error{Message: err.Error()}
+	}
+	var result struct {
+		Ok       float64 `bson:"ok"`
+		Errmsg   string  `bson:"errmsg"`
+		Code     int32   `bson:"code"`
+		CodeName string  `bson:"codeName"`
+		Cursor   struct {
+			FirstBatch []bson.D `bson:"firstBatch"`
+		} `bson:"cursor"`
+	}
+	b, err := bson.Marshal(resp)
+	if err == nil {
+		err = bson.Unmarshal(b, &result)
+	}
+	if err != nil {
+		return nil, &graphql.Error{Message: "invalid response: " + err.Error()}
+	}
+	if result.Ok != 1 {
+		return nil, &graphql.Error{
+			Message:    result.Errmsg,
+			Extensions: map[string]interface{}{"code": result.Code, "codeName": result.CodeName},
+		}
+	}
+
+	if p.query.count {
+		if len(result.Cursor.FirstBatch) == 0 {
+			return 0, nil
+		}
+		for _, e := range result.Cursor.FirstBatch[0] {
+			if e.Key == "n" {
+				return e.Value, nil
+			}
+		}
+		return 0, nil
+	}
+	list := make([]interface{}, len(result.Cursor.FirstBatch))
+	for i, doc := range result.Cursor.FirstBatch {
+		list[i] = p.sel.value(doc)
+	}
+	return list, nil
+}
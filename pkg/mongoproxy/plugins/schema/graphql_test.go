@@ -0,0 +1,161 @@
+package schema
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/graphql"
+)
+
+func TestGraphQL(t *testing.T) {
+	var s ClusterSchema
+	if err := json.Unmarshal([]byte(`{"dbs": {"db": {"collections": {
+		"users": {"fields": {
+			"name": {"type": "string"},
+			"age": {"type": "int"},
+			"address": {"type": "object", "subfields": {"city": {"type": "string"}, "geo": {"type": "point"}}},
+			"orders": {"type": "[]db.orders"},
+			"created": {"type": "date"},
+			"bad-name": {"type": "string"}
+		}},
+		"orders": {"fields": {"total": {"type": "double"}, "user": {"type": "db.users"}}}
+	}}}}`), &s); err != nil {
+		t.Fatal(err)
+	}
+	s.version = "1"
+	s.graphQL = newGraphQLSchema(&s)
+	p := &SchemaPlugin{}
+	p.s.Store(&s)
+
+	sdl, ok := p.GraphQLSchema()
+	if !ok {
+		t.Fatal("expected a GraphQL schema")
+	}
+	for _, line := range []string{
+		"db_users(filter: JSON, sort: [String!], skip: Int, limit: Int, _id: ID, age: Int, created: Date, name: String): [Db_users!]!",
+		"db_users_count(filter: JSON, _id: ID, age: Int, created: Date, name: String): Int!",
+		"type Db_users_address {\n  city: String\n  geo: JSON\n}",
+		"  orders: [Db_orders]\n",
+		"  user: Db_users\n",
+	} {
+		if !strings.Contains(sdl, line) {
+			t.Fatalf("expected %q in the schema:\n%s", line, sdl)
+		}
+	}
+	if strings.Contains(sdl, "bad") {
+		t.Fatalf("expected fields with invalid names to be left out:\n%s", sdl)
+	}
+
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	oid := primitive.NewObjectID()
+	var cmds []bson.D
+	cr := runCommandFunc(func(db string, cmd bson.D) (bson.D, error) {
+		cmds = append(cmds, cmd)
+		if cmd[0].Value == "orders" {
+			return bson.D{{"ok", 0}, {"errmsg", "unauthorized"}, {"code", 13}, {"codeName", "Unauthorized"}}, nil
+		}
+		switch cmd[0].Key {
+		case "find":
+			return bson.D{{"ok", 1}, {"cursor", bson.D{{"firstBatch", primitive.A{
+				bson.D{{"_id", oid}, {"address", bson.D{{"city", "Paris"}}}, {"created", primitive.NewDateTimeFromTime(created)}, {"orders", primitive.A{bson.D{{"total", 1.5}}}}},
+			}}, {"id", int64(0)}}}}, nil
+		case "aggregate":
+			return bson.D{{"ok", 1}, {"cursor", bson.D{{"firstBatch", primitive.A{bson.D{{"n", int32(3)}}}}, {"id", int64(0)}}}}, nil
+		}
+		return nil, nil
+	})
+
+	tests := []struct {
+		query string
+		vars  map[string]json.RawMessage
+		cmds  []bson.D
+		resp  string
+	}{
+		{
+			query: `query($age: Int, $filter: JSON) {
+				users: db_users(age: $age, filter: $filter, sort: ["-age", "name"], limit: 5000) {
+					__typename id: _id address { city } created orders { total }
+				}
+				n: db_users_count(name: "a")
+				__typename
+			}`,
+			vars: map[string]json.RawMessage{"age": json.RawMessage("30"), "filter": json.RawMessage(`{"name": {"$regex": "^a"}}`)},
+			cmds: []bson.D{
+				{
+					{"find", "users"},
+					{"filter", bson.D{{"$and", bson.A{bson.D{{"age", int32(30)}}, bson.D{{"name", bson.D{{"$regex", "^a"}}}}}}}},
+					{"projection", bson.D{{"_id", 1}, {"address.city", 1}, {"created", 1}, {"orders.total", 1}}},
+					{"sort", bson.D{{"age", -1}, {"name", 1}}},
+					{"limit", int64(100)}, {"batchSize", int64(100)}, {"singleBatch", true},
+				},
+				{
+					{"aggregate", "users"},
+					{"pipeline", bson.A{bson.D{{"$match", bson.D{{"name", "a"}}}}, bson.D{{"$count", "n"}}}},
+					{"cursor", bson.D{}},
+				},
+			},
+			resp: `{"data":{"users":[{"__typename":"Db_users","id":"` + oid.Hex() + `","address":{"city":"Paris"},"created":"2020-01-02T03:04:05Z","orders":[{"total":1.5}]}],"n":3,"__typename":"Query"}}`,
+		},
+		// Objects selected whole don't collide with their subfields, nor is the
+		// _id returned unless it's selected
+		{
+			query: `{ db_users(_id: "` + oid.Hex() + `", skip: 2) { a: address { __typename } b: address { city } } }`,
+			cmds: []bson.D{{
+				{"find", "users"},
+				{"filter", bson.D{{"_id", oid}}},
+				{"projection", bson.D{{"address", 1}, {"_id", 0}}},
+				{"skip", int64(2)},
+				{"limit", int64(100)}, {"batchSize", int64(100)}, {"singleBatch", true},
+			}},
+			resp: `{"data":{"db_users":[{"a":{"__typename":"Db_users_address"},"b":{"city":"Paris"}}]}}`,
+		},
+		// Validation errors fail the whole query
+		{
+			query: `{ db_users_count db_users { nope } }`,
+			resp:  `{"errors":[{"message":"cannot query field \"nope\" on type \"Db_users\""}]}`,
+		},
+		{
+			query: `{ db_users(age: "a") { name } }`,
+			resp:  `{"errors":[{"message":"invalid Int value of argument age: \"a\""}]}`,
+		},
+		{
+			query: `{ db_users { address } }`,
+			resp:  `{"errors":[{"message":"field \"Db_users.address\" of type \"Db_users_address\" must have a selection of subfields"}]}`,
+		},
+		{
+			query: `{ __schema { types { name } } }`,
+			resp:  `{"errors":[{"message":"introspection is not supported, the schema is served by GET /v1/graphql/schema"}]}`,
+		},
+		{
+			query: `{ db_other { a } }`,
+			resp:  `{"errors":[{"message":"cannot query field \"db_other\" on type \"Query\""}]}`,
+		},
+		// Failed commands null their field
+		{
+			query: `{ db_orders(limit: 1) { total } }`,
+			resp:  `{"data":{"db_orders":null},"errors":[{"message":"unauthorized","path":["db_orders"],"extensions":{"code":13,"codeName":"Unauthorized"}}]}`,
+		},
+	}
+
+	for i, test := range tests {
+		cmds = nil
+		resp := p.ResolveGraphQL(context.TODO(), &graphql.Request{Query: test.query, Variables: test.vars}, cr, 100)
+		b, err := json.Marshal(resp)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if string(b) != test.resp {
+			t.Fatalf("%d: expected %s, got %s", i, test.resp, b)
+		}
+		if test.cmds != nil && !reflect.DeepEqual(cmds, test.cmds) {
+			t.Fatalf("%d: expected commands %v, got %v", i, test.cmds, cmds)
+		}
+	}
+}
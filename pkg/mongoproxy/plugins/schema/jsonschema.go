@@ -0,0 +1,174 @@
+package schema
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// JSONSchemaDraft is the JSON Schema dialect of the published documents
+const JSONSchemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// jsonSchemaTypes are the JSON Schemas of the BSON types as represented in
+// relaxed extended JSON, with the BSON type in x-bsonType
+var jsonSchemaTypes = map[BSONType]map[string]interface{}{
+	INT:             {"type": "integer", "format": "int32"},
+	LONG:            {"type": "integer", "format": "int64"},
+	DOUBLE:          {"type": "number"},
+	STRING:          {"type": "string"},
+	OBJECT:          {"type": "object"},
+	BIN_DATA:        {"type": "object", "required": []string{"$binary"}},
+	OBJECT_ID:       {"type": "object", "required": []string{"$oid"}},
+	BOOL:            {"type": "boolean"},
+	DATE:            {"type": "object", "required": []string{"$date"}},
+	NULL:            {"type": "null"},
+	REGEX:           {"type": "object", "required": []string{"$regularExpression"}},
+	DECIMAL128:      {"type": "object", "required": []string{"$numberDecimal"}},
+	GEO_POINT:       {"type": "object", "required": []string{"type", "coordinates"}, "properties": map[string]interface{}{"type": map[string]interface{}{"const": "Point"}}},
+	GEO_LINE_STRING: {"type": "object", "required": []string{"type", "coordinates"}, "properties": map[string]interface{}{"type": map[string]interface{}{"const": "LineString"}}},
+	GEO_POLYGON:     {"type": "object", "required": []string{"type", "coordinates"}, "properties": map[string]interface{}{"type": map[string]interface{}{"const": "Polygon"}}},
+	LEGACY_POINT:    {"type": []string{"array", "object"}},
+}
+
+// JSONSchema returns the collection's schema as a JSON Schema document, with the
+// schemas of the collections its fields are typed by in $defs and the version of
+// the loaded schema in x-mongoproxy. It returns false for unknown collections.
+func (s *ClusterSchema) JSONSchema(database, collection string) (map[string]interface{}, bool) {
+	c, ok := s.Databases[database].Collections[collection]
+	if !ok {
+		return nil, false
+	}
+	ns := database + "." + collection
+	defs := make(map[string]interface{})
+	doc := s.jsonSchemaObject(c.Fields, c.DenyUnknownFields, defs)
+	doc["$schema"] = JSONSchemaDraft
+	doc["$id"] = ns
+	doc["title"] = ns
+	doc["x-mongoproxy"] = map[string]interface{}{
+		"version":                          s.version,
+		"loadedAt":                         s.loadedAt.UTC().Format(time.RFC3339),
+		"enforceSchema":                    c.EnforceSchema,
+		"enforceSchemaByCollectionLogOnly": c.EnforceSchemaByCollectionLogOnly,
+	}
+	if len(c.Annotations) > 0 {
+		doc["x-annotations"] = c.Annotations
+	}
+	if len(defs) > 0 {
+		doc["$defs"] = defs
+	}
+	return doc, true
+}
+
+// jsonSchemaObject returns the JSON Schema of an object with the fields, adding
+// the collections they reference to defs
+func (s *ClusterSchema) jsonSchemaObject(fields map[string]CollectionField, denyUnknownFields bool, defs map[string]interface{}) map[string]interface{} {
+	properties := make(map[string]interface{}, len(fields))
+	required := []string{}
+	for name, f := range fields {
+		properties[name] = s.jsonSchemaField(f, denyUnknownFields, defs)
+		if f.Required {
+			required = append(required, name)
+		}
+	}
+	sort.Strings(required)
+	obj := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		obj["required"] = required
+	}
+	if denyUnknownFields {
+		obj["additionalProperties"] = false
+	}
+	return obj
+}
+
+func (s *ClusterSchema) jsonSchemaField(f CollectionField, denyUnknownFields bool, defs map[string]interface{}) map[string]interface{} {
+	t := f.Type
+	isArray := strings.HasPrefix(string(t), "[]")
+	elem := elementType(t)
+
+	var schema map[string]interface{}
+	switch ref := fieldRef(t); {
+	case ref != "":
+		if _, ok := defs[ref]; !ok {
+			parts := strings.SplitN(ref, ".", 2)
+			remote := s.Databases[parts[0]].Collections[parts[1]]
+			// Reserve the def first as collections can reference themselves
+			defs[ref] = nil
+			defs[ref] = s.jsonSchemaObject(remote.Fields, denyUnknownFields, defs)
+		}
+		schema = map[string]interface{}{"$ref": "#/$defs/" + url.PathEscape(ref)}
+	case elem == OBJECT && len(f.SubFields) > 0:
+		schema = s.jsonSchemaObject(f.SubFields, denyUnknownFields, defs)
+		schema["x-bsonType"] = string(elem)
+	default:
+		schema = map[string]interface{}{"x-bsonType": string(elem)}
+		for k, v := range jsonSchemaTypes[elem] {
+			schema[k] = v
+		}
+	}
+
+	if isArray {
+		schema = map[string]interface{}{"type": "array", "items": schema}
+	}
+	if f.Name != "" {
+		schema["x-alias"] = f.Name
+	}
+	if len(f.Annotations) > 0 {
+		schema["x-annotations"] = f.Annotations
+	}
+	return schema
+}
+
+// serveJSONSchema serves the JSON Schema of the collection, or the index of the
+// collections' documents without a collection
+func (p *SchemaPlugin) serveJSONSchema(w http.ResponseWriter, r *http.Request) {
+	schema := p.GetSchema()
+	if schema == nil {
+		http.Error(w, "no schema loaded", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("ETag", `"`+schema.version+`"`)
+	if match := r.Header.Get("If-None-Match"); match != "" && match == `"`+schema.version+`"` {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	database, collection := r.URL.Query().Get("database"), r.URL.Query().Get("collection")
+	if collection == "" {
+		type entry struct {
+			Namespace string `json:"ns"`
+			URL       string `json:"url"`
+		}
+		index := struct {
+			Version     string    `json:"version"`
+			LoadedAt    time.Time `json:"loadedAt"`
+			Collections []entry   `json:"collections"`
+		}{Version: schema.version, LoadedAt: schema.loadedAt, Collections: []entry{}}
+		for _, dbName := range sortedKeys(schema.Databases) {
+			if database != "" && dbName != database {
+				continue
+			}
+			for _, collName := range sortedCollectionKeys(schema.Databases[dbName].Collections) {
+				q := url.Values{"database": {dbName}, "collection": {collName}}
+				index.Collections = append(index.Collections, entry{
+					Namespace: dbName + "." + collName,
+					URL:       "jsonschema?" + q.Encode(),
+				})
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(index)
+		return
+	}
+
+	doc, ok := schema.JSONSchema(database, collection)
+	if !ok {
+		http.Error(w, "unknown collection "+database+"."+collection, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	json.NewEncoder(w).Encode(doc)
+}
@@ -0,0 +1,109 @@
+package schema
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestJSONSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "schema.json")
+	if err := ioutil.WriteFile(path, []byte(`{"dbs": {"db": {"collections": {
+		"users": {"enforceSchema": true, "denyUnknownFields": true, "fields": {
+			"name": {"type": "string", "required": true, "alias": "n"},
+			"tags": {"type": "[]string"},
+			"address": {"type": "object", "subfields": {"city": {"type": "string", "required": true}}},
+			"orders": {"type": "[]db.orders"}
+		}},
+		"orders": {"fields": {"total": {"type": "double"}, "parent": {"type": "db.orders"}}}
+	}}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := &SchemaPlugin{}
+	if err := p.Configure(bson.D{{"schemaPath", path}}); err != nil {
+		t.Fatal(err)
+	}
+	version := p.GetSchema().version
+	if version == "" {
+		t.Fatal("expected the schema's version to be set")
+	}
+
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		p.AdminHandler().ServeHTTP(w, r)
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder) map[string]interface{} {
+		var v map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+			t.Fatalf("%v: %s", err, w.Body.String())
+		}
+		return v
+	}
+
+	w := get("/jsonschema?database=db&collection=users", nil)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"`+version+`"` {
+		t.Fatalf("unexpected response %d %v", w.Code, w.Header())
+	}
+	doc := decode(w)
+	var expected map[string]interface{}
+	if err := json.Unmarshal([]byte(`{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"$id": "db.users",
+		"title": "db.users",
+		"type": "object",
+		"additionalProperties": false,
+		"required": ["name"],
+		"properties": {
+			"name": {"type": "string", "x-bsonType": "string", "x-alias": "n"},
+			"tags": {"type": "array", "items": {"type": "string", "x-bsonType": "string"}},
+			"address": {"type": "object", "x-bsonType": "object", "additionalProperties": false, "required": ["city"],
+				"properties": {"city": {"type": "string", "x-bsonType": "string"}}},
+			"orders": {"type": "array", "items": {"$ref": "#/$defs/db.orders"}}
+		},
+		"$defs": {
+			"db.orders": {"type": "object", "additionalProperties": false, "properties": {
+				"total": {"type": "number", "x-bsonType": "double"},
+				"parent": {"$ref": "#/$defs/db.orders"}
+			}}
+		}
+	}`), &expected); err != nil {
+		t.Fatal(err)
+	}
+	meta := doc["x-mongoproxy"].(map[string]interface{})
+	delete(doc, "x-mongoproxy")
+	if !reflect.DeepEqual(doc, expected) {
+		b, _ := json.MarshalIndent(doc, "", "  ")
+		t.Fatalf("unexpected JSON Schema:\n%s", b)
+	}
+	if meta["version"] != version || meta["enforceSchema"] != true {
+		t.Fatalf("unexpected metadata: %v", meta)
+	}
+
+	index := decode(get("/jsonschema", nil))
+	if index["version"] != version || len(index["collections"].([]interface{})) != 2 {
+		t.Fatalf("unexpected index: %v", index)
+	}
+	if w := get("/jsonschema?database=db&collection=users", http.Header{"If-None-Match": {`"` + version + `"`}}); w.Code != http.StatusNotModified {
+		t.Fatalf("expected %d, got %d", http.StatusNotModified, w.Code)
+	}
+	if w := get("/jsonschema?database=db&collection=missing", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
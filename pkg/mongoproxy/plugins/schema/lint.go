@@ -0,0 +1,88 @@
+package schema
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// knownTypes are the types which can be used for fields (in addition to
+// references to other collections)
+var knownTypes = map[BSONType]struct{}{
+	INT: {}, LONG: {}, DOUBLE: {}, STRING: {}, OBJECT: {}, BIN_DATA: {}, OBJECT_ID: {},
+	BOOL: {}, DATE: {}, NULL: {}, REGEX: {}, DECIMAL128: {},
+	GEO_POINT: {}, GEO_LINE_STRING: {}, GEO_POLYGON: {}, LEGACY_POINT: {},
+}
+
+// Lint returns problems with the schema which don't prevent it from loading
+// (e.g. fields with unknown types, which never validate).
+func (s *ClusterSchema) Lint() []error {
+	var errs []error
+	for _, dbName := range sortedKeys(s.Databases) {
+		db := s.Databases[dbName]
+		for _, collectionName := range sortedCollectionKeys(db.Collections) {
+			c := db.Collections[collectionName]
+			errs = append(errs, lintFields(dbName+"."+collectionName, "", c.Fields)...)
+		}
+	}
+	return errs
+}
+
+func lintFields(ns, prefix string, fields map[string]CollectionField) []error {
+	var errs []error
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := fields[name]
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+
+		t := elementType(f.Type)
+		_, known := knownTypes[t]
+		isRef := strings.Contains(string(t), ".")
+		switch {
+		case f.Type == "":
+			errs = append(errs, fmt.Errorf("%s: field %s has no type", ns, path))
+		case !known && !isRef:
+			errs = append(errs, fmt.Errorf("%s: field %s has unknown type %q", ns, path, f.Type))
+		case len(f.SubFields) > 0 && t != OBJECT:
+			errs = append(errs, fmt.Errorf("%s: field %s has subfields but type %q (subfields are only used for objects)", ns, path, f.Type))
+		}
+
+		errs = append(errs, lintFields(ns, path, f.SubFields)...)
+	}
+	return errs
+}
+
+func sortedKeys(m map[string]Database) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedCollectionKeys(m map[string]Collection) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ValidateConfig lints the loaded schema
+func (p *SchemaPlugin) ValidateConfig() []error {
+	schema := p.GetSchema()
+	if schema == nil {
+		return []error{fmt.Errorf("no schema loaded")}
+	}
+	return schema.Lint()
+}
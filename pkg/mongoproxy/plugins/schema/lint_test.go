@@ -0,0 +1,44 @@
+package schema
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	b, err := ioutil.ReadFile("example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s ClusterSchema
+	if err := json.Unmarshal(b, &s); err != nil {
+		t.Fatal(err)
+	}
+	if errs := s.Lint(); len(errs) > 0 {
+		t.Fatalf("unexpected lint errors in example schema: %v", errs)
+	}
+
+	var bad ClusterSchema
+	if err := json.Unmarshal([]byte(`{"dbs": {"db": {"collections": {"c": {"fields": {
+		"a": {"type": "integer"},
+		"b": {"type": "string", "subfields": {"c": {"type": "int"}}},
+		"d": {"type": "object", "subfields": {"e": {"type": "strng"}}}
+	}}}}}}`), &bad); err != nil {
+		t.Fatal(err)
+	}
+	errs := bad.Lint()
+	expected := []string{
+		`db.c: field a has unknown type "integer"`,
+		`db.c: field b has subfields but type "string" (subfields are only used for objects)`,
+		`db.c: field d.e has unknown type "strng"`,
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("mismatch in lint errors expected=%v actual=%v", expected, errs)
+	}
+	for i, err := range errs {
+		if err.Error() != expected[i] {
+			t.Fatalf("mismatch in lint error %d expected=%q actual=%q", i, expected[i], err)
+		}
+	}
+}
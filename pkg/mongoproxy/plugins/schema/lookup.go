@@ -0,0 +1,294 @@
+package schema
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+var (
+	lookupRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_schema_lookup_refreshes_total",
+		Help: "The total refreshes of lookup sets",
+	}, []string{"set", "success"})
+	lookupSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mongoproxy_plugins_schema_lookup_set_size",
+		Help: "The number of values in the lookup set",
+	}, []string{"set"})
+)
+
+// lookupBatchSize is the batch size of the finds loading lookup sets from collections
+const lookupBatchSize = 10000
+
+// lookupTypes are the (element) types of the fields which can be looked up
+var lookupTypes = map[BSONType]struct{}{
+	STRING: {}, INT: {}, LONG: {}, OBJECT_ID: {},
+}
+
+type LookupSetConfig struct {
+	// Name is the name fields reference the set by (with "lookup" in the schema)
+	Name string `bson:"name"`
+	// File is the path of a file of the values, one per line (ignoring empty lines
+	// and lines starting with #)
+	File string `bson:"file"`
+	// Collection is the backend collection ("db.collection") of the values, the
+	// values of Field (default "_id") of the documents matching Filter
+	Collection string `bson:"collection"`
+	Field      string `bson:"field"`
+	Filter     bson.D `bson:"filter"`
+	// Refresh is how often the set is reloaded (default 5m)
+	Refresh string `bson:"refresh"`
+
+	db, collection string
+	refresh        time.Duration
+}
+
+// lookupSet is a set of values loaded from a file or a backend collection, which
+// is replaced as a whole on refresh
+type lookupSet struct {
+	conf LookupSetConfig
+
+	// values is the map[string]struct{} of the values, nil until loaded
+	values atomic.Value
+}
+
+func newLookupSet(conf LookupSetConfig) (*lookupSet, error) {
+	if conf.Name == "" {
+		return nil, fmt.Errorf("lookup set has no name")
+	}
+	if (conf.File == "") == (conf.Collection == "") {
+		return nil, fmt.Errorf("lookup set %s: exactly one of file and collection must be set", conf.Name)
+	}
+	if conf.Collection != "" {
+		parts := strings.SplitN(conf.Collection, ".", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("lookup set %s: invalid collection %q; must be db.collection", conf.Name, conf.Collection)
+		}
+		conf.db, conf.collection = parts[0], parts[1]
+	}
+	if conf.Field == "" {
+		conf.Field = "_id"
+	}
+	if conf.Refresh == "" {
+		conf.Refresh = "5m"
+	}
+	refresh, err := time.ParseDuration(conf.Refresh)
+	if err != nil {
+		return nil, fmt.Errorf("lookup set %s: invalid refresh: %w", conf.Name, err)
+	}
+	if refresh <= 0 {
+		return nil, fmt.Errorf("lookup set %s: refresh must be positive", conf.Name)
+	}
+	conf.refresh = refresh
+	return &lookupSet{conf: conf}, nil
+}
+
+// load replaces the values of the set with those of its file or collection
+func (l *lookupSet) load(ctx context.Context, cr plugins.CommandRunner) (err error) {
+	defer func() {
+		lookupRefreshes.WithLabelValues(l.conf.Name, strconv.FormatBool(err == nil)).Inc()
+	}()
+
+	var values map[string]struct{}
+	if l.conf.File != "" {
+		values, err = l.loadFile()
+	} else {
+		values, err = l.loadCollection(ctx, cr)
+	}
+	if err != nil {
+		return fmt.Errorf("lookup set %s: %w", l.conf.Name, err)
+	}
+	l.values.Store(values)
+	lookupSize.WithLabelValues(l.conf.Name).Set(float64(len(values)))
+	return nil
+}
+
+func (l *lookupSet) loadFile() (map[string]struct{}, error) {
+	b, err := ioutil.ReadFile(l.conf.File)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]struct{})
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		values[line] = struct{}{}
+	}
+	return values, scanner.Err()
+}
+
+func (l *lookupSet) loadCollection(ctx context.Context, cr plugins.CommandRunner) (map[string]struct{}, error) {
+	if cr == nil {
+		return nil, fmt.Errorf("no plugin in the chain can run commands on the backend")
+	}
+	filter := l.conf.Filter
+	if filter == nil {
+		filter = bson.D{}
+	}
+	result, err := cr.RunCommand(ctx, l.conf.db, bson.D{
+		{"find", l.conf.collection},
+		{"filter", filter},
+		{"projection", bson.D{{l.conf.Field, 1}}},
+		{"batchSize", lookupBatchSize},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]struct{})
+	batchKey := "firstBatch"
+	for {
+		batch, _ := bsonutil.Lookup(result, "cursor", batchKey)
+		items, _ := batch.(primitive.A)
+		for _, item := range items {
+			doc, ok := item.(bson.D)
+			if !ok {
+				continue
+			}
+			v, _ := bsonutil.Lookup(doc, strings.Split(l.conf.Field, ".")...)
+			if key, ok := lookupKey(v); ok {
+				values[key] = struct{}{}
+			}
+		}
+
+		id, _ := bsonutil.Lookup(result, "cursor", "id")
+		if cursorID, _ := id.(int64); cursorID == 0 {
+			return values, nil
+		}
+		if result, err = cr.RunCommand(ctx, l.conf.db, bson.D{
+			{"getMore", id},
+			{"collection", l.conf.collection},
+			{"batchSize", lookupBatchSize},
+		}); err != nil {
+			return nil, err
+		}
+		batchKey = "nextBatch"
+	}
+}
+
+// contains returns whether the key is in the set, and false if the set isn't loaded
+func (l *lookupSet) contains(key string) (found, loaded bool) {
+	values, _ := l.values.Load().(map[string]struct{})
+	if values == nil {
+		return false, false
+	}
+	_, found = values[key]
+	return found, true
+}
+
+// validate validates that the value (or each element of an array) is in the set;
+// values aren't checked until the set is loaded
+func (l *lookupSet) validate(name string, v interface{}) error {
+	if a, ok := v.(primitive.A); ok {
+		for _, e := range a {
+			if err := l.validate(name, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	key, ok := lookupKey(v)
+	if !ok {
+		return nil
+	}
+	if found, loaded := l.contains(key); loaded && !found {
+		return fmt.Errorf("%s: %s is not in lookup set %s", name, key, l.conf.Name)
+	}
+	return nil
+}
+
+// lookupKey returns the key of a value in lookup sets: strings as is, integers in
+// decimal and ObjectIDs in hex (as they'd be written in a file). It returns false
+// for values of other types, which are left to the type checks.
+func lookupKey(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case int:
+		return strconv.Itoa(v), true
+	case int32:
+		return strconv.FormatInt(int64(v), 10), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case primitive.ObjectID:
+		return v.Hex(), true
+	}
+	return "", false
+}
+
+// loadLookup checks the field can be looked up
+func (c *CollectionField) loadLookup() error {
+	if c.Lookup == "" {
+		return nil
+	}
+	if _, ok := lookupTypes[elementType(c.Type)]; !ok {
+		return fmt.Errorf("lookup is only supported for %s, %s, %s and %s fields (and arrays of them)", STRING, INT, LONG, OBJECT_ID)
+	}
+	return nil
+}
+
+// setLookupSets resolves the lookup sets referenced by the fields of the schema,
+// returning an error if one isn't in sets
+func (s *ClusterSchema) setLookupSets(sets map[string]*lookupSet) error {
+	for dbName, db := range s.Databases {
+		for collectionName, collection := range db.Collections {
+			if err := WalkCollectionFields(collection.Fields, func(fName string, f *CollectionField) error {
+				if f.Lookup == "" {
+					return nil
+				}
+				set, ok := sets[f.Lookup]
+				if !ok {
+					return fmt.Errorf("%s.%s %s: unknown lookup set %q", dbName, collectionName, fName, f.Lookup)
+				}
+				f.lookup = set
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	// The compiled paths are copies of the fields
+	s.compile()
+	return nil
+}
+
+// refreshLookupSets reloads the lookup sets every refresh interval until stopped
+func (p *SchemaPlugin) refreshLookupSets() {
+	for _, set := range p.lookups {
+		set := set
+		go func() {
+			ticker := time.NewTicker(set.conf.refresh)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-p.stop:
+					return
+				case <-ticker.C:
+					ctx, cancel := context.WithTimeout(context.Background(), set.conf.refresh)
+					if err := set.load(ctx, p.commandRunner()); err != nil {
+						logrus.Errorf("Error refreshing %v", err)
+					}
+					cancel()
+				}
+			}
+		}()
+	}
+}
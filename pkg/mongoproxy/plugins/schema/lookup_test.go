@@ -0,0 +1,177 @@
+package schema
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const lookupSchema = `{
+	"dbs": {
+		"shop": {
+			"collections": {
+				"orders": {
+					"enforceSchema": true,
+					"fields": {
+						"country": {"type": "string", "required": true, "lookup": "countries"},
+						"merchant": {"type": "long", "lookup": "merchants"},
+						"ships_to": {"type": "[]string", "lookup": "countries"}
+					}
+				}
+			}
+		}
+	}
+}`
+
+// runCommandFunc is a plugins.CommandRunner calling the func
+type runCommandFunc func(db string, cmd bson.D) (bson.D, error)
+
+func (f runCommandFunc) RunCommand(ctx context.Context, db string, cmd bson.D) (bson.D, error) {
+	return f(db, cmd)
+}
+
+func TestLookupSets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lookup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "countries.txt")
+	if err := ioutil.WriteFile(file, []byte("# ISO codes\nUS\n\nFR \nDE\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	countries, err := newLookupSet(LookupSetConfig{Name: "countries", File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := countries.load(context.TODO(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	merchants, err := newLookupSet(LookupSetConfig{Name: "merchants", Collection: "shop.merchants", Field: "merchant_id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cmds []string
+	cr := runCommandFunc(func(db string, cmd bson.D) (bson.D, error) {
+		cmds = append(cmds, db+" "+cmd[0].Key)
+		if cmd[0].Key == "find" {
+			return bson.D{{"cursor", bson.D{
+				{"firstBatch", primitive.A{bson.D{{"merchant_id", int64(1)}}, bson.D{{"merchant_id", int64(2)}}}},
+				{"id", int64(42)},
+			}}}, nil
+		}
+		return bson.D{{"cursor", bson.D{
+			{"nextBatch", primitive.A{bson.D{{"merchant_id", int64(3)}}}},
+			{"id", int64(0)},
+		}}}, nil
+	})
+	if err := merchants.load(context.TODO(), cr); err != nil {
+		t.Fatal(err)
+	}
+	if len(cmds) != 2 || cmds[0] != "shop find" || cmds[1] != "shop getMore" {
+		t.Fatalf("unexpected commands: %v", cmds)
+	}
+
+	var schema ClusterSchema
+	if err := json.Unmarshal([]byte(lookupSchema), &schema); err != nil {
+		t.Fatal(err)
+	}
+	if err := schema.setLookupSets(map[string]*lookupSet{"countries": countries, "merchants": merchants}); err != nil {
+		t.Fatal(err)
+	}
+	schema.setShapeCaches(100)
+
+	inserts := []struct {
+		doc bson.D
+		err bool
+	}{
+		{doc: bson.D{{"country", "US"}}},
+		{doc: bson.D{{"country", "FR"}, {"merchant", int64(3)}}},
+		// The shape of a valid document doesn't make its values valid
+		{doc: bson.D{{"country", "XX"}}, err: true},
+		{doc: bson.D{{"country", "# ISO codes"}}, err: true},
+		{doc: bson.D{{"country", "US"}, {"merchant", int64(4)}}, err: true},
+		{doc: bson.D{{"country", "US"}, {"ships_to", primitive.A{"FR", "DE"}}}},
+		{doc: bson.D{{"country", "US"}, {"ships_to", primitive.A{"FR", "XX"}}}, err: true},
+	}
+	for i, test := range inserts {
+		err := schema.ValidateInsert(context.TODO(), "shop", "orders", test.doc)
+		if (err != nil) != test.err {
+			t.Fatalf("insert %d: expected err=%v, got %v", i, test.err, err)
+		}
+	}
+
+	updates := []struct {
+		u   bson.D
+		err bool
+	}{
+		{u: bson.D{{"$set", bson.D{{"country", "DE"}}}}},
+		{u: bson.D{{"$set", bson.D{{"country", "XX"}}}}, err: true},
+		{u: bson.D{{"$push", bson.D{{"ships_to", "US"}}}}},
+		{u: bson.D{{"$push", bson.D{{"ships_to", "XX"}}}}, err: true},
+	}
+	for i, test := range updates {
+		err := schema.ValidateUpdate(context.TODO(), "shop", "orders", test.u, false)
+		if (err != nil) != test.err {
+			t.Fatalf("update %d: expected err=%v, got %v", i, test.err, err)
+		}
+	}
+
+	// Values aren't checked until the set is loaded
+	unloaded, err := newLookupSet(LookupSetConfig{Name: "countries", Collection: "geo.countries"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unloaded.validate("country", "XX"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := schema.setLookupSets(map[string]*lookupSet{"countries": countries}); err == nil {
+		t.Fatal("expected an error for the unknown lookup set")
+	}
+}
+
+func TestLookupLoad(t *testing.T) {
+	fields := []struct {
+		field string
+		ok    bool
+	}{
+		{field: `{"type": "string", "lookup": "countries"}`, ok: true},
+		{field: `{"type": "[]objectID", "lookup": "merchants"}`, ok: true},
+		{field: `{"type": "double", "lookup": "countries"}`},
+		{field: `{"type": "object", "lookup": "countries"}`},
+	}
+	for i, test := range fields {
+		var schema ClusterSchema
+		doc := `{"dbs": {"shop": {"collections": {"orders": {"fields": {"country": ` + test.field + `}}}}}}`
+		if err := json.Unmarshal([]byte(doc), &schema); (err == nil) != test.ok {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+
+	sets := []struct {
+		conf LookupSetConfig
+		ok   bool
+	}{
+		{conf: LookupSetConfig{Name: "countries", File: "countries.txt"}, ok: true},
+		{conf: LookupSetConfig{Name: "merchants", Collection: "shop.merchants", Refresh: "1m"}, ok: true},
+		{conf: LookupSetConfig{File: "countries.txt"}},
+		{conf: LookupSetConfig{Name: "countries"}},
+		{conf: LookupSetConfig{Name: "countries", File: "countries.txt", Collection: "geo.countries"}},
+		{conf: LookupSetConfig{Name: "merchants", Collection: "merchants"}},
+		{conf: LookupSetConfig{Name: "merchants", Collection: "shop.merchants", Refresh: "0s"}},
+	}
+	for i, test := range sets {
+		if _, err := newLookupSet(test.conf); (err == nil) != test.ok {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package schema
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/text/unicode/norm"
+)
+
+// stringTransforms are the transforms string fields can be normalized with on write
+var stringTransforms = map[string]func(string) string{
+	"trim":         strings.TrimSpace,
+	"lowercase":    strings.ToLower,
+	"nfc":          norm.NFC.String,
+	"stripControl": stripControl,
+}
+
+// stripControl removes the control characters of s other than tabs and newlines
+func stripControl(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// loadTransforms checks the transforms of the field
+func (c *CollectionField) loadTransforms() error {
+	if len(c.Transforms) == 0 {
+		return nil
+	}
+	if elementType(c.Type) != STRING {
+		return fmt.Errorf("transforms are only supported for %s fields (and arrays of them)", STRING)
+	}
+	for _, name := range c.Transforms {
+		if _, ok := stringTransforms[name]; !ok {
+			return fmt.Errorf("unknown transform %q", name)
+		}
+	}
+	return nil
+}
+
+// normalize returns the value with the transforms of the field (and of its
+// subfields) applied, and whether it changed. Values are copied rather than
+// modified in place.
+func (c *CollectionField) normalize(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case string:
+		if len(c.Transforms) == 0 {
+			return v, false
+		}
+		s := v
+		for _, name := range c.Transforms {
+			s = stringTransforms[name](s)
+		}
+		return s, s != v
+	case bson.D:
+		if c.remoteCollection != nil {
+			return normalizeDocument(c.remoteCollection.Fields, v)
+		}
+		return normalizeDocument(c.SubFields, v)
+	case primitive.A:
+		var out primitive.A
+		for i, e := range v {
+			n, changed := c.normalize(e)
+			if !changed {
+				continue
+			}
+			if out == nil {
+				out = make(primitive.A, len(v))
+				copy(out, v)
+			}
+			out[i] = n
+		}
+		if out != nil {
+			return out, true
+		}
+	}
+	return v, false
+}
+
+// normalizeDocument returns the document with the transforms of the fields applied,
+// and whether it changed
+func normalizeDocument(fields map[string]CollectionField, doc bson.D) (bson.D, bool) {
+	var out bson.D
+	for i, e := range doc {
+		f, ok := fields[e.Key]
+		if !ok {
+			continue
+		}
+		v, changed := f.normalize(e.Value)
+		if !changed {
+			continue
+		}
+		if out == nil {
+			out = make(bson.D, len(doc))
+			copy(out, doc)
+		}
+		out[i].Value = v
+	}
+	if out == nil {
+		return doc, false
+	}
+	return out, true
+}
+
+// Normalize returns the inserted (or replacement) document with the transforms of
+// the collection's fields applied, and whether it changed
+func (c *Collection) Normalize(obj bson.D) (bson.D, bool) {
+	if !c.transforms {
+		return obj, false
+	}
+	return normalizeDocument(c.Fields, obj)
+}
+
+// NormalizeUpdate returns the update with the transforms of the collection's fields
+// applied to the values it sets, and whether it changed
+func (c *Collection) NormalizeUpdate(u bson.D) (bson.D, bool) {
+	if !c.transforms || len(u) == 0 {
+		return u, false
+	}
+	if !strings.HasPrefix(u[0].Key, "$") {
+		return c.Normalize(u)
+	}
+
+	var out bson.D
+	for i, op := range u {
+		switch op.Key {
+		case "$set", "$setOnInsert", "$push", "$addToSet":
+		default:
+			continue
+		}
+		fields, ok := op.Value.(bson.D)
+		if !ok {
+			continue
+		}
+		if fields, changed := c.normalizeUpdateFields(fields); changed {
+			if out == nil {
+				out = make(bson.D, len(u))
+				copy(out, u)
+			}
+			out[i].Value = fields
+		}
+	}
+	if out == nil {
+		return u, false
+	}
+	return out, true
+}
+
+// normalizeUpdateFields normalizes the values of the (dotted) paths set by an
+// update operator, including the elements of $each
+func (c *Collection) normalizeUpdateFields(fields bson.D) (bson.D, bool) {
+	var out bson.D
+	for i, e := range fields {
+		f := c.lookupField(e.Key)
+		if f == nil {
+			continue
+		}
+		v := e.Value
+		each, isEach := eachValue(v)
+		if isEach {
+			v = each
+		}
+		n, changed := f.normalize(v)
+		if !changed {
+			continue
+		}
+		if isEach {
+			n = replaceEach(e.Value.(bson.D), n)
+		}
+		if out == nil {
+			out = make(bson.D, len(fields))
+			copy(out, fields)
+		}
+		out[i].Value = n
+	}
+	if out == nil {
+		return fields, false
+	}
+	return out, true
+}
+
+// eachValue returns the array of a $push or $addToSet modifier document
+// ({"$each": [...], ...})
+func eachValue(v interface{}) (primitive.A, bool) {
+	d, ok := v.(bson.D)
+	if !ok || len(d) == 0 || d[0].Key != "$each" {
+		return nil, false
+	}
+	a, ok := d[0].Value.(primitive.A)
+	return a, ok
+}
+
+// replaceEach returns a copy of the modifier document with the $each array replaced
+func replaceEach(d bson.D, each interface{}) bson.D {
+	out := make(bson.D, len(d))
+	copy(out, d)
+	out[0].Value = each
+	return out
+}
+
+// Normalize returns the inserted document with the transforms of the collection's
+// fields applied, and whether it changed
+func (s *ClusterSchema) Normalize(database, collection string, obj bson.D) (bson.D, bool) {
+	c := s.GetCollection(database, collection)
+	if c == nil {
+		return obj, false
+	}
+	return c.Normalize(obj)
+}
+
+// Transforms returns whether the collection's fields have transforms, so its
+// inserted documents may be normalized
+func (s *ClusterSchema) Transforms(database, collection string) bool {
+	c := s.GetCollection(database, collection)
+	return c != nil && c.transforms
+}
+
+// NormalizeUpdate returns the update with the transforms of the collection's
+// fields applied, and whether it changed
+func (s *ClusterSchema) NormalizeUpdate(database, collection string, u bson.D) (bson.D, bool) {
+	c := s.GetCollection(database, collection)
+	if c == nil {
+		return u, false
+	}
+	return c.NormalizeUpdate(u)
+}
@@ -0,0 +1,204 @@
+package schema
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const normalizeSchema = `{
+	"dbs": {
+		"shop": {
+			"collections": {
+				"users": {
+					"enforceSchema": true,
+					"fields": {
+						"email": {"type": "string", "required": true, "transforms": ["trim", "lowercase"]},
+						"name": {"type": "string", "transforms": ["stripControl", "nfc"]},
+						"tags": {"type": "[]string", "transforms": ["lowercase"]},
+						"address": {
+							"type": "object",
+							"subfields": {
+								"city": {"type": "string", "transforms": ["trim"]}
+							}
+						},
+						"age": {"type": "int"}
+					}
+				}
+			}
+		}
+	}
+}`
+
+func TestStringTransforms(t *testing.T) {
+	tests := []struct {
+		transform string
+		in, out   string
+	}{
+		{"trim", "  a b \t\n", "a b"},
+		{"lowercase", "Foo@Example.COM", "foo@example.com"},
+		// e + combining acute accent -> é
+		{"nfc", "cafe\u0301", "caf\u00e9"},
+		{"stripControl", "a\x00b\x1bc\u0085d\te\nf", "abcd\te\nf"},
+	}
+	for _, test := range tests {
+		if out := stringTransforms[test.transform](test.in); out != test.out {
+			t.Fatalf("%s(%q): expected %q, got %q", test.transform, test.in, test.out, out)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	var schema ClusterSchema
+	if err := json.Unmarshal([]byte(normalizeSchema), &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	doc := bson.D{
+		{"email", " Foo@Example.COM "},
+		{"name", "José\x00"},
+		{"tags", primitive.A{"VIP", "new"}},
+		{"address", bson.D{{"city", " Paris "}}},
+		{"age", int32(30)},
+		{"other", " Unknown "},
+	}
+	out, changed := schema.Normalize("shop", "users", doc)
+	if !changed {
+		t.Fatal("expected the document to change")
+	}
+	expected := bson.D{
+		{"email", "foo@example.com"},
+		{"name", "José"},
+		{"tags", primitive.A{"vip", "new"}},
+		{"address", bson.D{{"city", "Paris"}}},
+		{"age", int32(30)},
+		{"other", " Unknown "},
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Fatalf("expected %v, got %v", expected, out)
+	}
+	// The document isn't modified in place
+	if doc[0].Value != " Foo@Example.COM " || doc[3].Value.(bson.D)[0].Value != " Paris " {
+		t.Fatalf("document modified: %v", doc)
+	}
+	if _, changed := schema.Normalize("shop", "users", expected); changed {
+		t.Fatal("expected a normalized document not to change")
+	}
+	if _, changed := schema.Normalize("shop", "other", doc); changed {
+		t.Fatal("expected documents of collections without schema not to change")
+	}
+
+	updates := []struct {
+		u, expected bson.D
+	}{
+		{
+			u:        bson.D{{"$set", bson.D{{"email", "A@B.com"}, {"address.city", " Lyon "}}}, {"$inc", bson.D{{"age", 1}}}},
+			expected: bson.D{{"$set", bson.D{{"email", "a@b.com"}, {"address.city", "Lyon"}}}, {"$inc", bson.D{{"age", 1}}}},
+		},
+		{
+			u:        bson.D{{"$setOnInsert", bson.D{{"address", bson.D{{"city", " Nice"}}}}}},
+			expected: bson.D{{"$setOnInsert", bson.D{{"address", bson.D{{"city", "Nice"}}}}}},
+		},
+		{
+			u:        bson.D{{"$push", bson.D{{"tags", "VIP"}}}},
+			expected: bson.D{{"$push", bson.D{{"tags", "vip"}}}},
+		},
+		{
+			u:        bson.D{{"$addToSet", bson.D{{"tags", bson.D{{"$each", primitive.A{"A", "b"}}}}}}},
+			expected: bson.D{{"$addToSet", bson.D{{"tags", bson.D{{"$each", primitive.A{"a", "b"}}}}}}},
+		},
+		// Replacements are normalized as inserts
+		{
+			u:        bson.D{{"email", " X@Y.com"}},
+			expected: bson.D{{"email", "x@y.com"}},
+		},
+		{
+			u: bson.D{{"$unset", bson.D{{"email", " X "}}}},
+		},
+	}
+	for i, test := range updates {
+		out, changed := schema.NormalizeUpdate("shop", "users", test.u)
+		if changed != (test.expected != nil) {
+			t.Fatalf("update %d: expected changed=%v", i, test.expected != nil)
+		}
+		if changed && !reflect.DeepEqual(out, test.expected) {
+			t.Fatalf("update %d: expected %v, got %v", i, test.expected, out)
+		}
+	}
+}
+
+func TestNormalizeLoad(t *testing.T) {
+	tests := []struct {
+		field string
+		ok    bool
+	}{
+		{field: `{"type": "string", "transforms": ["trim", "lowercase", "nfc", "stripControl"]}`, ok: true},
+		{field: `{"type": "[]string", "transforms": ["trim"]}`, ok: true},
+		{field: `{"type": "int", "transforms": ["trim"]}`},
+		{field: `{"type": "string", "transforms": ["uppercase"]}`},
+	}
+	for i, test := range tests {
+		var schema ClusterSchema
+		doc := `{"dbs": {"shop": {"collections": {"users": {"fields": {"email": ` + test.field + `}}}}}}`
+		if err := json.Unmarshal([]byte(doc), &schema); (err == nil) != test.ok {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestProcessNormalize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "schema.json")
+	if err := ioutil.WriteFile(path, []byte(normalizeSchema), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := &SchemaPlugin{}
+	if err := p.Configure(bson.D{{"schemaPath", path}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var forwarded command.Command
+	next := func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+		forwarded = r.Command
+		return bson.D{{"ok", 1}}, nil
+	}
+
+	insert := &command.Insert{
+		Collection: "users",
+		Documents:  []bson.D{{{"email", " Foo@Example.COM"}}},
+		Common:     command.Common{Database: "shop"},
+	}
+	if _, err := p.Process(context.TODO(), &plugins.Request{CommandName: "insert", Command: insert}, next); err != nil {
+		t.Fatal(err)
+	}
+	if docs := forwarded.(*command.Insert).Documents; docs[0][0].Value != "foo@example.com" {
+		t.Fatalf("expected the normalized document to be forwarded, got %v", docs)
+	}
+
+	update := &command.Update{
+		Collection: "users",
+		Updates:    []command.UpdateStatement{{Query: bson.D{}, U: bson.D{{"$set", bson.D{{"tags", primitive.A{" A", "B"}}}}}}},
+		Common:     command.Common{Database: "shop"},
+	}
+	if _, err := p.Process(context.TODO(), &plugins.Request{CommandName: "update", Command: update}, next); err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.D{{"$set", bson.D{{"tags", primitive.A{" a", "b"}}}}}
+	if u := forwarded.(*command.Update).Updates[0].U; !reflect.DeepEqual(u, expected) {
+		t.Fatalf("expected %v to be forwarded, got %v", expected, u)
+	}
+}
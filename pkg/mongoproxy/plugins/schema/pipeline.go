@@ -0,0 +1,177 @@
+package schema
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ValidatePipeline will validate the $project and $addFields stages of an aggregate
+// pipeline against the schema of the collection.
+func (s *ClusterSchema) ValidatePipeline(ctx context.Context, database, collection string, pipeline primitive.A) error {
+	db, ok := s.Databases[database]
+	if !ok {
+		return nil
+	}
+
+	return db.ValidatePipeline(ctx, collection, pipeline)
+}
+
+// ValidatePipeline will validate the $project and $addFields stages of an aggregate
+// pipeline against the schema of the collection.
+func (d *Database) ValidatePipeline(ctx context.Context, collection string, pipeline primitive.A) error {
+	c, ok := d.Collections[collection]
+	if !ok {
+		return nil
+	}
+	if c.EnforceSchemaByCollectionLogOnly {
+		if err := c.ValidatePipeline(ctx, pipeline); err != nil {
+			schemaDenyLogOnly.WithLabelValues(collection, "aggregate").Inc()
+			logrus.Errorf("COLLECTION ENFORCE LOG ONLY: %s", err.Error())
+			return nil
+		}
+	}
+
+	return c.ValidatePipeline(ctx, pipeline)
+}
+
+// ValidatePipeline will validate the $project and $addFields stages of an aggregate
+// pipeline against the schema of the collection. Only the leading stages which see
+// the collection's documents are validated (up to and including the first
+// $project); later stages see reshaped documents which the schema doesn't describe.
+//
+// Field paths referenced by the stages (and the fields included or excluded by
+// $project) must be in the schema if it denies unknown fields, and literal values
+// that $addFields sets on fields in the schema must be of the field's type.
+func (c *Collection) ValidatePipeline(ctx context.Context, pipeline primitive.A) error {
+	if !c.EnforceSchema && !c.EnforceSchemaByCollectionLogOnly {
+		return nil
+	}
+
+	// added are the fields added by earlier stages (which references may use)
+	added := make(map[string]struct{})
+	for _, raw := range pipeline {
+		stage, ok := raw.(bson.D)
+		if !ok || len(stage) != 1 {
+			return nil
+		}
+		spec, _ := stage[0].Value.(bson.D)
+
+		switch stage[0].Key {
+		case "$match", "$sort", "$limit", "$skip", "$sample":
+		case "$addFields", "$set":
+			for _, e := range spec {
+				if err := c.validateReferences(e.Value, added); err != nil {
+					return err
+				}
+				if f := c.lookupField(e.Key); f != nil && isLiteral(e.Value) {
+					if err := f.Validate(ctx, e.Value, c.DenyUnknownFields, true); err != nil {
+						return fmt.Errorf("%s: %w", stage[0].Key, err)
+					}
+				}
+			}
+			for _, e := range spec {
+				added[e.Key] = struct{}{}
+			}
+		case "$project":
+			for _, e := range spec {
+				if isProjection(e.Value) {
+					if e.Key != "_id" && c.DenyUnknownFields && !c.knownPath(e.Key, added) {
+						return fmt.Errorf("$project of unknown field: %s", e.Key)
+					}
+					continue
+				}
+				if err := c.validateReferences(e.Value, added); err != nil {
+					return err
+				}
+			}
+			return nil
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// validateReferences checks that the field paths ("$field") referenced in the
+// expression are in the schema
+func (c *Collection) validateReferences(v interface{}, added map[string]struct{}) error {
+	if !c.DenyUnknownFields {
+		return nil
+	}
+	switch vTyped := v.(type) {
+	case string:
+		// "$$" are variables
+		if strings.HasPrefix(vTyped, "$") && !strings.HasPrefix(vTyped, "$$") && !c.knownPath(vTyped[1:], added) {
+			return fmt.Errorf("reference to unknown field: %s", vTyped)
+		}
+	case bson.D:
+		for _, e := range vTyped {
+			if e.Key == "$literal" {
+				continue
+			}
+			if err := c.validateReferences(e.Value, added); err != nil {
+				return err
+			}
+		}
+	case primitive.A:
+		for _, item := range vTyped {
+			if err := c.validateReferences(item, added); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// knownPath returns whether the dotted path is in the schema (or added by a stage)
+func (c *Collection) knownPath(path string, added map[string]struct{}) bool {
+	if path == "_id" || c.lookupField(path) != nil {
+		return true
+	}
+	root := path
+	if i := strings.IndexByte(path, '.'); i >= 0 {
+		root = path[:i]
+	}
+	_, ok := added[root]
+	if !ok {
+		_, ok = added[path]
+	}
+	return ok
+}
+
+// isProjection returns whether the $project value includes or excludes the field
+// (rather than computing it)
+func isProjection(v interface{}) bool {
+	switch v.(type) {
+	case bool, int, int32, int64, float64:
+		return true
+	}
+	return false
+}
+
+// isLiteral returns whether the expression is a literal value (with no field
+// references or operators)
+func isLiteral(v interface{}) bool {
+	switch vTyped := v.(type) {
+	case string:
+		return !strings.HasPrefix(vTyped, "$")
+	case bson.D:
+		for _, e := range vTyped {
+			if strings.HasPrefix(e.Key, "$") || !isLiteral(e.Value) {
+				return false
+			}
+		}
+	case primitive.A:
+		for _, item := range vTyped {
+			if !isLiteral(item) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,276 @@
+package schema
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// rawTypes are the BSON types of the values valid for the types which raw
+// documents can be validated against, matching the Go types Validate accepts
+// for them once decoded
+var rawTypes = map[BSONType][]bsontype.Type{
+	INT:        {bsontype.Int32, bsontype.Int64},
+	LONG:       {bsontype.Int32, bsontype.Int64},
+	DOUBLE:     {bsontype.Int32, bsontype.Int64, bsontype.Double},
+	STRING:     {bsontype.String},
+	OBJECT:     {bsontype.EmbeddedDocument},
+	BIN_DATA:   {bsontype.Binary},
+	OBJECT_ID:  {bsontype.ObjectID},
+	BOOL:       {bsontype.Boolean},
+	DATE:       {bsontype.Int64, bsontype.DateTime},
+	REGEX:      {bsontype.Regex},
+	DECIMAL128: {bsontype.Decimal128},
+}
+
+// rawArrayTypes are the array types which raw documents can be validated against
+var rawArrayTypes = map[BSONType]struct{}{
+	INT_ARRAY: {}, LONG_ARRAY: {}, DOUBLE_ARRAY: {}, STRING_ARRAY: {}, OBJECT_ARRAY: {},
+	BIN_DATA_ARRAY: {}, OBJECT_ID_ARRAY: {}, BOOL_ARRAY: {}, DATE_ARRAY: {},
+}
+
+// rawFields are fields compiled to validate raw documents against; only fields
+// needing type and presence checks (no remote collections) can be compiled
+type rawFields struct {
+	byName map[string]*rawField
+	list   []*rawField
+}
+
+type rawField struct {
+	index    int
+	name     string
+	required bool
+	array    bool
+	// types are the valid BSON types of the value (of the elements of arrays)
+	types []bsontype.Type
+	// sub are the subfields of objects
+	sub *rawFields
+}
+
+// compileRawFields returns the fields compiled to validate raw documents, or
+// false if they can't be
+func compileRawFields(fields map[string]CollectionField) (*rawFields, bool) {
+	rf := &rawFields{byName: make(map[string]*rawField, len(fields))}
+	for _, name := range sortedFieldKeys(fields) {
+		f := fields[name]
+		if f.remoteCollection != nil || f.checksValues() {
+			return nil, false
+		}
+		t := f.Type
+		_, isArray := rawArrayTypes[t]
+		if isArray {
+			t = elementType(t)
+		}
+		types, ok := rawTypes[t]
+		if !ok || (f.IsArray && !isArray) {
+			return nil, false
+		}
+		raw := &rawField{index: len(rf.list), name: name, required: f.Required, array: isArray, types: types}
+		if t == OBJECT {
+			if raw.sub, ok = compileRawFields(f.SubFields); !ok {
+				return nil, false
+			}
+		}
+		rf.byName[name] = raw
+		rf.list = append(rf.list, raw)
+	}
+	return rf, true
+}
+
+// errRawFallback is returned when the raw document must be decoded to be
+// validated, e.g. as it has duplicate fields (of which Validate checks the last)
+var errRawFallback = errors.New("raw validation not possible")
+
+// ValidateInsertRaw validates the raw document as ValidateInsert would (see
+// Collection.ValidateInsertRaw)
+func (s *ClusterSchema) ValidateInsertRaw(ctx context.Context, database, collection string, doc bson.Raw) error {
+	db, ok := s.Databases[database]
+	if !ok {
+		if s.DenyUnknownDatabases {
+			return fmt.Errorf("unknown DB %v not allowed", database)
+		}
+		return nil
+	}
+
+	return db.ValidateInsertRaw(ctx, collection, doc)
+}
+
+// ValidateInsertRaw validates the raw document as ValidateInsert would (see
+// Collection.ValidateInsertRaw)
+func (d *Database) ValidateInsertRaw(ctx context.Context, collection string, doc bson.Raw) error {
+	c, ok := d.Collections[collection]
+	if !ok {
+		if d.DenyUnknownCollections {
+			return fmt.Errorf("unknown Collection %v not allowed", collection)
+		}
+		return nil
+	}
+	if c.EnforceSchemaByCollectionLogOnly {
+		if err := c.ValidateInsertRaw(ctx, doc); err != nil {
+			schemaDenyLogOnly.WithLabelValues(collection, "insert").Inc()
+			logrus.Errorf("COLLECTION ENFORCE LOG ONLY: %s", err.Error())
+			return nil
+		}
+	}
+
+	return c.ValidateInsertRaw(ctx, doc)
+}
+
+// ValidateInsertRaw validates the raw document as ValidateInsert would, walking
+// its bytes rather than decoding it if the schema of the collection only needs
+// type and presence checks.
+func (c *Collection) ValidateInsertRaw(ctx context.Context, doc bson.Raw) error {
+	if !c.EnforceSchema && !c.EnforceSchemaByCollectionLogOnly {
+		return nil
+	}
+	// The policies of time-series collections check the values of the document
+	if c.raw != nil && c.TimeSeries == nil {
+		if err := validateRaw(bsoncore.Document(doc), c.raw, c.DenyUnknownFields); err != errRawFallback {
+			return err
+		}
+	}
+	var obj bson.D
+	if err := bson.Unmarshal(doc, &obj); err != nil {
+		return err
+	}
+	return c.ValidateInsert(ctx, obj)
+}
+
+// validateRaw validates the document's fields against the compiled fields
+func validateRaw(doc bsoncore.Document, rf *rawFields, denyUnknownFields bool) error {
+	if len(doc) < 5 {
+		return errRawFallback
+	}
+	// the fields seen, on the stack for all but the largest schemas
+	var buf [32]bool
+	var seen []bool
+	if len(rf.list) > len(buf) {
+		seen = make([]bool, len(rf.list))
+	} else {
+		seen = buf[:len(rf.list)]
+	}
+
+	// Scan the whole document after an error as a later duplicate of the field
+	// would replace the value checked
+	var firstErr error
+	rem := doc[4 : len(doc)-1]
+	for len(rem) > 0 {
+		var (
+			elem bsoncore.Element
+			ok   bool
+		)
+		if elem, rem, ok = bsoncore.ReadElement(rem); !ok {
+			return errRawFallback
+		}
+		f, ok := rf.byName[string(elem.KeyBytes())]
+		if !ok {
+			if denyUnknownFields {
+				return fmt.Errorf("unknown fields are not allowed")
+			}
+			continue
+		}
+		if seen[f.index] {
+			return errRawFallback
+		}
+		seen[f.index] = true
+		if firstErr != nil {
+			continue
+		}
+
+		v := elem.Value()
+		if rawEmpty(v) {
+			if f.required {
+				firstErr = fmt.Errorf("missing required field: %s, or value: %s", f.name, v)
+			}
+			continue
+		}
+		if err := validateRawValue(f, v, denyUnknownFields); err == errRawFallback {
+			return err
+		} else if err != nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+
+	for _, f := range rf.list {
+		if f.required && !seen[f.index] {
+			return fmt.Errorf("missing required field: %s", f.name)
+		}
+	}
+	return nil
+}
+
+func validateRawValue(f *rawField, v bsoncore.Value, denyUnknownFields bool) error {
+	if !f.array {
+		return validateRawElement(f, v, denyUnknownFields)
+	}
+	if v.Type != bsontype.Array {
+		return fmt.Errorf("wrong data type: expecting an array for field %s, but got %s", f.name, v.Type)
+	}
+	arr, _, ok := bsoncore.ReadArray(v.Data)
+	if !ok || len(arr) < 5 {
+		return errRawFallback
+	}
+	rem := arr[4 : len(arr)-1]
+	for len(rem) > 0 {
+		var (
+			elem bsoncore.Element
+			ok   bool
+		)
+		if elem, rem, ok = bsoncore.ReadElement(rem); !ok {
+			return errRawFallback
+		}
+		if err := validateRawElement(f, elem.Value(), denyUnknownFields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateRawElement validates the type of the value (an element of arrays)
+func validateRawElement(f *rawField, v bsoncore.Value, denyUnknownFields bool) error {
+	for _, t := range f.types {
+		if v.Type != t {
+			continue
+		}
+		if f.sub != nil {
+			sub, _, ok := bsoncore.ReadDocument(v.Data)
+			if !ok {
+				return errRawFallback
+			}
+			return validateRaw(sub, f.sub, denyUnknownFields)
+		}
+		return nil
+	}
+	return fmt.Errorf("wrong data type for field %s: %s", f.name, v.Type)
+}
+
+// rawEmpty returns whether the value is null or an empty array or document, which
+// don't satisfy required fields (see CheckObjectNonEmpty)
+func rawEmpty(v bsoncore.Value) bool {
+	switch v.Type {
+	case bsontype.Null:
+		return true
+	case bsontype.Array, bsontype.EmbeddedDocument:
+		// an empty document is its length and terminating null
+		return len(v.Data) == 5
+	}
+	return false
+}
+
+func sortedFieldKeys(m map[string]CollectionField) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
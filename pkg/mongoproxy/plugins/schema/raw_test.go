@@ -0,0 +1,175 @@
+package schema
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func loadExampleSchema(t testing.TB) *ClusterSchema {
+	buf, err := ioutil.ReadFile("example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema ClusterSchema
+	if err := json.Unmarshal(buf, &schema); err != nil {
+		t.Fatal(err)
+	}
+	return &schema
+}
+
+func TestValidateInsertRaw(t *testing.T) {
+	schema := loadExampleSchema(t)
+
+	// The raw validation of the insert tests matches the validation of the decoded
+	// documents
+	rawValidated := 0
+	for i, test := range insertTests {
+		c, ok := schema.Databases[test.DB].Collections[test.Collection]
+		if !ok {
+			continue
+		}
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			doc, err := bson.Marshal(test.In)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.ValidateInsertRaw(context.TODO(), doc)
+			if (err != nil) != test.Err {
+				t.Fatalf("expected err=%v, got %v for %v", test.Err, err, test.In)
+			}
+		})
+		if c.raw != nil {
+			rawValidated++
+		}
+	}
+	if rawValidated == 0 {
+		t.Fatal("expected some collections to be validated raw")
+	}
+
+	c := &Collection{EnforceSchema: true, Fields: map[string]CollectionField{
+		"a": {Type: STRING, Required: true},
+		"b": {Type: OBJECT, SubFields: map[string]CollectionField{"c": {Type: INT, Required: true}}},
+		"d": {Type: INT_ARRAY, IsArray: true},
+	}, DenyUnknownFields: true}
+	c.compile()
+	if c.raw == nil {
+		t.Fatal("expected the collection to be validated raw")
+	}
+	tests := []struct {
+		in  bson.D
+		err bool
+	}{
+		{bson.D{{"a", "x"}}, false},
+		{bson.D{{"a", ""}}, false},
+		{bson.D{{"a", nil}}, true},
+		{bson.D{{"a", 1}}, true},
+		{bson.D{{"b", bson.D{{"c", 1}}}}, true},
+		{bson.D{{"a", "x"}, {"b", bson.D{{"c", 1}}}}, false},
+		{bson.D{{"a", "x"}, {"b", bson.D{}}}, false},
+		{bson.D{{"a", "x"}, {"b", bson.D{{"c", "1"}}}}, true},
+		{bson.D{{"a", "x"}, {"b", bson.D{{"c", 1}, {"e", 1}}}}, true},
+		{bson.D{{"a", "x"}, {"d", bson.A{1, int64(2)}}}, false},
+		{bson.D{{"a", "x"}, {"d", bson.A{1, "2"}}}, true},
+		{bson.D{{"a", "x"}, {"d", bson.A{1, nil}}}, true},
+		{bson.D{{"a", "x"}, {"d", 1}}, true},
+		{bson.D{{"a", "x"}, {"e", 1}}, true},
+		// Duplicate fields fall back to validating the decoded document (the last)
+		{bson.D{{"a", 1}, {"a", "x"}}, false},
+		{bson.D{{"a", "x"}, {"a", 1}}, true},
+	}
+	for i, test := range tests {
+		doc, err := bson.Marshal(test.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rawErr := c.ValidateInsertRaw(context.TODO(), doc)
+		decodedErr := c.ValidateInsert(context.TODO(), test.in)
+		if (rawErr != nil) != test.err || (decodedErr != nil) != test.err {
+			t.Errorf("%d %v: expected err=%v, got raw=%v decoded=%v", i, test.in, test.err, rawErr, decodedErr)
+		}
+	}
+}
+
+// rawInsert returns the insert of the documents kept raw, as parsed from a
+// document sequence
+func rawInsert(t *testing.T, db, collection string, docs ...bson.D) *command.Insert {
+	raw := make([]bson.Raw, len(docs))
+	for i, doc := range docs {
+		b, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw[i] = b
+	}
+	insert := &command.Insert{}
+	if err := insert.FromBSOND(bson.D{{"insert", collection}, {"documents", raw}, {"$db", db}}); err != nil {
+		t.Fatal(err)
+	}
+	return insert
+}
+
+func TestProcessInsertRaw(t *testing.T) {
+	p := &SchemaPlugin{}
+	if err := p.Configure(bson.D{{"schemaPath", "example.json"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var forwarded *command.Insert
+	next := func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+		forwarded = r.Command.(*command.Insert)
+		return bson.D{{"ok", 1}}, nil
+	}
+
+	for i, test := range insertTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			forwarded = nil
+			insert := rawInsert(t, test.DB, test.Collection, test.In)
+			result, err := p.Process(context.TODO(), &plugins.Request{CommandName: "insert", Command: insert}, next)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bsonutil.Ok(result) == test.Err {
+				t.Fatalf("expected err=%v, got %v for %v", test.Err, result, test.In)
+			}
+			if test.Err {
+				return
+			}
+			// The documents are forwarded raw
+			if forwarded == nil || forwarded.RawDocuments == nil || forwarded.Documents != nil {
+				t.Fatalf("expected the raw documents to be forwarded, got %v", forwarded)
+			}
+		})
+	}
+
+	// The documents of collections with transforms are decoded to be normalized
+	dir, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "schema.json")
+	if err := ioutil.WriteFile(path, []byte(normalizeSchema), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Configure(bson.D{{"schemaPath", path}}); err != nil {
+		t.Fatal(err)
+	}
+	insert := rawInsert(t, "shop", "users", bson.D{{"email", " Foo@Example.COM"}})
+	if _, err := p.Process(context.TODO(), &plugins.Request{CommandName: "insert", Command: insert}, next); err != nil {
+		t.Fatal(err)
+	}
+	if forwarded.RawDocuments != nil || forwarded.Documents[0][0].Value != "foo@example.com" {
+		t.Fatalf("expected the normalized document to be forwarded, got %v", forwarded.Documents)
+	}
+}
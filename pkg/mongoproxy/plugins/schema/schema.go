@@ -3,7 +3,13 @@ package schema
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -12,9 +18,11 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
+	"gopkg.in/yaml.v3"
 
 	"github.com/wish/mongoproxy/pkg/bsonutil"
 	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/filewatch"
 	"github.com/wish/mongoproxy/pkg/mongoerror"
 	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
 )
@@ -37,6 +45,21 @@ var (
 		Name: "mongoproxy_plugins_schema_deny_logonly_total",
 		Help: "The total deny returns of a command",
 	}, []string{"collection", "command"})
+
+	unknownFilterFields = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_schema_unknown_filter_field_total",
+		Help: "The total reads referencing fields that aren't in the schema",
+	}, []string{"db", "collection", "command"})
+
+	filterTypeMismatch = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_schema_filter_type_mismatch_total",
+		Help: "The total filters comparing fields against values of another type than the schema's",
+	}, []string{"db", "collection", "command"})
+
+	schemaNormalized = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_schema_normalized_total",
+		Help: "The total documents and updates changed by the transforms of their fields",
+	}, []string{"db", "collection", "command"})
 )
 
 const (
@@ -52,10 +75,36 @@ func init() {
 }
 
 type SchemaPluginConfig struct {
-	// SchemaPath is the path on disk to the schema file to load + watch for changes
+	// SchemaPath is the path on disk to the schema file to load + watch for changes;
+	// JSON, or YAML if the extension is .yaml or .yml
 	SchemaPath string `bson:"schemaPath"`
 	// Log EnforceSchema errors
 	EnforceSchemaLogOnly bool `bson:"enforceSchemaLogOnly"`
+	// FilterFields validates that the fields referenced by reads (find filters, count
+	// and distinct queries and the leading $match stages of aggregates) are in the
+	// collection's schema; "warn" logs unknown fields and "strict" rejects the
+	// request (default ""; off)
+	FilterFields string `bson:"filterFields"`
+	// FilterTypes validates that the values filters (of reads as well as update,
+	// delete and findAndModify selectors) compare fields against are of the fields'
+	// types in the schema, as mismatched types silently match nothing; "warn" logs
+	// mismatches and "strict" rejects the request (default ""; off)
+	FilterTypes string `bson:"filterTypes"`
+	// StrictUpserts validates the document an upsert would insert (the query's
+	// equality fields with the update applied) as an insert, including required
+	// fields (default false; only the fields set by the upsert are validated)
+	StrictUpserts bool `bson:"strictUpserts"`
+	// ShapeCacheSize enables caching the shapes (field names and value types) of
+	// valid inserts per collection, up to this many, to skip validating inserts of
+	// shapes already proven valid (default 0; disabled)
+	ShapeCacheSize int `bson:"shapeCacheSize"`
+	// LookupSets are the sets of values fields can be restricted to (with "lookup"
+	// in the schema), loaded from files or backend collections and refreshed
+	// periodically
+	LookupSets []LookupSetConfig `bson:"lookupSets"`
+	// GraphQL generates a GraphQL schema from the collection schemas, answering
+	// read-only queries of the data API (experimental; default false)
+	GraphQL bool `bson:"graphQL"`
 }
 
 // This is a plugin that handles sending the request to the acutual downstream mongo
@@ -63,6 +112,16 @@ type SchemaPlugin struct {
 	conf SchemaPluginConfig
 
 	s atomic.Value
+
+	watcher *filewatch.Watcher
+	stop    chan struct{}
+
+	recorderLock sync.RWMutex
+	recorder     plugins.ChangeRecorder
+
+	lookups map[string]*lookupSet
+	crLock  sync.RWMutex
+	cr      plugins.CommandRunner
 }
 
 func (p *SchemaPlugin) Name() string { return Name }
@@ -88,18 +147,117 @@ func (p *SchemaPlugin) LoadSchema() (err error) {
 	if err != nil {
 		return err
 	}
+	switch strings.ToLower(filepath.Ext(p.conf.SchemaPath)) {
+	case ".yaml", ".yml":
+		if b, err = yamlToJSON(b); err != nil {
+			return fmt.Errorf("%s: %w", p.conf.SchemaPath, err)
+		}
+	}
 
 	var schema ClusterSchema
 	if err := json.Unmarshal(b, &schema); err != nil {
 		return err
 	}
 
+	if err := schema.setLookupSets(p.lookups); err != nil {
+		return err
+	}
+	if p.conf.ShapeCacheSize > 0 {
+		schema.setShapeCaches(p.conf.ShapeCacheSize)
+	}
+
+	hash := xxhash.Sum64(b)
+	schema.version = strconv.FormatUint(hash, 16)
+	schema.loadedAt = time.Now()
+	if p.conf.GraphQL {
+		schema.graphQL = newGraphQLSchema(&schema)
+	}
+	old := p.GetSchema()
 	p.s.Store(&schema)
-	schemaVersion.Set(float64(xxhash.Sum64(b)))
+	schemaVersion.Set(float64(hash))
 
+	// The initial load is part of the plugin config rather than a change
+	if old != nil {
+		p.recordChange(old, &schema)
+	}
 	return nil
 }
 
+// yamlToJSON converts a YAML schema to JSON, resolving its anchors, aliases and
+// merge keys (e.g. "<<: *common" to share fields between collections)
+func yamlToJSON(b []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(v)
+}
+
+// SetChangeRecorder sets the recorder schema reloads are recorded with
+func (p *SchemaPlugin) SetChangeRecorder(r plugins.ChangeRecorder) {
+	p.recorderLock.Lock()
+	defer p.recorderLock.Unlock()
+	p.recorder = r
+}
+
+// recordChange records the changed databases and collections of a schema reload
+func (p *SchemaPlugin) recordChange(old, new *ClusterSchema) {
+	p.recorderLock.RLock()
+	r := p.recorder
+	p.recorderLock.RUnlock()
+	if r == nil {
+		return
+	}
+	r.RecordChange(plugins.Change{
+		Kind:   Name,
+		Source: "file",
+		Diff:   plugins.DiffLines(schemaLines(old), schemaLines(new)),
+	})
+}
+
+// schemaLines returns the schema as lines to diff: the settings of the cluster,
+// then of each database followed by each of its collections (sorted)
+func schemaLines(s *ClusterSchema) []string {
+	line := func(prefix string, v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return prefix + " " + err.Error()
+		}
+		return prefix + " " + string(b)
+	}
+
+	lines := []string{line("cluster", struct {
+		MongosEndpoint       string            `json:"mongosEndpoint"`
+		Annotations          map[string]string `json:"annotations,omitempty"`
+		DenyUnknownDatabases bool              `json:"denyUnknownDatabases,omitempty"`
+	}{s.MongosEndpoint, s.Annotations, s.DenyUnknownDatabases})}
+	dbNames := make([]string, 0, len(s.Databases))
+	for name := range s.Databases {
+		dbNames = append(dbNames, name)
+	}
+	sort.Strings(dbNames)
+	for _, dbName := range dbNames {
+		db := s.Databases[dbName]
+		lines = append(lines, line(dbName, struct {
+			Annotations            map[string]string `json:"annotations,omitempty"`
+			DenyUnknownCollections bool              `json:"denyUnknownCollections,omitempty"`
+		}{db.Annotations, db.DenyUnknownCollections}))
+
+		collNames := make([]string, 0, len(db.Collections))
+		for name := range db.Collections {
+			collNames = append(collNames, name)
+		}
+		sort.Strings(collNames)
+		for _, collName := range collNames {
+			lines = append(lines, line(dbName+"."+collName, db.Collections[collName]))
+		}
+	}
+	return lines
+}
+
 // Configure configures this plugin with the given configuration object. Returns
 // an error if the configuration is invalid for the plugin.
 func (p *SchemaPlugin) Configure(d bson.D) error {
@@ -113,42 +271,247 @@ func (p *SchemaPlugin) Configure(d bson.D) error {
 		return err
 	}
 
+	switch p.conf.FilterFields {
+	case "", "warn", "strict":
+	default:
+		return fmt.Errorf("invalid filterFields %q; must be one of warn, strict", p.conf.FilterFields)
+	}
+	switch p.conf.FilterTypes {
+	case "", "warn", "strict":
+	default:
+		return fmt.Errorf("invalid filterTypes %q; must be one of warn, strict", p.conf.FilterTypes)
+	}
+	if p.conf.ShapeCacheSize < 0 {
+		return fmt.Errorf("shapeCacheSize must not be negative")
+	}
+
+	// Sets of files are loaded now, those of collections once started
+	p.lookups = make(map[string]*lookupSet, len(p.conf.LookupSets))
+	for _, conf := range p.conf.LookupSets {
+		set, err := newLookupSet(conf)
+		if err != nil {
+			return err
+		}
+		if _, ok := p.lookups[conf.Name]; ok {
+			return fmt.Errorf("duplicate lookup set %s", conf.Name)
+		}
+		if conf.File != "" {
+			if err := set.load(context.Background(), nil); err != nil {
+				return err
+			}
+		}
+		p.lookups[conf.Name] = set
+	}
+
 	// load schema
-	if err := p.LoadSchema(); err != nil {
+	return p.LoadSchema()
+}
+
+// SetCommandRunner sets the runner lookup sets are loaded from collections with
+func (p *SchemaPlugin) SetCommandRunner(cr plugins.CommandRunner) {
+	p.crLock.Lock()
+	defer p.crLock.Unlock()
+	p.cr = cr
+}
+
+func (p *SchemaPlugin) commandRunner() plugins.CommandRunner {
+	p.crLock.RLock()
+	defer p.crLock.RUnlock()
+	return p.cr
+}
+
+// Start watches the schema file for changes (as well as reloading it periodically)
+// and loads the lookup sets of collections, refreshing all of them periodically
+func (p *SchemaPlugin) Start(ctx context.Context) error {
+	w, err := filewatch.New([]string{p.conf.SchemaPath}, filewatch.DefaultDebounce, func() {
+		logrus.Infof("Schema file changed, reloading")
+		if err := p.LoadSchema(); err != nil {
+			logrus.Errorf("Error reloading schema: %v", err)
+		}
+	})
+	if err != nil {
 		return err
 	}
+	p.watcher = w
+	p.stop = make(chan struct{})
 
 	go func() {
+		ticker := time.NewTicker(5 * time.Minute)
+		defer ticker.Stop()
 		for {
-			p.LoadSchema()
-			time.Sleep(5 * time.Minute)
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				p.LoadSchema()
+			}
 		}
 	}()
 
+	for _, set := range p.lookups {
+		if set.conf.Collection == "" {
+			continue
+		}
+		// Values aren't checked until the set loads, which is retried on refresh
+		if err := set.load(ctx, p.commandRunner()); err != nil {
+			logrus.Errorf("Error loading %v", err)
+		}
+	}
+	p.refreshLookupSets()
+
 	return nil
 }
 
+// Stop stops watching the schema file
+func (p *SchemaPlugin) Stop(ctx context.Context) error {
+	if p.stop == nil {
+		return nil
+	}
+	close(p.stop)
+	return p.watcher.Close()
+}
+
+// validateFilterFields validates the fields referenced by a read (see FilterFields);
+// it returns the error response if the read is rejected
+func (p *SchemaPlugin) validateFilterFields(ctx context.Context, r *plugins.Request, db, collection string, filters []bson.D, fields ...string) bson.D {
+	if p.conf.FilterFields == "" {
+		return nil
+	}
+	c := p.GetSchema().GetCollection(db, collection)
+	if c == nil {
+		return nil
+	}
+
+	err := c.ValidateFields(ctx, fields...)
+	for i := 0; err == nil && i < len(filters); i++ {
+		err = c.ValidateFilterFields(ctx, filters[i])
+	}
+	if err == nil {
+		return nil
+	}
+
+	unknownFilterFields.WithLabelValues(db, collection, r.CommandName).Inc()
+	logrus.Warningf("SCHEMA FILTER ERROR: %s, in db: %s, collection: %s, with cmd: %s",
+		err.Error(), db, collection, r.CommandName)
+	if p.conf.FilterFields == "strict" {
+		return mongoerror.BadValue.ErrMessage(err.Error())
+	}
+	return nil
+}
+
+// validateFilterTypes validates the types of the values the filters compare fields
+// against (see FilterTypes); it returns the error response if the request is rejected
+func (p *SchemaPlugin) validateFilterTypes(ctx context.Context, r *plugins.Request, db, collection string, filters ...bson.D) bson.D {
+	if p.conf.FilterTypes == "" {
+		return nil
+	}
+	c := p.GetSchema().GetCollection(db, collection)
+	if c == nil {
+		return nil
+	}
+
+	var err error
+	for i := 0; err == nil && i < len(filters); i++ {
+		err = c.ValidateFilterTypes(ctx, filters[i])
+	}
+	if err == nil {
+		return nil
+	}
+
+	filterTypeMismatch.WithLabelValues(db, collection, r.CommandName).Inc()
+	logrus.Warningf("SCHEMA FILTER TYPE ERROR: %s, in db: %s, collection: %s, with cmd: %s",
+		err.Error(), db, collection, r.CommandName)
+	if p.conf.FilterTypes == "strict" {
+		return mongoerror.BadValue.ErrMessage(err.Error())
+	}
+	return nil
+}
+
+// validateFilters validates the filters (and fields) of a read; it returns the
+// error response if the read is rejected
+func (p *SchemaPlugin) validateFilters(ctx context.Context, r *plugins.Request, db, collection string, filters []bson.D, fields ...string) bson.D {
+	if errDoc := p.validateFilterFields(ctx, r, db, collection, filters, fields...); errDoc != nil {
+		return errDoc
+	}
+	return p.validateFilterTypes(ctx, r, db, collection, filters...)
+}
+
+// leadingMatches returns the filters of the $match stages at the start of the pipeline
+func leadingMatches(pipeline bson.A) []bson.D {
+	var filters []bson.D
+	for _, raw := range pipeline {
+		stage, ok := raw.(bson.D)
+		if !ok || len(stage) != 1 || stage[0].Key != "$match" {
+			break
+		}
+		if filter, ok := stage[0].Value.(bson.D); ok {
+			filters = append(filters, filter)
+		}
+	}
+	return filters
+}
+
+// denyInsert returns the error response if the insert is rejected for the
+// validation error of one of its documents
+func (p *SchemaPlugin) denyInsert(r *plugins.Request, cmd *command.Insert, err error) bson.D {
+	if err == nil {
+		return nil
+	}
+	schemaDeny.WithLabelValues(cmd.Database, cmd.Collection, r.CommandName).Inc()
+	logrus.Warningf("ENFORCE SCHEMA ERROR: %s, in db: %s, collection: %s, with cmd: %s",
+		err.Error(), cmd.Database, cmd.Collection, r.CommandName)
+	if p.conf.EnforceSchemaLogOnly {
+		return nil
+	}
+	return mongoerror.DocumentValidationFailure.ErrMessage(err.Error())
+}
+
 // Process is the function executed when a message is called in the pipeline.
 func (p *SchemaPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
 	switch cmd := r.Command.(type) {
 	case *command.Insert:
 		schema := p.GetSchema()
-		for _, document := range cmd.Documents {
-			if err := schema.ValidateInsert(ctx, cmd.Database, cmd.Collection, document); err != nil {
-				schemaDeny.WithLabelValues(cmd.Database, cmd.Collection, r.CommandName).Inc()
-				logrus.Warningf("ENFORCE SCHEMA ERROR: %s, in db: %s, collection: %s, with cmd: %s",
-					err.Error(), cmd.Database, cmd.Collection, r.CommandName)
-				if !p.conf.EnforceSchemaLogOnly {
-					return mongoerror.DocumentValidationFailure.ErrMessage(err.Error()), nil
+		// Raw documents are validated without decoding them unless they may
+		// be normalized
+		if cmd.RawDocuments != nil && !schema.Transforms(cmd.Database, cmd.Collection) {
+			for _, document := range cmd.RawDocuments {
+				if errDoc := p.denyInsert(r, cmd, schema.ValidateInsertRaw(ctx, cmd.Database, cmd.Collection, document)); errDoc != nil {
+					return errDoc, nil
 				}
 			}
+			break
+		}
+		if err := cmd.DecodeDocuments(); err != nil {
+			return mongoerror.FailedToParse.ErrMessage(err.Error()), nil
+		}
+		for i, document := range cmd.Documents {
+			if doc, changed := schema.Normalize(cmd.Database, cmd.Collection, document); changed {
+				schemaNormalized.WithLabelValues(cmd.Database, cmd.Collection, r.CommandName).Inc()
+				r.SetDocument(i, doc)
+				document = doc
+			}
+			if errDoc := p.denyInsert(r, cmd, schema.ValidateInsert(ctx, cmd.Database, cmd.Collection, document)); errDoc != nil {
+				return errDoc, nil
+			}
 		}
 
 	case *command.FindAndModify:
+		if errDoc := p.validateFilterTypes(ctx, r, cmd.Database, cmd.Collection, cmd.Query); errDoc != nil {
+			return errDoc, nil
+		}
 		if len(cmd.Update) > 0 {
 			schema := p.GetSchema()
+			if u, changed := schema.NormalizeUpdate(cmd.Database, cmd.Collection, cmd.Update); changed {
+				schemaNormalized.WithLabelValues(cmd.Database, cmd.Collection, r.CommandName).Inc()
+				r.SetUpdate(0, u)
+			}
 			logrus.Debugf("command findAndModify: %s", cmd.Update)
-			if err := schema.ValidateUpdate(ctx, cmd.Database, cmd.Collection, cmd.Update, bsonutil.GetBoolDefault(cmd.Upsert, false)); err != nil {
+			upsert := bsonutil.GetBoolDefault(cmd.Upsert, false)
+			err := schema.ValidateUpdate(ctx, cmd.Database, cmd.Collection, cmd.Update, upsert)
+			if err == nil && upsert && p.conf.StrictUpserts {
+				err = schema.ValidateUpsert(ctx, cmd.Database, cmd.Collection, cmd.Query, cmd.Update)
+			}
+			if err != nil {
 				schemaDeny.WithLabelValues(cmd.Database, cmd.Collection, r.CommandName).Inc()
 				logrus.Warningf("ENFORCE SCHEMA ERROR: %s, in db: %s, collection: %s, with cmd: %s",
 					err.Error(), cmd.Database, cmd.Collection, r.CommandName)
@@ -158,11 +521,55 @@ func (p *SchemaPlugin) Process(ctx context.Context, r *plugins.Request, next plu
 			}
 		}
 
+	case *command.Find:
+		if errDoc := p.validateFilters(ctx, r, cmd.Database, cmd.Collection, []bson.D{cmd.Filter}); errDoc != nil {
+			return errDoc, nil
+		}
+
+	case *command.Count:
+		if errDoc := p.validateFilters(ctx, r, cmd.Database, cmd.Collection, []bson.D{cmd.Query}); errDoc != nil {
+			return errDoc, nil
+		}
+
+	case *command.Distinct:
+		if errDoc := p.validateFilters(ctx, r, cmd.Database, cmd.Collection, []bson.D{cmd.Query}, cmd.Key); errDoc != nil {
+			return errDoc, nil
+		}
+
+	case *command.Aggregate:
+		schema := p.GetSchema()
+		collection := cmd.GetCollection()
+		// countDocuments is an aggregate with a leading $match
+		if errDoc := p.validateFilters(ctx, r, cmd.Database, collection, leadingMatches(cmd.Pipeline)); errDoc != nil {
+			return errDoc, nil
+		}
+		if err := schema.ValidatePipeline(ctx, cmd.Database, collection, cmd.Pipeline); err != nil {
+			schemaDeny.WithLabelValues(cmd.Database, collection, r.CommandName).Inc()
+			logrus.Warningf("ENFORCE SCHEMA ERROR: %s, in db: %s, collection: %s, with cmd: %s",
+				err.Error(), cmd.Database, collection, r.CommandName)
+			if !p.conf.EnforceSchemaLogOnly {
+				return mongoerror.DocumentValidationFailure.ErrMessage(err.Error()), nil
+			}
+		}
+
 	case *command.Update:
 		schema := p.GetSchema()
-		for _, updateDoc := range cmd.Updates {
+		for i, updateDoc := range cmd.Updates {
+			if errDoc := p.validateFilterTypes(ctx, r, cmd.Database, cmd.Collection, updateDoc.Query); errDoc != nil {
+				return errDoc, nil
+			}
+			if u, changed := schema.NormalizeUpdate(cmd.Database, cmd.Collection, updateDoc.U); changed {
+				schemaNormalized.WithLabelValues(cmd.Database, cmd.Collection, r.CommandName).Inc()
+				r.SetUpdate(i, u)
+				updateDoc.U = u
+			}
 			logrus.Debugf("command Update wiht doc: %v", updateDoc)
-			if err := schema.ValidateUpdate(ctx, cmd.Database, cmd.Collection, updateDoc.U, bsonutil.GetBoolDefault(updateDoc.Upsert, false)); err != nil {
+			upsert := bsonutil.GetBoolDefault(updateDoc.Upsert, false)
+			err := schema.ValidateUpdate(ctx, cmd.Database, cmd.Collection, updateDoc.U, upsert)
+			if err == nil && upsert && p.conf.StrictUpserts {
+				err = schema.ValidateUpsert(ctx, cmd.Database, cmd.Collection, updateDoc.Query, updateDoc.U)
+			}
+			if err != nil {
 				schemaDeny.WithLabelValues(cmd.Database, cmd.Collection, r.CommandName).Inc()
 				logrus.Warningf("ENFORCE SCHEMA ERROR: %s, in db: %s, collection: %s, with cmd: %s",
 					err.Error(), cmd.Database, cmd.Collection, r.CommandName)
@@ -171,6 +578,15 @@ func (p *SchemaPlugin) Process(ctx context.Context, r *plugins.Request, next plu
 				}
 			}
 		}
+
+	case *command.Delete:
+		for _, deleteDoc := range cmd.Deletes {
+			q, _ := bsonutil.Lookup(deleteDoc, "q")
+			filter, _ := q.(bson.D)
+			if errDoc := p.validateFilterTypes(ctx, r, cmd.Database, cmd.Collection, filter); errDoc != nil {
+				return errDoc, nil
+			}
+		}
 	}
 	return next(ctx, r)
 }
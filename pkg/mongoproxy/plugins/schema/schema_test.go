@@ -2,8 +2,13 @@ package schema
 
 import (
 	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -81,6 +86,35 @@ func TestSchema(t *testing.T) {
 			cmd: bson.D{{"update", "requirea"}, {"updates", []bson.D{{{"u", bson.D{{"$set", bson.D{{"a", 1}}}}}}}}, {"$db", "testdb"}},
 			ok:  0,
 		},
+
+		//////////////////
+		// Aggregate Tests
+		//////////////////
+		{
+			cmd: bson.D{{"aggregate", "requireonlya"}, {"pipeline", bson.A{
+				bson.D{{"$match", bson.D{{"a", "x"}}}},
+				bson.D{{"$addFields", bson.D{{"b", bson.D{{"$concat", bson.A{"$a", "-"}}}}}}},
+				bson.D{{"$project", bson.D{{"a", 1}, {"b", 1}, {"c", "$b"}}}},
+				// After $project the schema no longer applies
+				bson.D{{"$project", bson.D{{"d", 1}}}},
+			}}, {"cursor", bson.D{}}, {"$db", "testdb"}},
+			ok: 1,
+		},
+		// Project an unknown field
+		{
+			cmd: bson.D{{"aggregate", "requireonlya"}, {"pipeline", bson.A{bson.D{{"$project", bson.D{{"typo", 1}}}}}}, {"cursor", bson.D{}}, {"$db", "testdb"}},
+			ok:  0,
+		},
+		// Reference an unknown field
+		{
+			cmd: bson.D{{"aggregate", "requireonlya"}, {"pipeline", bson.A{bson.D{{"$addFields", bson.D{{"b", "$typo"}}}}}}, {"cursor", bson.D{}}, {"$db", "testdb"}},
+			ok:  0,
+		},
+		// Set a field to a literal of the wrong type
+		{
+			cmd: bson.D{{"aggregate", "requireonlya"}, {"pipeline", bson.A{bson.D{{"$set", bson.D{{"a", 1}}}}}}, {"cursor", bson.D{}}, {"$db", "testdb"}},
+			ok:  0,
+		},
 	}
 
 	for i, test := range tests {
@@ -114,3 +148,106 @@ func TestSchema(t *testing.T) {
 		})
 	}
 }
+
+type changes []plugins.Change
+
+func (c *changes) RecordChange(change plugins.Change) { *c = append(*c, change) }
+
+func TestSchemaChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "schema.json")
+	write := func(s string) {
+		if err := ioutil.WriteFile(path, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"dbs": {"testdb": {"collections": {"a": {"enforceSchema": true}, "b": {}}}}}`)
+	p := &SchemaPlugin{}
+	if err := p.Configure(bson.D{{"schemaPath", path}}); err != nil {
+		t.Fatal(err)
+	}
+	var recorded changes
+	p.SetChangeRecorder(&recorded)
+
+	// Only the changed collections are in the diff
+	write(`{"dbs": {"testdb": {"collections": {"a": {"enforceSchema": false}, "b": {}, "c": {}}}}}`)
+	if err := p.LoadSchema(); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != 1 {
+		t.Fatalf("expected 1 change, got %v", recorded)
+	}
+	var changed []string
+	for _, line := range recorded[0].Diff {
+		changed = append(changed, strings.Fields(line)[:2]...)
+	}
+	if expected := []string{"-", "testdb.a", "+", "testdb.a", "+", "testdb.c"}; !reflect.DeepEqual(changed, expected) {
+		t.Fatalf("expected %v, got %v", expected, recorded[0].Diff)
+	}
+}
+
+func TestLoadSchemaYAML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "schema.yaml")
+	if err := ioutil.WriteFile(path, []byte(`
+common: &common
+  created_at: {type: date, required: true}
+  updated_at: {type: date}
+dbs:
+  testdb:
+    collections:
+      users:
+        enforceSchema: true
+        fields:
+          <<: *common
+          name: {type: string, required: true}
+      orders:
+        enforceSchema: true
+        fields: *common
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &SchemaPlugin{}
+	if err := p.Configure(bson.D{{"schemaPath", path}}); err != nil {
+		t.Fatal(err)
+	}
+	db := p.GetSchema().Databases["testdb"]
+	tests := []struct {
+		collection string
+		fields     []string
+	}{
+		{"users", []string{"created_at", "name", "updated_at"}},
+		{"orders", []string{"created_at", "updated_at"}},
+	}
+	for _, test := range tests {
+		var fields []string
+		for name := range db.Collections[test.collection].Fields {
+			fields = append(fields, name)
+		}
+		sort.Strings(fields)
+		if !reflect.DeepEqual(fields, test.fields) {
+			t.Fatalf("%s: expected fields %v, got %v", test.collection, test.fields, fields)
+		}
+	}
+	if f := db.Collections["users"].Fields["created_at"]; f.Type != DATE || !f.Required {
+		t.Fatalf("unexpected created_at field: %+v", f)
+	}
+
+	// Invalid YAML fails the load
+	if err := ioutil.WriteFile(path, []byte("dbs: [\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.LoadSchema(); err == nil {
+		t.Fatal("expected an error loading invalid YAML")
+	}
+}
@@ -0,0 +1,162 @@
+package schema
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var shapeCacheTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mongoproxy_plugins_schema_shape_cache_total",
+	Help: "The total inserts validated with the shape cache enabled, by whether their shape was cached as valid",
+}, []string{"result"})
+
+// shapeCache is the set of the shapes (field names and value types) of documents
+// which passed a collection's insert validation. Validation only depends on the
+// shape of a document, so a document of a cached shape is valid without walking
+// the schema. The cache is per collection of a loaded schema, so it's dropped when
+// the schema is reloaded.
+type shapeCache struct {
+	l      sync.RWMutex
+	size   int
+	shapes map[uint64]struct{}
+}
+
+func newShapeCache(size int) *shapeCache {
+	return &shapeCache{size: size, shapes: make(map[uint64]struct{})}
+}
+
+func (c *shapeCache) valid(shape uint64) bool {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	_, ok := c.shapes[shape]
+	return ok
+}
+
+// add adds a valid shape, evicting an arbitrary one if the cache is full
+func (c *shapeCache) add(shape uint64) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if len(c.shapes) >= c.size {
+		for k := range c.shapes {
+			delete(c.shapes, k)
+			break
+		}
+	}
+	c.shapes[shape] = struct{}{}
+}
+
+// setShapeCaches enables the shape cache (of size shapes) of the collections
+func (s *ClusterSchema) setShapeCaches(size int) {
+	for _, db := range s.Databases {
+		for name, c := range db.Collections {
+			c.shapes = newShapeCache(size)
+			db.Collections[name] = c
+		}
+	}
+}
+
+// documentShape returns the hash of the shape of the document: its field names
+// and the types of their values, recursively. It returns false if the document has
+// values of types the shape can't describe, which must be validated.
+func documentShape(obj bson.D) (uint64, bool) {
+	d := xxhash.New()
+	ok := writeShape(d, obj)
+	return d.Sum64(), ok
+}
+
+// The types of values in shapes
+const (
+	shapeNull byte = iota + 1
+	shapeInt32
+	shapeInt64
+	shapeInt
+	shapeFloat64
+	shapeString
+	shapeBool
+	shapeObjectID
+	shapeDateTime
+	shapeTime
+	shapeBinary
+	shapeDecimal
+	shapeRegex
+	shapeTimestamp
+	shapeDocument
+	shapeDocumentEnd
+	shapeArray
+	shapeArrayEnd
+)
+
+func writeShape(d *xxhash.Digest, v interface{}) bool {
+	var t byte
+	switch v := v.(type) {
+	case nil, primitive.Null:
+		t = shapeNull
+	case int32:
+		t = shapeInt32
+	case int64:
+		t = shapeInt64
+	case int:
+		t = shapeInt
+	case float64:
+		t = shapeFloat64
+	case string:
+		t = shapeString
+	case bool:
+		t = shapeBool
+	case primitive.ObjectID:
+		t = shapeObjectID
+	case primitive.DateTime:
+		t = shapeDateTime
+	case time.Time:
+		t = shapeTime
+	case primitive.Binary:
+		t = shapeBinary
+	case primitive.Decimal128:
+		t = shapeDecimal
+	case primitive.Regex:
+		t = shapeRegex
+	case primitive.Timestamp:
+		t = shapeTimestamp
+	case bson.D:
+		d.Write([]byte{shapeDocument})
+		for _, e := range v {
+			d.WriteString(e.Key)
+			d.Write([]byte{0})
+			if !writeShape(d, e.Value) {
+				return false
+			}
+		}
+		d.Write([]byte{shapeDocumentEnd})
+		return true
+	case primitive.A:
+		// Elements are validated independently, so runs of elements of the same
+		// shape are written once for arrays of any length to share a shape
+		d.Write([]byte{shapeArray})
+		var prev uint64
+		var b [8]byte
+		for i, e := range v {
+			ed := xxhash.New()
+			if !writeShape(ed, e) {
+				return false
+			}
+			if h := ed.Sum64(); i == 0 || h != prev {
+				binary.LittleEndian.PutUint64(b[:], h)
+				d.Write(b[:])
+				prev = h
+			}
+		}
+		d.Write([]byte{shapeArrayEnd})
+		return true
+	default:
+		return false
+	}
+	d.Write([]byte{t})
+	return true
+}
@@ -0,0 +1,91 @@
+package schema
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDocumentShape(t *testing.T) {
+	tests := []struct {
+		a, b  bson.D
+		equal bool
+	}{
+		{bson.D{{"a", 1}}, bson.D{{"a", 2}}, true},
+		{bson.D{{"a", "x"}}, bson.D{{"a", "y"}}, true},
+		{bson.D{{"a", int32(1)}}, bson.D{{"a", int64(1)}}, false},
+		{bson.D{{"a", 1}}, bson.D{{"b", 1}}, false},
+		{bson.D{{"a", 1}, {"b", 1}}, bson.D{{"ab", 1}}, false},
+		{bson.D{{"a", bson.D{{"b", 1}}}}, bson.D{{"a", bson.D{{"b", 2}}}}, true},
+		{bson.D{{"a", bson.D{{"b", 1}}}}, bson.D{{"a", bson.D{{"b", "x"}}}}, false},
+		{bson.D{{"a", bson.D{}}}, bson.D{{"a", bson.D{{"b", 1}}}}, false},
+		// Runs of elements of the same shape share a shape
+		{bson.D{{"a", bson.A{"x"}}}, bson.D{{"a", bson.A{"x", "y", "z"}}}, true},
+		{bson.D{{"a", bson.A{}}}, bson.D{{"a", bson.A{"x"}}}, false},
+		{bson.D{{"a", bson.A{"x", 1}}}, bson.D{{"a", bson.A{"x"}}}, false},
+		{bson.D{{"a", bson.A{bson.D{{"b", 1}}}}}, bson.D{{"a", bson.A{bson.D{{"c", 1}}}}}, false},
+		{bson.D{{"a", nil}}, bson.D{{"a", primitive.Null{}}}, true},
+		{bson.D{{"a", primitive.NewDateTimeFromTime(time.Now())}}, bson.D{{"a", int64(1)}}, false},
+	}
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			a, ok := documentShape(test.a)
+			if !ok {
+				t.Fatalf("no shape for %v", test.a)
+			}
+			b, ok := documentShape(test.b)
+			if !ok {
+				t.Fatalf("no shape for %v", test.b)
+			}
+			if (a == b) != test.equal {
+				t.Fatalf("expected shapes of %v and %v equal=%v", test.a, test.b, test.equal)
+			}
+		})
+	}
+
+	if _, ok := documentShape(bson.D{{"a", bson.M{"b": 1}}}); ok {
+		t.Fatal("expected no shape for a map value")
+	}
+}
+
+func TestShapeCache(t *testing.T) {
+	buf, err := ioutil.ReadFile("example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema ClusterSchema
+	if err := json.Unmarshal(buf, &schema); err != nil {
+		t.Fatal(err)
+	}
+	schema.setShapeCaches(1000)
+
+	// Validating twice (the second time with the valid shapes cached) gives the
+	// same results as without the cache
+	for pass := 0; pass < 2; pass++ {
+		for i, test := range insertTests {
+			err := schema.ValidateInsert(context.TODO(), test.DB, test.Collection, test.In)
+			if (err != nil) != test.Err {
+				t.Fatalf("pass %d test %d: expected err=%v, got %v", pass, i, test.Err, err)
+			}
+		}
+	}
+	c := schema.Databases["testdb"].Collections["testcollection"]
+	if len(c.shapes.shapes) == 0 {
+		t.Fatal("expected valid shapes to be cached")
+	}
+
+	// The cache is bounded
+	c.shapes = newShapeCache(2)
+	for i := 0; i < 10; i++ {
+		c.shapes.add(uint64(i))
+	}
+	if len(c.shapes.shapes) != 2 || !c.shapes.valid(9) {
+		t.Fatalf("unexpected cache %v", c.shapes.shapes)
+	}
+}
@@ -0,0 +1,183 @@
+package schema
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var timeSeriesDeny = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mongoproxy_plugins_schema_timeseries_deny_total",
+	Help: "The total writes to time-series collections violating their policies, by reason",
+}, []string{"reason"})
+
+// Reasons of time-series violations
+const (
+	timeSeriesTimeField   = "time_field"
+	timeSeriesMetaField   = "meta_field"
+	timeSeriesFuture      = "future"
+	timeSeriesPast        = "past"
+	timeSeriesCardinality = "cardinality"
+)
+
+// TimeSeries are the policies of the writes to a time-series collection
+type TimeSeries struct {
+	// TimeField is the field holding the date of the measurements (required)
+	TimeField string `json:"timeField"`
+	// MetaField is the field holding the metadata of the series; when set, it is
+	// required in inserted measurements
+	MetaField string `json:"metaField,omitempty"`
+	// MaxFuture and MaxPast are how far in the future and past of the proxy's clock
+	// the measurements' times may be (e.g. "1h"; empty for no limit)
+	MaxFuture string `json:"maxFuture,omitempty"`
+	MaxPast   string `json:"maxPast,omitempty"`
+	// MaxMetaCardinality is the maximum number of distinct values of the metaField
+	// (i.e. series, and so buckets) seen by the proxy since the schema was loaded (0
+	// for no maximum)
+	MaxMetaCardinality int `json:"maxMetaCardinality,omitempty"`
+
+	maxFuture, maxPast time.Duration
+	metas              *metaSet
+}
+
+// load validates and compiles the policies
+func (t *TimeSeries) load() error {
+	if t.TimeField == "" || strings.HasPrefix(t.TimeField, "$") {
+		return fmt.Errorf("invalid timeField %q", t.TimeField)
+	}
+	if strings.HasPrefix(t.MetaField, "$") || t.MetaField == t.TimeField {
+		return fmt.Errorf("invalid metaField %q", t.MetaField)
+	}
+	var err error
+	if t.MaxFuture != "" {
+		if t.maxFuture, err = time.ParseDuration(t.MaxFuture); err != nil || t.maxFuture < 0 {
+			return fmt.Errorf("invalid maxFuture %q", t.MaxFuture)
+		}
+	}
+	if t.MaxPast != "" {
+		if t.maxPast, err = time.ParseDuration(t.MaxPast); err != nil || t.maxPast < 0 {
+			return fmt.Errorf("invalid maxPast %q", t.MaxPast)
+		}
+	}
+	if t.MaxMetaCardinality < 0 {
+		return fmt.Errorf("maxMetaCardinality must not be negative")
+	}
+	if t.MaxMetaCardinality > 0 {
+		if t.MetaField == "" {
+			return fmt.Errorf("maxMetaCardinality requires a metaField")
+		}
+		t.metas = &metaSet{max: t.MaxMetaCardinality, values: make(map[uint64]struct{})}
+	}
+	return nil
+}
+
+// metaSet is the set of the (hashes of the) metaField values seen
+type metaSet struct {
+	l      sync.Mutex
+	max    int
+	values map[uint64]struct{}
+}
+
+// add adds the value, returning false if it is new and the set is full
+func (s *metaSet) add(v interface{}) bool {
+	b, err := bson.Marshal(bson.D{{"v", v}})
+	if err != nil {
+		return false
+	}
+	h := xxhash.Sum64(b)
+	s.l.Lock()
+	defer s.l.Unlock()
+	if _, ok := s.values[h]; ok {
+		return true
+	}
+	if len(s.values) >= s.max {
+		return false
+	}
+	s.values[h] = struct{}{}
+	return true
+}
+
+// deny counts the violation
+func (t *TimeSeries) deny(reason string, err error) error {
+	timeSeriesDeny.WithLabelValues(reason).Inc()
+	return err
+}
+
+// validate validates the fields of a measurement; with partial only the fields
+// present are checked (the fields set by an update)
+func (t *TimeSeries) validate(obj bson.D, partial bool, now time.Time) error {
+	var (
+		ts, meta       interface{}
+		hasTS, hasMeta bool
+	)
+	for _, e := range obj {
+		switch e.Key {
+		case t.TimeField:
+			ts, hasTS = e.Value, true
+		case t.MetaField:
+			meta, hasMeta = e.Value, true
+		}
+	}
+
+	if hasTS {
+		var at time.Time
+		switch v := ts.(type) {
+		case primitive.DateTime:
+			at = v.Time()
+		case time.Time:
+			at = v
+		default:
+			return t.deny(timeSeriesTimeField, fmt.Errorf("time-series timeField %s must be a date, got %T", t.TimeField, ts))
+		}
+		if t.maxFuture > 0 && at.After(now.Add(t.maxFuture)) {
+			return t.deny(timeSeriesFuture, fmt.Errorf("time-series %s %s is more than %s in the future", t.TimeField, at.UTC().Format(time.RFC3339), t.maxFuture))
+		}
+		if t.maxPast > 0 && at.Before(now.Add(-t.maxPast)) {
+			return t.deny(timeSeriesPast, fmt.Errorf("time-series %s %s is more than %s in the past", t.TimeField, at.UTC().Format(time.RFC3339), t.maxPast))
+		}
+	} else if !partial {
+		return t.deny(timeSeriesTimeField, fmt.Errorf("time-series timeField %s is required", t.TimeField))
+	}
+
+	if t.MetaField == "" {
+		return nil
+	}
+	if !hasMeta {
+		if partial {
+			return nil
+		}
+		return t.deny(timeSeriesMetaField, fmt.Errorf("time-series metaField %s is required", t.MetaField))
+	}
+	if t.metas != nil && !t.metas.add(meta) {
+		return t.deny(timeSeriesCardinality, fmt.Errorf("time-series metaField %s exceeds its maximum of %d distinct values", t.MetaField, t.MaxMetaCardinality))
+	}
+	return nil
+}
+
+// validateUpdate validates the time and meta fields set by the update (a
+// replacement document or its $set and $setOnInsert)
+func (t *TimeSeries) validateUpdate(obj bson.D, now time.Time) error {
+	if len(obj) == 0 {
+		return nil
+	}
+	if !strings.HasPrefix(obj[0].Key, "$") {
+		return t.validate(obj, true, now)
+	}
+	var fields bson.D
+	for _, e := range obj {
+		if e.Key != "$set" && e.Key != "$setOnInsert" {
+			continue
+		}
+		if set, ok := e.Value.(bson.D); ok {
+			fields = append(fields, set...)
+		}
+	}
+	return t.validate(fields, true, now)
+}
@@ -0,0 +1,109 @@
+package schema
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const timeSeriesSchema = `{
+	"dbs": {
+		"metrics": {
+			"collections": {
+				"cpu": {
+					"enforceSchema": true,
+					"fields": {
+						"ts": {"type": "date", "required": true},
+						"value": {"type": "double"}
+					},
+					"timeSeries": {
+						"timeField": "ts",
+						"metaField": "host",
+						"maxFuture": "1h",
+						"maxPast": "24h",
+						"maxMetaCardinality": 2
+					}
+				}
+			}
+		}
+	}
+}`
+
+func TestTimeSeries(t *testing.T) {
+	var schema ClusterSchema
+	if err := json.Unmarshal([]byte(timeSeriesSchema), &schema); err != nil {
+		t.Fatal(err)
+	}
+	at := func(d time.Duration) primitive.DateTime {
+		return primitive.NewDateTimeFromTime(time.Now().Add(d))
+	}
+
+	inserts := []struct {
+		doc bson.D
+		err bool
+	}{
+		{doc: bson.D{{"ts", at(0)}, {"host", "a"}, {"value", 1.5}}},
+		{doc: bson.D{{"ts", at(-time.Hour)}, {"host", bson.D{{"name", "b"}}}, {"value", 1.5}}},
+		// The time and meta fields are required
+		{doc: bson.D{{"host", "a"}, {"value", 1.5}}, err: true},
+		{doc: bson.D{{"ts", at(0)}, {"value", 1.5}}, err: true},
+		{doc: bson.D{{"ts", "2020-01-01"}, {"host", "a"}}, err: true},
+		// Times far in the future or past
+		{doc: bson.D{{"ts", at(2 * time.Hour)}, {"host", "a"}}, err: true},
+		{doc: bson.D{{"ts", at(-48 * time.Hour)}, {"host", "a"}}, err: true},
+		// The cardinality of the meta field is capped, known values are allowed
+		{doc: bson.D{{"ts", at(0)}, {"host", "c"}}, err: true},
+		{doc: bson.D{{"ts", at(0)}, {"host", "a"}}},
+		// Invalid fields are rejected before counting the meta value
+		{doc: bson.D{{"ts", at(0)}, {"host", "d"}, {"value", "x"}}, err: true},
+	}
+	for i, test := range inserts {
+		err := schema.ValidateInsert(context.TODO(), "metrics", "cpu", test.doc)
+		if (err != nil) != test.err {
+			t.Fatalf("insert %d: expected err=%v, got %v", i, test.err, err)
+		}
+	}
+
+	updates := []struct {
+		u   bson.D
+		err bool
+	}{
+		{u: bson.D{{"$set", bson.D{{"value", 2.5}}}}},
+		{u: bson.D{{"$set", bson.D{{"host", "a"}}}}},
+		{u: bson.D{{"$set", bson.D{{"host", "e"}}}}, err: true},
+		{u: bson.D{{"$set", bson.D{{"ts", at(3 * time.Hour)}}}}, err: true},
+	}
+	for i, test := range updates {
+		err := schema.ValidateUpdate(context.TODO(), "metrics", "cpu", test.u, false)
+		if (err != nil) != test.err {
+			t.Fatalf("update %d: expected err=%v, got %v", i, test.err, err)
+		}
+	}
+}
+
+func TestTimeSeriesLoad(t *testing.T) {
+	tests := []struct {
+		timeSeries string
+		ok         bool
+	}{
+		{timeSeries: `{"timeField": "ts"}`, ok: true},
+		{timeSeries: `{"timeField": "ts", "metaField": "host", "maxPast": "720h", "maxMetaCardinality": 100}`, ok: true},
+		{timeSeries: `{"metaField": "host"}`},
+		{timeSeries: `{"timeField": "ts", "metaField": "ts"}`},
+		{timeSeries: `{"timeField": "ts", "maxFuture": "soon"}`},
+		{timeSeries: `{"timeField": "ts", "maxMetaCardinality": 100}`},
+		// The time field must be a date
+		{timeSeries: `{"timeField": "value"}`},
+	}
+	for i, test := range tests {
+		var schema ClusterSchema
+		doc := `{"dbs": {"metrics": {"collections": {"cpu": {"fields": {"value": {"type": "double"}}, "timeSeries": ` + test.timeSeries + `}}}}}`
+		if err := json.Unmarshal([]byte(doc), &schema); (err == nil) != test.ok {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+}
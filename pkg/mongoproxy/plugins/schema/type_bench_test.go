@@ -6,6 +6,8 @@ import (
 	"io/ioutil"
 	"strconv"
 	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 var benchErr error
@@ -51,3 +53,53 @@ func BenchmarkSchemaUpdate(b *testing.B) {
 		})
 	}
 }
+
+func BenchmarkSchemaInsertShapeCache(b *testing.B) {
+	var schema ClusterSchema
+
+	buf, err := ioutil.ReadFile("example.json")
+	if err != nil {
+		panic(err)
+	}
+
+	if err := json.Unmarshal(buf, &schema); err != nil {
+		panic(err)
+	}
+	schema.setShapeCaches(1000)
+
+	for i, test := range insertTests {
+		b.Run(strconv.Itoa(i), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				benchErr = schema.ValidateInsert(context.TODO(), test.DB, test.Collection, test.In)
+			}
+		})
+	}
+}
+
+func BenchmarkSchemaInsertRaw(b *testing.B) {
+	schema := loadExampleSchema(b)
+
+	for i, test := range insertTests {
+		c, ok := schema.Databases[test.DB].Collections[test.Collection]
+		if !ok {
+			continue
+		}
+		doc, err := bson.Marshal(test.In)
+		if err != nil {
+			panic(err)
+		}
+		b.Run(strconv.Itoa(i)+"/decoded", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var obj bson.D
+				if benchErr = bson.Unmarshal(doc, &obj); benchErr == nil {
+					benchErr = c.ValidateInsert(context.TODO(), obj)
+				}
+			}
+		})
+		b.Run(strconv.Itoa(i)+"/raw", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				benchErr = c.ValidateInsertRaw(context.TODO(), doc)
+			}
+		})
+	}
+}
@@ -4,8 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"reflect"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
@@ -37,6 +37,10 @@ const (
 	NULL            BSONType = "null"
 	REGEX           BSONType = "regex"
 	DECIMAL128      BSONType = "decimal"
+	GEO_POINT       BSONType = "geoPoint"
+	GEO_LINE_STRING BSONType = "geoLineString"
+	GEO_POLYGON     BSONType = "geoPolygon"
+	LEGACY_POINT    BSONType = "legacyPoint"
 
 	SKIP_SCHEMA_ANNOTATION = "skipSchema"
 )
@@ -48,6 +52,12 @@ type ClusterSchema struct {
 	Annotations          map[string]string   `json:"annotations,omitempty"`
 	Databases            map[string]Database `json:"dbs"`
 	DenyUnknownDatabases bool                `json:"denyUnknownDatabases,omitempty"`
+
+	// version is the hash of the file the schema was loaded from, at loadedAt
+	version  string
+	loadedAt time.Time
+	// graphQL is the GraphQL schema generated from the schema, if enabled
+	graphQL *graphQLSchema
 }
 
 func (s *ClusterSchema) UnmarshalJSON(data []byte) error {
@@ -83,6 +93,15 @@ func (s *ClusterSchema) UnmarshalJSON(data []byte) error {
 				continue
 			}
 
+			if ts := collection.TimeSeries; ts != nil {
+				if err := ts.load(); err != nil {
+					return fmt.Errorf("%s.%s: %w", dbName, collectionName, err)
+				}
+				if f, ok := collection.Fields[ts.TimeField]; ok && f.Type != DATE {
+					return fmt.Errorf("%s.%s: timeField %s must be a date", dbName, collectionName, ts.TimeField)
+				}
+			}
+
 			if err := WalkCollectionFields(collection.Fields, func(fName string, f *CollectionField) error {
 				if strings.ToLower(collectionName) != collectionName {
 					return fmt.Errorf("field names must be lowercase: %s.%s %s", dbName, collectionName, fName)
@@ -90,6 +109,15 @@ func (s *ClusterSchema) UnmarshalJSON(data []byte) error {
 				if strings.HasPrefix(string(f.Type), "[]") {
 					f.IsArray = true
 				}
+				if err := f.loadDecimal(); err != nil {
+					return fmt.Errorf("%s.%s %s: %w", dbName, collectionName, fName, err)
+				}
+				if err := f.loadLookup(); err != nil {
+					return fmt.Errorf("%s.%s %s: %w", dbName, collectionName, fName, err)
+				}
+				if err := f.loadTransforms(); err != nil {
+					return fmt.Errorf("%s.%s %s: %w", dbName, collectionName, fName, err)
+				}
 				// TODO: check against types instead
 				if strings.Contains(string(f.Type), ".") && f.remoteCollection == nil {
 					ref := strings.Split(string(f.Type), ".")
@@ -111,6 +139,8 @@ func (s *ClusterSchema) UnmarshalJSON(data []byte) error {
 			}
 		}
 	}
+
+	s.compile()
 	return nil
 }
 
@@ -196,6 +226,20 @@ type Collection struct {
 	EnforceSchema bool `json:"enforceSchema,omitempty"`
 	// Whether we should enforce schema check logonly for this collection
 	EnforceSchemaByCollectionLogOnly bool `json:"enforceSchemaByCollectionLogOnly,omitempty"`
+	// The policies of a time-series collection
+	TimeSeries *TimeSeries `json:"timeSeries,omitempty"`
+
+	// paths is the compiled map of dotted path -> field (see compile())
+	paths map[string]*CollectionField
+	// shapes are the shapes of valid inserts, if the shape cache is enabled
+	shapes *shapeCache
+	// valueChecks is set if validating the fields depends on their values and not
+	// only on the shape of documents (e.g. geospatial coordinate ranges)
+	valueChecks bool
+	// transforms is set if fields have transforms to normalize their values with
+	transforms bool
+	// raw are the fields compiled to validate raw documents, if they can be
+	raw *rawFields
 }
 
 func (c *Collection) GetField(names ...string) *CollectionField {
@@ -232,7 +276,35 @@ func (c *Collection) ValidateInsert(ctx context.Context, obj bson.D) error {
 	if !c.EnforceSchema && !c.EnforceSchemaByCollectionLogOnly {
 		return nil
 	}
-	return Validate(ctx, obj, c.Fields, c.DenyUnknownFields, false)
+	if err := c.validateFields(ctx, obj); err != nil {
+		return err
+	}
+	if c.TimeSeries != nil {
+		return c.TimeSeries.validate(obj, false, time.Now())
+	}
+	return nil
+}
+
+// validateFields validates the fields of an inserted document, with the shape cache
+// if enabled
+func (c *Collection) validateFields(ctx context.Context, obj bson.D) error {
+	if c.shapes == nil || c.valueChecks {
+		return Validate(ctx, obj, c.Fields, c.DenyUnknownFields, false)
+	}
+
+	shape, ok := documentShape(obj)
+	if ok && c.shapes.valid(shape) {
+		shapeCacheTotal.WithLabelValues("hit").Inc()
+		return nil
+	}
+	shapeCacheTotal.WithLabelValues("miss").Inc()
+	if err := Validate(ctx, obj, c.Fields, c.DenyUnknownFields, false); err != nil {
+		return err
+	}
+	if ok {
+		c.shapes.add(shape)
+	}
+	return nil
 }
 
 // ValidateUpdate will validate the schema of the passed in object.
@@ -309,7 +381,7 @@ func (c *Collection) ValidateUpdate(ctx context.Context, obj bson.D, upsert bool
 
 	// Verify that unset fields aren't required
 	for k := range unsetFields {
-		f := c.GetField(strings.Split(k, ".")...)
+		f := c.lookupField(k)
 		if c.DenyUnknownFields && f == nil {
 			return fmt.Errorf("cannot unset unknown field: %s", k)
 		}
@@ -326,12 +398,12 @@ func (c *Collection) ValidateUpdate(ctx context.Context, obj bson.D, upsert bool
 			return fmt.Errorf("malformed rename of %s", oldK)
 		}
 		// Check that the old field exists
-		oldF := c.GetField(strings.Split(oldK, ".")...)
+		oldF := c.lookupField(oldK)
 		if c.DenyUnknownFields && oldF == nil {
 			return fmt.Errorf("cannot rename unknown field: %s", oldK)
 		}
 		// Check that the new field exists
-		newF := c.GetField(strings.Split(newK, ".")...)
+		newF := c.lookupField(newK)
 		if c.DenyUnknownFields && newF == nil {
 			return fmt.Errorf("cannot rename unknown field: %s", newK)
 		}
@@ -350,7 +422,7 @@ func (c *Collection) ValidateUpdate(ctx context.Context, obj bson.D, upsert bool
 
 	// verify setFields are of the correct type
 	for k, v := range setFields {
-		f := c.GetField(strings.Split(k, ".")...)
+		f := c.lookupField(k)
 		if c.DenyUnknownFields && f == nil {
 			return fmt.Errorf("cannot set unknown field: %s", k)
 		}
@@ -386,6 +458,9 @@ func (c *Collection) ValidateUpdate(ctx context.Context, obj bson.D, upsert bool
 		}
 		logrus.Debugf("finished Validate upsert true")
 	}
+	if c.TimeSeries != nil {
+		return c.TimeSeries.validateUpdate(obj, time.Now())
+	}
 	return nil
 }
 
@@ -397,10 +472,23 @@ type CollectionField struct {
 
 	// Various configuration options
 	Required bool `json:"required,omitempty"`
+	// Precision is the maximum number of digits, and Scale of decimal places, of
+	// decimal values (e.g. a scale of 2 for money)
+	Precision int  `json:"precision,omitempty"`
+	Scale     *int `json:"scale,omitempty"`
+	// Lookup is the name of the lookup set (configured in the plugin) the values
+	// must be in, e.g. country codes
+	Lookup string     `json:"lookup,omitempty"`
+	lookup *lookupSet // resolved by setLookupSets
+	// Transforms normalize string values on write, before they're validated, in
+	// order: trim, lowercase, nfc and stripControl
+	Transforms []string `json:"transforms,omitempty"`
 	//Default interface{} `json:"default,omitempty"`
 
 	// Field is a array type
-	IsArray bool
+	IsArray bool `json:",omitempty"`
+	// elemType is the precompiled element type for array types
+	elemType BSONType
 
 	// Optional subfields
 	SubFields map[string]CollectionField `json:"subfields,omitempty"`
@@ -460,11 +548,19 @@ func (c *CollectionField) ValidateElement(ctx context.Context, d interface{}, va
 
 // ValidateInsert will validate the schema of the passed in object.
 func (c *CollectionField) Validate(ctx context.Context, v interface{}, denyUnknownFields, isUpdate bool) error {
+	if c.lookup != nil && v != nil {
+		if err := c.lookup.validate(c.Name, v); err != nil {
+			return err
+		}
+	}
 	validateType := c.Type
-	interfaceType := fmt.Sprint(reflect.TypeOf(v))
 	if isUpdate { // array update is validating a scalar instead of []
-		if !strings.HasPrefix(interfaceType, "[]") && interfaceType != "primitive.A" {
-			validateType = BSONType(strings.Trim(string(validateType), "[]"))
+		if !isArrayValue(v) {
+			if c.elemType != "" {
+				validateType = c.elemType
+			} else {
+				validateType = elementType(validateType)
+			}
 		}
 	}
 	ok := false
@@ -625,7 +721,15 @@ func (c *CollectionField) Validate(ctx context.Context, v interface{}, denyUnkno
 		switch v.(type) {
 		case primitive.Decimal128:
 			ok = true
+			if err := c.validateDecimal(v); err != nil {
+				return err
+			}
+		}
+	case GEO_POINT, GEO_LINE_STRING, GEO_POLYGON, LEGACY_POINT:
+		if err := validateGeo(validateType, v); err != nil {
+			return fmt.Errorf("%s: %w", c.Name, err)
 		}
+		ok = true
 	default:
 		if c.remoteCollection != nil {
 			switch vTyped := v.(type) {
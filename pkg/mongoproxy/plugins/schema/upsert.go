@@ -0,0 +1,203 @@
+package schema
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ValidateUpsert will validate the document an upsert would insert (see
+// Collection.ValidateUpsert).
+func (s *ClusterSchema) ValidateUpsert(ctx context.Context, database, collection string, query, obj bson.D) error {
+	db, ok := s.Databases[database]
+	if !ok {
+		return nil
+	}
+
+	return db.ValidateUpsert(ctx, collection, query, obj)
+}
+
+// ValidateUpsert will validate the document an upsert would insert (see
+// Collection.ValidateUpsert).
+func (d *Database) ValidateUpsert(ctx context.Context, collection string, query, obj bson.D) error {
+	c, ok := d.Collections[collection]
+	if !ok {
+		return nil
+	}
+	if c.EnforceSchemaByCollectionLogOnly {
+		if err := c.ValidateUpsert(ctx, query, obj); err != nil {
+			schemaDenyLogOnly.WithLabelValues(collection, "upsert").Inc()
+			logrus.Errorf("COLLECTION ENFORCE LOG ONLY: %s", err.Error())
+			return nil
+		}
+	}
+
+	return c.ValidateUpsert(ctx, query, obj)
+}
+
+// ValidateUpsert will validate the document an upsert with the query and update
+// would insert as an insert (including required fields). ValidateUpdate only
+// validates the fields the upsert sets, which lets it create incomplete documents.
+func (c *Collection) ValidateUpsert(ctx context.Context, query, obj bson.D) error {
+	if !c.EnforceSchema && !c.EnforceSchemaByCollectionLogOnly {
+		return nil
+	}
+	doc, err := upsertDocument(query, obj)
+	if err != nil {
+		return err
+	}
+	if err := Validate(ctx, doc, c.Fields, c.DenyUnknownFields, false); err != nil {
+		return fmt.Errorf("upsert would insert an invalid document: %w", err)
+	}
+	return nil
+}
+
+// upsertDocument returns the document an upsert inserts: the equality fields of the
+// query with the update applied (or the replacement document with the query's
+// _id). The _id the server generates for documents without one isn't added, as
+// inserts are also validated without it.
+func upsertDocument(query, update bson.D) (bson.D, error) {
+	doc := make(bson.M)
+	queryFields := make(bson.M)
+	if err := equalityFields(query, queryFields); err != nil {
+		return nil, err
+	}
+
+	if len(update) > 0 && !strings.HasPrefix(update[0].Key, "$") {
+		// Replacement documents only get the query's _id
+		for _, e := range update {
+			doc[e.Key] = e.Value
+		}
+		if id, ok := queryFields["_id"]; ok {
+			if _, ok := doc["_id"]; !ok {
+				doc["_id"] = id
+			}
+		}
+	} else {
+		doc = queryFields
+		for _, e := range update {
+			fields, ok := e.Value.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("malformed %s", e.Key)
+			}
+			for _, f := range fields {
+				if hasArrayIndex(f.Key) {
+					continue
+				}
+				path := strings.Split(f.Key, ".")
+				switch e.Key {
+				case "$set", "$setOnInsert", "$inc", "$mul", "$min", "$max":
+					if err := SetValue(doc, path, f.Value); err != nil {
+						return nil, err
+					}
+				case "$currentDate":
+					var v interface{} = primitive.NewDateTimeFromTime(time.Now())
+					if spec, ok := f.Value.(bson.D); ok && len(spec) > 0 && spec[0].Key == "$type" && spec[0].Value == "timestamp" {
+						v = primitive.Timestamp{T: uint32(time.Now().Unix())}
+					}
+					if err := SetValue(doc, path, v); err != nil {
+						return nil, err
+					}
+				case "$push", "$addToSet":
+					v := primitive.A{f.Value}
+					if spec, ok := f.Value.(bson.D); ok && len(spec) > 0 && spec[0].Key == "$each" {
+						v, _ = spec[0].Value.(primitive.A)
+					}
+					if err := SetValue(doc, path, v); err != nil {
+						return nil, err
+					}
+				case "$unset":
+					unsetValue(doc, path)
+				case "$rename":
+					newKey, _ := f.Value.(string)
+					if v, ok := getValue(doc, path); ok && newKey != "" {
+						unsetValue(doc, path)
+						if err := SetValue(doc, strings.Split(newKey, "."), v); err != nil {
+							return nil, err
+						}
+					}
+				}
+				// $pull, $pullAll, $pop and $bit don't add fields to a new document
+			}
+		}
+	}
+
+	return ToBsonD(doc), nil
+}
+
+// equalityFields sets the fields matched by equality in the query (including in
+// $and) in m
+func equalityFields(query bson.D, m bson.M) error {
+	for _, e := range query {
+		if e.Key == "$and" {
+			items, _ := e.Value.(primitive.A)
+			for _, item := range items {
+				if sub, ok := item.(bson.D); ok {
+					if err := equalityFields(sub, m); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(e.Key, "$") || hasArrayIndex(e.Key) {
+			continue
+		}
+
+		v := e.Value
+		if ops, ok := v.(bson.D); ok && len(ops) > 0 && strings.HasPrefix(ops[0].Key, "$") {
+			eq, ok := ops.Map()["$eq"]
+			if !ok {
+				continue
+			}
+			v = eq
+		}
+		if _, ok := v.(primitive.Regex); ok {
+			continue
+		}
+		if err := SetValue(m, strings.Split(e.Key, "."), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasArrayIndex returns whether the path has array indexes or positional operators
+func hasArrayIndex(path string) bool {
+	for _, part := range strings.Split(path, ".") {
+		if isArrayIndex(part) {
+			return true
+		}
+	}
+	return false
+}
+
+// getValue returns the value at the path in m
+func getValue(m bson.M, path []string) (interface{}, bool) {
+	for _, k := range path[:len(path)-1] {
+		sub, ok := m[k].(bson.M)
+		if !ok {
+			return nil, false
+		}
+		m = sub
+	}
+	v, ok := m[path[len(path)-1]]
+	return v, ok
+}
+
+// unsetValue removes the value at the path in m
+func unsetValue(m bson.M, path []string) {
+	for _, k := range path[:len(path)-1] {
+		sub, ok := m[k].(bson.M)
+		if !ok {
+			return
+		}
+		m = sub
+	}
+	delete(m, path[len(path)-1])
+}
@@ -0,0 +1,34 @@
+package plugins
+
+// SchemaProvider is an optional interface a Plugin can implement to share the
+// collection schemas it enforces (e.g. the schema plugin) with other plugins
+type SchemaProvider interface {
+	// FieldType returns the type of the field (dotted path) in the collection's
+	// schema ("" if the schema doesn't declare it), and false if the collection
+	// has no schema
+	FieldType(db, collection, field string) (string, bool)
+}
+
+// SchemaProviderUser is an optional interface a Plugin can implement to be passed
+// the SchemaProvider of its chain (the first plugin implementing SchemaProvider)
+// when the chain is built, like CommandRunnerUser.
+type SchemaProviderUser interface {
+	SetSchemaProvider(SchemaProvider)
+}
+
+// SetSchemaProviders passes the first SchemaProvider in the plugins to all the
+// plugins implementing SchemaProviderUser
+func SetSchemaProviders(ps []Plugin) {
+	var sp SchemaProvider
+	for _, p := range ps {
+		if s, ok := Unwrap(p).(SchemaProvider); ok {
+			sp = s
+			break
+		}
+	}
+	for _, p := range ps {
+		if u, ok := Unwrap(p).(SchemaProviderUser); ok {
+			u.SetSchemaProvider(sp)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package plugins
+
+import (
+	"context"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/command"
+)
+
+// Scope defines which requests a plugin is run for. Empty lists match everything;
+// the Skip* lists take precedence over the inclusion lists.
+type Scope struct {
+	// Databases to run the plugin for
+	Databases []string `bson:"databases"`
+	// Collections to run the plugin for; either "collection" or "db.collection"
+	// ("db.*" matches all collections in db)
+	Collections []string `bson:"collections"`
+	// Commands to run the plugin for
+	Commands []string `bson:"commands"`
+
+	// SkipDatabases are databases to skip the plugin for
+	SkipDatabases []string `bson:"skipDatabases"`
+	// SkipCollections are collections to skip the plugin for (same format as Collections)
+	SkipCollections []string `bson:"skipCollections"`
+	// SkipCommands are commands to skip the plugin for
+	SkipCommands []string `bson:"skipCommands"`
+
+	databases, collections, commands             map[string]struct{}
+	skipDatabases, skipCollections, skipCommands map[string]struct{}
+}
+
+func toSet(items []string) map[string]struct{} {
+	if len(items) == 0 {
+		return nil
+	}
+	m := make(map[string]struct{}, len(items))
+	for _, item := range items {
+		m[item] = struct{}{}
+	}
+	return m
+}
+
+// Compile prepares the scope for Match; it must be called once the scope is decoded
+func (s *Scope) Compile() {
+	s.databases = toSet(s.Databases)
+	s.collections = toSet(s.Collections)
+	s.commands = toSet(s.Commands)
+	s.skipDatabases = toSet(s.SkipDatabases)
+	s.skipCollections = toSet(s.SkipCollections)
+	s.skipCommands = toSet(s.SkipCommands)
+}
+
+// IsZero returns whether the scope matches all requests
+func (s *Scope) IsZero() bool {
+	return s == nil || (len(s.Databases) == 0 && len(s.Collections) == 0 && len(s.Commands) == 0 &&
+		len(s.SkipDatabases) == 0 && len(s.SkipCollections) == 0 && len(s.SkipCommands) == 0)
+}
+
+// matchCollection returns whether the namespace is in the collection set
+func matchCollection(set map[string]struct{}, db, collection string) bool {
+	if _, ok := set[collection]; ok {
+		return true
+	}
+	if _, ok := set[db+"."+collection]; ok {
+		return true
+	}
+	_, ok := set[db+".*"]
+	return ok
+}
+
+// Match returns whether the request is in scope
+func (s *Scope) Match(r *Request) bool {
+	return s.match(r.CommandName, command.GetCommandDatabase(r.Command), command.GetCommandCollection(r.Command))
+}
+
+func (s *Scope) match(commandName, db, collection string) bool {
+	if _, ok := s.skipCommands[commandName]; ok {
+		return false
+	}
+	if s.commands != nil {
+		if _, ok := s.commands[commandName]; !ok {
+			return false
+		}
+	}
+	return s.MatchNamespace(db, collection)
+}
+
+// MatchNamespace returns whether the namespace is in scope (ignoring the commands)
+func (s *Scope) MatchNamespace(db, collection string) bool {
+	if _, ok := s.skipDatabases[db]; ok {
+		return false
+	}
+	if s.skipCollections != nil && matchCollection(s.skipCollections, db, collection) {
+		return false
+	}
+
+	if s.databases != nil {
+		if _, ok := s.databases[db]; !ok {
+			return false
+		}
+	}
+	if s.collections != nil && !matchCollection(s.collections, db, collection) {
+		return false
+	}
+
+	return true
+}
+
+// Scoped returns a Plugin which only runs p for requests that match the scope;
+// other requests are passed directly to the next plugin.
+func Scoped(p Plugin, s *Scope) Plugin {
+	if s.IsZero() {
+		return p
+	}
+	s.Compile()
+	return &scopedPlugin{Plugin: p, scope: s}
+}
+
+type scopedPlugin struct {
+	Plugin
+	scope *Scope
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *scopedPlugin) Process(ctx context.Context, r *Request, next PipelineFunc) (bson.D, error) {
+	if !p.scope.Match(r) {
+		return next(ctx, r)
+	}
+	return p.Plugin.Process(ctx, r, next)
+}
+
+// Unwrap returns the underlying plugin
+func (p *scopedPlugin) Unwrap() Plugin {
+	return p.Plugin
+}
+
+// String returns a description of the scope
+func (s *Scope) String() string {
+	var parts []string
+	add := func(name string, items []string) {
+		if len(items) > 0 {
+			parts = append(parts, name+"="+strings.Join(items, ","))
+		}
+	}
+	add("databases", s.Databases)
+	add("collections", s.Collections)
+	add("commands", s.Commands)
+	add("skipDatabases", s.SkipDatabases)
+	add("skipCollections", s.SkipCollections)
+	add("skipCommands", s.SkipCommands)
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,73 @@
+package plugins
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/command"
+)
+
+type countPlugin struct {
+	count int
+}
+
+func (p *countPlugin) Name() string           { return "count" }
+func (p *countPlugin) Configure(bson.D) error { return nil }
+func (p *countPlugin) Process(ctx context.Context, r *Request, next PipelineFunc) (bson.D, error) {
+	p.count++
+	return next(ctx, r)
+}
+
+func TestScope(t *testing.T) {
+	find := func(db, collection string) *Request {
+		return &Request{
+			CommandName: "find",
+			Command:     &command.Find{Collection: collection, Common: command.Common{Database: db}},
+		}
+	}
+	insert := func(db, collection string) *Request {
+		return &Request{
+			CommandName: "insert",
+			Command:     &command.Insert{Collection: collection, Common: command.Common{Database: db}},
+		}
+	}
+
+	tests := []struct {
+		scope *Scope
+		r     *Request
+		match bool
+	}{
+		{scope: nil, r: find("a", "b"), match: true},
+		{scope: &Scope{}, r: find("a", "b"), match: true},
+		{scope: &Scope{Databases: []string{"a"}}, r: find("a", "b"), match: true},
+		{scope: &Scope{Databases: []string{"a"}}, r: find("c", "b"), match: false},
+		{scope: &Scope{Collections: []string{"b"}}, r: find("c", "b"), match: true},
+		{scope: &Scope{Collections: []string{"a.b"}}, r: find("c", "b"), match: false},
+		{scope: &Scope{Collections: []string{"a.*"}}, r: find("a", "z"), match: true},
+		{scope: &Scope{Commands: []string{"insert"}}, r: find("a", "b"), match: false},
+		{scope: &Scope{Commands: []string{"insert"}}, r: insert("a", "b"), match: true},
+		{scope: &Scope{SkipCommands: []string{"find"}}, r: find("a", "b"), match: false},
+		{scope: &Scope{SkipCommands: []string{"find"}}, r: insert("a", "b"), match: true},
+		{scope: &Scope{Databases: []string{"a"}, SkipCollections: []string{"a.b"}}, r: find("a", "b"), match: false},
+		{scope: &Scope{Databases: []string{"a"}, SkipCollections: []string{"a.b"}}, r: find("a", "c"), match: true},
+		{scope: &Scope{SkipDatabases: []string{"admin"}}, r: find("admin", "c"), match: false},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			p := &countPlugin{}
+			pipe := BuildPipeline([]Plugin{Scoped(p, test.scope)}, func(context.Context, *Request) (bson.D, error) {
+				return bson.D{{"ok", 1}}, nil
+			})
+			if _, err := pipe(context.TODO(), test.r); err != nil {
+				t.Fatal(err)
+			}
+			if (p.count == 1) != test.match {
+				t.Fatalf("mismatch in scope match expected=%v actual=%v", test.match, p.count == 1)
+			}
+		})
+	}
+}
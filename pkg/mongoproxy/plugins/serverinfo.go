@@ -0,0 +1,65 @@
+package plugins
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ServerInfo is information about the downstream server used by the proxy to
+// answer handshake commands (isMaster/hello, buildInfo) itself
+type ServerInfo struct {
+	// BuildInfo is the buildInfo response of the downstream server
+	BuildInfo bson.D
+	// Hello is the isMaster response of the downstream server
+	Hello bson.D
+	// HelloOverrides are fields set as is in the proxy's isMaster/hello response
+	// (a nil value removes the field) to adapt the handshake to the downstream
+	// server, e.g. a lower maxWireVersion for an older backend
+	HelloOverrides bson.D
+}
+
+// ServerInfoProvider is an optional interface a Plugin can implement to provide
+// the ServerInfo of the server it sends requests to. The proxy caches it and
+// periodically refreshes it (see serverInfoRefresh in the config).
+type ServerInfoProvider interface {
+	ServerInfo(context.Context) (*ServerInfo, error)
+}
+
+// CommandRunner is an optional interface a Plugin can implement to run commands
+// on the downstream server on behalf of the proxy (e.g. to merge the backend's
+// serverStatus into the proxy's)
+type CommandRunner interface {
+	RunCommand(ctx context.Context, db string, cmd bson.D) (bson.D, error)
+}
+
+// CommandRunnerUser is an optional interface a Plugin can implement to be passed
+// the CommandRunner of its chain (the first plugin implementing CommandRunner)
+// when the chain is built, before the plugin is started. It is called again (on
+// running plugins) when the chain is rebuilt, and with nil if the chain has none.
+type CommandRunnerUser interface {
+	SetCommandRunner(CommandRunner)
+}
+
+// SetCommandRunners passes the first CommandRunner in the plugins to all the
+// plugins implementing CommandRunnerUser
+func SetCommandRunners(ps []Plugin) {
+	var cr CommandRunner
+	for _, p := range ps {
+		if r, ok := Unwrap(p).(CommandRunner); ok {
+			cr = r
+			break
+		}
+	}
+	for _, p := range ps {
+		if u, ok := Unwrap(p).(CommandRunnerUser); ok {
+			u.SetCommandRunner(cr)
+		}
+	}
+}
+
+// StatsProvider is an optional interface a Plugin can implement to include its
+// stats in the "mongoproxy" section of serverStatus
+type StatsProvider interface {
+	Stats() bson.D
+}
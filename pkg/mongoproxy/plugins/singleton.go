@@ -0,0 +1,45 @@
+package plugins
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var singletonRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mongoproxy_plugins_singleton_runs_total",
+	Help: "The total intervals of singleton tasks, by whether the task ran or was left to the leader",
+}, []string{"task", "result"})
+
+// RunSingleton calls run every interval until stop is closed. Singleton tasks (e.g.
+// periodic checks of the backend) only need to run on one proxy of the fleet: with
+// a Coordinator run is only called on the proxy leading the task, and without one
+// on every proxy. coordinator is called each interval as the chain's coordinator
+// can change (see CoordinatorUser).
+func RunSingleton(task string, interval time.Duration, coordinator func() Coordinator, stop <-chan struct{}, run func(context.Context)) {
+	// Ask early so the leadership is settled by the first interval
+	if c := coordinator(); c != nil {
+		c.Leader(task)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if c := coordinator(); c != nil && !c.Leader(task) {
+			singletonRuns.WithLabelValues(task, "skipped").Inc()
+			continue
+		}
+		singletonRuns.WithLabelValues(task, "ran").Inc()
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		run(ctx)
+		cancel()
+	}
+}
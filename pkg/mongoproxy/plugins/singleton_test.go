@@ -0,0 +1,61 @@
+package plugins
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type leaderCoordinator struct {
+	leader int32
+	asked  int32
+}
+
+func (c *leaderCoordinator) Members() int                                        { return 2 }
+func (c *leaderCoordinator) Value(string) (interface{}, bool)                    { return nil, false }
+func (c *leaderCoordinator) SetValue(context.Context, string, interface{}) error { return nil }
+func (c *leaderCoordinator) Leader(string) bool {
+	atomic.AddInt32(&c.asked, 1)
+	return atomic.LoadInt32(&c.leader) == 1
+}
+
+func TestRunSingleton(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		coordinator *leaderCoordinator
+		runs        bool
+	}{
+		{"no coordinator", nil, true},
+		{"leader", &leaderCoordinator{leader: 1}, true},
+		{"follower", &leaderCoordinator{}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			coordinator := func() Coordinator {
+				if test.coordinator == nil {
+					return nil
+				}
+				return test.coordinator
+			}
+			var runs int32
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				RunSingleton("task", 10*time.Millisecond, coordinator, stop, func(context.Context) {
+					atomic.AddInt32(&runs, 1)
+				})
+			}()
+			time.Sleep(55 * time.Millisecond)
+			close(stop)
+			<-done
+
+			if (atomic.LoadInt32(&runs) > 0) != test.runs {
+				t.Fatalf("expected runs=%v, got %d runs", test.runs, runs)
+			}
+			if test.coordinator != nil && atomic.LoadInt32(&test.coordinator.asked) < 2 {
+				t.Fatalf("expected the leadership to be checked each interval")
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package defaults
 
 import (
 	"context"
+	"net/http"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -46,6 +47,17 @@ type SlowlogPluginConfig struct {
 // This is a plugin that handles sending the request to the acutual downstream mongo
 type SlowlogPlugin struct {
 	conf SlowlogPluginConfig
+
+	events broadcaster
+}
+
+// AdminHandler returns the handler for the slowlog admin endpoints:
+//
+//	GET tail   stream slow queries as they happen (one JSON object per line)
+func (p *SlowlogPlugin) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tail", p.events.ServeHTTP)
+	return mux
 }
 
 func (p *SlowlogPlugin) Name() string { return Name }
@@ -74,16 +86,49 @@ func (p *SlowlogPlugin) Configure(d bson.D) error {
 
 // Process is the function executed when a message is called in the pipeline.
 func (p *SlowlogPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	// The database is cleared from the command by the mongo plugin; so we grab it first
+	db, collection := command.GetCommandDatabase(r.Command), command.GetCommandCollection(r.Command)
 	start := time.Now()
 	result, err := next(ctx, r)
 	if took := time.Since(start); took > p.conf.thresholdDuration {
 		slowlogTotal.WithLabelValues(
-			command.GetCommandDatabase(r.Command),
-			command.GetCommandCollection(r.Command),
+			db,
+			collection,
 			r.CommandName,
 			command.GetCommandReadPreferenceMode(r.Command),
 		).Inc()
-		logrus.Infof("Slowlog: took=%s request=%s", took, mongowire.ToJson(r.Command, p.conf.RequestLengthLimit))
+		request := mongowire.ToJson(r.Command, p.conf.RequestLengthLimit)
+		traceID := plugins.GetMetadata(ctx).TraceID()
+		if traceID != "" {
+			logrus.WithField("traceID", traceID).Infof("Slowlog: took=%s request=%s", took, request)
+		} else {
+			logrus.Infof("Slowlog: took=%s request=%s", took, request)
+		}
+		p.events.publish(&SlowlogEvent{
+			Time:        start,
+			Database:    db,
+			Collection:  collection,
+			CommandName: r.CommandName,
+			Took:        took.String(),
+			Request:     request,
+			TraceID:     traceID,
+		})
+		if plugins.EventSubscribers() {
+			fields := map[string]interface{}{"took": took.String(), "request": request}
+			if traceID != "" {
+				fields["traceID"] = traceID
+			}
+			plugins.PublishEvent(&plugins.Event{
+				Time:        start,
+				Type:        plugins.EventSlowQuery,
+				Source:      Name,
+				Message:     "took " + took.String(),
+				Database:    db,
+				Collection:  collection,
+				CommandName: r.CommandName,
+				Fields:      fields,
+			})
+		}
 	}
 	return result, err
 }
@@ -0,0 +1,83 @@
+package defaults
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SlowlogEvent is a slow query sent to tail subscribers
+type SlowlogEvent struct {
+	Time        time.Time `json:"time"`
+	Database    string    `json:"database"`
+	Collection  string    `json:"collection"`
+	CommandName string    `json:"commandName"`
+	Took        string    `json:"took"`
+	Request     string    `json:"request"`
+	TraceID     string    `json:"traceID,omitempty"`
+}
+
+// broadcaster sends events to all current subscribers; slow subscribers miss events
+// instead of blocking requests.
+type broadcaster struct {
+	l    sync.RWMutex
+	subs map[chan *SlowlogEvent]struct{}
+}
+
+func (b *broadcaster) subscribe() chan *SlowlogEvent {
+	b.l.Lock()
+	defer b.l.Unlock()
+	if b.subs == nil {
+		b.subs = make(map[chan *SlowlogEvent]struct{})
+	}
+	ch := make(chan *SlowlogEvent, 100)
+	b.subs[ch] = struct{}{}
+	return ch
+}
+
+func (b *broadcaster) unsubscribe(ch chan *SlowlogEvent) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	delete(b.subs, ch)
+}
+
+func (b *broadcaster) publish(e *SlowlogEvent) {
+	b.l.RLock()
+	defer b.l.RUnlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// ServeHTTP streams events to the client until it disconnects
+func (b *broadcaster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := b.subscribe()
+	defer b.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-ch:
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
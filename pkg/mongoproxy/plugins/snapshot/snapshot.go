@@ -0,0 +1,471 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+	"github.com/wish/mongoproxy/pkg/objectstore"
+)
+
+const Name = "snapshot"
+
+const (
+	// OperationUpdateMany snapshots the documents matching multi updates
+	OperationUpdateMany = "updateMany"
+	// OperationDeleteMany snapshots the documents matching multi deletes
+	OperationDeleteMany = "deleteMany"
+	// OperationDrop snapshots the documents of dropped collections
+	OperationDrop = "drop"
+
+	// insertBatchSize caps the documents of an insert into the recovery collection
+	insertBatchSize = 1000
+	// insertBatchBytes caps the size of an insert into the recovery collection
+	insertBatchBytes = 8 * 1024 * 1024
+)
+
+var (
+	snapshotsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_snapshot_snapshots_total",
+		Help: "The total snapshots of destructive writes",
+	}, []string{"db", "collection", "command", "result"})
+	documentsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_snapshot_documents_total",
+		Help: "The total documents stored in snapshots",
+	}, []string{"db", "collection"})
+)
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &SnapshotPlugin{
+			conf: SnapshotPluginConfig{
+				Operations:   []string{OperationUpdateMany, OperationDeleteMany, OperationDrop},
+				MaxDocuments: 10000,
+				MaxBytes:     64 * 1024 * 1024,
+				Timeout:      "30s",
+			},
+		}
+	})
+}
+
+type SnapshotPluginConfig struct {
+	// Operations are the operations snapshotted: updateMany, deleteMany and/or drop
+	// (default all)
+	Operations []string `bson:"operations"`
+	// Collection is the recovery collection snapshots are stored in, either
+	// "<db>.<collection>" or "<collection>" in the database of the write
+	Collection string `bson:"collection"`
+	// S3 is the bucket snapshots are stored in, instead of a recovery collection;
+	// their keys are "<prefix><db>/<collection>/<id>.bson"
+	S3 *objectstore.S3Config `bson:"s3"`
+	// MaxDocuments is the maximum number of documents of a snapshot (default 10000)
+	MaxDocuments int64 `bson:"maxDocuments"`
+	// MaxBytes is the maximum size of the documents of a snapshot (default 64MB)
+	MaxBytes int64 `bson:"maxBytes"`
+	// Required rejects writes which couldn't be snapshotted (exceeding the limits
+	// or failing) instead of running them without a snapshot
+	Required bool `bson:"required"`
+	// Timeout is the timeout of reading and storing a snapshot (default "30s")
+	Timeout string `bson:"timeout"`
+	timeout time.Duration
+
+	operations map[string]bool
+}
+
+// This is a plugin that copies the documents a multi update or delete (or a drop)
+// is about to touch to a recovery collection or S3 before running it, for a quick
+// undo of mistakes
+type SnapshotPlugin struct {
+	conf SnapshotPluginConfig
+	s3   *objectstore.S3Client
+
+	crLock sync.RWMutex
+	cr     plugins.CommandRunner
+}
+
+func (p *SnapshotPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *SnapshotPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	p.conf.operations = make(map[string]bool, len(p.conf.Operations))
+	for _, op := range p.conf.Operations {
+		switch op {
+		case OperationUpdateMany, OperationDeleteMany, OperationDrop:
+			p.conf.operations[op] = true
+		default:
+			return fmt.Errorf("invalid operation %q; must be one of updateMany, deleteMany, drop", op)
+		}
+	}
+	if (p.conf.Collection == "") == (p.conf.S3 == nil) {
+		return fmt.Errorf("exactly one of collection and s3 is required")
+	}
+	if p.conf.S3 != nil {
+		if err := p.conf.S3.Load(); err != nil {
+			return fmt.Errorf("invalid s3: %w", err)
+		}
+		p.s3 = objectstore.NewS3Client(p.conf.S3, nil)
+	}
+	if p.conf.MaxDocuments <= 0 || p.conf.MaxBytes <= 0 {
+		return fmt.Errorf("maxDocuments and maxBytes must be positive")
+	}
+	if p.conf.timeout, err = time.ParseDuration(p.conf.Timeout); err != nil {
+		return fmt.Errorf("invalid timeout: %w", err)
+	}
+	if p.conf.timeout <= 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+
+	return nil
+}
+
+// SetCommandRunner sets the runner the documents are read and the recovery
+// collection written with
+func (p *SnapshotPlugin) SetCommandRunner(cr plugins.CommandRunner) {
+	p.crLock.Lock()
+	defer p.crLock.Unlock()
+	p.cr = cr
+}
+
+func (p *SnapshotPlugin) commandRunner() plugins.CommandRunner {
+	p.crLock.RLock()
+	defer p.crLock.RUnlock()
+	return p.cr
+}
+
+// recoveryNamespace returns the namespace of the recovery collection of a write
+// on the database
+func (p *SnapshotPlugin) recoveryNamespace(db string) (string, string) {
+	if i := strings.Index(p.conf.Collection, "."); i >= 0 {
+		return p.conf.Collection[:i], p.conf.Collection[i+1:]
+	}
+	return db, p.conf.Collection
+}
+
+// target is the filter (and its options) of the documents an operation touches
+type target struct {
+	op        string
+	filter    bson.D
+	collation interface{}
+	hint      interface{}
+}
+
+// targets returns what the operations of the command touch
+func (p *SnapshotPlugin) targets(c command.Command) []target {
+	var targets []target
+	switch cmd := c.(type) {
+	case *command.Update:
+		if !p.conf.operations[OperationUpdateMany] {
+			return nil
+		}
+		for _, u := range cmd.Updates {
+			if !bsonutil.GetBoolDefault(u.Multi, false) {
+				continue
+			}
+			t := target{op: OperationUpdateMany, filter: u.Query, hint: u.Hint}
+			if u.Collation != nil {
+				t.collation = u.Collation
+			}
+			targets = append(targets, t)
+		}
+	case *command.Delete:
+		if !p.conf.operations[OperationDeleteMany] {
+			return nil
+		}
+		for _, deleteDoc := range cmd.Deletes {
+			if limit, _ := bsonutil.Lookup(deleteDoc, "limit"); bsonutil.BoolNumber(limit) {
+				continue
+			}
+			q, _ := bsonutil.Lookup(deleteDoc, "q")
+			filter, _ := q.(bson.D)
+			collation, _ := bsonutil.Lookup(deleteDoc, "collation")
+			hint, _ := bsonutil.Lookup(deleteDoc, "hint")
+			targets = append(targets, target{op: OperationDeleteMany, filter: filter, collation: collation, hint: hint})
+		}
+	case *command.Drop:
+		if p.conf.operations[OperationDrop] {
+			targets = append(targets, target{op: OperationDrop})
+		}
+	}
+	return targets
+}
+
+// snapshot is the documents the operations of a write touch
+type snapshot struct {
+	id         primitive.ObjectID
+	db         string
+	collection string
+	docs       []bson.Raw
+	ops        []string
+	bytes      int64
+}
+
+// limitError is returned when the documents exceed the limits of a snapshot
+type limitError struct {
+	limit string
+	max   int64
+}
+
+func (e *limitError) Error() string {
+	return fmt.Sprintf("the documents exceed the %s limit of %d", e.limit, e.max)
+}
+
+// read reads the documents the target touches into the snapshot
+func (p *SnapshotPlugin) read(ctx context.Context, cr plugins.CommandRunner, s *snapshot, t target) error {
+	filter := t.filter
+	if filter == nil {
+		filter = bson.D{}
+	}
+	cmd := bson.D{
+		{"find", s.collection},
+		{"filter", filter},
+		// One more than the limit to know it's exceeded
+		{"limit", p.conf.MaxDocuments - int64(len(s.docs)) + 1},
+	}
+	if t.collation != nil {
+		cmd = append(cmd, bson.E{"collation", t.collation})
+	}
+	if t.hint != nil {
+		cmd = append(cmd, bson.E{"hint", t.hint})
+	}
+
+	for {
+		result, err := cr.RunCommand(ctx, s.db, cmd)
+		if err != nil {
+			return err
+		}
+		if !bsonutil.Ok(result) {
+			msg, _ := bsonutil.Lookup(result, "errmsg")
+			return fmt.Errorf("%s failed: %v", cmd[0].Key, msg)
+		}
+		batch, _ := bsonutil.Lookup(result, "cursor", "firstBatch")
+		if batch == nil {
+			batch, _ = bsonutil.Lookup(result, "cursor", "nextBatch")
+		}
+		items, _ := batch.(primitive.A)
+		cursorID, _ := bsonutil.Lookup(result, "cursor", "id")
+		id, _ := cursorID.(int64)
+
+		for _, item := range items {
+			b, err := bson.Marshal(item)
+			if err != nil {
+				return err
+			}
+			var exceeded error
+			if int64(len(s.docs)) >= p.conf.MaxDocuments {
+				exceeded = &limitError{limit: "maxDocuments", max: p.conf.MaxDocuments}
+			} else if s.bytes+int64(len(b)) > p.conf.MaxBytes {
+				exceeded = &limitError{limit: "maxBytes", max: p.conf.MaxBytes}
+			}
+			if exceeded != nil {
+				if id != 0 {
+					killCursor(ctx, cr, s.db, s.collection, id)
+				}
+				return exceeded
+			}
+			s.docs = append(s.docs, b)
+			s.ops = append(s.ops, t.op)
+			s.bytes += int64(len(b))
+		}
+		if id == 0 {
+			return nil
+		}
+		cmd = bson.D{{"getMore", id}, {"collection", s.collection}}
+	}
+}
+
+// killCursor kills the backend cursor of a snapshot exceeding its limits
+func killCursor(ctx context.Context, cr plugins.CommandRunner, db, collection string, cursorID int64) {
+	result, err := cr.RunCommand(ctx, db, bson.D{{"killCursors", collection}, {"cursors", bson.A{cursorID}}})
+	if err != nil || !bsonutil.Ok(result) {
+		logrus.Debugf("Error killing cursor %d on %s.%s: %v %v", cursorID, db, collection, err, result)
+	}
+}
+
+// storeCollection inserts the documents of the snapshot in the recovery
+// collection, with what touched them
+func (p *SnapshotPlugin) storeCollection(ctx context.Context, cr plugins.CommandRunner, s *snapshot, targets []target, info bson.D) error {
+	db, collection := p.recoveryNamespace(s.db)
+	filters := make(map[string]string, len(targets))
+	for _, t := range targets {
+		if t.filter == nil {
+			continue
+		}
+		// Filters may have operators, which can't be stored as field names
+		js, err := bson.MarshalExtJSON(t.filter, true, false)
+		if err != nil {
+			return err
+		}
+		filters[t.op] = string(js)
+	}
+
+	var (
+		batch bson.A
+		size  int
+	)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		result, err := cr.RunCommand(ctx, db, bson.D{{"insert", collection}, {"documents", batch}, {"ordered", false}})
+		if err != nil {
+			return err
+		}
+		if !bsonutil.Ok(result) {
+			msg, _ := bsonutil.Lookup(result, "errmsg")
+			return fmt.Errorf("insert failed: %v", msg)
+		}
+		if writeErrors, _ := bsonutil.Lookup(result, "writeErrors"); writeErrors != nil {
+			return fmt.Errorf("insert failed: %v", writeErrors)
+		}
+		batch, size = nil, 0
+		return nil
+	}
+	for i, doc := range s.docs {
+		d := bson.D{
+			{"_id", primitive.NewObjectID()},
+			{"snapshot", s.id},
+			{"ns", s.db + "." + s.collection},
+			{"op", s.ops[i]},
+		}
+		d = append(d, info...)
+		if filter, ok := filters[s.ops[i]]; ok {
+			d = append(d, bson.E{"filter", filter})
+		}
+		d = append(d, bson.E{"document", doc})
+		batch = append(batch, d)
+		size += len(doc)
+		if len(batch) >= insertBatchSize || size >= insertBatchBytes {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// storeS3 puts the documents of the snapshot in S3 as a single object of
+// concatenated BSON documents (as mongodump writes them)
+func (p *SnapshotPlugin) storeS3(ctx context.Context, s *snapshot, info map[string]string) error {
+	body := make([]byte, 0, s.bytes)
+	for _, doc := range s.docs {
+		body = append(body, doc...)
+	}
+	return p.s3.Put(ctx, s.db+"/"+s.collection+"/"+s.id.Hex()+".bson", body, info)
+}
+
+// take reads and stores the snapshot of the documents the targets touch
+func (p *SnapshotPlugin) take(ctx context.Context, r *plugins.Request, s *snapshot, targets []target) error {
+	cr := p.commandRunner()
+	if cr == nil {
+		return fmt.Errorf("no plugin in the chain can run commands on the backend")
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.conf.timeout)
+	defer cancel()
+
+	for _, t := range targets {
+		if err := p.read(ctx, cr, s, t); err != nil {
+			return err
+		}
+	}
+	if len(s.docs) == 0 {
+		return nil
+	}
+
+	var appName, user string
+	if r.CC != nil {
+		appName = r.CC.AppName
+	}
+	if ident := plugins.GetMetadata(ctx).Identity(); ident != nil {
+		user = ident.User()
+	}
+	if p.s3 != nil {
+		ops := make([]string, 0, len(targets))
+		for _, t := range targets {
+			ops = append(ops, t.op)
+		}
+		return p.storeS3(ctx, s, map[string]string{
+			"Snapshot": s.id.Hex(),
+			"Ns":       s.db + "." + s.collection,
+			"Op":       strings.Join(ops, ","),
+			"App-Name": appName,
+			"User":     user,
+		})
+	}
+	return p.storeCollection(ctx, cr, s, targets, bson.D{
+		{"time", primitive.NewDateTimeFromTime(time.Now())},
+		{"appName", appName},
+		{"user", user},
+	})
+}
+
+// Process snapshots the documents multi updates, multi deletes and drops touch
+// before running them
+func (p *SnapshotPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	targets := p.targets(r.Command)
+	if len(targets) == 0 {
+		return next(ctx, r)
+	}
+	db, collection := r.Database(), r.Collection()
+	if p.s3 == nil {
+		// Deletes of old snapshots aren't snapshotted
+		if rdb, rcoll := p.recoveryNamespace(db); rdb == db && rcoll == collection {
+			return next(ctx, r)
+		}
+	}
+
+	s := &snapshot{id: primitive.NewObjectID(), db: db, collection: collection}
+	err := p.take(ctx, r, s, targets)
+	if err == nil {
+		if len(s.docs) == 0 {
+			snapshotsTotal.WithLabelValues(db, collection, r.CommandName, "empty").Inc()
+		} else {
+			snapshotsTotal.WithLabelValues(db, collection, r.CommandName, "stored").Inc()
+			documentsTotal.WithLabelValues(db, collection).Add(float64(len(s.docs)))
+			logrus.Infof("SNAPSHOT: %s on %s.%s: snapshot %s of %d documents", r.CommandName, db, collection, s.id.Hex(), len(s.docs))
+		}
+		return next(ctx, r)
+	}
+
+	limitErr, exceeded := err.(*limitError)
+	result := "failed"
+	if exceeded {
+		result = "skipped"
+	}
+	if !p.conf.Required {
+		snapshotsTotal.WithLabelValues(db, collection, r.CommandName, result).Inc()
+		logrus.Warningf("SNAPSHOT FAILED: %s on %s.%s runs without a snapshot: %v", r.CommandName, db, collection, err)
+		return next(ctx, r)
+	}
+	snapshotsTotal.WithLabelValues(db, collection, r.CommandName, "rejected").Inc()
+	logrus.Warningf("SNAPSHOT REJECTED: %s on %s.%s couldn't be snapshotted: %v", r.CommandName, db, collection, err)
+	if exceeded {
+		return mongoerror.IllegalOperation.ErrMessage(fmt.Sprintf(
+			"%s on %s.%s couldn't be snapshotted before running it: %v; split it into smaller writes",
+			r.CommandName, db, collection, limitErr)), nil
+	}
+	return mongoerror.InternalError.ErrMessage(fmt.Sprintf(
+		"%s on %s.%s couldn't be snapshotted before running it: %v", r.CommandName, db, collection, err)), nil
+}
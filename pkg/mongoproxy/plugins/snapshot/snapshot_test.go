@@ -0,0 +1,313 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+	"github.com/wish/mongoproxy/pkg/objectstore"
+)
+
+// backend is a plugins.CommandRunner returning all the documents of a collection
+// for any filter, in batches of 2, and recording the inserts
+type backend struct {
+	docs    map[string][]bson.D
+	cmds    []bson.D
+	inserts map[string][]bson.D
+	fail    bool
+	// rest is the documents of the open cursor
+	rest primitive.A
+}
+
+func (b *backend) RunCommand(ctx context.Context, db string, cmd bson.D) (bson.D, error) {
+	b.cmds = append(b.cmds, cmd)
+	if b.fail {
+		return nil, fmt.Errorf("connection refused")
+	}
+	batch := func(key string, docs primitive.A) bson.D {
+		var id int64
+		if len(docs) > 2 {
+			docs, b.rest, id = docs[:2], docs[2:], 1
+		}
+		return bson.D{{"cursor", bson.D{{key, docs}, {"id", id}}}, {"ok", 1}}
+	}
+	switch cmd[0].Key {
+	case "find":
+		limit, _ := bsonutil.Lookup(cmd, "limit")
+		var docs primitive.A
+		for _, doc := range b.docs[db+"."+cmd[0].Value.(string)] {
+			if int64(len(docs)) < limit.(int64) {
+				docs = append(docs, doc)
+			}
+		}
+		return batch("firstBatch", docs), nil
+	case "getMore":
+		return batch("nextBatch", b.rest), nil
+	case "insert":
+		ns := db + "." + cmd[0].Value.(string)
+		docs, _ := bsonutil.Lookup(cmd, "documents")
+		for _, doc := range docs.(bson.A) {
+			b.inserts[ns] = append(b.inserts[ns], doc.(bson.D))
+		}
+	}
+	return bson.D{{"ok", 1}}, nil
+}
+
+func (b *backend) ran(name string) bool {
+	for _, cmd := range b.cmds {
+		if cmd[0].Key == name {
+			return true
+		}
+	}
+	return false
+}
+
+func newBackend() *backend {
+	var docs []bson.D
+	for i := 0; i < 5; i++ {
+		docs = append(docs, bson.D{{"_id", int32(i)}, {"name", strings.Repeat("x", 10)}})
+	}
+	return &backend{
+		docs:    map[string][]bson.D{"db.coll": docs},
+		inserts: make(map[string][]bson.D),
+	}
+}
+
+// snapshotPipeline returns a func running a command through a pipeline of the
+// plugin, returning its result and whether it reached the backend
+func snapshotPipeline(t *testing.T, p *SnapshotPlugin) func(cmd bson.D) (bson.D, bool) {
+	var ran bool
+	pipeline := plugins.BuildPipeline([]plugins.Plugin{p}, func(context.Context, *plugins.Request) (bson.D, error) {
+		ran = true
+		return bson.D{{"ok", 1}}, nil
+	})
+	return func(doc bson.D) (bson.D, bool) {
+		ran = false
+		cmd, ok := command.GetCommand(doc[0].Key)
+		if !ok {
+			t.Fatalf("no such command: %s", doc[0].Key)
+		}
+		if err := cmd.FromBSOND(doc); err != nil {
+			t.Fatal(err)
+		}
+		result, err := pipeline(context.TODO(), &plugins.Request{CommandName: doc[0].Key, Command: cmd, CC: plugins.NewClientConnection()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result, ran
+	}
+}
+
+func newPlugin(t *testing.T, config bson.D) *SnapshotPlugin {
+	plugin, _ := plugins.GetPlugin(Name)
+	p := plugin.(*SnapshotPlugin)
+	if err := p.Configure(config); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestSnapshotCollection(t *testing.T) {
+	deleteMany := func(coll string, limit int) bson.D {
+		return bson.D{{"delete", coll}, {"deletes", bson.A{bson.D{{"q", bson.D{{"n", bson.D{{"$gt", 1}}}}}, {"limit", limit}}}}, {"$db", "db"}}
+	}
+	updateMany := func(multi bool) bson.D {
+		return bson.D{{"update", "coll"}, {"updates", bson.A{bson.D{{"q", bson.D{}}, {"u", bson.D{{"$set", bson.D{{"a", 1}}}}}, {"multi", multi}}}}, {"$db", "db"}}
+	}
+
+	tests := []struct {
+		cmd bson.D
+		op  string
+	}{
+		{cmd: deleteMany("coll", 0), op: OperationDeleteMany},
+		{cmd: deleteMany("coll", 1)},
+		{cmd: updateMany(true), op: OperationUpdateMany},
+		{cmd: updateMany(false)},
+		{cmd: bson.D{{"drop", "coll"}, {"$db", "db"}}, op: OperationDrop},
+		{cmd: bson.D{{"dropDatabase", 1}, {"$db", "db"}}},
+		// Deletes of old snapshots
+		{cmd: deleteMany("snapshots", 0)},
+	}
+	for i, test := range tests {
+		b := newBackend()
+		p := newPlugin(t, bson.D{{"collection", "snapshots"}})
+		p.SetCommandRunner(b)
+		run := snapshotPipeline(t, p)
+
+		if _, ran := run(test.cmd); !ran {
+			t.Fatalf("%d: expected the command to run", i)
+		}
+		inserts := b.inserts["db.snapshots"]
+		if test.op == "" {
+			if len(b.cmds) > 0 {
+				t.Fatalf("%d: expected no snapshot, got %v", i, b.cmds)
+			}
+			continue
+		}
+		if len(inserts) != 5 {
+			t.Fatalf("%d: expected a snapshot of 5 documents, got %v", i, inserts)
+		}
+		for j, doc := range inserts {
+			if op, _ := bsonutil.Lookup(doc, "op"); op != test.op {
+				t.Fatalf("%d: expected op %s, got %v", i, test.op, doc)
+			}
+			if ns, _ := bsonutil.Lookup(doc, "ns"); ns != "db.coll" {
+				t.Fatalf("%d: expected ns db.coll, got %v", i, doc)
+			}
+			document, _ := bsonutil.Lookup(doc, "document")
+			if id, ok := document.(bson.Raw).Lookup("_id").Int32OK(); !ok || id != int32(j) {
+				t.Fatalf("%d: expected document %d, got %v", i, j, doc)
+			}
+			snapshot, _ := bsonutil.Lookup(doc, "snapshot")
+			if first, _ := bsonutil.Lookup(inserts[0], "snapshot"); snapshot != first {
+				t.Fatalf("%d: expected the documents in a single snapshot, got %v", i, inserts)
+			}
+		}
+		filter, _ := bsonutil.Lookup(inserts[0], "filter")
+		if test.op == OperationDeleteMany && !strings.HasPrefix(filter.(string), `{"n":{"$gt":`) {
+			t.Fatalf("%d: unexpected filter %v", i, filter)
+		}
+	}
+}
+
+func TestSnapshotLimits(t *testing.T) {
+	deleteMany := bson.D{{"delete", "coll"}, {"deletes", bson.A{bson.D{{"q", bson.D{}}, {"limit", 0}}}}, {"$db", "db"}}
+
+	tests := []struct {
+		config bson.D
+		fail   bool
+		ran    bool
+		stored bool
+		code   mongoerror.ErrorCode
+	}{
+		{config: bson.D{{"maxDocuments", 5}}, ran: true, stored: true},
+		{config: bson.D{{"maxDocuments", 4}}, ran: true},
+		{config: bson.D{{"maxDocuments", 4}, {"required", true}}, code: mongoerror.IllegalOperation},
+		{config: bson.D{{"maxBytes", 100}, {"required", true}}, code: mongoerror.IllegalOperation},
+		{config: bson.D{{"required", true}}, fail: true, code: mongoerror.InternalError},
+		{config: bson.D{}, fail: true, ran: true},
+	}
+	for i, test := range tests {
+		b := newBackend()
+		b.fail = test.fail
+		p := newPlugin(t, append(bson.D{{"collection", "recovery.snapshots"}}, test.config...))
+		p.SetCommandRunner(b)
+		run := snapshotPipeline(t, p)
+
+		result, ran := run(deleteMany)
+		if ran != test.ran {
+			t.Fatalf("%d: expected ran %v, got %v: %v", i, test.ran, ran, result)
+		}
+		if !test.ran {
+			if code, _ := bsonutil.Lookup(result, "code"); code != int(test.code) {
+				t.Fatalf("%d: expected code %d, got %v", i, test.code, result)
+			}
+		}
+		if stored := len(b.inserts["recovery.snapshots"]) > 0; stored != test.stored {
+			t.Fatalf("%d: unexpected snapshot %v", i, b.inserts)
+		}
+	}
+
+	// The cursor of a snapshot exceeding its limit is killed
+	b := newBackend()
+	p := newPlugin(t, bson.D{{"collection", "snapshots"}, {"maxBytes", 40}})
+	p.SetCommandRunner(b)
+	snapshotPipeline(t, p)(deleteMany)
+	if !b.ran("killCursors") {
+		t.Fatalf("expected the cursor to be killed, got %v", b.cmds)
+	}
+}
+
+func TestSnapshotS3(t *testing.T) {
+	var (
+		paths, auths, namespaces []string
+		body                     []byte
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			t.Errorf("unexpected method %s", r.Method)
+		}
+		paths = append(paths, r.URL.Path)
+		auths = append(auths, r.Header.Get("Authorization"))
+		namespaces = append(namespaces, r.Header.Get("X-Amz-Meta-Ns"))
+		body, _ = ioutil.ReadAll(r.Body)
+		if strings.Contains(r.URL.Path, "fail") {
+			http.Error(w, "AccessDenied", http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	b := newBackend()
+	b.docs["db.fail"] = b.docs["db.coll"]
+	p := newPlugin(t, bson.D{
+		{"s3", bson.D{{"bucket", "bucket"}, {"region", "us-west-1"}, {"prefix", "snapshots/"}, {"endpoint", server.URL + "/"}}},
+		{"required", true},
+	})
+	p.s3 = objectstore.NewS3Client(p.conf.S3, credentials.NewStaticCredentials("AKID", "SECRET", ""))
+	p.SetCommandRunner(b)
+	run := snapshotPipeline(t, p)
+
+	if _, ran := run(bson.D{{"drop", "coll"}, {"$db", "db"}}); !ran {
+		t.Fatal("expected the drop to run")
+	}
+	if len(paths) != 1 || !strings.HasPrefix(paths[0], "/bucket/snapshots/db/coll/") || !strings.HasSuffix(paths[0], ".bson") {
+		t.Fatalf("unexpected object %v", paths)
+	}
+	if !strings.HasPrefix(auths[0], "AWS4-HMAC-SHA256 Credential=AKID/") {
+		t.Fatalf("expected a signed request, got %q", auths[0])
+	}
+	if namespaces[0] != "db.coll" {
+		t.Fatalf("expected the namespace in the metadata, got %q", namespaces[0])
+	}
+	var expected []byte
+	for _, doc := range b.docs["db.coll"] {
+		raw, _ := bson.Marshal(doc)
+		expected = append(expected, raw...)
+	}
+	if !bytes.Equal(body, expected) {
+		t.Fatalf("expected the concatenated documents, got %v", body)
+	}
+
+	result, ran := run(bson.D{{"drop", "fail"}, {"$db", "db"}})
+	if ran {
+		t.Fatal("expected the drop to be rejected")
+	}
+	if errmsg, _ := bsonutil.Lookup(result, "errmsg"); !strings.Contains(errmsg.(string), "403 Forbidden") {
+		t.Fatalf("expected the S3 error, got %v", result)
+	}
+}
+
+func TestSnapshotConfig(t *testing.T) {
+	tests := []struct {
+		config bson.D
+		ok     bool
+	}{
+		{bson.D{{"collection", "snapshots"}}, true},
+		{bson.D{{"s3", bson.D{{"bucket", "b"}, {"region", "us-west-1"}}}}, true},
+		{bson.D{}, false},
+		{bson.D{{"collection", "snapshots"}, {"s3", bson.D{{"bucket", "b"}, {"region", "us-west-1"}}}}, false},
+		{bson.D{{"s3", bson.D{{"bucket", "b"}}}}, false},
+		{bson.D{{"collection", "snapshots"}, {"operations", bson.A{"dropDatabase"}}}, false},
+		{bson.D{{"collection", "snapshots"}, {"maxDocuments", 0}}, false},
+		{bson.D{{"collection", "snapshots"}, {"timeout", "soon"}}, false},
+	}
+	for i, test := range tests {
+		plugin, _ := plugins.GetPlugin(Name)
+		if err := plugin.Configure(test.config); (err == nil) != test.ok {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,559 @@
+package stalereads
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "stalereads"
+
+var (
+	checkedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_stalereads_checked_total",
+		Help: "The total reads of recently written documents checked",
+	}, []string{"db", "collection"})
+	staleTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_stalereads_stale_total",
+		Help: "The total reads which returned a recently written document stale (stale), a recently inserted one missing (missing) or a recently deleted one (deleted)",
+	}, []string{"db", "collection", "kind"})
+	staleAge = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mongoproxy_plugins_stalereads_write_age_seconds",
+		Help:    "The time between the write of a document and the stale read of it",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"db", "collection"})
+	trackedGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongoproxy_plugins_stalereads_tracked_documents",
+		Help: "The recently written documents tracked",
+	})
+)
+
+// Kinds of stale reads
+const (
+	// KindStale is a document returned with other values than written
+	KindStale = "stale"
+	// KindMissing is an inserted document which wasn't returned
+	KindMissing = "missing"
+	// KindDeleted is a deleted document which was returned
+	KindDeleted = "deleted"
+)
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &StaleReadsPlugin{
+			conf: StaleReadsPluginConfig{
+				Window:          "1m",
+				MaxDocuments:    100000,
+				SampleRate:      1,
+				ReadPreferences: []string{"secondary", "secondaryPreferred", "nearest"},
+			},
+		}
+	})
+}
+
+type StaleReadsPluginConfig struct {
+	// Keys are the key fields documents are tracked by; the first key matching a
+	// request applies (default _id)
+	Keys []*Key `bson:"keys"`
+	// Window is how long after a write the reads of the document are checked
+	// (default "1m")
+	Window string `bson:"window"`
+	window time.Duration
+	// MaxDocuments is the maximum number of documents tracked (default 100000)
+	MaxDocuments int `bson:"maxDocuments"`
+	// SampleRate is the fraction of documents tracked (default 1)
+	SampleRate float64 `bson:"sampleRate"`
+	// ReadPreferences are the read preference modes of the reads checked (default
+	// secondary, secondaryPreferred and nearest)
+	ReadPreferences []string `bson:"readPreferences"`
+}
+
+// Key is the field documents of a set of collections are tracked by
+type Key struct {
+	// Scope are the collections the key applies to (same format as a plugin scope; required)
+	Scope *plugins.Scope `bson:"scope"`
+	// Field is the (top-level) field identifying documents (required)
+	Field string `bson:"field"`
+}
+
+func (k *Key) load() error {
+	if k.Scope.IsZero() {
+		return fmt.Errorf("scope is required")
+	}
+	k.Scope.Compile()
+
+	if k.Field == "" || strings.ContainsAny(k.Field, ".$") {
+		return fmt.Errorf("field must be a top-level field: %q", k.Field)
+	}
+	return nil
+}
+
+// document is what is known of a recently written document
+type document struct {
+	// fields are the (top-level) fields written and their values
+	fields map[string]interface{}
+	// exists is whether the document was inserted (or upserted); deleted whether it
+	// was deleted
+	exists, deleted bool
+	written         time.Time
+}
+
+// counts are the reads checked and found stale of a namespace
+type counts struct {
+	checked int64
+	stale   map[string]int64
+}
+
+// This is a plugin that tracks recent writes of documents (by key) and flags the
+// reads routed to secondaries which return them stale or missing
+type StaleReadsPlugin struct {
+	conf     StaleReadsPluginConfig
+	readPref map[string]struct{}
+
+	l         sync.Mutex
+	documents map[string]*document
+
+	countsLock sync.Mutex
+	counts     map[string]*counts
+}
+
+func (p *StaleReadsPlugin) Name() string { return Name }
+
+// ReadsBatches returns false as only the reads of tracked documents are checked,
+// decoding their (raw) batches then
+func (p *StaleReadsPlugin) ReadsBatches() bool { return false }
+
+// ReadsDocuments returns true as the keys of inserted documents are tracked
+func (p *StaleReadsPlugin) ReadsDocuments() bool { return true }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *StaleReadsPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	for i, k := range p.conf.Keys {
+		if err := k.load(); err != nil {
+			return fmt.Errorf("invalid key %d: %w", i, err)
+		}
+	}
+	if p.conf.window, err = time.ParseDuration(p.conf.Window); err != nil {
+		return fmt.Errorf("invalid window: %w", err)
+	}
+	if p.conf.window <= 0 {
+		return fmt.Errorf("window must be positive")
+	}
+	if p.conf.MaxDocuments <= 0 {
+		return fmt.Errorf("maxDocuments must be positive")
+	}
+	if p.conf.SampleRate <= 0 || p.conf.SampleRate > 1 {
+		return fmt.Errorf("sampleRate must be in (0, 1]")
+	}
+	p.readPref = make(map[string]struct{}, len(p.conf.ReadPreferences))
+	for _, mode := range p.conf.ReadPreferences {
+		p.readPref[mode] = struct{}{}
+	}
+
+	p.documents = make(map[string]*document)
+	p.counts = make(map[string]*counts)
+	return nil
+}
+
+// keyField returns the key field of the collection (so reads and writes of it
+// share the key regardless of the commands of the scope)
+func (p *StaleReadsPlugin) keyField(db, collection string) string {
+	for _, k := range p.conf.Keys {
+		if k.Scope.MatchNamespace(db, collection) {
+			return k.Field
+		}
+	}
+	return "_id"
+}
+
+// valueKey returns the encoding of the value, so equal values have equal keys
+func valueKey(v interface{}) (string, bool) {
+	b, err := bson.Marshal(bson.D{{"v", v}})
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+// keyValues returns the values of the key field the filter matches if it only
+// matches documents by key (by equality or $in)
+func keyValues(filter bson.D, field string) ([]interface{}, bool) {
+	if len(filter) != 1 || filter[0].Key != field {
+		return nil, false
+	}
+	cond, ok := filter[0].Value.(bson.D)
+	if !ok || len(cond) == 0 || !strings.HasPrefix(cond[0].Key, "$") {
+		return []interface{}{filter[0].Value}, true
+	}
+	if len(cond) != 1 {
+		return nil, false
+	}
+	switch cond[0].Key {
+	case "$eq":
+		return []interface{}{cond[0].Value}, true
+	case "$in":
+		if values, ok := cond[0].Value.(primitive.A); ok {
+			return values, true
+		}
+	}
+	return nil, false
+}
+
+// documentKey returns the key of the document with the key value in the namespace,
+// and whether it's sampled
+func (p *StaleReadsPlugin) documentKey(ns string, value interface{}) (string, bool) {
+	v, ok := valueKey(value)
+	if !ok {
+		return "", false
+	}
+	key := ns + "\x00" + v
+	if p.conf.SampleRate < 1 {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		if float64(h.Sum32()) >= p.conf.SampleRate*math.MaxUint32 {
+			return "", false
+		}
+	}
+	return key, true
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *StaleReadsPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	// The backend plugin clears the database of the command it sends
+	db, collection := r.Database(), r.Collection()
+	start := time.Now()
+	result, err := next(ctx, r)
+	if err != nil || !bsonutil.Ok(result) {
+		return result, err
+	}
+
+	switch cmd := r.Command.(type) {
+	case *command.Find:
+		if _, ok := p.readPref[command.GetCommandReadPreferenceMode(cmd)]; ok {
+			p.checkRead(db, collection, cmd, result, start)
+		}
+	case *command.Insert, *command.Update, *command.Delete:
+		// Statements after a failed one may not have been applied
+		if _, ok := bsonutil.Lookup(result, "writeErrors"); !ok {
+			p.recordWrite(db, collection, cmd)
+		}
+	}
+	return result, nil
+}
+
+// recordWrite records the documents written by the command
+func (p *StaleReadsPlugin) recordWrite(db, collection string, cmd command.Command) {
+	ns := db + "." + collection
+	field := p.keyField(db, collection)
+	now := time.Now()
+
+	p.l.Lock()
+	defer p.l.Unlock()
+	switch cmd := cmd.(type) {
+	case *command.Insert:
+		for _, doc := range cmd.Documents {
+			value, ok := bsonutil.Lookup(doc, field)
+			if !ok {
+				continue
+			}
+			if key, ok := p.documentKey(ns, value); ok {
+				p.track(key, now).set(doc, true)
+			}
+		}
+
+	case *command.Update:
+		for _, u := range cmd.Updates {
+			values, ok := keyValues(u.Query, field)
+			if !ok {
+				continue
+			}
+			for _, value := range values {
+				key, ok := p.documentKey(ns, value)
+				if !ok {
+					continue
+				}
+				d := p.track(key, now)
+				if d.deleted && !bsonutil.GetBoolDefault(u.Upsert, false) {
+					continue
+				}
+				d.update(u.U, bsonutil.GetBoolDefault(u.Upsert, false))
+			}
+		}
+
+	case *command.Delete:
+		for _, d := range cmd.Deletes {
+			filter, _ := bsonutil.Lookup(d, "q")
+			q, _ := filter.(bson.D)
+			values, ok := keyValues(q, field)
+			if !ok {
+				continue
+			}
+			for _, value := range values {
+				if key, ok := p.documentKey(ns, value); ok {
+					d := p.track(key, now)
+					d.fields, d.exists, d.deleted = nil, false, true
+				}
+			}
+		}
+	}
+	trackedGauge.Set(float64(len(p.documents)))
+}
+
+// track returns the tracked document of the key, tracking it if it isn't; the
+// lock must be held
+func (p *StaleReadsPlugin) track(key string, now time.Time) *document {
+	d, ok := p.documents[key]
+	if !ok || now.Sub(d.written) > p.conf.window {
+		if !ok && len(p.documents) >= p.conf.MaxDocuments {
+			p.evict(now)
+		}
+		d = &document{}
+		p.documents[key] = d
+	}
+	d.written = now
+	return d
+}
+
+// evict removes the documents written before the window, or an arbitrary one if
+// there are none; the lock must be held
+func (p *StaleReadsPlugin) evict(now time.Time) {
+	for key, d := range p.documents {
+		if now.Sub(d.written) > p.conf.window {
+			delete(p.documents, key)
+		}
+	}
+	if len(p.documents) < p.conf.MaxDocuments {
+		return
+	}
+	for key := range p.documents {
+		delete(p.documents, key)
+		break
+	}
+}
+
+// set sets the fields of the document to those of doc
+func (d *document) set(doc bson.D, exists bool) {
+	d.fields = make(map[string]interface{}, len(doc))
+	for _, e := range doc {
+		d.fields[e.Key] = e.Value
+	}
+	d.exists, d.deleted = exists, false
+}
+
+// update applies the update to the fields of the document: fields $set are
+// tracked and other fields modified are no longer (as their value is unknown)
+func (d *document) update(u bson.D, upsert bool) {
+	if len(u) == 0 || !strings.HasPrefix(u[0].Key, "$") {
+		d.set(u, d.exists || upsert)
+		return
+	}
+	if d.fields == nil {
+		d.fields = make(map[string]interface{})
+	}
+	for _, op := range u {
+		fields, ok := op.Value.(bson.D)
+		if !ok {
+			continue
+		}
+		for _, e := range fields {
+			top := strings.SplitN(e.Key, ".", 2)[0]
+			if op.Key == "$set" && top == e.Key {
+				d.fields[e.Key] = e.Value
+			} else {
+				delete(d.fields, top)
+			}
+		}
+	}
+	d.exists = d.exists || upsert
+	d.deleted = false
+}
+
+// checkRead checks the documents the find (started at start) returned against
+// the writes since the window
+func (p *StaleReadsPlugin) checkRead(db, collection string, cmd *command.Find, result bson.D, start time.Time) {
+	if cmd.Skip != nil && *cmd.Skip > 0 {
+		return
+	}
+	field := p.keyField(db, collection)
+	values, ok := keyValues(cmd.Filter, field)
+	if !ok {
+		return
+	}
+	ns := db + "." + collection
+
+	// The documents tracked (written before the read started)
+	type written struct {
+		document
+		value string
+	}
+	var tracked []written
+	p.l.Lock()
+	for _, value := range values {
+		key, ok := p.documentKey(ns, value)
+		if !ok {
+			continue
+		}
+		if d, ok := p.documents[key]; ok && d.written.Before(start) && start.Sub(d.written) <= p.conf.window {
+			tracked = append(tracked, written{*d, key[len(ns)+1:]})
+		}
+	}
+	p.l.Unlock()
+	if len(tracked) == 0 {
+		return
+	}
+
+	// Documents may only be missing if the result is complete
+	returned := make(map[string]bson.D)
+	batch, _ := bsonutil.Lookup(result, "cursor", "firstBatch")
+	docs := batchDocuments(batch)
+	for _, doc := range docs {
+		if value, ok := bsonutil.Lookup(doc, field); ok {
+			if v, ok := valueKey(value); ok {
+				returned[v] = doc
+			}
+		}
+	}
+	cursorID, _ := bsonutil.Lookup(result, "cursor", "id")
+	complete := cursorID == int64(0) && (cmd.Limit == nil || *cmd.Limit == 0 || int(*cmd.Limit) > len(docs))
+
+	checkedTotal.WithLabelValues(db, collection).Inc()
+	kind := ""
+	var age time.Duration
+	for _, w := range tracked {
+		doc, ok := returned[w.value]
+		if k := w.stale(doc, ok, complete, cmd.Projection == nil); k != "" {
+			kind, age = k, start.Sub(w.written)
+			break
+		}
+	}
+	p.count(ns, kind)
+	if kind == "" {
+		return
+	}
+	staleTotal.WithLabelValues(db, collection, kind).Inc()
+	staleAge.WithLabelValues(db, collection).Observe(age.Seconds())
+	logrus.Debugf("stale read (%s) of %s %s after the write", kind, ns, age)
+}
+
+// batchDocuments returns the documents of a cursor batch, decoding raw batches
+// (see ReadsBatches)
+func batchDocuments(batch interface{}) []bson.D {
+	var docs []bson.D
+	switch batch := batch.(type) {
+	case primitive.A:
+		for _, doc := range batch {
+			if doc, ok := doc.(bson.D); ok {
+				docs = append(docs, doc)
+			}
+		}
+	case bson.RawValue:
+		array, ok := batch.ArrayOK()
+		if !ok {
+			return nil
+		}
+		values, err := array.Values()
+		if err != nil {
+			return nil
+		}
+		for _, v := range values {
+			var doc bson.D
+			if raw, ok := v.DocumentOK(); ok && bson.Unmarshal(raw, &doc) == nil {
+				docs = append(docs, doc)
+			}
+		}
+	}
+	return docs
+}
+
+// stale returns the kind of staleness of the document returned (if ok) by a read,
+// "" if it isn't stale. Fields not returned are only stale if the read has no
+// projection (full).
+func (d *document) stale(doc bson.D, ok, complete, full bool) string {
+	switch {
+	case d.deleted && ok:
+		return KindDeleted
+	case d.exists && !ok && complete:
+		return KindMissing
+	case !ok:
+		return ""
+	}
+	for field, value := range d.fields {
+		got, found := bsonutil.Lookup(doc, field)
+		if !found {
+			if full {
+				return KindStale
+			}
+			continue
+		}
+		want, _ := valueKey(value)
+		if v, _ := valueKey(got); v != want {
+			return KindStale
+		}
+	}
+	return ""
+}
+
+func (p *StaleReadsPlugin) count(ns, kind string) {
+	p.countsLock.Lock()
+	defer p.countsLock.Unlock()
+	c, ok := p.counts[ns]
+	if !ok {
+		c = &counts{stale: make(map[string]int64)}
+		p.counts[ns] = c
+	}
+	c.checked++
+	if kind != "" {
+		c.stale[kind]++
+	}
+}
+
+// Stats returns the reads checked and found stale per namespace
+func (p *StaleReadsPlugin) Stats() bson.D {
+	p.countsLock.Lock()
+	defer p.countsLock.Unlock()
+	names := make([]string, 0, len(p.counts))
+	for ns := range p.counts {
+		names = append(names, ns)
+	}
+	sort.Strings(names)
+	namespaces := make(bson.D, 0, len(names))
+	for _, ns := range names {
+		c := p.counts[ns]
+		namespaces = append(namespaces, bson.E{ns, bson.D{
+			{"checked", c.checked},
+			{KindStale, c.stale[KindStale]},
+			{KindMissing, c.stale[KindMissing]},
+			{KindDeleted, c.stale[KindDeleted]},
+		}})
+	}
+	p.l.Lock()
+	tracked := len(p.documents)
+	p.l.Unlock()
+	return bson.D{{"tracked", tracked}, {"namespaces", namespaces}}
+}
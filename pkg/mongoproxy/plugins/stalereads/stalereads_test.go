@@ -0,0 +1,154 @@
+package stalereads
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func newPlugin(t *testing.T, cfg bson.D) *StaleReadsPlugin {
+	plugin, _ := plugins.GetPlugin(Name)
+	p := plugin.(*StaleReadsPlugin)
+	if err := p.Configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func request(t *testing.T, d bson.D) *plugins.Request {
+	cmd, ok := command.GetCommand(d[0].Key)
+	if !ok {
+		t.Fatalf("unknown command %s", d[0].Key)
+	}
+	if err := cmd.FromBSOND(d); err != nil {
+		t.Fatal(err)
+	}
+	r := &plugins.Request{}
+	r.SetCommand(d[0].Key, cmd, d)
+	return r
+}
+
+func TestStaleReads(t *testing.T) {
+	p := newPlugin(t, bson.D{
+		{"keys", bson.A{bson.D{{"scope", bson.D{{"collections", bson.A{"db.users"}}}}, {"field", "email"}}}},
+	})
+
+	secondary := bson.D{{"mode", "secondary"}}
+	find := func(collection string, filter bson.D, readPref bson.D) bson.D {
+		d := bson.D{{"find", collection}, {"filter", filter}, {"$db", "db"}}
+		if readPref != nil {
+			d = append(d, bson.E{"$readPreference", readPref})
+		}
+		return d
+	}
+	found := func(docs ...interface{}) bson.D {
+		return bson.D{{"cursor", bson.D{{"firstBatch", bson.A(docs)}, {"id", int64(0)}, {"ns", "db.c"}}}, {"ok", 1}}
+	}
+	// foundRaw is found with the batch left raw, as it is when no plugin reads batches
+	foundRaw := func(docs ...interface{}) bson.D {
+		typ, b, err := bson.MarshalValue(append(bson.A{}, docs...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bson.D{{"cursor", bson.D{{"firstBatch", bson.RawValue{Type: typ, Value: b}}, {"id", int64(0)}, {"ns", "db.c"}}}, {"ok", 1}}
+	}
+	ok := bson.D{{"ok", 1}}
+
+	if plugins.ReadsBatches([]plugins.Plugin{p}) {
+		t.Fatal("expected batches to be left raw")
+	}
+
+	tests := []struct {
+		cmd    bson.D
+		result bson.D
+		// stale is the kind of the stale read ("" if the read isn't stale)
+		stale   string
+		checked bool
+	}{
+		// Reads of documents which weren't written aren't checked
+		{cmd: find("c", bson.D{{"_id", int32(1)}}, secondary), result: found()},
+
+		{cmd: bson.D{{"insert", "c"}, {"documents", bson.A{bson.D{{"_id", int32(1)}, {"a", int32(1)}}}}, {"$db", "db"}}, result: ok},
+		{cmd: find("c", bson.D{{"_id", int32(1)}}, secondary), result: found(), stale: KindMissing, checked: true},
+		{cmd: find("c", bson.D{{"_id", int32(1)}}, secondary), result: found(bson.D{{"_id", int32(1)}, {"a", int32(1)}}), checked: true},
+		// Reads from the primary, and of more than the key, aren't checked
+		{cmd: find("c", bson.D{{"_id", int32(1)}}, nil), result: found()},
+		{cmd: find("c", bson.D{{"_id", int32(1)}, {"a", int32(1)}}, secondary), result: found()},
+
+		{cmd: bson.D{{"update", "c"}, {"updates", bson.A{bson.D{{"q", bson.D{{"_id", int32(1)}}}, {"u", bson.D{{"$set", bson.D{{"a", int32(2)}}}}}}}}, {"$db", "db"}}, result: ok},
+		{cmd: find("c", bson.D{{"_id", bson.D{{"$in", bson.A{int32(1), int32(2)}}}}}, secondary), result: found(bson.D{{"_id", int32(1)}, {"a", int32(1)}}), stale: KindStale, checked: true},
+		{cmd: find("c", bson.D{{"_id", int32(1)}}, secondary), result: found(bson.D{{"_id", int32(1)}, {"a", int32(2)}}), checked: true},
+		// Raw batches are decoded
+		{cmd: find("c", bson.D{{"_id", int32(1)}}, secondary), result: foundRaw(bson.D{{"_id", int32(1)}, {"a", int32(2)}}), checked: true},
+		{cmd: find("c", bson.D{{"_id", int32(1)}}, secondary), result: foundRaw(bson.D{{"_id", int32(1)}, {"a", int32(1)}}), stale: KindStale, checked: true},
+		{cmd: find("c", bson.D{{"_id", int32(1)}}, secondary), result: foundRaw(), stale: KindMissing, checked: true},
+
+		// Fields modified by other operators aren't compared
+		{cmd: bson.D{{"update", "c"}, {"updates", bson.A{bson.D{{"q", bson.D{{"_id", int32(1)}}}, {"u", bson.D{{"$inc", bson.D{{"a", int32(1)}}}}}}}}, {"$db", "db"}}, result: ok},
+		{cmd: find("c", bson.D{{"_id", int32(1)}}, secondary), result: found(bson.D{{"_id", int32(1)}, {"a", int32(2)}}), checked: true},
+
+		{cmd: bson.D{{"delete", "c"}, {"deletes", bson.A{bson.D{{"q", bson.D{{"_id", int32(1)}}}, {"limit", int32(1)}}}}, {"$db", "db"}}, result: ok},
+		{cmd: find("c", bson.D{{"_id", int32(1)}}, secondary), result: found(bson.D{{"_id", int32(1)}, {"a", int32(3)}}), stale: KindDeleted, checked: true},
+
+		// Failed writes aren't tracked
+		{cmd: bson.D{{"insert", "c"}, {"documents", bson.A{bson.D{{"_id", int32(5)}}}}, {"$db", "db"}}, result: bson.D{{"ok", 1}, {"writeErrors", bson.A{bson.D{{"index", 0}}}}}},
+		{cmd: find("c", bson.D{{"_id", int32(5)}}, secondary), result: found()},
+
+		// Collections with a key are tracked by it
+		{cmd: bson.D{{"insert", "users"}, {"documents", bson.A{bson.D{{"_id", int32(1)}, {"email", "a@example.com"}, {"name", "a"}}}}, {"$db", "db"}}, result: ok},
+		{cmd: find("users", bson.D{{"email", "a@example.com"}}, secondary), result: found(bson.D{{"_id", int32(1)}, {"email", "a@example.com"}, {"name", "b"}}), stale: KindStale, checked: true},
+	}
+
+	var checked, stale int64
+	for i, test := range tests {
+		r := request(t, test.cmd)
+		result, err := p.Process(context.Background(), r, func(context.Context, *plugins.Request) (bson.D, error) {
+			return test.result, nil
+		})
+		if err != nil || !bsonutil.Ok(result) {
+			t.Fatalf("%d: unexpected result %v: %v", i, result, err)
+		}
+		ns := "db." + test.cmd[0].Value.(string)
+		nsCounts := p.counts[ns]
+		if test.checked {
+			checked++
+		}
+		if test.stale != "" {
+			stale++
+		}
+		var gotChecked, gotStale int64
+		for _, c := range p.counts {
+			gotChecked += c.checked
+			for _, n := range c.stale {
+				gotStale += n
+			}
+		}
+		if gotChecked != checked || gotStale != stale {
+			t.Fatalf("%d: expected %d checked and %d stale reads, got %d and %d", i, checked, stale, gotChecked, gotStale)
+		}
+		if test.stale != "" && (nsCounts == nil || nsCounts.stale[test.stale] == 0) {
+			t.Fatalf("%d: expected a %s read", i, test.stale)
+		}
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	tests := []bson.D{
+		{{"window", "0s"}},
+		{{"sampleRate", 2.0}},
+		{{"maxDocuments", int64(0)}},
+		{{"keys", bson.A{bson.D{{"field", "email"}}}}},
+		{{"keys", bson.A{bson.D{{"scope", bson.D{{"collections", bson.A{"db.users"}}}}, {"field", "a.b"}}}}},
+	}
+	for i, cfg := range tests {
+		p, _ := plugins.GetPlugin(Name)
+		if err := p.Configure(cfg); err == nil {
+			t.Fatalf("%d: expected an error", i)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// TapRecord is a request streamed live to a tap
+type TapRecord struct {
+	Time        time.Time `json:"time"`
+	Duration    string    `json:"duration"`
+	DurationMS  float64   `json:"durationMs"`
+	Client      string    `json:"client,omitempty"`
+	AppName     string    `json:"appName,omitempty"`
+	User        string    `json:"user,omitempty"`
+	Database    string    `json:"db"`
+	Collection  string    `json:"collection,omitempty"`
+	CommandName string    `json:"command"`
+	Fingerprint string    `json:"fingerprint"`
+	// Request is the shape of the request (values replaced by "?"), or the
+	// redacted request if the tap streams values
+	Request json.RawMessage `json:"request"`
+	OK      bool            `json:"ok"`
+	// CodeName is the error of a failed request
+	CodeName string `json:"codeName,omitempty"`
+	// Docs is the documents returned (in the first batch) or written
+	Docs  int    `json:"docs"`
+	Error string `json:"error,omitempty"`
+}
+
+// TapOptions select the requests streamed by a tap
+type TapOptions struct {
+	// Collections are the namespaces (as in a Scope, e.g. db.coll or db.*) and
+	// Commands the commands of the requests (all if empty)
+	Collections []string
+	Commands    []string
+	// Client is the client's address (with or without port), appName or user
+	Client string
+	// Fingerprint is the fingerprint of the command
+	Fingerprint string
+	// Sample is the fraction of the matching requests streamed (all if 0)
+	Sample float64
+	// Values streams the redacted values of requests rather than their shape
+	Values bool
+	// Duration is how long to stream for (capped by the provider's maximum)
+	Duration time.Duration
+}
+
+// Tap is a live stream of requests
+type Tap interface {
+	// Records returns the requests as they complete; the requests the reader
+	// doesn't keep up with are dropped
+	Records() <-chan *TapRecord
+	// Done is closed when the tap stops: it was closed, its context is done
+	// or its duration passed
+	Done() <-chan struct{}
+	// Close stops the tap
+	Close()
+}
+
+// TapProvider is an optional interface a Plugin can implement to stream a
+// sample of the requests live (e.g. the capture plugin). The control plane
+// streams the taps of the first plugin of the chain providing them.
+type TapProvider interface {
+	// StartTap starts a tap streaming until the context is done (or the
+	// duration passed); it returns an error if the tap can't be started (e.g.
+	// too many taps are streaming)
+	StartTap(ctx context.Context, opts TapOptions) (Tap, error)
+}
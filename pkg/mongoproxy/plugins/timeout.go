@@ -0,0 +1,206 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+)
+
+var (
+	pluginTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_timeout_total",
+		Help: "The total number of plugin calls which exceeded the plugin timeout",
+	}, []string{"plugin", "policy"})
+)
+
+// TimeoutPolicy defines what happens to a request when a plugin exceeds its timeout
+type TimeoutPolicy string
+
+const (
+	// TimeoutFail returns an error to the client
+	TimeoutFail TimeoutPolicy = "fail"
+	// TimeoutSkip continues the pipeline as if the plugin wasn't configured
+	TimeoutSkip TimeoutPolicy = "skip"
+)
+
+var errPluginAbandoned = errors.New("plugin call abandoned after timeout")
+
+// WithTimeout returns a Plugin which limits the time p itself (not including the
+// rest of the pipeline) takes to process a request. When exceeded the request
+// either fails or skips p depending on the policy; p keeps running in the
+// background (with a cancelled context) but can no longer call the rest of the pipeline.
+// With the skip policy p processes a copy of the request, so that the pipeline
+// can continue with the original while p still runs.
+func WithTimeout(p Plugin, timeout time.Duration, policy TimeoutPolicy) (Plugin, error) {
+	if timeout <= 0 {
+		return p, nil
+	}
+	switch policy {
+	case "":
+		policy = TimeoutFail
+	case TimeoutFail, TimeoutSkip:
+	default:
+		return nil, fmt.Errorf("unknown timeout policy %q", policy)
+	}
+	return &timeoutPlugin{Plugin: p, timeout: timeout, policy: policy}, nil
+}
+
+type timeoutPlugin struct {
+	Plugin
+	timeout time.Duration
+	policy  TimeoutPolicy
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *timeoutPlugin) Process(ctx context.Context, r *Request, next PipelineFunc) (bson.D, error) {
+	return p.wrap(p.Plugin.Process)(ctx, r, next)
+}
+
+// Unwrap returns the underlying plugin
+func (p *timeoutPlugin) Unwrap() Plugin {
+	return p.Plugin
+}
+
+type timeoutEventType int
+
+const (
+	timeoutEnterNext timeoutEventType = iota
+	timeoutExitNext
+	timeoutDone
+)
+
+type timeoutEvent struct {
+	t     timeoutEventType
+	d     bson.D
+	err   error
+	panic interface{}
+}
+
+// wrap returns a ProcessFunc which runs process in a goroutine and only counts
+// time spent outside of next against the timeout.
+func (p *timeoutPlugin) wrap(process ProcessFunc) ProcessFunc {
+	return func(ctx context.Context, r *Request, next PipelineFunc) (bson.D, error) {
+		pctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		finished := make(chan struct{})
+		defer close(finished)
+		events := make(chan timeoutEvent, 1)
+		send := func(e timeoutEvent) {
+			select {
+			case events <- e:
+			case <-finished:
+			}
+		}
+
+		// Under the skip policy the rest of the pipeline may run with r while
+		// the abandoned plugin still runs; so it gets its own copy
+		pr := r
+		if p.policy == TimeoutSkip {
+			var err error
+			if pr, err = r.clone(); err != nil {
+				return nil, err
+			}
+		}
+
+		var (
+			l          sync.Mutex
+			inNext     bool
+			abandoned  bool
+			downstream *timeoutEvent
+		)
+
+		wrappedNext := func(ctx context.Context, r *Request) (bson.D, error) {
+			l.Lock()
+			if abandoned {
+				l.Unlock()
+				return nil, errPluginAbandoned
+			}
+			inNext = true
+			l.Unlock()
+			send(timeoutEvent{t: timeoutEnterNext})
+
+			d, err := next(ctx, r)
+
+			l.Lock()
+			inNext = false
+			downstream = &timeoutEvent{d: d, err: err}
+			l.Unlock()
+			send(timeoutEvent{t: timeoutExitNext})
+			return d, err
+		}
+
+		go func() {
+			e := timeoutEvent{t: timeoutDone}
+			defer func() {
+				if err := recover(); err != nil {
+					e.panic = err
+				}
+				send(e)
+			}()
+			e.d, e.err = process(pctx, pr, wrappedNext)
+		}()
+
+		var elapsed time.Duration
+		phaseStart := time.Now()
+		timer := time.NewTimer(p.timeout)
+		defer func() { timer.Stop() }()
+		timerC := timer.C
+
+		for {
+			select {
+			case e := <-events:
+				switch e.t {
+				case timeoutEnterNext:
+					elapsed += time.Since(phaseStart)
+					timer.Stop()
+					timerC = nil
+				case timeoutExitNext:
+					phaseStart = time.Now()
+					timer = time.NewTimer(p.timeout - elapsed)
+					timerC = timer.C
+				case timeoutDone:
+					if e.panic != nil {
+						panic(e.panic)
+					}
+					// The plugin is done; its changes to the request are kept
+					if pr != r {
+						*r = *pr
+					}
+					return e.d, e.err
+				}
+
+			case <-timerC:
+				l.Lock()
+				if inNext {
+					// The plugin already handed off to the pipeline; the event is on its way
+					l.Unlock()
+					timerC = nil
+					continue
+				}
+				abandoned = true
+				result := downstream
+				l.Unlock()
+				cancel()
+
+				pluginTimeouts.WithLabelValues(p.Name(), string(p.policy)).Inc()
+				if p.policy == TimeoutFail {
+					return mongoerror.ExceededTimeLimit.ErrMessage("plugin " + p.Name() + " exceeded timeout"), nil
+				}
+				// Skip the plugin; if the rest of the pipeline already ran use its result
+				if result != nil {
+					return result.d, result.err
+				}
+				return next(ctx, r)
+			}
+		}
+	}
+}
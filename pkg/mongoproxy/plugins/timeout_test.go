@@ -0,0 +1,138 @@
+package plugins
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+)
+
+type sleepPlugin struct {
+	noopPlugin
+	before, after time.Duration
+}
+
+func (p *sleepPlugin) Process(ctx context.Context, r *Request, next PipelineFunc) (bson.D, error) {
+	time.Sleep(p.before)
+	d, err := next(ctx, r)
+	time.Sleep(p.after)
+	if err != nil {
+		return d, err
+	}
+	return append(d, bson.E{"plugin", true}), nil
+}
+
+func TestTimeout(t *testing.T) {
+	if _, err := WithTimeout(&noopPlugin{}, time.Second, "unknown"); err == nil {
+		t.Fatalf("expected error for unknown policy")
+	}
+
+	tests := []struct {
+		plugin     *sleepPlugin
+		downstream time.Duration
+		policy     TimeoutPolicy
+		ok         bool
+		pluginRan  bool
+		nextCalls  int32
+	}{
+		// Fast plugin
+		{plugin: &sleepPlugin{}, policy: TimeoutFail, ok: true, pluginRan: true, nextCalls: 1},
+		// Slow downstream isn't counted against the plugin
+		{plugin: &sleepPlugin{}, downstream: 100 * time.Millisecond, policy: TimeoutFail, ok: true, pluginRan: true, nextCalls: 1},
+		// Slow before next
+		{plugin: &sleepPlugin{before: 100 * time.Millisecond}, policy: TimeoutFail, ok: false, nextCalls: 0},
+		{plugin: &sleepPlugin{before: 100 * time.Millisecond}, policy: TimeoutSkip, ok: true, nextCalls: 1},
+		// Slow after next
+		{plugin: &sleepPlugin{after: 100 * time.Millisecond}, policy: TimeoutFail, ok: false, nextCalls: 1},
+		{plugin: &sleepPlugin{after: 100 * time.Millisecond}, policy: TimeoutSkip, ok: true, nextCalls: 1},
+	}
+
+	for i, test := range tests {
+		var nextCalls int32
+		p, err := WithTimeout(test.plugin, 20*time.Millisecond, test.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pipe := BuildPipeline([]Plugin{p}, func(ctx context.Context, r *Request) (bson.D, error) {
+			atomic.AddInt32(&nextCalls, 1)
+			time.Sleep(test.downstream)
+			return bson.D{{"ok", 1}}, nil
+		})
+		d, err := pipe(context.TODO(), &Request{})
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if bsonutil.Ok(d) != test.ok {
+			t.Fatalf("%d: mismatch in ok expected=%v actual=%v", i, test.ok, d)
+		}
+		_, pluginRan := bsonutil.Lookup(d, "plugin")
+		if pluginRan != test.pluginRan {
+			t.Fatalf("%d: mismatch in plugin ran expected=%v actual=%v", i, test.pluginRan, pluginRan)
+		}
+
+		// Wait for any abandoned plugin to finish to ensure it didn't call next again
+		time.Sleep(150 * time.Millisecond)
+		if n := atomic.LoadInt32(&nextCalls); n != test.nextCalls {
+			t.Fatalf("%d: mismatch in next calls expected=%d actual=%d", i, test.nextCalls, n)
+		}
+	}
+}
+
+// renamePlugin renames the collection of the request, after sleeping
+type renamePlugin struct {
+	noopPlugin
+	sleep time.Duration
+}
+
+func (p *renamePlugin) Process(ctx context.Context, r *Request, next PipelineFunc) (bson.D, error) {
+	time.Sleep(p.sleep)
+	r.SetNamespace("db", "renamed")
+	r.Map["renamed"] = true
+	return next(ctx, r)
+}
+
+func TestTimeoutSkipRequest(t *testing.T) {
+	tests := []struct {
+		sleep time.Duration
+		// collection is the one the rest of the pipeline and the caller see
+		collection string
+	}{
+		{collection: "renamed"},
+		// The abandoned plugin doesn't change the request the pipeline continues with
+		{sleep: 50 * time.Millisecond, collection: "c"},
+	}
+
+	for i, test := range tests {
+		p, err := WithTimeout(&renamePlugin{sleep: test.sleep}, 20*time.Millisecond, TimeoutSkip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var collection string
+		pipe := BuildPipeline([]Plugin{p}, func(ctx context.Context, r *Request) (bson.D, error) {
+			collection = r.Collection()
+			return bson.D{{"ok", 1}}, nil
+		})
+
+		cmd := &command.Find{}
+		if err := cmd.FromBSOND(bson.D{{"find", "c"}, {"$db", "db"}}); err != nil {
+			t.Fatal(err)
+		}
+		r := &Request{CommandName: "find", Command: cmd, Map: map[string]interface{}{}}
+		if _, err := pipe(context.TODO(), r); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if collection != test.collection || r.Collection() != test.collection {
+			t.Fatalf("%d: expected collection %s, got %s and %s", i, test.collection, collection, r.Collection())
+		}
+		if _, ok := r.Map["renamed"]; ok != (test.sleep == 0) {
+			t.Fatalf("%d: unexpected request map %v", i, r.Map)
+		}
+		// Let the abandoned plugin finish
+		time.Sleep(50 * time.Millisecond)
+	}
+}
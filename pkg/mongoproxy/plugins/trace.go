@@ -0,0 +1,157 @@
+package plugins
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+type requestTraceContextKey struct{}
+
+// The phases of a request recorded in its RequestTrace (the proxy times the
+// others itself)
+const (
+	PhasePlugin  = "plugin"
+	PhaseBackend = "backend"
+)
+
+// Phase is the time a request spent in a phase of its handling: reading,
+// decoding, each plugin, the backend, encoding and writing
+type Phase struct {
+	Name string `json:"name"`
+	// Plugin is the plugin of plugin phases
+	Plugin   string        `json:"plugin,omitempty"`
+	Duration time.Duration `json:"-"`
+
+	// index orders the plugin phases as the chain
+	index int
+}
+
+// Cancellation is the phase a request was in when its context was cancelled
+type Cancellation struct {
+	Phase  string `json:"phase"`
+	Plugin string `json:"plugin,omitempty"`
+	// Reason is "timeout" if the context's deadline passed, else "cancelled"
+	Reason string `json:"reason"`
+}
+
+// RequestTrace records the time a request spends in each phase of its handling.
+// The proxy adds one to the request context when request phases are enabled;
+// the pipeline records the time of each plugin (excluding the rest of the
+// pipeline and the backend) and the backend plugin records the backend time. A
+// nil RequestTrace records nothing.
+type RequestTrace struct {
+	l       sync.Mutex
+	phases  []Phase
+	backend time.Duration
+	// cancelled is the phase which first saw the context done (nil if it wasn't)
+	cancelled *Cancellation
+}
+
+// WithRequestTrace returns a context with the trace
+func WithRequestTrace(ctx context.Context, t *RequestTrace) context.Context {
+	return context.WithValue(ctx, requestTraceContextKey{}, t)
+}
+
+// GetRequestTrace returns the trace of the request (nil if it's not traced)
+func GetRequestTrace(ctx context.Context) *RequestTrace {
+	t, _ := ctx.Value(requestTraceContextKey{}).(*RequestTrace)
+	return t
+}
+
+// AddBackend adds the time of a backend round trip
+func (t *RequestTrace) AddBackend(d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.add(Phase{Name: PhaseBackend, Duration: d})
+	t.l.Lock()
+	t.backend += d
+	t.l.Unlock()
+}
+
+// addPlugin adds the time of the plugin (the i-th of the chain)
+func (t *RequestTrace) addPlugin(i int, plugin string, d time.Duration) {
+	t.add(Phase{Name: PhasePlugin, Plugin: plugin, Duration: d, index: i})
+}
+
+func (t *RequestTrace) add(phase Phase) {
+	if t == nil {
+		return
+	}
+	t.l.Lock()
+	defer t.l.Unlock()
+	for i, p := range t.phases {
+		if p.Name == phase.Name && p.Plugin == phase.Plugin {
+			t.phases[i].Duration += phase.Duration
+			return
+		}
+	}
+	t.phases = append(t.phases, phase)
+}
+
+// backendTotal returns the backend time so far
+func (t *RequestTrace) backendTotal() time.Duration {
+	if t == nil {
+		return 0
+	}
+	t.l.Lock()
+	defer t.l.Unlock()
+	return t.backend
+}
+
+// Cancel records the phase as the one the request was in when its context was
+// done, unless one already was (the innermost phase sees it first)
+func (t *RequestTrace) Cancel(ctx context.Context, phase, plugin string) {
+	if t == nil {
+		return
+	}
+	err := ctx.Err()
+	if err == nil {
+		// The backend times out on socket deadlines set from the context's, which
+		// may expire before the context is done
+		if deadline, ok := ctx.Deadline(); !ok || time.Now().Before(deadline) {
+			return
+		}
+		err = context.DeadlineExceeded
+	}
+	reason := "cancelled"
+	if err == context.DeadlineExceeded {
+		reason = "timeout"
+	}
+	t.l.Lock()
+	defer t.l.Unlock()
+	if t.cancelled == nil {
+		t.cancelled = &Cancellation{Phase: phase, Plugin: plugin, Reason: reason}
+	}
+}
+
+// Phases returns the recorded phases: the plugins in chain order, then the backend
+func (t *RequestTrace) Phases() []Phase {
+	if t == nil {
+		return nil
+	}
+	t.l.Lock()
+	defer t.l.Unlock()
+	phases := append([]Phase(nil), t.phases...)
+	// The plugins finish innermost first
+	sort.SliceStable(phases, func(i, j int) bool {
+		if phases[i].Name != phases[j].Name {
+			return phases[i].Name == PhasePlugin
+		}
+		return phases[i].index < phases[j].index
+	})
+	return phases
+}
+
+// Cancelled returns the phase the request was in when its context was done (nil
+// if it wasn't)
+func (t *RequestTrace) Cancelled() *Cancellation {
+	if t == nil {
+		return nil
+	}
+	t.l.Lock()
+	defer t.l.Unlock()
+	return t.cancelled
+}
@@ -0,0 +1,82 @@
+package plugins
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/command"
+)
+
+// tracedPlugin sleeps for self in the plugin and for backend in a (traced)
+// backend round trip before calling the rest of the pipeline
+type tracedPlugin struct {
+	name          string
+	self, backend time.Duration
+}
+
+func (p *tracedPlugin) Name() string           { return p.name }
+func (p *tracedPlugin) Configure(bson.D) error { return nil }
+func (p *tracedPlugin) Process(ctx context.Context, r *Request, next PipelineFunc) (bson.D, error) {
+	time.Sleep(p.self)
+	if p.backend > 0 {
+		start := time.Now()
+		select {
+		case <-time.After(p.backend):
+		case <-ctx.Done():
+		}
+		trace := GetRequestTrace(ctx)
+		trace.AddBackend(time.Since(start))
+		trace.Cancel(ctx, PhaseBackend, "")
+	}
+	return next(ctx, r)
+}
+
+func TestPipelineTrace(t *testing.T) {
+	pipe := BuildPipeline([]Plugin{
+		&tracedPlugin{name: "a", self: 20 * time.Millisecond},
+		&tracedPlugin{name: "b"},
+		&tracedPlugin{name: "c", backend: time.Second},
+	}, func(context.Context, *Request) (bson.D, error) {
+		return bson.D{{"ok", 1}}, nil
+	})
+
+	trace := &RequestTrace{}
+	ctx, cancel := context.WithTimeout(WithRequestTrace(context.Background(), trace), 50*time.Millisecond)
+	defer cancel()
+	if _, err := pipe(ctx, &Request{CommandName: "find", Command: &command.Find{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	phases := trace.Phases()
+	expected := []Phase{{Name: PhasePlugin, Plugin: "a"}, {Name: PhasePlugin, Plugin: "b"}, {Name: PhasePlugin, Plugin: "c"}, {Name: PhaseBackend}}
+	if len(phases) != len(expected) {
+		t.Fatalf("unexpected phases %v", phases)
+	}
+	for i, phase := range phases {
+		if phase.Name != expected[i].Name || phase.Plugin != expected[i].Plugin {
+			t.Fatalf("unexpected phase %d: %v", i, phase)
+		}
+	}
+	// The plugins' time excludes the rest of the pipeline and the backend
+	if phases[0].Duration < 20*time.Millisecond || phases[0].Duration > 40*time.Millisecond {
+		t.Fatalf("unexpected time of a: %v", phases[0].Duration)
+	}
+	if phases[2].Duration > 10*time.Millisecond || phases[3].Duration < 20*time.Millisecond {
+		t.Fatalf("unexpected time of c (%v) and the backend (%v)", phases[2].Duration, phases[3].Duration)
+	}
+
+	// The backend saw the deadline first
+	if c := trace.Cancelled(); c == nil || *c != (Cancellation{Phase: PhaseBackend, Reason: "timeout"}) {
+		t.Fatalf("unexpected cancellation %v", c)
+	}
+
+	// Untraced requests record nothing
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if _, err := pipe(ctx, &Request{CommandName: "find", Command: &command.Find{}}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,76 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TransactionCommand is a command run in a transaction
+type TransactionCommand struct {
+	Database string
+	// Command is the command's document, without session or write concern fields
+	// (e.g. lsid, txnNumber) which are set by the TransactionRunner
+	Command bson.D
+}
+
+// TransactionRunner is an optional interface a Plugin can implement to run
+// commands in a transaction on the downstream server on behalf of the proxy, like
+// CommandRunner
+type TransactionRunner interface {
+	// RunTransaction runs the commands in a transaction committed with the write
+	// concern (nil for the default), returning the responses of the commands run.
+	// The transaction is aborted, and an error returned, when a command fails or
+	// has write errors (its response being the last one returned) or the commit
+	// fails.
+	RunTransaction(ctx context.Context, cmds []TransactionCommand, writeConcern interface{}) ([]bson.D, error)
+}
+
+// TransactionRunnerUser is an optional interface a Plugin can implement to be
+// passed the TransactionRunner of its chain (the first plugin implementing
+// TransactionRunner) when the chain is built, like CommandRunnerUser; it is
+// passed nil if the chain has none.
+type TransactionRunnerUser interface {
+	SetTransactionRunner(TransactionRunner)
+}
+
+// SetTransactionRunners passes the first TransactionRunner in the plugins to all
+// the plugins implementing TransactionRunnerUser
+func SetTransactionRunners(ps []Plugin) {
+	var tr TransactionRunner
+	for _, p := range ps {
+		if r, ok := Unwrap(p).(TransactionRunner); ok {
+			tr = r
+			break
+		}
+	}
+	for _, p := range ps {
+		if u, ok := Unwrap(p).(TransactionRunnerUser); ok {
+			u.SetTransactionRunner(tr)
+		}
+	}
+}
+
+// CheckTransactionRunnerUsers returns an error if a plugin implementing
+// TransactionRunnerUser isn't directly followed by the chain's TransactionRunner
+// (if any): the plugins between them would be skipped for the commands run in
+// transactions
+func CheckTransactionRunnerUsers(ps []Plugin) error {
+	runner := -1
+	for i, p := range ps {
+		if _, ok := Unwrap(p).(TransactionRunner); ok {
+			runner = i
+			break
+		}
+	}
+	if runner < 0 {
+		return nil
+	}
+	for i, p := range ps {
+		if _, ok := Unwrap(p).(TransactionRunnerUser); ok && i != runner-1 {
+			return fmt.Errorf("plugin %s must be directly followed by the plugin running its transactions (%s)", p.Name(), ps[runner].Name())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package plugins
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type transactionRunnerPlugin struct{ noopPlugin }
+
+func (*transactionRunnerPlugin) Name() string { return "runner" }
+
+func (*transactionRunnerPlugin) RunTransaction(context.Context, []TransactionCommand, interface{}) ([]bson.D, error) {
+	return nil, nil
+}
+
+type transactionUserPlugin struct{ noopPlugin }
+
+func (*transactionUserPlugin) Name() string { return "user" }
+
+func (*transactionUserPlugin) SetTransactionRunner(TransactionRunner) {}
+
+func TestCheckTransactionRunnerUsers(t *testing.T) {
+	user, runner, other := &transactionUserPlugin{}, &transactionRunnerPlugin{}, &lifecyclePlugin{name: "other"}
+	tests := []struct {
+		ps []Plugin
+		ok bool
+	}{
+		{ps: []Plugin{other, user, runner}, ok: true},
+		{ps: []Plugin{user, runner, other}, ok: true},
+		{ps: []Plugin{other, runner}, ok: true},
+		// Without a runner the user fails its writes itself
+		{ps: []Plugin{user, other}, ok: true},
+		// The plugins between the user and the runner would be skipped
+		{ps: []Plugin{user, other, runner}},
+	}
+	for i, test := range tests {
+		if err := CheckTransactionRunnerUsers(test.ps); (err == nil) != test.ok {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+package ttl
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const Name = "ttl"
+
+// verifyTask is the singleton task verifying the TTL indexes and schemas
+const verifyTask = "ttl.verify"
+
+var (
+	injectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_ttl_injected_total",
+		Help: "The total expiry timestamps injected into writes",
+	}, []string{"db", "collection"})
+	driftGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mongoproxy_plugins_ttl_drift",
+		Help: "Whether the backend TTL index or schema of a collection doesn't match its TTL policy",
+	}, []string{"db", "collection", "reason"})
+)
+
+// Reasons of a drift
+const (
+	// DriftMissingIndex is a collection without a TTL index on the field
+	DriftMissingIndex = "missingIndex"
+	// DriftIndexExpiry is a TTL index on the field with expireAfterSeconds other than 0
+	DriftIndexExpiry = "indexExpiry"
+	// DriftSchemaUndeclared is a collection schema which doesn't declare the field
+	DriftSchemaUndeclared = "schemaUndeclared"
+	// DriftSchemaType is a collection schema declaring the field with a type other than date
+	DriftSchemaType = "schemaType"
+)
+
+var driftReasons = []string{DriftMissingIndex, DriftIndexExpiry, DriftSchemaUndeclared, DriftSchemaType}
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &TTLPlugin{
+			conf: TTLPluginConfig{},
+		}
+	})
+}
+
+type TTLPluginConfig struct {
+	// Policies are the TTL policies of collections; the first policy matching the
+	// request applies
+	Policies []*Policy `bson:"policies"`
+	// VerifyInterval is how often the TTL index and schema of the collections written
+	// to are checked against their policy (default ""; not checked)
+	VerifyInterval string `bson:"verifyInterval"`
+
+	verifyInterval time.Duration
+}
+
+// Policy is the TTL of the documents of a set of collections
+type Policy struct {
+	// Scope are the collections the policy applies to (same format as a plugin scope; required)
+	Scope *plugins.Scope `bson:"scope"`
+	// Field is the (top-level) field set to the time the document expires (required)
+	Field string `bson:"field"`
+	// TTL is how long after being written documents expire (required)
+	TTL string `bson:"ttl"`
+	// Overwrite replaces the expiry set by clients (default false; it is kept)
+	Overwrite bool `bson:"overwrite"`
+	// RefreshOnUpdate resets the expiry of documents on updates (default false; only
+	// inserts and upserts set it)
+	RefreshOnUpdate bool `bson:"refreshOnUpdate"`
+
+	ttl time.Duration
+}
+
+func (p *Policy) load() error {
+	if p.Scope.IsZero() {
+		return fmt.Errorf("scope is required")
+	}
+	p.Scope.Compile()
+
+	if p.Field == "" || p.Field == "_id" || strings.ContainsAny(p.Field, ".$") {
+		return fmt.Errorf("field must be a top-level field other than _id: %q", p.Field)
+	}
+	var err error
+	if p.ttl, err = time.ParseDuration(p.TTL); err != nil {
+		return err
+	}
+	if p.ttl <= 0 {
+		return fmt.Errorf("ttl must be positive: %s", p.TTL)
+	}
+	return nil
+}
+
+type namespace struct {
+	db, collection string
+}
+
+// This is a plugin that sets the expiry timestamp of documents written to
+// collections with a TTL policy
+type TTLPlugin struct {
+	conf TTLPluginConfig
+
+	providersLock sync.RWMutex
+	cr            plugins.CommandRunner
+	sp            plugins.SchemaProvider
+	c             plugins.Coordinator
+
+	// written are the namespaces written to (and their policy), which are verified
+	writtenLock sync.Mutex
+	written     map[namespace]*Policy
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (p *TTLPlugin) Name() string { return Name }
+
+// ReadsDocuments returns true as the expiry is set on inserted documents
+func (p *TTLPlugin) ReadsDocuments() bool { return true }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *TTLPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	for i, policy := range p.conf.Policies {
+		if policy == nil {
+			return fmt.Errorf("empty policy %d", i)
+		}
+		if err := policy.load(); err != nil {
+			return fmt.Errorf("invalid policy %d: %w", i, err)
+		}
+	}
+	if p.conf.VerifyInterval != "" {
+		if p.conf.verifyInterval, err = time.ParseDuration(p.conf.VerifyInterval); err != nil {
+			return err
+		}
+		if p.conf.verifyInterval <= 0 {
+			return fmt.Errorf("verifyInterval must be positive: %s", p.conf.VerifyInterval)
+		}
+	}
+
+	p.written = make(map[namespace]*Policy)
+
+	return nil
+}
+
+// SetCommandRunner sets the runner used to list the TTL indexes of collections
+func (p *TTLPlugin) SetCommandRunner(cr plugins.CommandRunner) {
+	p.providersLock.Lock()
+	defer p.providersLock.Unlock()
+	p.cr = cr
+}
+
+// SetSchemaProvider sets the provider of the schemas declaring the expiry field
+func (p *TTLPlugin) SetSchemaProvider(sp plugins.SchemaProvider) {
+	p.providersLock.Lock()
+	defer p.providersLock.Unlock()
+	p.sp = sp
+}
+
+func (p *TTLPlugin) providers() (plugins.CommandRunner, plugins.SchemaProvider) {
+	p.providersLock.RLock()
+	defer p.providersLock.RUnlock()
+	return p.cr, p.sp
+}
+
+// SetCoordinator sets the coordinator electing the proxy verifying for the fleet
+func (p *TTLPlugin) SetCoordinator(c plugins.Coordinator) {
+	p.providersLock.Lock()
+	defer p.providersLock.Unlock()
+	p.c = c
+}
+
+func (p *TTLPlugin) coordinator() plugins.Coordinator {
+	p.providersLock.RLock()
+	defer p.providersLock.RUnlock()
+	return p.c
+}
+
+// Start starts verifying the written collections every verifyInterval (on only
+// one proxy of the fleet with a coordinator)
+func (p *TTLPlugin) Start(ctx context.Context) error {
+	if p.conf.verifyInterval == 0 {
+		return nil
+	}
+	p.stop = make(chan struct{})
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		plugins.RunSingleton(verifyTask, p.conf.verifyInterval, p.coordinator, p.stop, p.verify)
+	}()
+
+	return nil
+}
+
+// Stop stops the verification
+func (p *TTLPlugin) Stop(ctx context.Context) error {
+	if p.stop == nil {
+		return nil
+	}
+	close(p.stop)
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// drift returns the ways the collection's TTL index and schema don't match the policy
+func (p *TTLPlugin) drift(ctx context.Context, ns namespace, policy *Policy) (map[string]bool, error) {
+	drift := make(map[string]bool, len(driftReasons))
+	cr, sp := p.providers()
+
+	if sp != nil {
+		if typ, ok := sp.FieldType(ns.db, ns.collection, policy.Field); ok {
+			drift[DriftSchemaUndeclared] = typ == ""
+			drift[DriftSchemaType] = typ != "" && typ != "date"
+		}
+	}
+
+	if cr == nil {
+		return drift, fmt.Errorf("no plugin in the chain can run commands on the backend")
+	}
+	result, err := cr.RunCommand(ctx, ns.db, bson.D{{"listIndexes", ns.collection}})
+	if err != nil {
+		return drift, err
+	}
+	batch, _ := bsonutil.Lookup(result, "cursor", "firstBatch")
+	items, _ := batch.(primitive.A)
+
+	drift[DriftMissingIndex] = true
+	for _, item := range items {
+		spec, ok := item.(bson.D)
+		if !ok {
+			continue
+		}
+		key, _ := bsonutil.Lookup(spec, "key")
+		keyD, _ := key.(bson.D)
+		expire, ok := bsonutil.Lookup(spec, "expireAfterSeconds")
+		if !ok || len(keyD) != 1 || keyD[0].Key != policy.Field {
+			continue
+		}
+		drift[DriftMissingIndex] = false
+		// The field is the time the document expires
+		drift[DriftIndexExpiry] = !isZero(expire)
+	}
+	return drift, nil
+}
+
+func isZero(v interface{}) bool {
+	switch n := v.(type) {
+	case int32:
+		return n == 0
+	case int64:
+		return n == 0
+	case float64:
+		return n == 0
+	}
+	return false
+}
+
+// verify checks the TTL index and schema of the collections written to
+func (p *TTLPlugin) verify(ctx context.Context) {
+	p.writtenLock.Lock()
+	written := make(map[namespace]*Policy, len(p.written))
+	for ns, policy := range p.written {
+		written[ns] = policy
+	}
+	p.writtenLock.Unlock()
+
+	for ns, policy := range written {
+		drift, err := p.drift(ctx, ns, policy)
+		if err != nil {
+			logrus.Errorf("TTL VERIFY ERROR: %s.%s: %s", ns.db, ns.collection, err.Error())
+		}
+		for _, reason := range driftReasons {
+			v, ok := drift[reason]
+			if !ok {
+				continue
+			}
+			if v {
+				driftGauge.WithLabelValues(ns.db, ns.collection, reason).Set(1)
+				logrus.Warningf("TTL DRIFT: %s.%s with ttl field %s: %s", ns.db, ns.collection, policy.Field, reason)
+			} else {
+				driftGauge.WithLabelValues(ns.db, ns.collection, reason).Set(0)
+			}
+		}
+	}
+}
+
+func (p *TTLPlugin) policy(r *plugins.Request) *Policy {
+	for _, policy := range p.conf.Policies {
+		if policy.Scope.Match(r) {
+			return policy
+		}
+	}
+	return nil
+}
+
+// setDocument sets the expiry in the document (which is inserted or replaces one)
+func (policy *Policy) setDocument(doc bson.D, expiry primitive.DateTime) (bson.D, bool) {
+	for i, e := range doc {
+		if e.Key == policy.Field {
+			if !policy.Overwrite {
+				return doc, false
+			}
+			doc[i].Value = expiry
+			return doc, true
+		}
+	}
+	return append(doc, bson.E{policy.Field, expiry}), true
+}
+
+// setUpdate sets the expiry in the update (an operator update or a replacement)
+func (policy *Policy) setUpdate(update bson.D, upsert bool, expiry primitive.DateTime) (bson.D, bool) {
+	if len(update) == 0 || !strings.HasPrefix(update[0].Key, "$") {
+		return policy.setDocument(update, expiry)
+	}
+
+	op := "$set"
+	if !policy.RefreshOnUpdate {
+		if !upsert {
+			return update, false
+		}
+		op = "$setOnInsert"
+	}
+
+	// Updates of the field by the client are kept unless overwriting
+	for _, e := range update {
+		if fields, ok := e.Value.(bson.D); ok {
+			if _, ok := bsonutil.Lookup(fields, policy.Field); ok && !policy.Overwrite {
+				return update, false
+			}
+		}
+	}
+
+	out := make(bson.D, 0, len(update)+1)
+	var added bool
+	for _, e := range update {
+		fields, ok := e.Value.(bson.D)
+		if !ok {
+			out = append(out, e)
+			continue
+		}
+		// Drop the client's value (setting a field with 2 operators is an error)
+		set := make(bson.D, 0, len(fields)+1)
+		for _, f := range fields {
+			if f.Key != policy.Field {
+				set = append(set, f)
+			}
+		}
+		if e.Key == op {
+			set = append(set, bson.E{policy.Field, expiry})
+			added = true
+		}
+		if len(set) > 0 {
+			out = append(out, bson.E{e.Key, set})
+		}
+	}
+	if !added {
+		out = append(out, bson.E{op, bson.D{{policy.Field, expiry}}})
+	}
+	return out, true
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *TTLPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	policy := p.policy(r)
+	if policy == nil {
+		return next(ctx, r)
+	}
+	expiry := primitive.NewDateTimeFromTime(time.Now().Add(policy.ttl))
+
+	var injected int
+	switch cmd := r.Command.(type) {
+	case *command.Insert:
+		for i, doc := range cmd.Documents {
+			if doc, ok := policy.setDocument(doc, expiry); ok {
+				r.SetDocument(i, doc)
+				injected++
+			}
+		}
+	case *command.Update:
+		for i, u := range cmd.Updates {
+			if update, ok := policy.setUpdate(u.U, bsonutil.GetBoolDefault(u.Upsert, false), expiry); ok {
+				r.SetUpdate(i, update)
+				injected++
+			}
+		}
+	case *command.FindAndModify:
+		if len(cmd.Update) > 0 {
+			if update, ok := policy.setUpdate(cmd.Update, bsonutil.GetBoolDefault(cmd.Upsert, false), expiry); ok {
+				r.SetUpdate(0, update)
+				injected++
+			}
+		}
+	default:
+		return next(ctx, r)
+	}
+
+	db, collection := command.GetCommandDatabase(r.Command), command.GetCommandCollection(r.Command)
+	if injected > 0 {
+		injectedTotal.WithLabelValues(db, collection).Add(float64(injected))
+	}
+	if p.conf.verifyInterval > 0 {
+		p.writtenLock.Lock()
+		p.written[namespace{db, collection}] = policy
+		p.writtenLock.Unlock()
+	}
+
+	return next(ctx, r)
+}
@@ -0,0 +1,201 @@
+package ttl
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func TestTTL(t *testing.T) {
+	d := &TTLPlugin{}
+	if err := d.Configure(bson.D{{"policies", bson.A{
+		bson.D{{"scope", bson.D{{"collections", bson.A{"db.sessions"}}}}, {"field", "expireAt"}, {"ttl", "1h"}},
+		bson.D{{"scope", bson.D{{"collections", bson.A{"db.cache"}}}}, {"field", "expireAt"}, {"ttl", "1h"}, {"overwrite", true}, {"refreshOnUpdate", true}},
+	}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var last command.Command
+	p := plugins.BuildPipeline([]plugins.Plugin{d}, func(ctx context.Context, r *plugins.Request) (bson.D, error) {
+		last = r.Command
+		return bson.D{{"ok", 1}}, nil
+	})
+
+	clientExpiry := primitive.NewDateTimeFromTime(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	tests := []struct {
+		cmd bson.D
+		// get returns the document or update of the command sent to the backend
+		get func(command.Command) bson.D
+		// path to the expiry in it ("" if there should be none)
+		path []string
+		// whether the expiry is the client's
+		client bool
+	}{
+		{
+			bson.D{{"insert", "sessions"}, {"documents", bson.A{bson.D{{"a", 1}}}}, {"$db", "db"}},
+			func(c command.Command) bson.D { return c.(*command.Insert).Documents[0] },
+			[]string{"expireAt"}, false,
+		},
+		{
+			bson.D{{"insert", "sessions"}, {"documents", bson.A{bson.D{{"a", 1}, {"expireAt", clientExpiry}}}}, {"$db", "db"}},
+			func(c command.Command) bson.D { return c.(*command.Insert).Documents[0] },
+			[]string{"expireAt"}, true,
+		},
+		{
+			bson.D{{"insert", "cache"}, {"documents", bson.A{bson.D{{"a", 1}, {"expireAt", clientExpiry}}}}, {"$db", "db"}},
+			func(c command.Command) bson.D { return c.(*command.Insert).Documents[0] },
+			[]string{"expireAt"}, false,
+		},
+		{
+			bson.D{{"insert", "other"}, {"documents", bson.A{bson.D{{"a", 1}}}}, {"$db", "db"}},
+			func(c command.Command) bson.D { return c.(*command.Insert).Documents[0] },
+			nil, false,
+		},
+		// Updates only set the expiry on upserts (unless refreshed)
+		{
+			bson.D{{"update", "sessions"}, {"updates", bson.A{bson.D{{"q", bson.D{{"a", 1}}}, {"u", bson.D{{"$set", bson.D{{"b", 1}}}}}}}}, {"$db", "db"}},
+			func(c command.Command) bson.D { return c.(*command.Update).Updates[0].U },
+			nil, false,
+		},
+		{
+			bson.D{{"update", "sessions"}, {"updates", bson.A{bson.D{{"q", bson.D{{"a", 1}}}, {"u", bson.D{{"$set", bson.D{{"b", 1}}}}}, {"upsert", true}}}}, {"$db", "db"}},
+			func(c command.Command) bson.D { return c.(*command.Update).Updates[0].U },
+			[]string{"$setOnInsert", "expireAt"}, false,
+		},
+		{
+			bson.D{{"update", "sessions"}, {"updates", bson.A{bson.D{{"q", bson.D{{"a", 1}}}, {"u", bson.D{{"b", 1}}}}}}, {"$db", "db"}},
+			func(c command.Command) bson.D { return c.(*command.Update).Updates[0].U },
+			[]string{"expireAt"}, false,
+		},
+		{
+			bson.D{{"update", "cache"}, {"updates", bson.A{bson.D{{"q", bson.D{{"a", 1}}}, {"u", bson.D{{"$set", bson.D{{"b", 1}, {"expireAt", clientExpiry}}}}}}}}, {"$db", "db"}},
+			func(c command.Command) bson.D { return c.(*command.Update).Updates[0].U },
+			[]string{"$set", "expireAt"}, false,
+		},
+		{
+			bson.D{{"update", "cache"}, {"updates", bson.A{bson.D{{"q", bson.D{{"a", 1}}}, {"u", bson.D{{"$setOnInsert", bson.D{{"expireAt", clientExpiry}}}, {"$inc", bson.D{{"n", 1}}}}}}}}, {"$db", "db"}},
+			func(c command.Command) bson.D { return c.(*command.Update).Updates[0].U },
+			[]string{"$set", "expireAt"}, false,
+		},
+		{
+			bson.D{{"findAndModify", "sessions"}, {"query", bson.D{{"a", 1}}}, {"update", bson.D{{"$inc", bson.D{{"n", 1}}}}}, {"upsert", true}, {"$db", "db"}},
+			func(c command.Command) bson.D { return c.(*command.FindAndModify).Update },
+			[]string{"$setOnInsert", "expireAt"}, false,
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			cmd, ok := command.GetCommand(test.cmd[0].Key)
+			if !ok {
+				t.Fatalf("no such command: %s", test.cmd[0].Key)
+			}
+			if err := cmd.FromBSOND(test.cmd); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := p(context.TODO(), &plugins.Request{CommandName: test.cmd[0].Key, Command: cmd}); err != nil {
+				t.Fatal(err)
+			}
+
+			doc := test.get(last)
+			if test.path == nil {
+				for _, e := range doc {
+					if e.Key == "expireAt" {
+						t.Fatalf("unexpected expiry in %v", doc)
+					}
+				}
+				return
+			}
+			v, ok := bsonutil.Lookup(doc, test.path...)
+			if !ok {
+				t.Fatalf("no expiry in %v", doc)
+			}
+			if (v == clientExpiry) != test.client {
+				t.Fatalf("unexpected expiry %v in %v", v, doc)
+			}
+			// The client's expiry isn't set by another operator
+			if test.path[0] == "$set" {
+				if _, ok := bsonutil.Lookup(doc, "$setOnInsert", "expireAt"); ok {
+					t.Fatalf("expiry set twice in %v", doc)
+				}
+			}
+		})
+	}
+}
+
+type indexRunner struct {
+	indexes bson.A
+}
+
+func (r *indexRunner) RunCommand(ctx context.Context, db string, cmd bson.D) (bson.D, error) {
+	return bson.D{{"cursor", bson.D{{"firstBatch", r.indexes}}}, {"ok", 1}}, nil
+}
+
+type fieldTypes map[string]string
+
+func (f fieldTypes) FieldType(db, collection, field string) (string, bool) {
+	typ, ok := f[db+"."+collection]
+	return typ, ok
+}
+
+func TestDrift(t *testing.T) {
+	policy := &Policy{Field: "expireAt"}
+	ns := namespace{"db", "coll"}
+	idIndex := bson.D{{"key", bson.D{{"_id", 1}}}, {"name", "_id_"}}
+
+	tests := []struct {
+		indexes bson.A
+		types   fieldTypes
+		drift   map[string]bool
+	}{
+		{
+			bson.A{idIndex, bson.D{{"key", bson.D{{"expireAt", 1}}}, {"name", "expireAt_1"}, {"expireAfterSeconds", int32(0)}}},
+			fieldTypes{"db.coll": "date"},
+			map[string]bool{},
+		},
+		{
+			bson.A{idIndex, bson.D{{"key", bson.D{{"expireAt", 1}}}, {"name", "expireAt_1"}}},
+			fieldTypes{},
+			map[string]bool{DriftMissingIndex: true},
+		},
+		{
+			bson.A{idIndex, bson.D{{"key", bson.D{{"expireAt", 1}}}, {"name", "expireAt_1"}, {"expireAfterSeconds", int32(3600)}}},
+			fieldTypes{"db.coll": ""},
+			map[string]bool{DriftIndexExpiry: true, DriftSchemaUndeclared: true},
+		},
+		{
+			bson.A{idIndex},
+			fieldTypes{"db.coll": "long"},
+			map[string]bool{DriftMissingIndex: true, DriftSchemaType: true},
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			p := &TTLPlugin{}
+			plugins.SetCommandRunners([]plugins.Plugin{p, &struct {
+				plugins.Plugin
+				*indexRunner
+			}{indexRunner: &indexRunner{test.indexes}}})
+			p.SetSchemaProvider(test.types)
+
+			drift, err := p.drift(context.TODO(), ns, policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, reason := range driftReasons {
+				if drift[reason] != test.drift[reason] {
+					t.Fatalf("expected %s=%v, got %v", reason, test.drift[reason], drift)
+				}
+			}
+		})
+	}
+}
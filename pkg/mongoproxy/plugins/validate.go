@@ -0,0 +1,9 @@
+package plugins
+
+// ConfigValidator is an optional interface a Plugin can implement to report
+// problems with its (already successfully configured) config which don't prevent
+// it from running, such as references to unknown types. These are reported by
+// the validate-config command.
+type ConfigValidator interface {
+	ValidateConfig() []error
+}
@@ -0,0 +1,14 @@
+package plugins
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// VirtualCollectionProvider is an optional interface a Plugin can implement to
+// expose its state as collections of the proxy's virtual admin database (see the
+// virtualAdminDatabase config), e.g. the schema plugin's schemas.
+type VirtualCollectionProvider interface {
+	// VirtualCollections returns the functions returning the documents of the
+	// collections by name; they're called when the collection is queried
+	VirtualCollections() map[string]func() []bson.D
+}
@@ -57,6 +57,7 @@ func (p *WriteconcernOverridePlugin) Process(ctx context.Context, r *plugins.Req
 				override, ok := p.conf.UpdateOverrides[writeConcern]
 				if ok {
 					cmd.WriteConcern.W = override
+					r.Modified()
 				}
 			}
 		}
@@ -3,6 +3,7 @@ package mongoproxy
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"reflect"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ReneKroon/ttlcache/v2"
@@ -22,10 +24,12 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/x/mongo/driver"
 	"go.mongodb.org/mongo-driver/x/mongo/driver/wiremessage"
+	"golang.org/x/sync/semaphore"
 
 	"github.com/wish/mongoproxy/pkg/bsonutil"
 	"github.com/wish/mongoproxy/pkg/command"
 	"github.com/wish/mongoproxy/pkg/models"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
 	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
 	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
 	"github.com/wish/mongoproxy/pkg/mongowire"
@@ -47,6 +51,18 @@ var (
 		Name: "mongoproxy_client_message_total",
 		Help: "The total number of messages from clients",
 	}, []string{"opcode"})
+	clientIdleTimeoutCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mongoproxy_client_idle_timeout_total",
+		Help: "The total number of client connections closed for being idle",
+	})
+	oversizedMessageCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mongoproxy_client_oversized_message_total",
+		Help: "The total number of client messages rejected for exceeding maxMessageSizeBytes",
+	})
+	backpressureWaitCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mongoproxy_client_backpressure_wait_seconds_total",
+		Help: "The total time spent waiting to read client messages due to maxInFlightBytes",
+	})
 
 	ErrServerClosed = errors.New("server closed")
 	SKIP_RECOVER    = false
@@ -65,17 +81,58 @@ func init() {
 }
 
 func NewProxy(l net.Listener, cfg *config.Config) (*Proxy, error) {
-	// Create plugin chain
-	ps, err := cfg.GetPlugins()
-	if err != nil {
-		return nil, err
-	}
-
 	p := &Proxy{
 		l:           l,
 		cfg:         cfg,
 		doneChan:    make(chan struct{}),
 		cursorCache: ttlcache.NewCache(),
+		start:       time.Now(),
+	}
+	p.memory.limit = cfg.MemoryBudgetBytes
+	p.changes = newChangeHistory(cfg.ChangeHistory)
+	if cfg.HandshakeLimits != nil {
+		p.handshakes = newHandshakeLimiter(cfg.HandshakeLimits, p.start)
+	}
+	if cfg.MaxInFlightBytes > 0 {
+		p.inflight = semaphore.NewWeighted(cfg.MaxInFlightBytes)
+	}
+	if cfg.WorkerPool != nil {
+		p.workers = newWorkerPool(cfg.WorkerPool)
+	}
+	if cfg.Bandwidth != nil {
+		p.bandwidth = newBandwidth(cfg.Bandwidth)
+	}
+	if cfg.TLS != nil {
+		tlsConfig, err := newTLSConfig(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		p.l = tls.NewListener(l, tlsConfig)
+		p.tlsHandshakes = newTLSHandshaker(cfg.TLS)
+	}
+	if cfg.RequestPhases != nil {
+		p.phases = newRequestPhases(cfg.RequestPhases)
+	}
+	if cfg.TrustedProxies != nil {
+		keys, err := plugins.LoadForwardingKeys(cfg.TrustedProxies.KeyFiles)
+		if err != nil {
+			return nil, err
+		}
+		p.forwardingKeys = keys
+	}
+	if cfg.DataAPI != nil {
+		keys, err := loadDataAPIKeys(cfg.DataAPI)
+		if err != nil {
+			return nil, err
+		}
+		p.dataAPIKeys = keys
+	}
+	if cfg.IdlePoll {
+		idle, err := newIdlePoller(p)
+		if err != nil {
+			return nil, err
+		}
+		p.idle = idle
 	}
 
 	// Create internal ClientConnection for "admin" tasks
@@ -87,8 +144,6 @@ func NewProxy(l net.Listener, cfg *config.Config) (*Proxy, error) {
 		p.internalCC.Identities = []plugins.ClientIdentity{cfg.InternalIdentity}
 	}
 
-	p.pipe = plugins.BuildPipeline(ps, p.baseRequestHandler)
-
 	// Set up cursorCache
 	p.cursorCache.SetTTL(p.cfg.IdleCursorTimeout) // default TTL -- config
 	p.cursorCache.SetLoaderFunction(func(key string) (interface{}, time.Duration, error) {
@@ -116,6 +171,30 @@ func NewProxy(l net.Listener, cfg *config.Config) (*Proxy, error) {
 		}
 	})
 
+	// Create plugin chain
+	var err error
+	if p.chain, err = p.newChainFromConfig(cfg.Plugins); err != nil {
+		return nil, err
+	}
+
+	// Create the canary chain
+	if cfg.Canary != nil {
+		if p.canary, err = p.newChainFromConfig(cfg.Canary.Plugins); err != nil {
+			p.chain.close(context.TODO(), p.chain.plugins)
+			return nil, err
+		}
+		p.canaryAppNames = make(map[string]struct{}, len(cfg.Canary.AppNames))
+		for _, appName := range cfg.Canary.AppNames {
+			p.canaryAppNames[appName] = struct{}{}
+		}
+	}
+
+	go p.serverInfoLoop()
+	if cfg.WarmUp != nil {
+		p.warm = newWarmUp(cfg.WarmUp)
+		go p.warmUp()
+	}
+
 	return p, nil
 }
 
@@ -123,12 +202,20 @@ type Proxy struct {
 	l   net.Listener // Listener for incoming client connections
 	cfg *config.Config
 
-	pipe plugins.PipelineFunc
+	chain     *chain
+	chainLock sync.RWMutex
+	// reconfigureLock serializes updates to the plugin chain
+	reconfigureLock sync.Mutex
+	// canary is the chain used for canary connections (nil if no canary is configured)
+	canary         *chain
+	canaryAppNames map[string]struct{}
 
 	doneChan chan struct{}
 
 	activeConn     map[*conn]struct{}
 	activeConnLock sync.Mutex
+	// connsCreated is the total number of client connections accepted
+	connsCreated int64
 
 	// Cursor cache for plugins.CursorCacheEntry this is stored at the proxy
 	// level because both the core proxy needs it (to handle OP_QUERY and OP_GETMORE)
@@ -136,6 +223,47 @@ type Proxy struct {
 	cursorCache *ttlcache.Cache
 
 	internalCC *plugins.ClientConnection
+
+	ops      opTracker
+	readOnly int32
+
+	// serverInfo is the cached *plugins.ServerInfo of the downstream server
+	serverInfo atomic.Value
+
+	// start is when the proxy was created (for uptime)
+	start time.Time
+
+	// inflight limits the bytes of client messages being processed (nil if unlimited)
+	inflight *semaphore.Weighted
+	// memory tracks the buffered request and response bytes
+	memory memoryBudget
+	// handshakes rate limits new connections (nil if unlimited)
+	handshakes *handshakeLimiter
+	// warm is the warm-up of the proxy (nil if not configured)
+	warm *warmUp
+	// changes is the history of the config and schema changes
+	changes *changeHistory
+	// nsStats are the stats of the requests by namespace
+	nsStats namespaceStats
+	// workers handle the client requests (nil if handled on the connections'
+	// goroutines)
+	workers *workerPool
+	// tlsHandshakes does the handshakes of TLS client connections
+	tlsHandshakes *tlsHandshaker
+	// phases times the phases of requests (nil if they aren't timed)
+	phases *requestPhases
+	// idle parks the idle client connections (nil if they're read from on their
+	// goroutines)
+	idle *idlePoller
+	// bandwidth accounts the bytes of the clients and throttles those over their
+	// quotas (nil if not configured)
+	bandwidth *bandwidth
+	// forwardingKeys are the keys of the clients forwarded by trusted proxies (nil
+	// if none are trusted)
+	forwardingKeys [][]byte
+	// dataAPIKeys are the keys of the data API clients (nil if the data API isn't
+	// configured)
+	dataAPIKeys []dataAPIKey
 }
 
 func (p *Proxy) GetCursor(cursorID int64) *plugins.CursorCacheEntry {
@@ -151,6 +279,20 @@ func (p *Proxy) CloseCursor(cursorID int64) {
 	p.cursorCache.Remove(strconv.FormatInt(cursorID, 10))
 }
 
+// Health returns an error if the proxy is warming up or any of the plugins are unhealthy
+func (p *Proxy) Health(ctx context.Context) error {
+	if p.warm != nil && p.warm.warming() {
+		return errWarmingUp
+	}
+	p.chainLock.RLock()
+	c := p.chain
+	p.chainLock.RUnlock()
+	if err := c.health(ctx); err != nil {
+		return err
+	}
+	return p.canary.health(ctx)
+}
+
 func (p *Proxy) Addr() string {
 	return p.l.Addr().String()
 }
@@ -227,35 +369,43 @@ func (p *Proxy) baseRequestHandler(ctx context.Context, r *plugins.Request) (bso
 		}, nil
 
 	case *command.BuildInfo:
+		if info := p.getServerInfo(); info != nil && len(info.BuildInfo) > 0 {
+			return append(bson.D(nil), info.BuildInfo...), nil
+		}
 		return bson.D{
 			{"bits", 64}, //TODO dynamically pull
 			{"debug", false},
-			{"version", "4.3.1"}, // TODO pull from downstream? Or have set in config
+			{"version", p.version()},
 			{"maxBsonObjectSize", bsonutil.MaxBsonObjectSize},
 			{"ok", 1},
 		}, nil
 
-	case *command.Ping:
+	case *command.KillOp:
+		id, ok := plugins.ProxyOpID(cmd.OpID)
+		if !ok {
+			return mongoerror.OperationFailed.ErrMessage(fmt.Sprintf("invalid op: %v", cmd.OpID)), nil
+		}
+		auditKill("op", id, "client", r.CC, p.KillOp(id))
+		// Like mongod, killOp succeeds whether or not the op exists
 		return bson.D{
+			{"info", "attempting to kill op"},
 			{"ok", 1},
 		}, nil
 
-	// TODO: complete more options
-	case *command.ServerStatus:
+	case *command.Ping:
 		return bson.D{
-			//{"host" : <string>,
-			//{"advisoryHostFQDNs" : <array>,
-			{"version", "4.3.1"}, // TODO pull from downstream? Or have set in config
-			//{"process" : <"mongod"|"mongos">,
-			//{"pid" : <num>,
-			//{"uptime" : <num>,
-			//{"uptimeMillis" : <num>,
-			//{"uptimeEstimate" : <num>,
-			//{"localTime" : ISODate(""),
-
 			{"ok", 1},
 		}, nil
 
+	case *command.ServerStatus:
+		return p.serverStatus(ctx, cmd), nil
+
+	case *command.ProxyStats:
+		return p.proxyStats(cmd), nil
+
+	case *command.GetParameter:
+		return p.getParameter(ctx, cmd), nil
+
 	// Pretend we are mongoS
 	case *command.IsDBGrid:
 		return bson.D{
@@ -265,19 +415,33 @@ func (p *Proxy) baseRequestHandler(ctx context.Context, r *plugins.Request) (bso
 		}, nil
 
 	case *command.IsMaster:
+		primaryKey := "ismaster"
+		if r.CommandName == "hello" {
+			primaryKey = "isWritablePrimary"
+		}
 		ret := bson.D{
-			{"ismaster", true},
+			{primaryKey, true},
 			{"localTime", time.Now().Truncate(time.Millisecond)},
 			{"logicalSessionTimeoutMinutes", 30},
 			{"maxBsonObjectSize", bsonutil.MaxBsonObjectSize},
-			{"maxMessageSizeBytes", 48000000},
+			{"maxMessageSizeBytes", p.cfg.MaxMessageSizeBytes},
 			{"maxWireVersion", 8},
 			{"maxWriteBatchSize", 100000},
 			{"minWireVersion", 0},
 			{"msg", "isdbgrid"},
-			{"helloOk", false},
+			{"helloOk", true},
 			{"ok", 1},
 		}
+		if info := p.getServerInfo(); info != nil {
+			ret = setFrom(ret, info.Hello, helloLimitKeys...)
+			ret = override(ret, info.HelloOverrides)
+		}
+		// Never advertise more than the proxy accepts
+		for i, e := range ret {
+			if v, ok := e.Value.(int32); e.Key == "maxMessageSizeBytes" && ok && int(v) > p.cfg.MaxMessageSizeBytes {
+				ret[i].Value = p.cfg.MaxMessageSizeBytes
+			}
+		}
 
 		// TODO: validate compressors
 		if len(p.cfg.Compressors) > 0 && len(cmd.Compression) > 0 {
@@ -331,22 +495,36 @@ func (p *Proxy) Serve() error {
 		clientConnectionCounter.Inc()
 		clientConnectionGauge.Inc()
 
-		go func(c net.Conn) {
-			defer func() {
-				clientConnectionGauge.Dec()
-				if !SKIP_RECOVER {
-					if err := recover(); err != nil {
-						logrus.Errorf("Panic in connection: %v", err)
-						sentry.CurrentHub().Recover(err)
-						sentry.Flush(time.Second * 5)
-					}
-				}
-			}()
+		go p.serveClient(func() error {
 			logrus.Debugf("Starting connection: %v", c)
-			if err := p.clientServeLoop(c); err != nil && err != io.EOF {
-				logrus.Errorf("Error serving client: %s %v -- %s", reflect.TypeOf(err), err, err.Error())
+			return p.clientServeLoop(c)
+		})
+	}
+}
+
+// serveClient serves a client connection with serve, recovering panics
+func (p *Proxy) serveClient(serve func() error) {
+	parked := false
+	defer func() {
+		// Parked connections are still open
+		if !parked {
+			clientConnectionGauge.Dec()
+		}
+		if !SKIP_RECOVER {
+			if err := recover(); err != nil {
+				logrus.Errorf("Panic in connection: %v", err)
+				sentry.CurrentHub().Recover(err)
+				sentry.Flush(time.Second * 5)
 			}
-		}(c)
+		}
+	}()
+	err := serve()
+	if err == errParked {
+		parked = true
+		return
+	}
+	if err != nil && err != io.EOF {
+		logrus.Errorf("Error serving client: %s %v -- %s", reflect.TypeOf(err), err, err.Error())
 	}
 }
 
@@ -360,6 +538,7 @@ func (p *Proxy) trackConn(c *conn, add bool) {
 
 	if add {
 		p.activeConn[c] = struct{}{}
+		p.connsCreated++
 	} else {
 		delete(p.activeConn, c)
 	}
@@ -402,11 +581,29 @@ func (p *Proxy) Shutdown(ctx context.Context) error {
 
 	// Close the listener
 	lnerr := p.l.Close()
+	// Parked connections are served on goroutines again to be closed once idle
+	if p.idle != nil {
+		p.idle.close()
+	}
 
 	ticker := time.NewTicker(time.Millisecond * 200) // TODO: config?
 	defer ticker.Stop()
 	for {
 		if p.closeIdleConns() {
+			p.chainLock.RLock()
+			c := p.chain
+			p.chainLock.RUnlock()
+			if p.workers != nil {
+				p.workers.close()
+			}
+			if err := c.close(ctx, c.plugins); err != nil {
+				return err
+			}
+			if p.canary != nil {
+				if err := p.canary.close(ctx, p.canary.plugins); err != nil {
+					return err
+				}
+			}
 			return lnerr
 		}
 
@@ -469,10 +666,10 @@ func (p *Proxy) handleOp(ctx context.Context, clientConn *plugins.ClientConnecti
 		// If the OP_MSG has set moreToCome we aren't allowed to respond
 		// https://docs.mongodb.com/manual/reference/mongodb-wire-protocol/#flag-bits
 		if m.Flags.MoreToCome() {
-			// TODO: do we want to background this? Or just run it without a return. As
-			// it stands how this causes race conditions with writeConcern=0 writes and subsequent writes
-			// from the same client on the same connection (e.g. test.test_common.TestCommon.test_mongo_client)
-			go p.handleOpMsg(ctx, clientConn, m)
+			// This is handled inline (as mongod does) so that the next message isn't read
+			// until this one is done; this keeps the writes from a connection ordered and
+			// applies backpressure to clients streaming unacknowledged writes.
+			p.handleOpMsg(ctx, clientConn, m)
 			return nil, nil
 		}
 
@@ -480,6 +677,10 @@ func (p *Proxy) handleOp(ctx context.Context, clientConn *plugins.ClientConnecti
 		if err != nil {
 			return nil, err
 		}
+		// The reply was streamed to the client
+		if reply == nil {
+			return nil, nil
+		}
 
 		if logrus.IsLevelEnabled(logrus.DebugLevel) {
 			logrus.Debugf("OUT OP_MSG %s", mongowire.ToJson(reply, p.cfg.RequestLengthLimit))
@@ -492,6 +693,11 @@ func (p *Proxy) handleOp(ctx context.Context, clientConn *plugins.ClientConnecti
 			logrus.Debugf("IN OP_COMPRESSED %s", mongowire.ToJson(req, p.cfg.RequestLengthLimit))
 		}
 
+		if int(m.UncompressedSize)+mongowire.HeaderLen > p.cfg.MaxMessageSizeBytes {
+			oversizedMessageCounter.Inc()
+			return nil, fmt.Errorf("uncompressed message size %d exceeds maxMessageSizeBytes %d", m.UncompressedSize, p.cfg.MaxMessageSizeBytes)
+		}
+
 		// Decompress
 		b, err := driver.DecompressPayload(m.CompressedMessage, driver.CompressionOpts{
 			Compressor:       m.CompressorID,
@@ -504,7 +710,8 @@ func (p *Proxy) handleOp(ctx context.Context, clientConn *plugins.ClientConnecti
 		newReq := mongowire.NewRequestWithHeader(*req.GetHeader(), bytes.NewReader(b))
 		newReq.GetHeader().OpCode = m.OriginalOpcode
 		newReq.GetHeader().MessageLength = m.UncompressedSize + mongowire.HeaderLen
-		reply, err := p.handleOp(ctx, clientConn, newReq)
+		// The reply is compressed, so can't be streamed
+		reply, err := p.handleOp(withReplyWriter(ctx, nil), clientConn, newReq)
 		if err != nil {
 			return nil, err
 		}
@@ -549,15 +756,63 @@ func (p *Proxy) handleOp(ctx context.Context, clientConn *plugins.ClientConnecti
 }
 
 func (p *Proxy) clientServeLoop(c net.Conn) error {
-	conn := &conn{
-		p: p,
-		c: c,
+	if p.handshakes != nil {
+		if err := p.handshakes.wait(c.RemoteAddr(), p.doneChan); err != nil {
+			logrus.Debugf("Closing connection %v: %v", c.RemoteAddr(), err)
+			c.Close()
+			return nil
+		}
+	}
+	if p.warm != nil && !p.warm.admit(p.openConns(), time.Now()) {
+		logrus.Debugf("Closing connection %v: over the warm-up connection ramp", c.RemoteAddr())
+		c.Close()
+		return nil
+	}
+
+	if tc, ok := c.(*tls.Conn); ok {
+		if err := p.tlsHandshakes.handshake(tc); err != nil {
+			logrus.Debugf("Closing connection %v: TLS handshake failed: %v", c.RemoteAddr(), err)
+			c.Close()
+			return nil
+		}
+	}
+
+	// Watch the client for disconnects while requests are handled
+	if p.cfg.CancelAbandoned {
+		c = &watchedConn{Conn: c}
 	}
-	conn.setState(StateNew)
 
 	clientConn := plugins.NewClientConnection()
 	clientConn.Addr = c.RemoteAddr()
+	p.assignCanary(clientConn)
+
+	conn := &conn{
+		p:  p,
+		c:  c,
+		cc: clientConn,
+	}
+	conn.setState(StateNew)
+	return p.serveConn(conn, false)
+}
+
+// serveConn serves the connection's requests until it's closed, or parked in the
+// idle poller (returning errParked) to be resumed once it's readable
+func (p *Proxy) serveConn(conn *conn, resumed bool) (err error) {
+	c, clientConn := conn.c, conn.cc
+	wc, _ := c.(*watchedConn)
+	// The reads are timed when timing the phases of requests
+	var (
+		r  io.Reader = c
+		tr *timedReader
+	)
+	if p.phases != nil {
+		tr = &timedReader{Reader: c}
+		r = tr
+	}
 	defer func() {
+		if err == errParked {
+			return
+		}
 		c.Close()
 		clientConn.Close()
 		conn.setState(StateClosed)
@@ -566,31 +821,184 @@ func (p *Proxy) clientServeLoop(c net.Conn) error {
 	}()
 
 	for {
-		conn.setState(StateIdle)
-		logrus.Debugf("waiting for request %v", c)
-		req, err := mongowire.NewRequest(c)
+		// A resumed connection is already idle, with its read deadline set
+		if !resumed {
+			conn.setState(StateIdle)
+			logrus.Debugf("waiting for request %v", c)
+			if p.cfg.ClientIdleTimeoutDuration > 0 {
+				c.SetReadDeadline(time.Now().Add(p.cfg.ClientIdleTimeoutDuration))
+			}
+			if p.idle != nil && p.idle.park(conn) {
+				return errParked
+			}
+		}
+		resumed = false
+		req, err := mongowire.NewRequest(r)
 		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				logrus.Debugf("Closing idle connection: %v", c)
+				clientIdleTimeoutCounter.Inc()
+				return nil
+			}
 			return err
 		}
+		if p.cfg.ClientIdleTimeoutDuration > 0 {
+			c.SetReadDeadline(time.Time{})
+		}
 		conn.setState(StateActive)
 
-		// TODO: context that will close when the client connection closes
+		// Only the header has been read; reject oversized messages before reading the body.
+		// The connection is closed as the rest of the message isn't read.
+		size := int64(req.GetHeader().MessageLength)
+		if size < mongowire.HeaderLen || size > int64(p.cfg.MaxMessageSizeBytes) {
+			oversizedMessageCounter.Inc()
+			if reply := errorReply(*req.GetHeader(), mongoerror.BSONObjectTooLarge.ErrMessage(
+				fmt.Sprintf("message size %d exceeds maxMessageSizeBytes %d", size, p.cfg.MaxMessageSizeBytes))); reply != nil {
+				reply.WriteTo(c)
+			}
+			return fmt.Errorf("invalid message size %d from %v", size, c.RemoteAddr())
+		}
+
+		// Shed load while the memory budget is exhausted
+		if !p.memory.reserve(conn, size) {
+			memoryShedCounter.Inc()
+			if err := shed(c, req, shedError()); err != nil {
+				return err
+			}
+			continue
+		}
+
 		ctx := context.Background()
+		var timing *requestTiming
+		if tr != nil {
+			// Waiting for the request isn't part of it
+			tr.d = 0
+			ctx, timing = newRequestTiming(ctx)
+		}
+		stopWatch := func() {}
+		if wc != nil {
+			// The connection can only be watched once the request has been read
+			if err := req.Buffer(); err != nil {
+				p.memory.release(conn, size)
+				return err
+			}
+			ctx, stopWatch = wc.watch(ctx)
+		}
+
+		timing.queue()
+		if p.inflight != nil {
+			waitStart := time.Now()
+			if err := p.inflight.Acquire(ctx, size); err != nil {
+				stopWatch()
+				p.memory.release(conn, size)
+				return err
+			}
+			if wait := time.Since(waitStart); wait > time.Millisecond {
+				backpressureWaitCounter.Add(wait.Seconds())
+			}
+		}
 
 		// Unpack request
 
 		// Handle Reply (write to wire)
 
-		reply, err := p.handleOp(ctx, clientConn, req)
+		w := &budgetWriter{Conn: c, m: &p.memory, c: conn}
+		var out io.Writer = w
+		var tw *timedWriter
+		if timing != nil {
+			tw = &timedWriter{Writer: w}
+			out = tw
+		}
+		// Cursor replies may be streamed to the client while the request is handled
+		ctx = withReplyWriter(ctx, out)
+
+		ctx, traffic := withNSTraffic(ctx)
+		var reply mongowire.WireSerializer
+		if p.workers != nil {
+			werr := p.workers.do(ctx, p.workers.priority(clientConn), func() {
+				timing.handle()
+				reply, err = p.handleOp(ctx, clientConn, req)
+			})
+			if werr == errQueueFull {
+				stopWatch()
+				if p.inflight != nil {
+					p.inflight.Release(size)
+				}
+				p.memory.release(conn, size)
+				if err := shed(c, req, queueFullError()); err != nil {
+					return err
+				}
+				continue
+			}
+			if werr != nil {
+				err = werr
+			}
+		} else {
+			timing.handle()
+			reply, err = p.handleOp(ctx, clientConn, req)
+		}
+		timing.endHandle()
+		stopWatch()
+		if p.inflight != nil {
+			p.inflight.Release(size)
+		}
 		if err != nil {
+			p.memory.release(conn, size)
 			return err
 		}
 
 		// If we have a reply, write it back out
 		if reply != nil {
-			if err := reply.WriteTo(c); err != nil {
-				return err
+			err = reply.WriteTo(out)
+		}
+		if timing != nil {
+			p.phases.finish(timing, tr.d, tw.d)
+		}
+		p.memory.release(conn, size)
+		if traffic.ns != "" {
+			p.nsStats.addBytes(traffic.ns, size, w.written)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Clients over their bandwidth quota are throttled by not reading their next
+		// request until they are back under it
+		if wait := p.bandwidth.record(conn, traffic.ns, size, w.written, time.Now()); wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-p.doneChan:
+				t.Stop()
 			}
 		}
 	}
 }
+
+// shed rejects the request (whose header has been read) with the retryable error;
+// the body is discarded without being buffered so the connection can be reused
+func shed(w io.Writer, req *mongowire.Request, errDoc bson.D) error {
+	h := *req.GetHeader()
+	moreToCome := false
+	if h.OpCode == mongowire.OpMsg {
+		flags, err := req.ReadOpMsgFlags()
+		if err != nil {
+			return err
+		}
+		moreToCome = flags.MoreToCome()
+	}
+	if err := req.Discard(); err != nil {
+		return err
+	}
+
+	if moreToCome || h.OpCode == mongowire.OpKillCursors {
+		return nil
+	}
+	reply := errorReply(h, errDoc)
+	if reply == nil {
+		// The client expects a reply we can't produce; closing the connection is
+		// the only way to tell it
+		return fmt.Errorf("shed %v message", h.OpCode)
+	}
+	return reply.WriteTo(w)
+}
@@ -0,0 +1,45 @@
+package mongoproxy
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+// BenchmarkHandleMongo benchmarks the core command handling path (command
+// decode + pipeline) against the built-in handlers.
+func BenchmarkHandleMongo(b *testing.B) {
+	cfg := &config.Config{}
+	if err := cfg.Load(); err != nil {
+		b.Fatal(err)
+	}
+
+	proxy, err := NewProxy(nil, cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	cmds := map[string]bson.D{
+		"ping":     {{"ping", 1}, {"$db", "admin"}},
+		"isMaster": {{"isMaster", 1}, {"$db", "admin"}},
+	}
+
+	for name, cmd := range cmds {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r := &plugins.Request{
+					CC:          plugins.NewClientConnection(),
+					CursorCache: proxy,
+				}
+				if _, err := proxy.HandleMongo(context.TODO(), r, cmd); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -25,6 +27,14 @@ var (
 		Name: "mongoproxy_client_command_total",
 		Help: "The total number of commands from clients",
 	}, []string{"command"})
+	clientHandshakeCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_client_handshakes_total",
+		Help: "The total number of client handshakes by appName and driver",
+	}, []string{"app_name", "driver", "driver_version"})
+	operationTimeoutCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_operation_timeout_total",
+		Help: "The total number of requests which exceeded the proxy operationTimeout",
+	}, []string{"command"})
 )
 
 // HandleMongo needs to actually disbatch the command. This includes loading the command into a struct, processing the pipeline, and then returning
@@ -39,6 +49,11 @@ func (p *Proxy) HandleMongo(ctx context.Context, req *plugins.Request, d bson.D)
 	}
 	clientCommandCounter.WithLabelValues(d[0].Key).Inc()
 
+	ctx, d, rejected := p.forwardedClient(ctx, req, d)
+	if rejected != nil {
+		return rejected, nil
+	}
+
 	if err := cmd.FromBSOND(d); err != nil {
 		d, err := mongo.ErrorToDoc(err)
 		if err != nil {
@@ -47,11 +62,128 @@ func (p *Proxy) HandleMongo(ctx context.Context, req *plugins.Request, d bson.D)
 		return append(bson.D{{"ok", 0}}, d...), nil
 	}
 
-	req.CommandName = d[0].Key
-	req.Command = cmd
+	req.SetCommand(d[0].Key, cmd, d)
+
+	// The client metadata is only sent in the first isMaster of a connection
+	if isMaster, ok := cmd.(*command.IsMaster); ok && req.CC != nil && req.CC.ClientMetadata == nil && len(isMaster.Client) > 0 {
+		md, err := plugins.ParseClientMetadata(isMaster.Client)
+		if err != nil {
+			logrus.Debugf("unable to parse client metadata: %v", err)
+		} else {
+			req.CC.ClientMetadata = md
+			req.CC.AppName = md.Application.Name
+			clientHandshakeCounter.WithLabelValues(md.Application.Name, md.Driver.Name, md.Driver.Version).Inc()
+		}
+	}
+
+	if p.cfg.VirtualAdminDatabase != "" && command.GetCommandDatabase(cmd) == p.cfg.VirtualAdminDatabase {
+		if !p.virtualAdmin(req.CC) {
+			return mongoerror.Unauthorized.ErrMessage("not authorized on " + p.cfg.VirtualAdminDatabase), nil
+		}
+		return p.handleVirtual(d), nil
+	}
+
+	if _, ok := writeCommands[req.CommandName]; ok && p.ReadOnly() {
+		return mongoerror.IllegalOperation.ErrMessage("proxy is in read-only mode"), nil
+	}
+
+	ctx, op, finishOp := p.ops.start(ctx, req)
+	defer finishOp()
+
+	var opDeadline time.Time
+	if p.cfg.OperationTimeoutDuration > 0 {
+		var cancel context.CancelFunc
+		opDeadline = time.Now().Add(p.cfg.OperationTimeoutDuration)
+		ctx, cancel = context.WithDeadline(ctx, opDeadline)
+		defer cancel()
+	}
+	// The backend enforces maxTimeMS; the proxy only gives up after the grace
+	var maxTimeDeadline time.Time
+	if maxTime := maxTimeMS(d); maxTime > 0 && p.cfg.MaxTimeMSGraceDuration > 0 {
+		var cancel context.CancelFunc
+		maxTimeDeadline = time.Now().Add(maxTime + p.cfg.MaxTimeMSGraceDuration)
+		ctx, cancel = context.WithDeadline(ctx, maxTimeDeadline)
+		defer cancel()
+	}
+
+	c, group := p.acquireChain(req.CC)
+	defer c.inflight.Done()
+	req.RawBatches = req.RawBatches && c.rawBatches
+	if !req.RawBatches {
+		req.ReplyStream = nil
+	}
+	if insert, ok := cmd.(*command.Insert); ok && insert.RawDocuments != nil && !c.rawDocuments {
+		if err := insert.DecodeDocuments(); err != nil {
+			return mongoerror.FailedToParse.ErrMessage(err.Error()), nil
+		}
+		req.Modified()
+	}
+
+	ctx, md := plugins.WithMetadata(ctx)
+
+	// The namespace is kept as the backend plugin clears it from the command
+	db, collection := req.Database(), req.Collection()
+
+	var event *plugins.PostCommitEvent
+	if c.postCommit != nil {
+		event = &plugins.PostCommitEvent{
+			Request:    req,
+			Database:   db,
+			Collection: collection,
+			Metadata:   md,
+			Start:      time.Now(),
+		}
+		defer func() {
+			event.Duration = time.Since(event.Start)
+			c.postCommit.Dispatch(event)
+		}()
+	}
 
 	// handle error -- check if its a type we can convert; if so convert (so we don't close the connection)
-	resp, err := p.pipe(ctx, req)
+	timing := getRequestTiming(ctx)
+	timing.startPipe(op)
+	start := time.Now()
+	resp, err := c.pipe(ctx, req)
+	timing.endPipe()
+	if event != nil {
+		event.Response, event.Err = resp, err
+	}
+	if group != "" {
+		status := "success"
+		if err != nil || !bsonutil.Ok(resp) {
+			status = "error"
+		}
+		canaryRequestSummary.WithLabelValues(group, status).Observe(time.Since(start).Seconds())
+	}
+	// Plugins may have turned the context error into an error response
+	failed := err != nil || !bsonutil.Ok(resp)
+	p.recordNamespace(ctx, namespace(db, collection), req.CommandName, resp, failed)
+	if failed && err == nil && plugins.EventSubscribers() {
+		publishViolation(md, req, db, collection, resp)
+	}
+	// The response won't be read; make sure the backend stops the operation and
+	// nothing it left behind lingers
+	if abandoned(ctx) {
+		abandonedCounter.WithLabelValues(req.CommandName).Inc()
+		cursorID, ns := abandonedCursor(d, resp)
+		go p.reapAbandoned(d, cursorID, ns, failed)
+		if failed {
+			return mongoerror.Interrupted.ErrMessage("client disconnected"), nil
+		}
+	}
+	if failed && op.Killed() {
+		return mongoerror.Interrupted.ErrMessage("operation was interrupted"), nil
+	}
+	// The deadline is checked (rather than ctx.Err()) as the backend read deadline
+	// derived from it can fire before the context is marked done
+	if failed && !opDeadline.IsZero() && !time.Now().Before(opDeadline) {
+		operationTimeoutCounter.WithLabelValues(req.CommandName).Inc()
+		return mongoerror.ExceededTimeLimit.ErrMessage("operation exceeded the proxy operationTimeout of " + p.cfg.OperationTimeoutDuration.String()), nil
+	}
+	if failed && !maxTimeDeadline.IsZero() && !time.Now().Before(maxTimeDeadline) {
+		maxTimeMSCounter.WithLabelValues(req.CommandName).Inc()
+		return mongoerror.MaxTimeMSExpired.ErrMessage("operation exceeded time limit"), nil
+	}
 	if err != nil {
 		// TODO: move this logic down; here we only want to check against some BSONError interface type; so other plugins can implement their own errors that become the same on the wire
 		d, err := mongo.ErrorToDoc(err)
@@ -301,6 +433,30 @@ func (p *Proxy) handleOpQuery(ctx context.Context, cc *plugins.ClientConnection,
 	return reply, nil
 }
 
+// errorReply returns a reply with the error doc to a message which wasn't read;
+// returns nil for opcodes which can't be replied to
+func errorReply(h mongowire.MessageHeader, d bson.D) mongowire.WireSerializer {
+	switch h.OpCode {
+	case mongowire.OpMsg:
+		reply := &mongowire.OP_MSG{
+			Header:   h,
+			Sections: []mongowire.MSGSection{mongowire.MSGSection_Body{d}},
+		}
+		reply.Header.ResponseTo = h.RequestID
+		return reply
+	case mongowire.OpQuery:
+		reply := &mongowire.OP_REPLY{
+			Header:         h,
+			NumberReturned: 1,
+			Documents:      []bson.D{d},
+		}
+		reply.Header.OpCode = mongowire.OpReply
+		reply.Header.ResponseTo = h.RequestID
+		return reply
+	}
+	return nil
+}
+
 // Responsible to kill the requested cursors
 func (p *Proxy) handleOpKillCursors(ctx context.Context, cc *plugins.ClientConnection, q *mongowire.OP_KILL_CURSORS) error {
 	request := &plugins.Request{
@@ -380,12 +536,28 @@ func (p *Proxy) handleOpGetMore(ctx context.Context, cc *plugins.ClientConnectio
 	return reply, nil
 }
 
+// replyWriterKey is the context key of the client's writer
+type replyWriterKey struct{}
+
+// withReplyWriter returns the context with the writer of the client's replies,
+// which cursor replies may be streamed to (nil if they can't be)
+func withReplyWriter(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, replyWriterKey{}, w)
+}
+
+// handleOpMsg handles the OP_MSG, returning its reply (nil if it was streamed to
+// the client)
 func (p *Proxy) handleOpMsg(ctx context.Context, cc *plugins.ClientConnection, m *mongowire.OP_MSG) (*mongowire.OP_MSG, error) {
+	// Only OP_MSG replies can be written without decoding the batches
 	request := &plugins.Request{
 		CC:          cc,
 		CursorCache: p,
+		RawBatches:  true,
 	}
 	defer request.Close()
+	if w, _ := ctx.Value(replyWriterKey{}).(io.Writer); w != nil && !m.Flags.MoreToCome() {
+		request.ReplyStream = mongowire.NewReplyStream(w, m.Header.RequestID)
+	}
 
 	reply := &mongowire.OP_MSG{
 		Header:   m.Header,
@@ -398,6 +570,7 @@ func (p *Proxy) handleOpMsg(ctx context.Context, cc *plugins.ClientConnection, m
 	}
 
 	var d bson.D
+	var sequences []mongowire.MSGSection_DocumentSequence
 
 	for _, sectionRaw := range m.Sections {
 		switch sectionTyped := sectionRaw.(type) {
@@ -410,14 +583,28 @@ func (p *Proxy) handleOpMsg(ctx context.Context, cc *plugins.ClientConnection, m
 			if strings.Contains(sectionTyped.SequenceIdentifier, ".") {
 				return nil, fmt.Errorf("not implemented")
 			}
-			d = append(d, primitive.E{sectionTyped.SequenceIdentifier, sectionTyped.Documents})
+			sequences = append(sequences, sectionTyped)
 		default:
 			return nil, fmt.Errorf("not implemented")
 		}
 	}
+	for _, sequence := range sequences {
+		v, err := sequenceValue(d, sequence)
+		if err != nil {
+			return nil, err
+		}
+		d = append(d, primitive.E{sequence.SequenceIdentifier, v})
+	}
 
 	// run command
 	result, err := p.HandleMongo(ctx, request, d)
+	if s := request.ReplyStream; s != nil && s.Started() {
+		// A reply partly written can't be followed by another one
+		if err := s.Err(); err != nil {
+			return nil, fmt.Errorf("error streaming reply: %v", err)
+		}
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -426,3 +613,19 @@ func (p *Proxy) handleOpMsg(ctx context.Context, cc *plugins.ClientConnection, m
 
 	return reply, nil
 }
+
+// sequenceValue returns the value of the document sequence in the command: the
+// documents of inserts are kept raw (see HandleMongo), those of other commands
+// are decoded
+func sequenceValue(cmd bson.D, sequence mongowire.MSGSection_DocumentSequence) (interface{}, error) {
+	if len(cmd) > 0 && cmd[0].Key == "insert" && sequence.SequenceIdentifier == "documents" {
+		return sequence.Documents, nil
+	}
+	docs := make([]bson.D, len(sequence.Documents))
+	for i, raw := range sequence.Documents {
+		if err := bson.Unmarshal(raw, &docs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
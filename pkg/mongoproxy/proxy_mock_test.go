@@ -0,0 +1,494 @@
+package mongoproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongotest"
+	"github.com/wish/mongoproxy/pkg/mongowire"
+)
+
+// TestProxyMockBackend runs requests end-to-end through the proxy (and the
+// mongo plugin) against the in-process fake backend.
+func TestProxyMockBackend(t *testing.T) {
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		Plugins: []config.PluginConfig{
+			{
+				Name: "mongo",
+				Config: bson.D{
+					{"connectTimeout", "1s"},
+					{"mongoAddr", backend.URI()},
+				},
+			},
+		},
+	}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(l, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Serve()
+	defer proxy.Shutdown(context.TODO())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://"+proxy.Addr()).SetRetryWrites(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+
+	if err := client.Ping(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// No plugin reads the inserted documents so they are sent to the backend
+	// without being decoded
+	if !proxy.chain.rawDocuments {
+		t.Fatal("expected raw documents")
+	}
+	collection := client.Database("test").Collection("trainers")
+	if _, err := collection.InsertMany(ctx, []interface{}{
+		bson.D{{"name", "Ash"}, {"age", 10}},
+		bson.D{{"name", "Misty"}, {"age", 10}},
+		bson.D{{"name", "Brock"}, {"age", 15}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if docs := backend.Store.Documents("test", "trainers"); len(docs) != 3 {
+		t.Fatalf("expected 3 documents in backend, got %d", len(docs))
+	}
+
+	if _, err := collection.UpdateOne(ctx, bson.D{{"name", "Ash"}}, bson.D{{"$inc", bson.D{{"age", 1}}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var result struct {
+		Name string
+		Age  int
+	}
+	if err := collection.FindOne(ctx, bson.D{{"name", "Ash"}}).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Age != 11 {
+		t.Fatalf("expected age 11, got %d", result.Age)
+	}
+
+	// Exercise cursors through the proxy (no plugin reads the batches so they
+	// are passed through without being decoded)
+	if !proxy.chain.rawBatches {
+		t.Fatal("expected raw batches")
+	}
+	streamed := streamedReplies(t)
+	cur, err := collection.Find(ctx, bson.D{}, options.Find().SetBatchSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []bson.D
+	if err := cur.All(ctx, &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	// The find and getMores were streamed from the backend
+	if n := streamedReplies(t) - streamed; n < 3 {
+		t.Fatalf("expected the cursor's replies to be streamed, got %v", n)
+	}
+}
+
+// streamedReplies returns the number of replies the mongo plugin streamed
+func streamedReplies(t *testing.T) float64 {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n float64
+	for _, mf := range mfs {
+		if mf.GetName() == "mongoproxy_plugins_mongo_streamed_replies_total" {
+			for _, m := range mf.GetMetric() {
+				n += m.GetCounter().GetValue()
+			}
+		}
+	}
+	return n
+}
+
+func TestProxyTimeouts(t *testing.T) {
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	// Block the "find" longer than the operation timeout
+	release := make(chan struct{})
+	defer close(release)
+	backend.Handle("find", func(database string, cmd bson.D) bson.D {
+		<-release
+		return bson.D{{"ok", 1}}
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		Plugins: []config.PluginConfig{
+			{
+				Name: "mongo",
+				Config: bson.D{
+					{"connectTimeout", "1s"},
+					{"mongoAddr", backend.URI()},
+				},
+			},
+		},
+		ClientIdleTimeout: "200ms",
+		OperationTimeout:  "100ms",
+	}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(l, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Serve()
+	defer proxy.Shutdown(context.TODO())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://"+proxy.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+
+	err = client.Database("test").RunCommand(ctx, bson.D{{"find", "foo"}}).Err()
+	if cmdErr, ok := err.(mongo.CommandError); !ok || cmdErr.Code != int32(mongoerror.ExceededTimeLimit) {
+		t.Fatalf("expected ExceededTimeLimit error: %v", err)
+	}
+
+	// Idle connections are closed
+	c, err := net.Dial("tcp", proxy.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected idle connection to be closed: %v", err)
+	}
+}
+
+func TestProxyMaxMessageSize(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		MaxMessageSizeBytes: 1024,
+		MaxInFlightBytes:    4096,
+	}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(l, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Serve()
+	defer proxy.Shutdown(context.TODO())
+
+	c, err := net.Dial("tcp", proxy.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Only the header of an oversized message is sent; the proxy must not wait for the body
+	h, err := mongowire.MessageHeader{
+		MessageLength: 100 * 1024 * 1024,
+		RequestID:     1,
+		OpCode:        mongowire.OpMsg,
+	}.ToWire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(h); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := mongowire.NewRequest(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.GetHeader().ResponseTo != 1 {
+		t.Fatalf("mismatch in responseTo: %v", req.GetHeader())
+	}
+	reply := req.GetOpMsg()
+	if len(reply.Sections) != 1 {
+		t.Fatalf("expected a single section: %v", reply.Sections)
+	}
+	body := reply.Sections[0].(mongowire.MSGSection_Body).Document.Map()
+	if body["codeName"] != "BSONObjectTooLarge" {
+		t.Fatalf("expected BSONObjectTooLarge: %v", body)
+	}
+
+	// The connection is closed
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected connection to be closed: %v", err)
+	}
+}
+
+func TestProxyMemoryBudget(t *testing.T) {
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	// Block the "find" so its request stays buffered
+	release := make(chan struct{})
+	backend.Handle("find", func(database string, cmd bson.D) bson.D {
+		<-release
+		return bson.D{{"ok", 1}}
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		Plugins: []config.PluginConfig{
+			{
+				Name: "mongo",
+				Config: bson.D{
+					{"connectTimeout", "1s"},
+					{"mongoAddr", backend.URI()},
+				},
+			},
+		},
+		MemoryBudgetBytes: 1,
+	}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(l, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Serve()
+	defer proxy.Shutdown(context.TODO())
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", proxy.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		return c
+	}
+	send := func(c net.Conn, d bson.D) {
+		msg := &mongowire.OP_MSG{
+			Header:   mongowire.MessageHeader{RequestID: 1, OpCode: mongowire.OpMsg},
+			Sections: []mongowire.MSGSection{mongowire.MSGSection_Body{d}},
+		}
+		if err := msg.WriteTo(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recv := func(c net.Conn) map[string]interface{} {
+		req, err := mongowire.NewRequest(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req.GetOpMsg().Sections[0].(mongowire.MSGSection_Body).Document.Map()
+	}
+
+	// The find is allowed as nothing else is buffered (even though it exceeds the budget)
+	a := dial()
+	defer a.Close()
+	send(a, bson.D{{"find", "foo"}, {"$db", "test"}})
+	for start := time.Now(); len(proxy.Ops()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("find op not found")
+		}
+	}
+
+	// Other requests are shed while it's buffered
+	b := dial()
+	defer b.Close()
+	send(b, bson.D{{"ping", 1}, {"$db", "admin"}})
+	if resp := recv(b); resp["codeName"] != "ExceededTimeLimit" {
+		t.Fatalf("expected request to be shed: %v", resp)
+	}
+	if proxy.memory.Used() == 0 {
+		t.Fatalf("expected buffered bytes")
+	}
+
+	close(release)
+	if resp := recv(a); resp["ok"] != int32(1) {
+		t.Fatalf("mismatch in find response: %v", resp)
+	}
+
+	// The shed connection is still usable
+	send(b, bson.D{{"ping", 1}, {"$db", "admin"}})
+	if resp := recv(b); resp["ok"] != int32(1) {
+		t.Fatalf("mismatch in ping response: %v", resp)
+	}
+	if used := proxy.memory.Used(); used != 0 {
+		t.Fatalf("expected no buffered bytes: %d", used)
+	}
+}
+
+func TestProxyWorkerPool(t *testing.T) {
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	// Block the "find" so it holds the only worker
+	release := make(chan struct{})
+	backend.Handle("find", func(database string, cmd bson.D) bson.D {
+		<-release
+		return bson.D{{"ok", 1}}
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		Plugins: []config.PluginConfig{
+			{
+				Name: "mongo",
+				Config: bson.D{
+					{"connectTimeout", "1s"},
+					{"mongoAddr", backend.URI()},
+				},
+			},
+		},
+		WorkerPool: &config.WorkerPoolConfig{Size: 1, MaxQueue: 1},
+	}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(l, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Serve()
+	defer proxy.Shutdown(context.TODO())
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", proxy.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		return c
+	}
+	send := func(c net.Conn, d bson.D) {
+		msg := &mongowire.OP_MSG{
+			Header:   mongowire.MessageHeader{RequestID: 1, OpCode: mongowire.OpMsg},
+			Sections: []mongowire.MSGSection{mongowire.MSGSection_Body{d}},
+		}
+		if err := msg.WriteTo(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recv := func(c net.Conn) map[string]interface{} {
+		req, err := mongowire.NewRequest(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req.GetOpMsg().Sections[0].(mongowire.MSGSection_Body).Document.Map()
+	}
+	queued := func(n int) {
+		for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+			proxy.workers.l.Lock()
+			q := len(proxy.workers.queues[0])
+			proxy.workers.l.Unlock()
+			if q == n {
+				return
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("expected %d queued requests, got %d", n, q)
+			}
+		}
+	}
+
+	a := dial()
+	defer a.Close()
+	send(a, bson.D{{"find", "foo"}, {"$db", "test"}})
+	for start := time.Now(); len(proxy.Ops()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("find op not found")
+		}
+	}
+
+	// The next request waits for the worker, and the one after is rejected as the
+	// queue is full
+	b := dial()
+	defer b.Close()
+	send(b, bson.D{{"ping", 1}, {"$db", "admin"}})
+	queued(1)
+
+	c := dial()
+	defer c.Close()
+	send(c, bson.D{{"ping", 1}, {"$db", "admin"}})
+	if resp := recv(c); resp["codeName"] != "ExceededTimeLimit" {
+		t.Fatalf("expected request to be rejected: %v", resp)
+	}
+
+	close(release)
+	if resp := recv(a); resp["ok"] != int32(1) {
+		t.Fatalf("mismatch in find response: %v", resp)
+	}
+	if resp := recv(b); resp["ok"] != int32(1) {
+		t.Fatalf("mismatch in ping response: %v", resp)
+	}
+
+	// The rejected connection is still usable
+	send(c, bson.D{{"ping", 1}, {"$db", "admin"}})
+	if resp := recv(c); resp["ok"] != int32(1) {
+		t.Fatalf("mismatch in ping response: %v", resp)
+	}
+}
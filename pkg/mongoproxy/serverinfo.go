@@ -0,0 +1,141 @@
+package mongoproxy
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+var (
+	serverInfoRefreshCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_serverinfo_refresh_total",
+		Help: "The total refreshes of the downstream server info",
+	}, []string{"success"})
+)
+
+// helloLimitKeys are the limits in the isMaster/hello response taken from the downstream server
+var helloLimitKeys = []string{
+	"maxBsonObjectSize",
+	"maxMessageSizeBytes",
+	"maxWriteBatchSize",
+	"logicalSessionTimeoutMinutes",
+}
+
+// getServerInfo returns the cached downstream server info (nil if it isn't available)
+func (p *Proxy) getServerInfo() *plugins.ServerInfo {
+	info, _ := p.serverInfo.Load().(*plugins.ServerInfo)
+	return info
+}
+
+// refreshServerInfo fetches the server info from the first plugin in the chain
+// that provides it
+func (p *Proxy) refreshServerInfo(ctx context.Context) error {
+	p.chainLock.RLock()
+	c := p.chain
+	p.chainLock.RUnlock()
+
+	for _, pl := range c.plugins {
+		sp, ok := plugins.Unwrap(pl).(plugins.ServerInfoProvider)
+		if !ok {
+			continue
+		}
+		info, err := sp.ServerInfo(ctx)
+		serverInfoRefreshCounter.WithLabelValues(strconv.FormatBool(err == nil)).Inc()
+		if err != nil {
+			return err
+		}
+		p.serverInfo.Store(info)
+		return nil
+	}
+	return nil
+}
+
+// serverInfoLoop refreshes the server info until the proxy is shut down
+func (p *Proxy) serverInfoLoop() {
+	interval := p.cfg.ServerInfoRefreshInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Abort an in-flight refresh on shutdown: once the backend client is
+	// disconnected, server selection would otherwise spin until the timeout
+	done, stop := context.WithCancel(context.Background())
+	defer stop()
+	go func() {
+		select {
+		case <-p.doneChan:
+			stop()
+		case <-done.Done():
+		}
+	}()
+
+	for {
+		ctx, cancel := context.WithTimeout(done, 10*time.Second)
+		if err := p.refreshServerInfo(ctx); err != nil {
+			logrus.Errorf("Error refreshing server info: %v", err)
+		}
+		cancel()
+
+		select {
+		case <-p.doneChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// setFrom sets the keys in d to their values in src (if present)
+func setFrom(d, src bson.D, keys ...string) bson.D {
+	for _, key := range keys {
+		for _, e := range src {
+			if e.Key != key {
+				continue
+			}
+			found := false
+			for i := range d {
+				if d[i].Key == key {
+					d[i].Value = e.Value
+					found = true
+					break
+				}
+			}
+			if !found {
+				d = append(d, e)
+			}
+			break
+		}
+	}
+	return d
+}
+
+// override sets the fields of overrides in d, removing those with a nil value
+func override(d, overrides bson.D) bson.D {
+	for _, o := range overrides {
+		found := false
+		for i := 0; i < len(d); i++ {
+			if d[i].Key != o.Key {
+				continue
+			}
+			found = true
+			if o.Value == nil {
+				d = append(d[:i], d[i+1:]...)
+			} else {
+				d[i].Value = o.Value
+			}
+			break
+		}
+		if !found && o.Value != nil {
+			d = append(d, o)
+		}
+	}
+	return d
+}
@@ -0,0 +1,150 @@
+package mongoproxy
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+	"github.com/wish/mongoproxy/pkg/mongotest"
+)
+
+func TestServerInfo(t *testing.T) {
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	backend.Handle("buildInfo", func(string, bson.D) bson.D {
+		return bson.D{{"version", "4.4.1"}, {"ok", 1}}
+	})
+
+	cfg := &config.Config{
+		Plugins: []config.PluginConfig{
+			{
+				Name: "mongo",
+				Config: bson.D{
+					{"connectTimeout", "1s"},
+					{"mongoAddr", backend.URI()},
+				},
+			},
+		},
+	}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.closeDoneChan()
+
+	for i := 0; proxy.getServerInfo() == nil; i++ {
+		if i > 100 {
+			t.Fatalf("server info not loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	run := func(d bson.D) bson.D {
+		t.Helper()
+		resp, err := proxy.HandleMongo(context.TODO(), &plugins.Request{CC: plugins.NewClientConnection(), CursorCache: proxy}, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if v := run(bson.D{{"buildInfo", 1}, {"$db", "admin"}}).Map()["version"]; v != "4.4.1" {
+		t.Fatalf("mismatch in version: %v", v)
+	}
+	hello := run(bson.D{{"hello", 1}, {"helloOk", true}, {"$db", "admin"}}).Map()
+	if hello["isWritablePrimary"] != true || hello["helloOk"] != true {
+		t.Fatalf("mismatch in hello: %v", hello)
+	}
+	if isMaster := run(bson.D{{"isMaster", 1}, {"$db", "admin"}}).Map(); isMaster["ismaster"] != true {
+		t.Fatalf("mismatch in isMaster: %v", isMaster)
+	}
+}
+
+func TestServerStatus(t *testing.T) {
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	backend.Handle("serverStatus", func(string, bson.D) bson.D {
+		return bson.D{{"host", "backend"}, {"opcounters", bson.D{{"insert", 1}}}, {"ok", 1}}
+	})
+	backend.Handle("getParameter", func(string, bson.D) bson.D {
+		return bson.D{{"logLevel", 0}, {"ok", 1}}
+	})
+
+	cfg := &config.Config{
+		Plugins: []config.PluginConfig{
+			{
+				Name: "mongo",
+				Config: bson.D{
+					{"connectTimeout", "1s"},
+					{"mongoAddr", backend.URI()},
+				},
+			},
+		},
+	}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.closeDoneChan()
+
+	run := func(d bson.D) map[string]interface{} {
+		t.Helper()
+		resp, err := proxy.HandleMongo(context.TODO(), &plugins.Request{CC: plugins.NewClientConnection(), CursorCache: proxy}, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Map()
+	}
+
+	status := run(bson.D{{"serverStatus", 1}, {"repl", 0}, {"$db", "admin"}})
+	if status["process"] != "mongos" || status["mongoproxy"] == nil || status["opcounters"] != nil {
+		t.Fatalf("mismatch in serverStatus: %v", status)
+	}
+	if status := run(bson.D{{"serverStatus", 1}, {"mongoproxy", 0}, {"$db", "admin"}}); status["mongoproxy"] != nil {
+		t.Fatalf("mongoproxy section not excluded: %v", status)
+	}
+	if params := run(bson.D{{"getParameter", 1}, {"featureCompatibilityVersion", 1}, {"$db", "admin"}}); params["featureCompatibilityVersion"] == nil {
+		t.Fatalf("mismatch in getParameter: %v", params)
+	}
+	if params := run(bson.D{{"getParameter", 1}, {"logLevel", 1}, {"$db", "admin"}}); params["codeName"] != "InvalidOptions" {
+		t.Fatalf("expected error for unknown parameter: %v", params)
+	}
+
+	// merged with the backend
+	proxy.cfg.MergeBackendStatus = true
+	status = run(bson.D{{"serverStatus", 1}, {"$db", "admin"}})
+	if status["host"] == "backend" || status["opcounters"] == nil || status["mongoproxy"] == nil {
+		t.Fatalf("mismatch in merged serverStatus: %v", status)
+	}
+	if params := run(bson.D{{"getParameter", 1}, {"logLevel", 1}, {"$db", "admin"}}); params["logLevel"] == nil {
+		t.Fatalf("mismatch in merged getParameter: %v", params)
+	}
+}
+
+func TestOverride(t *testing.T) {
+	d := bson.D{{"ismaster", true}, {"logicalSessionTimeoutMinutes", 30}, {"maxWireVersion", 8}, {"ok", 1}}
+	d = override(d, bson.D{{"logicalSessionTimeoutMinutes", nil}, {"maxWireVersion", 7}, {"compression", bson.A{}}})
+	expected := bson.D{{"ismaster", true}, {"maxWireVersion", 7}, {"ok", 1}, {"compression", bson.A{}}}
+	if !reflect.DeepEqual(d, expected) {
+		t.Fatalf("mismatch\nexpected=%v\nactual=%v", expected, d)
+	}
+}
@@ -0,0 +1,188 @@
+package mongoproxy
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+// defaultVersion is the version reported if the downstream version isn't known
+const defaultVersion = "4.3.1"
+
+// version returns the downstream server version
+func (p *Proxy) version() string {
+	if info := p.getServerInfo(); info != nil {
+		if v, ok := info.BuildInfo.Map()["version"].(string); ok {
+			return v
+		}
+	}
+	return defaultVersion
+}
+
+// commandRunner returns the first plugin in the chain which can run commands downstream
+func (p *Proxy) commandRunner() plugins.CommandRunner {
+	p.chainLock.RLock()
+	c := p.chain
+	p.chainLock.RUnlock()
+
+	for _, pl := range c.plugins {
+		if cr, ok := plugins.Unwrap(pl).(plugins.CommandRunner); ok {
+			return cr
+		}
+	}
+	return nil
+}
+
+// serverStatus returns the proxy's serverStatus; with mergeBackendStatus the
+// backend's serverStatus is used as the base. Sections can be excluded as usual
+// (e.g. {mongoproxy: 0}).
+func (p *Proxy) serverStatus(ctx context.Context, cmd *command.ServerStatus) bson.D {
+	var status bson.D
+	if p.cfg.MergeBackendStatus {
+		if cr := p.commandRunner(); cr != nil {
+			backend, err := cr.RunCommand(ctx, "admin", append(bson.D{{"serverStatus", 1}}, cmd.Options...))
+			if err != nil {
+				logrus.Errorf("Error getting backend serverStatus: %v", err)
+			} else {
+				status = backend
+			}
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	uptime := time.Since(p.start)
+
+	p.activeConnLock.Lock()
+	current, created := len(p.activeConn), p.connsCreated
+	p.activeConnLock.Unlock()
+
+	status = setFrom(status, bson.D{
+		{"host", hostname},
+		{"version", p.version()},
+		{"process", "mongos"},
+		{"pid", int64(os.Getpid())},
+		{"uptime", int64(uptime.Seconds())},
+		{"uptimeMillis", uptime.Milliseconds()},
+		{"uptimeEstimate", int64(uptime.Seconds())},
+		{"localTime", time.Now().Truncate(time.Millisecond)},
+		{"connections", bson.D{
+			{"current", int32(current)},
+			{"totalCreated", created},
+		}},
+		{"mongoproxy", p.proxyStatus()},
+		{"ok", 1},
+	}, "host", "version", "process", "pid", "uptime", "uptimeMillis", "uptimeEstimate", "localTime", "connections", "mongoproxy", "ok")
+
+	// Remove excluded sections
+	for _, option := range cmd.Options {
+		if !truthy(option.Value) {
+			for i, e := range status {
+				if e.Key == option.Key {
+					status = append(status[:i], status[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	return status
+}
+
+// proxyStatus returns the proxy specific serverStatus section
+func (p *Proxy) proxyStatus() bson.D {
+	p.chainLock.RLock()
+	c := p.chain
+	p.chainLock.RUnlock()
+
+	pluginStats := make(bson.A, 0, len(c.plugins))
+	for _, pl := range c.plugins {
+		stats := bson.D{{"name", pl.Name()}}
+		if sp, ok := plugins.Unwrap(pl).(plugins.StatsProvider); ok {
+			stats = append(stats, sp.Stats()...)
+		}
+		pluginStats = append(pluginStats, stats)
+	}
+
+	return bson.D{
+		{"ops", bson.D{{"running", int32(len(p.Ops()))}}},
+		{"cursors", bson.D{{"open", int32(p.cursorCache.Count())}}},
+		{"readOnly", p.ReadOnly()},
+		{"canary", p.canary != nil},
+		{"memory", p.memory.status()},
+		{"plugins", pluginStats},
+	}
+}
+
+// getParameter answers getParameter; the proxy only knows featureCompatibilityVersion
+// so with mergeBackendStatus other parameters come from the backend.
+func (p *Proxy) getParameter(ctx context.Context, cmd *command.GetParameter) bson.D {
+	if p.cfg.MergeBackendStatus {
+		if cr := p.commandRunner(); cr != nil {
+			resp, err := cr.RunCommand(ctx, "admin", append(bson.D{{"getParameter", cmd.GetParameter}}, cmd.Parameters...))
+			if err == nil {
+				return resp
+			}
+			logrus.Errorf("Error getting backend parameters: %v", err)
+		}
+	}
+
+	// featureCompatibilityVersion is the major.minor of the version
+	fcv := p.version()
+	for i, dots := 0, 0; i < len(fcv); i++ {
+		if fcv[i] == '.' {
+			if dots++; dots == 2 {
+				fcv = fcv[:i]
+				break
+			}
+		}
+	}
+	known := bson.D{
+		{"featureCompatibilityVersion", bson.D{{"version", fcv}}},
+	}
+
+	if cmd.AllParameters() {
+		return append(known, bson.E{"ok", 1})
+	}
+
+	resp := bson.D{}
+	for _, param := range cmd.Parameters {
+		found := false
+		for _, e := range known {
+			if e.Key == param.Key {
+				resp = append(resp, e)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return mongoerror.InvalidOptions.ErrMessage("no option found to get")
+		}
+	}
+	if len(resp) == 0 {
+		return mongoerror.InvalidOptions.ErrMessage("no option found to get")
+	}
+	return append(resp, bson.E{"ok", 1})
+}
+
+// truthy returns whether a serverStatus option value enables the section
+func truthy(v interface{}) bool {
+	switch tv := v.(type) {
+	case bool:
+		return tv
+	case int:
+		return tv != 0
+	case int32:
+		return tv != 0
+	case int64:
+		return tv != 0
+	case float64:
+		return tv != 0
+	}
+	return true
+}
@@ -0,0 +1,123 @@
+package mongoproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/semaphore"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+)
+
+var (
+	tlsHandshakeCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_client_tls_handshakes_total",
+		Help: "The total TLS handshakes with clients by whether the session was resumed",
+	}, []string{"resumed"})
+	tlsHandshakeFailedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_client_tls_handshake_failed_total",
+		Help: "The total failed TLS handshakes with clients by reason",
+	}, []string{"reason"})
+	tlsHandshakeSummary = promauto.NewSummaryVec(prometheus.SummaryOpts{
+		Name:       "mongoproxy_client_tls_handshake_seconds",
+		Help:       "Summary of the time of TLS handshakes with clients by whether the session was resumed",
+		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001, 1.0: 0.0},
+		MaxAge:     time.Minute,
+	}, []string{"resumed"})
+	tlsHandshakeWaitingGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongoproxy_client_tls_handshakes_waiting",
+		Help: "The current number of client connections waiting for a TLS handshake slot",
+	})
+)
+
+// newTLSConfig returns the TLS config of the client listener
+func newTLSConfig(cfg *config.TLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading tls certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates:           []tls.Certificate{cert},
+		SessionTicketsDisabled: cfg.DisableSessionTickets,
+	}
+	if len(cfg.SessionTicketKeyFiles) > 0 {
+		keys := make([][32]byte, len(cfg.SessionTicketKeyFiles))
+		for i, path := range cfg.SessionTicketKeyFiles {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("error reading session ticket key: %w", err)
+			}
+			key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+			if err != nil {
+				return nil, fmt.Errorf("invalid session ticket key %s: %w", path, err)
+			}
+			if len(key) != len(keys[i]) {
+				return nil, fmt.Errorf("invalid session ticket key %s: must be %d bytes, got %d", path, len(keys[i]), len(key))
+			}
+			copy(keys[i][:], key)
+		}
+		tlsConfig.SetSessionTicketKeys(keys)
+	}
+	return tlsConfig, nil
+}
+
+// tlsHandshaker does the TLS handshakes of client connections, at most
+// maxConcurrentHandshakes at once, so that the full handshakes of a reconnect
+// storm don't starve the requests of the connected clients of CPU
+type tlsHandshaker struct {
+	cfg *config.TLSConfig
+	// sem is nil if the handshakes are unlimited
+	sem *semaphore.Weighted
+}
+
+func newTLSHandshaker(cfg *config.TLSConfig) *tlsHandshaker {
+	h := &tlsHandshaker{cfg: cfg}
+	if cfg.MaxConcurrentHandshakes > 0 {
+		h.sem = semaphore.NewWeighted(int64(cfg.MaxConcurrentHandshakes))
+	}
+	return h
+}
+
+// handshake does the connection's handshake once there is a slot for it, failing
+// if it isn't done within the handshake timeout
+func (h *tlsHandshaker) handshake(c *tls.Conn) error {
+	deadline := time.Now().Add(h.cfg.HandshakeTimeoutDuration)
+	if h.sem != nil {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		tlsHandshakeWaitingGauge.Inc()
+		err := h.sem.Acquire(ctx, 1)
+		tlsHandshakeWaitingGauge.Dec()
+		if err != nil {
+			tlsHandshakeFailedCounter.WithLabelValues("wait").Inc()
+			return fmt.Errorf("timed out waiting for a handshake slot")
+		}
+		defer h.sem.Release(1)
+	}
+
+	start := time.Now()
+	c.SetDeadline(deadline)
+	err := c.Handshake()
+	c.SetDeadline(time.Time{})
+	if err != nil {
+		reason := "error"
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			reason = "timeout"
+		}
+		tlsHandshakeFailedCounter.WithLabelValues(reason).Inc()
+		return err
+	}
+	resumed := strconv.FormatBool(c.ConnectionState().DidResume)
+	tlsHandshakeCounter.WithLabelValues(resumed).Inc()
+	tlsHandshakeSummary.WithLabelValues(resumed).Observe(time.Since(start).Seconds())
+	return nil
+}
@@ -0,0 +1,183 @@
+package mongoproxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongotest"
+	"github.com/wish/mongoproxy/pkg/mongowire"
+)
+
+// writeTestCert writes a self-signed certificate and its key to dir
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mongoproxy"},
+		DNSNames:     []string{"mongoproxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestProxyTLSResumption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir)
+	ticketKeyFile := filepath.Join(dir, "ticket.key")
+	if err := ioutil.WriteFile(ticketKeyFile, []byte(base64.StdEncoding.EncodeToString(make([]byte, 32))+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	// Two proxies sharing the session ticket key
+	start := func() *Proxy {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := &config.Config{
+			Plugins: []config.PluginConfig{
+				{
+					Name: "mongo",
+					Config: bson.D{
+						{"connectTimeout", "1s"},
+						{"mongoAddr", backend.URI()},
+					},
+				},
+			},
+			TLS: &config.TLSConfig{
+				CertFile:                certFile,
+				KeyFile:                 keyFile,
+				SessionTicketKeyFiles:   []string{ticketKeyFile},
+				MaxConcurrentHandshakes: 2,
+			},
+		}
+		if err := cfg.Load(); err != nil {
+			t.Fatal(err)
+		}
+		proxy, err := NewProxy(l, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go proxy.Serve()
+		return proxy
+	}
+	a, b := start(), start()
+	defer a.Shutdown(context.TODO())
+	defer b.Shutdown(context.TODO())
+
+	clientConfig := &tls.Config{
+		ServerName:         "mongoproxy",
+		InsecureSkipVerify: true,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	ping := func(addr string) bool {
+		c, err := tls.Dial("tcp", addr, clientConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		msg := &mongowire.OP_MSG{
+			Header:   mongowire.MessageHeader{RequestID: 1, OpCode: mongowire.OpMsg},
+			Sections: []mongowire.MSGSection{mongowire.MSGSection_Body{bson.D{{"ping", 1}, {"$db", "admin"}}}},
+		}
+		if err := msg.WriteTo(c); err != nil {
+			t.Fatal(err)
+		}
+		req, err := mongowire.NewRequest(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp := req.GetOpMsg().Sections[0].(mongowire.MSGSection_Body).Document.Map(); resp["ok"] != int32(1) {
+			t.Fatalf("mismatch in ping response: %v", resp)
+		}
+		return c.ConnectionState().DidResume
+	}
+
+	if ping(a.Addr()) {
+		t.Fatalf("expected a full handshake")
+	}
+	if !ping(a.Addr()) {
+		t.Fatalf("expected the session to be resumed")
+	}
+	// The other proxy decrypts the ticket with the shared key
+	if !ping(b.Addr()) {
+		t.Fatalf("expected the session to be resumed on the other proxy")
+	}
+}
+
+func TestTLSHandshakerLimit(t *testing.T) {
+	cfg := &config.TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem", MaxConcurrentHandshakes: 1, HandshakeTimeout: "50ms"}
+	if err := (&config.Config{TLS: cfg}).Load(); err != nil {
+		t.Fatal(err)
+	}
+	h := newTLSHandshaker(cfg)
+
+	// Connections wait for a slot while all are taken, and are closed after the
+	// handshake timeout
+	h.sem.Acquire(context.Background(), 1)
+	server, client := net.Pipe()
+	defer client.Close()
+	start := time.Now()
+	if err := h.handshake(tls.Server(server, &tls.Config{})); err == nil {
+		t.Fatalf("expected the handshake to time out")
+	}
+	if wait := time.Since(start); wait < 50*time.Millisecond {
+		t.Fatalf("expected to wait for a slot, waited %v", wait)
+	}
+
+	// Handshakes which don't finish time out too
+	h.sem.Release(1)
+	if err := h.handshake(tls.Server(server, &tls.Config{})); err == nil {
+		t.Fatalf("expected the handshake to time out")
+	}
+	if !h.sem.TryAcquire(1) {
+		t.Fatalf("expected the slot to be released")
+	}
+}
@@ -0,0 +1,131 @@
+package mongoproxy
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+var (
+	warmingUpGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongoproxy_warming_up",
+		Help: "Whether the proxy is warming up (1) and not ready yet",
+	})
+	warmUpRejectedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mongoproxy_client_warmup_rejected_total",
+		Help: "The total number of client connections closed by the warm-up connection ramp",
+	})
+
+	errWarmingUp = errors.New("warming up")
+)
+
+// warmUp tracks the warm-up of the proxy: the proxy isn't ready until it's done
+// and the open client connections are then ramped up
+type warmUp struct {
+	cfg *config.WarmUpConfig
+	// done is closed once the warm-up is over (end is set before)
+	done chan struct{}
+	end  time.Time
+}
+
+func newWarmUp(cfg *config.WarmUpConfig) *warmUp {
+	return &warmUp{cfg: cfg, done: make(chan struct{})}
+}
+
+// warming returns whether the warm-up isn't over yet
+func (w *warmUp) warming() bool {
+	select {
+	case <-w.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// maxConns returns the cap on open client connections at the time (0 if none)
+func (w *warmUp) maxConns(now time.Time) int {
+	if w.cfg.MaxConnections <= 0 {
+		return 0
+	}
+	var elapsed time.Duration
+	if !w.warming() {
+		elapsed = now.Sub(w.end)
+	}
+	if elapsed >= w.cfg.RampDuration {
+		return 0
+	}
+	ramp := slowStartFloor + (1-slowStartFloor)*float64(elapsed)/float64(w.cfg.RampDuration)
+	if n := int(math.Round(float64(w.cfg.MaxConnections) * ramp)); n > 1 {
+		return n
+	}
+	return 1
+}
+
+// admit returns whether a new client connection may be served given the open ones
+func (w *warmUp) admit(open int, now time.Time) bool {
+	max := w.maxConns(now)
+	if max > 0 && open >= max {
+		warmUpRejectedCounter.Inc()
+		return false
+	}
+	return true
+}
+
+// warmUp warms up the plugins of the chains and loads the server info (up to the
+// warm-up timeout) after which the proxy reports ready
+func (p *Proxy) warmUp() {
+	start := time.Now()
+	warmingUpGauge.Set(1)
+	defer func() {
+		warmingUpGauge.Set(0)
+		p.warm.end = time.Now()
+		close(p.warm.done)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.warm.cfg.TimeoutDuration)
+	defer cancel()
+	// Stop warming up if the proxy shuts down
+	go func() {
+		select {
+		case <-p.doneChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	p.chainLock.RLock()
+	c, canary := p.chain, p.canary
+	p.chainLock.RUnlock()
+	err := plugins.WarmUpPlugins(ctx, c.plugins)
+	if canary != nil {
+		if canaryErr := plugins.WarmUpPlugins(ctx, canary.plugins); err == nil && canaryErr != nil {
+			err = canaryErr
+		}
+	}
+	// isMaster/hello are answered from the server info
+	if p.getServerInfo() == nil {
+		if infoErr := p.refreshServerInfo(ctx); err == nil && infoErr != nil {
+			err = infoErr
+		}
+	}
+	if err != nil {
+		logrus.Warnf("Warm-up incomplete after %s, ready anyway: %v", time.Since(start), err)
+		return
+	}
+	logrus.Infof("Warmed up in %s", time.Since(start))
+}
+
+// openConns returns the number of open client connections
+func (p *Proxy) openConns() int {
+	p.activeConnLock.Lock()
+	defer p.activeConnLock.Unlock()
+	return len(p.activeConn)
+}
@@ -0,0 +1,89 @@
+package mongoproxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongotest"
+)
+
+func TestWarmUp(t *testing.T) {
+	backend, err := mongotest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		Plugins: []config.PluginConfig{{
+			Name: "mongo",
+			Config: bson.D{
+				{"connectTimeout", "1s"},
+				{"mongoAddr", backend.URI()},
+				{"warmUpConnections", int64(5)},
+			},
+		}},
+		WarmUp: &config.WarmUpConfig{Timeout: "10s"},
+	}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(l, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Serve()
+	defer proxy.Shutdown(context.TODO())
+
+	select {
+	case <-proxy.warm.done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("warm-up didn't finish")
+	}
+	if err := proxy.Health(context.TODO()); err != nil {
+		t.Fatalf("expected the proxy to be ready after the warm-up: %v", err)
+	}
+	if proxy.getServerInfo() == nil {
+		t.Fatalf("expected the server info to be loaded during the warm-up")
+	}
+}
+
+func TestWarmUpRamp(t *testing.T) {
+	cfg := config.WarmUpConfig{MaxConnections: 100, Ramp: "10s"}
+	if err := (&config.Config{WarmUp: &cfg}).Load(); err != nil {
+		t.Fatal(err)
+	}
+	w := newWarmUp(&cfg)
+	now := time.Now()
+	if max := w.maxConns(now); max != 10 {
+		t.Fatalf("expected 10 connections while warming up, got %d", max)
+	}
+	if !w.admit(9, now) || w.admit(10, now) {
+		t.Fatalf("expected connections to be capped at 10")
+	}
+
+	w.end = now
+	close(w.done)
+	for _, test := range []struct {
+		at       time.Duration
+		expected int
+	}{
+		{0, 10},
+		{5 * time.Second, 55},
+		{10 * time.Second, 0},
+	} {
+		if max := w.maxConns(now.Add(test.at)); max != test.expected {
+			t.Fatalf("expected a cap of %d connections after %s, got %d", test.expected, test.at, max)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package mongoproxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+var (
+	workerPoolSizeGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongoproxy_worker_pool_size",
+		Help: "The number of workers handling client requests",
+	})
+	workerPoolBusyGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongoproxy_worker_pool_busy",
+		Help: "The current number of workers handling a client request",
+	})
+	workerPoolQueueGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mongoproxy_worker_pool_queue_depth",
+		Help: "The current number of client requests waiting for a worker per priority",
+	}, []string{"priority"})
+	workerPoolWaitSummary = promauto.NewSummaryVec(prometheus.SummaryOpts{
+		Name:       "mongoproxy_worker_pool_queue_wait_seconds",
+		Help:       "Summary of the time client requests waited for a worker per priority",
+		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001, 1.0: 0.0},
+		MaxAge:     time.Minute,
+	}, []string{"priority"})
+	workerPoolRejectedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_worker_pool_rejected_total",
+		Help: "The total client requests rejected as their priority's queue was full",
+	}, []string{"priority"})
+)
+
+// errQueueFull is returned for requests whose priority's queue is full
+var errQueueFull = errors.New("worker pool queue full")
+
+// queueFullError is the (retryable) error returned to clients for requests
+// rejected as their queue is full
+func queueFullError() bson.D {
+	return append(mongoerror.ExceededTimeLimit.ErrMessage("proxy worker pool saturated; retry later"),
+		bson.E{"errorLabels", bson.A{"RetryableWriteError"}})
+}
+
+// workerPool handles client requests with a fixed number of workers rather than
+// on each connection's goroutine, bounding the requests handled at once. Requests
+// wait for a worker in a queue per priority; a worker takes the oldest request of
+// the highest priority with requests waiting.
+type workerPool struct {
+	cfg *config.WorkerPoolConfig
+	// appNames are the priorities (index) of client appNames
+	appNames map[string]int
+
+	l      sync.Mutex
+	cond   *sync.Cond
+	queues [][]*workerJob
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type workerJob struct {
+	fn       func()
+	priority int
+	enqueued time.Time
+	done     chan struct{}
+	// panicked is the value fn panicked with, re-panicked on the caller's
+	// goroutine so the connection's recovery handles it
+	panicked interface{}
+}
+
+func newWorkerPool(cfg *config.WorkerPoolConfig) *workerPool {
+	wp := &workerPool{
+		cfg:      cfg,
+		appNames: make(map[string]int),
+		queues:   make([][]*workerJob, len(cfg.Priorities)+1),
+	}
+	wp.cond = sync.NewCond(&wp.l)
+	for i, priority := range cfg.Priorities {
+		for _, appName := range priority.AppNames {
+			if _, ok := wp.appNames[appName]; !ok {
+				wp.appNames[appName] = i
+			}
+		}
+	}
+	wp.wg.Add(cfg.Size)
+	for i := 0; i < cfg.Size; i++ {
+		go wp.work()
+	}
+	workerPoolSizeGauge.Add(float64(cfg.Size))
+	return wp
+}
+
+// priority returns the priority of the connection's requests: that of its appName,
+// or the lowest (the default priority) if it's in none
+func (wp *workerPool) priority(cc *plugins.ClientConnection) int {
+	if p, ok := wp.appNames[cc.AppName]; ok {
+		return p
+	}
+	return len(wp.cfg.Priorities)
+}
+
+// priorityName returns the name of the priority for metrics
+func (wp *workerPool) priorityName(priority int) string {
+	if priority < len(wp.cfg.Priorities) {
+		return wp.cfg.Priorities[priority].Name
+	}
+	return "default"
+}
+
+// do runs fn on a worker once one is available, returning errQueueFull if the
+// priority's queue is full, or the context's error if it's done before a worker
+// took the request
+func (wp *workerPool) do(ctx context.Context, priority int, fn func()) error {
+	j := &workerJob{fn: fn, priority: priority, enqueued: time.Now(), done: make(chan struct{})}
+	name := wp.priorityName(priority)
+
+	wp.l.Lock()
+	if wp.closed {
+		wp.l.Unlock()
+		fn()
+		return nil
+	}
+	if wp.cfg.MaxQueue > 0 && len(wp.queues[priority]) >= wp.cfg.MaxQueue {
+		wp.l.Unlock()
+		workerPoolRejectedCounter.WithLabelValues(name).Inc()
+		return errQueueFull
+	}
+	wp.queues[priority] = append(wp.queues[priority], j)
+	workerPoolQueueGauge.WithLabelValues(name).Inc()
+	wp.cond.Signal()
+	wp.l.Unlock()
+
+	select {
+	case <-j.done:
+		j.repanic()
+		return nil
+	case <-ctx.Done():
+	}
+
+	// Take the request out of the queue unless a worker already took it
+	wp.l.Lock()
+	q := wp.queues[priority]
+	for i, queued := range q {
+		if queued == j {
+			wp.queues[priority] = append(q[:i:i], q[i+1:]...)
+			wp.l.Unlock()
+			workerPoolQueueGauge.WithLabelValues(name).Dec()
+			return ctx.Err()
+		}
+	}
+	wp.l.Unlock()
+	<-j.done
+	j.repanic()
+	return nil
+}
+
+func (j *workerJob) repanic() {
+	if j.panicked != nil {
+		panic(j.panicked)
+	}
+}
+
+// run runs the request, recovering a panic for the caller
+func (j *workerJob) run() {
+	defer func() {
+		j.panicked = recover()
+		close(j.done)
+	}()
+	j.fn()
+}
+
+// next returns the next request to handle, or nil once the pool is closed and
+// the queues are drained
+func (wp *workerPool) next() *workerJob {
+	wp.l.Lock()
+	defer wp.l.Unlock()
+	for {
+		for priority, q := range wp.queues {
+			if len(q) > 0 {
+				j := q[0]
+				q[0] = nil
+				wp.queues[priority] = q[1:]
+				return j
+			}
+		}
+		if wp.closed {
+			return nil
+		}
+		wp.cond.Wait()
+	}
+}
+
+func (wp *workerPool) work() {
+	defer wp.wg.Done()
+	for {
+		j := wp.next()
+		if j == nil {
+			return
+		}
+		name := wp.priorityName(j.priority)
+		workerPoolQueueGauge.WithLabelValues(name).Dec()
+		workerPoolWaitSummary.WithLabelValues(name).Observe(time.Since(j.enqueued).Seconds())
+
+		workerPoolBusyGauge.Inc()
+		j.run()
+		workerPoolBusyGauge.Dec()
+	}
+}
+
+// close stops the workers once the queued requests are handled; requests after
+// close are handled on the caller's goroutine
+func (wp *workerPool) close() {
+	wp.l.Lock()
+	if wp.closed {
+		wp.l.Unlock()
+		return
+	}
+	wp.closed = true
+	wp.cond.Broadcast()
+	wp.l.Unlock()
+	wp.wg.Wait()
+	workerPoolSizeGauge.Sub(float64(wp.cfg.Size))
+}
@@ -0,0 +1,125 @@
+package mongoproxy
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func TestWorkerPool(t *testing.T) {
+	cfg := &config.WorkerPoolConfig{
+		Size:       1,
+		MaxQueue:   2,
+		Priorities: []config.WorkerPriorityConfig{{Name: "high", AppNames: []string{"api"}}},
+	}
+	if err := (&config.Config{WorkerPool: cfg}).Load(); err != nil {
+		t.Fatal(err)
+	}
+	wp := newWorkerPool(cfg)
+	defer wp.close()
+
+	high := wp.priority(&plugins.ClientConnection{AppName: "api"})
+	low := wp.priority(&plugins.ClientConnection{AppName: "batch"})
+	if high != 0 || low != 1 || wp.priorityName(low) != "default" {
+		t.Fatalf("unexpected priorities %d, %d", high, low)
+	}
+
+	// Hold the only worker so the following requests queue
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go wp.do(context.Background(), low, func() {
+		close(started)
+		<-release
+	})
+	<-started
+
+	var (
+		l     sync.Mutex
+		order []string
+		wg    sync.WaitGroup
+	)
+	enqueue := func(priority int, name string, queued int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := wp.do(context.Background(), priority, func() {
+				l.Lock()
+				order = append(order, name)
+				l.Unlock()
+			}); err != nil {
+				t.Error(err)
+			}
+		}()
+		// Wait for the request to be queued to keep the order
+		for {
+			wp.l.Lock()
+			n := len(wp.queues[priority])
+			wp.l.Unlock()
+			if n == queued {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	enqueue(low, "low1", 1)
+	enqueue(low, "low2", 2)
+	enqueue(high, "high", 1)
+
+	// The default queue is full
+	if err := wp.do(context.Background(), low, func() {}); err != errQueueFull {
+		t.Fatalf("expected %v, got %v", errQueueFull, err)
+	}
+
+	// Requests whose context is done are taken out of the queue
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := wp.do(ctx, high, func() { t.Error("canceled request ran") }); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	close(release)
+	wg.Wait()
+	if len(order) != 3 || order[0] != "high" || order[1] != "low1" || order[2] != "low2" {
+		t.Fatalf("unexpected order %v", order)
+	}
+
+	// Panics are raised on the caller's goroutine
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Fatalf("expected panic, got %v", r)
+			}
+		}()
+		wp.do(context.Background(), high, func() { panic("boom") })
+	}()
+
+	// Requests after close run on the caller's goroutine
+	wp.close()
+	ran := false
+	if err := wp.do(context.Background(), high, func() { ran = true }); err != nil || !ran {
+		t.Fatalf("expected the request to run after close: %v", err)
+	}
+}
+
+func TestWorkerPoolConfig(t *testing.T) {
+	tests := []struct {
+		cfg config.WorkerPoolConfig
+		ok  bool
+	}{
+		{config.WorkerPoolConfig{Size: 4}, true},
+		{config.WorkerPoolConfig{}, false},
+		{config.WorkerPoolConfig{Size: 4, MaxQueue: -1}, false},
+		{config.WorkerPoolConfig{Size: 4, Priorities: []config.WorkerPriorityConfig{{Name: "default"}}}, false},
+		{config.WorkerPoolConfig{Size: 4, Priorities: []config.WorkerPriorityConfig{{Name: "a"}, {Name: "a"}}}, false},
+	}
+	for i, test := range tests {
+		cfg := test.cfg
+		if err := (&config.Config{WorkerPool: &cfg}).Load(); (err == nil) != test.ok {
+			t.Fatalf("%d: unexpected error %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,521 @@
+package mongotest
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+)
+
+// MaxWireVersion is the wire version the fake server advertises
+const MaxWireVersion = 8
+
+// NewStore returns an empty Store
+func NewStore() *Store {
+	return &Store{
+		collections: make(map[string][]bson.D),
+		cursors:     make(map[int64]*cursor),
+	}
+}
+
+// Store is a very small in-memory document store; it only supports
+// equality filters and the simplest of update operators.
+type Store struct {
+	l            sync.Mutex
+	collections  map[string][]bson.D
+	cursors      map[int64]*cursor
+	nextCursorID int64
+}
+
+type cursor struct {
+	ns   string
+	docs []bson.D
+}
+
+// Documents returns a copy of the documents in the given namespace
+func (s *Store) Documents(database, collection string) []bson.D {
+	s.l.Lock()
+	defer s.l.Unlock()
+	docs := s.collections[database+"."+collection]
+	ret := make([]bson.D, len(docs))
+	copy(ret, docs)
+	return ret
+}
+
+// Insert adds documents to the given namespace
+func (s *Store) Insert(database, collection string, docs ...bson.D) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	ns := database + "." + collection
+	for _, doc := range docs {
+		if _, ok := bsonutil.Lookup(doc, "_id"); !ok {
+			doc = append(bson.D{{"_id", primitive.NewObjectID()}}, doc...)
+		}
+		s.collections[ns] = append(s.collections[ns], doc)
+	}
+}
+
+func (s *Store) newCursor(ns string, docs []bson.D) int64 {
+	s.nextCursorID++
+	s.cursors[s.nextCursorID] = &cursor{ns: ns, docs: docs}
+	return s.nextCursorID
+}
+
+func (s *Server) registerDefaults() {
+	isMaster := func(string, bson.D) bson.D {
+		return bson.D{
+			{"ismaster", true},
+			{"isWritablePrimary", true},
+			{"helloOk", true},
+			{"localTime", time.Now().Truncate(time.Millisecond)},
+			{"maxBsonObjectSize", bsonutil.MaxBsonObjectSize},
+			{"maxMessageSizeBytes", 48000000},
+			{"maxWriteBatchSize", 100000},
+			{"logicalSessionTimeoutMinutes", 30},
+			{"minWireVersion", 0},
+			{"maxWireVersion", MaxWireVersion},
+			{"ok", 1},
+		}
+	}
+	s.Handle("isMaster", isMaster)
+	s.Handle("ismaster", isMaster)
+	s.Handle("hello", isMaster)
+
+	ok := func(string, bson.D) bson.D { return bson.D{{"ok", 1}} }
+	s.Handle("ping", ok)
+	s.Handle("endSessions", ok)
+
+	s.Handle("buildInfo", func(string, bson.D) bson.D {
+		return bson.D{
+			{"version", "4.2.0"},
+			{"versionArray", bson.A{4, 2, 0, 0}},
+			{"maxBsonObjectSize", bsonutil.MaxBsonObjectSize},
+			{"ok", 1},
+		}
+	})
+
+	s.Handle("insert", s.Store.handleInsert)
+	s.Handle("find", s.Store.handleFind)
+	s.Handle("getMore", s.Store.handleGetMore)
+	s.Handle("killCursors", s.Store.handleKillCursors)
+	s.Handle("update", s.Store.handleUpdate)
+	s.Handle("delete", s.Store.handleDelete)
+	s.Handle("count", s.Store.handleCount)
+}
+
+func (s *Store) handleInsert(database string, cmd bson.D) bson.D {
+	collection, _ := cmd[0].Value.(string)
+	docsRaw, _ := bsonutil.Lookup(cmd, "documents")
+	docs := toDocs(docsRaw)
+	s.Insert(database, collection, docs...)
+	return bson.D{{"n", len(docs)}, {"ok", 1}}
+}
+
+func (s *Store) handleFind(database string, cmd bson.D) bson.D {
+	collection, _ := cmd[0].Value.(string)
+	ns := database + "." + collection
+	filter, _ := getDoc(cmd, "filter")
+
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	var docs []bson.D
+	for _, doc := range s.collections[ns] {
+		if matches(doc, filter) {
+			docs = append(docs, doc)
+		}
+	}
+
+	if skip := getInt(cmd, "skip"); skip > 0 {
+		if skip > len(docs) {
+			skip = len(docs)
+		}
+		docs = docs[skip:]
+	}
+	if limit := getInt(cmd, "limit"); limit > 0 && limit < len(docs) {
+		docs = docs[:limit]
+	}
+
+	batch, rest := splitBatch(docs, getInt(cmd, "batchSize"))
+	var cursorID int64
+	if len(rest) > 0 && !truthy(lookupOrNil(cmd, "singleBatch")) {
+		cursorID = s.newCursor(ns, rest)
+	}
+
+	return bson.D{
+		{"cursor", bson.D{
+			{"firstBatch", toArray(batch)},
+			{"id", cursorID},
+			{"ns", ns},
+		}},
+		{"ok", 1},
+	}
+}
+
+func (s *Store) handleGetMore(database string, cmd bson.D) bson.D {
+	cursorID, _ := cmd[0].Value.(int64)
+
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	c, ok := s.cursors[cursorID]
+	if !ok {
+		return mongoerror.CursorNotFound.ErrMessage("cursor not found")
+	}
+
+	batch, rest := splitBatch(c.docs, getInt(cmd, "batchSize"))
+	c.docs = rest
+	if len(rest) == 0 {
+		delete(s.cursors, cursorID)
+		cursorID = 0
+	}
+
+	return bson.D{
+		{"cursor", bson.D{
+			{"nextBatch", toArray(batch)},
+			{"id", cursorID},
+			{"ns", c.ns},
+		}},
+		{"ok", 1},
+	}
+}
+
+func (s *Store) handleKillCursors(database string, cmd bson.D) bson.D {
+	cursorsRaw, _ := bsonutil.Lookup(cmd, "cursors")
+	cursors, _ := cursorsRaw.(primitive.A)
+
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	killed, notFound := primitive.A{}, primitive.A{}
+	for _, idRaw := range cursors {
+		id, _ := idRaw.(int64)
+		if _, ok := s.cursors[id]; ok {
+			delete(s.cursors, id)
+			killed = append(killed, id)
+		} else {
+			notFound = append(notFound, id)
+		}
+	}
+
+	return bson.D{
+		{"cursorsKilled", killed},
+		{"cursorsNotFound", notFound},
+		{"cursorsAlive", primitive.A{}},
+		{"cursorsUnknown", primitive.A{}},
+		{"ok", 1},
+	}
+}
+
+func (s *Store) handleUpdate(database string, cmd bson.D) bson.D {
+	collection, _ := cmd[0].Value.(string)
+	ns := database + "." + collection
+	updatesRaw, _ := bsonutil.Lookup(cmd, "updates")
+
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	var (
+		n, nModified int
+		upserted     primitive.A
+	)
+	for i, update := range toDocs(updatesRaw) {
+		filter, _ := getDoc(update, "q")
+		u, _ := getDoc(update, "u")
+		multi := truthy(lookupOrNil(update, "multi"))
+
+		matched := 0
+		for j, doc := range s.collections[ns] {
+			if !matches(doc, filter) {
+				continue
+			}
+			s.collections[ns][j] = applyUpdate(doc, u)
+			matched++
+			if !multi {
+				break
+			}
+		}
+		n += matched
+		nModified += matched
+
+		if matched == 0 && truthy(lookupOrNil(update, "upsert")) {
+			// Build the new doc from the equality fields in the filter + the update
+			doc := bson.D{{"_id", primitive.NewObjectID()}}
+			for _, e := range filter {
+				if _, isDoc := e.Value.(bson.D); !isDoc && e.Key[0] != '$' {
+					doc = set(doc, e.Key, e.Value)
+				}
+			}
+			doc = applyUpdate(doc, u)
+			s.collections[ns] = append(s.collections[ns], doc)
+			id, _ := bsonutil.Lookup(doc, "_id")
+			upserted = append(upserted, bson.D{{"index", i}, {"_id", id}})
+			n++
+		}
+	}
+
+	ret := bson.D{{"n", n}, {"nModified", nModified}}
+	if len(upserted) > 0 {
+		ret = append(ret, bson.E{"upserted", upserted})
+	}
+	return append(ret, bson.E{"ok", 1})
+}
+
+func (s *Store) handleDelete(database string, cmd bson.D) bson.D {
+	collection, _ := cmd[0].Value.(string)
+	ns := database + "." + collection
+	deletesRaw, _ := bsonutil.Lookup(cmd, "deletes")
+
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	n := 0
+	for _, del := range toDocs(deletesRaw) {
+		filter, _ := getDoc(del, "q")
+		limit := getInt(del, "limit")
+
+		remaining := s.collections[ns][:0]
+		deleted := 0
+		for _, doc := range s.collections[ns] {
+			if (limit == 0 || deleted < limit) && matches(doc, filter) {
+				deleted++
+				continue
+			}
+			remaining = append(remaining, doc)
+		}
+		s.collections[ns] = remaining
+		n += deleted
+	}
+
+	return bson.D{{"n", n}, {"ok", 1}}
+}
+
+func (s *Store) handleCount(database string, cmd bson.D) bson.D {
+	collection, _ := cmd[0].Value.(string)
+	filter, _ := getDoc(cmd, "query")
+
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	n := 0
+	for _, doc := range s.collections[database+"."+collection] {
+		if matches(doc, filter) {
+			n++
+		}
+	}
+	return bson.D{{"n", n}, {"ok", 1}}
+}
+
+// matches returns whether doc matches the filter. Only equality (and $eq/$in)
+// matches on top-level or dotted fields are supported.
+func matches(doc, filter bson.D) bool {
+	for _, e := range filter {
+		v, ok := lookupPath(doc, e.Key)
+		if ops, isDoc := e.Value.(bson.D); isDoc && len(ops) > 0 && ops[0].Key[0] == '$' {
+			for _, op := range ops {
+				switch op.Key {
+				case "$eq":
+					if !ok || !valuesEqual(v, op.Value) {
+						return false
+					}
+				case "$in":
+					arr, _ := op.Value.(primitive.A)
+					found := false
+					for _, item := range arr {
+						if ok && valuesEqual(v, item) {
+							found = true
+							break
+						}
+					}
+					if !found {
+						return false
+					}
+				case "$exists":
+					if ok != truthy(op.Value) {
+						return false
+					}
+				default:
+					return false
+				}
+			}
+			continue
+		}
+		if !ok || !valuesEqual(v, e.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyUpdate applies the update (either a replacement or $set/$unset/$inc) to doc
+func applyUpdate(doc, u bson.D) bson.D {
+	if len(u) == 0 || u[0].Key[0] != '$' {
+		id, _ := bsonutil.Lookup(doc, "_id")
+		if _, ok := bsonutil.Lookup(u, "_id"); ok {
+			return u
+		}
+		return append(bson.D{{"_id", id}}, u...)
+	}
+
+	ret := make(bson.D, len(doc))
+	copy(ret, doc)
+	for _, op := range u {
+		fields, _ := op.Value.(bson.D)
+		for _, f := range fields {
+			switch op.Key {
+			case "$set", "$setOnInsert":
+				ret = set(ret, f.Key, f.Value)
+			case "$unset":
+				ret = unset(ret, f.Key)
+			case "$inc":
+				cur, _ := lookupPath(ret, f.Key)
+				if isFloat(cur) || isFloat(f.Value) {
+					ret = set(ret, f.Key, toFloat(cur)+toFloat(f.Value))
+				} else {
+					ret = set(ret, f.Key, int64(toFloat(cur)+toFloat(f.Value)))
+				}
+			}
+		}
+	}
+	return ret
+}
+
+func lookupPath(doc bson.D, path string) (interface{}, bool) {
+	return bsonutil.Lookup(doc, splitPath(path)...)
+}
+
+func set(doc bson.D, key string, v interface{}) bson.D {
+	for i, e := range doc {
+		if e.Key == key {
+			doc[i].Value = v
+			return doc
+		}
+	}
+	return append(doc, bson.E{key, v})
+}
+
+func unset(doc bson.D, key string) bson.D {
+	for i, e := range doc {
+		if e.Key == key {
+			return append(doc[:i:i], doc[i+1:]...)
+		}
+	}
+	return doc
+}
+
+func splitPath(path string) []string {
+	var (
+		parts []string
+		start int
+	)
+	for i := 0; i < len(path); i++ {
+		if path[i] == '.' {
+			parts = append(parts, path[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, path[start:])
+}
+
+func valuesEqual(a, b interface{}) bool {
+	if isNumber(a) && isNumber(b) {
+		return toFloat(a) == toFloat(b)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case int, int32, int64, float64:
+		return true
+	}
+	return false
+}
+
+func isFloat(v interface{}) bool {
+	_, ok := v.(float64)
+	return ok
+}
+
+// truthy returns whether v is true (either a bool or a non-zero number)
+func truthy(v interface{}) bool {
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	return toFloat(v) != 0
+}
+
+func toFloat(v interface{}) float64 {
+	switch vTyped := v.(type) {
+	case int:
+		return float64(vTyped)
+	case int32:
+		return float64(vTyped)
+	case int64:
+		return float64(vTyped)
+	case float64:
+		return vTyped
+	}
+	return 0
+}
+
+func getDoc(d bson.D, key string) (bson.D, bool) {
+	v, ok := bsonutil.Lookup(d, key)
+	if !ok {
+		return nil, false
+	}
+	doc, ok := v.(bson.D)
+	return doc, ok
+}
+
+func getInt(d bson.D, key string) int {
+	v, ok := bsonutil.Lookup(d, key)
+	if !ok {
+		return 0
+	}
+	return int(toFloat(v))
+}
+
+func lookupOrNil(d bson.D, key string) interface{} {
+	v, _ := bsonutil.Lookup(d, key)
+	return v
+}
+
+func toDocs(v interface{}) []bson.D {
+	switch vTyped := v.(type) {
+	case []bson.D:
+		return vTyped
+	case primitive.A:
+		docs := make([]bson.D, 0, len(vTyped))
+		for _, item := range vTyped {
+			if doc, ok := item.(bson.D); ok {
+				docs = append(docs, doc)
+			}
+		}
+		return docs
+	}
+	return nil
+}
+
+func toArray(docs []bson.D) primitive.A {
+	arr := make(primitive.A, len(docs))
+	for i, doc := range docs {
+		arr[i] = doc
+	}
+	return arr
+}
+
+func splitBatch(docs []bson.D, batchSize int) ([]bson.D, []bson.D) {
+	if batchSize <= 0 {
+		batchSize = 101
+	}
+	if batchSize >= len(docs) {
+		return docs, nil
+	}
+	return docs[:batchSize], docs[batchSize:]
+}
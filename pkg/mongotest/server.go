@@ -0,0 +1,217 @@
+// Package mongotest provides an in-process fake mongo backend which speaks enough of
+// the wire protocol to run plugin and routing tests without a real mongod.
+package mongotest
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongowire"
+)
+
+// HandlerFunc handles a single command sent to the Server. The database is
+// the "$db" the command was sent to.
+type HandlerFunc func(database string, cmd bson.D) bson.D
+
+// NewServer returns a new Server listening on a random localhost port.
+func NewServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		l:        l,
+		handlers: make(map[string]HandlerFunc),
+		Store:    NewStore(),
+	}
+	s.registerDefaults()
+
+	go s.serve()
+
+	return s, nil
+}
+
+// Server is a fake mongo server. By default it handles the handshake (isMaster/hello)
+// and basic CRUD against an in-memory Store; additional (or canned) responses can be
+// added with Handle.
+type Server struct {
+	l net.Listener
+
+	handlersLock sync.RWMutex
+	handlers     map[string]HandlerFunc
+
+	// Store is the in-memory storage used by the default CRUD handlers
+	Store *Store
+
+	requestID int32
+	commands  sync.Map // command name -> *int64
+}
+
+// Addr returns the address the server is listening on
+func (s *Server) Addr() string {
+	return s.l.Addr().String()
+}
+
+// URI returns the mongo URI to connect to this server
+func (s *Server) URI() string {
+	return "mongodb://" + s.Addr()
+}
+
+// Close stops the server from accepting new connections
+func (s *Server) Close() error {
+	return s.l.Close()
+}
+
+// Handle registers (or replaces) the handler for the given command name
+func (s *Server) Handle(name string, h HandlerFunc) {
+	s.handlersLock.Lock()
+	defer s.handlersLock.Unlock()
+	s.handlers[name] = h
+}
+
+// CommandCount returns the number of times a command has been received
+func (s *Server) CommandCount(name string) int64 {
+	v, ok := s.commands.Load(name)
+	if !ok {
+		return 0
+	}
+	return atomic.LoadInt64(v.(*int64))
+}
+
+func (s *Server) serve() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			if err := s.serveConn(c); err != nil && err != io.EOF {
+				logrus.Debugf("mongotest: error serving conn: %v", err)
+			}
+		}()
+	}
+}
+
+func (s *Server) serveConn(c net.Conn) error {
+	for {
+		req, err := mongowire.NewRequest(c)
+		if err != nil {
+			return err
+		}
+
+		var reply mongowire.WireSerializer
+		switch req.GetHeader().OpCode {
+		case mongowire.OpQuery:
+			q := req.GetOpQuery()
+			reply = s.handleOpQuery(q)
+
+		case mongowire.OpMsg:
+			m := req.GetOpMsg()
+			reply = s.handleOpMsg(m)
+			if m.Flags.MoreToCome() {
+				reply = nil
+			}
+
+		default:
+			return fmt.Errorf("unsupported opcode: %v", req.GetHeader().OpCode)
+		}
+
+		if reply != nil {
+			if err := reply.WriteTo(c); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *Server) nextRequestID() int32 {
+	return atomic.AddInt32(&s.requestID, 1)
+}
+
+func (s *Server) handleOpQuery(q *mongowire.OP_QUERY) *mongowire.OP_REPLY {
+	cmd := q.Query
+	if len(cmd) > 0 && cmd[0].Key == "$query" {
+		if inner, ok := cmd[0].Value.(bson.D); ok {
+			cmd = inner
+		}
+	}
+
+	database := strings.SplitN(q.FullCollectionName, ".", 2)[0]
+	return &mongowire.OP_REPLY{
+		Header: mongowire.MessageHeader{
+			RequestID:  s.nextRequestID(),
+			ResponseTo: q.Header.RequestID,
+			OpCode:     mongowire.OpReply,
+		},
+		NumberReturned: 1,
+		Documents:      []bson.D{s.RunCommand(database, cmd)},
+	}
+}
+
+func (s *Server) handleOpMsg(m *mongowire.OP_MSG) *mongowire.OP_MSG {
+	var cmd bson.D
+	for _, sectionRaw := range m.Sections {
+		switch sectionTyped := sectionRaw.(type) {
+		case mongowire.MSGSection_Body:
+			cmd = append(sectionTyped.Document, cmd...)
+		case mongowire.MSGSection_DocumentSequence:
+			docs := make(primitive.A, len(sectionTyped.Documents))
+			for i, raw := range sectionTyped.Documents {
+				var doc bson.D
+				if err := bson.Unmarshal(raw, &doc); err != nil {
+					panic(err)
+				}
+				docs[i] = doc
+			}
+			cmd = append(cmd, primitive.E{Key: sectionTyped.SequenceIdentifier, Value: docs})
+		}
+	}
+
+	var database string
+	if v, ok := bsonutil.Lookup(cmd, "$db"); ok {
+		database, _ = v.(string)
+	}
+
+	return &mongowire.OP_MSG{
+		Header: mongowire.MessageHeader{
+			RequestID:  s.nextRequestID(),
+			ResponseTo: m.Header.RequestID,
+			OpCode:     mongowire.OpMsg,
+		},
+		Sections: []mongowire.MSGSection{
+			mongowire.MSGSection_Body{Document: s.RunCommand(database, cmd)},
+		},
+	}
+}
+
+// RunCommand runs the given command against the server's handlers
+func (s *Server) RunCommand(database string, cmd bson.D) bson.D {
+	if len(cmd) == 0 {
+		return mongoerror.FailedToParse.ErrMessage("empty command")
+	}
+	name := cmd[0].Key
+
+	v, _ := s.commands.LoadOrStore(name, new(int64))
+	atomic.AddInt64(v.(*int64), 1)
+
+	s.handlersLock.RLock()
+	h, ok := s.handlers[name]
+	s.handlersLock.RUnlock()
+	if !ok {
+		return mongoerror.CommandNotFound.ErrMessage("no such command: '" + name + "'")
+	}
+
+	return h(database, cmd)
+}
@@ -0,0 +1,89 @@
+package mongotest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestServer(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(s.URI()).SetRetryWrites(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+
+	if err := client.Ping(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	collection := client.Database("test").Collection("test")
+	for i := 0; i < 5; i++ {
+		if _, err := collection.InsertOne(ctx, bson.D{{"i", i}, {"name", "a"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Find with a small batchSize to exercise getMore
+	cur, err := collection.Find(ctx, bson.D{{"name", "a"}}, options.Find().SetBatchSize(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []bson.D
+	if err := cur.All(ctx, &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 5 {
+		t.Fatalf("expected 5 results, got %d", len(results))
+	}
+	if s.CommandCount("getMore") == 0 {
+		t.Fatalf("expected getMore to be called")
+	}
+
+	res, err := collection.UpdateOne(ctx, bson.D{{"i", 1}}, bson.D{{"$set", bson.D{{"name", "b"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ModifiedCount != 1 {
+		t.Fatalf("expected 1 modified, got %d", res.ModifiedCount)
+	}
+
+	var countResult struct {
+		N int `bson:"n"`
+	}
+	if err := client.Database("test").RunCommand(ctx, bson.D{{"count", "test"}, {"query", bson.D{{"name", "b"}}}}).Decode(&countResult); err != nil {
+		t.Fatal(err)
+	}
+	if countResult.N != 1 {
+		t.Fatalf("expected count of 1, got %d", countResult.N)
+	}
+
+	delRes, err := collection.DeleteMany(ctx, bson.D{{"name", "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delRes.DeletedCount != 4 {
+		t.Fatalf("expected 4 deleted, got %d", delRes.DeletedCount)
+	}
+
+	// Canned response
+	s.Handle("ping", func(string, bson.D) bson.D {
+		return bson.D{{"ok", 0}, {"errmsg", "canned"}, {"code", 1}}
+	})
+	if err := client.Ping(ctx, nil); err == nil {
+		t.Fatalf("expected canned error")
+	}
+}
@@ -0,0 +1,129 @@
+package mongowire
+
+import (
+	"bufio"
+	"errors"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// chunksBufferSize is the size of the buffer used when writing a message in
+// chunks; larger raw values are written directly to the underlying writer
+const chunksBufferSize = 64 * 1024
+
+// hasRawValue returns whether the document (or a sub-document) has a bson.RawValue
+func hasRawValue(d bson.D) bool {
+	for _, e := range d {
+		switch v := e.Value.(type) {
+		case bson.RawValue:
+			return true
+		case bson.D:
+			if hasRawValue(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// chunks is an encoded message split into chunks; raw values are referenced
+// instead of being copied into a single buffer
+type chunks struct {
+	b    [][]byte
+	size int
+}
+
+func (c *chunks) append(b []byte) {
+	c.b = append(c.b, b)
+	c.size += len(b)
+}
+
+// appendElementHeader appends the type and key of an element
+func (c *chunks) appendElementHeader(t bsontype.Type, key string) {
+	b := make([]byte, 0, len(key)+2)
+	b = append(b, byte(t))
+	b = append(b, key...)
+	c.append(append(b, 0))
+}
+
+// appendDocument appends the document d; the sub-documents with raw values are
+// appended recursively and all other elements are marshalled
+func (c *chunks) appendDocument(d bson.D) error {
+	start := c.size
+	length := make([]byte, 4)
+	c.append(length)
+	for _, e := range d {
+		switch v := e.Value.(type) {
+		case bson.RawValue:
+			c.appendElementHeader(v.Type, e.Key)
+			c.append(v.Value)
+			continue
+		case bson.D:
+			if hasRawValue(v) {
+				c.appendElementHeader(bsontype.EmbeddedDocument, e.Key)
+				if err := c.appendDocument(v); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		b, err := bson.Marshal(bson.D{e})
+		if err != nil {
+			return err
+		}
+		// Strip the length and terminator of the single element document
+		c.append(b[4 : len(b)-1])
+	}
+	c.append([]byte{0})
+	setInt32(length, 0, int32(c.size-start))
+	return nil
+}
+
+// writeChunks writes the message without building it in a single buffer; this
+// is used for messages with raw values (e.g. cursor batches) to avoid copying
+// them. The raw values themselves are still held whole in memory.
+func (o *OP_MSG) writeChunks(w io.Writer) error {
+	var c chunks
+	flags := make([]byte, 4)
+	setInt32(flags, 0, int32(o.Flags))
+	c.append(flags)
+	for _, section := range o.Sections {
+		sectionTyped, ok := section.(MSGSection_Body)
+		if !ok {
+			return errors.New("unknown section type")
+		}
+		c.append([]byte{0})
+		if err := c.appendDocument(sectionTyped.Document); err != nil {
+			return err
+		}
+	}
+
+	o.Header.MessageLength = int32(c.size) + HeaderLen
+	hb, err := o.Header.ToWire()
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriterSize(w, chunksBufferSize)
+	if _, err := bw.Write(hb); err != nil {
+		return err
+	}
+	for _, b := range c.b {
+		if _, err := bw.Write(b); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// hasRawValue returns whether any of the body sections have raw values
+func (o *OP_MSG) hasRawValue() bool {
+	for _, section := range o.Sections {
+		if body, ok := section.(MSGSection_Body); ok && hasRawValue(body.Document) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package mongowire
+
+import (
+	"bytes"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestOpMsgRawValues(t *testing.T) {
+	batch, err := bson.Marshal(bson.D{{"0", bson.D{{"_id", 1}, {"name", "a"}}}, {"1", bson.D{{"_id", 2}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := bson.A{bson.D{{"_id", 1}, {"name", "a"}}, bson.D{{"_id", 2}}}
+
+	msg := func(batch interface{}) *OP_MSG {
+		return &OP_MSG{
+			Header: MessageHeader{RequestID: 1, OpCode: OpMsg},
+			Sections: []MSGSection{
+				MSGSection_Body{bson.D{
+					{"cursor", bson.D{
+						{"firstBatch", batch},
+						{"id", int64(0)},
+						{"ns", "db.collection"},
+					}},
+					{"ok", 1},
+				}},
+			},
+		}
+	}
+
+	var expected, chunked bytes.Buffer
+	if err := msg(decoded).WriteTo(&expected); err != nil {
+		t.Fatal(err)
+	}
+	if err := msg(bson.RawValue{Type: bson.TypeArray, Value: batch}).WriteTo(&chunked); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expected.Bytes(), chunked.Bytes()) {
+		t.Fatalf("mismatch:\nexpected %x\ngot      %x", expected.Bytes(), chunked.Bytes())
+	}
+}
@@ -210,7 +210,7 @@ func (o *OP_MSG) FromWire(r io.Reader, crc *Crc32c, msgLen int) error {
 			o.Sections = append(o.Sections, MSGSection_DocumentSequence{
 				Size:               sectionSize,
 				SequenceIdentifier: ReadCString(r1),
-				Documents:          ReadDocuments(r1),
+				Documents:          ReadRawDocuments(r1),
 			})
 		default:
 			msg := fmt.Sprintf("unknown body kind=%v", t[0])
@@ -268,6 +268,9 @@ func (o *OP_MSG) ToWire() ([]byte, error) {
 }
 
 func (o *OP_MSG) WriteTo(w io.Writer) error {
+	if o.hasRawValue() {
+		return o.writeChunks(w)
+	}
 	b, err := o.ToWire()
 	if err != nil {
 		return err
@@ -292,10 +295,12 @@ type MSGSection_Body struct {
 
 func (MSGSection_Body) MSGSection() {}
 
+// MSGSection_DocumentSequence is a sequence of documents; they are kept raw
+// (e.g. the documents of an insert aren't decoded unless needed)
 type MSGSection_DocumentSequence struct {
 	Size               int32
 	SequenceIdentifier string
-	Documents          []bson.D
+	Documents          []bson.Raw
 }
 
 func (MSGSection_DocumentSequence) MSGSection() {}
@@ -0,0 +1,63 @@
+package mongowire
+
+import (
+	"bytes"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var benchMsg *OP_MSG
+
+func benchOpMsgBytes(b *testing.B) []byte {
+	m := &OP_MSG{
+		Header: MessageHeader{
+			RequestID: 1,
+			OpCode:    OpMsg,
+		},
+		Sections: []MSGSection{
+			MSGSection_Body{bson.D{
+				{"find", "collection"},
+				{"filter", bson.D{{"_id", 1}, {"name", bson.D{{"$in", bson.A{"a", "b", "c"}}}}}},
+				{"limit", 10},
+				{"$db", "testdb"},
+			}},
+		},
+	}
+	buf, err := m.ToWire()
+	if err != nil {
+		b.Fatal(err)
+	}
+	return buf
+}
+
+func BenchmarkOpMsgDecode(b *testing.B) {
+	buf := benchOpMsgBytes(b)
+	b.SetBytes(int64(len(buf)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		req, err := NewRequest(bytes.NewReader(buf))
+		if err != nil {
+			b.Fatal(err)
+		}
+		benchMsg = req.GetOpMsg()
+	}
+}
+
+func BenchmarkOpMsgEncode(b *testing.B) {
+	req, err := NewRequest(bytes.NewReader(benchOpMsgBytes(b)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	m := req.GetOpMsg()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := m.ToWire(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
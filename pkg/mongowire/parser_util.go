@@ -124,6 +124,18 @@ func ReadDocuments(r io.Reader) (ms []bson.D) {
 	return
 }
 
+// ReadRawDocuments reads the documents without decoding them
+func ReadRawDocuments(r io.Reader) (ms []bson.Raw) {
+	for {
+		one := ReadOne(r)
+		if one == nil {
+			break
+		}
+		ms = append(ms, bson.Raw(one))
+	}
+	return
+}
+
 func ToJson(v interface{}, l int) string {
 	w := ioutil.NewLimitedWriter(make([]byte, l))
 	jsoniter.NewEncoder(w).Encode(v)
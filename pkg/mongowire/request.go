@@ -1,7 +1,9 @@
 package mongowire
 
 import (
+	"bytes"
 	"io"
+	"io/ioutil"
 
 	"github.com/sirupsen/logrus"
 )
@@ -10,27 +12,30 @@ type Request struct {
 	hdr MessageHeader
 	crc Crc32c
 	r   io.Reader
+	// body is the rest of the message (r reads it, computing the crc if needed)
+	body io.Reader
 }
 
 func NewRequestWithHeader(h MessageHeader, c io.Reader) *Request {
 	return &Request{
-		hdr: h,
-		r:   c,
+		hdr:  h,
+		r:    c,
+		body: c,
 	}
 }
 
 func NewRequest(c io.Reader) (*Request, error) {
 	req := &Request{}
 	req.crc.Init()
-	tr := io.TeeReader(c, &req.crc)
-	h, err := ReadHeader(tr)
+	h, err := ReadHeader(io.TeeReader(c, &req.crc))
 	if err != nil {
 		return nil, err
 	}
 	logrus.Debugf("Header=%s\n", h)
 	req.hdr = *h
 
-	req.r = io.LimitReader(tr, int64(h.MessageLength-HeaderLen))
+	req.body = io.LimitReader(c, int64(h.MessageLength-HeaderLen))
+	req.r = io.TeeReader(req.body, &req.crc)
 	return req, nil
 }
 
@@ -77,3 +82,35 @@ func (req *Request) GetOpCompressed() *OP_COMPRESSED {
 	o.FromWire(req.r)
 	return o
 }
+
+// ReadOpMsgFlags reads the flags of an OP_MSG; this must be called before the
+// rest of the message is read (and only for OP_MSG)
+func (req *Request) ReadOpMsgFlags() (OP_MSG_Flags, error) {
+	n, err := ReadInt32(req.r)
+	if err != nil {
+		return 0, err
+	}
+	return OP_MSG_Flags(n), nil
+}
+
+// Buffer reads the rest of the message into memory so that the underlying reader
+// can be used (e.g. to watch the client connection) while the message is handled
+func (req *Request) Buffer() error {
+	b, err := ioutil.ReadAll(req.body)
+	if err != nil {
+		return err
+	}
+	tee := req.r != req.body
+	req.body = bytes.NewReader(b)
+	req.r = req.body
+	if tee {
+		req.r = io.TeeReader(req.body, &req.crc)
+	}
+	return nil
+}
+
+// Discard reads and discards the rest of the message without buffering it
+func (req *Request) Discard() error {
+	_, err := io.Copy(ioutil.Discard, req.r)
+	return err
+}
@@ -0,0 +1,146 @@
+package mongowire
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// streamPrefixLen is the length of the start of a reply buffered before it's
+// streamed: the header, flags, section kind, document length and the type and
+// key of its first element ("cursor")
+const streamPrefixLen = HeaderLen + 4 + 1 + 4 + 1 + len(streamFirstKey)
+
+// streamFirstKey is the first element of the replies streamed: the cursor of a
+// successful find or getMore (error replies start with ok)
+const streamFirstKey = "cursor\x00"
+
+const (
+	streamPending = iota
+	streamStreaming
+	streamDone
+	streamDeclined
+	streamFailed
+)
+
+// errStreamInterrupted is the error of a reply whose end wasn't streamed
+var errStreamInterrupted = errors.New("reply stream interrupted")
+
+// ReplyStream writes the reply of a backend to a client as it's read from the
+// backend connection, rather than once it has been read whole: the bytes read
+// from the backend are written to it (see Write). Only OP_MSG replies with a
+// single body section (no checksum or moreToCome) whose first element is a
+// cursor are streamed, with their header rewritten as a reply to the client's
+// request; other replies are declined and should be written as usual.
+type ReplyStream struct {
+	w         io.Writer
+	requestID int32
+
+	state  int
+	prefix []byte
+	// remaining is the length of the reply left to stream
+	remaining int
+	err       error
+}
+
+// NewReplyStream returns a stream of the reply to the client's request to w
+func NewReplyStream(w io.Writer, requestID int32) *ReplyStream {
+	return &ReplyStream{w: w, requestID: requestID}
+}
+
+// Write writes the bytes of the reply read from the backend. Errors writing to
+// the client are kept (see Err) rather than returned, so the backend's reply is
+// still read whole.
+func (s *ReplyStream) Write(b []byte) (int, error) {
+	n := len(b)
+	switch s.state {
+	case streamPending:
+		need := streamPrefixLen - len(s.prefix)
+		if len(b) < need {
+			s.prefix = append(s.prefix, b...)
+			return n, nil
+		}
+		s.prefix = append(s.prefix, b[:need]...)
+		b = b[need:]
+		if !s.start() {
+			s.state = streamDeclined
+			s.prefix = nil
+			return n, nil
+		}
+		s.state = streamStreaming
+		prefix := s.prefix
+		s.prefix = nil
+		s.write(prefix)
+		s.write(b)
+	case streamStreaming:
+		s.write(b)
+	}
+	return n, nil
+}
+
+// write writes the bytes of the reply (ignoring those past its end) to the client
+func (s *ReplyStream) write(b []byte) {
+	if s.state != streamStreaming || len(b) == 0 {
+		return
+	}
+	if len(b) > s.remaining {
+		b = b[:s.remaining]
+	}
+	if _, err := s.w.Write(b); err != nil {
+		s.state = streamFailed
+		s.err = err
+		return
+	}
+	s.remaining -= len(b)
+	if s.remaining == 0 {
+		s.state = streamDone
+	}
+}
+
+// start checks whether the reply (whose prefix has been read) can be streamed,
+// rewriting its header for the client
+func (s *ReplyStream) start() bool {
+	p := s.prefix
+	length := int(getInt32(p, 0))
+	if OpCode(getInt32(p, 12)) != OpMsg || getInt32(p, HeaderLen) != 0 || p[HeaderLen+4] != 0 {
+		return false
+	}
+	// The body is the only section
+	if int(getInt32(p, HeaderLen+5)) != length-HeaderLen-5 {
+		return false
+	}
+	if p[HeaderLen+9] != 0x03 || !bytes.Equal(p[HeaderLen+10:], []byte(streamFirstKey)) {
+		return false
+	}
+	setInt32(p, 4, s.requestID)
+	setInt32(p, 8, s.requestID)
+	s.remaining = length
+	return true
+}
+
+// Started returns whether the reply is being written to the client: it mustn't
+// be written again then
+func (s *ReplyStream) Started() bool {
+	return s.state == streamStreaming || s.state == streamDone || s.state == streamFailed
+}
+
+// Err returns the error of a started reply which wasn't written whole to the
+// client (whose connection can't be used anymore)
+func (s *ReplyStream) Err() error {
+	switch s.state {
+	case streamStreaming:
+		return errStreamInterrupted
+	case streamFailed:
+		return s.err
+	}
+	return nil
+}
+
+// Decline declines the reply if none of it was written yet, so it's written as
+// usual (e.g. as the backend's reply wasn't read whole)
+func (s *ReplyStream) Decline() {
+	if s.state == streamPending {
+		s.state = streamDeclined
+		s.prefix = nil
+	}
+}
@@ -0,0 +1,101 @@
+package mongowire
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write(b []byte) (int, error) { return 0, errors.New("closed") }
+
+func TestReplyStream(t *testing.T) {
+	reply := func(flags OP_MSG_Flags, d bson.D) []byte {
+		var buf bytes.Buffer
+		m := &OP_MSG{
+			Header:   MessageHeader{RequestID: 100, ResponseTo: 7, OpCode: OpMsg},
+			Flags:    flags,
+			Sections: []MSGSection{MSGSection_Body{Document: d}},
+		}
+		if err := m.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	cursor := bson.D{
+		{"cursor", bson.D{{"firstBatch", bson.A{bson.D{{"_id", 1}}}}, {"id", int64(0)}, {"ns", "db.c"}}},
+		{"ok", 1},
+	}
+
+	tests := []struct {
+		reply []byte
+		// read is the number of bytes of the reply read
+		read     int
+		streamed bool
+		err      bool
+	}{
+		{reply: reply(0, cursor), streamed: true},
+		{reply: append(reply(0, cursor), 1, 2, 3), streamed: true},
+		{reply: reply(0, bson.D{{"ok", 0}, {"errmsg", "failed"}}), streamed: false},
+		{reply: reply(0, bson.D{{"n", 1}, {"ok", 1}}), streamed: false},
+		{reply: reply(1<<16, cursor), streamed: false},
+		{reply: reply(0, cursor), read: 40, streamed: true, err: true},
+		{reply: reply(0, cursor), read: 20, streamed: false},
+	}
+	for i, test := range tests {
+		var out bytes.Buffer
+		s := NewReplyStream(&out, 42)
+		read := test.reply
+		if test.read > 0 {
+			read = read[:test.read]
+		}
+		// The reply is read in small chunks
+		for len(read) > 0 {
+			n := 5
+			if n > len(read) {
+				n = len(read)
+			}
+			if written, err := s.Write(read[:n]); err != nil || written != n {
+				t.Fatalf("%d: unexpected write %d %v", i, written, err)
+			}
+			read = read[n:]
+		}
+		s.Decline()
+
+		if s.Started() != test.streamed {
+			t.Fatalf("%d: expected streamed %v", i, test.streamed)
+		}
+		if (s.Err() != nil) != test.err {
+			t.Fatalf("%d: unexpected error %v", i, s.Err())
+		}
+		if !test.streamed {
+			if out.Len() != 0 {
+				t.Fatalf("%d: expected nothing written, got %x", i, out.Bytes())
+			}
+			continue
+		}
+		if test.err {
+			continue
+		}
+
+		// The reply is written as a reply to the client's request
+		expected := reply(0, cursor)
+		setInt32(expected, 4, 42)
+		setInt32(expected, 8, 42)
+		if !bytes.Equal(out.Bytes(), expected) {
+			t.Fatalf("%d: mismatch:\nexpected %x\ngot      %x", i, expected, out.Bytes())
+		}
+	}
+
+	// Errors writing to the client are kept
+	s := NewReplyStream(failingWriter{}, 42)
+	if _, err := s.Write(reply(0, cursor)); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Started() || s.Err() == nil {
+		t.Fatalf("expected the write error, got %v", s.Err())
+	}
+}
@@ -0,0 +1,235 @@
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// PartSize is the size of the parts of multipart uploads (S3's minimum is 5MB)
+const PartSize = 8 * 1024 * 1024
+
+// S3Config is the bucket objects are stored in, on S3 or an S3 compatible store
+// (e.g. GCS's XML API with HMAC keys, https://storage.googleapis.com)
+type S3Config struct {
+	// Bucket is the bucket objects are stored in (required)
+	Bucket string `bson:"bucket"`
+	// Region is the region of the bucket (required)
+	Region string `bson:"region"`
+	// Prefix prefixes the keys of the objects
+	Prefix string `bson:"prefix"`
+	// Endpoint is the S3 endpoint, e.g. of an S3 compatible store (default
+	// https://s3.<region>.amazonaws.com); buckets are addressed by path
+	Endpoint string `bson:"endpoint"`
+}
+
+// Load validates the config and sets its defaults
+func (c *S3Config) Load() error {
+	if c.Bucket == "" || c.Region == "" {
+		return fmt.Errorf("bucket and region are required")
+	}
+	if c.Endpoint == "" {
+		c.Endpoint = "https://s3." + c.Region + ".amazonaws.com"
+	}
+	if _, err := url.Parse(c.Endpoint); err != nil {
+		return fmt.Errorf("invalid endpoint: %w", err)
+	}
+	c.Endpoint = strings.TrimSuffix(c.Endpoint, "/")
+	return nil
+}
+
+// S3Client stores objects in S3 with requests signed with the given credentials
+type S3Client struct {
+	conf   *S3Config
+	client *http.Client
+	signer *v4.Signer
+}
+
+// NewS3Client returns a client of the bucket; nil credentials are those of the
+// environment (or shared credentials file)
+func NewS3Client(conf *S3Config, creds *credentials.Credentials) *S3Client {
+	if creds == nil {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvProvider{},
+			&credentials.SharedCredentialsProvider{},
+		})
+	}
+	return &S3Client{
+		conf:   conf,
+		client: &http.Client{},
+		signer: v4.NewSigner(creds),
+	}
+}
+
+// URL returns the s3:// URL of the object of the key
+func (c *S3Client) URL(key string) string {
+	return "s3://" + c.conf.Bucket + "/" + c.conf.Prefix + key
+}
+
+// do runs a signed request on the object of the key, returning the response's
+// headers and body
+func (c *S3Client) do(ctx context.Context, method, key string, query url.Values, body []byte, header http.Header) (http.Header, []byte, error) {
+	u := c.conf.Endpoint + "/" + c.conf.Bucket + "/" + (&url.URL{Path: c.conf.Prefix + key}).EscapedPath()
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	// The signer sets the body, S3 requires its length
+	if _, err := c.signer.Sign(req, bytes.NewReader(body), "s3", c.conf.Region, time.Now()); err != nil {
+		return nil, nil, err
+	}
+	req.ContentLength = int64(len(body))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, nil, fmt.Errorf("error on %s: %s %s: %s", c.URL(key), method, resp.Status, bytes.TrimSpace(b))
+	}
+	return resp.Header, b, nil
+}
+
+// metadataHeader returns the metadata (but empty values) as x-amz-meta- headers
+func metadataHeader(metadata map[string]string) http.Header {
+	h := http.Header{"Content-Type": {"application/octet-stream"}}
+	for k, v := range metadata {
+		if v != "" {
+			h.Set("X-Amz-Meta-"+k, v)
+		}
+	}
+	return h
+}
+
+// Put stores the object under the key, with the metadata as x-amz-meta- headers
+func (c *S3Client) Put(ctx context.Context, key string, body []byte, metadata map[string]string) error {
+	_, _, err := c.do(ctx, http.MethodPut, key, nil, body, metadataHeader(metadata))
+	return err
+}
+
+// Upload returns a writer storing the object under the key, which is uploaded in
+// parts of PartSize as it's written (or with a single Put if it's smaller)
+func (c *S3Client) Upload(key string, metadata map[string]string) *Upload {
+	return &Upload{c: c, key: key, metadata: metadata}
+}
+
+// Upload is a multipart upload of an object; it must be either closed to store
+// the object or aborted
+type Upload struct {
+	c        *S3Client
+	key      string
+	metadata map[string]string
+
+	buf      []byte
+	uploadID string
+	etags    []string
+	size     int64
+}
+
+// Size returns the bytes written
+func (u *Upload) Size() int64 { return u.size }
+
+// Write buffers the bytes, uploading a part when the buffer is full
+func (u *Upload) Write(ctx context.Context, b []byte) error {
+	u.buf = append(u.buf, b...)
+	u.size += int64(len(b))
+	if len(u.buf) < PartSize {
+		return nil
+	}
+	return u.uploadPart(ctx)
+}
+
+func (u *Upload) uploadPart(ctx context.Context) error {
+	if u.uploadID == "" {
+		_, body, err := u.c.do(ctx, http.MethodPost, u.key, url.Values{"uploads": {""}}, nil, metadataHeader(u.metadata))
+		if err != nil {
+			return err
+		}
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		if err := xml.Unmarshal(body, &result); err != nil || result.UploadID == "" {
+			return fmt.Errorf("error starting the upload of %s: invalid response %q", u.c.URL(u.key), body)
+		}
+		u.uploadID = result.UploadID
+	}
+	query := url.Values{
+		"partNumber": {strconv.Itoa(len(u.etags) + 1)},
+		"uploadId":   {u.uploadID},
+	}
+	header, _, err := u.c.do(ctx, http.MethodPut, u.key, query, u.buf, nil)
+	if err != nil {
+		return err
+	}
+	u.etags = append(u.etags, header.Get("ETag"))
+	u.buf = u.buf[:0]
+	return nil
+}
+
+// Close stores the object
+func (u *Upload) Close(ctx context.Context) error {
+	if u.uploadID == "" {
+		return u.c.Put(ctx, u.key, u.buf, u.metadata)
+	}
+	if len(u.buf) > 0 {
+		if err := u.uploadPart(ctx); err != nil {
+			return err
+		}
+	}
+
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{}
+	for i, etag := range u.etags {
+		complete.Parts = append(complete.Parts, part{PartNumber: i + 1, ETag: etag})
+	}
+	b, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	_, body, err := u.c.do(ctx, http.MethodPost, u.key, url.Values{"uploadId": {u.uploadID}}, b, nil)
+	if err != nil {
+		return err
+	}
+	// Completing may fail with a 200 response
+	if bytes.Contains(body, []byte("<Error>")) {
+		return fmt.Errorf("error completing the upload of %s: %s", u.c.URL(u.key), bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// Abort deletes the parts uploaded
+func (u *Upload) Abort(ctx context.Context) error {
+	if u.uploadID == "" {
+		return nil
+	}
+	_, _, err := u.c.do(ctx, http.MethodDelete, u.key, url.Values{"uploadId": {u.uploadID}}, nil, nil)
+	return err
+}
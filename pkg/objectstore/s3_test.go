@@ -0,0 +1,188 @@
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// fakeS3 is an S3 server storing objects and multipart uploads in memory
+type fakeS3 struct {
+	lock     sync.Mutex
+	objects  map[string][]byte
+	metadata map[string]string
+	uploads  map[string]map[int][]byte
+	requests []string
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	q := r.URL.Query()
+	s.requests = append(s.requests, r.Method+" "+r.URL.RawQuery)
+	key := r.URL.Path
+
+	switch {
+	case r.Method == http.MethodPost && q["uploads"] != nil:
+		id := strconv.Itoa(len(s.uploads) + 1)
+		s.uploads[id] = make(map[int][]byte)
+		s.metadata[key] = r.Header.Get("X-Amz-Meta-Ns")
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPut && q.Get("uploadId") != "":
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		s.uploads[q.Get("uploadId")][n] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"etag%d"`, n))
+	case r.Method == http.MethodPost && q.Get("uploadId") != "":
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var object []byte
+		for i, part := range complete.Parts {
+			if part.PartNumber != i+1 || part.ETag != fmt.Sprintf(`"etag%d"`, i+1) {
+				fmt.Fprint(w, "<Error><Code>InvalidPart</Code></Error>")
+				return
+			}
+			object = append(object, s.uploads[q.Get("uploadId")][part.PartNumber]...)
+		}
+		s.objects[key] = object
+		delete(s.uploads, q.Get("uploadId"))
+	case r.Method == http.MethodDelete:
+		delete(s.uploads, q.Get("uploadId"))
+	case r.Method == http.MethodPut:
+		s.objects[key] = body
+		s.metadata[key] = r.Header.Get("X-Amz-Meta-Ns")
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *S3Client, func()) {
+	s := &fakeS3{
+		objects:  make(map[string][]byte),
+		metadata: make(map[string]string),
+		uploads:  make(map[string]map[int][]byte),
+	}
+	server := httptest.NewServer(s)
+	conf := &S3Config{Bucket: "bucket", Region: "us-west-1", Prefix: "exports/", Endpoint: server.URL}
+	if err := conf.Load(); err != nil {
+		t.Fatal(err)
+	}
+	return s, NewS3Client(conf, credentials.NewStaticCredentials("AKID", "SECRET", "")), server.Close
+}
+
+func TestUpload(t *testing.T) {
+	s, c, stop := newFakeS3(t)
+	defer stop()
+	ctx := context.TODO()
+
+	tests := []struct {
+		writes   int
+		size     int
+		requests []string
+	}{
+		// Smaller than a part
+		{writes: 3, size: 1000, requests: []string{"PUT "}},
+		{writes: 0, size: 0, requests: []string{"PUT "}},
+		// Two full parts and the rest
+		{writes: 5, size: PartSize / 2, requests: []string{"POST uploads=", "PUT partNumber=1&uploadId=1", "PUT partNumber=2&uploadId=1", "PUT partNumber=3&uploadId=1", "POST uploadId=1"}},
+	}
+	for i, test := range tests {
+		s.requests = nil
+		key := fmt.Sprintf("db/coll/%d.bson", i)
+		u := c.Upload(key, map[string]string{"Ns": "db.coll", "User": ""})
+		var expected []byte
+		for j := 0; j < test.writes; j++ {
+			b := bytes.Repeat([]byte{byte(j)}, test.size)
+			expected = append(expected, b...)
+			if err := u.Write(ctx, b); err != nil {
+				t.Fatalf("%d: %v", i, err)
+			}
+		}
+		if err := u.Close(ctx); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if u.Size() != int64(len(expected)) {
+			t.Fatalf("%d: expected size %d, got %d", i, len(expected), u.Size())
+		}
+		object, ok := s.objects["/bucket/exports/"+key]
+		if !ok || !bytes.Equal(object, expected) {
+			t.Fatalf("%d: unexpected object of %d bytes", i, len(object))
+		}
+		if s.metadata["/bucket/exports/"+key] != "db.coll" {
+			t.Fatalf("%d: expected the metadata, got %v", i, s.metadata)
+		}
+		if strings.Join(s.requests, ",") != strings.Join(test.requests, ",") {
+			t.Fatalf("%d: expected requests %v, got %v", i, test.requests, s.requests)
+		}
+	}
+}
+
+func TestUploadAbort(t *testing.T) {
+	s, c, stop := newFakeS3(t)
+	defer stop()
+	ctx := context.TODO()
+
+	u := c.Upload("db/coll/aborted.bson", nil)
+	if err := u.Write(ctx, make([]byte, PartSize)); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.uploads) != 1 {
+		t.Fatalf("expected an upload in progress, got %v", s.uploads)
+	}
+	if err := u.Abort(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.uploads) != 0 || len(s.objects) != 0 {
+		t.Fatalf("expected the upload to be aborted, got %v %v", s.uploads, s.objects)
+	}
+
+	// Errors include the object and response
+	c.signer.Credentials = credentials.NewStaticCredentials("OTHER", "SECRET", "")
+	err := c.Put(ctx, "db/coll/denied.bson", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "s3://bucket/exports/db/coll/denied.bson") || !strings.Contains(err.Error(), "403 Forbidden: AccessDenied") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestS3ConfigLoad(t *testing.T) {
+	tests := []struct {
+		conf     S3Config
+		endpoint string
+	}{
+		{conf: S3Config{Bucket: "b", Region: "us-west-1"}, endpoint: "https://s3.us-west-1.amazonaws.com"},
+		{conf: S3Config{Bucket: "b", Region: "auto", Endpoint: "https://storage.googleapis.com/"}, endpoint: "https://storage.googleapis.com"},
+		{conf: S3Config{Bucket: "b"}},
+		{conf: S3Config{Region: "us-west-1"}},
+	}
+	for i, test := range tests {
+		err := test.conf.Load()
+		if (err == nil) != (test.endpoint != "") {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if err == nil && test.conf.Endpoint != test.endpoint {
+			t.Fatalf("%d: expected endpoint %s, got %s", i, test.endpoint, test.conf.Endpoint)
+		}
+	}
+}
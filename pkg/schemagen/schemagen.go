@@ -0,0 +1,264 @@
+// Package schemagen generates the schema plugin's collection schemas from the Go
+// structs a service stores in its collections, so the proxy's schema can be kept
+// in lockstep with the service's models. It's meant to be run from a small
+// program in the service (e.g. with go:generate):
+//
+//	g := schemagen.New()
+//	g.Add("shop", "users", User{}, schema.Collection{EnforceSchema: true})
+//	g.WriteJSON(os.Stdout)
+//
+// The fields are named by their bson tags (lowercased field names by default, as
+// the mongo driver does), skipped with bson:"-" and inlined with bson:",inline".
+// The mongoproxy tag sets the schema specific options, comma separated:
+//
+//	required        the field is required
+//	type=long       the type of the field, overriding the one of its Go type
+//	alias=name      the alias of the field
+//	enum=a|b|c      the allowed values, recorded as the "enum" annotation (the
+//	                schema plugin doesn't validate them)
+//	-               the field isn't in the schema (so it's rejected by collections
+//	                with denyUnknownFields)
+package schemagen
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins/schema"
+)
+
+// Generator builds a schema from the structs of collections
+type Generator struct {
+	schema schema.ClusterSchema
+}
+
+// New returns a Generator with an empty schema
+func New() *Generator {
+	return &Generator{schema: schema.ClusterSchema{Databases: make(map[string]schema.Database)}}
+}
+
+// Add adds the collection with the fields of the struct v (or pointer to one).
+// The other settings of the collection (e.g. EnforceSchema) are those of c.
+func (g *Generator) Add(database, collection string, v interface{}, c schema.Collection) error {
+	if strings.ToLower(database) != database || strings.ToLower(collection) != collection {
+		return fmt.Errorf("db and collection names must be lowercase: %s.%s", database, collection)
+	}
+	fields, err := Fields(reflect.TypeOf(v))
+	if err != nil {
+		return fmt.Errorf("%s.%s: %w", database, collection, err)
+	}
+	c.Fields = fields
+
+	db, ok := g.schema.Databases[database]
+	if !ok {
+		db = schema.Database{Collections: make(map[string]schema.Collection)}
+	}
+	db.Collections[collection] = c
+	g.schema.Databases[database] = db
+	return nil
+}
+
+// Schema returns the generated schema
+func (g *Generator) Schema() *schema.ClusterSchema {
+	return &g.schema
+}
+
+// WriteJSON writes the generated schema as the JSON the schema plugin loads
+func (g *Generator) WriteJSON(w io.Writer) error {
+	b, err := json.MarshalIndent(&g.schema, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	dateTimeType   = reflect.TypeOf(primitive.DateTime(0))
+	objectIDType   = reflect.TypeOf(primitive.ObjectID{})
+	binaryType     = reflect.TypeOf(primitive.Binary{})
+	decimalType    = reflect.TypeOf(primitive.Decimal128{})
+	regexType      = reflect.TypeOf(primitive.Regex{})
+	byteSliceType  = reflect.TypeOf([]byte(nil))
+	primitiveDType = reflect.TypeOf(primitive.D{})
+	primitiveMType = reflect.TypeOf(primitive.M{})
+)
+
+// arrayTypes are the types which have an array type in the schema
+var arrayTypes = map[schema.BSONType]struct{}{
+	schema.INT: {}, schema.LONG: {}, schema.DOUBLE: {}, schema.STRING: {}, schema.OBJECT: {},
+	schema.BIN_DATA: {}, schema.OBJECT_ID: {}, schema.BOOL: {}, schema.DATE: {},
+}
+
+// Fields returns the schema fields of the struct type (or pointer to one)
+func Fields(t reflect.Type) (map[string]schema.CollectionField, error) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%v is not a struct", t)
+	}
+	fields := make(map[string]schema.CollectionField)
+	if err := addFields(fields, t, map[reflect.Type]struct{}{}); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// addFields adds the fields of the struct type to fields; seen are the structs
+// being walked, as recursive types can't be expressed by subfields
+func addFields(fields map[string]schema.CollectionField, t reflect.Type, seen map[reflect.Type]struct{}) error {
+	if _, ok := seen[t]; ok {
+		return fmt.Errorf("recursive type %v", t)
+	}
+	seen[t] = struct{}{}
+	defer delete(seen, t)
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" { // unexported, which the driver skips even if inlined
+			continue
+		}
+		name, inline := bsonName(sf)
+		if name == "-" || sf.Tag.Get("mongoproxy") == "-" {
+			continue
+		}
+
+		if inline {
+			ft := sf.Type
+			for ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() != reflect.Struct {
+				return fmt.Errorf("%s: only structs can be inlined", sf.Name)
+			}
+			if err := addFields(fields, ft, seen); err != nil {
+				return err
+			}
+			continue
+		}
+
+		f, err := field(sf, seen)
+		if err != nil {
+			return fmt.Errorf("%s: %w", sf.Name, err)
+		}
+		if _, ok := fields[name]; ok {
+			return fmt.Errorf("duplicate field %s", name)
+		}
+		fields[name] = f
+	}
+	return nil
+}
+
+// bsonName returns the name of the struct field in documents and whether it's
+// inlined
+func bsonName(sf reflect.StructField) (string, bool) {
+	parts := strings.Split(sf.Tag.Get("bson"), ",")
+	name := parts[0]
+	inline := false
+	for _, opt := range parts[1:] {
+		if opt == "inline" {
+			inline = true
+		}
+	}
+	if name == "" {
+		name = strings.ToLower(sf.Name)
+	}
+	return name, inline
+}
+
+// field returns the schema field of the struct field
+func field(sf reflect.StructField, seen map[reflect.Type]struct{}) (schema.CollectionField, error) {
+	var f schema.CollectionField
+	var typeOverride string
+	for _, opt := range strings.Split(sf.Tag.Get("mongoproxy"), ",") {
+		k, v := opt, ""
+		if i := strings.IndexByte(opt, '='); i >= 0 {
+			k, v = opt[:i], opt[i+1:]
+		}
+		switch k {
+		case "":
+		case "required":
+			f.Required = true
+		case "type":
+			typeOverride = v
+		case "alias":
+			f.Name = v
+		case "enum":
+			f.Annotations = map[string]string{"enum": v}
+		default:
+			return f, fmt.Errorf("unknown mongoproxy tag option %q", k)
+		}
+	}
+
+	if typeOverride != "" {
+		f.Type = schema.BSONType(typeOverride)
+		return f, nil
+	}
+	t, subfields, err := fieldType(sf.Type, seen)
+	if err != nil {
+		return f, err
+	}
+	f.Type = t
+	f.SubFields = subfields
+	return f, nil
+}
+
+// fieldType returns the schema type of the Go type, and the subfields of structs
+func fieldType(t reflect.Type, seen map[reflect.Type]struct{}) (schema.BSONType, map[string]schema.CollectionField, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t {
+	case timeType, dateTimeType:
+		return schema.DATE, nil, nil
+	case objectIDType:
+		return schema.OBJECT_ID, nil, nil
+	case binaryType, byteSliceType:
+		return schema.BIN_DATA, nil, nil
+	case decimalType:
+		return schema.DECIMAL128, nil, nil
+	case regexType:
+		return schema.REGEX, nil, nil
+	case primitiveDType, primitiveMType:
+		return schema.OBJECT, nil, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return schema.BOOL, nil, nil
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return schema.INT, nil, nil
+	case reflect.Int, reflect.Int64, reflect.Uint32, reflect.Uint, reflect.Uint64:
+		return schema.LONG, nil, nil
+	case reflect.Float32, reflect.Float64:
+		return schema.DOUBLE, nil, nil
+	case reflect.String:
+		return schema.STRING, nil, nil
+	case reflect.Map:
+		return schema.OBJECT, nil, nil
+	case reflect.Struct:
+		subfields := make(map[string]schema.CollectionField)
+		if err := addFields(subfields, t, seen); err != nil {
+			return "", nil, err
+		}
+		return schema.OBJECT, subfields, nil
+	case reflect.Slice, reflect.Array:
+		elem, subfields, err := fieldType(t.Elem(), seen)
+		if err != nil {
+			return "", nil, err
+		}
+		if _, ok := arrayTypes[elem]; !ok {
+			return "", nil, fmt.Errorf("arrays of %s aren't supported by the schema", elem)
+		}
+		return "[]" + elem, subfields, nil
+	}
+	return "", nil, fmt.Errorf("unsupported type %v (set its type with the mongoproxy tag)", t)
+}
@@ -0,0 +1,146 @@
+package schemagen
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins/schema"
+)
+
+type Base struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	CreatedAt time.Time          `bson:"created_at" mongoproxy:"required"`
+}
+
+type address struct {
+	City string `bson:"city" mongoproxy:"required"`
+	Zip  *string
+}
+
+type user struct {
+	Base      `bson:",inline"`
+	Name      string            `bson:"name" mongoproxy:"required,alias=n"`
+	Age       int32             `bson:"age,omitempty"`
+	Score     float64           `bson:"score"`
+	Status    string            `bson:"status" mongoproxy:"enum=active|banned"`
+	Tags      []string          `bson:"tags"`
+	Addresses []address         `bson:"addresses"`
+	Home      *address          `bson:"home"`
+	Extra     map[string]string `bson:"extra"`
+	Avatar    []byte            `bson:"avatar"`
+	Counter   int               `bson:"counter" mongoproxy:"type=int"`
+	Ignored   string            `bson:"-"`
+	Internal  string            `bson:"internal" mongoproxy:"-"`
+	private   string
+}
+
+type node struct {
+	Children []node `bson:"children"`
+}
+
+func TestFields(t *testing.T) {
+	addressFields := map[string]schema.CollectionField{
+		"city": {Type: schema.STRING, Required: true},
+		"zip":  {Type: schema.STRING},
+	}
+	expected := map[string]schema.CollectionField{
+		"_id":        {Type: schema.OBJECT_ID},
+		"created_at": {Type: schema.DATE, Required: true},
+		"name":       {Type: schema.STRING, Required: true, Name: "n"},
+		"age":        {Type: schema.INT},
+		"score":      {Type: schema.DOUBLE},
+		"status":     {Type: schema.STRING, Annotations: map[string]string{"enum": "active|banned"}},
+		"tags":       {Type: schema.STRING_ARRAY},
+		"addresses":  {Type: schema.OBJECT_ARRAY, SubFields: addressFields},
+		"home":       {Type: schema.OBJECT, SubFields: addressFields},
+		"extra":      {Type: schema.OBJECT},
+		"avatar":     {Type: schema.BIN_DATA},
+		"counter":    {Type: schema.INT},
+	}
+	fields, err := Fields(reflect.TypeOf(&user{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Fatalf("mismatch\nexpected=%+v\nactual=%+v", expected, fields)
+	}
+
+	errTests := []struct {
+		v   interface{}
+		err string
+	}{
+		{"", "string is not a struct"},
+		{node{}, "recursive type"},
+		{struct{ V interface{} }{}, "unsupported type"},
+		{struct{ V [][]int }{}, "arrays of []long aren't supported"},
+		{struct {
+			V int `mongoproxy:"requird"`
+		}{}, `unknown mongoproxy tag option "requird"`},
+		{struct {
+			A int `bson:"a"`
+			B int `bson:"a"`
+		}{}, "duplicate field a"},
+	}
+	for _, test := range errTests {
+		if _, err := Fields(reflect.TypeOf(test.v)); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%T: expected error %q, got %v", test.v, test.err, err)
+		}
+	}
+}
+
+func TestGenerator(t *testing.T) {
+	g := New()
+	if err := g.Add("shop", "users", user{}, schema.Collection{EnforceSchema: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Add("shop", "Users", user{}, schema.Collection{}); err == nil {
+		t.Fatal("expected an error for an uppercase collection")
+	}
+	var buf bytes.Buffer
+	if err := g.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The output loads as a schema which validates the struct's documents
+	var s schema.ClusterSchema
+	if err := json.Unmarshal(buf.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if errs := s.Lint(); len(errs) > 0 {
+		t.Fatalf("unexpected lint errors: %v", errs)
+	}
+	c := s.Databases["shop"].Collections["users"]
+	if !c.EnforceSchema || !c.Fields["tags"].IsArray {
+		t.Fatalf("unexpected collection: %+v", c)
+	}
+	zip := "10001"
+	home := address{City: "nyc", Zip: &zip}
+	b, err := bson.Marshal(user{
+		Base:      Base{ID: primitive.NewObjectID(), CreatedAt: time.Now()},
+		Name:      "a",
+		Status:    "active",
+		Tags:      []string{"x"},
+		Addresses: []address{home},
+		Home:      &home,
+		Extra:     map[string]string{"k": "v"},
+		Avatar:    []byte("x"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ValidateInsert(context.Background(), doc); err != nil {
+		t.Fatalf("the struct's document doesn't validate: %v", err)
+	}
+}